@@ -0,0 +1,620 @@
+package main
+
+import (
+	"bufio"
+	crand "crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/misachi/DarDB/sql"
+	"github.com/misachi/DarDB/storage/db"
+)
+
+/* errTerminate ends a connection the client closed with Terminate */
+var errTerminate = errors.New("terminate")
+
+/* fatalError is an error that ends the connection once reported */
+type fatalError struct {
+	err *sql.Error
+}
+
+func (e *fatalError) Error() string {
+	return e.err.Error()
+}
+
+/* parameters are the settings reported to the client after the startup, as PostgreSQL reports them */
+var parameters = [][2]string{
+	{"server_version", "16.0 (DarDB)"},
+	{"server_encoding", "UTF8"},
+	{"client_encoding", "UTF8"},
+	{"DateStyle", "ISO, MDY"},
+	{"TimeZone", "UTC"},
+	{"integer_datetimes", "on"},
+	{"standard_conforming_strings", "on"},
+}
+
+/* statement is a statement prepared with Parse. ps is nil for an empty query */
+type statement struct {
+	ps   *sql.PreparedStmt
+	oids []int // Types of the parameters
+}
+
+/* portal is a statement bound to its parameters by Bind, run by Execute */
+type portal struct {
+	stmt    *statement
+	args    []sql.Value
+	formats []int       // Format of each result column
+	result  *sql.Result // Set once the statement ran
+	rows    []sql.Row   // Rows of the result not sent yet
+}
+
+/*
+conn serves a client connection. The client gets a ClientContext and a Session of its own, so
+statements commit as they do in the shell. Statements and portals of the extended protocol live
+until closed, except portals, which go at the end of the transaction.
+*/
+type conn struct {
+	srv      *server
+	nc       net.Conn
+	in       *bufio.Reader
+	out      *writer
+	ctx      *db.ClientContext
+	session  *sql.Session
+	secret   int
+	stmts    map[string]*statement
+	portals  map[string]*portal
+	skipping bool // An extended query message failed, so messages are ignored until Sync
+}
+
+func newConn(srv *server, nc net.Conn) *conn {
+	return &conn{
+		srv:     srv,
+		nc:      nc,
+		in:      bufio.NewReader(nc),
+		out:     &writer{w: bufio.NewWriter(nc)},
+		stmts:   make(map[string]*statement),
+		portals: make(map[string]*portal),
+	}
+}
+
+/* serve runs the connection until the client leaves or an error ends it */
+func (c *conn) serve() {
+	defer c.close()
+	err := c.startup()
+	for err == nil {
+		var typ byte
+		var msg *message
+		if typ, msg, err = readMessage(c.in); err == nil {
+			err = c.handle(typ, msg)
+		}
+	}
+	var fatalErr *fatalError
+	switch {
+	case errors.As(err, &fatalErr):
+		c.sendError(fatalErr.err, "FATAL")
+		c.out.flush()
+	case err != errTerminate && err != io.EOF && !errors.Is(err, net.ErrClosed):
+		slog.Warn("dardbd: connection ended", "remote", c.nc.RemoteAddr(), "err", err)
+	}
+}
+
+func (c *conn) close() {
+	for _, stmt := range c.stmts {
+		if stmt.ps != nil {
+			stmt.ps.Close()
+		}
+	}
+	if c.ctx != nil {
+		db.GetClientContextMgr(c.srv.cfg).CloseClientCtx(c.ctx)
+	}
+	c.nc.Close()
+}
+
+/* startup answers requests for encryption, which are turned down, then takes the startup message and logs the client in */
+func (c *conn) startup() error {
+	for {
+		msg, err := readStartup(c.in)
+		if err != nil {
+			return err
+		}
+		code := msg.int32()
+		switch {
+		case code == SSL_REQUEST_CODE || code == GSSENC_REQUEST_CODE:
+			if _, err := c.nc.Write([]byte{'N'}); err != nil {
+				return err
+			}
+			continue
+		case code == CANCEL_REQUEST_CODE:
+			// Statements cannot be cancelled, so the request is dropped as one for an unknown backend would be
+			return errTerminate
+		case code>>16 != PROTOCOL_VERSION>>16:
+			return fatal(sql.SQLSTATE_FEATURE_UNSUPPORTED, "unsupported frontend protocol %d.%d: server supports 3.0", code>>16, code&0xffff)
+		}
+		params := make(map[string]string)
+		var unknown []string
+		for {
+			name := msg.string()
+			if name == "" || msg.err != nil {
+				break
+			}
+			params[name] = msg.string()
+			if strings.HasPrefix(name, "_pq_.") {
+				unknown = append(unknown, name)
+			}
+		}
+		if msg.err != nil {
+			return fatal(sql.SQLSTATE_PROTOCOL_VIOLATION, "invalid startup packet layout")
+		}
+		if code != PROTOCOL_VERSION || len(unknown) > 0 {
+			c.negotiate(unknown)
+		}
+		return c.login(params)
+	}
+}
+
+/* negotiate tells a client asking for a newer minor version or protocol options that the server speaks 3.0 without them */
+func (c *conn) negotiate(unknown []string) {
+	c.out.begin('v')
+	c.out.int32(0)
+	c.out.int32(len(unknown))
+	for _, name := range unknown {
+		c.out.string(name)
+	}
+	c.out.end()
+}
+
+/* login checks the database asked for and opens a client context. There is no authentication: every user is trusted */
+func (c *conn) login(params map[string]string) error {
+	user := params["user"]
+	if user == "" {
+		return fatal(sql.SQLSTATE_PROTOCOL_VIOLATION, "no PostgreSQL user name specified in startup packet")
+	}
+	database := params["database"]
+	if database == "" {
+		database = user
+	}
+	if database != c.srv.name {
+		return fatal(sql.SQLSTATE_INVALID_CATALOG_NAME, "database %q does not exist", database)
+	}
+	c.ctx = db.GetClientContextMgr(c.srv.cfg).NewClientCtx(c.srv.cfg, c.srv.db)
+	c.session = sql.NewSession(c.srv.db, c.ctx)
+	var secret [4]byte
+	crand.Read(secret[:])
+	c.secret = int(binary.BigEndian.Uint32(secret[:]))
+
+	c.out.begin('R')
+	c.out.int32(0)
+	c.out.end()
+	for _, p := range parameters {
+		value := p[1]
+		if p[0] == "client_encoding" && params["client_encoding"] != "" {
+			value = params["client_encoding"]
+		}
+		c.parameterStatus(p[0], value)
+	}
+	if name, ok := params["application_name"]; ok {
+		c.parameterStatus("application_name", name)
+	}
+	c.out.begin('K')
+	c.out.int32(int(c.ctx.ID()))
+	c.out.int32(c.secret)
+	c.out.end()
+	return c.ready()
+}
+
+func (c *conn) parameterStatus(name, value string) {
+	c.out.begin('S')
+	c.out.string(name)
+	c.out.string(value)
+	c.out.end()
+}
+
+/* handle answers a message. Errors of a statement are sent to the client; the error returned ends the connection */
+func (c *conn) handle(typ byte, msg *message) error {
+	var err error
+	switch typ {
+	case 'Q':
+		query := msg.string()
+		if msg.err != nil {
+			return fatal(sql.SQLSTATE_PROTOCOL_VIOLATION, "invalid Query message")
+		}
+		c.query(query)
+		return c.ready()
+	case 'S':
+		c.skipping = false
+		if inBlock, _ := c.session.InTransaction(); !inBlock {
+			c.portals = make(map[string]*portal)
+		}
+		return c.ready()
+	case 'H':
+		return c.out.flush()
+	case 'X':
+		return errTerminate
+	case 'P', 'B', 'D', 'E', 'C':
+		if c.skipping {
+			return nil
+		}
+		switch typ {
+		case 'P':
+			err = c.parse(msg)
+		case 'B':
+			err = c.bind(msg)
+		case 'D':
+			err = c.describe(msg)
+		case 'E':
+			err = c.execute(msg)
+		case 'C':
+			err = c.closeMessage(msg)
+		}
+	default:
+		return fatal(sql.SQLSTATE_PROTOCOL_VIOLATION, "invalid frontend message type %d", typ)
+	}
+	var fatalErr *fatalError
+	switch {
+	case msg.err != nil:
+		return fatal(sql.SQLSTATE_PROTOCOL_VIOLATION, "invalid message format")
+	case errors.As(err, &fatalErr):
+		return err
+	case err != nil:
+		c.sendError(err, "ERROR")
+		c.skipping = true
+	}
+	return nil
+}
+
+/* query runs the statements of a Query message, stopping at the first that fails */
+func (c *conn) query(query string) {
+	stmts, err := sql.ParseAll(query)
+	if err != nil {
+		c.sendError(err, "ERROR")
+		return
+	}
+	if len(stmts) == 0 {
+		c.out.begin('I')
+		c.out.end()
+		return
+	}
+	for _, stmt := range stmts {
+		r, err := c.session.ExecStmt(stmt)
+		if err != nil {
+			c.sendError(err, "ERROR")
+			return
+		}
+		if len(r.Columns) > 0 {
+			c.rowDescription(r.Columns, nil)
+		}
+		c.dataRows(r.Columns, r.Rows, nil)
+		c.commandComplete(r.Tag)
+	}
+}
+
+/* parse prepares the statement of a Parse message */
+func (c *conn) parse(msg *message) error {
+	name, query := msg.string(), msg.string()
+	oids := make([]int, msg.int16())
+	for i := range oids {
+		oids[i] = msg.int32()
+	}
+	if msg.err != nil {
+		return nil
+	}
+	if _, ok := c.stmts[name]; ok && name != "" {
+		return pgError(sql.SQLSTATE_DUPLICATE_PSTATEMENT, "prepared statement %q already exists", name)
+	}
+	kinds := make([]sql.Kind, len(oids))
+	for i, oid := range oids {
+		kind, ok := oidKind(oid)
+		if !ok {
+			return pgError(sql.SQLSTATE_UNDEFINED_OBJECT, "type with OID %d is not supported", oid)
+		}
+		kinds[i] = kind
+	}
+
+	stmts, err := sql.ParseAll(query)
+	if err != nil {
+		return err
+	}
+	stmt := &statement{}
+	switch len(stmts) {
+	case 0:
+	case 1:
+		if stmt.ps, err = sql.Prepare(c.ctx, query, kinds...); err != nil {
+			return err
+		}
+		stmt.oids = make([]int, len(stmt.ps.ParamTypes()))
+		for i, kind := range stmt.ps.ParamTypes() {
+			if i < len(oids) && oids[i] != 0 {
+				stmt.oids[i] = oids[i]
+			} else {
+				stmt.oids[i] = kindOID(kind)
+			}
+		}
+	default:
+		return pgError(sql.SQLSTATE_SYNTAX_ERROR, "cannot insert multiple commands into a prepared statement")
+	}
+	c.closeStatement(name)
+	c.stmts[name] = stmt
+	c.out.begin('1')
+	return c.out.end()
+}
+
+/* bind makes a portal of a prepared statement and the parameters of a Bind message */
+func (c *conn) bind(msg *message) error {
+	name, stmtName := msg.string(), msg.string()
+	formats := make([]int, msg.int16())
+	for i := range formats {
+		formats[i] = msg.int16()
+	}
+	values := make([][]byte, msg.int16())
+	for i := range values {
+		if size := msg.int32(); size >= 0 {
+			values[i] = msg.take(size)
+		}
+	}
+	resultFormats := make([]int, msg.int16())
+	for i := range resultFormats {
+		resultFormats[i] = msg.int16()
+	}
+	if msg.err != nil {
+		return nil
+	}
+
+	stmt, ok := c.stmts[stmtName]
+	if !ok {
+		return pgError(sql.SQLSTATE_INVALID_STATEMENT_NAME, "prepared statement %q does not exist", stmtName)
+	}
+	if _, ok := c.portals[name]; ok && name != "" {
+		return pgError(sql.SQLSTATE_DUPLICATE_CURSOR, "portal %q already exists", name)
+	}
+	if len(values) != len(stmt.oids) {
+		return pgError(sql.SQLSTATE_PROTOCOL_VIOLATION, "bind message supplies %d parameters, but prepared statement %q requires %d", len(values), stmtName, len(stmt.oids))
+	}
+	paramFormats, err := expandFormats(formats, len(values), "parameter")
+	if err != nil {
+		return err
+	}
+	p := &portal{stmt: stmt, args: make([]sql.Value, len(values))}
+	for i, data := range values {
+		if p.args[i], err = decodeParam(data, stmt.oids[i], paramFormats[i]); err != nil {
+			return err
+		}
+	}
+	if stmt.ps != nil {
+		if p.formats, err = expandFormats(resultFormats, len(stmt.ps.Columns()), "result"); err != nil {
+			return err
+		}
+	}
+	c.portals[name] = p
+	c.out.begin('2')
+	return c.out.end()
+}
+
+/* expandFormats gives each of n values its format: none means text, one applies to all */
+func expandFormats(formats []int, n int, what string) ([]int, error) {
+	expanded := make([]int, n)
+	switch len(formats) {
+	case 0:
+		return expanded, nil
+	case 1:
+		for i := range expanded {
+			expanded[i] = formats[0]
+		}
+	case n:
+		copy(expanded, formats)
+	default:
+		return nil, pgError(sql.SQLSTATE_PROTOCOL_VIOLATION, "bind message has %d %s formats but %d %ss", len(formats), what, n, what)
+	}
+	for _, format := range expanded {
+		if format != FORMAT_TEXT && format != FORMAT_BINARY {
+			return nil, pgError(sql.SQLSTATE_PROTOCOL_VIOLATION, "unsupported format code: %d", format)
+		}
+	}
+	return expanded, nil
+}
+
+/* describe answers a Describe message with the parameters of a statement and the columns it returns, or the columns of a portal */
+func (c *conn) describe(msg *message) error {
+	kind, name := msg.byte(), msg.string()
+	if msg.err != nil {
+		return nil
+	}
+	switch kind {
+	case 'S':
+		stmt, ok := c.stmts[name]
+		if !ok {
+			return pgError(sql.SQLSTATE_INVALID_STATEMENT_NAME, "prepared statement %q does not exist", name)
+		}
+		c.out.begin('t')
+		c.out.int16(len(stmt.oids))
+		for _, oid := range stmt.oids {
+			c.out.int32(oid)
+		}
+		c.out.end()
+		c.columns(stmt, nil)
+	case 'P':
+		p, ok := c.portals[name]
+		if !ok {
+			return pgError(sql.SQLSTATE_INVALID_CURSOR_NAME, "portal %q does not exist", name)
+		}
+		c.columns(p.stmt, p.formats)
+	default:
+		return fatal(sql.SQLSTATE_PROTOCOL_VIOLATION, "invalid DESCRIBE message subtype %d", kind)
+	}
+	return nil
+}
+
+/* columns sends the RowDescription of the rows stmt returns, or NoData */
+func (c *conn) columns(stmt *statement, formats []int) {
+	if stmt.ps == nil || len(stmt.ps.Columns()) == 0 {
+		c.out.begin('n')
+		c.out.end()
+		return
+	}
+	c.rowDescription(stmt.ps.Columns(), formats)
+}
+
+/* execute runs a portal, sending at most maxRows rows of its result if maxRows is positive. The rest wait for the next Execute */
+func (c *conn) execute(msg *message) error {
+	name, maxRows := msg.string(), msg.int32()
+	if msg.err != nil {
+		return nil
+	}
+	p, ok := c.portals[name]
+	if !ok {
+		return pgError(sql.SQLSTATE_INVALID_CURSOR_NAME, "portal %q does not exist", name)
+	}
+	if p.stmt.ps == nil {
+		c.out.begin('I')
+		return c.out.end()
+	}
+	suspended := p.result != nil
+	if p.result == nil {
+		r, err := c.session.ExecPrepared(p.stmt.ps, p.args...)
+		if err != nil {
+			return err
+		}
+		p.result, p.rows = r, r.Rows
+	}
+	rows := p.rows
+	if maxRows > 0 && maxRows < len(rows) {
+		rows = rows[:maxRows]
+	}
+	c.dataRows(p.result.Columns, rows, p.formats)
+	p.rows = p.rows[len(rows):]
+	switch {
+	case len(p.rows) > 0:
+		c.out.begin('s')
+		return c.out.end()
+	case suspended && len(p.result.Columns) > 0:
+		// Rows fetched in parts are counted by the Execute that sends them
+		c.commandComplete("SELECT " + strconv.Itoa(len(rows)))
+	default:
+		c.commandComplete(p.result.Tag)
+	}
+	return nil
+}
+
+/* closeMessage closes the statement or portal a Close message names. Closing one that does not exist is not an error */
+func (c *conn) closeMessage(msg *message) error {
+	kind, name := msg.byte(), msg.string()
+	if msg.err != nil {
+		return nil
+	}
+	switch kind {
+	case 'S':
+		c.closeStatement(name)
+	case 'P':
+		delete(c.portals, name)
+	default:
+		return fatal(sql.SQLSTATE_PROTOCOL_VIOLATION, "invalid CLOSE message subtype %d", kind)
+	}
+	c.out.begin('3')
+	return c.out.end()
+}
+
+func (c *conn) closeStatement(name string) {
+	if stmt, ok := c.stmts[name]; ok {
+		if stmt.ps != nil {
+			stmt.ps.Close()
+		}
+		delete(c.stmts, name)
+	}
+}
+
+func (c *conn) rowDescription(columns []sql.ResultColumn, formats []int) {
+	c.out.begin('T')
+	c.out.int16(len(columns))
+	for i, col := range columns {
+		oid := kindOID(col.Kind)
+		c.out.string(col.Name)
+		c.out.int32(0)
+		c.out.int16(0)
+		c.out.int32(oid)
+		c.out.int16(typeSize(oid))
+		c.out.int32(-1)
+		c.out.int16(format(formats, i))
+	}
+	c.out.end()
+}
+
+func (c *conn) dataRows(columns []sql.ResultColumn, rows []sql.Row, formats []int) {
+	for _, row := range rows {
+		c.out.begin('D')
+		c.out.int16(len(row))
+		for i, v := range row {
+			data := encodeValue(v, kindOID(columns[i].Kind), format(formats, i))
+			if data == nil {
+				c.out.int32(-1)
+				continue
+			}
+			c.out.int32(len(data))
+			c.out.bytes(data)
+		}
+		c.out.end()
+	}
+}
+
+func format(formats []int, i int) int {
+	if i < len(formats) {
+		return formats[i]
+	}
+	return FORMAT_TEXT
+}
+
+func (c *conn) commandComplete(tag string) {
+	c.out.begin('C')
+	c.out.string(tag)
+	c.out.end()
+}
+
+/* ready sends ReadyForQuery with the state of the transaction and flushes what was written */
+func (c *conn) ready() error {
+	status := byte('I')
+	switch inBlock, failed := c.session.InTransaction(); {
+	case failed:
+		status = 'E'
+	case inBlock:
+		status = 'T'
+	}
+	c.out.begin('Z')
+	c.out.bytes([]byte{status})
+	c.out.end()
+	return c.out.flush()
+}
+
+/* sendError sends an ErrorResponse with the SQLSTATE of err, and its position in the query if it has one */
+func (c *conn) sendError(err error, severity string) {
+	code, msg, pos := sql.SQLSTATE_INTERNAL_ERROR, err.Error(), -1
+	var sqlErr *sql.Error
+	if errors.As(err, &sqlErr) {
+		code, msg, pos = sqlErr.Code, sqlErr.Msg, sqlErr.Pos
+	}
+	c.out.begin('E')
+	for _, field := range []struct {
+		typ   byte
+		value string
+	}{{'S', severity}, {'V', severity}, {'C', code}, {'M', msg}} {
+		c.out.bytes([]byte{field.typ})
+		c.out.string(field.value)
+	}
+	if pos >= 0 {
+		c.out.bytes([]byte{'P'})
+		c.out.string(strconv.Itoa(pos + 1))
+	}
+	c.out.bytes([]byte{0})
+	c.out.end()
+}
+
+func pgError(code, format string, args ...any) *sql.Error {
+	return &sql.Error{Code: code, Msg: fmt.Sprintf(format, args...), Pos: -1}
+}
+
+func fatal(code, format string, args ...any) *fatalError {
+	return &fatalError{pgError(code, format, args...)}
+}
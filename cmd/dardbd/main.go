@@ -0,0 +1,101 @@
+/*
+dardbd serves a DarDB database to PostgreSQL clients such as psql and pgx, speaking version 3.0
+of the PostgreSQL frontend/backend protocol over TCP and a Unix socket. Clients are not
+authenticated and connections are not encrypted, so listen only where clients are trusted.
+
+	dardbd [-D datadir] [-d dbname] [-h host] [-p port] [-k socketdir]
+*/
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"syscall"
+
+	"github.com/misachi/DarDB/config"
+	"github.com/misachi/DarDB/storage/db"
+)
+
+func main() {
+	dataDir := flag.String("D", "/tmp/DarDB", "data directory")
+	name := flag.String("d", "myDB", "database to serve, which clients connect to by name")
+	host := flag.String("h", "localhost", "`host` to listen on for TCP connections, empty for none")
+	port := flag.Int("p", 5432, "`port` to listen on, which also names the Unix socket")
+	socketDir := flag.String("k", "/tmp", "`directory` of the Unix socket, empty for none")
+	flag.Parse()
+
+	cfg := config.NewConfig(*dataDir, 0, 0)
+	database := db.NewDB(*name, cfg)
+	if database == nil {
+		fmt.Fprintf(os.Stderr, "dardbd: unable to open database %s in %s\n", *name, *dataDir)
+		os.Exit(2)
+	}
+	srv := newServer(cfg, database, *name)
+
+	var listeners []net.Listener
+	if *host != "" {
+		l, err := net.Listen("tcp", net.JoinHostPort(*host, strconv.Itoa(*port)))
+		if err != nil {
+			fail(err)
+		}
+		listeners = append(listeners, l)
+	}
+	if *socketDir != "" {
+		l, err := listenUnix(filepath.Join(*socketDir, fmt.Sprintf(".s.PGSQL.%d", *port)))
+		if err != nil {
+			fail(err)
+		}
+		listeners = append(listeners, l)
+	}
+	if len(listeners) == 0 {
+		fail(fmt.Errorf("no host or socket directory to listen on"))
+	}
+
+	workers := db.StartBgWorkers(cfg)
+	errs := make(chan error, len(listeners))
+	for _, l := range listeners {
+		slog.Info("dardbd: listening", "network", l.Addr().Network(), "addr", l.Addr().String(), "database", *name)
+		go func(l net.Listener) { errs <- srv.serve(l) }(l)
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	status := 0
+	select {
+	case sig := <-signals:
+		slog.Info("dardbd: shutting down", "signal", sig)
+	case err := <-errs:
+		slog.Error("dardbd: unable to accept connections", "err", err)
+		status = 1
+	}
+	srv.close()
+	if err := workers.Stop(); err != nil {
+		slog.Error("dardbd: final checkpoint failed", "err", err)
+		status = 1
+	}
+	os.Exit(status)
+}
+
+/* listenUnix listens on the socket at path, replacing a socket left by a server that is no longer running */
+func listenUnix(path string) (net.Listener, error) {
+	if _, err := os.Stat(path); err == nil {
+		if nc, err := net.Dial("unix", path); err == nil {
+			nc.Close()
+			return nil, fmt.Errorf("socket %s is in use by another server", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	return net.Listen("unix", path)
+}
+
+func fail(err error) {
+	fmt.Fprintf(os.Stderr, "dardbd: %v\n", err)
+	os.Exit(2)
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/misachi/DarDB/sql"
+)
+
+/* Codes a startup packet opens with: the protocol version, or a request made before the startup */
+const (
+	PROTOCOL_VERSION    = 3 << 16
+	CANCEL_REQUEST_CODE = 80877102
+	SSL_REQUEST_CODE    = 80877103
+	GSSENC_REQUEST_CODE = 80877104
+)
+
+/* Largest messages read; a longer length is taken as a broken client */
+const (
+	MAX_STARTUP_SIZE = 10000
+	MAX_MESSAGE_SIZE = 1 << 30
+)
+
+/* OIDs of the PostgreSQL types values are described and sent as */
+const (
+	OID_BOOL    = 16
+	OID_INT8    = 20
+	OID_INT2    = 21
+	OID_INT4    = 23
+	OID_TEXT    = 25
+	OID_FLOAT4  = 700
+	OID_FLOAT8  = 701
+	OID_UNKNOWN = 705
+	OID_BPCHAR  = 1042
+	OID_VARCHAR = 1043
+	OID_NUMERIC = 1700
+)
+
+/* Formats of parameter and result values */
+const (
+	FORMAT_TEXT   = 0
+	FORMAT_BINARY = 1
+)
+
+/* errMalformed is a message too short for what it says it holds */
+var errMalformed = errors.New("invalid message format")
+
+/* readStartup reads a startup packet, which has no type byte */
+func readStartup(r *bufio.Reader) (*message, error) {
+	var head [4]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return nil, err
+	}
+	size := int(binary.BigEndian.Uint32(head[:]))
+	if size < 8 || size > MAX_STARTUP_SIZE {
+		return nil, fmt.Errorf("invalid length of startup packet: %d", size)
+	}
+	data := make([]byte, size-4)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	return &message{data: data}, nil
+}
+
+/* readMessage reads a message: its type byte, then its length and body */
+func readMessage(r *bufio.Reader) (byte, *message, error) {
+	var head [5]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return 0, nil, err
+	}
+	size := int(binary.BigEndian.Uint32(head[1:]))
+	if size < 4 || size > MAX_MESSAGE_SIZE {
+		return 0, nil, fmt.Errorf("invalid message length %d", size)
+	}
+	data := make([]byte, size-4)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return 0, nil, err
+	}
+	return head[0], &message{data: data}, nil
+}
+
+/* message is the body of a message read field by field. A field past the end sets err and reads as zero */
+type message struct {
+	data []byte
+	err  error
+}
+
+func (m *message) take(n int) []byte {
+	if m.err != nil || n < 0 || n > len(m.data) {
+		m.err = errMalformed
+		return nil
+	}
+	b := m.data[:n]
+	m.data = m.data[n:]
+	return b
+}
+
+func (m *message) byte() byte {
+	if b := m.take(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (m *message) int16() int {
+	if b := m.take(2); b != nil {
+		return int(int16(binary.BigEndian.Uint16(b)))
+	}
+	return 0
+}
+
+func (m *message) int32() int {
+	if b := m.take(4); b != nil {
+		return int(int32(binary.BigEndian.Uint32(b)))
+	}
+	return 0
+}
+
+func (m *message) string() string {
+	i := -1
+	if m.err == nil {
+		i = strings.IndexByte(string(m.data), 0)
+	}
+	if i < 0 {
+		m.err = errMalformed
+		return ""
+	}
+	s := string(m.data[:i])
+	m.data = m.data[i+1:]
+	return s
+}
+
+/* writer builds messages and buffers them until flushed */
+type writer struct {
+	w   *bufio.Writer
+	buf []byte
+}
+
+/* begin starts a message of type typ; end writes it out */
+func (w *writer) begin(typ byte) {
+	w.buf = append(w.buf[:0], typ, 0, 0, 0, 0)
+}
+
+func (w *writer) int16(v int) {
+	w.buf = binary.BigEndian.AppendUint16(w.buf, uint16(v))
+}
+
+func (w *writer) int32(v int) {
+	w.buf = binary.BigEndian.AppendUint32(w.buf, uint32(v))
+}
+
+func (w *writer) string(s string) {
+	w.buf = append(append(w.buf, s...), 0)
+}
+
+func (w *writer) bytes(b []byte) {
+	w.buf = append(w.buf, b...)
+}
+
+func (w *writer) end() error {
+	binary.BigEndian.PutUint32(w.buf[1:5], uint32(len(w.buf)-1))
+	_, err := w.w.Write(w.buf)
+	return err
+}
+
+func (w *writer) flush() error {
+	return w.w.Flush()
+}
+
+/* kindOID is the type a value of kind is described as. Unsigned integers may not fit a bigint, so they are numeric */
+func kindOID(kind sql.Kind) int {
+	switch kind {
+	case sql.KIND_BOOL:
+		return OID_BOOL
+	case sql.KIND_INT:
+		return OID_INT8
+	case sql.KIND_UINT:
+		return OID_NUMERIC
+	case sql.KIND_FLOAT:
+		return OID_FLOAT8
+	}
+	return OID_TEXT
+}
+
+/* oidKind is the kind of a parameter the client declared of type oid. Zero leaves the kind to the statement */
+func oidKind(oid int) (sql.Kind, bool) {
+	switch oid {
+	case 0, OID_UNKNOWN, OID_NUMERIC:
+		return sql.KIND_NULL, true
+	case OID_BOOL:
+		return sql.KIND_BOOL, true
+	case OID_INT2, OID_INT4, OID_INT8:
+		return sql.KIND_INT, true
+	case OID_FLOAT4, OID_FLOAT8:
+		return sql.KIND_FLOAT, true
+	case OID_TEXT, OID_VARCHAR, OID_BPCHAR:
+		return sql.KIND_STRING, true
+	}
+	return sql.KIND_NULL, false
+}
+
+/* typeSize is the size a RowDescription gives for values of type oid, -1 for those of varying size */
+func typeSize(oid int) int {
+	switch oid {
+	case OID_BOOL:
+		return 1
+	case OID_INT2:
+		return 2
+	case OID_INT4, OID_FLOAT4:
+		return 4
+	case OID_INT8, OID_FLOAT8:
+		return 8
+	}
+	return -1
+}
+
+/* encodeValue writes v as a value of type oid in format. It returns nil for NULL */
+func encodeValue(v sql.Value, oid, format int) []byte {
+	if v.IsNull() {
+		return nil
+	}
+	if format == FORMAT_BINARY {
+		switch {
+		case oid == OID_BOOL && v.Kind == sql.KIND_BOOL:
+			if v.B {
+				return []byte{1}
+			}
+			return []byte{0}
+		case oid == OID_INT8 && v.Kind == sql.KIND_INT:
+			return binary.BigEndian.AppendUint64(nil, uint64(v.I))
+		case oid == OID_FLOAT8 && v.Kind == sql.KIND_FLOAT:
+			return binary.BigEndian.AppendUint64(nil, math.Float64bits(v.F))
+		case oid == OID_NUMERIC && v.Kind == sql.KIND_UINT:
+			return encodeNumeric(v.U)
+		}
+	}
+	if v.Kind == sql.KIND_FLOAT {
+		switch {
+		case math.IsNaN(v.F):
+			return []byte("NaN")
+		case math.IsInf(v.F, 1):
+			return []byte("Infinity")
+		case math.IsInf(v.F, -1):
+			return []byte("-Infinity")
+		}
+	}
+	return []byte(v.String())
+}
+
+/* decodeParam reads a parameter value sent as type oid in format. Text is left for the statement to read as the kind of its parameter */
+func decodeParam(data []byte, oid, format int) (sql.Value, error) {
+	if data == nil {
+		return sql.Null(), nil
+	}
+	if format == FORMAT_TEXT {
+		return sql.String(string(data)), nil
+	}
+	size := typeSize(oid)
+	if size > 0 && len(data) != size {
+		return sql.Null(), &sql.Error{Code: sql.SQLSTATE_INVALID_BINARY, Msg: fmt.Sprintf("incorrect binary data format for a value of type %d", oid), Pos: -1}
+	}
+	switch oid {
+	case OID_BOOL:
+		return sql.Bool(data[0] != 0), nil
+	case OID_INT2:
+		return sql.Int(int64(int16(binary.BigEndian.Uint16(data)))), nil
+	case OID_INT4:
+		return sql.Int(int64(int32(binary.BigEndian.Uint32(data)))), nil
+	case OID_INT8:
+		return sql.Int(int64(binary.BigEndian.Uint64(data))), nil
+	case OID_FLOAT4:
+		return sql.Float(float64(math.Float32frombits(binary.BigEndian.Uint32(data)))), nil
+	case OID_FLOAT8:
+		return sql.Float(math.Float64frombits(binary.BigEndian.Uint64(data))), nil
+	case OID_NUMERIC:
+		return decodeNumeric(data)
+	case OID_TEXT, OID_VARCHAR, OID_BPCHAR, OID_UNKNOWN:
+		return sql.String(string(data)), nil
+	}
+	return sql.Null(), &sql.Error{Code: sql.SQLSTATE_FEATURE_UNSUPPORTED, Msg: fmt.Sprintf("binary format is not supported for type %d", oid), Pos: -1}
+}
+
+/*
+encodeNumeric writes u in the binary format of numeric: the count of base 10000 digits, the weight
+of the first, the sign and the display scale, then the digits without trailing zeros.
+*/
+func encodeNumeric(u uint64) []byte {
+	var digits []uint16
+	for ; u > 0; u /= 10000 {
+		digits = append([]uint16{uint16(u % 10000)}, digits...)
+	}
+	weight := len(digits) - 1
+	if weight < 0 {
+		weight = 0
+	}
+	for len(digits) > 0 && digits[len(digits)-1] == 0 {
+		digits = digits[:len(digits)-1]
+	}
+	data := make([]byte, 0, 8+2*len(digits))
+	data = binary.BigEndian.AppendUint16(data, uint16(len(digits)))
+	data = binary.BigEndian.AppendUint16(data, uint16(weight))
+	data = binary.BigEndian.AppendUint16(data, 0)
+	data = binary.BigEndian.AppendUint16(data, 0)
+	for _, d := range digits {
+		data = binary.BigEndian.AppendUint16(data, d)
+	}
+	return data
+}
+
+/* decodeNumeric reads a binary numeric as an integer when it is whole and fits, else as a float */
+func decodeNumeric(data []byte) (sql.Value, error) {
+	m := &message{data: data}
+	ndigits, weight, sign := m.int16(), m.int16(), uint16(m.int16())
+	m.int16()
+	digits := make([]int, ndigits)
+	for i := range digits {
+		digits[i] = m.int16()
+	}
+	if m.err != nil || ndigits < 0 {
+		return sql.Null(), &sql.Error{Code: sql.SQLSTATE_INVALID_BINARY, Msg: "incorrect binary data format for a numeric value", Pos: -1}
+	}
+	switch sign {
+	case 0xC000:
+		return sql.Float(math.NaN()), nil
+	case 0xD000:
+		return sql.Float(math.Inf(1)), nil
+	case 0xF000:
+		return sql.Float(math.Inf(-1)), nil
+	}
+	digit := func(i int) int {
+		if i >= 0 && i < len(digits) {
+			return digits[i]
+		}
+		return 0
+	}
+	var text strings.Builder
+	if sign == 0x4000 {
+		text.WriteString("-")
+	}
+	text.WriteString("0")
+	for i := 0; i <= weight; i++ {
+		fmt.Fprintf(&text, "%04d", digit(i))
+	}
+	if ndigits > weight+1 {
+		text.WriteString(".")
+		for i := weight + 1; i < ndigits; i++ {
+			fmt.Fprintf(&text, "%04d", digit(i))
+		}
+		f, err := strconv.ParseFloat(text.String(), 64)
+		return sql.Float(f), err
+	}
+	if i, err := strconv.ParseInt(text.String(), 10, 64); err == nil {
+		return sql.Int(i), nil
+	}
+	if u, err := strconv.ParseUint(text.String(), 10, 64); err == nil {
+		return sql.Uint(u), nil
+	}
+	f, err := strconv.ParseFloat(text.String(), 64)
+	return sql.Float(f), err
+}
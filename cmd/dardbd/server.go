@@ -0,0 +1,88 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net"
+	"sync"
+
+	"github.com/misachi/DarDB/config"
+	"github.com/misachi/DarDB/storage/db"
+)
+
+/* errServerClosed is returned by serve once the server is closed */
+var errServerClosed = errors.New("server closed")
+
+/* server accepts clients of a database on any number of listeners, serving each connection on a goroutine of its own */
+type server struct {
+	cfg       *config.Config
+	db        *db.DB
+	name      string // Name clients connect to the database by
+	mtx       sync.Mutex
+	listeners []net.Listener
+	conns     map[net.Conn]bool
+	wg        sync.WaitGroup
+	closed    bool
+}
+
+func newServer(cfg *config.Config, database *db.DB, name string) *server {
+	return &server{cfg: cfg, db: database, name: name, conns: make(map[net.Conn]bool)}
+}
+
+/* serve accepts connections on l until the server is closed, when it returns errServerClosed */
+func (srv *server) serve(l net.Listener) error {
+	srv.mtx.Lock()
+	if srv.closed {
+		srv.mtx.Unlock()
+		l.Close()
+		return errServerClosed
+	}
+	srv.listeners = append(srv.listeners, l)
+	srv.mtx.Unlock()
+
+	for {
+		nc, err := l.Accept()
+		if err != nil {
+			srv.mtx.Lock()
+			closed := srv.closed
+			srv.mtx.Unlock()
+			if closed {
+				return errServerClosed
+			}
+			return err
+		}
+		srv.mtx.Lock()
+		if srv.closed {
+			srv.mtx.Unlock()
+			nc.Close()
+			return errServerClosed
+		}
+		srv.conns[nc] = true
+		srv.wg.Add(1)
+		srv.mtx.Unlock()
+
+		go func() {
+			defer srv.wg.Done()
+			newConn(srv, nc).serve()
+			srv.mtx.Lock()
+			delete(srv.conns, nc)
+			srv.mtx.Unlock()
+		}()
+	}
+}
+
+/* close stops the listeners and ends every connection, rolling back the transactions they have open */
+func (srv *server) close() {
+	srv.mtx.Lock()
+	srv.closed = true
+	for _, l := range srv.listeners {
+		if err := l.Close(); err != nil {
+			slog.Warn("dardbd: unable to close listener", "addr", l.Addr(), "err", err)
+		}
+	}
+	for nc := range srv.conns {
+		nc.Close()
+	}
+	srv.mtx.Unlock()
+	srv.wg.Wait()
+}
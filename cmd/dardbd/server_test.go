@@ -0,0 +1,525 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/misachi/DarDB/config"
+	"github.com/misachi/DarDB/sql"
+	st "github.com/misachi/DarDB/storage"
+	"github.com/misachi/DarDB/storage/db"
+)
+
+var (
+	testDBOnce sync.Once
+	testDBInst *db.DB
+	testDBCfg  *config.Config
+)
+
+/* testServer serves a database on an in memory file system on a TCP port of the loopback interface */
+func testServer(t *testing.T) (*server, string) {
+	testDBOnce.Do(func() {
+		testDBCfg = config.NewConfig("/data", 1, 1)
+		testDBCfg.SetFS(st.NewMemFS())
+		testDBInst = db.NewDB("wiretest", testDBCfg)
+	})
+	if testDBInst == nil {
+		t.Fatalf("NewDB error: unable to create the test database")
+	}
+	srv := newServer(testDBCfg, testDBInst, "wiretest")
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen error: %v", err)
+	}
+	go srv.serve(l)
+	t.Cleanup(srv.close)
+	return srv, l.Addr().String()
+}
+
+/*
+Wire values as the protocol documents them. The client writes and reads every frame by hand with
+these, so a mistake in the server's own encoding cannot hide behind the same mistake in the client.
+*/
+const (
+	WIRE_SSL_REQUEST  = 80877103
+	WIRE_PROTOCOL_3_0 = 196608
+	WIRE_TEXT         = 0
+	WIRE_BINARY       = 1
+	WIRE_INT4         = 23
+	WIRE_NUMERIC      = 1700
+)
+
+/* frame is the body of a message the client sends */
+type frame []byte
+
+func (f frame) int16(v int) frame {
+	return append(f, byte(v>>8), byte(v))
+}
+
+func (f frame) int32(v int) frame {
+	return append(f, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func (f frame) cstring(s string) frame {
+	return append(append(f, s...), 0)
+}
+
+func (f frame) bytes(b ...byte) frame {
+	return append(f, b...)
+}
+
+/* reply is the body of a message the client received, read front to back */
+type reply struct {
+	t    *testing.T
+	data []byte
+}
+
+func (r *reply) take(n int) []byte {
+	if n > len(r.data) {
+		r.t.Fatalf("reply error: expected %d more bytes but %d are left", n, len(r.data))
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *reply) byte() byte {
+	return r.take(1)[0]
+}
+
+func (r *reply) int16() int {
+	return int(int16(binary.BigEndian.Uint16(r.take(2))))
+}
+
+func (r *reply) int32() int {
+	return int(int32(binary.BigEndian.Uint32(r.take(4))))
+}
+
+func (r *reply) cstring() string {
+	end := bytes.IndexByte(r.data, 0)
+	if end < 0 {
+		r.t.Fatalf("reply error: string without its terminating zero")
+	}
+	return string(r.take(end + 1)[:end])
+}
+
+/* client speaks the frontend side of the protocol, turning each message it receives into a line of text to compare */
+type client struct {
+	t   *testing.T
+	nc  net.Conn
+	in  *bufio.Reader
+	out []byte // Messages not sent yet
+}
+
+func dial(t *testing.T, network, addr string, params ...string) *client {
+	nc, err := net.Dial(network, addr)
+	if err != nil {
+		t.Fatalf("Dial error: %v", err)
+	}
+	t.Cleanup(func() { nc.Close() })
+	c := &client{t: t, nc: nc, in: bufio.NewReader(nc)}
+
+	c.startup(frame{}.int32(WIRE_SSL_REQUEST))
+	if b, err := c.in.ReadByte(); err != nil || b != 'N' {
+		t.Fatalf("SSLRequest error: expected N but got %q, %v", b, err)
+	}
+	body := frame{}.int32(WIRE_PROTOCOL_3_0)
+	for _, p := range params {
+		body = body.cstring(p)
+	}
+	c.startup(body.bytes(0))
+	return c
+}
+
+/* startup sends a startup packet, which has no type byte */
+func (c *client) startup(body frame) {
+	c.out = append(frame(c.out).int32(len(body)+4), body...)
+	c.flush()
+}
+
+/* send queues a message; the length counts itself but not the type byte */
+func (c *client) send(typ byte, body frame) {
+	c.out = append(frame(append(c.out, typ)).int32(len(body)+4), body...)
+}
+
+func (c *client) flush() {
+	if _, err := c.nc.Write(c.out); err != nil {
+		c.t.Fatalf("Write error: %v", err)
+	}
+	c.out = c.out[:0]
+}
+
+func (c *client) sync() []string {
+	c.send('S', nil)
+	return c.until('Z')
+}
+
+func (c *client) query(query string) []string {
+	c.send('Q', frame{}.cstring(query))
+	return c.until('Z')
+}
+
+/* until reads messages up to one of type last */
+func (c *client) until(last byte) []string {
+	c.flush()
+	var got []string
+	for {
+		typ, msg := c.recv()
+		got = append(got, c.text(typ, msg))
+		if typ == last {
+			return got
+		}
+	}
+}
+
+func (c *client) recv() (byte, *reply) {
+	c.nc.SetReadDeadline(time.Now().Add(10 * time.Second))
+	var hdr [5]byte
+	if _, err := io.ReadFull(c.in, hdr[:]); err != nil {
+		c.t.Fatalf("recv error: %v", err)
+	}
+	size := int(binary.BigEndian.Uint32(hdr[1:]))
+	if size < 4 {
+		c.t.Fatalf("recv error: message %q of %d bytes", hdr[0], size)
+	}
+	data := make([]byte, size-4)
+	if _, err := io.ReadFull(c.in, data); err != nil {
+		c.t.Fatalf("recv error: %v", err)
+	}
+	return hdr[0], &reply{t: c.t, data: data}
+}
+
+/* text shows a message briefly: rows as their values, errors as severity, SQLSTATE, message and position */
+func (c *client) text(typ byte, msg *reply) string {
+	switch typ {
+	case 'T':
+		cols := make([]string, msg.int16())
+		for i := range cols {
+			name := msg.cstring()
+			msg.int32()
+			msg.int16()
+			oid := msg.int32()
+			msg.int16()
+			msg.int32()
+			cols[i] = fmt.Sprintf("%s:%d", name, oid)
+			if msg.int16() == WIRE_BINARY {
+				cols[i] += ":b"
+			}
+		}
+		return "T " + strings.Join(cols, ",")
+	case 'D':
+		values := make([]string, msg.int16())
+		for i := range values {
+			if size := msg.int32(); size < 0 {
+				values[i] = "NULL"
+			} else {
+				values[i] = string(msg.take(size))
+			}
+		}
+		return "D " + strings.Join(values, "|")
+	case 'C':
+		return "C " + msg.cstring()
+	case 'Z':
+		return "Z " + string(msg.byte())
+	case 't':
+		oids := make([]string, msg.int16())
+		for i := range oids {
+			oids[i] = fmt.Sprint(msg.int32())
+		}
+		return "t " + strings.Join(oids, ",")
+	case 'E':
+		fields := make(map[byte]string)
+		for f := msg.byte(); f != 0; f = msg.byte() {
+			fields[f] = msg.cstring()
+		}
+		text := fmt.Sprintf("E %s %s %s", fields['S'], fields['C'], fields['M'])
+		if pos, ok := fields['P']; ok {
+			text += " at " + pos
+		}
+		return text
+	case 'S':
+		return "S " + msg.cstring() + "=" + msg.cstring()
+	case 'K':
+		msg.take(8)
+		return "K"
+	case 'R':
+		return fmt.Sprintf("R %d", msg.int32())
+	}
+	return string(typ)
+}
+
+func expect(t *testing.T, what string, got []string, expected ...string) {
+	t.Helper()
+	if strings.Join(got, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("%s error: expected\n%s\nbut got\n%s", what, strings.Join(expected, "\n"), strings.Join(got, "\n"))
+	}
+}
+
+func TestStartup(t *testing.T) {
+	srv, addr := testServer(t)
+	c := dial(t, "tcp", addr, "user", "ann", "database", "wiretest", "application_name", "test")
+	got := c.until('Z')
+	expect(t, "startup", got, "R 0", "S server_version=16.0 (DarDB)", "S server_encoding=UTF8", "S client_encoding=UTF8",
+		"S DateStyle=ISO, MDY", "S TimeZone=UTC", "S integer_datetimes=on", "S standard_conforming_strings=on",
+		"S application_name=test", "K", "Z I")
+
+	c = dial(t, "tcp", addr, "user", "wiretest")
+	if got := c.until('Z'); got[len(got)-1] != "Z I" {
+		t.Errorf("startup error: expected the database to default to the user name but got %s", got)
+	}
+	c = dial(t, "tcp", addr, "user", "ann", "database", "nowhere")
+	expect(t, "startup", c.until('E'), `E FATAL 3D000 database "nowhere" does not exist`)
+
+	// The client context of a connection goes when the connection does
+	before := db.GetClientContextMgr(srv.cfg).NumClients()
+	c = dial(t, "tcp", addr, "user", "wiretest")
+	c.until('Z')
+	c.send('X', nil)
+	c.flush()
+	for i := 0; i < 100 && db.GetClientContextMgr(srv.cfg).NumClients() != before; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := db.GetClientContextMgr(srv.cfg).NumClients(); n != before {
+		t.Errorf("Terminate error: expected %d clients but got %d", before, n)
+	}
+
+	// A Unix socket serves the same way
+	path := filepath.Join(t.TempDir(), ".s.PGSQL.5432")
+	l, err := listenUnix(path)
+	if err != nil {
+		t.Fatalf("listenUnix error: %v", err)
+	}
+	go srv.serve(l)
+	c = dial(t, "unix", path, "user", "wiretest")
+	c.until('Z')
+	expect(t, "Query", c.query("SELECT 1 AS one"), "T one:20", "D 1", "C SELECT 1", "Z I")
+	if _, err := listenUnix(path); err == nil {
+		t.Errorf("listenUnix error: expected a socket in use to fail")
+	}
+}
+
+func TestSimpleQuery(t *testing.T) {
+	_, addr := testServer(t)
+	c := dial(t, "tcp", addr, "user", "wiretest")
+	c.until('Z')
+	c.query("DROP TABLE pets")
+
+	expect(t, "Query", c.query("CREATE TABLE pets (id int PRIMARY KEY, name text, weight float); INSERT INTO pets (id, name, weight) VALUES (1, 'rex', 4.5), (2, NULL, 1e308)"),
+		"C CREATE TABLE", "C INSERT 0 2", "Z I")
+	expect(t, "Query", c.query("SELECT id, name, weight * 10 AS w, id = 1 AS good FROM pets ORDER BY id; SELECT count(*) AS n FROM pets WHERE id > 5"),
+		"T id:20,name:25,w:701,good:16", "D 1|rex|45|t", "D 2|NULL|Infinity|f", "C SELECT 2",
+		"T n:20", "D 0", "C SELECT 1", "Z I")
+	expect(t, "Query", c.query("  "), "I", "Z I")
+	expect(t, "Query", c.query("SELECT id FROM nowhere"), `E ERROR 42P01 relation "nowhere" does not exist at 16`, "Z I")
+	expect(t, "Query", c.query("SELEC 1"), "E ERROR 42601 syntax error at or near \"selec\" at 1", "Z I")
+
+	// A failed transaction block ignores statements until it ends
+	expect(t, "Query", c.query("BEGIN"), "C BEGIN", "Z T")
+	expect(t, "Query", c.query("DELETE FROM pets WHERE id = 1"), "C DELETE 1", "Z T")
+	expect(t, "Query", c.query("SELECT 1 / 0"), "E ERROR 22012 division by zero at 10", "Z E")
+	expect(t, "Query", c.query("SELECT 1"), "E ERROR 25P02 current transaction is aborted, commands ignored until end of transaction block", "Z E")
+	expect(t, "Query", c.query("COMMIT"), "C ROLLBACK", "Z I")
+	expect(t, "Query", c.query("SELECT count(*) FROM pets"), "T count:20", "D 2", "C SELECT 1", "Z I")
+
+	// Clients each have a transaction of their own, so one ending a block leaves the other idle
+	other := dial(t, "tcp", addr, "user", "wiretest")
+	other.until('Z')
+	expect(t, "Query", c.query("BEGIN; INSERT INTO pets (id, name) VALUES (3, 'kit')"), "C BEGIN", "C INSERT 0 1", "Z T")
+	expect(t, "Query", other.query("COMMIT"), "C COMMIT", "Z I")
+	expect(t, "Query", c.query("COMMIT"), "C COMMIT", "Z I")
+	expect(t, "Query", other.query("SELECT count(*) FROM pets"), "T count:20", "D 3", "C SELECT 1", "Z I")
+}
+
+func TestConcurrentClients(t *testing.T) {
+	_, addr := testServer(t)
+	c := dial(t, "tcp", addr, "user", "wiretest")
+	c.until('Z')
+	c.query("DROP TABLE herd")
+	c.query("CREATE TABLE herd (id int PRIMARY KEY, client int)")
+
+	// Every client inserts into the blocks the others are scanning
+	var wg sync.WaitGroup
+	for n := 0; n < 8; n++ {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			cl := dial(t, "tcp", addr, "user", "wiretest")
+			cl.until('Z')
+			for i := 0; i < 50; i++ {
+				if got := cl.query(fmt.Sprintf("INSERT INTO herd (id, client) VALUES (%d, %d)", n*1000+i, n)); got[0] != "C INSERT 0 1" {
+					t.Errorf("Query error: client %d: unexpected %s", n, got)
+					return
+				}
+				got := cl.query(fmt.Sprintf("SELECT count(*) FROM herd WHERE client = %d", n))
+				if len(got) < 2 || got[1] != fmt.Sprintf("D %d", i+1) {
+					t.Errorf("Query error: client %d: expected %d rows of its own but got %s", n, i+1, got)
+					return
+				}
+			}
+		}(n)
+	}
+	wg.Wait()
+	expect(t, "Query", c.query("SELECT client, count(*) AS n FROM herd GROUP BY client ORDER BY client"),
+		"T client:20,n:20", "D 0|50", "D 1|50", "D 2|50", "D 3|50", "D 4|50", "D 5|50", "D 6|50", "D 7|50", "C SELECT 8", "Z I")
+}
+
+func TestExtendedQuery(t *testing.T) {
+	_, addr := testServer(t)
+	c := dial(t, "tcp", addr, "user", "wiretest")
+	c.until('Z')
+	c.query("DROP TABLE birds")
+	c.query("CREATE TABLE birds (id int PRIMARY KEY, name text, big uint64)")
+
+	parse := func(name, query string, oids ...int) {
+		f := frame{}.cstring(name).cstring(query).int16(len(oids))
+		for _, oid := range oids {
+			f = f.int32(oid)
+		}
+		c.send('P', f)
+	}
+	bind := func(portal, stmt string, formats []int, values [][]byte, resultFormats ...int) {
+		f := frame{}.cstring(portal).cstring(stmt).int16(len(formats))
+		for _, format := range formats {
+			f = f.int16(format)
+		}
+		f = f.int16(len(values))
+		for _, v := range values {
+			if v == nil {
+				f = f.int32(-1)
+				continue
+			}
+			f = f.int32(len(v)).bytes(v...)
+		}
+		f = f.int16(len(resultFormats))
+		for _, format := range resultFormats {
+			f = f.int16(format)
+		}
+		c.send('B', f)
+	}
+	describe := func(kind byte, name string) {
+		c.send('D', frame{kind}.cstring(name))
+	}
+	execute := func(portal string, maxRows int) {
+		c.send('E', frame{}.cstring(portal).int32(maxRows))
+	}
+	int8 := func(i int64) []byte { return frame{}.int32(int(i >> 32)).int32(int(i)) }
+
+	// Text and binary parameters, the types of the statement described
+	parse("ins", "INSERT INTO birds (id, name, big) VALUES ($1, $2, $3)", WIRE_INT4)
+	describe('S', "ins")
+	expect(t, "Parse", c.sync(), "1", "t 23,25,1700", "n", "Z I")
+	bind("", "ins", []int{WIRE_BINARY, WIRE_TEXT, WIRE_TEXT}, [][]byte{{0, 0, 0, 1}, []byte("owl"), []byte("18446744073709551615")})
+	execute("", 0)
+	bind("", "ins", []int{WIRE_TEXT}, [][]byte{[]byte("2"), nil, nil})
+	execute("", 0)
+	bind("", "ins", []int{WIRE_BINARY}, [][]byte{{0, 0, 0, 3}, []byte("jay"), {0, 2, 0, 1, 0, 0, 0, 0, 0x04, 0xd2, 0x16, 0x2e}})
+	execute("", 0)
+	expect(t, "Execute", c.sync(), "2", "C INSERT 0 1", "2", "C INSERT 0 1", "2", "C INSERT 0 1", "Z I")
+
+	// Results in binary, fetched a row at a time
+	parse("sel", "SELECT id, name, big FROM birds WHERE id >= $1 ORDER BY id")
+	bind("p", "sel", []int{WIRE_BINARY}, [][]byte{int8(1)}, WIRE_BINARY, WIRE_TEXT, WIRE_TEXT)
+	describe('P', "p")
+	execute("p", 2)
+	execute("p", 2)
+	expect(t, "Execute", c.sync(), "1", "2", "T id:20:b,name:25,big:1700", "D "+string(int8(1))+"|owl|18446744073709551615", "D "+string(int8(2))+"|NULL|NULL", "s",
+		"D "+string(int8(3))+"|jay|12345678", "C SELECT 1", "Z I")
+
+	// Portals end with the transaction; statements stay
+	execute("p", 0)
+	expect(t, "Execute", c.sync(), `E ERROR 34000 portal "p" does not exist`, "Z I")
+	bind("", "sel", nil, [][]byte{[]byte("3")})
+	execute("", 0)
+	expect(t, "Execute", c.sync(), "2", "D 3|jay|12345678", "C SELECT 1", "Z I")
+
+	// Binary numeric values come back as the value they stand for
+	parse("", "SELECT $1 + 0.5 AS f", WIRE_NUMERIC)
+	for _, v := range []struct {
+		in       []byte
+		expected string
+	}{
+		{[]byte{0, 0, 0, 0, 0, 0, 0, 0}, "D 0.5"},
+		{[]byte{0, 2, 0, 0, 0x40, 0, 0, 2, 0, 12, 0x13, 0x88}, "D -12"},
+	} {
+		bind("", "", []int{WIRE_BINARY}, [][]byte{v.in})
+		execute("", 0)
+		if got := c.sync(); !strings.Contains(strings.Join(got, "\n"), "\n"+v.expected+"\n") {
+			t.Errorf("Execute error: numeric %v: expected %s but got %s", v.in, v.expected, got)
+		}
+	}
+
+	// After an error the messages up to Sync are skipped
+	bind("", "nope", nil, nil)
+	execute("", 0)
+	parse("x", "SELECT 1")
+	expect(t, "Bind", c.sync(), `E ERROR 26000 prepared statement "nope" does not exist`, "Z I")
+	parse("sel", "SELECT 1")
+	expect(t, "Parse", c.sync(), `E ERROR 42P05 prepared statement "sel" already exists`, "Z I")
+	parse("", "SELECT 1; SELECT 2")
+	bind("", "sel", nil, [][]byte{[]byte("x")})
+	expect(t, "Parse", c.sync(), "E ERROR 42601 cannot insert multiple commands into a prepared statement", "Z I")
+	bind("", "sel", nil, nil)
+	expect(t, "Bind", c.sync(), `E ERROR 08P01 bind message supplies 0 parameters, but prepared statement "sel" requires 1`, "Z I")
+	bind("", "sel", nil, [][]byte{[]byte("x")})
+	execute("", 0)
+	expect(t, "Execute", c.sync(), "2", `E ERROR 22P02 invalid input syntax for type integer: "x"`, "Z I")
+	bind("", "sel", []int{WIRE_BINARY}, [][]byte{{1, 2}})
+	expect(t, "Bind", c.sync(), "E ERROR 22P03 incorrect binary data format for a value of type 20", "Z I")
+
+	// Closing a statement, and an empty query
+	c.send('C', frame{'S'}.cstring("sel"))
+	parse("e", "")
+	bind("", "e", nil, nil)
+	describe('P', "")
+	execute("", 0)
+	expect(t, "Close", c.sync(), "3", "1", "2", "n", "I", "Z I")
+	bind("", "sel", nil, nil)
+	expect(t, "Close", c.sync(), `E ERROR 26000 prepared statement "sel" does not exist`, "Z I")
+
+	// A message the server does not know ends the connection
+	c.send('?', nil)
+	expect(t, "message", c.until('E'), "E FATAL 08P01 invalid frontend message type 63")
+}
+
+func TestValueEncoding(t *testing.T) {
+	for _, u := range []uint64{0, 1, 9999, 10000, 123456789, math.MaxUint64} {
+		v, err := decodeNumeric(encodeNumeric(u))
+		if err != nil || v.String() != fmt.Sprint(u) {
+			t.Errorf("numeric error: expected %d but got %s, %v", u, v, err)
+		}
+	}
+	// Two base 10000 digits, weight 1: 1234 5678
+	if data := encodeNumeric(12345678); !bytes.Equal(data, []byte{0, 2, 0, 1, 0, 0, 0, 0, 0x04, 0xd2, 0x16, 0x2e}) {
+		t.Errorf("numeric error: unexpected encoding %v of 12345678", data)
+	}
+	tests := []struct {
+		v        sql.Value
+		oid      int
+		expected []byte
+	}{
+		{sql.Bool(true), OID_BOOL, []byte{1}},
+		{sql.Int(-2), OID_INT8, []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xfe}},
+		{sql.Float(1), OID_FLOAT8, []byte{0x3f, 0xf0, 0, 0, 0, 0, 0, 0}},
+		{sql.String("é"), OID_TEXT, []byte("é")},
+		{sql.Null(), OID_TEXT, nil},
+	}
+	for _, test := range tests {
+		data := encodeValue(test.v, test.oid, FORMAT_BINARY)
+		if string(data) != string(test.expected) || (data == nil) != (test.expected == nil) {
+			t.Errorf("encodeValue error: %s: expected %v but got %v", test.v, test.expected, data)
+		}
+		if back, err := decodeParam(data, test.oid, FORMAT_BINARY); err != nil || back != test.v {
+			t.Errorf("decodeParam error: %v: expected %s but got %s, %v", data, test.v, back, err)
+		}
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+/* HISTORY_SIZE is how many lines the history keeps */
+const HISTORY_SIZE = 500
+
+/* Keys the editor acts on */
+const (
+	KEY_CTRL_A    = 1
+	KEY_CTRL_B    = 2
+	KEY_CTRL_C    = 3
+	KEY_CTRL_D    = 4
+	KEY_CTRL_E    = 5
+	KEY_CTRL_F    = 6
+	KEY_CTRL_H    = 8
+	KEY_CTRL_K    = 11
+	KEY_CTRL_N    = 14
+	KEY_CTRL_P    = 16
+	KEY_CTRL_U    = 21
+	KEY_ESC       = 27
+	KEY_BACKSPACE = 127
+	KEY_DELETE    = 256 // Sent as an escape sequence, so it has no byte of its own
+)
+
+/* errInterrupted is returned when Ctrl-C discards the line */
+var errInterrupted = errors.New("interrupted")
+
+/*
+editor reads lines of input. On a terminal it edits the line in place, with the arrow keys and the
+usual Emacs keys, and moves through the history with up and down. The history is kept in a file
+so it lasts between runs. Other input is read a plain line at a time.
+*/
+type editor struct {
+	in      *bufio.Reader
+	out     io.Writer
+	fd      int
+	tty     bool
+	history []string
+	file    string // Where the history is kept, empty to keep it in memory
+}
+
+func newEditor(in *os.File, out io.Writer, file string) *editor {
+	e := &editor{in: bufio.NewReader(in), out: out, fd: int(in.Fd()), tty: isTerminal(int(in.Fd())), file: file}
+	e.load()
+	return e
+}
+
+/* load reads the history file, cutting it down to the last HISTORY_SIZE lines */
+func (e *editor) load() {
+	if e.file == "" {
+		return
+	}
+	data, err := os.ReadFile(e.file)
+	if err != nil {
+		return
+	}
+	e.history = strings.Split(strings.TrimRight(string(data), "\n"), "\n")
+	if len(e.history) > HISTORY_SIZE {
+		e.history = e.history[len(e.history)-HISTORY_SIZE:]
+		os.WriteFile(e.file, []byte(strings.Join(e.history, "\n")+"\n"), 0600)
+	}
+}
+
+/* add puts line at the end of the history unless it is blank or repeats the last line */
+func (e *editor) add(line string) {
+	if strings.TrimSpace(line) == "" || (len(e.history) > 0 && e.history[len(e.history)-1] == line) {
+		return
+	}
+	e.history = append(e.history, line)
+	if len(e.history) > HISTORY_SIZE {
+		e.history = e.history[1:]
+	}
+	if e.file == "" {
+		return
+	}
+	// The history is a convenience; a file that cannot be written is not worth stopping for
+	f, err := os.OpenFile(e.file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	fmt.Fprintln(f, line)
+}
+
+/* lines returns the history, oldest first */
+func (e *editor) lines() []string {
+	return e.history
+}
+
+/* readLine reads a line, showing prompt on a terminal. It returns io.EOF once the input ends */
+func (e *editor) readLine(prompt string) (string, error) {
+	if e.tty {
+		if restore, err := makeRaw(e.fd); err == nil {
+			defer restore()
+			return e.edit(prompt)
+		}
+		fmt.Fprint(e.out, prompt)
+	}
+	line, err := e.in.ReadString('\n')
+	if err != nil && (err != io.EOF || line == "") {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+/* edit reads a line from a terminal in raw mode, redrawing it as it changes */
+func (e *editor) edit(prompt string) (string, error) {
+	var line []rune
+	pos := 0
+	shown := len(e.history) // Entry of the history being edited, len(e.history) for the new line
+	typed := ""             // The new line, kept while moving through the history
+	show := func(i int) {
+		if shown == len(e.history) {
+			typed = string(line)
+		}
+		shown = i
+		if i == len(e.history) {
+			line = []rune(typed)
+		} else {
+			line = []rune(e.history[i])
+		}
+		pos = len(line)
+	}
+
+	fmt.Fprint(e.out, prompt)
+	for {
+		r, _, err := e.in.ReadRune()
+		if err != nil {
+			return "", err
+		}
+		if r == KEY_ESC {
+			r = e.escape()
+		}
+		switch r {
+		case '\r', '\n':
+			fmt.Fprint(e.out, "\r\n")
+			return string(line), nil
+		case KEY_CTRL_C:
+			fmt.Fprint(e.out, "^C\r\n")
+			return "", errInterrupted
+		case KEY_CTRL_D:
+			if len(line) == 0 {
+				fmt.Fprint(e.out, "\r\n")
+				return "", io.EOF
+			}
+			fallthrough
+		case KEY_DELETE:
+			if pos < len(line) {
+				line = append(line[:pos], line[pos+1:]...)
+			}
+		case KEY_CTRL_A:
+			pos = 0
+		case KEY_CTRL_E:
+			pos = len(line)
+		case KEY_CTRL_B:
+			if pos > 0 {
+				pos--
+			}
+		case KEY_CTRL_F:
+			if pos < len(line) {
+				pos++
+			}
+		case KEY_CTRL_K:
+			line = line[:pos]
+		case KEY_CTRL_U:
+			line, pos = append([]rune{}, line[pos:]...), 0
+		case KEY_CTRL_P:
+			if shown > 0 {
+				show(shown - 1)
+			}
+		case KEY_CTRL_N:
+			if shown < len(e.history) {
+				show(shown + 1)
+			}
+		case KEY_BACKSPACE, KEY_CTRL_H:
+			if pos > 0 {
+				line = append(line[:pos-1], line[pos:]...)
+				pos--
+			}
+		default:
+			if r < ' ' {
+				continue
+			}
+			line = append(line[:pos], append([]rune{r}, line[pos:]...)...)
+			pos++
+		}
+		// Write the line again and move the cursor back to where it is in the line
+		fmt.Fprintf(e.out, "\r%s%s\x1b[K", prompt, string(line))
+		if back := len(line) - pos; back > 0 {
+			fmt.Fprintf(e.out, "\x1b[%dD", back)
+		}
+	}
+}
+
+/* escape reads the rest of an escape sequence and returns the key it stands for, or 0 if it is not one the editor knows */
+func (e *editor) escape() rune {
+	r, _, err := e.in.ReadRune()
+	if err != nil || (r != '[' && r != 'O') {
+		return 0
+	}
+	if r, _, err = e.in.ReadRune(); err != nil {
+		return 0
+	}
+	var code rune
+	for r >= '0' && r <= '9' {
+		code = r
+		if r, _, err = e.in.ReadRune(); err != nil {
+			return 0
+		}
+	}
+	switch {
+	case r == 'A':
+		return KEY_CTRL_P
+	case r == 'B':
+		return KEY_CTRL_N
+	case r == 'C':
+		return KEY_CTRL_F
+	case r == 'D':
+		return KEY_CTRL_B
+	case r == 'H' || (r == '~' && (code == '1' || code == '7')):
+		return KEY_CTRL_A
+	case r == 'F' || (r == '~' && (code == '4' || code == '8')):
+		return KEY_CTRL_E
+	case r == '~' && code == '3':
+		return KEY_DELETE
+	}
+	return 0
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestEditor(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "history")
+	if err := os.WriteFile(file, []byte("SELECT 1;\nSELECT 2;\n"), 0600); err != nil {
+		t.Fatalf("WriteFile error: %v", err)
+	}
+	e := &editor{out: io.Discard, file: file}
+	e.load()
+	edit := func(keys string) (string, error) {
+		e.in = bufio.NewReader(strings.NewReader(keys))
+		return e.edit("> ")
+	}
+
+	tests := []struct {
+		keys     string
+		expected string
+	}{
+		{"abc\r", "abc"},
+		{"abd\x7fc\r", "abc"},
+		{"bc\x01a\x05d\r", "abcd"},
+		{"ac\x1b[Db\r", "abc"},
+		{"abc\x1b[D\x1b[D\x1b[3~\r", "ac"},
+		{"abc\x02\x02\x0b\r", "a"},
+		{"abc\x02\x15\r", "c"},
+		{"x\x1b[A\r", "SELECT 2;"},
+		{"\x1b[A\x1b[A\x1b[A\r", "SELECT 1;"},
+		{"x\x1b[A\x1b[B\r", "x"},
+		{"a\x1b[Zb\x07\r", "ab"},
+	}
+	for _, test := range tests {
+		line, err := edit(test.keys)
+		if err != nil || line != test.expected {
+			t.Errorf("edit error: %q: expected %q but got %q, %v", test.keys, test.expected, line, err)
+		}
+	}
+	if _, err := edit("abc\x03"); err != errInterrupted {
+		t.Errorf("edit error: expected Ctrl-C to interrupt but got %v", err)
+	}
+	if _, err := edit("\x04"); err != io.EOF {
+		t.Errorf("edit error: expected Ctrl-D on an empty line to end the input but got %v", err)
+	}
+
+	e.add("SELECT 3;")
+	e.add("SELECT 3;")
+	e.add("  ")
+	data, err := os.ReadFile(file)
+	if err != nil || string(data) != "SELECT 1;\nSELECT 2;\nSELECT 3;\n" {
+		t.Errorf("add error: unexpected history file %q, %v", data, err)
+	}
+	if line, _ := edit("\x1b[A\r"); line != "SELECT 3;" {
+		t.Errorf("edit error: expected the added line in the history but got %q", line)
+	}
+
+	var lines []string
+	for i := 0; i < HISTORY_SIZE+10; i++ {
+		lines = append(lines, strings.Repeat("x", i+1))
+	}
+	os.WriteFile(file, []byte(strings.Join(lines, "\n")+"\n"), 0600)
+	e = &editor{file: file}
+	e.load()
+	data, _ = os.ReadFile(file)
+	if len(e.history) != HISTORY_SIZE || e.history[0] != lines[10] || strings.Count(string(data), "\n") != HISTORY_SIZE {
+		t.Errorf("load error: expected the history cut down to the last %d lines but got %d", HISTORY_SIZE, len(e.history))
+	}
+}
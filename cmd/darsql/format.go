@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/misachi/DarDB/sql"
+)
+
+/* table is what printTable writes: a title, the header, the rows as text and which columns line up on the right */
+type table struct {
+	title   string
+	header  []string
+	rows    [][]string
+	numeric []bool
+	footer  []string // Lines printed in place of the count of rows
+}
+
+/* resultTable turns the rows of a result into text. Numbers line up on the right, as psql shows them */
+func resultTable(r *sql.Result) *table {
+	t := &table{header: make([]string, len(r.Columns)), numeric: make([]bool, len(r.Columns))}
+	for i, c := range r.Columns {
+		t.header[i] = c.Name
+		t.numeric[i] = c.Kind == sql.KIND_INT || c.Kind == sql.KIND_UINT || c.Kind == sql.KIND_FLOAT
+	}
+	for _, row := range r.Rows {
+		text := make([]string, len(row))
+		for i, v := range row {
+			text[i] = v.String()
+		}
+		t.rows = append(t.rows, text)
+	}
+	return t
+}
+
+/*
+printTable writes t aligned as psql does: the header centred over its column, a rule under it and
+the count of rows last. Lines of a multi-line value continue in the same column, marked with + at
+the end of the column.
+*/
+func printTable(w io.Writer, t *table) {
+	widths := make([]int, len(t.header))
+	for i, name := range t.header {
+		widths[i] = textWidth(name)
+	}
+	for _, row := range t.rows {
+		for i, v := range row {
+			for _, line := range strings.Split(v, "\n") {
+				if n := textWidth(line); n > widths[i] {
+					widths[i] = n
+				}
+			}
+		}
+	}
+	total := len(widths)*3 - 1
+	for _, width := range widths {
+		total += width
+	}
+	if t.title != "" {
+		pad := (total - textWidth(t.title)) / 2
+		if pad < 0 {
+			pad = 0
+		}
+		fmt.Fprintf(w, "%s%s\n", strings.Repeat(" ", pad), t.title)
+	}
+
+	var b strings.Builder
+	for i, name := range t.header {
+		pad := widths[i] - textWidth(name)
+		cell(&b, i, strings.Repeat(" ", pad/2)+name+strings.Repeat(" ", pad-pad/2), " ")
+	}
+	fmt.Fprintln(w, strings.TrimRight(b.String(), " "))
+	b.Reset()
+	for i, width := range widths {
+		if i > 0 {
+			b.WriteString("+")
+		}
+		b.WriteString(strings.Repeat("-", width+2))
+	}
+	fmt.Fprintln(w, b.String())
+
+	for _, row := range t.rows {
+		lines := make([][]string, len(row))
+		height := 1
+		for i, v := range row {
+			lines[i] = strings.Split(v, "\n")
+			if len(lines[i]) > height {
+				height = len(lines[i])
+			}
+		}
+		for l := 0; l < height; l++ {
+			b.Reset()
+			for i := range row {
+				var text string
+				if l < len(lines[i]) {
+					text = lines[i][l]
+				}
+				pad := strings.Repeat(" ", widths[i]-textWidth(text))
+				if t.numeric[i] {
+					text = pad + text
+				} else {
+					text += pad
+				}
+				more := " "
+				if l < len(lines[i])-1 {
+					more = "+"
+				}
+				cell(&b, i, text, more)
+			}
+			fmt.Fprintln(w, strings.TrimRight(b.String(), " "))
+		}
+	}
+	if t.footer != nil {
+		for _, line := range t.footer {
+			fmt.Fprintln(w, line)
+		}
+	} else if len(t.rows) == 1 {
+		fmt.Fprintln(w, "(1 row)")
+	} else {
+		fmt.Fprintf(w, "(%d rows)\n", len(t.rows))
+	}
+	fmt.Fprintln(w)
+}
+
+/* cell writes the text of column i, with the separator before it and more after it */
+func cell(b *strings.Builder, i int, text, more string) {
+	if i > 0 {
+		b.WriteString("|")
+	}
+	b.WriteString(" ")
+	b.WriteString(text)
+	b.WriteString(more)
+}
+
+func textWidth(s string) int {
+	return utf8.RuneCountInString(s)
+}
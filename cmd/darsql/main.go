@@ -0,0 +1,127 @@
+/*
+darsql is an interactive shell for a DarDB database. It runs SQL and psql-like meta-commands
+typed at the prompt, or the SQL of a script given with -f. A script goes on past a statement
+that fails, and darsql then exits with status 3.
+
+	darsql [-D datadir] [-d dbname] [-f file.sql]
+*/
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/misachi/DarDB/config"
+	"github.com/misachi/DarDB/storage/db"
+)
+
+func main() {
+	dataDir := flag.String("D", "/tmp/DarDB", "data directory")
+	name := flag.String("d", "myDB", "database to open")
+	file := flag.String("f", "", "run the SQL in `file` and exit")
+	history := flag.String("history", defaultHistory(), "`file` the line history is kept in")
+	flag.Parse()
+
+	cfg := config.NewConfig(*dataDir, 0, 0)
+	database := db.NewDB(*name, cfg)
+	if database == nil {
+		fmt.Fprintf(os.Stderr, "darsql: unable to open database %s in %s\n", *name, *dataDir)
+		os.Exit(2)
+	}
+	workers := db.StartBgWorkers(cfg)
+	ctx := db.GetClientContextMgr(cfg).NewClientCtx(cfg, database)
+	sh := newShell(database, ctx, os.Stdout, os.Stderr)
+
+	status := 0
+	if *file != "" {
+		if err := runFile(sh, *file); err != nil {
+			fmt.Fprintf(os.Stderr, "darsql: %v\n", err)
+			status = 1
+		} else if sh.failed {
+			status = 3
+		}
+	} else {
+		interactive(sh, newEditor(os.Stdin, os.Stdout, *history), *name)
+	}
+
+	ctx.Close()
+	if err := workers.Stop(); err != nil {
+		fmt.Fprintf(os.Stderr, "darsql: %v\n", err)
+		status = 1
+	}
+	os.Exit(status)
+}
+
+func defaultHistory() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".darsql_history")
+}
+
+/* interactive reads lines until \q or the end of the input. Only lines typed at a terminal are kept in the history */
+func interactive(sh *shell, e *editor, name string) {
+	if e.tty {
+		fmt.Fprintf(e.out, "darsql (DarDB)\nType \"\\?\" for help.\n\n")
+		sh.history = e.lines
+	}
+	for n := 1; ; n++ {
+		line, err := e.readLine(sh.prompt(name))
+		if errors.Is(err, errInterrupted) {
+			sh.query.Reset()
+			continue
+		}
+		if err != nil {
+			if err != io.EOF {
+				fmt.Fprintf(sh.errOut, "darsql: %v\n", err)
+			}
+			break
+		}
+		if e.tty {
+			e.add(line)
+		}
+		if err := sh.feed(line, n); err == errQuit {
+			return
+		}
+	}
+	if !e.tty {
+		sh.finish()
+	}
+}
+
+/* runFile runs the statements of a script. A statement that fails is reported and the rest still run, as psql does */
+func runFile(sh *shell, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return runScript(sh, path, f)
+}
+
+func runScript(sh *shell, source string, r io.Reader) error {
+	sh.source = source
+	in := bufio.NewReader(r)
+	for n := 1; ; n++ {
+		line, err := in.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if line != "" {
+			if quitErr := sh.feed(strings.TrimRight(line, "\r\n"), n); quitErr == errQuit {
+				return nil
+			}
+		}
+		if err == io.EOF {
+			sh.finish()
+			return nil
+		}
+	}
+}
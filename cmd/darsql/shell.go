@@ -0,0 +1,274 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/misachi/DarDB/sql"
+	"github.com/misachi/DarDB/storage/db"
+)
+
+/* errQuit is returned by \q */
+var errQuit = errors.New("quit")
+
+const HELP = `General
+  \q                 quit darsql
+  \?                 show this help
+  \s                 show the history of the session
+Informational
+  \d                 list tables
+  \d NAME            describe table NAME
+  \dt                list tables
+Transactions
+  \begin             start a transaction block
+  \commit            commit the transaction block
+  \rollback          roll back the transaction block
+Formatting
+  \timing [on|off]   show how long each statement takes
+`
+
+/*
+shell reads SQL and meta-commands line by line. A statement runs once a semicolon ends it, so it
+can span lines; a line starting with a backslash is a meta-command.
+*/
+type shell struct {
+	db      *db.DB
+	session *sql.Session
+	out     io.Writer
+	errOut  io.Writer
+	history func() []string // Lines entered so far, for \s
+	timing  bool
+	query   strings.Builder // Lines of a statement not yet ended with a semicolon
+	start   int             // Line of the input where query starts, for error messages
+	source  string          // Name of the script being run, empty when interactive
+	failed  bool            // A statement or meta-command failed
+}
+
+func newShell(database *db.DB, ctx *db.ClientContext, out, errOut io.Writer) *shell {
+	return &shell{db: database, session: sql.NewSession(database, ctx), out: out, errOut: errOut}
+}
+
+/* prompt is the prompt for the next line, showing as psql does whether a statement or a transaction block is open */
+func (sh *shell) prompt(name string) string {
+	mark := "="
+	if sh.query.Len() > 0 {
+		mark = "-"
+	}
+	switch inBlock, failed := sh.session.InTransaction(); {
+	case failed:
+		mark += "!"
+	case inBlock:
+		mark += "*"
+	}
+	return name + mark + "> "
+}
+
+/* feed takes line n of the input, running the statements it ends. It returns errQuit on \q */
+func (sh *shell) feed(line string, n int) error {
+	if sh.query.Len() == 0 {
+		if strings.TrimSpace(line) == "" {
+			return nil
+		}
+		sh.start = n
+	}
+	if trimmed := strings.TrimSpace(line); strings.HasPrefix(trimmed, `\`) {
+		return sh.command(trimmed)
+	}
+	sh.query.WriteString(line)
+	sh.query.WriteString("\n")
+	stmts, rest := splitStatements(sh.query.String())
+	for _, stmt := range stmts {
+		sh.exec(stmt)
+	}
+	sh.query.Reset()
+	if strings.TrimSpace(rest) != "" {
+		sh.query.WriteString(rest)
+	}
+	return nil
+}
+
+/* finish runs what is left of the input when it ends without a semicolon, as psql does for scripts */
+func (sh *shell) finish() {
+	if text := sh.query.String(); strings.TrimSpace(text) != "" {
+		sh.query.Reset()
+		sh.exec(text)
+	}
+}
+
+/* exec runs one statement and prints its result */
+func (sh *shell) exec(query string) {
+	began := time.Now()
+	results, err := sh.session.Exec(query)
+	elapsed := time.Since(began)
+	for _, r := range results {
+		sh.print(r)
+	}
+	if err != nil {
+		sh.error(query, err)
+	}
+	if sh.timing {
+		fmt.Fprintf(sh.out, "Time: %.3f ms\n", float64(elapsed.Microseconds())/1000)
+	}
+}
+
+/* print writes the rows of a result as a table, or its command tag if it has no columns */
+func (sh *shell) print(r *sql.Result) {
+	if len(r.Columns) == 0 {
+		fmt.Fprintln(sh.out, r.Tag)
+		return
+	}
+	printTable(sh.out, resultTable(r))
+}
+
+/* error reports err, pointing at where in query it happened when the error says */
+func (sh *shell) error(query string, err error) {
+	sh.failed = true
+	prefix := ""
+	if sh.source != "" {
+		prefix = fmt.Sprintf("darsql:%s:%d: ", sh.source, sh.start)
+	}
+	var sqlErr *sql.Error
+	if !errors.As(err, &sqlErr) {
+		fmt.Fprintf(sh.errOut, "%sERROR:  %v\n", prefix, err)
+		return
+	}
+	fmt.Fprintf(sh.errOut, "%sERROR:  %s\n", prefix, sqlErr.Msg)
+	if sqlErr.Pos < 0 || sqlErr.Pos > len(query) {
+		return
+	}
+	lineStart := strings.LastIndex(query[:sqlErr.Pos], "\n") + 1
+	lineEnd := strings.Index(query[lineStart:], "\n")
+	if lineEnd < 0 {
+		lineEnd = len(query) - lineStart
+	}
+	label := fmt.Sprintf("LINE %d: ", strings.Count(query[:lineStart], "\n")+1)
+	fmt.Fprintf(sh.errOut, "%s%s\n", label, query[lineStart:lineStart+lineEnd])
+	fmt.Fprintf(sh.errOut, "%s^\n", strings.Repeat(" ", len(label)+textWidth(query[lineStart:sqlErr.Pos])))
+}
+
+/* command runs a meta-command */
+func (sh *shell) command(line string) error {
+	fields := strings.Fields(line)
+	name, args := fields[0], fields[1:]
+	switch name {
+	case `\q`:
+		return errQuit
+	case `\?`:
+		fmt.Fprint(sh.out, HELP)
+	case `\s`:
+		if sh.history != nil {
+			for _, entry := range sh.history() {
+				fmt.Fprintln(sh.out, entry)
+			}
+		}
+	case `\dt`:
+		sh.listTables()
+	case `\d`:
+		if len(args) == 0 {
+			sh.listTables()
+		} else {
+			sh.describe(args[0])
+		}
+	case `\timing`:
+		switch {
+		case len(args) == 0:
+			sh.timing = !sh.timing
+		case args[0] == "on" || args[0] == "off":
+			sh.timing = args[0] == "on"
+		default:
+			sh.commandError("\\timing: unrecognized value %q: on or off expected", args[0])
+			return nil
+		}
+		if sh.timing {
+			fmt.Fprintln(sh.out, "Timing is on.")
+		} else {
+			fmt.Fprintln(sh.out, "Timing is off.")
+		}
+	case `\begin`, `\commit`, `\rollback`:
+		sh.exec(strings.ToUpper(name[1:]))
+	default:
+		sh.commandError("invalid command %s\nTry \\? for help.", name)
+	}
+	return nil
+}
+
+func (sh *shell) commandError(format string, args ...any) {
+	sh.failed = true
+	fmt.Fprintf(sh.errOut, format+"\n", args...)
+}
+
+/* listTables prints the tables of the database */
+func (sh *shell) listTables() {
+	names, err := sh.db.Tables()
+	if err != nil {
+		sh.commandError("ERROR:  %v", err)
+		return
+	}
+	if len(names) == 0 {
+		fmt.Fprintln(sh.out, "Did not find any relations.")
+		return
+	}
+	t := &table{title: "List of relations", header: []string{"Name", "Type"}, numeric: []bool{false, false}}
+	for _, name := range names {
+		t.rows = append(t.rows, []string{name, "table"})
+	}
+	printTable(sh.out, t)
+}
+
+/* describe prints the columns of a table and its primary key */
+func (sh *shell) describe(name string) {
+	tbl := sh.db.GetTable(name)
+	if tbl == nil {
+		sh.commandError("Did not find any relation named %q.", name)
+		return
+	}
+	info := tbl.GetInfo()
+	t := &table{title: fmt.Sprintf("Table %q", name), header: []string{"Column", "Type", "Nullable"}, numeric: []bool{false, false, false}}
+	for _, i := range info.DeclaredOrder() {
+		c := info.Column[i]
+		nullable := ""
+		if c.Name == info.Pkey.Name {
+			nullable = "not null"
+		}
+		t.rows = append(t.rows, []string{c.Name, sql.TypeName(c.Type), nullable})
+	}
+	t.footer = []string{"Indexes:", fmt.Sprintf("    \"%s_pkey\" PRIMARY KEY (%s)", name, info.Pkey.Name)}
+	printTable(sh.out, t)
+}
+
+/*
+splitStatements splits text at the semicolons that end statements, leaving out those in quoted
+strings, quoted names and comments. It returns the statements ended and the text after the last.
+*/
+func splitStatements(text string) ([]string, string) {
+	var stmts []string
+	start := 0
+	for i := 0; i < len(text); i++ {
+		switch text[i] {
+		case '\'', '"':
+			end := strings.IndexByte(text[i+1:], text[i])
+			if end < 0 {
+				return stmts, text[start:]
+			}
+			// A doubled quote is a quote in the text and is skipped by the next iteration
+			i += end + 1
+		case '-':
+			if i+1 < len(text) && text[i+1] == '-' {
+				end := strings.IndexByte(text[i:], '\n')
+				if end < 0 {
+					return stmts, text[start:]
+				}
+				i += end
+			}
+		case ';':
+			if stmt := text[start : i+1]; strings.TrimSpace(stmt) != ";" {
+				stmts = append(stmts, stmt)
+			}
+			start = i + 1
+		}
+	}
+	return stmts, text[start:]
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/misachi/DarDB/config"
+	st "github.com/misachi/DarDB/storage"
+	"github.com/misachi/DarDB/storage/db"
+)
+
+func testShell(t *testing.T) (*shell, *strings.Builder, *strings.Builder) {
+	cfg := config.NewConfig("/data", 1, 1)
+	cfg.SetFS(st.NewMemFS())
+	database := db.NewDB("shelltest", cfg)
+	if database == nil {
+		t.Fatalf("NewDB error: unable to create the test database")
+	}
+	ctx := db.GetClientContextMgr(cfg).NewClientCtx(cfg, database)
+	t.Cleanup(ctx.Close)
+	var out, errOut strings.Builder
+	return newShell(database, ctx, &out, &errOut), &out, &errOut
+}
+
+func TestSplitStatements(t *testing.T) {
+	tests := []struct {
+		text  string
+		stmts []string
+		rest  string
+	}{
+		{"SELECT 1;", []string{"SELECT 1;"}, ""},
+		{"SELECT 1; SELECT 2", []string{"SELECT 1;"}, " SELECT 2"},
+		{"SELECT 'a;''b'; ;", []string{"SELECT 'a;''b';"}, ""},
+		{`SELECT 1 AS "x;y";`, []string{`SELECT 1 AS "x;y";`}, ""},
+		{"SELECT 1 -- a; b\n;", []string{"SELECT 1 -- a; b\n;"}, ""},
+		{"SELECT 'open;\n", nil, "SELECT 'open;\n"},
+		{"SELECT 1 - -2;", []string{"SELECT 1 - -2;"}, ""},
+	}
+	for _, test := range tests {
+		stmts, rest := splitStatements(test.text)
+		if strings.Join(stmts, "|") != strings.Join(test.stmts, "|") || rest != test.rest {
+			t.Errorf("splitStatements error: %q: expected %q and %q but got %q and %q", test.text, test.stmts, test.rest, stmts, rest)
+		}
+	}
+}
+
+func TestPrintTable(t *testing.T) {
+	var b strings.Builder
+	printTable(&b, &table{
+		title:   "Things",
+		header:  []string{"id", "name"},
+		rows:    [][]string{{"1", "ann"}, {"22", "bob\nsmith"}},
+		numeric: []bool{true, false},
+	})
+	expected := `   Things
+ id | name
+----+-------
+  1 | ann
+ 22 | bob  +
+    | smith
+(2 rows)
+
+`
+	if b.String() != expected {
+		t.Errorf("printTable error: expected\n%s\nbut got\n%s", expected, b.String())
+	}
+}
+
+func TestShellScript(t *testing.T) {
+	sh, out, errOut := testShell(t)
+	script := `CREATE TABLE pets (id int PRIMARY KEY,
+  name text);
+INSERT INTO pets (id, name) VALUES (1, 'rex'), (2, 'tom'); SELECT name
+FROM pets WHERE id = 2;
+\d pets
+\begin
+DELETE FROM pets;
+SELECT nope FROM pets;
+\rollback
+\bogus
+SELECT count(*) AS n FROM pets`
+	if err := runScript(sh, "pets.sql", strings.NewReader(script)); err != nil {
+		t.Fatalf("runScript error: %v", err)
+	}
+	expected := `CREATE TABLE
+INSERT 0 2
+ name
+------
+ tom
+(1 row)
+
+        Table "pets"
+ Column |  Type   | Nullable
+--------+---------+----------
+ id     | integer | not null
+ name   | text    |
+Indexes:
+    "pets_pkey" PRIMARY KEY (id)
+
+BEGIN
+DELETE 2
+ROLLBACK
+ n
+---
+ 2
+(1 row)
+
+`
+	if out.String() != expected {
+		t.Errorf("runScript error: expected\n%s\nbut got\n%s", expected, out.String())
+	}
+	errors := `darsql:pets.sql:8: ERROR:  column "nope" does not exist
+LINE 1: SELECT nope FROM pets;
+               ^
+invalid command \bogus
+Try \? for help.
+`
+	if errOut.String() != errors || !sh.failed {
+		t.Errorf("runScript error: expected errors\n%s\nbut got\n%s", errors, errOut.String())
+	}
+
+	out.Reset()
+	sh.feed(`\dt`, 1)
+	sh.feed(`\timing on`, 2)
+	sh.feed(`SELECT 1;`, 3)
+	if !strings.Contains(out.String(), " pets | table\n") || !strings.Contains(out.String(), "Time: ") {
+		t.Errorf("feed error: unexpected output\n%s", out.String())
+	}
+	if err := sh.feed(`\q`, 4); err != errQuit {
+		t.Errorf("feed error: expected \\q to quit but got %v", err)
+	}
+}
+
+func TestShellPrompt(t *testing.T) {
+	sh, _, _ := testShell(t)
+	prompts := []struct {
+		line   string
+		prompt string
+	}{
+		{"", "db=> "},
+		{"SELECT", "db-> "},
+		{"1;", "db=> "},
+		{`\begin`, "db=*> "},
+		{"SELECT nope;", "db=!> "},
+		{"ROLLBACK;", "db=> "},
+	}
+	for i, p := range prompts {
+		sh.feed(p.line, i+1)
+		if got := sh.prompt("db"); got != p.prompt {
+			t.Errorf("prompt error: after %q expected %q but got %q", p.line, p.prompt, got)
+		}
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+/* Line editing is only supported on Linux; elsewhere lines are read as the terminal gives them */
+func isTerminal(fd int) bool {
+	return false
+}
+
+func makeRaw(fd int) (func(), error) {
+	return nil, errors.New("raw mode is not supported")
+}
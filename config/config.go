@@ -1,12 +1,53 @@
 package config
 
+import (
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/misachi/DarDB/storage"
+)
+
 var Cfg *Config
 
+/* WalSyncMethod is how the WAL makes flushed entries durable */
+type WalSyncMethod uint8
+
+const (
+	WAL_SYNC_FSYNC     WalSyncMethod = iota // File.Sync after writing
+	WAL_SYNC_FDATASYNC                      // fdatasync, which skips metadata such as the modification time
+	WAL_SYNC_DSYNC                          // Segments are opened with O_DSYNC so every write is durable
+)
+
 type Config struct {
 	bufferSize    uint64
 	walBufferSize uint64
 	dataPath      string
 	// walPath       string
+	bgWriterDelay       time.Duration
+	bgWriterMaxPages    int
+	checkpointTimeout   time.Duration
+	autovacuumDelay     time.Duration
+	autovacuumThreshold float64
+	fs                  storage.FS
+	directIO            bool
+	walSync             WalSyncMethod
+	blockSize           int
+	masterKeyFile       string
+	masterKeyEnv        string
+	workMem             int64
+	engine              Engine
+}
+
+/*
+Engine is the state the storage engine keeps for the databases opened with a config: its buffer
+pool, WAL, catalog and clients. Databases opened with the same config share it; those opened with
+different configs share nothing.
+*/
+type Engine interface {
+	Close() error
 }
 
 func NewConfig(path string, bufSz, walBufSz uint64) *Config {
@@ -37,3 +78,155 @@ func (c Config) DataPath() string {
 // func (c Config) WalDataPath() string {
 // 	return c.walPath
 // }
+
+/* BgWriterDelay is the pause between background writer rounds. Zero uses the default */
+func (c Config) BgWriterDelay() time.Duration {
+	return c.bgWriterDelay
+}
+
+func (c *Config) SetBgWriterDelay(delay time.Duration) {
+	c.bgWriterDelay = delay
+}
+
+/* BgWriterMaxPages caps the blocks written per background writer round. Zero uses the default */
+func (c Config) BgWriterMaxPages() int {
+	return c.bgWriterMaxPages
+}
+
+func (c *Config) SetBgWriterMaxPages(maxPages int) {
+	c.bgWriterMaxPages = maxPages
+}
+
+/* CheckpointTimeout is the time between checkpoints. Zero uses the default */
+func (c Config) CheckpointTimeout() time.Duration {
+	return c.checkpointTimeout
+}
+
+func (c *Config) SetCheckpointTimeout(timeout time.Duration) {
+	c.checkpointTimeout = timeout
+}
+
+/* AutovacuumDelay is the pause between autovacuum rounds. Zero uses the default */
+func (c Config) AutovacuumDelay() time.Duration {
+	return c.autovacuumDelay
+}
+
+func (c *Config) SetAutovacuumDelay(delay time.Duration) {
+	c.autovacuumDelay = delay
+}
+
+/* AutovacuumThreshold is the share of free space in the blocks of a table that makes autovacuum vacuum it. Zero uses the default */
+func (c Config) AutovacuumThreshold() float64 {
+	return c.autovacuumThreshold
+}
+
+func (c *Config) SetAutovacuumThreshold(threshold float64) {
+	c.autovacuumThreshold = threshold
+}
+
+/* FS is the filesystem the data files live in. Nil uses the OS filesystem */
+func (c Config) FS() storage.FS {
+	if c.fs == nil {
+		return storage.OSFS{}
+	}
+	return c.fs
+}
+
+func (c *Config) SetFS(fs storage.FS) {
+	c.fs = fs
+}
+
+/* DirectIO opens table files with O_DIRECT so blocks are cached only in the buffer pool */
+func (c Config) DirectIO() bool {
+	return c.directIO
+}
+
+func (c *Config) SetDirectIO(direct bool) {
+	c.directIO = direct
+}
+
+func (c Config) WalSync() WalSyncMethod {
+	return c.walSync
+}
+
+func (c *Config) SetWalSync(method WalSyncMethod) {
+	c.walSync = method
+}
+
+/* BlockSize is the block size of tables created in new databases. Zero uses the default */
+func (c Config) BlockSize() int {
+	return c.blockSize
+}
+
+func (c *Config) SetBlockSize(size int) {
+	c.blockSize = size
+}
+
+/* MasterKeyFile is a file holding the master key, as 32 raw bytes or 64 hex digits */
+func (c Config) MasterKeyFile() string {
+	return c.masterKeyFile
+}
+
+func (c *Config) SetMasterKeyFile(path string) {
+	c.masterKeyFile = path
+}
+
+/* MasterKeyEnv names an environment variable holding the master key as 64 hex digits */
+func (c Config) MasterKeyEnv() string {
+	return c.masterKeyEnv
+}
+
+func (c *Config) SetMasterKeyEnv(name string) {
+	c.masterKeyEnv = name
+}
+
+/* WorkMem is the memory in bytes a sort or hash table of a query may use before it spills to temp files. Zero uses the default */
+func (c Config) WorkMem() int64 {
+	return c.workMem
+}
+
+func (c *Config) SetWorkMem(bytes int64) {
+	c.workMem = bytes
+}
+
+/*
+MasterKey is the key the data keys of encrypted databases are wrapped with, read from the key file
+or else the environment variable. Without either it is nil and new tables are not encrypted.
+*/
+func (c Config) MasterKey() ([]byte, error) {
+	if c.masterKeyFile != "" {
+		data, err := os.ReadFile(c.masterKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("MasterKey: %v", err)
+		}
+		if len(data) == storage.KEY_SIZE {
+			return data, nil
+		}
+		return decodeMasterKey(string(data), c.masterKeyFile)
+	}
+	if c.masterKeyEnv != "" {
+		val, ok := os.LookupEnv(c.masterKeyEnv)
+		if !ok {
+			return nil, fmt.Errorf("MasterKey: %s is not set", c.masterKeyEnv)
+		}
+		return decodeMasterKey(val, c.masterKeyEnv)
+	}
+	return nil, nil
+}
+
+func decodeMasterKey(text, source string) ([]byte, error) {
+	key, err := hex.DecodeString(strings.TrimSpace(text))
+	if err != nil || len(key) != storage.KEY_SIZE {
+		return nil, fmt.Errorf("MasterKey: %s does not hold %d hex encoded bytes", source, storage.KEY_SIZE)
+	}
+	return key, nil
+}
+
+/* Engine is the storage engine state of the config, nil until a database is opened with it. The storage engine serializes access */
+func (c *Config) Engine() Engine {
+	return c.engine
+}
+
+func (c *Config) SetEngine(engine Engine) {
+	c.engine = engine
+}
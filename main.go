@@ -11,7 +11,9 @@ import (
 func main() {
 	cfg := config.NewConfig("/tmp/DarDB", 0, 0)
 	_db := db.NewDB("myDB", cfg)
-	ctx := db.GetClientContextMgr().NewClientCtx(cfg, _db)
+	workers := db.StartBgWorkers(cfg)
+	defer workers.Stop()
+	ctx := db.GetClientContextMgr(cfg).NewClientCtx(cfg, _db)
 	schema := map[string]col.SUPPORTED_TYPE{
 		"id":   col.INT64,
 		"name": col.STRING,
@@ -27,7 +29,9 @@ func main() {
 		"name": []byte("HeIsYOu"),
 	}
 	_db.AddRecord(ctx, tbl, data)
-	tbl.Flush()
+	if err := ctx.Commit(); err != nil {
+		fmt.Println(err)
+	}
 
 	recs, err := _db.GetRecord(ctx, tbl, "name", []byte("HeIsYOu"))
 	if err != nil {
@@ -0,0 +1,364 @@
+package sql
+
+import (
+	"math/bits"
+
+	"github.com/misachi/DarDB/storage/db"
+)
+
+/*
+Aggregates return a row per group of their input rows: the values of GroupBy followed by the
+results of Aggs. Rows with equal GroupBy values, NULLs included, are a group. Without GroupBy all
+the rows are one group, which is returned even when there are none.
+*/
+
+const AGG_STATE_SIZE = 96 // Bytes an aggregate of a group is estimated to take in memory
+
+/*
+aggState accumulates an aggregate over the rows of a group. Integers are summed exactly in 128
+bits, hi:lo, so a sum fails only if its result does not fit, whatever the order of the rows.
+Floats are summed as doubles.
+*/
+type aggState struct {
+	count    int64
+	hi       int64
+	lo       uint64
+	sum      float64
+	best     Value // MIN or MAX so far
+	distinct map[string]bool
+}
+
+/* add adds r to the aggregate, returning the bytes the state grew by */
+func (s *aggState) add(call *FuncCall, r Row) (int64, error) {
+	if call.Star {
+		s.count++
+		return 0, nil
+	}
+	v, err := Eval(call.Args[0], r)
+	if err != nil || v.IsNull() {
+		return 0, err
+	}
+	var grown int64
+	if call.Distinct {
+		key := string(appendKey(nil, v))
+		if s.distinct[key] {
+			return 0, nil
+		}
+		if s.distinct == nil {
+			s.distinct = make(map[string]bool)
+		}
+		s.distinct[key] = true
+		grown = int64(len(key)) + 48
+	}
+	s.count++
+	switch call.Name {
+	case "sum", "avg":
+		var carry uint64
+		switch v.Kind {
+		case KIND_INT:
+			s.lo, carry = bits.Add64(s.lo, uint64(v.I), 0)
+			s.hi += int64(carry) + v.I>>63
+		case KIND_UINT:
+			s.lo, carry = bits.Add64(s.lo, v.U, 0)
+			s.hi += int64(carry)
+		default:
+			s.sum += v.F
+		}
+	case "min":
+		if s.count == 1 || compare(v, s.best) < 0 {
+			s.best = v
+		}
+	case "max":
+		if s.count == 1 || compare(v, s.best) > 0 {
+			s.best = v
+		}
+	}
+	return grown, nil
+}
+
+/* result is the value of the aggregate. Only COUNT of no rows is not NULL */
+func (s *aggState) result(call *FuncCall) (Value, error) {
+	switch {
+	case call.Name == "count":
+		return Int(s.count), nil
+	case s.count == 0:
+		return Null(), nil
+	case call.Name == "min" || call.Name == "max":
+		return s.best, nil
+	case call.Name == "avg":
+		return Float(s.total() / float64(s.count)), nil
+	}
+	switch call.Kind() {
+	case KIND_INT:
+		if s.hi != int64(s.lo)>>63 {
+			return Null(), errorf(SQLSTATE_OUT_OF_RANGE, call.pos, "bigint out of range")
+		}
+		return Int(int64(s.lo)), nil
+	case KIND_UINT:
+		if s.hi != 0 {
+			return Null(), errorf(SQLSTATE_OUT_OF_RANGE, call.pos, "uint64 out of range")
+		}
+		return Uint(s.lo), nil
+	}
+	return Float(s.total()), nil
+}
+
+/* total is the sum as a double */
+func (s *aggState) total() float64 {
+	if s.hi == int64(s.lo)>>63 {
+		return s.sum + float64(int64(s.lo))
+	}
+	return s.sum + float64(s.hi)*(1<<64) + float64(s.lo)
+}
+
+type aggGroup struct {
+	values Row // The GROUP BY values
+	states []aggState
+}
+
+func newAggGroup(values Row, aggs int) *aggGroup {
+	return &aggGroup{values: values, states: make([]aggState, aggs)}
+}
+
+func (g *aggGroup) add(aggs []*FuncCall, r Row) (int64, error) {
+	var grown int64
+	for i, call := range aggs {
+		n, err := g.states[i].add(call, r)
+		if err != nil {
+			return 0, err
+		}
+		grown += n
+	}
+	return grown, nil
+}
+
+func (g *aggGroup) row(aggs []*FuncCall) (Row, error) {
+	out := make(Row, len(g.values), len(g.values)+len(aggs))
+	copy(out, g.values)
+	for i, call := range aggs {
+		v, err := g.states[i].result(call)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, v)
+	}
+	return out, nil
+}
+
+/* groupKey evaluates the GROUP BY values of r, returning them with their encoding as a hash key */
+func groupKey(keys []Expr, r Row) (string, Row, error) {
+	values := make(Row, len(keys))
+	var buf []byte
+	for i, e := range keys {
+		v, err := Eval(e, r)
+		if err != nil {
+			return "", nil, err
+		}
+		values[i] = v
+		buf = appendKey(buf, v)
+	}
+	return string(buf), values, nil
+}
+
+/*
+HashAggregate keeps its groups in a hash table. Once the table outgrows WorkMem, the rows of
+groups not in it yet are written to partitions in temp files by key, and the groups in the table
+keep being added to. The partitions are aggregated one at a time after those groups are returned,
+splitting again any whose groups still do not fit.
+*/
+type HashAggregate struct {
+	Child   Operator
+	GroupBy []Expr
+	Aggs    []*FuncCall
+	WorkMem int64 // Zero uses the config
+
+	ctx       *db.ClientContext
+	mem       int64
+	groups    map[string]*aggGroup
+	order     []*aggGroup // Groups in the order they were first seen
+	next      int
+	pending   []*aggPartition
+	spilled   int // Partitions written, for tests and EXPLAIN
+	childOpen bool
+}
+
+type aggPartition struct {
+	rows  *spillFile
+	depth int
+}
+
+func (a *HashAggregate) Open(ctx *db.ClientContext) error {
+	a.ctx, a.mem = ctx, workMem(ctx, a.WorkMem)
+	a.pending, a.spilled = nil, 0
+	if err := a.Child.Open(ctx); err != nil {
+		return err
+	}
+	a.childOpen = true
+	if err := a.consume(a.Child.Next, 0); err != nil {
+		return err
+	}
+	a.childOpen = false
+	if err := a.Child.Close(); err != nil {
+		return err
+	}
+	if len(a.GroupBy) == 0 && len(a.order) == 0 {
+		a.order = []*aggGroup{newAggGroup(nil, len(a.Aggs))}
+	}
+	return nil
+}
+
+/* consume aggregates the rows of next into a new table, spilling to partitions of the given depth */
+func (a *HashAggregate) consume(next func() (Row, error), depth int) error {
+	a.groups, a.order, a.next = make(map[string]*aggGroup), nil, 0
+	var parts []*aggPartition
+	var size int64
+	for {
+		r, err := next()
+		if err != nil || r == nil {
+			return err
+		}
+		key, values, err := groupKey(a.GroupBy, r)
+		if err != nil {
+			return err
+		}
+		g := a.groups[key]
+		if g == nil && parts != nil {
+			if err := parts[partitionOf(key, depth)].rows.write(r); err != nil {
+				return err
+			}
+			continue
+		}
+		if g == nil {
+			g = newAggGroup(values, len(a.Aggs))
+			a.groups[key] = g
+			a.order = append(a.order, g)
+			size += rowSize(values) + int64(len(key)) + AGG_STATE_SIZE*int64(len(a.Aggs))
+		}
+		grown, err := g.add(a.Aggs, r)
+		if err != nil {
+			return err
+		}
+		size += grown
+		if size > a.mem && parts == nil && len(a.GroupBy) > 0 && depth < MAX_PARTITION_DEPTH {
+			if parts, err = a.newPartitions(depth); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+/* newPartitions creates partitions of the given depth, queued to be aggregated before those pending */
+func (a *HashAggregate) newPartitions(depth int) ([]*aggPartition, error) {
+	parts := make([]*aggPartition, HASH_PARTITIONS)
+	for i := range parts {
+		f, err := newSpillFile(a.ctx)
+		if err != nil {
+			closeAggPartitions(parts[:i])
+			return nil, err
+		}
+		parts[i] = &aggPartition{rows: f, depth: depth}
+	}
+	a.pending = append(parts, a.pending...)
+	a.spilled += len(parts)
+	return parts, nil
+}
+
+func closeAggPartitions(parts []*aggPartition) {
+	for _, p := range parts {
+		p.rows.close()
+	}
+}
+
+func (a *HashAggregate) Next() (Row, error) {
+	for a.next >= len(a.order) {
+		if len(a.pending) == 0 {
+			return nil, nil
+		}
+		p := a.pending[0]
+		a.pending = a.pending[1:]
+		err := p.rows.rewind()
+		if err == nil {
+			err = a.consume(p.rows.read, p.depth+1)
+		}
+		p.rows.close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	g := a.order[a.next]
+	a.next++
+	return g.row(a.Aggs)
+}
+
+func (a *HashAggregate) Close() error {
+	a.groups, a.order = nil, nil
+	closeAggPartitions(a.pending)
+	a.pending = nil
+	if !a.childOpen {
+		return nil
+	}
+	a.childOpen = false
+	return a.Child.Close()
+}
+
+/*
+GroupAggregate aggregates input sorted on GroupBy, so the rows of a group come one after the
+other and each group is returned once the row after its last is read. Only one group is in
+memory at a time.
+*/
+type GroupAggregate struct {
+	Child   Operator
+	GroupBy []Expr
+	Aggs    []*FuncCall
+
+	group *aggGroup
+	key   string
+	done  bool
+}
+
+func (a *GroupAggregate) Open(ctx *db.ClientContext) error {
+	a.group, a.key, a.done = nil, "", false
+	return a.Child.Open(ctx)
+}
+
+func (a *GroupAggregate) Next() (Row, error) {
+	for !a.done {
+		r, err := a.Child.Next()
+		if err != nil {
+			return nil, err
+		}
+		if r == nil {
+			a.done = true
+			if a.group == nil && len(a.GroupBy) == 0 {
+				a.group = newAggGroup(nil, len(a.Aggs))
+			}
+			break
+		}
+		key, values, err := groupKey(a.GroupBy, r)
+		if err != nil {
+			return nil, err
+		}
+		var finished *aggGroup
+		if a.group == nil || key != a.key {
+			finished = a.group
+			a.group, a.key = newAggGroup(values, len(a.Aggs)), key
+		}
+		if _, err := a.group.add(a.Aggs, r); err != nil {
+			return nil, err
+		}
+		if finished != nil {
+			return finished.row(a.Aggs)
+		}
+	}
+	if a.group == nil {
+		return nil, nil
+	}
+	g := a.group
+	a.group = nil
+	return g.row(a.Aggs)
+}
+
+func (a *GroupAggregate) Close() error {
+	a.group = nil
+	return a.Child.Close()
+}
@@ -0,0 +1,132 @@
+package sql
+
+import (
+	"fmt"
+	"path"
+	"testing"
+
+	"github.com/misachi/DarDB/storage/db"
+)
+
+func TestAggregateOperators(t *testing.T) {
+	_, ctx := testSession(t)
+	var rows []Row
+	for i := 0; i < 300; i++ {
+		value := Int(int64(i))
+		if i%7 == 0 {
+			value = Null()
+		}
+		rows = append(rows, Row{Int(int64(i % 40)), value})
+	}
+	group := []Expr{col(0)}
+	aggs := []*FuncCall{
+		{exprBase: exprBase{kind: KIND_INT}, Name: "count", Star: true},
+		{exprBase: exprBase{kind: KIND_INT}, Name: "sum", Args: []Expr{col(1)}},
+		{exprBase: exprBase{kind: KIND_INT}, Name: "max", Args: []Expr{col(1)}},
+		{exprBase: exprBase{kind: KIND_INT}, Name: "count", Args: []Expr{&Binary{exprBase: exprBase{kind: KIND_INT}, Op: "%", Left: col(1), Right: lit(Int(3))}}, Distinct: true},
+	}
+
+	sorted, err := Run(ctx, &GroupAggregate{Child: &Sort{Child: valuesOf(rows...), Keys: []*OrderItem{{Expr: col(0)}}}, GroupBy: group, Aggs: aggs})
+	if err != nil {
+		t.Fatalf("GroupAggregate error: %v", err)
+	}
+	if len(sorted) != 40 || rowsText(sorted[:2]) != "0|8|840|240|3\n1|8|967|281|3" {
+		t.Fatalf("GroupAggregate error: unexpected groups\n%s", rowsText(sorted))
+	}
+	for _, mem := range []int64{0, 1} {
+		hash := &HashAggregate{Child: valuesOf(rows...), GroupBy: group, Aggs: aggs, WorkMem: mem}
+		got, err := Run(ctx, hash)
+		if err != nil {
+			t.Fatalf("HashAggregate error: %v", err)
+		}
+		if sortedText(got) != sortedText(sorted) {
+			t.Errorf("HashAggregate error: with WorkMem %d expected\n%s\nbut got\n%s", mem, sortedText(sorted), sortedText(got))
+		}
+		if (hash.spilled > 0) != (mem > 0) {
+			t.Errorf("HashAggregate error: with WorkMem %d unexpected %d spilled partitions", mem, hash.spilled)
+		}
+	}
+	files, err := testDBCfg.FS().ReadDir(path.Join(testDBCfg.DataPath(), db.TEMP_DIR))
+	if err != nil {
+		t.Fatalf("ReadDir error: %v", err)
+	}
+	if len(files) != 0 {
+		t.Errorf("HashAggregate error: %d temp files left", len(files))
+	}
+
+	// Without GROUP BY there is a group even when there are no rows
+	for _, op := range []Operator{&HashAggregate{Child: valuesOf(), Aggs: aggs}, &GroupAggregate{Child: valuesOf(), Aggs: aggs}} {
+		got, err := Run(ctx, op)
+		if err != nil || rowsText(got) != "0|NULL|NULL|0" {
+			t.Errorf("%T error: expected one group of no rows but got %v\n%s", op, err, rowsText(got))
+		}
+	}
+	if got, err := Run(ctx, &GroupAggregate{Child: valuesOf(), GroupBy: group, Aggs: aggs}); err != nil || len(got) != 0 {
+		t.Errorf("GroupAggregate error: expected no groups but got %v %v", got, err)
+	}
+}
+
+func TestAggregate(t *testing.T) {
+	s, _ := testSession(t)
+	exec(t, s, "CREATE TABLE metrics (id int PRIMARY KEY, grp text, n bigint, u uint64, f double, small smallint)")
+	exec(t, s, "INSERT INTO metrics (id, grp, n, u, f, small) VALUES (1, 'a', 10, 1, 1.5, 1), (2, 'a', 20, 2, 2.5, 2), (3, 'b', NULL, 3, NULL, 3), (4, 'b', 5, NULL, 0.5, 3), (5, NULL, 7, 4, 1, NULL)")
+	exec(t, s, "CREATE TABLE big (id int PRIMARY KEY, v bigint, w uint64)")
+	exec(t, s, "INSERT INTO big (id, v, w) VALUES (1, 9223372036854775807, 18446744073709551615), (2, 1, 1), (3, -5, 0)")
+	t.Cleanup(func() { s.Exec("DROP TABLE metrics; DROP TABLE big") })
+
+	tests := []struct {
+		query    string
+		expected string
+	}{
+		{"SELECT count(*), count(n), sum(n), avg(n), min(grp), max(f) FROM metrics", "5|4|42|10.5|a|2.5"},
+		{"SELECT grp, count(*), sum(n) FROM metrics GROUP BY grp ORDER BY grp", "a|2|30\nb|2|5\nNULL|1|7"},
+		{"SELECT grp, count(*), sum(n) FROM metrics GROUP BY grp ORDER BY grp DESC", "NULL|1|7\nb|2|5\na|2|30"},
+		{"SELECT grp, sum(u) FROM metrics GROUP BY grp HAVING count(n) = 2", "a|3"},
+		{"SELECT grp, sum(f) AS total FROM metrics GROUP BY 1 ORDER BY total DESC NULLS LAST", "a|4\nNULL|1\nb|0.5"},
+		{"SELECT count(DISTINCT small), sum(DISTINCT small), avg(small), sum(f) FROM metrics", "3|6|2.25|5.5"},
+		{"SELECT n % 2 AS odd, count(*) FROM metrics GROUP BY odd ORDER BY odd", "0|2\n1|2\nNULL|1"},
+		{"SELECT count(*), sum(n), max(grp) FROM metrics WHERE id < 0", "0|NULL|NULL"},
+		{"SELECT grp FROM metrics WHERE id < 0 GROUP BY grp", ""},
+		{"SELECT m.grp, count(*) FROM metrics m JOIN metrics o ON m.grp = o.grp GROUP BY m.grp ORDER BY count(*) DESC, 1", "a|4\nb|4"},
+		{"SELECT count(*) + 1, max(id) - min(id) FROM metrics HAVING count(*) > 1", "6|4"},
+		{"SELECT sum(v), avg(v) FROM big", "9223372036854775803|3.0744573456182584e+18"},
+		{"SELECT sum(v), sum(w) FROM big WHERE id > 1", "-4|1"},
+	}
+	for _, test := range tests {
+		r := exec(t, s, test.query)
+		if got := rowsText(r.Rows); got != test.expected {
+			t.Errorf("Exec error: %s: expected\n%s\nbut got\n%s", test.query, test.expected, got)
+		}
+	}
+
+	// Groups asked for in the order of their values are aggregated from sorted rows, others in a hash table
+	plans := map[string]string{
+		"SELECT grp, count(*) FROM metrics GROUP BY grp ORDER BY grp":      "*sql.GroupAggregate",
+		"SELECT grp, count(*) FROM metrics GROUP BY grp ORDER BY count(*)": "*sql.HashAggregate",
+		"SELECT grp, count(*) FROM metrics GROUP BY grp":                   "*sql.HashAggregate",
+	}
+	for query, expected := range plans {
+		op, err := Plan(bind(t, testDB(t), query))
+		if err != nil {
+			t.Fatalf("Plan error: %s: %v", query, err)
+		}
+		op = op.(*Project).Child
+		if sort, ok := op.(*Sort); ok {
+			op = sort.Child
+		}
+		if got := fmt.Sprintf("%T", op); got != expected {
+			t.Errorf("Plan error: %s: expected %s but got %s", query, expected, got)
+		}
+	}
+
+	r := exec(t, s, "SELECT sum(small), max(small), avg(small), count(*) FROM metrics")
+	types := []string{"bigint", "smallint", "double", "bigint"}
+	for i, col := range r.Columns {
+		if TypeName(col.Type) != types[i] {
+			t.Errorf("Exec error: expected column %s of type %s but got %s", col.Name, types[i], TypeName(col.Type))
+		}
+	}
+
+	execError(t, s, "SELECT sum(v) FROM big WHERE id < 3", SQLSTATE_OUT_OF_RANGE)
+	execError(t, s, "SELECT sum(w) FROM big", SQLSTATE_OUT_OF_RANGE)
+}
@@ -0,0 +1,358 @@
+package sql
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/misachi/DarDB/column"
+	"github.com/misachi/DarDB/storage/db"
+)
+
+/* Stmt is a parsed statement. Bind resolves its names against the catalog in place */
+type Stmt interface {
+	stmt()
+}
+
+/* Expr is an expression. Kind is the type of its values, known once the statement is bound */
+type Expr interface {
+	Pos() int
+	Kind() Kind
+}
+
+type exprBase struct {
+	pos  int
+	kind Kind
+}
+
+func (e *exprBase) Pos() int   { return e.pos }
+func (e *exprBase) Kind() Kind { return e.kind }
+
+/* ColumnDef is a column of CREATE TABLE */
+type ColumnDef struct {
+	Name       string
+	Type       column.SUPPORTED_TYPE
+	PrimaryKey bool
+	NotNull    bool // Only the primary key can be NOT NULL, and it always is
+	Pos        int
+}
+
+type CreateTableStmt struct {
+	Name        string
+	IfNotExists bool
+	Columns     []ColumnDef
+	PrimaryKey  string // The first column unless one is declared
+	Pos         int
+}
+
+type DropTableStmt struct {
+	Name     string
+	IfExists bool
+	Pos      int
+}
+
+type InsertStmt struct {
+	Table   *TableRef
+	Columns []string // Every column of the table in storage order when none are named
+	Rows    [][]Expr
+
+	Targets []int // Bound: the table column each value is stored in
+}
+
+/* SelectItem is an expression of the select list, or * when Star is set */
+type SelectItem struct {
+	Expr  Expr
+	Alias string
+	Star  bool
+	Table string // Qualifier of table.*
+	Pos   int
+}
+
+/* ResultColumn describes a column of a statement's result */
+type ResultColumn struct {
+	Name string
+	Kind Kind
+	Type column.SUPPORTED_TYPE // Type of the column read when the item is a plain column reference
+}
+
+/* Nulls orders NULL values of a sort key. The default puts them last ascending and first descending */
+type Nulls int
+
+const (
+	NULLS_DEFAULT Nulls = iota
+	NULLS_FIRST
+	NULLS_LAST
+)
+
+type OrderItem struct {
+	Expr  Expr
+	Desc  bool
+	Nulls Nulls
+}
+
+/* NullsFirst reports whether NULL values sort before the others */
+func (o *OrderItem) NullsFirst() bool {
+	if o.Nulls == NULLS_DEFAULT {
+		return o.Desc
+	}
+	return o.Nulls == NULLS_FIRST
+}
+
+type SelectStmt struct {
+	Items   []*SelectItem
+	From    TableExpr // Nil for SELECT without FROM
+	Where   Expr
+	GroupBy []Expr
+	Having  Expr
+	OrderBy []*OrderItem
+	Limit   Expr
+	Offset  Expr
+
+	Columns    []ResultColumn // Bound: the columns of the result, after * is expanded
+	Grouped    bool           // Bound: the rows are grouped, by GROUP BY, HAVING or an aggregate
+	Aggregates []*FuncCall    // Bound: the aggregates computed for every group, over the input rows
+}
+
+type Assignment struct {
+	Column string
+	Value  Expr
+	Pos    int
+
+	Index int // Bound: the table column assigned
+}
+
+type UpdateStmt struct {
+	Table *TableRef
+	Set   []*Assignment
+	Where Expr
+}
+
+type DeleteStmt struct {
+	Table *TableRef
+	Where Expr
+}
+
+/* ExplainFormat is how EXPLAIN writes a plan */
+type ExplainFormat int
+
+const (
+	EXPLAIN_TEXT ExplainFormat = iota // An indented line per operator, as psql shows it
+	EXPLAIN_JSON                      // A single JSON document
+)
+
+/* ExplainStmt shows the plan of a query or data change. With Analyze it runs the statement too */
+type ExplainStmt struct {
+	Stmt    Stmt
+	Analyze bool
+	Format  ExplainFormat
+}
+
+type BeginStmt struct{}
+type CommitStmt struct{}
+type RollbackStmt struct{}
+
+func (*CreateTableStmt) stmt() {}
+func (*DropTableStmt) stmt()   {}
+func (*InsertStmt) stmt()      {}
+func (*SelectStmt) stmt()      {}
+func (*UpdateStmt) stmt()      {}
+func (*DeleteStmt) stmt()      {}
+func (*ExplainStmt) stmt()     {}
+func (*BeginStmt) stmt()       {}
+func (*CommitStmt) stmt()      {}
+func (*RollbackStmt) stmt()    {}
+
+/* TableExpr is an item of a FROM clause */
+type TableExpr interface {
+	tableExpr()
+}
+
+/* TableRef names a table. Columns of the table are read at Offset of the rows its scope builds */
+type TableRef struct {
+	Name  string
+	Alias string
+	Pos   int
+
+	Table  *db.Table // Bound
+	Offset int       // Bound
+}
+
+func (*TableRef) tableExpr() {}
+
+/* JoinType is how a join matches the rows of its left input with those of its right input */
+type JoinType int
+
+const (
+	JOIN_INNER JoinType = iota // Pairs of rows that match
+	JOIN_LEFT                  // As inner, plus left rows without a match padded with NULLs
+	JOIN_SEMI                  // Left rows with a match, once each
+	JOIN_ANTI                  // Left rows without a match
+)
+
+func (t JoinType) String() string {
+	switch t {
+	case JOIN_LEFT:
+		return "Left"
+	case JOIN_SEMI:
+		return "Semi"
+	case JOIN_ANTI:
+		return "Anti"
+	}
+	return "Inner"
+}
+
+/* JoinExpr joins two FROM items. Joins nest to the left, so Right is a table; cross joins have no On */
+type JoinExpr struct {
+	Type        JoinType
+	Left, Right TableExpr
+	On          Expr
+	Pos         int
+}
+
+func (*JoinExpr) tableExpr() {}
+
+/* RefName is the name columns of the table are qualified with */
+func (t *TableRef) RefName() string {
+	if t.Alias != "" {
+		return t.Alias
+	}
+	return t.Name
+}
+
+/* Literal is a constant. Quoted strings stay untyped until compared with or stored in a column */
+type Literal struct {
+	exprBase
+	Value   Value
+	untyped bool
+}
+
+/* ColumnRef is a column of a table in scope. Bound, Index is its position in the input row */
+type ColumnRef struct {
+	exprBase
+	Table string
+	Name  string
+	Index int
+	Type  column.SUPPORTED_TYPE // Bound
+}
+
+/* Param is the parameter $Index+1 of a prepared statement. Its kind is unknown until its use decides it */
+type Param struct {
+	exprBase
+	Index int
+
+	params *params // Bound: the statement's parameters, which hold the values of the current run
+}
+
+/* Unary is -X or NOT X */
+type Unary struct {
+	exprBase
+	Op string
+	X  Expr
+}
+
+/* Binary is an arithmetic, comparison, logical or || operator */
+type Binary struct {
+	exprBase
+	Op          string
+	Left, Right Expr
+}
+
+type IsNull struct {
+	exprBase
+	X   Expr
+	Not bool
+}
+
+type Like struct {
+	exprBase
+	X, Pattern Expr
+	Not        bool
+}
+
+type In struct {
+	exprBase
+	X    Expr
+	List []Expr
+	Not  bool
+}
+
+type Between struct {
+	exprBase
+	X, Low, High Expr
+	Not          bool
+}
+
+type FuncCall struct {
+	exprBase
+	Name     string
+	Args     []Expr
+	Star     bool // COUNT(*)
+	Distinct bool
+}
+
+/* FormatExpr renders e as SQL, with every operation in parentheses so the grouping is visible */
+func FormatExpr(e Expr) string {
+	switch e := e.(type) {
+	case *Literal:
+		switch e.Value.Kind {
+		case KIND_NULL:
+			return "NULL"
+		case KIND_STRING:
+			return "'" + strings.ReplaceAll(e.Value.S, "'", "''") + "'"
+		case KIND_BOOL:
+			if e.Value.B {
+				return "true"
+			}
+			return "false"
+		}
+		return e.Value.String()
+	case *ColumnRef:
+		if e.Table != "" {
+			return e.Table + "." + e.Name
+		}
+		return e.Name
+	case *Param:
+		return "$" + strconv.Itoa(e.Index+1)
+	case *Unary:
+		if e.Op == "NOT" {
+			return "(NOT " + FormatExpr(e.X) + ")"
+		}
+		return "(" + e.Op + FormatExpr(e.X) + ")"
+	case *Binary:
+		return "(" + FormatExpr(e.Left) + " " + e.Op + " " + FormatExpr(e.Right) + ")"
+	case *IsNull:
+		if e.Not {
+			return "(" + FormatExpr(e.X) + " IS NOT NULL)"
+		}
+		return "(" + FormatExpr(e.X) + " IS NULL)"
+	case *Like:
+		return "(" + FormatExpr(e.X) + not(e.Not) + " LIKE " + FormatExpr(e.Pattern) + ")"
+	case *In:
+		return "(" + FormatExpr(e.X) + not(e.Not) + " IN (" + formatList(e.List) + "))"
+	case *Between:
+		return "(" + FormatExpr(e.X) + not(e.Not) + " BETWEEN " + FormatExpr(e.Low) + " AND " + FormatExpr(e.High) + ")"
+	case *FuncCall:
+		switch {
+		case e.Star:
+			return e.Name + "(*)"
+		case e.Distinct:
+			return e.Name + "(DISTINCT " + formatList(e.Args) + ")"
+		}
+		return e.Name + "(" + formatList(e.Args) + ")"
+	}
+	return "?"
+}
+
+func formatList(list []Expr) string {
+	parts := make([]string, len(list))
+	for i, e := range list {
+		parts[i] = FormatExpr(e)
+	}
+	return strings.Join(parts, ", ")
+}
+
+func not(negated bool) string {
+	if negated {
+		return " NOT"
+	}
+	return ""
+}
@@ -0,0 +1,883 @@
+package sql
+
+import (
+	"errors"
+
+	"github.com/misachi/DarDB/column"
+	"github.com/misachi/DarDB/storage/db"
+)
+
+/* scope is the tables an expression can refer to. Their columns are laid out one table after the other in the input row */
+type scope struct {
+	tables []*TableRef
+	width  int
+}
+
+func (sc *scope) add(ref *TableRef) error {
+	for _, t := range sc.tables {
+		if t.RefName() == ref.RefName() {
+			return errorf(SQLSTATE_DUPLICATE_ALIAS, ref.Pos, "table name %q specified more than once", ref.RefName())
+		}
+	}
+	ref.Offset = sc.width
+	sc.tables = append(sc.tables, ref)
+	sc.width += len(ref.Table.GetInfo().Column)
+	return nil
+}
+
+/* resolve finds the column ref names, failing if no table or more than one table in scope has it */
+func (sc *scope) resolve(ref *ColumnRef) error {
+	found := false
+	qualified := false
+	for _, t := range sc.tables {
+		if ref.Table != "" && ref.Table != t.RefName() {
+			continue
+		}
+		qualified = true
+		for i, col := range t.Table.GetInfo().Column {
+			if col.Name != ref.Name {
+				continue
+			}
+			if found {
+				return errorf(SQLSTATE_AMBIGUOUS_COLUMN, ref.pos, "column reference %q is ambiguous", ref.Name)
+			}
+			found = true
+			ref.Index = t.Offset + i
+			ref.Type = col.Type
+			ref.kind = KindOf(col.Type)
+		}
+	}
+	switch {
+	case ref.Table != "" && !qualified:
+		return errorf(SQLSTATE_UNDEFINED_TABLE, ref.pos, "missing FROM-clause entry for table %q", ref.Table)
+	case !found && ref.Table != "":
+		return errorf(SQLSTATE_UNDEFINED_COLUMN, ref.pos, "column %s.%s does not exist", ref.Table, ref.Name)
+	case !found:
+		return errorf(SQLSTATE_UNDEFINED_COLUMN, ref.pos, "column %q does not exist", ref.Name)
+	}
+	return nil
+}
+
+type binder struct {
+	db     *db.DB
+	scope  *scope
+	clause string  // The clause being bound, which decides whether it may call aggregates
+	inAgg  bool    // Binding the argument of an aggregate
+	params *params // Parameters of the statement being prepared, nil if it cannot have any
+}
+
+/*
+Bind resolves the tables and columns stmt refers to in database and checks the types of its
+expressions. The statement is annotated in place; quoted literals compared with or stored in a
+column are converted to the column's type.
+*/
+func Bind(stmt Stmt, database *db.DB) error {
+	return bindParams(stmt, database, nil)
+}
+
+/* bindParams binds a statement that may use the parameters ps, typing those whose type is not known yet */
+func bindParams(stmt Stmt, database *db.DB, ps *params) error {
+	b := &binder{db: database, scope: &scope{}, params: ps}
+	switch s := stmt.(type) {
+	case *CreateTableStmt:
+		return b.createTable(s)
+	case *DropTableStmt:
+		if !s.IfExists && database.GetTable(s.Name) == nil {
+			return errorf(SQLSTATE_UNDEFINED_TABLE, s.Pos, "table %q does not exist", s.Name)
+		}
+	case *InsertStmt:
+		return b.insert(s)
+	case *SelectStmt:
+		return b.selectStmt(s)
+	case *UpdateStmt:
+		return b.update(s)
+	case *DeleteStmt:
+		return b.delete(s)
+	case *ExplainStmt:
+		return bindParams(s.Stmt, database, ps)
+	}
+	return nil
+}
+
+func (b *binder) table(ref *TableRef) error {
+	ref.Table = b.db.GetTable(ref.Name)
+	if ref.Table == nil {
+		return errorf(SQLSTATE_UNDEFINED_TABLE, ref.Pos, "relation %q does not exist", ref.Name)
+	}
+	return nil
+}
+
+func (b *binder) createTable(s *CreateTableStmt) error {
+	if !s.IfNotExists && b.db.GetTable(s.Name) != nil {
+		return errorf(SQLSTATE_DUPLICATE_TABLE, s.Pos, "relation %q already exists", s.Name)
+	}
+	names := make(map[string]bool)
+	for _, def := range s.Columns {
+		if names[def.Name] {
+			return errorf(SQLSTATE_DUPLICATE_COLUMN, def.Pos, "column %q specified more than once", def.Name)
+		}
+		names[def.Name] = true
+	}
+	if !names[s.PrimaryKey] {
+		return errorf(SQLSTATE_UNDEFINED_COLUMN, s.Pos, "column %q named in key does not exist", s.PrimaryKey)
+	}
+	for _, def := range s.Columns {
+		if def.NotNull && def.Name != s.PrimaryKey {
+			return errorf(SQLSTATE_FEATURE_UNSUPPORTED, def.Pos, "NOT NULL is only supported on the primary key")
+		}
+	}
+	return nil
+}
+
+func (b *binder) insert(s *InsertStmt) error {
+	if err := b.table(s.Table); err != nil {
+		return err
+	}
+	info := s.Table.Table.GetInfo()
+	if len(s.Columns) == 0 {
+		for _, i := range info.DeclaredOrder() {
+			s.Columns = append(s.Columns, info.Column[i].Name)
+		}
+	}
+	s.Targets = make([]int, len(s.Columns))
+	seen := make(map[int]bool)
+	hasPkey := false
+	for i, name := range s.Columns {
+		idx := columnIndex(info, name)
+		if idx < 0 {
+			return errorf(SQLSTATE_UNDEFINED_COLUMN, s.Table.Pos, "column %q of relation %q does not exist", name, info.Name)
+		}
+		if seen[idx] {
+			return errorf(SQLSTATE_DUPLICATE_COLUMN, s.Table.Pos, "column %q specified more than once", name)
+		}
+		seen[idx] = true
+		s.Targets[i] = idx
+		hasPkey = hasPkey || name == info.Pkey.Name
+	}
+	if !hasPkey {
+		return errorf(SQLSTATE_NOT_NULL_VIOLATION, s.Table.Pos, "null value in column %q of relation %q violates not-null constraint", info.Pkey.Name, info.Name)
+	}
+	b.clause = "VALUES"
+	for _, values := range s.Rows {
+		if len(values) > len(s.Columns) {
+			return errorf(SQLSTATE_SYNTAX_ERROR, values[len(s.Columns)].Pos(), "INSERT has more expressions than target columns")
+		}
+		if len(values) < len(s.Columns) {
+			return errorf(SQLSTATE_SYNTAX_ERROR, values[len(values)-1].Pos(), "INSERT has more target columns than expressions")
+		}
+		for i, value := range values {
+			// VALUES cannot refer to columns, so they are bound without tables in scope
+			bound, err := b.expr(value)
+			if err != nil {
+				return err
+			}
+			b.typeParam(bound, KindOf(info.Column[s.Targets[i]].Type))
+			if values[i], err = assign(bound, info, s.Targets[i]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (b *binder) update(s *UpdateStmt) error {
+	if err := b.table(s.Table); err != nil {
+		return err
+	}
+	if err := b.scope.add(s.Table); err != nil {
+		return err
+	}
+	info := s.Table.Table.GetInfo()
+	seen := make(map[int]bool)
+	b.clause = "UPDATE"
+	for _, set := range s.Set {
+		set.Index = columnIndex(info, set.Column)
+		if set.Index < 0 {
+			return errorf(SQLSTATE_UNDEFINED_COLUMN, set.Pos, "column %q of relation %q does not exist", set.Column, info.Name)
+		}
+		if seen[set.Index] {
+			return errorf(SQLSTATE_DUPLICATE_COLUMN, set.Pos, "multiple assignments to same column %q", set.Column)
+		}
+		seen[set.Index] = true
+		bound, err := b.expr(set.Value)
+		if err != nil {
+			return err
+		}
+		b.typeParam(bound, KindOf(info.Column[set.Index].Type))
+		if set.Value, err = assign(bound, info, set.Index); err != nil {
+			return err
+		}
+	}
+	return b.where(&s.Where, "WHERE")
+}
+
+func (b *binder) delete(s *DeleteStmt) error {
+	if err := b.table(s.Table); err != nil {
+		return err
+	}
+	if err := b.scope.add(s.Table); err != nil {
+		return err
+	}
+	return b.where(&s.Where, "WHERE")
+}
+
+func (b *binder) selectStmt(s *SelectStmt) error {
+	if s.From != nil {
+		if err := b.from(s.From); err != nil {
+			return err
+		}
+	}
+	if err := b.selectItems(s); err != nil {
+		return err
+	}
+	if err := b.where(&s.Where, "WHERE"); err != nil {
+		return err
+	}
+	b.clause = "GROUP BY"
+	for i := range s.GroupBy {
+		if err := b.groupItem(s, &s.GroupBy[i]); err != nil {
+			return err
+		}
+	}
+	if err := b.where(&s.Having, "HAVING"); err != nil {
+		return err
+	}
+	b.clause = "ORDER BY"
+	for _, item := range s.OrderBy {
+		if err := b.orderItem(s, item); err != nil {
+			return err
+		}
+	}
+	if err := b.group(s); err != nil {
+		return err
+	}
+	if err := b.count(&s.Limit, "LIMIT"); err != nil {
+		return err
+	}
+	return b.count(&s.Offset, "OFFSET")
+}
+
+func (b *binder) from(t TableExpr) error {
+	switch t := t.(type) {
+	case *TableRef:
+		if err := b.table(t); err != nil {
+			return err
+		}
+		return b.scope.add(t)
+	case *JoinExpr:
+		if err := b.from(t.Left); err != nil {
+			return err
+		}
+		if err := b.from(t.Right); err != nil {
+			return err
+		}
+		// ON sees the tables joined so far, which are those in scope
+		return b.where(&t.On, "JOIN/ON")
+	}
+	return errorf(SQLSTATE_FEATURE_UNSUPPORTED, -1, "unsupported FROM item %T", t)
+}
+
+/* selectItems expands * into the columns of the tables in scope, binds the rest and names the result columns */
+func (b *binder) selectItems(s *SelectStmt) error {
+	items := make([]*SelectItem, 0, len(s.Items))
+	b.clause = "SELECT"
+	for _, item := range s.Items {
+		if !item.Star {
+			bound, err := b.expr(item.Expr)
+			if err != nil {
+				return err
+			}
+			item.Expr = bound
+			items = append(items, item)
+			continue
+		}
+		if len(b.scope.tables) == 0 {
+			return errorf(SQLSTATE_SYNTAX_ERROR, item.Pos, "SELECT * with no tables specified is not valid")
+		}
+		matched := false
+		for _, t := range b.scope.tables {
+			if item.Table != "" && item.Table != t.RefName() {
+				continue
+			}
+			matched = true
+			info := t.Table.GetInfo()
+			for _, i := range info.DeclaredOrder() {
+				col := info.Column[i]
+				ref := &ColumnRef{exprBase: exprBase{pos: item.Pos, kind: KindOf(col.Type)}, Table: t.RefName(), Name: col.Name, Index: t.Offset + i, Type: col.Type}
+				items = append(items, &SelectItem{Expr: ref, Pos: item.Pos})
+			}
+		}
+		if !matched {
+			return errorf(SQLSTATE_UNDEFINED_TABLE, item.Pos, "missing FROM-clause entry for table %q", item.Table)
+		}
+	}
+	s.Items = items
+	s.Columns = make([]ResultColumn, len(items))
+	for i, item := range items {
+		s.Columns[i] = resultColumn(item)
+	}
+	return nil
+}
+
+func resultColumn(item *SelectItem) ResultColumn {
+	col := ResultColumn{Name: item.Alias, Kind: item.Expr.Kind(), Type: kindType(item.Expr.Kind())}
+	switch e := item.Expr.(type) {
+	case *ColumnRef:
+		col.Type = e.Type
+		if col.Name == "" {
+			col.Name = e.Name
+		}
+	case *FuncCall:
+		if col.Name == "" {
+			col.Name = e.Name
+		}
+		// MIN and MAX of a column are of the column's type
+		if ref, ok := firstArg(e).(*ColumnRef); ok && (e.Name == "min" || e.Name == "max") {
+			col.Type = ref.Type
+		}
+	}
+	if col.Name == "" {
+		col.Name = "?column?"
+	}
+	return col
+}
+
+/* kindType is the column type values of kind are stored as when they do not come from a column */
+func kindType(kind Kind) column.SUPPORTED_TYPE {
+	switch kind {
+	case KIND_INT:
+		return column.INT64
+	case KIND_UINT:
+		return column.UINT64
+	case KIND_FLOAT:
+		return column.FLOAT64
+	}
+	return column.STRING
+}
+
+/*
+orderItem binds a sort key. A bare name is looked up among the output column names first and an
+integer constant is the position of an output column, as in PostgreSQL.
+*/
+func (b *binder) orderItem(s *SelectStmt, item *OrderItem) error {
+	switch e := item.Expr.(type) {
+	case *ColumnRef:
+		if e.Table != "" {
+			break
+		}
+		for i, col := range s.Columns {
+			if col.Name == e.Name && s.Items[i].Alias != "" {
+				item.Expr = s.Items[i].Expr
+				return nil
+			}
+		}
+	case *Literal:
+		if e.Kind() != KIND_INT {
+			break
+		}
+		if e.Value.I < 1 || e.Value.I > int64(len(s.Items)) {
+			return errorf(SQLSTATE_INVALID_COLUMN_REFERENCE, e.pos, "ORDER BY position %d is not in select list", e.Value.I)
+		}
+		item.Expr = s.Items[e.Value.I-1].Expr
+		return nil
+	}
+	bound, err := b.expr(item.Expr)
+	if err != nil {
+		return err
+	}
+	item.Expr = bound
+	return nil
+}
+
+/*
+groupItem binds a GROUP BY item. An integer constant is the position of an output column and a
+bare name that is no input column is looked up among the output column names, as in PostgreSQL.
+*/
+func (b *binder) groupItem(s *SelectStmt, e *Expr) error {
+	switch ref := (*e).(type) {
+	case *ColumnRef:
+		bound, err := b.expr(ref)
+		var sqlErr *Error
+		if err == nil || ref.Table != "" || !errors.As(err, &sqlErr) || sqlErr.Code != SQLSTATE_UNDEFINED_COLUMN {
+			*e = bound
+			return err
+		}
+		for i, col := range s.Columns {
+			if col.Name == ref.Name && s.Items[i].Alias != "" {
+				return b.groupOutput(s, e, i, ref.pos)
+			}
+		}
+		return err
+	case *Literal:
+		if ref.Kind() != KIND_INT {
+			break
+		}
+		if ref.Value.I < 1 || ref.Value.I > int64(len(s.Items)) {
+			return errorf(SQLSTATE_INVALID_COLUMN_REFERENCE, ref.pos, "GROUP BY position %d is not in select list", ref.Value.I)
+		}
+		return b.groupOutput(s, e, int(ref.Value.I-1), ref.pos)
+	}
+	bound, err := b.expr(*e)
+	if err != nil {
+		return err
+	}
+	*e = bound
+	return nil
+}
+
+/* groupOutput groups by output column i, which cannot be an aggregate */
+func (b *binder) groupOutput(s *SelectStmt, e *Expr, i, pos int) error {
+	if hasAggregate(s.Items[i].Expr) {
+		return errorf(SQLSTATE_GROUPING_ERROR, pos, "aggregate functions are not allowed in GROUP BY")
+	}
+	*e = s.Items[i].Expr
+	return nil
+}
+
+/*
+group makes a query with GROUP BY, HAVING or aggregates compute its select list, HAVING and ORDER
+BY over group rows, which hold the GROUP BY values followed by the aggregate results. Grouped
+expressions and aggregates are replaced with references to the group row; any other column is an
+error, as its value could differ between the rows of a group.
+*/
+func (b *binder) group(s *SelectStmt) error {
+	s.Grouped = len(s.GroupBy) > 0 || s.Having != nil
+	for _, item := range s.Items {
+		s.Grouped = s.Grouped || hasAggregate(item.Expr)
+	}
+	for _, item := range s.OrderBy {
+		s.Grouped = s.Grouped || hasAggregate(item.Expr)
+	}
+	if !s.Grouped {
+		return nil
+	}
+	var err error
+	for _, item := range s.Items {
+		if item.Expr, err = groupRef(s, item.Expr); err != nil {
+			return err
+		}
+	}
+	if s.Having, err = groupRef(s, s.Having); err != nil {
+		return err
+	}
+	for _, item := range s.OrderBy {
+		if item.Expr, err = groupRef(s, item.Expr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func groupRef(s *SelectStmt, e Expr) (Expr, error) {
+	return transform(e, func(e Expr) (Expr, bool, error) {
+		for i, key := range s.GroupBy {
+			if equalExpr(e, key) {
+				return groupColumn(e, i), true, nil
+			}
+		}
+		switch e := e.(type) {
+		case *FuncCall:
+			i := 0
+			for i < len(s.Aggregates) && !equalExpr(e, s.Aggregates[i]) {
+				i++
+			}
+			if i == len(s.Aggregates) {
+				s.Aggregates = append(s.Aggregates, e)
+			}
+			return groupColumn(e, len(s.GroupBy)+i), true, nil
+		case *ColumnRef:
+			return nil, true, errorf(SQLSTATE_GROUPING_ERROR, e.pos, "column %q must appear in the GROUP BY clause or be used in an aggregate function", FormatExpr(e))
+		}
+		return e, false, nil
+	})
+}
+
+/* groupColumn refers to column i of the group row, which holds the value of e */
+func groupColumn(e Expr, i int) *ColumnRef {
+	ref := &ColumnRef{exprBase: exprBase{pos: e.Pos(), kind: e.Kind()}, Index: i, Type: kindType(e.Kind())}
+	switch e := e.(type) {
+	case *ColumnRef:
+		ref.Table, ref.Name, ref.Type = e.Table, e.Name, e.Type
+	case *FuncCall:
+		ref.Name = e.Name
+	}
+	return ref
+}
+
+/* where binds a condition, which has to be boolean */
+func (b *binder) where(e *Expr, clause string) error {
+	if *e == nil {
+		return nil
+	}
+	b.clause = clause
+	bound, err := b.expr(*e)
+	if err != nil {
+		return err
+	}
+	if bound, err = b.coerce(bound, KIND_BOOL); err != nil {
+		return err
+	}
+	if bound.Kind() != KIND_BOOL && bound.Kind() != KIND_NULL {
+		return errorf(SQLSTATE_DATATYPE_MISMATCH, bound.Pos(), "argument of %s must be type boolean, not type %s", clause, bound.Kind())
+	}
+	*e = bound
+	return nil
+}
+
+/* count binds LIMIT or OFFSET, which cannot refer to columns and has to be an integer */
+func (b *binder) count(e *Expr, clause string) error {
+	if *e == nil {
+		return nil
+	}
+	inner := &binder{db: b.db, scope: &scope{}, clause: clause, params: b.params}
+	bound, err := inner.expr(*e)
+	if err != nil {
+		return err
+	}
+	if bound, err = b.coerce(bound, KIND_INT); err != nil {
+		return err
+	}
+	if kind := bound.Kind(); kind != KIND_INT && kind != KIND_UINT && kind != KIND_NULL {
+		return errorf(SQLSTATE_DATATYPE_MISMATCH, bound.Pos(), "argument of %s must be type bigint, not type %s", clause, kind)
+	}
+	*e = bound
+	return nil
+}
+
+/* expr binds the column references of e and types it, returning the expression to use in its place */
+func (b *binder) expr(e Expr) (Expr, error) {
+	var err error
+	switch e := e.(type) {
+	case *Literal:
+		return e, nil
+	case *Param:
+		if b.params == nil {
+			return nil, errorf(SQLSTATE_UNDEFINED_PARAMETER, e.pos, "there is no parameter $%d", e.Index+1)
+		}
+		for len(b.params.kinds) <= e.Index {
+			b.params.kinds = append(b.params.kinds, KIND_NULL)
+		}
+		e.kind, e.params = b.params.kinds[e.Index], b.params
+		return e, nil
+	case *ColumnRef:
+		return e, b.scope.resolve(e)
+	case *Unary:
+		if e.X, err = b.expr(e.X); err != nil {
+			return nil, err
+		}
+		if e.Op == "NOT" {
+			if e.X, err = b.boolean(e.X, "NOT"); err != nil {
+				return nil, err
+			}
+			e.kind = KIND_BOOL
+			return e, nil
+		}
+		if e.X, err = b.coerce(e.X, KIND_FLOAT); err != nil {
+			return nil, err
+		}
+		switch kind := e.X.Kind(); kind {
+		case KIND_INT, KIND_FLOAT, KIND_NULL:
+			e.kind = kind
+		case KIND_UINT:
+			e.kind = KIND_INT
+		default:
+			return nil, errorf(SQLSTATE_UNDEFINED_FUNCTION, e.pos, "operator does not exist: -%s", kind)
+		}
+		return e, nil
+	case *Binary:
+		return b.binary(e)
+	case *IsNull:
+		if e.X, err = b.expr(e.X); err != nil {
+			return nil, err
+		}
+		e.kind = KIND_BOOL
+		return e, nil
+	case *Like:
+		if e.X, err = b.expr(e.X); err != nil {
+			return nil, err
+		}
+		if e.Pattern, err = b.expr(e.Pattern); err != nil {
+			return nil, err
+		}
+		for _, x := range []Expr{e.X, e.Pattern} {
+			if kind := x.Kind(); kind != KIND_STRING && kind != KIND_NULL {
+				return nil, errorf(SQLSTATE_UNDEFINED_FUNCTION, e.pos, "operator does not exist: %s ~~ %s", e.X.Kind(), e.Pattern.Kind())
+			}
+		}
+		e.kind = KIND_BOOL
+		return e, nil
+	case *In:
+		if e.X, err = b.expr(e.X); err != nil {
+			return nil, err
+		}
+		for i := range e.List {
+			if e.List[i], err = b.expr(e.List[i]); err != nil {
+				return nil, err
+			}
+			if e.X, e.List[i], err = b.comparable(e.X, e.List[i], "=", e.pos); err != nil {
+				return nil, err
+			}
+		}
+		e.kind = KIND_BOOL
+		return e, nil
+	case *Between:
+		if e.X, err = b.expr(e.X); err != nil {
+			return nil, err
+		}
+		if e.Low, err = b.expr(e.Low); err != nil {
+			return nil, err
+		}
+		if e.High, err = b.expr(e.High); err != nil {
+			return nil, err
+		}
+		if e.X, e.Low, err = b.comparable(e.X, e.Low, ">=", e.pos); err != nil {
+			return nil, err
+		}
+		if e.X, e.High, err = b.comparable(e.X, e.High, "<=", e.pos); err != nil {
+			return nil, err
+		}
+		e.kind = KIND_BOOL
+		return e, nil
+	case *FuncCall:
+		return b.aggregate(e)
+	}
+	return nil, errorf(SQLSTATE_INTERNAL_ERROR, e.Pos(), "unexpected expression %T", e)
+}
+
+/* aggregateNames are the aggregate functions, which are all the functions there are */
+var aggregateNames = map[string]bool{"count": true, "sum": true, "avg": true, "min": true, "max": true}
+
+/*
+aggregate binds a call of an aggregate, which may be used in the select list, HAVING and ORDER BY
+of a query but not within another aggregate. COUNT is a bigint, SUM of integers an integer of the
+same signedness and of floats a double, AVG a double, and MIN and MAX of the type of their argument.
+*/
+func (b *binder) aggregate(e *FuncCall) (Expr, error) {
+	switch {
+	case !aggregateNames[e.Name]:
+		return nil, errorf(SQLSTATE_UNDEFINED_FUNCTION, e.pos, "function %s does not exist", e.Name)
+	case b.inAgg:
+		return nil, errorf(SQLSTATE_GROUPING_ERROR, e.pos, "aggregate function calls cannot be nested")
+	case b.clause != "SELECT" && b.clause != "HAVING" && b.clause != "ORDER BY":
+		return nil, errorf(SQLSTATE_GROUPING_ERROR, e.pos, "aggregate functions are not allowed in %s", b.clause)
+	}
+	if e.Star {
+		if e.Name != "count" {
+			return nil, errorf(SQLSTATE_UNDEFINED_FUNCTION, e.pos, "function %s(*) does not exist", e.Name)
+		}
+		e.kind = KIND_INT
+		return e, nil
+	}
+	if len(e.Args) != 1 {
+		return nil, errorf(SQLSTATE_UNDEFINED_FUNCTION, e.pos, "function %s with %d arguments does not exist", e.Name, len(e.Args))
+	}
+	b.inAgg = true
+	arg, err := b.expr(e.Args[0])
+	b.inAgg = false
+	if err != nil {
+		return nil, err
+	}
+	switch e.Name {
+	case "count":
+		e.kind = KIND_INT
+	case "sum", "avg":
+		if arg, err = b.coerce(arg, KIND_FLOAT); err != nil {
+			return nil, err
+		}
+		if kind := arg.Kind(); !kind.numeric() && kind != KIND_NULL {
+			return nil, errorf(SQLSTATE_UNDEFINED_FUNCTION, e.pos, "function %s(%s) does not exist", e.Name, kind)
+		}
+		e.kind = arg.Kind()
+		if e.Name == "avg" {
+			e.kind = KIND_FLOAT
+		}
+	default:
+		e.kind = arg.Kind()
+	}
+	e.Args[0] = arg
+	return e, nil
+}
+
+func firstArg(e *FuncCall) Expr {
+	if len(e.Args) == 0 {
+		return nil
+	}
+	return e.Args[0]
+}
+
+func (b *binder) binary(e *Binary) (Expr, error) {
+	var err error
+	if e.Left, err = b.expr(e.Left); err != nil {
+		return nil, err
+	}
+	if e.Right, err = b.expr(e.Right); err != nil {
+		return nil, err
+	}
+	switch e.Op {
+	case "AND", "OR":
+		if e.Left, err = b.boolean(e.Left, e.Op); err != nil {
+			return nil, err
+		}
+		if e.Right, err = b.boolean(e.Right, e.Op); err != nil {
+			return nil, err
+		}
+		e.kind = KIND_BOOL
+	case "=", "<>", "<", "<=", ">", ">=":
+		if e.Left, e.Right, err = b.comparable(e.Left, e.Right, e.Op, e.pos); err != nil {
+			return nil, err
+		}
+		e.kind = KIND_BOOL
+	case "||":
+		e.kind = KIND_STRING
+	default:
+		// Arithmetic; a quoted operand takes the type of the other side
+		if isUntyped(e.Left) && e.Right.Kind().numeric() {
+			if e.Left, err = b.coerce(e.Left, e.Right.Kind()); err != nil {
+				return nil, err
+			}
+		}
+		if isUntyped(e.Right) && e.Left.Kind().numeric() {
+			if e.Right, err = b.coerce(e.Right, e.Left.Kind()); err != nil {
+				return nil, err
+			}
+		}
+		left, right := e.Left.Kind(), e.Right.Kind()
+		if (!left.numeric() && left != KIND_NULL) || (!right.numeric() && right != KIND_NULL) {
+			return nil, errorf(SQLSTATE_UNDEFINED_FUNCTION, e.pos, "operator does not exist: %s %s %s", left, e.Op, right)
+		}
+		e.kind = arithKind(left, right)
+	}
+	return e, nil
+}
+
+/* arithKind is the kind of the result of arithmetic on left and right: float beats signed beats unsigned */
+func arithKind(left, right Kind) Kind {
+	switch {
+	case left == KIND_NULL:
+		return right
+	case right == KIND_NULL:
+		return left
+	case left == KIND_FLOAT || right == KIND_FLOAT:
+		return KIND_FLOAT
+	case left == KIND_INT || right == KIND_INT:
+		return KIND_INT
+	}
+	return KIND_UINT
+}
+
+/* boolean checks an operand of AND, OR and NOT */
+func (b *binder) boolean(e Expr, op string) (Expr, error) {
+	e, err := b.coerce(e, KIND_BOOL)
+	if err != nil {
+		return nil, err
+	}
+	if kind := e.Kind(); kind != KIND_BOOL && kind != KIND_NULL {
+		return nil, errorf(SQLSTATE_DATATYPE_MISMATCH, e.Pos(), "argument of %s must be type boolean, not type %s", op, kind)
+	}
+	return e, nil
+}
+
+/* comparable checks two operands can be compared, converting a quoted literal to the type of the other side */
+func (b *binder) comparable(left, right Expr, op string, pos int) (Expr, Expr, error) {
+	var err error
+	if isUntyped(left) && !isUntyped(right) {
+		left, err = b.coerce(left, right.Kind())
+	} else if isUntyped(right) {
+		right, err = b.coerce(right, left.Kind())
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	l, r := left.Kind(), right.Kind()
+	if l != r && l != KIND_NULL && r != KIND_NULL && !(l.numeric() && r.numeric()) {
+		return nil, nil, errorf(SQLSTATE_UNDEFINED_FUNCTION, pos, "operator does not exist: %s %s %s", l, op, r)
+	}
+	return left, right, nil
+}
+
+/* isUntyped reports whether e takes its type from where it is used: a quoted literal, or a parameter not yet typed */
+func isUntyped(e Expr) bool {
+	switch e := e.(type) {
+	case *Literal:
+		return e.untyped
+	case *Param:
+		return e.kind == KIND_NULL
+	}
+	return false
+}
+
+/* typeParam gives a parameter not yet typed the type kind, for it and every other use of it */
+func (b *binder) typeParam(e Expr, kind Kind) {
+	if p, ok := e.(*Param); ok && p.kind == KIND_NULL && kind != KIND_NULL {
+		p.kind = kind
+		b.params.kinds[p.Index] = kind
+	}
+}
+
+/* coerce converts a quoted literal to kind, and types a parameter not yet typed as kind. Other expressions are returned as they are */
+func (b *binder) coerce(e Expr, kind Kind) (Expr, error) {
+	b.typeParam(e, kind)
+	lit, ok := e.(*Literal)
+	if !ok || !lit.untyped || kind == KIND_STRING || kind == KIND_NULL {
+		return e, nil
+	}
+	value, ok := parseValue(lit.Value.S, kind)
+	if !ok {
+		return nil, errorf(SQLSTATE_INVALID_TEXT, lit.pos, "invalid input syntax for type %s: %q", kind, lit.Value.S)
+	}
+	return &Literal{exprBase: exprBase{pos: lit.pos, kind: kind}, Value: value}, nil
+}
+
+/*
+assign checks e can be stored in column idx of the table. Constants are converted to the column's
+type, so values out of its range fail here; other expressions are checked when they are stored.
+*/
+func assign(e Expr, info *db.TableInfo, idx int) (Expr, error) {
+	col := info.Column[idx]
+	kind := KindOf(col.Type)
+	if lit, ok := e.(*Literal); ok {
+		value := lit.Value
+		if lit.untyped && kind != KIND_STRING {
+			parsed, ok := parseValue(value.S, kind)
+			if !ok {
+				return nil, errorf(SQLSTATE_INVALID_TEXT, lit.pos, "invalid input syntax for type %s: %q", TypeName(col.Type), value.S)
+			}
+			value = parsed
+		}
+		if value.IsNull() && col.Name == info.Pkey.Name {
+			return nil, errorf(SQLSTATE_NOT_NULL_VIOLATION, lit.pos, "null value in column %q of relation %q violates not-null constraint", col.Name, info.Name)
+		}
+		value, err := Coerce(value, col.Type)
+		if err != nil {
+			return nil, at(err, lit.pos)
+		}
+		return &Literal{exprBase: exprBase{pos: lit.pos, kind: value.Kind}, Value: value}, nil
+	}
+	from := e.Kind()
+	switch {
+	case from == KIND_NULL || from == kind:
+	case kind == KIND_FLOAT && from.numeric():
+	case (kind == KIND_INT || kind == KIND_UINT) && (from == KIND_INT || from == KIND_UINT):
+	default:
+		return nil, errorf(SQLSTATE_DATATYPE_MISMATCH, e.Pos(), "column %q is of type %s but expression is of type %s", col.Name, TypeName(col.Type), from)
+	}
+	return e, nil
+}
+
+/* at points an error without a position at pos */
+func at(err error, pos int) error {
+	var sqlErr *Error
+	if errors.As(err, &sqlErr) && sqlErr.Pos < 0 {
+		sqlErr.Pos = pos
+	}
+	return err
+}
+
+func columnIndex(info *db.TableInfo, name string) int {
+	for i, col := range info.Column {
+		if col.Name == name {
+			return i
+		}
+	}
+	return -1
+}
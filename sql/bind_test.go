@@ -0,0 +1,265 @@
+package sql
+
+import (
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/misachi/DarDB/column"
+	"github.com/misachi/DarDB/config"
+	st "github.com/misachi/DarDB/storage"
+	"github.com/misachi/DarDB/storage/db"
+)
+
+var (
+	testDBOnce sync.Once
+	testDBInst *db.DB
+	testDBCfg  *config.Config
+)
+
+/* testDB is a database on an in memory file system shared by the tests of the package, which create each table once */
+func testDB(t *testing.T) *db.DB {
+	testDBOnce.Do(func() {
+		testDBCfg = config.NewConfig("/data", 1, 1)
+		testDBCfg.SetFS(st.NewMemFS())
+		testDBInst = db.NewDB("sqltest", testDBCfg)
+	})
+	if testDBInst == nil {
+		t.Fatalf("NewDB error: unable to create the test database")
+	}
+	return testDBInst
+}
+
+/* testTable creates the table once; its columns are stored fixed size first, by name, then the STRING columns */
+func testTable(t *testing.T, database *db.DB, name string, cols map[string]column.SUPPORTED_TYPE, pkey string) *db.Table {
+	if tbl := database.GetTable(name); tbl != nil {
+		return tbl
+	}
+	tbl, err := database.CreateTable(name, cols, column.NewColumn(pkey, cols[pkey]))
+	if err != nil {
+		t.Fatalf("CreateTable error: %v", err)
+	}
+	return tbl
+}
+
+func bindOrders(t *testing.T) *db.DB {
+	database := testDB(t)
+	testTable(t, database, "orders", map[string]column.SUPPORTED_TYPE{
+		"id": column.INT64, "customer": column.INT, "qty": column.UINT8, "total": column.FLOAT64, "note": column.STRING,
+	}, "id")
+	return database
+}
+
+func bind(t *testing.T, database *db.DB, query string) Stmt {
+	stmt, err := Parse(query)
+	if err != nil {
+		t.Fatalf("Parse error: %s: %v", query, err)
+	}
+	if err := Bind(stmt, database); err != nil {
+		t.Fatalf("Bind error: %s: %v", query, err)
+	}
+	return stmt
+}
+
+func TestBindSelect(t *testing.T) {
+	database := bindOrders(t)
+	// Stored as customer, id, qty, total, note
+	sel := bind(t, database, "SELECT *, o.total * 2 AS twice, qty + 1, note || '!' FROM orders o WHERE id > '10' AND note LIKE 'a%' ORDER BY twice DESC, 2, qty").(*SelectStmt)
+
+	names := []string{"customer", "id", "qty", "total", "note", "twice", "?column?", "?column?"}
+	kinds := []Kind{KIND_INT, KIND_INT, KIND_UINT, KIND_FLOAT, KIND_STRING, KIND_FLOAT, KIND_INT, KIND_STRING}
+	if len(sel.Columns) != len(names) {
+		t.Fatalf("Bind error: expected %d result columns but got %d", len(names), len(sel.Columns))
+	}
+	for i, col := range sel.Columns {
+		if col.Name != names[i] || col.Kind != kinds[i] {
+			t.Errorf("Bind error: column %d expected %s %v but got %s %v", i, names[i], kinds[i], col.Name, col.Kind)
+		}
+	}
+	for i := 0; i < 5; i++ {
+		if ref := sel.Items[i].Expr.(*ColumnRef); ref.Index != i {
+			t.Errorf("Bind error: expected * column %s at %d but got %d", ref.Name, i, ref.Index)
+		}
+	}
+	if sel.Columns[1].Type != column.INT64 || sel.Columns[2].Type != column.UINT8 {
+		t.Errorf("Bind error: expected the column types of plain column references but got %v", sel.Columns)
+	}
+
+	// The quoted literal is read as the integer it is compared with
+	cmp := sel.Where.(*Binary).Left.(*Binary)
+	if lit := cmp.Right.(*Literal); lit.Kind() != KIND_INT || lit.Value.I != 10 {
+		t.Errorf("Bind error: expected '10' to become an integer but got %+v", lit.Value)
+	}
+	if sel.Where.Kind() != KIND_BOOL {
+		t.Errorf("Bind error: expected a boolean WHERE but got %v", sel.Where.Kind())
+	}
+
+	// ORDER BY an alias, a position and a column
+	if sel.OrderBy[0].Expr != sel.Items[5].Expr {
+		t.Errorf("Bind error: expected ORDER BY twice to sort on the select item")
+	}
+	if sel.OrderBy[1].Expr != sel.Items[1].Expr {
+		t.Errorf("Bind error: expected ORDER BY 2 to sort on the second select item")
+	}
+	if ref := sel.OrderBy[2].Expr.(*ColumnRef); ref.Index != 2 {
+		t.Errorf("Bind error: expected ORDER BY qty to read column 2 but got %d", ref.Index)
+	}
+
+	sel = bind(t, database, "SELECT 1 + 2.5, -qty FROM orders LIMIT '3'").(*SelectStmt)
+	if sel.Columns[0].Kind != KIND_FLOAT || sel.Columns[1].Kind != KIND_INT {
+		t.Errorf("Bind error: unexpected result kinds %v", sel.Columns)
+	}
+	if lit := sel.Limit.(*Literal); lit.Value.Kind != KIND_INT || lit.Value.I != 3 {
+		t.Errorf("Bind error: expected LIMIT 3 but got %+v", lit.Value)
+	}
+}
+
+func TestBindInsert(t *testing.T) {
+	database := bindOrders(t)
+	insert := bind(t, database, "INSERT INTO orders (note, id, qty, total) VALUES ('a', '7', 255, 3), (NULL, -1, NULL, 1.5)").(*InsertStmt)
+	if targets := insert.Targets; len(targets) != 4 || targets[0] != 4 || targets[1] != 1 || targets[2] != 2 || targets[3] != 3 {
+		t.Errorf("Bind error: unexpected targets %v", insert.Targets)
+	}
+	row := insert.Rows[0]
+	expected := []Value{String("a"), Int(7), Uint(255), Float(3)}
+	for i, e := range row {
+		if got := e.(*Literal).Value; got != expected[i] {
+			t.Errorf("Bind error: value %d expected %+v but got %+v", i, expected[i], got)
+		}
+	}
+
+	insert = bind(t, database, "INSERT INTO orders VALUES (1, 2, 3, 4, 'x')").(*InsertStmt)
+	if len(insert.Columns) != 5 || insert.Columns[0] != "customer" || insert.Targets[4] != 4 {
+		t.Errorf("Bind error: expected every column in storage order but got %v", insert.Columns)
+	}
+
+	update := bind(t, database, "UPDATE orders SET qty = qty + 1, note = 'n' WHERE customer = 3").(*UpdateStmt)
+	if update.Set[0].Index != 2 || update.Set[1].Index != 4 {
+		t.Errorf("Bind error: unexpected assignments %+v %+v", update.Set[0], update.Set[1])
+	}
+	bind(t, database, "DELETE FROM orders WHERE total BETWEEN 1 AND '2.5' OR customer IN (1, '2')")
+}
+
+func TestBindGroup(t *testing.T) {
+	database := bindOrders(t)
+	sel := bind(t, database, "SELECT customer, count(*), sum(qty), avg(total), max(note) AS last, min(qty) FROM orders GROUP BY customer HAVING count(*) > 1 ORDER BY sum(qty) DESC").(*SelectStmt)
+	if !sel.Grouped || len(sel.GroupBy) != 1 || len(sel.Aggregates) != 5 {
+		t.Fatalf("Bind error: expected 1 group value and 5 aggregates but got %d and %d", len(sel.GroupBy), len(sel.Aggregates))
+	}
+	kinds := []Kind{KIND_INT, KIND_INT, KIND_UINT, KIND_FLOAT, KIND_STRING, KIND_UINT}
+	types := []column.SUPPORTED_TYPE{column.INT, column.INT64, column.UINT64, column.FLOAT64, column.STRING, column.UINT8}
+	for i, item := range sel.Items {
+		if ref, ok := item.Expr.(*ColumnRef); !ok || ref.Index != i {
+			t.Errorf("Bind error: expected item %d to read column %d of the group row but got %s", i, i, FormatExpr(item.Expr))
+		}
+		if col := sel.Columns[i]; col.Kind != kinds[i] || col.Type != types[i] {
+			t.Errorf("Bind error: column %s expected %v %v but got %v %v", col.Name, kinds[i], types[i], col.Kind, col.Type)
+		}
+	}
+	// count(*) in HAVING is the aggregate of the select list, computed once
+	if ref := sel.Having.(*Binary).Left.(*ColumnRef); ref.Index != 1 {
+		t.Errorf("Bind error: expected HAVING to read column 1 of the group row but got %d", ref.Index)
+	}
+	if ref := sel.OrderBy[0].Expr.(*ColumnRef); ref.Index != 2 {
+		t.Errorf("Bind error: expected ORDER BY to read column 2 of the group row but got %d", ref.Index)
+	}
+
+	// GROUP BY an expression, a position and an output column name
+	sel = bind(t, database, "SELECT qty % 2 AS parity, customer + 1, sum(total) FROM orders GROUP BY qty % 2, 2").(*SelectStmt)
+	if FormatExpr(sel.GroupBy[0]) != "(qty % 2)" || FormatExpr(sel.GroupBy[1]) != "(customer + 1)" {
+		t.Errorf("Bind error: unexpected GROUP BY %s, %s", FormatExpr(sel.GroupBy[0]), FormatExpr(sel.GroupBy[1]))
+	}
+	if ref := sel.Items[1].Expr.(*ColumnRef); ref.Index != 1 {
+		t.Errorf("Bind error: expected customer + 1 to read column 1 of the group row but got %d", ref.Index)
+	}
+	sel = bind(t, database, "SELECT qty % 2 AS parity, count(*) FROM orders GROUP BY parity").(*SelectStmt)
+	if FormatExpr(sel.GroupBy[0]) != "(qty % 2)" {
+		t.Errorf("Bind error: expected GROUP BY parity to group on the select item but got %s", FormatExpr(sel.GroupBy[0]))
+	}
+
+	sel = bind(t, database, "SELECT count(*) FROM orders").(*SelectStmt)
+	if !sel.Grouped || len(sel.GroupBy) != 0 {
+		t.Errorf("Bind error: expected an aggregate without GROUP BY to make one group")
+	}
+	if sel = bind(t, database, "SELECT customer FROM orders ORDER BY customer").(*SelectStmt); sel.Grouped {
+		t.Errorf("Bind error: expected a query without aggregates not to be grouped")
+	}
+}
+
+func TestBindErrors(t *testing.T) {
+	database := bindOrders(t)
+	testTable(t, database, "customers", map[string]column.SUPPORTED_TYPE{"id": column.INT, "name": column.STRING}, "id")
+	tests := []struct {
+		query string
+		code  string
+	}{
+		{"SELECT * FROM missing", SQLSTATE_UNDEFINED_TABLE},
+		{"SELECT nope FROM orders", SQLSTATE_UNDEFINED_COLUMN},
+		{"SELECT x.id FROM orders", SQLSTATE_UNDEFINED_TABLE},
+		{"SELECT orders.id FROM orders o", SQLSTATE_UNDEFINED_TABLE},
+		{"SELECT *", SQLSTATE_SYNTAX_ERROR},
+		{"SELECT id FROM orders WHERE id", SQLSTATE_DATATYPE_MISMATCH},
+		{"SELECT id FROM orders WHERE note = 1", SQLSTATE_UNDEFINED_FUNCTION},
+		{"SELECT id FROM orders WHERE id = 'abc'", SQLSTATE_INVALID_TEXT},
+		{"SELECT note + 1 FROM orders", SQLSTATE_UNDEFINED_FUNCTION},
+		{"SELECT id FROM orders WHERE NOT note", SQLSTATE_DATATYPE_MISMATCH},
+		{"SELECT id FROM orders WHERE id LIKE 'a'", SQLSTATE_UNDEFINED_FUNCTION},
+		{"SELECT id FROM orders ORDER BY 3", SQLSTATE_INVALID_COLUMN_REFERENCE},
+		{"SELECT id FROM orders LIMIT 1.5", SQLSTATE_DATATYPE_MISMATCH},
+		{"SELECT id FROM orders LIMIT id", SQLSTATE_UNDEFINED_COLUMN},
+		{"SELECT lower(note) FROM orders", SQLSTATE_UNDEFINED_FUNCTION},
+		{"SELECT sum(*) FROM orders", SQLSTATE_UNDEFINED_FUNCTION},
+		{"SELECT sum(note) FROM orders", SQLSTATE_UNDEFINED_FUNCTION},
+		{"SELECT max(id, qty) FROM orders", SQLSTATE_UNDEFINED_FUNCTION},
+		{"SELECT id, count(*) FROM orders", SQLSTATE_GROUPING_ERROR},
+		{"SELECT note FROM orders GROUP BY customer", SQLSTATE_GROUPING_ERROR},
+		{"SELECT customer FROM orders GROUP BY customer ORDER BY qty", SQLSTATE_GROUPING_ERROR},
+		{"SELECT customer FROM orders GROUP BY customer HAVING total > 1", SQLSTATE_GROUPING_ERROR},
+		{"SELECT id FROM orders WHERE count(*) > 1", SQLSTATE_GROUPING_ERROR},
+		{"SELECT sum(count(*)) FROM orders", SQLSTATE_GROUPING_ERROR},
+		{"SELECT count(*) AS n FROM orders GROUP BY n", SQLSTATE_GROUPING_ERROR},
+		{"SELECT count(*) FROM orders GROUP BY 2", SQLSTATE_INVALID_COLUMN_REFERENCE},
+		{"SELECT count(*) FROM orders HAVING sum(qty)", SQLSTATE_DATATYPE_MISMATCH},
+		{"UPDATE orders SET qty = max(qty)", SQLSTATE_GROUPING_ERROR},
+		{"INSERT INTO orders (note) VALUES ('a')", SQLSTATE_NOT_NULL_VIOLATION},
+		{"INSERT INTO orders (id) VALUES (NULL)", SQLSTATE_NOT_NULL_VIOLATION},
+		{"INSERT INTO orders (id, qty) VALUES (1, 256)", SQLSTATE_OUT_OF_RANGE},
+		{"INSERT INTO orders (id, qty) VALUES (1, -1)", SQLSTATE_OUT_OF_RANGE},
+		{"INSERT INTO orders (id, customer) VALUES (1, 2147483648)", SQLSTATE_OUT_OF_RANGE},
+		{"INSERT INTO orders (id, customer) VALUES (1, 1.5)", SQLSTATE_DATATYPE_MISMATCH},
+		{"INSERT INTO orders (id, note) VALUES (1, 2)", SQLSTATE_DATATYPE_MISMATCH},
+		{"INSERT INTO orders (id, id) VALUES (1, 2)", SQLSTATE_DUPLICATE_COLUMN},
+		{"INSERT INTO orders (id, nope) VALUES (1, 2)", SQLSTATE_UNDEFINED_COLUMN},
+		{"INSERT INTO orders (id, note) VALUES (1)", SQLSTATE_SYNTAX_ERROR},
+		{"INSERT INTO orders (id) VALUES (id)", SQLSTATE_UNDEFINED_COLUMN},
+		{"UPDATE orders SET note = qty", SQLSTATE_DATATYPE_MISMATCH},
+		{"UPDATE orders SET qty = 1, qty = 2", SQLSTATE_DUPLICATE_COLUMN},
+		{"UPDATE orders SET id = NULL", SQLSTATE_NOT_NULL_VIOLATION},
+		{"DELETE FROM orders WHERE nope = 1", SQLSTATE_UNDEFINED_COLUMN},
+		{"CREATE TABLE customers (id int)", SQLSTATE_DUPLICATE_TABLE},
+		{"CREATE TABLE t (a int, a text)", SQLSTATE_DUPLICATE_COLUMN},
+		{"CREATE TABLE t (a int, PRIMARY KEY (b))", SQLSTATE_UNDEFINED_COLUMN},
+		{"CREATE TABLE t (a int, b int NOT NULL)", SQLSTATE_FEATURE_UNSUPPORTED},
+		{"DROP TABLE missing", SQLSTATE_UNDEFINED_TABLE},
+	}
+	for _, test := range tests {
+		stmt, err := Parse(test.query)
+		if err != nil {
+			t.Errorf("Parse error: %s: %v", test.query, err)
+			continue
+		}
+		err = Bind(stmt, database)
+		var sqlErr *Error
+		if !errors.As(err, &sqlErr) {
+			t.Errorf("Bind error: %s: expected an error but got %v", test.query, err)
+			continue
+		}
+		if sqlErr.Code != test.code {
+			t.Errorf("Bind error: %s: expected %s but got %s: %v", test.query, test.code, sqlErr.Code, sqlErr)
+		}
+	}
+
+	for _, query := range []string{"CREATE TABLE IF NOT EXISTS customers (id int)", "DROP TABLE IF EXISTS missing", "CREATE TABLE t (a int NOT NULL, b text)"} {
+		bind(t, database, query)
+	}
+}
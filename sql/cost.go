@@ -0,0 +1,604 @@
+package sql
+
+import (
+	"math"
+
+	"github.com/misachi/DarDB/storage"
+	"github.com/misachi/DarDB/storage/db"
+)
+
+/*
+The planner compares plans by their estimated cost, counted like PostgreSQL's in pages read:
+reading a block in order costs SEQ_PAGE_COST, fetching one out of order RANDOM_PAGE_COST, and
+every row processed and every condition evaluated a fraction of a page. Row counts start from the
+live records of each table and shrink by the share of rows each condition keeps, estimated from
+the column statistics of ANALYZE, or from fixed defaults for tables never analyzed.
+*/
+const (
+	SEQ_PAGE_COST     = 1.0
+	RANDOM_PAGE_COST  = 4.0
+	CPU_TUPLE_COST    = 0.01   // Per row an operator returns
+	CPU_OPERATOR_COST = 0.0025 // Per condition or key evaluated
+
+	DEFAULT_EQ_SEL    = 0.005   // Share of rows equal to a value when nothing is known of the column
+	DEFAULT_RANGE_SEL = 1.0 / 3 // Share of rows in a range, or kept by a condition nothing is known of
+	DEFAULT_MATCH_SEL = 0.05    // Share of rows LIKE a pattern
+	DEFAULT_DISTINCT  = 200     // Distinct values of a column without statistics
+)
+
+/* estimate is what the planner expects of an operator: the rows it returns and the cost of returning them all */
+type estimate struct {
+	rows float64
+	cost float64
+	cols []*colStats // What is known of each column of the rows, nil if nothing
+}
+
+/* colStats describes the values of a column, from ANALYZE when known is set. Otherwise only distinct is guessed */
+type colStats struct {
+	known    bool
+	nullFrac float64
+	distinct float64
+	mcv      []Value // Most common values
+	mcvFreq  []float64
+	mcvTotal float64
+	hist     []Value // Bounds of equi-depth buckets of the values not in mcv
+}
+
+func newColStats(stats db.ColumnStats) *colStats {
+	cs := &colStats{known: true, nullFrac: stats.NullFrac, distinct: stats.Distinct}
+	for i, data := range stats.MCV {
+		v, err := decodeValue(data, stats.Type)
+		if err != nil || i >= len(stats.MCVFreq) {
+			continue
+		}
+		cs.mcv = append(cs.mcv, v)
+		cs.mcvFreq = append(cs.mcvFreq, stats.MCVFreq[i])
+		cs.mcvTotal += stats.MCVFreq[i]
+	}
+	for _, data := range stats.Histogram {
+		if v, err := decodeValue(data, stats.Type); err == nil {
+			cs.hist = append(cs.hist, v)
+		}
+	}
+	return cs
+}
+
+/* tableStats is what the planner knows of a table */
+type tableStats struct {
+	rows  float64
+	pages float64
+	cols  []*colStats
+}
+
+/* tableStats reads the size and column statistics of tbl, once per plan */
+func (p *planner) tableStats(tbl *db.Table) (*tableStats, error) {
+	if ts, ok := p.tables[tbl]; ok {
+		return ts, nil
+	}
+	blocks, err := tbl.NumBlocks()
+	if err != nil {
+		return nil, err
+	}
+	analysis, err := tbl.Analysis()
+	if err != nil {
+		return nil, err
+	}
+	info := tbl.GetInfo()
+	ts := &tableStats{rows: float64(tbl.NumRecords()), pages: float64(blocks), cols: make([]*colStats, len(info.Column))}
+	if analysis != nil {
+		for i, col := range info.Column {
+			for _, stats := range analysis.Columns {
+				if stats.Name == col.Name && stats.Type == col.Type {
+					ts.cols[i] = newColStats(stats)
+				}
+			}
+		}
+	}
+	for i := range ts.cols {
+		if ts.cols[i] == nil {
+			ts.cols[i] = &colStats{distinct: DEFAULT_DISTINCT}
+		}
+	}
+	p.tables[tbl] = ts
+	return ts, nil
+}
+
+/* clampRows keeps an estimate of rows at one or more, as an estimate of none would make every plan over it free */
+func clampRows(rows float64) float64 {
+	if rows < 1 || math.IsNaN(rows) {
+		return 1
+	}
+	return rows
+}
+
+func clampSel(sel float64) float64 {
+	switch {
+	case sel < 0 || math.IsNaN(sel):
+		return 0
+	case sel > 1:
+		return 1
+	}
+	return sel
+}
+
+/* limitCols copies cols with no column holding more distinct values than there are rows */
+func limitCols(cols []*colStats, rows float64) []*colStats {
+	out := make([]*colStats, len(cols))
+	for i, cs := range cols {
+		out[i] = cs
+		if cs != nil && cs.distinct > rows {
+			c := *cs
+			c.distinct = rows
+			out[i] = &c
+		}
+	}
+	return out
+}
+
+/* rowWidth estimates the memory of a row of n values, like rowSize without strings */
+func rowWidth(n int) float64 {
+	return float64(24 + 56*n)
+}
+
+/* spillCost is the cost of writing rows of n values to temp files and reading them back, if they do not fit in mem */
+func spillCost(rows float64, n int, mem int64) float64 {
+	bytes := rows * rowWidth(n)
+	if bytes <= float64(mem) {
+		return 0
+	}
+	return 2 * SEQ_PAGE_COST * math.Ceil(bytes/storage.DEFAULT_BLOCK_SIZE)
+}
+
+/* estimate works out the rows and cost of op, remembering them for the rest of the plan */
+func (p *planner) estimate(op Operator) (*estimate, error) {
+	if est, ok := p.ests[op]; ok {
+		return est, nil
+	}
+	est, err := p.estimateOp(op)
+	if err != nil {
+		return nil, err
+	}
+	est.rows = clampRows(est.rows)
+	est.cols = limitCols(est.cols, est.rows)
+	p.ests[op] = est
+	return est, nil
+}
+
+func (p *planner) estimateOp(op Operator) (*estimate, error) {
+	switch op := op.(type) {
+	case *SeqScan:
+		ts, err := p.tableStats(op.Table)
+		if err != nil {
+			return nil, err
+		}
+		conds := float64(len(conjuncts(op.Filter)))
+		return &estimate{
+			rows: ts.rows * selectivity(op.Filter, ts.cols),
+			cost: ts.pages*SEQ_PAGE_COST + ts.rows*(CPU_TUPLE_COST+conds*CPU_OPERATOR_COST),
+			cols: ts.cols,
+		}, nil
+	case *IndexScan:
+		ts, err := p.tableStats(op.Table)
+		if err != nil {
+			return nil, err
+		}
+		sel := DEFAULT_EQ_SEL
+		if key, ok := constValue(op.Key); ok && op.Column < len(ts.cols) {
+			sel = eqSel(ts.cols[op.Column], key)
+		}
+		rows := ts.rows * sel
+		return &estimate{
+			rows: rows,
+			cost: RANDOM_PAGE_COST*math.Min(math.Ceil(rows), ts.pages) + rows*CPU_TUPLE_COST + math.Log2(ts.rows+1)*CPU_OPERATOR_COST,
+			cols: ts.cols,
+		}, nil
+	case *Values:
+		rows := float64(len(op.Rows))
+		var cols []*colStats
+		if len(op.Rows) > 0 {
+			cols = make([]*colStats, len(op.Rows[0]))
+		}
+		return &estimate{rows: rows, cost: rows * CPU_TUPLE_COST, cols: cols}, nil
+	case *Filter:
+		child, err := p.estimate(op.Child)
+		if err != nil {
+			return nil, err
+		}
+		conds := float64(len(conjuncts(op.Pred)))
+		return &estimate{
+			rows: child.rows * selectivity(op.Pred, child.cols),
+			cost: child.cost + child.rows*conds*CPU_OPERATOR_COST,
+			cols: child.cols,
+		}, nil
+	case *Project:
+		child, err := p.estimate(op.Child)
+		if err != nil {
+			return nil, err
+		}
+		cols := make([]*colStats, len(op.Exprs))
+		for i, e := range op.Exprs {
+			cols[i] = colOf(e, child.cols)
+		}
+		return &estimate{rows: child.rows, cost: child.cost + child.rows*float64(len(op.Exprs))*CPU_OPERATOR_COST, cols: cols}, nil
+	case *Limit:
+		child, err := p.estimate(op.Child)
+		if err != nil {
+			return nil, err
+		}
+		rows := child.rows
+		if n, ok := constValue(op.Offset); ok && n.Kind == KIND_INT && n.I > 0 {
+			rows -= float64(n.I)
+		}
+		if n, ok := constValue(op.Limit); ok && n.Kind == KIND_INT && float64(n.I) < rows {
+			rows = float64(n.I)
+		}
+		return &estimate{rows: rows, cost: child.cost, cols: child.cols}, nil
+	case *Sort:
+		child, err := p.estimate(op.Child)
+		if err != nil {
+			return nil, err
+		}
+		n := child.rows
+		return &estimate{
+			rows: n,
+			cost: child.cost + 2*CPU_OPERATOR_COST*float64(len(op.Keys))*n*math.Log2(n+1) + spillCost(n, len(child.cols), p.mem),
+			cols: child.cols,
+		}, nil
+	case *NestedLoopJoin:
+		return p.estimateJoin(op.Left, op.Right, op.Type, nil, nil, op.Cond, func(l, r *estimate) float64 {
+			return l.cost + l.rows*r.cost
+		})
+	case *BlockNestedLoopJoin:
+		return p.estimateJoin(op.Left, op.Right, op.Type, nil, nil, op.Cond, func(l, r *estimate) float64 {
+			// The right input is read once per block of left rows
+			blocks := math.Ceil(l.rows * rowWidth(len(l.cols)) / float64(p.mem))
+			return l.cost + math.Max(blocks, 1)*r.cost
+		})
+	case *HashJoin:
+		return p.estimateJoin(op.Left, op.Right, op.Type, op.LeftKeys, op.RightKeys, op.Cond, func(l, r *estimate) float64 {
+			keys := float64(len(op.LeftKeys))
+			cost := l.cost + r.cost + r.rows*(CPU_TUPLE_COST+keys*CPU_OPERATOR_COST) + l.rows*keys*CPU_OPERATOR_COST
+			if spill := spillCost(r.rows, len(r.cols), p.mem); spill > 0 {
+				cost += spill + spillCost(l.rows, len(l.cols), 0)
+			}
+			return cost
+		})
+	case *MergeJoin:
+		return p.estimateJoin(op.Left, op.Right, op.Type, op.LeftKeys, op.RightKeys, op.Cond, func(l, r *estimate) float64 {
+			return l.cost + r.cost + (l.rows+r.rows)*float64(len(op.LeftKeys))*CPU_OPERATOR_COST
+		})
+	case *HashAggregate:
+		return p.estimateAggregate(op.Child, op.GroupBy, op.Aggs, true)
+	case *GroupAggregate:
+		return p.estimateAggregate(op.Child, op.GroupBy, op.Aggs, false)
+	case *Insert:
+		return p.estimateWrite(op.Child)
+	case *Update:
+		return p.estimateWrite(op.Child)
+	case *Delete:
+		return p.estimateWrite(op.Child)
+	}
+	return &estimate{rows: 1}, nil
+}
+
+/*
+estimateJoin estimates a join of left and right on equal keys and cond, given the cost of reading
+the inputs and matching their rows by the join's algorithm
+*/
+func (p *planner) estimateJoin(left, right Operator, typ JoinType, leftKeys, rightKeys []Expr, cond Expr, cost func(l, r *estimate) float64) (*estimate, error) {
+	l, err := p.estimate(left)
+	if err != nil {
+		return nil, err
+	}
+	r, err := p.estimate(right)
+	if err != nil {
+		return nil, err
+	}
+	cols := append(append([]*colStats{}, l.cols...), r.cols...)
+	keySel := joinKeySel(leftKeys, rightKeys, l.cols, r.cols)
+	sel := selectivity(cond, cols) * keySel
+	pairs := l.rows * r.rows
+	rows := pairs * sel
+	switch typ {
+	case JOIN_LEFT:
+		rows = math.Max(rows, l.rows)
+	case JOIN_SEMI:
+		rows = l.rows * math.Min(1, r.rows*sel)
+		cols = l.cols
+	case JOIN_ANTI:
+		rows = l.rows * math.Max(0, 1-r.rows*sel)
+		cols = l.cols
+	}
+	// Cond is evaluated for the pairs with equal keys, every pair without keys
+	conds := float64(len(conjuncts(cond))) * pairs * keySel
+	return &estimate{rows: rows, cost: cost(l, r) + conds*CPU_OPERATOR_COST + rows*CPU_TUPLE_COST, cols: cols}, nil
+}
+
+func joinKeySel(leftKeys, rightKeys []Expr, left, right []*colStats) float64 {
+	sel := 1.0
+	for i := range leftKeys {
+		sel *= joinEqSel(colOf(leftKeys[i], left), colOf(rightKeys[i], right))
+	}
+	return sel
+}
+
+func (p *planner) estimateAggregate(input Operator, groupBy []Expr, aggs []*FuncCall, hashed bool) (*estimate, error) {
+	child, err := p.estimate(input)
+	if err != nil {
+		return nil, err
+	}
+	groups := 1.0
+	cols := make([]*colStats, len(groupBy)+len(aggs))
+	for i, e := range groupBy {
+		cs := colOf(e, child.cols)
+		groups *= distinct(cs, child.rows)
+		if cs != nil {
+			cols[i] = &colStats{known: cs.known, nullFrac: cs.nullFrac, distinct: cs.distinct}
+		}
+	}
+	groups = math.Min(groups, child.rows)
+	cost := child.cost + child.rows*float64(len(groupBy)+len(aggs))*CPU_OPERATOR_COST + groups*CPU_TUPLE_COST
+	if hashed && len(groupBy) > 0 && groups*(rowWidth(len(groupBy))+AGG_STATE_SIZE*float64(len(aggs))) > float64(p.mem) {
+		cost += spillCost(child.rows, len(child.cols), 0)
+	}
+	return &estimate{rows: groups, cost: cost, cols: cols}, nil
+}
+
+func (p *planner) estimateWrite(input Operator) (*estimate, error) {
+	child, err := p.estimate(input)
+	if err != nil {
+		return nil, err
+	}
+	return &estimate{rows: 1, cost: child.cost + child.rows*CPU_TUPLE_COST, cols: make([]*colStats, 1)}, nil
+}
+
+/* colOf is what is known of the values of e, when it is a column */
+func colOf(e Expr, cols []*colStats) *colStats {
+	if ref, ok := e.(*ColumnRef); ok && ref.Index >= 0 && ref.Index < len(cols) {
+		return cols[ref.Index]
+	}
+	return nil
+}
+
+/* constValue evaluates e if it reads no columns */
+func constValue(e Expr) (Value, bool) {
+	if e == nil {
+		return Null(), false
+	}
+	constant := true
+	walkExpr(e, func(e Expr) bool {
+		switch e.(type) {
+		case *ColumnRef, *FuncCall, *Param:
+			constant = false
+		}
+		return constant
+	})
+	if !constant {
+		return Null(), false
+	}
+	v, err := Eval(e, nil)
+	return v, err == nil
+}
+
+/* distinct is the number of distinct values of a column in rows rows */
+func distinct(cs *colStats, rows float64) float64 {
+	d := float64(DEFAULT_DISTINCT)
+	if cs != nil {
+		d = cs.distinct
+	}
+	return math.Max(1, math.Min(d, rows))
+}
+
+/* selectivity estimates the share of rows cond is true for, given what is known of their columns. Nil keeps every row */
+func selectivity(cond Expr, cols []*colStats) float64 {
+	if cond == nil {
+		return 1
+	}
+	return clampSel(condSel(cond, cols))
+}
+
+func condSel(e Expr, cols []*colStats) float64 {
+	switch e := e.(type) {
+	case *Literal:
+		if isTrue(e.Value) {
+			return 1
+		}
+		return 0
+	case *Unary:
+		if e.Op == "NOT" {
+			return 1 - selectivity(e.X, cols)
+		}
+	case *Binary:
+		switch e.Op {
+		case "AND":
+			return selectivity(e.Left, cols) * selectivity(e.Right, cols)
+		case "OR":
+			a, b := selectivity(e.Left, cols), selectivity(e.Right, cols)
+			return a + b - a*b
+		case "=", "<>", "<", "<=", ">", ">=":
+			return compareSel(e, cols)
+		}
+	case *IsNull:
+		sel := DEFAULT_EQ_SEL
+		if cs := colOf(e.X, cols); cs != nil && cs.known {
+			sel = cs.nullFrac
+		}
+		if e.Not {
+			return 1 - sel
+		}
+		return sel
+	case *Between:
+		cs := colOf(e.X, cols)
+		low, okLow := constValue(e.Low)
+		high, okHigh := constValue(e.High)
+		sel := DEFAULT_EQ_SEL
+		if cs != nil && cs.known && okLow && okHigh {
+			sel = clampSel(ltSel(cs, high) + eqSel(cs, high) - ltSel(cs, low))
+		}
+		if e.Not {
+			return 1 - sel
+		}
+		return sel
+	case *In:
+		cs := colOf(e.X, cols)
+		sel := 0.0
+		for _, item := range e.List {
+			v, ok := constValue(item)
+			if !ok {
+				sel += DEFAULT_EQ_SEL
+				continue
+			}
+			sel += eqSel(cs, v)
+		}
+		sel = clampSel(sel)
+		if e.Not {
+			return 1 - sel
+		}
+		return sel
+	case *Like:
+		if e.Not {
+			return 1 - DEFAULT_MATCH_SEL
+		}
+		return DEFAULT_MATCH_SEL
+	}
+	return DEFAULT_RANGE_SEL
+}
+
+/* compareSel estimates a comparison of a column with a constant, or of two columns */
+func compareSel(b *Binary, cols []*colStats) float64 {
+	op, x, y := b.Op, b.Left, b.Right
+	if _, ok := constValue(x); ok {
+		// Put the column on the left
+		x, y = y, x
+		op = map[string]string{"<": ">", "<=": ">=", ">": "<", ">=": "<="}[op]
+		if op == "" {
+			op = b.Op
+		}
+	}
+	cs := colOf(x, cols)
+	v, isConst := constValue(y)
+	if isConst && v.IsNull() {
+		return 0
+	}
+	if !isConst {
+		if other := colOf(y, cols); cs != nil && other != nil {
+			switch op {
+			case "=":
+				return joinEqSel(cs, other)
+			case "<>":
+				return 1 - joinEqSel(cs, other)
+			}
+		}
+		if op == "=" {
+			return DEFAULT_EQ_SEL
+		}
+		return DEFAULT_RANGE_SEL
+	}
+	if cs == nil || !cs.known {
+		switch op {
+		case "=":
+			return DEFAULT_EQ_SEL
+		case "<>":
+			return 1 - DEFAULT_EQ_SEL
+		}
+		return DEFAULT_RANGE_SEL
+	}
+	nonNull := 1 - cs.nullFrac
+	switch op {
+	case "=":
+		return eqSel(cs, v)
+	case "<>":
+		return nonNull - eqSel(cs, v)
+	case "<":
+		return ltSel(cs, v)
+	case "<=":
+		return ltSel(cs, v) + eqSel(cs, v)
+	case ">":
+		return nonNull - ltSel(cs, v) - eqSel(cs, v)
+	}
+	return nonNull - ltSel(cs, v)
+}
+
+/* eqSel is the share of rows whose column equals v: its frequency if it is a common value, else a share of the rest */
+func eqSel(cs *colStats, v Value) float64 {
+	if v.IsNull() {
+		return 0
+	}
+	if cs == nil || !cs.known {
+		return DEFAULT_EQ_SEL
+	}
+	for i, m := range cs.mcv {
+		if compare(m, v) == 0 {
+			return cs.mcvFreq[i]
+		}
+	}
+	others := cs.distinct - float64(len(cs.mcv))
+	if others < 1 {
+		return 0
+	}
+	return clampSel(1-cs.nullFrac-cs.mcvTotal) / others
+}
+
+/* ltSel is the share of rows whose column is less than v, from its common values and histogram */
+func ltSel(cs *colStats, v Value) float64 {
+	if cs == nil || !cs.known {
+		return DEFAULT_RANGE_SEL
+	}
+	sel := 0.0
+	for i, m := range cs.mcv {
+		if compare(m, v) < 0 {
+			sel += cs.mcvFreq[i]
+		}
+	}
+	rest := clampSel(1 - cs.nullFrac - cs.mcvTotal)
+	n := len(cs.hist) - 1
+	switch {
+	case n < 1:
+		if len(cs.mcv) == 0 {
+			// Too few values for a histogram or common values
+			sel += rest * DEFAULT_RANGE_SEL
+		}
+	case compare(v, cs.hist[0]) <= 0:
+	case compare(v, cs.hist[n]) > 0:
+		sel += rest
+	default:
+		i := 0
+		for i < n-1 && compare(v, cs.hist[i+1]) > 0 {
+			i++
+		}
+		// v is in bucket i; numbers are placed in it by value, other values in its middle
+		within := 0.5
+		lo, okLo := numeric(cs.hist[i])
+		hi, okHi := numeric(cs.hist[i+1])
+		x, okX := numeric(v)
+		if okLo && okHi && okX && hi > lo {
+			within = (x - lo) / (hi - lo)
+		}
+		sel += rest * (float64(i) + clampSel(within)) / float64(n)
+	}
+	return sel
+}
+
+/* joinEqSel is the share of pairs of rows whose columns are equal: with d distinct values on the larger side, 1/d of the pairs that are not NULL */
+func joinEqSel(a, b *colStats) float64 {
+	if a == nil || b == nil {
+		return DEFAULT_EQ_SEL
+	}
+	d := math.Max(distinct(a, math.Inf(1)), distinct(b, math.Inf(1)))
+	sel := 1 / d
+	if a.known {
+		sel *= 1 - a.nullFrac
+	}
+	if b.known {
+		sel *= 1 - b.nullFrac
+	}
+	return sel
+}
+
+func numeric(v Value) (float64, bool) {
+	switch v.Kind {
+	case KIND_INT, KIND_UINT, KIND_FLOAT:
+		return v.float(), true
+	}
+	return 0, false
+}
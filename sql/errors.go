@@ -0,0 +1,59 @@
+package sql
+
+import "fmt"
+
+/* SQLSTATE codes of the errors the SQL layer reports */
+const (
+	SQLSTATE_SYNTAX_ERROR             = "42601"
+	SQLSTATE_UNDEFINED_TABLE          = "42P01"
+	SQLSTATE_UNDEFINED_COLUMN         = "42703"
+	SQLSTATE_UNDEFINED_FUNCTION       = "42883"
+	SQLSTATE_UNDEFINED_OBJECT         = "42704"
+	SQLSTATE_UNDEFINED_PARAMETER      = "42P02"
+	SQLSTATE_AMBIGUOUS_COLUMN         = "42702"
+	SQLSTATE_DUPLICATE_ALIAS          = "42712"
+	SQLSTATE_INVALID_COLUMN_REFERENCE = "42P10"
+	SQLSTATE_DUPLICATE_TABLE          = "42P07"
+	SQLSTATE_DUPLICATE_COLUMN         = "42701"
+	SQLSTATE_DATATYPE_MISMATCH        = "42804"
+	SQLSTATE_GROUPING_ERROR           = "42803"
+	SQLSTATE_INVALID_TEXT             = "22P02"
+	SQLSTATE_OUT_OF_RANGE             = "22003"
+	SQLSTATE_DIVISION_BY_ZERO         = "22012"
+	SQLSTATE_INVALID_LIMIT            = "2201W"
+	SQLSTATE_INVALID_OFFSET           = "2201X"
+	SQLSTATE_NOT_NULL_VIOLATION       = "23502"
+	SQLSTATE_UNIQUE_VIOLATION         = "23505"
+	SQLSTATE_FEATURE_UNSUPPORTED      = "0A000"
+	SQLSTATE_INTERNAL_ERROR           = "XX000"
+	SQLSTATE_OBJECT_IN_USE            = "55006"
+	SQLSTATE_INVALID_TRANSACTION      = "25000"
+	SQLSTATE_FAILED_TRANSACTION       = "25P02"
+	SQLSTATE_NO_ACTIVE_TRANSACTION    = "25P01"
+	SQLSTATE_PROTOCOL_VIOLATION       = "08P01"
+	SQLSTATE_INVALID_STATEMENT_NAME   = "26000"
+	SQLSTATE_DUPLICATE_PSTATEMENT     = "42P05"
+	SQLSTATE_DUPLICATE_CURSOR         = "42P03"
+	SQLSTATE_INVALID_CURSOR_NAME      = "34000"
+	SQLSTATE_INVALID_BINARY           = "22P03"
+	SQLSTATE_INVALID_CATALOG_NAME     = "3D000"
+	SQLSTATE_SERIALIZATION_FAILURE    = "40001"
+)
+
+/* Error is an error of a statement, with the SQLSTATE code clients see */
+type Error struct {
+	Code string
+	Msg  string
+	Pos  int // Byte offset in the query the error points at, -1 if none
+}
+
+func (e *Error) Error() string {
+	if e.Pos >= 0 {
+		return fmt.Sprintf("%s at position %d", e.Msg, e.Pos+1)
+	}
+	return e.Msg
+}
+
+func errorf(code string, pos int, format string, args ...interface{}) *Error {
+	return &Error{Code: code, Msg: fmt.Sprintf(format, args...), Pos: pos}
+}
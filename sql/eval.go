@@ -0,0 +1,429 @@
+package sql
+
+import (
+	"math"
+	"strings"
+)
+
+/*
+Eval computes the value of a bound expression over r. NULL propagates through operators, and AND,
+OR and NOT follow three-valued logic.
+*/
+func Eval(e Expr, r Row) (Value, error) {
+	switch e := e.(type) {
+	case *Literal:
+		return e.Value, nil
+	case *Param:
+		if e.params == nil || e.Index >= len(e.params.values) {
+			return Null(), errorf(SQLSTATE_UNDEFINED_PARAMETER, e.pos, "no value supplied for parameter $%d", e.Index+1)
+		}
+		return e.params.values[e.Index], nil
+	case *ColumnRef:
+		if e.Index < 0 || e.Index >= len(r) {
+			return Null(), errorf(SQLSTATE_INTERNAL_ERROR, e.pos, "column %s is not in the row", e.Name)
+		}
+		return r[e.Index], nil
+	case *Unary:
+		x, err := Eval(e.X, r)
+		if err != nil || x.IsNull() {
+			return x, err
+		}
+		if e.Op == "NOT" {
+			return Bool(!x.B), nil
+		}
+		return negate(x, e.pos)
+	case *Binary:
+		return evalBinary(e, r)
+	case *IsNull:
+		x, err := Eval(e.X, r)
+		if err != nil {
+			return x, err
+		}
+		return Bool(x.IsNull() != e.Not), nil
+	case *Like:
+		x, err := Eval(e.X, r)
+		if err != nil || x.IsNull() {
+			return x, err
+		}
+		pattern, err := Eval(e.Pattern, r)
+		if err != nil || pattern.IsNull() {
+			return pattern, err
+		}
+		return Bool(like(x.S, pattern.S) != e.Not), nil
+	case *In:
+		return evalIn(e, r)
+	case *Between:
+		x, err := Eval(e.X, r)
+		if err != nil || x.IsNull() {
+			return x, err
+		}
+		low, err := compareWith(x, e.Low, r, ">=")
+		if err != nil {
+			return low, err
+		}
+		high, err := compareWith(x, e.High, r, "<=")
+		if err != nil {
+			return high, err
+		}
+		result := and(low, high)
+		if e.Not && !result.IsNull() {
+			result.B = !result.B
+		}
+		return result, nil
+	case *FuncCall:
+		// The binder replaces aggregates with the columns of the group row they are computed into
+		return Null(), errorf(SQLSTATE_INTERNAL_ERROR, e.pos, "aggregate %s evaluated outside of a group", e.Name)
+	}
+	return Null(), errorf(SQLSTATE_INTERNAL_ERROR, e.Pos(), "unexpected expression %T", e)
+}
+
+/* isTrue reports whether a condition holds; NULL does not */
+func isTrue(v Value) bool {
+	return v.Kind == KIND_BOOL && v.B
+}
+
+func evalBinary(e *Binary, r Row) (Value, error) {
+	left, err := Eval(e.Left, r)
+	if err != nil {
+		return left, err
+	}
+	switch e.Op {
+	case "AND":
+		if left.Kind == KIND_BOOL && !left.B {
+			return left, nil
+		}
+		right, err := Eval(e.Right, r)
+		if err != nil {
+			return right, err
+		}
+		return and(left, right), nil
+	case "OR":
+		if isTrue(left) {
+			return left, nil
+		}
+		right, err := Eval(e.Right, r)
+		if err != nil {
+			return right, err
+		}
+		switch {
+		case isTrue(right):
+			return right, nil
+		case left.IsNull() || right.IsNull():
+			return Null(), nil
+		}
+		return Bool(false), nil
+	}
+
+	right, err := Eval(e.Right, r)
+	if err != nil {
+		return right, err
+	}
+	if left.IsNull() || right.IsNull() {
+		return Null(), nil
+	}
+	switch e.Op {
+	case "=", "<>", "<", "<=", ">", ">=":
+		return Bool(compareOp(compare(left, right), e.Op)), nil
+	case "||":
+		return String(left.String() + right.String()), nil
+	}
+	return arith(e.Op, left, right, e.kind, e.pos)
+}
+
+func and(left, right Value) Value {
+	switch {
+	case left.Kind == KIND_BOOL && !left.B, right.Kind == KIND_BOOL && !right.B:
+		return Bool(false)
+	case left.IsNull() || right.IsNull():
+		return Null()
+	}
+	return Bool(true)
+}
+
+/* compareWith compares x with the value of e, NULL if either is */
+func compareWith(x Value, e Expr, r Row, op string) (Value, error) {
+	y, err := Eval(e, r)
+	if err != nil || y.IsNull() {
+		return y, err
+	}
+	return Bool(compareOp(compare(x, y), op)), nil
+}
+
+func evalIn(e *In, r Row) (Value, error) {
+	x, err := Eval(e.X, r)
+	if err != nil || x.IsNull() {
+		return x, err
+	}
+	sawNull := false
+	for _, item := range e.List {
+		y, err := Eval(item, r)
+		if err != nil {
+			return y, err
+		}
+		if y.IsNull() {
+			sawNull = true
+			continue
+		}
+		if compare(x, y) == 0 {
+			return Bool(!e.Not), nil
+		}
+	}
+	if sawNull {
+		return Null(), nil
+	}
+	return Bool(e.Not), nil
+}
+
+func compareOp(cmp int, op string) bool {
+	switch op {
+	case "=":
+		return cmp == 0
+	case "<>":
+		return cmp != 0
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	}
+	return cmp >= 0
+}
+
+/*
+compare orders two values that are not NULL. Numbers of different kinds compare by value; the
+binder only lets values of the same kind or numbers meet.
+*/
+func compare(a, b Value) int {
+	switch {
+	case a.Kind == KIND_STRING && b.Kind == KIND_STRING:
+		return strings.Compare(a.S, b.S)
+	case a.Kind == KIND_BOOL && b.Kind == KIND_BOOL:
+		switch {
+		case a.B == b.B:
+			return 0
+		case b.B:
+			return -1
+		}
+		return 1
+	case a.Kind == KIND_FLOAT || b.Kind == KIND_FLOAT:
+		return compareFloat(a.float(), b.float())
+	case a.Kind == KIND_INT && b.Kind == KIND_INT:
+		return compareInt(a.I, b.I)
+	case a.Kind == KIND_UINT && b.Kind == KIND_UINT:
+		return compareUint(a.U, b.U)
+	case a.Kind == KIND_INT:
+		if a.I < 0 {
+			return -1
+		}
+		return compareUint(uint64(a.I), b.U)
+	case b.Kind == KIND_INT:
+		return -compare(b, a)
+	}
+	return strings.Compare(a.String(), b.String())
+}
+
+/* compareFloat orders NaN above every other value, as PostgreSQL does */
+func compareFloat(a, b float64) int {
+	switch {
+	case math.IsNaN(a) && math.IsNaN(b):
+		return 0
+	case math.IsNaN(a):
+		return 1
+	case math.IsNaN(b):
+		return -1
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func compareInt(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func compareUint(a, b uint64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func negate(x Value, pos int) (Value, error) {
+	switch x.Kind {
+	case KIND_INT:
+		if x.I == math.MinInt64 {
+			return x, errorf(SQLSTATE_OUT_OF_RANGE, pos, "integer out of range")
+		}
+		return Int(-x.I), nil
+	case KIND_UINT:
+		if x.U > 1<<63 {
+			return x, errorf(SQLSTATE_OUT_OF_RANGE, pos, "integer out of range")
+		}
+		return Int(int64(-x.U)), nil
+	}
+	return Float(-x.F), nil
+}
+
+/* toInt converts an integer value to int64 for signed arithmetic */
+func toInt(v Value, pos int) (int64, error) {
+	if v.Kind == KIND_UINT {
+		if v.U > math.MaxInt64 {
+			return 0, errorf(SQLSTATE_OUT_OF_RANGE, pos, "integer out of range")
+		}
+		return int64(v.U), nil
+	}
+	return v.I, nil
+}
+
+/* arith applies an arithmetic operator in the kind the binder chose, failing on overflow and division by zero */
+func arith(op string, left, right Value, kind Kind, pos int) (Value, error) {
+	switch kind {
+	case KIND_FLOAT:
+		a, b := left.float(), right.float()
+		switch op {
+		case "+":
+			return Float(a + b), nil
+		case "-":
+			return Float(a - b), nil
+		case "*":
+			return Float(a * b), nil
+		}
+		if b == 0 {
+			return Null(), errorf(SQLSTATE_DIVISION_BY_ZERO, pos, "division by zero")
+		}
+		if op == "/" {
+			return Float(a / b), nil
+		}
+		return Float(math.Mod(a, b)), nil
+	case KIND_UINT:
+		return arithUint(op, left.U, right.U, pos)
+	}
+	a, err := toInt(left, pos)
+	if err != nil {
+		return Null(), err
+	}
+	b, err := toInt(right, pos)
+	if err != nil {
+		return Null(), err
+	}
+	return arithInt(op, a, b, pos)
+}
+
+func arithInt(op string, a, b int64, pos int) (Value, error) {
+	overflow := errorf(SQLSTATE_OUT_OF_RANGE, pos, "integer out of range")
+	switch op {
+	case "+":
+		c := a + b
+		if (c > a) != (b > 0) {
+			return Null(), overflow
+		}
+		return Int(c), nil
+	case "-":
+		c := a - b
+		if (c < a) != (b > 0) {
+			return Null(), overflow
+		}
+		return Int(c), nil
+	case "*":
+		if a == 0 || b == 0 {
+			return Int(0), nil
+		}
+		c := a * b
+		if c/b != a || (a == -1 && b == math.MinInt64) || (b == -1 && a == math.MinInt64) {
+			return Null(), overflow
+		}
+		return Int(c), nil
+	}
+	if b == 0 {
+		return Null(), errorf(SQLSTATE_DIVISION_BY_ZERO, pos, "division by zero")
+	}
+	if b == -1 {
+		// MinInt64 / -1 does not fit; the remainder is always zero
+		if op == "%" {
+			return Int(0), nil
+		}
+		return negate(Int(a), pos)
+	}
+	if op == "/" {
+		return Int(a / b), nil
+	}
+	return Int(a % b), nil
+}
+
+func arithUint(op string, a, b uint64, pos int) (Value, error) {
+	overflow := errorf(SQLSTATE_OUT_OF_RANGE, pos, "integer out of range")
+	switch op {
+	case "+":
+		if a+b < a {
+			return Null(), overflow
+		}
+		return Uint(a + b), nil
+	case "-":
+		if b > a {
+			return Null(), overflow
+		}
+		return Uint(a - b), nil
+	case "*":
+		if a != 0 && (a*b)/a != b {
+			return Null(), overflow
+		}
+		return Uint(a * b), nil
+	}
+	if b == 0 {
+		return Null(), errorf(SQLSTATE_DIVISION_BY_ZERO, pos, "division by zero")
+	}
+	if op == "/" {
+		return Uint(a / b), nil
+	}
+	return Uint(a % b), nil
+}
+
+/* like matches s against a LIKE pattern: % matches any run of characters, _ one character and \ escapes the next */
+func like(s, pattern string) bool {
+	str, pat := []rune(s), []rune(pattern)
+	// Backtracking to the last % keeps the match linear in practice
+	si, pi := 0, 0
+	starPi, starSi := -1, 0
+	for si < len(str) {
+		if pi < len(pat) {
+			c := pat[pi]
+			switch {
+			case c == '%':
+				starPi, starSi = pi, si
+				pi++
+				continue
+			case c == '\\' && pi+1 < len(pat):
+				if pat[pi+1] == str[si] {
+					pi += 2
+					si++
+					continue
+				}
+			case c == '_' || c == str[si]:
+				pi++
+				si++
+				continue
+			}
+		}
+		if starPi < 0 {
+			return false
+		}
+		starSi++
+		si, pi = starSi, starPi+1
+	}
+	for pi < len(pat) && pat[pi] == '%' {
+		pi++
+	}
+	return pi == len(pat)
+}
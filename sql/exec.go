@@ -0,0 +1,506 @@
+package sql
+
+import (
+	"errors"
+
+	"github.com/misachi/DarDB/storage/db"
+)
+
+/*
+Operator is a node of a query plan. Open prepares it to run inside the transaction of ctx, each
+call to Next returns the next row, nil once there are no more, and Close releases what Open took.
+Operators pull rows from their children, so a plan runs a row at a time.
+*/
+type Operator interface {
+	Open(ctx *db.ClientContext) error
+	Next() (Row, error)
+	Close() error
+}
+
+/* recordSource is an operator whose rows are records of a table. RecordID is the record of the last row returned */
+type recordSource interface {
+	Operator
+	RecordID() db.RecordID
+}
+
+/* Index finds the records of a table with a key */
+type Index interface {
+	Lookup(key Value) ([]db.RecordID, error)
+}
+
+/*
+SeqScan reads every record of a table, or with Filter the records it is true for. Filter is over
+the columns of the table and is checked as each block is read, so the records it rejects are not
+locked.
+*/
+type SeqScan struct {
+	Table  *db.Table
+	Filter Expr
+
+	scan    *db.TableScan
+	rid     db.RecordID
+	matched []Row // Rows the filter passed, in the order the scan returns their records
+}
+
+func (s *SeqScan) Open(ctx *db.ClientContext) error {
+	s.scan, s.matched = s.Table.Scan(ctx), nil
+	if s.Filter != nil {
+		cols := s.Table.GetInfo().Column
+		s.scan.Where(func(values [][]byte) (bool, error) {
+			r, err := decodeRow(values, cols)
+			if err != nil {
+				return false, err
+			}
+			ok, err := Eval(s.Filter, r)
+			if err != nil || !isTrue(ok) {
+				return false, err
+			}
+			s.matched = append(s.matched, r)
+			return true, nil
+		})
+	}
+	return nil
+}
+
+func (s *SeqScan) Next() (Row, error) {
+	rid, values, err := s.scan.Next()
+	if err != nil || values == nil {
+		return nil, err
+	}
+	s.rid = rid
+	if s.Filter != nil {
+		r := s.matched[0]
+		s.matched = s.matched[1:]
+		return r, nil
+	}
+	return decodeRow(values, s.Table.GetInfo().Column)
+}
+
+func (s *SeqScan) Close() error {
+	s.scan, s.matched = nil, nil
+	return nil
+}
+
+func (s *SeqScan) RecordID() db.RecordID { return s.rid }
+
+/*
+IndexScan reads the records of a table an index on Column finds with the value of Key. The index
+may point at a record that no longer holds the key, so the key is checked again on every record.
+*/
+type IndexScan struct {
+	Table  *db.Table
+	Index  Index
+	Column int
+	Key    Expr // Evaluated once, over no row, and converted to the type of Column
+
+	ctx  *db.ClientContext
+	key  Value
+	rids []db.RecordID
+	rid  db.RecordID
+}
+
+func (s *IndexScan) Open(ctx *db.ClientContext) error {
+	s.ctx = ctx
+	key, err := Eval(s.Key, nil)
+	if err != nil {
+		return err
+	}
+	if key.IsNull() {
+		s.rids = nil
+		return nil
+	}
+	if key, err = Coerce(key, s.Table.GetInfo().Column[s.Column].Type); err != nil {
+		return err
+	}
+	s.key = key
+	s.rids, err = s.Index.Lookup(key)
+	return err
+}
+
+func (s *IndexScan) Next() (Row, error) {
+	for len(s.rids) > 0 {
+		rid := s.rids[0]
+		s.rids = s.rids[1:]
+		values, err := s.Table.Fetch(s.ctx, rid)
+		if errors.Is(err, db.ErrRecordNotFound) {
+			// Deleted since the index was read
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		r, err := decodeRow(values, s.Table.GetInfo().Column)
+		if err != nil {
+			return nil, err
+		}
+		if r[s.Column].IsNull() || compare(r[s.Column], s.key) != 0 {
+			// Changed since the index was read
+			continue
+		}
+		s.rid = rid
+		return r, nil
+	}
+	return nil, nil
+}
+
+func (s *IndexScan) Close() error {
+	s.rids = nil
+	return nil
+}
+
+func (s *IndexScan) RecordID() db.RecordID { return s.rid }
+
+/* Values returns rows of expressions that do not refer to columns, like SELECT without FROM */
+type Values struct {
+	Rows [][]Expr
+
+	next int
+}
+
+func (v *Values) Open(ctx *db.ClientContext) error {
+	v.next = 0
+	return nil
+}
+
+func (v *Values) Next() (Row, error) {
+	if v.next >= len(v.Rows) {
+		return nil, nil
+	}
+	exprs := v.Rows[v.next]
+	v.next++
+	r := make(Row, len(exprs))
+	for i, e := range exprs {
+		value, err := Eval(e, nil)
+		if err != nil {
+			return nil, err
+		}
+		r[i] = value
+	}
+	return r, nil
+}
+
+func (v *Values) Close() error { return nil }
+
+/* Filter passes on the rows for which Pred is true */
+type Filter struct {
+	Child Operator
+	Pred  Expr
+}
+
+func (f *Filter) Open(ctx *db.ClientContext) error { return f.Child.Open(ctx) }
+
+func (f *Filter) Next() (Row, error) {
+	for {
+		r, err := f.Child.Next()
+		if err != nil || r == nil {
+			return nil, err
+		}
+		ok, err := Eval(f.Pred, r)
+		if err != nil {
+			return nil, err
+		}
+		if isTrue(ok) {
+			return r, nil
+		}
+	}
+}
+
+func (f *Filter) Close() error { return f.Child.Close() }
+
+/* RecordID is the record of the last row when the child reads a table */
+func (f *Filter) RecordID() db.RecordID {
+	if src, ok := f.Child.(recordSource); ok {
+		return src.RecordID()
+	}
+	return db.RecordID{}
+}
+
+/* Project computes Exprs over each row */
+type Project struct {
+	Child Operator
+	Exprs []Expr
+}
+
+func (p *Project) Open(ctx *db.ClientContext) error { return p.Child.Open(ctx) }
+
+func (p *Project) Next() (Row, error) {
+	r, err := p.Child.Next()
+	if err != nil || r == nil {
+		return nil, err
+	}
+	out := make(Row, len(p.Exprs))
+	for i, e := range p.Exprs {
+		if out[i], err = Eval(e, r); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+func (p *Project) Close() error { return p.Child.Close() }
+
+/* Limit skips the first Offset rows and passes on at most Limit rows. Either can be nil */
+type Limit struct {
+	Child  Operator
+	Limit  Expr
+	Offset Expr
+
+	remaining int64 // Negative without a limit
+	skip      int64
+}
+
+func (l *Limit) Open(ctx *db.ClientContext) error {
+	var err error
+	if l.remaining, err = count(l.Limit, "LIMIT", SQLSTATE_INVALID_LIMIT); err != nil {
+		return err
+	}
+	if l.skip, err = count(l.Offset, "OFFSET", SQLSTATE_INVALID_OFFSET); err != nil {
+		return err
+	}
+	if l.skip < 0 {
+		l.skip = 0
+	}
+	return l.Child.Open(ctx)
+}
+
+/* count evaluates a LIMIT or OFFSET; NULL, like a missing clause, is -1 */
+func count(e Expr, clause, code string) (int64, error) {
+	if e == nil {
+		return -1, nil
+	}
+	v, err := Eval(e, nil)
+	if err != nil || v.IsNull() {
+		return -1, err
+	}
+	n, err := toInt(v, e.Pos())
+	if err == nil && n < 0 {
+		err = errorf(code, e.Pos(), "%s must not be negative", clause)
+	}
+	return n, err
+}
+
+func (l *Limit) Next() (Row, error) {
+	if l.remaining == 0 {
+		return nil, nil
+	}
+	for ; l.skip > 0; l.skip-- {
+		r, err := l.Child.Next()
+		if err != nil || r == nil {
+			return nil, err
+		}
+	}
+	r, err := l.Child.Next()
+	if err != nil || r == nil {
+		return nil, err
+	}
+	if l.remaining > 0 {
+		l.remaining--
+	}
+	return r, nil
+}
+
+func (l *Limit) Close() error { return l.Child.Close() }
+
+/*
+Insert stores the rows of its child in a table, each value in column Targets[i]. Columns without
+a value are NULL. Next returns a single row holding the number of rows inserted.
+*/
+type Insert struct {
+	Table   *db.Table
+	Targets []int
+	Child   Operator
+
+	ctx  *db.ClientContext
+	done bool
+}
+
+func (ins *Insert) Open(ctx *db.ClientContext) error {
+	ins.ctx = ctx
+	ins.done = false
+	return ins.Child.Open(ctx)
+}
+
+func (ins *Insert) Next() (Row, error) {
+	if ins.done {
+		return nil, nil
+	}
+	ins.done = true
+	info := ins.Table.GetInfo()
+	var n int64
+	for {
+		r, err := ins.Child.Next()
+		if err != nil {
+			return nil, err
+		}
+		if r == nil {
+			break
+		}
+		full := make(Row, len(info.Column))
+		for i, target := range ins.Targets {
+			full[target] = r[i]
+		}
+		values, err := encodeRow(full, info)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := ins.Table.AddRecord(ins.ctx, info.Column, values); err != nil {
+			return nil, changeError(err, info)
+		}
+		n++
+	}
+	return Row{Int(n)}, nil
+}
+
+func (ins *Insert) Close() error { return ins.Child.Close() }
+
+/*
+Update assigns Set to the records its child reads, returning the number of records changed. The
+child's records are read before any is changed, so a record moved by the update is not seen again.
+*/
+type Update struct {
+	Table *db.Table
+	Set   []*Assignment
+	Child recordSource
+
+	ctx  *db.ClientContext
+	done bool
+}
+
+func (u *Update) Open(ctx *db.ClientContext) error {
+	u.ctx = ctx
+	u.done = false
+	return u.Child.Open(ctx)
+}
+
+func (u *Update) Next() (Row, error) {
+	if u.done {
+		return nil, nil
+	}
+	u.done = true
+	rids, rows, err := readRecords(u.Child)
+	if err != nil {
+		return nil, err
+	}
+	info := u.Table.GetInfo()
+	for i, r := range rows {
+		updated := make(Row, len(r))
+		copy(updated, r)
+		for _, set := range u.Set {
+			if updated[set.Index], err = Eval(set.Value, r); err != nil {
+				return nil, err
+			}
+		}
+		values, err := encodeRow(updated, info)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := u.Table.UpdateRecord(u.ctx, rids[i], info.Column, values); err != nil {
+			return nil, changeError(err, info)
+		}
+	}
+	return Row{Int(int64(len(rows)))}, nil
+}
+
+func (u *Update) Close() error { return u.Child.Close() }
+
+/* Delete removes the records its child reads, returning the number of records removed */
+type Delete struct {
+	Table *db.Table
+	Child recordSource
+
+	ctx  *db.ClientContext
+	done bool
+}
+
+func (d *Delete) Open(ctx *db.ClientContext) error {
+	d.ctx = ctx
+	d.done = false
+	return d.Child.Open(ctx)
+}
+
+func (d *Delete) Next() (Row, error) {
+	if d.done {
+		return nil, nil
+	}
+	d.done = true
+	rids, _, err := readRecords(d.Child)
+	if err != nil {
+		return nil, err
+	}
+	for _, rid := range rids {
+		if err := d.Table.DeleteRecord(d.ctx, rid); err != nil {
+			return nil, changeError(err, d.Table.GetInfo())
+		}
+	}
+	return Row{Int(int64(len(rids)))}, nil
+}
+
+func (d *Delete) Close() error { return d.Child.Close() }
+
+/* readRecords reads every row of src with its record ID */
+func readRecords(src recordSource) ([]db.RecordID, []Row, error) {
+	var rids []db.RecordID
+	var rows []Row
+	for {
+		r, err := src.Next()
+		if err != nil {
+			return nil, nil, err
+		}
+		if r == nil {
+			return rids, rows, nil
+		}
+		rids = append(rids, src.RecordID())
+		rows = append(rows, r)
+	}
+}
+
+/* encodeRow converts a row to the values a table stores, checking the primary key is set */
+func encodeRow(r Row, info *db.TableInfo) ([][]byte, error) {
+	values := make([][]byte, len(info.Column))
+	for i, col := range info.Column {
+		if r[i].IsNull() && col.Name == info.Pkey.Name {
+			return nil, errorf(SQLSTATE_NOT_NULL_VIOLATION, -1, "null value in column %q of relation %q violates not-null constraint", col.Name, info.Name)
+		}
+		data, err := encodeValue(r[i], col.Type)
+		if err != nil {
+			return nil, err
+		}
+		values[i] = data
+	}
+	return values, nil
+}
+
+/*
+changeError reports a record whose primary key is already taken as a unique violation, and a record
+another transaction is changing as a serialization failure
+*/
+func changeError(err error, info *db.TableInfo) error {
+	switch {
+	case errors.Is(err, db.ErrDuplicateKey):
+		return errorf(SQLSTATE_UNIQUE_VIOLATION, -1, "duplicate key value violates unique constraint \"%s_pkey\"", info.Name)
+	case errors.Is(err, db.ErrWriteConflict):
+		return errorf(SQLSTATE_SERIALIZATION_FAILURE, -1, "could not serialize access due to concurrent update")
+	}
+	return err
+}
+
+/* Run opens op, reads all its rows and closes it */
+func Run(ctx *db.ClientContext, op Operator) ([]Row, error) {
+	if err := op.Open(ctx); err != nil {
+		op.Close()
+		return nil, err
+	}
+	var rows []Row
+	for {
+		r, err := op.Next()
+		if err != nil {
+			op.Close()
+			return nil, err
+		}
+		if r == nil {
+			break
+		}
+		rows = append(rows, r)
+	}
+	return rows, op.Close()
+}
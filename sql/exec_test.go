@@ -0,0 +1,358 @@
+package sql
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/misachi/DarDB/column"
+	"github.com/misachi/DarDB/storage/db"
+)
+
+func testSession(t *testing.T) (*Session, *db.ClientContext) {
+	database := testDB(t)
+	ctx := db.GetClientContextMgr(testDBCfg).NewClientCtx(testDBCfg, database)
+	t.Cleanup(ctx.Close)
+	return NewSession(database, ctx), ctx
+}
+
+func exec(t *testing.T, s *Session, query string) *Result {
+	results, err := s.Exec(query)
+	if err != nil {
+		t.Fatalf("Exec error: %s: %v", query, err)
+	}
+	return results[len(results)-1]
+}
+
+func execError(t *testing.T, s *Session, query, code string) {
+	_, err := s.Exec(query)
+	var sqlErr *Error
+	if !errors.As(err, &sqlErr) || sqlErr.Code != code {
+		t.Errorf("Exec error: %s: expected %s but got %v", query, code, err)
+	}
+}
+
+/* rowsText formats rows as psql does, a row per line with | between values */
+func rowsText(rows []Row) string {
+	lines := make([]string, len(rows))
+	for i, r := range rows {
+		values := make([]string, len(r))
+		for j, v := range r {
+			values[j] = v.String()
+			if v.IsNull() {
+				values[j] = "NULL"
+			}
+		}
+		lines[i] = strings.Join(values, "|")
+	}
+	return strings.Join(lines, "\n")
+}
+
+/* columnNames joins the names of result columns with commas */
+func columnNames(cols []ResultColumn) string {
+	names := make([]string, len(cols))
+	for i, col := range cols {
+		names[i] = col.Name
+	}
+	return strings.Join(names, ",")
+}
+
+func TestEval(t *testing.T) {
+	database := testDB(t)
+	tests := []struct {
+		expr     string
+		expected string
+	}{
+		{"1 + 2 * 3", "7"},
+		{"7 / 2", "3"},
+		{"-7 % 3", "-1"},
+		{"7 / 2.0", "3.5"},
+		{"'ab' || NULL", "NULL"},
+		{"'ab' || 1", "ab1"},
+		{"NULL AND false", "f"},
+		{"NULL AND true", "NULL"},
+		{"NULL OR true", "t"},
+		{"NOT (NULL = 1)", "NULL"},
+		{"1 < 2.5", "t"},
+		{"-1 < 18446744073709551615", "t"},
+		{"'abc' LIKE 'a%'", "t"},
+		{"'abc' LIKE '_b_'", "t"},
+		{"'abc' LIKE 'a%d'", "f"},
+		{"'a%c' LIKE 'a\\%c'", "t"},
+		{"'abc' NOT LIKE '%c'", "f"},
+		{"2 IN (1, 2)", "t"},
+		{"3 IN (1, NULL)", "NULL"},
+		{"3 NOT IN (1, 2)", "t"},
+		{"2 BETWEEN 1 AND 3", "t"},
+		{"2 NOT BETWEEN NULL AND 1", "t"},
+		{"NULL IS NULL", "t"},
+		{"-9223372036854775807 - 1", "-9223372036854775808"},
+	}
+	for _, test := range tests {
+		sel := bind(t, database, "SELECT "+test.expr).(*SelectStmt)
+		v, err := Eval(sel.Items[0].Expr, nil)
+		if err != nil {
+			t.Errorf("Eval error: %s: %v", test.expr, err)
+			continue
+		}
+		if got := rowsText([]Row{{v}}); got != test.expected {
+			t.Errorf("Eval error: %s: expected %s but got %s", test.expr, test.expected, got)
+		}
+	}
+
+	errs := []struct {
+		expr string
+		code string
+	}{
+		{"9223372036854775807 + 1", SQLSTATE_OUT_OF_RANGE},
+		{"-9223372036854775808 * -1", SQLSTATE_OUT_OF_RANGE},
+		{"-(-9223372036854775808)", SQLSTATE_OUT_OF_RANGE},
+		{"4294967296 * 4294967296", SQLSTATE_OUT_OF_RANGE},
+		{"18446744073709551615 + 1", SQLSTATE_OUT_OF_RANGE},
+		{"1 / 0", SQLSTATE_DIVISION_BY_ZERO},
+		{"1.5 / 0", SQLSTATE_DIVISION_BY_ZERO},
+	}
+	for _, test := range errs {
+		sel := bind(t, database, "SELECT "+test.expr).(*SelectStmt)
+		_, err := Eval(sel.Items[0].Expr, nil)
+		var sqlErr *Error
+		if !errors.As(err, &sqlErr) || sqlErr.Code != test.code {
+			t.Errorf("Eval error: %s: expected %s but got %v", test.expr, test.code, err)
+		}
+	}
+}
+
+func TestValueCodec(t *testing.T) {
+	tests := []struct {
+		value Value
+		typ   column.SUPPORTED_TYPE
+	}{
+		{String(""), column.STRING},
+		{String("\x00a"), column.STRING},
+		{String("a\x00"), column.STRING},
+		{Null(), column.STRING},
+		{Int(-5), column.INT8},
+		{Uint(18446744073709551615), column.UINT64},
+		{Float(0.1), column.FLOAT64},
+		{Float(float64(float32(0.1))), column.FLOAT32},
+	}
+	for _, test := range tests {
+		data, err := encodeValue(test.value, test.typ)
+		if err != nil {
+			t.Errorf("encodeValue error: %+v: %v", test.value, err)
+			continue
+		}
+		if (data == nil) != test.value.IsNull() {
+			t.Errorf("encodeValue error: %+v encoded as %q", test.value, data)
+		}
+		got, err := decodeValue(data, test.typ)
+		if err != nil || got != test.value {
+			t.Errorf("decodeValue error: expected %+v but got %+v: %v", test.value, got, err)
+		}
+	}
+	if _, err := encodeValue(Int(128), column.INT8); err == nil {
+		t.Errorf("encodeValue error: expected 128 to be out of range for tinyint")
+	}
+}
+
+func TestSession(t *testing.T) {
+	s, _ := testSession(t)
+	exec(t, s, "CREATE TABLE items (id int PRIMARY KEY, name text, qty uint16, price real)")
+	if r := exec(t, s, "INSERT INTO items (id, name, qty, price) VALUES (1, 'apple', 3, 0.5), (2, '', 10, 1.25), (3, NULL, 0, NULL), (4, 'pear', 7, 2)"); r.Tag != "INSERT 0 4" {
+		t.Errorf("Exec error: unexpected INSERT tag %q", r.Tag)
+	}
+
+	tests := []struct {
+		query    string
+		expected string
+	}{
+		{"SELECT id, name FROM items ORDER BY id", "1|apple\n2|\n3|NULL\n4|pear"},
+		{"SELECT name, qty * 2 AS double FROM items WHERE qty > 2 ORDER BY double DESC", "|20\npear|14\napple|6"},
+		{"SELECT id FROM items ORDER BY name NULLS FIRST, id", "3\n2\n1\n4"},
+		{"SELECT id FROM items ORDER BY price DESC", "3\n4\n2\n1"},
+		{"SELECT id FROM items ORDER BY id LIMIT 2 OFFSET 1", "2\n3"},
+		{"SELECT id FROM items WHERE name LIKE 'p%' OR price IS NULL ORDER BY 1", "3\n4"},
+		{"SELECT 1 + 1, 'x'", "2|x"},
+	}
+	for _, test := range tests {
+		r := exec(t, s, test.query)
+		if got := rowsText(r.Rows); got != test.expected {
+			t.Errorf("Exec error: %s: expected\n%s\nbut got\n%s", test.query, test.expected, got)
+		}
+	}
+
+	// A record that grows out of its block moves; the update must not see it again
+	long := strings.Repeat("x", 3000)
+	if r := exec(t, s, "UPDATE items SET name = name || '"+long+"', qty = qty + 1 WHERE name IS NOT NULL"); r.RowsAffected != 3 {
+		t.Errorf("Exec error: expected 3 updated rows but got %d", r.RowsAffected)
+	}
+	r := exec(t, s, "SELECT id, qty, name = 'apple"+long+"' FROM items ORDER BY id")
+	if got := rowsText(r.Rows); got != "1|4|t\n2|11|f\n3|0|NULL\n4|8|f" {
+		t.Errorf("Exec error: unexpected rows after UPDATE\n%s", got)
+	}
+	execError(t, s, "UPDATE items SET qty = qty - 1 WHERE id = 3", SQLSTATE_OUT_OF_RANGE)
+	execError(t, s, "UPDATE items SET qty = qty * 10000", SQLSTATE_OUT_OF_RANGE)
+	if r := exec(t, s, "SELECT qty FROM items WHERE id = 4"); rowsText(r.Rows) != "8" {
+		t.Errorf("Exec error: expected a failed UPDATE to change nothing but got %s", rowsText(r.Rows))
+	}
+	if r := exec(t, s, "DELETE FROM items WHERE qty >= 8"); r.Tag != "DELETE 2" {
+		t.Errorf("Exec error: unexpected DELETE tag %q", r.Tag)
+	}
+	if r := exec(t, s, "SELECT id FROM items ORDER BY id"); rowsText(r.Rows) != "1\n3" {
+		t.Errorf("Exec error: unexpected rows after DELETE %s", rowsText(r.Rows))
+	}
+
+	execError(t, s, "SELECT id FROM items LIMIT -1", SQLSTATE_INVALID_LIMIT)
+	execError(t, s, "INSERT INTO items (id) VALUES (1 / 0)", SQLSTATE_DIVISION_BY_ZERO)
+	exec(t, s, "DROP TABLE items")
+	execError(t, s, "SELECT * FROM items", SQLSTATE_UNDEFINED_TABLE)
+}
+
+func TestDeclaredOrder(t *testing.T) {
+	s, _ := testSession(t)
+	exec(t, s, "CREATE TABLE pets (name text, id int PRIMARY KEY, age int, owner text)")
+	exec(t, s, "INSERT INTO pets VALUES ('rex', 1, 4, 'ann'), ('tom', 2, 9, NULL)")
+	r := exec(t, s, "SELECT * FROM pets ORDER BY id")
+	if names := columnNames(r.Columns); names != "name,id,age,owner" {
+		t.Errorf("Exec error: expected the columns in declared order but got %s", names)
+	}
+	if got := rowsText(r.Rows); got != "rex|1|4|ann\ntom|2|9|NULL" {
+		t.Errorf("Exec error: unexpected rows of a positional INSERT\n%s", got)
+	}
+	exec(t, s, "DROP TABLE pets")
+}
+
+func TestPrimaryKey(t *testing.T) {
+	s, _ := testSession(t)
+	exec(t, s, "CREATE TABLE users (id int PRIMARY KEY, name text)")
+	exec(t, s, "INSERT INTO users (id, name) VALUES (1, 'ann'), (2, 'bob')")
+	execError(t, s, "INSERT INTO users (id, name) VALUES (1, 'cat')", SQLSTATE_UNIQUE_VIOLATION)
+	execError(t, s, "INSERT INTO users (id, name) VALUES (3, 'cat'), (3, 'dan')", SQLSTATE_UNIQUE_VIOLATION)
+	execError(t, s, "UPDATE users SET id = 2 WHERE id = 1", SQLSTATE_UNIQUE_VIOLATION)
+	exec(t, s, "UPDATE users SET name = 'bo' WHERE id = 2")
+	exec(t, s, "UPDATE users SET id = 3 WHERE id = 1")
+	exec(t, s, "INSERT INTO users (id, name) VALUES (1, 'eve')")
+
+	// Rolling back a delete takes the key again
+	exec(t, s, "BEGIN; DELETE FROM users WHERE id = 2; ROLLBACK")
+	execError(t, s, "INSERT INTO users (id, name) VALUES (2, 'fay')", SQLSTATE_UNIQUE_VIOLATION)
+	if r := exec(t, s, "SELECT id, name FROM users ORDER BY id"); rowsText(r.Rows) != "1|eve\n2|bo\n3|ann" {
+		t.Errorf("Exec error: unexpected rows after duplicate keys\n%s", rowsText(r.Rows))
+	}
+	exec(t, s, "DROP TABLE users")
+}
+
+func TestSessionTransaction(t *testing.T) {
+	s, _ := testSession(t)
+	exec(t, s, "CREATE TABLE IF NOT EXISTS accounts (id int, balance int)")
+	exec(t, s, "INSERT INTO accounts (id, balance) VALUES (1, 100), (2, 50)")
+
+	exec(t, s, "BEGIN; UPDATE accounts SET balance = balance - 30 WHERE id = 1; UPDATE accounts SET balance = balance + 30 WHERE id = 2")
+	if inBlock, failed := s.InTransaction(); !inBlock || failed {
+		t.Errorf("Session error: expected an open transaction block")
+	}
+	exec(t, s, "ROLLBACK")
+	if r := exec(t, s, "SELECT balance FROM accounts ORDER BY id"); rowsText(r.Rows) != "100\n50" {
+		t.Errorf("Session error: expected ROLLBACK to undo the updates but got %s", rowsText(r.Rows))
+	}
+
+	// An error aborts the block; statements are refused until it ends and COMMIT rolls back
+	exec(t, s, "BEGIN; DELETE FROM accounts WHERE id = 2")
+	execError(t, s, "SELECT 1 / 0", SQLSTATE_DIVISION_BY_ZERO)
+	execError(t, s, "SELECT 1", SQLSTATE_FAILED_TRANSACTION)
+	if r := exec(t, s, "COMMIT"); r.Tag != "ROLLBACK" {
+		t.Errorf("Session error: expected COMMIT of a failed block to roll back but got %s", r.Tag)
+	}
+	if r := exec(t, s, "SELECT id FROM accounts ORDER BY id"); rowsText(r.Rows) != "1\n2" {
+		t.Errorf("Session error: expected the failed block to be rolled back but got %s", rowsText(r.Rows))
+	}
+	if inBlock, failed := s.InTransaction(); inBlock || failed {
+		t.Errorf("Session error: expected the transaction block to be over")
+	}
+}
+
+func TestWriteConflict(t *testing.T) {
+	a, _ := testSession(t)
+	b, _ := testSession(t)
+	exec(t, a, "CREATE TABLE conflicts (id int PRIMARY KEY, v text)")
+	exec(t, a, "INSERT INTO conflicts (id, v) VALUES (1, 'one')")
+
+	// A record changed by a running transaction is not written by another until it ends
+	exec(t, a, "BEGIN; UPDATE conflicts SET v = 'a' WHERE id = 1")
+	execError(t, b, "UPDATE conflicts SET v = 'b' WHERE id = 1", SQLSTATE_SERIALIZATION_FAILURE)
+	exec(t, a, "ROLLBACK")
+	exec(t, b, "UPDATE conflicts SET v = 'b-committed' WHERE id = 1")
+	exec(t, a, "BEGIN; INSERT INTO conflicts (id, v) VALUES (2, 'two')")
+	execError(t, b, "UPDATE conflicts SET v = 'b' WHERE id = 2", SQLSTATE_SERIALIZATION_FAILURE)
+	execError(t, b, "DELETE FROM conflicts WHERE id = 2", SQLSTATE_SERIALIZATION_FAILURE)
+	exec(t, a, "ROLLBACK")
+	if r := exec(t, b, "SELECT id, v FROM conflicts ORDER BY id"); rowsText(r.Rows) != "1|b-committed" {
+		t.Errorf("Exec error: expected the committed update to survive the rollbacks but got\n%s", rowsText(r.Rows))
+	}
+
+	// A key deleted by a running transaction stays taken, so the rollback gets it back
+	exec(t, a, "BEGIN; DELETE FROM conflicts WHERE id = 1")
+	execError(t, b, "INSERT INTO conflicts (id, v) VALUES (1, 'b-one')", SQLSTATE_SERIALIZATION_FAILURE)
+	exec(t, a, "ROLLBACK")
+	execError(t, b, "INSERT INTO conflicts (id, v) VALUES (1, 'b-one')", SQLSTATE_UNIQUE_VIOLATION)
+	if r := exec(t, b, "SELECT id, v FROM conflicts ORDER BY id"); rowsText(r.Rows) != "1|b-committed" {
+		t.Errorf("Exec error: expected one row with the key after the rollback but got\n%s", rowsText(r.Rows))
+	}
+
+	// Locks are released at commit
+	exec(t, a, "BEGIN; DELETE FROM conflicts WHERE id = 1; COMMIT")
+	exec(t, b, "INSERT INTO conflicts (id, v) VALUES (1, 'again')")
+	exec(t, a, "UPDATE conflicts SET v = 'a-again' WHERE id = 1")
+	exec(t, a, "DROP TABLE conflicts")
+}
+
+/* mapIndex is an index kept by the test, which does not follow later changes to the table */
+type mapIndex map[int64][]db.RecordID
+
+func (m mapIndex) Lookup(key Value) ([]db.RecordID, error) {
+	return m[key.I], nil
+}
+
+func TestIndexScan(t *testing.T) {
+	s, ctx := testSession(t)
+	database := testDB(t)
+	exec(t, s, "CREATE TABLE indexed (id bigint, name text)")
+	exec(t, s, "INSERT INTO indexed (id, name) VALUES (1, 'a'), (2, 'b'), (3, 'c'), (4, 'b')")
+	tbl := database.GetTable("indexed")
+
+	index := mapIndex{}
+	scan := &SeqScan{Table: tbl}
+	if err := scan.Open(ctx); err != nil {
+		t.Fatalf("Open error: %v", err)
+	}
+	for {
+		r, err := scan.Next()
+		if err != nil {
+			t.Fatalf("Next error: %v", err)
+		}
+		if r == nil {
+			break
+		}
+		index[r[0].I] = append(index[r[0].I], scan.RecordID())
+	}
+	scan.Close()
+	if err := ctx.Commit(); err != nil {
+		t.Fatalf("Commit error: %v", err)
+	}
+	exec(t, s, "DELETE FROM indexed WHERE id = 3")
+	exec(t, s, "UPDATE indexed SET id = 6 WHERE id = 4")
+
+	for key, expected := range map[int64]string{2: "2|b", 3: "", 4: "", 5: ""} {
+		scan := &IndexScan{Table: tbl, Index: index, Key: &Literal{Value: Int(key)}}
+		rows, err := Run(ctx, scan)
+		if err != nil {
+			t.Fatalf("Run error: %v", err)
+		}
+		if got := rowsText(rows); got != expected {
+			t.Errorf("IndexScan error: key %d expected %q but got %q", key, expected, got)
+		}
+	}
+	if err := ctx.Commit(); err != nil {
+		t.Fatalf("Commit error: %v", err)
+	}
+}
@@ -0,0 +1,450 @@
+package sql
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/misachi/DarDB/storage/db"
+)
+
+/*
+explainNode describes an operator of a plan, named and laid out as PostgreSQL does. The JSON
+format writes it as it is; the text format writes the fields that are set, one line each.
+*/
+type explainNode struct {
+	NodeType   string         `json:"Node Type"`
+	JoinType   string         `json:"Join Type,omitempty"`
+	Relation   string         `json:"Relation Name,omitempty"`
+	Cost       float64        `json:"Total Cost"`
+	Rows       int64          `json:"Plan Rows"`
+	*actual                   // Set by EXPLAIN ANALYZE
+	Output     []string       `json:"Output,omitempty"`
+	IndexCond  string         `json:"Index Cond,omitempty"`
+	HashCond   string         `json:"Hash Cond,omitempty"`
+	MergeCond  string         `json:"Merge Cond,omitempty"`
+	JoinFilter string         `json:"Join Filter,omitempty"`
+	Filter     string         `json:"Filter,omitempty"`
+	SortKey    []string       `json:"Sort Key,omitempty"`
+	GroupKey   []string       `json:"Group Key,omitempty"`
+	Plans      []*explainNode `json:"Plans,omitempty"`
+}
+
+/* actual is what an operator did when it ran. Rows, time and buffers are totals over every loop */
+type actual struct {
+	Time       float64 `json:"Actual Total Time"` // Milliseconds, including the children
+	Rows       int64   `json:"Actual Rows"`
+	Loops      int64   `json:"Actual Loops"`
+	Hits       int64   `json:"Shared Hit Blocks"`
+	Reads      int64   `json:"Shared Read Blocks"`
+	SpillFiles int     `json:"Spill Files,omitempty"`
+}
+
+type explainPlan struct {
+	Plan          *explainNode `json:"Plan"`
+	PlanningTime  *float64     `json:"Planning Time,omitempty"`
+	ExecutionTime *float64     `json:"Execution Time,omitempty"`
+}
+
+/*
+instrumented counts what an operator does while EXPLAIN ANALYZE runs it. Time and buffers include
+the work of the operator's children. Buffers are the blocks the client running the statement asked
+the pool for, so other sessions do not add to them.
+*/
+type instrumented struct {
+	op  Operator
+	ctx *db.ClientContext
+	actual
+	elapsed time.Duration
+}
+
+func (in *instrumented) Open(ctx *db.ClientContext) error {
+	in.Loops++
+	defer in.measure()()
+	return in.op.Open(ctx)
+}
+
+func (in *instrumented) Next() (Row, error) {
+	defer in.measure()()
+	r, err := in.op.Next()
+	if r != nil {
+		in.Rows++
+	}
+	return r, err
+}
+
+func (in *instrumented) Close() error {
+	in.SpillFiles += spillFiles(in.op)
+	defer in.measure()()
+	return in.op.Close()
+}
+
+/* RecordID is the record of the last row when the operator reads a table */
+func (in *instrumented) RecordID() db.RecordID {
+	if src, ok := in.op.(recordSource); ok {
+		return src.RecordID()
+	}
+	return db.RecordID{}
+}
+
+/* measure starts timing a call; the function it returns adds the time and blocks used since */
+func (in *instrumented) measure() func() {
+	start, before := time.Now(), in.ctx.BufferStats()
+	return func() {
+		in.elapsed += time.Since(start)
+		after := in.ctx.BufferStats()
+		in.Hits += after.Hits - before.Hits
+		in.Reads += after.Reads - before.Reads
+	}
+}
+
+/* spillFiles is the number of temp files op wrote the last time it ran */
+func spillFiles(op Operator) int {
+	switch op := op.(type) {
+	case *Sort:
+		if op.sorter != nil {
+			return op.sorter.spilled
+		}
+	case *HashJoin:
+		return op.spilled
+	case *HashAggregate:
+		return op.spilled
+	}
+	return 0
+}
+
+/* instrument wraps op and every operator below it to count what they do when ctx runs them */
+func instrument(op Operator, ctx *db.ClientContext) Operator {
+	mapChildren(op, func(child Operator) Operator { return instrument(child, ctx) })
+	return &instrumented{op: op, ctx: ctx}
+}
+
+/* mapChildren replaces each input of op with what fn returns for it, left before right */
+func mapChildren(op Operator, fn func(Operator) Operator) {
+	switch op := op.(type) {
+	case *Filter:
+		op.Child = fn(op.Child)
+	case *Project:
+		op.Child = fn(op.Child)
+	case *Limit:
+		op.Child = fn(op.Child)
+	case *Sort:
+		op.Child = fn(op.Child)
+	case *HashAggregate:
+		op.Child = fn(op.Child)
+	case *GroupAggregate:
+		op.Child = fn(op.Child)
+	case *Insert:
+		op.Child = fn(op.Child)
+	case *Update:
+		op.Child = fn(op.Child).(recordSource)
+	case *Delete:
+		op.Child = fn(op.Child).(recordSource)
+	case *NestedLoopJoin:
+		op.Left, op.Right = fn(op.Left), fn(op.Right)
+	case *BlockNestedLoopJoin:
+		op.Left, op.Right = fn(op.Left), fn(op.Right)
+	case *HashJoin:
+		op.Left, op.Right = fn(op.Left), fn(op.Right)
+	case *MergeJoin:
+		op.Left, op.Right = fn(op.Left), fn(op.Right)
+	}
+}
+
+/* children lists the inputs of op, left before right */
+func children(op Operator) []Operator {
+	var out []Operator
+	mapChildren(op, func(child Operator) Operator {
+		out = append(out, child)
+		return child
+	})
+	return out
+}
+
+/* explainColumns describes the rows of EXPLAIN, which are text */
+var explainColumns = []ResultColumn{{Name: "QUERY PLAN", Kind: KIND_STRING, Type: kindType(KIND_STRING)}}
+
+/*
+explain plans the statement of s and describes the plan, one row per line of text or a single row
+of JSON. EXPLAIN ANALYZE runs the statement as well, so the changes of a data change are made.
+*/
+func explain(ctx *db.ClientContext, s *ExplainStmt) (*Result, error) {
+	start := time.Now()
+	p := newPlanner(workMem(ctx, 0))
+	op, err := p.plan(s.Stmt)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := p.estimate(op); err != nil {
+		return nil, err
+	}
+	planning := time.Since(start)
+
+	out := &explainPlan{}
+	if s.Analyze {
+		op = instrument(op, ctx)
+		start = time.Now()
+		if _, err := Run(ctx, op); err != nil {
+			return nil, err
+		}
+		planningMs, executionMs := millis(planning), millis(time.Since(start))
+		out.PlanningTime, out.ExecutionTime = &planningMs, &executionMs
+	}
+	out.Plan, _ = describe(p, op)
+
+	var lines []string
+	if s.Format == EXPLAIN_JSON {
+		data, err := json.MarshalIndent([]*explainPlan{out}, "", "  ")
+		if err != nil {
+			return nil, errorf(SQLSTATE_INTERNAL_ERROR, -1, "cannot write the plan as JSON: %v", err)
+		}
+		lines = []string{string(data)}
+	} else {
+		lines = writePlan(nil, out.Plan, 0)
+		if out.PlanningTime != nil {
+			lines = append(lines, fmt.Sprintf("Planning Time: %.3f ms", *out.PlanningTime), fmt.Sprintf("Execution Time: %.3f ms", *out.ExecutionTime))
+		}
+	}
+	rows := make([]Row, len(lines))
+	for i, line := range lines {
+		rows[i] = Row{String(line)}
+	}
+	return &Result{
+		Columns:      explainColumns,
+		Rows:         rows,
+		RowsAffected: int64(len(rows)),
+		Tag:          "EXPLAIN",
+	}, nil
+}
+
+func millis(d time.Duration) float64 {
+	return math.Round(float64(d)/float64(time.Microsecond)) / 1000
+}
+
+/* describe builds the node of op and its children, returning the names of the columns of its rows too */
+func describe(p *planner, op Operator) (*explainNode, []string) {
+	var run *instrumented
+	if in, ok := op.(*instrumented); ok {
+		run, op = in, in.op
+	}
+	node := &explainNode{}
+	if est, ok := p.ests[op]; ok {
+		node.Cost, node.Rows = math.Round(est.cost*100)/100, int64(math.Round(est.rows))
+	}
+	if run != nil {
+		a := run.actual
+		a.Time = millis(run.elapsed)
+		node.actual = &a
+	}
+	var inputs [][]string
+	for _, child := range children(op) {
+		plan, cols := describe(p, child)
+		node.Plans = append(node.Plans, plan)
+		inputs = append(inputs, cols)
+	}
+	var cols []string
+	if len(inputs) > 0 {
+		cols = inputs[0]
+	}
+	joined := func(typ JoinType) []string {
+		if typ == JOIN_SEMI || typ == JOIN_ANTI {
+			return inputs[0]
+		}
+		return append(append([]string{}, inputs[0]...), inputs[1]...)
+	}
+	both := func() []string { return joined(JOIN_INNER) }
+
+	switch op := op.(type) {
+	case *SeqScan:
+		node.NodeType, node.Relation = "Seq Scan", op.Table.GetInfo().Name
+		cols = tableColumns(op.Table)
+		node.Filter = label(op.Filter, cols)
+	case *IndexScan:
+		node.NodeType, node.Relation = "Index Scan", op.Table.GetInfo().Name
+		cols = tableColumns(op.Table)
+		node.IndexCond = "(" + cols[op.Column] + " = " + label(op.Key, nil) + ")"
+	case *Values:
+		node.NodeType = "Values Scan"
+		if len(op.Rows) > 0 {
+			for i := range op.Rows[0] {
+				cols = append(cols, "column"+strconv.Itoa(i+1))
+			}
+		}
+	case *Filter:
+		node.NodeType, node.Filter = "Filter", label(op.Pred, cols)
+	case *Project:
+		node.NodeType, node.Output = "Project", labels(op.Exprs, cols)
+		cols = node.Output
+	case *Limit:
+		node.NodeType = "Limit"
+	case *Sort:
+		node.NodeType = "Sort"
+		for _, key := range op.Keys {
+			node.SortKey = append(node.SortKey, sortKey(key, cols))
+		}
+	case *HashAggregate:
+		node.NodeType, node.GroupKey = "HashAggregate", labels(op.GroupBy, cols)
+		cols = append(append([]string{}, node.GroupKey...), aggLabels(op.Aggs, cols)...)
+	case *GroupAggregate:
+		node.NodeType, node.GroupKey = "GroupAggregate", labels(op.GroupBy, cols)
+		if len(op.GroupBy) == 0 {
+			node.NodeType = "Aggregate"
+		}
+		cols = append(append([]string{}, node.GroupKey...), aggLabels(op.Aggs, cols)...)
+	case *Insert:
+		node.NodeType, node.Relation, cols = "Insert", op.Table.GetInfo().Name, []string{"count"}
+	case *Update:
+		node.NodeType, node.Relation, cols = "Update", op.Table.GetInfo().Name, []string{"count"}
+	case *Delete:
+		node.NodeType, node.Relation, cols = "Delete", op.Table.GetInfo().Name, []string{"count"}
+	case *NestedLoopJoin:
+		node.NodeType, node.JoinType = "Nested Loop", op.Type.String()
+		node.JoinFilter, cols = label(op.Cond, both()), joined(op.Type)
+	case *BlockNestedLoopJoin:
+		node.NodeType, node.JoinType = "Block Nested Loop", op.Type.String()
+		node.JoinFilter, cols = label(op.Cond, both()), joined(op.Type)
+	case *HashJoin:
+		node.NodeType, node.JoinType = "Hash Join", op.Type.String()
+		node.HashCond = keyCond(op.LeftKeys, op.RightKeys, inputs)
+		node.JoinFilter, cols = label(op.Cond, both()), joined(op.Type)
+	case *MergeJoin:
+		node.NodeType, node.JoinType = "Merge Join", op.Type.String()
+		node.MergeCond = keyCond(op.LeftKeys, op.RightKeys, inputs)
+		node.JoinFilter, cols = label(op.Cond, both()), joined(op.Type)
+	default:
+		node.NodeType = fmt.Sprintf("%T", op)
+	}
+	return node, cols
+}
+
+func tableColumns(tbl *db.Table) []string {
+	info := tbl.GetInfo()
+	cols := make([]string, len(info.Column))
+	for i, col := range info.Column {
+		cols[i] = col.Name
+	}
+	return cols
+}
+
+/*
+label writes e as SQL over rows whose columns are named by cols. Columns the binder named keep
+the name the query gave them; those the planner made up are named after the column they read.
+*/
+func label(e Expr, cols []string) string {
+	if e == nil {
+		return ""
+	}
+	e, _ = transform(e, func(e Expr) (Expr, bool, error) {
+		if ref, ok := e.(*ColumnRef); ok && ref.Name == "" {
+			c := *ref
+			c.Name = "$" + strconv.Itoa(ref.Index)
+			if ref.Index >= 0 && ref.Index < len(cols) {
+				c.Name = cols[ref.Index]
+			}
+			return &c, true, nil
+		}
+		return e, false, nil
+	})
+	return FormatExpr(e)
+}
+
+func labels(list []Expr, cols []string) []string {
+	var out []string
+	for _, e := range list {
+		out = append(out, label(e, cols))
+	}
+	return out
+}
+
+func aggLabels(aggs []*FuncCall, cols []string) []string {
+	out := make([]string, len(aggs))
+	for i, agg := range aggs {
+		out[i] = label(agg, cols)
+	}
+	return out
+}
+
+func sortKey(key *OrderItem, cols []string) string {
+	text := label(key.Expr, cols)
+	if key.Desc {
+		text += " DESC"
+	}
+	switch key.Nulls {
+	case NULLS_FIRST:
+		text += " NULLS FIRST"
+	case NULLS_LAST:
+		text += " NULLS LAST"
+	}
+	return text
+}
+
+/* keyCond writes the equal keys of a join as a condition, left keys over the left columns and right keys over the right */
+func keyCond(left, right []Expr, inputs [][]string) string {
+	conds := make([]string, len(left))
+	for i := range left {
+		conds[i] = "(" + label(left[i], inputs[0]) + " = " + label(right[i], inputs[1]) + ")"
+	}
+	if len(conds) == 1 {
+		return conds[0]
+	}
+	return "(" + strings.Join(conds, " AND ") + ")"
+}
+
+/*
+writePlan appends the text lines of node at depth, as psql shows a plan: children are marked with
+an arrow under their parent, and the details of a node are indented below it.
+*/
+func writePlan(lines []string, node *explainNode, depth int) []string {
+	name := node.NodeType
+	if node.JoinType != "" && node.JoinType != JOIN_INNER.String() {
+		name = strings.TrimSuffix(name, " Join") + " " + node.JoinType + " Join"
+	}
+	if node.Relation != "" {
+		name += " on " + node.Relation
+	}
+	text := fmt.Sprintf("%s  (cost=%.2f rows=%d)", name, node.Cost, node.Rows)
+	if a := node.actual; a != nil {
+		text += fmt.Sprintf(" (actual time=%.3f rows=%d loops=%d)", a.Time, a.Rows, a.Loops)
+	}
+	if depth > 0 {
+		text = strings.Repeat(" ", 6*depth-4) + "->  " + text
+	}
+	lines = append(lines, text)
+
+	indent := strings.Repeat(" ", 6*depth+2)
+	detail := func(key, value string) {
+		if value != "" {
+			lines = append(lines, indent+key+": "+value)
+		}
+	}
+	detail("Output", strings.Join(node.Output, ", "))
+	detail("Index Cond", node.IndexCond)
+	detail("Hash Cond", node.HashCond)
+	detail("Merge Cond", node.MergeCond)
+	detail("Join Filter", node.JoinFilter)
+	detail("Filter", node.Filter)
+	detail("Sort Key", strings.Join(node.SortKey, ", "))
+	detail("Group Key", strings.Join(node.GroupKey, ", "))
+	if a := node.actual; a != nil {
+		if a.SpillFiles > 0 {
+			detail("Spill Files", strconv.Itoa(a.SpillFiles))
+		}
+		var buffers []string
+		if a.Hits > 0 {
+			buffers = append(buffers, "hit="+strconv.FormatInt(a.Hits, 10))
+		}
+		if a.Reads > 0 {
+			buffers = append(buffers, "read="+strconv.FormatInt(a.Reads, 10))
+		}
+		if len(buffers) > 0 {
+			detail("Buffers", "shared "+strings.Join(buffers, " "))
+		}
+	}
+	for _, child := range node.Plans {
+		lines = writePlan(lines, child, depth+1)
+	}
+	return lines
+}
@@ -0,0 +1,127 @@
+package sql
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestExplain(t *testing.T) {
+	s, ctx := testSession(t)
+	database := testDB(t)
+	exec(t, s, "CREATE TABLE tools (id int PRIMARY KEY, bin int, name text)")
+	exec(t, s, "CREATE TABLE bins (id int PRIMARY KEY, label text)")
+	t.Cleanup(func() { s.Exec("DROP TABLE tools; DROP TABLE bins") })
+	var values []string
+	for i := 0; i < 200; i++ {
+		values = append(values, fmt.Sprintf("(%d, %d, 'tool %d')", i, i%5, i))
+	}
+	exec(t, s, "INSERT INTO tools (id, bin, name) VALUES "+strings.Join(values, ", "))
+	exec(t, s, "INSERT INTO bins (id, label) VALUES (0, 'b0'), (1, 'b1'), (2, 'b2'), (3, 'b3'), (4, 'b4')")
+	for _, name := range []string{"tools", "bins"} {
+		if _, err := database.Analyze(database.GetTable(name)); err != nil {
+			t.Fatalf("Analyze error: %v", err)
+		}
+	}
+	explain := func(query string) []string {
+		r := exec(t, s, query)
+		if r.Tag != "EXPLAIN" || len(r.Columns) != 1 || r.Columns[0].Name != "QUERY PLAN" {
+			t.Fatalf("Exec error: %s: unexpected result %+v", query, r)
+		}
+		return strings.Split(rowsText(r.Rows), "\n")
+	}
+	contains := func(lines []string, text string) bool {
+		for _, line := range lines {
+			if strings.Contains(line, text) {
+				return true
+			}
+		}
+		return false
+	}
+
+	lines := explain("EXPLAIN SELECT name FROM tools WHERE bin = 2")
+	expected := []string{
+		"Project  (cost=",
+		"  Output: name",
+		"  ->  Seq Scan on tools  (cost=",
+		"        Filter: (bin = 2)",
+	}
+	if len(lines) != len(expected) {
+		t.Fatalf("EXPLAIN error: expected %d lines but got\n%s", len(expected), strings.Join(lines, "\n"))
+	}
+	for i, line := range lines {
+		if !strings.HasPrefix(line, expected[i]) || strings.Contains(line, "actual") {
+			t.Errorf("EXPLAIN error: line %d: expected %q but got %q", i, expected[i], line)
+		}
+	}
+	if !strings.HasSuffix(lines[2], "rows=40)") {
+		t.Errorf("EXPLAIN error: expected the scan to estimate 40 rows but got %q", lines[2])
+	}
+
+	lines = explain("EXPLAIN ANALYZE SELECT name FROM tools WHERE bin = 2")
+	for _, line := range lines {
+		if strings.Contains(line, "Seq Scan") && (!strings.Contains(line, "(actual time=") || !strings.HasSuffix(line, "rows=40 loops=1)")) {
+			t.Errorf("EXPLAIN ANALYZE error: expected the scan to return 40 rows once but got %q", line)
+		}
+	}
+	if !contains(lines, "Buffers: shared hit=") || !strings.HasPrefix(lines[len(lines)-1], "Execution Time: ") {
+		t.Errorf("EXPLAIN ANALYZE error: expected buffers and times in\n%s", strings.Join(lines, "\n"))
+	}
+	if lines = explain("EXPLAIN SELECT b.label, t.name FROM bins b LEFT JOIN tools t ON t.bin = b.id"); !contains(lines, "Left Join") {
+		t.Errorf("EXPLAIN error: expected a left join in\n%s", strings.Join(lines, "\n"))
+	}
+
+	lines = explain("EXPLAIN (ANALYZE, FORMAT JSON) SELECT b.label, count(*) FROM tools t JOIN bins b ON t.bin = b.id GROUP BY b.label")
+	if len(lines) < 2 {
+		t.Fatalf("EXPLAIN error: expected JSON written over several lines but got %s", lines)
+	}
+	var plans []struct {
+		Plan          map[string]any
+		ExecutionTime *float64 `json:"Execution Time"`
+	}
+	if err := json.Unmarshal([]byte(strings.Join(lines, "\n")), &plans); err != nil {
+		t.Fatalf("EXPLAIN error: invalid JSON: %v", err)
+	}
+	if len(plans) != 1 || plans[0].ExecutionTime == nil || plans[0].Plan["Node Type"] != "Project" || plans[0].Plan["Actual Rows"] != float64(5) {
+		t.Fatalf("EXPLAIN error: unexpected JSON plan %+v", plans)
+	}
+	var scans int
+	var walk func(node map[string]any)
+	walk = func(node map[string]any) {
+		if node["Node Type"] == "Seq Scan" {
+			scans++
+			if hits, _ := node["Shared Hit Blocks"].(float64); hits == 0 {
+				t.Errorf("EXPLAIN error: expected the scan of %v to hit buffers", node["Relation Name"])
+			}
+		}
+		children, _ := node["Plans"].([]any)
+		for _, child := range children {
+			walk(child.(map[string]any))
+		}
+	}
+	walk(plans[0].Plan)
+	if scans != 2 {
+		t.Errorf("EXPLAIN error: expected 2 scans in the JSON plan but got %d", scans)
+	}
+
+	// EXPLAIN alone changes nothing; EXPLAIN ANALYZE makes the change it reports
+	explain("EXPLAIN DELETE FROM tools WHERE bin = 4")
+	if lines = explain("EXPLAIN ANALYZE DELETE FROM tools WHERE bin = 4"); !strings.HasPrefix(lines[0], "Delete on tools") || !strings.Contains(lines[0], "rows=1 loops=1") {
+		t.Errorf("EXPLAIN ANALYZE error: unexpected plan\n%s", strings.Join(lines, "\n"))
+	}
+	if r := exec(t, s, "SELECT count(*) FROM tools"); rowsText(r.Rows) != "160" {
+		t.Errorf("EXPLAIN ANALYZE error: expected 160 rows left but got %s", rowsText(r.Rows))
+	}
+
+	// The right input of a nested loop is scanned again for every left row
+	join := instrument(&NestedLoopJoin{Left: valuesOf(Row{Int(1)}, Row{Int(2)}, Row{Int(3)}), Right: valuesOf(Row{Int(1)}, Row{Int(2)}), RightWidth: 1}, ctx)
+	rows, err := Run(ctx, join)
+	if err != nil {
+		t.Fatalf("Run error: %v", err)
+	}
+	inner := children(join.(*instrumented).op)[1].(*instrumented)
+	if len(rows) != 6 || inner.Loops != 3 || inner.Rows != 6 {
+		t.Errorf("instrument error: expected 3 loops of 2 rows but got %d loops of %d rows", inner.Loops, inner.Rows)
+	}
+}
@@ -0,0 +1,224 @@
+package sql
+
+/* walkExpr calls fn on e and the expressions under it, depth first, while fn returns true */
+func walkExpr(e Expr, fn func(Expr) bool) {
+	if e == nil || !fn(e) {
+		return
+	}
+	switch e := e.(type) {
+	case *Unary:
+		walkExpr(e.X, fn)
+	case *Binary:
+		walkExpr(e.Left, fn)
+		walkExpr(e.Right, fn)
+	case *IsNull:
+		walkExpr(e.X, fn)
+	case *Like:
+		walkExpr(e.X, fn)
+		walkExpr(e.Pattern, fn)
+	case *In:
+		walkExpr(e.X, fn)
+		for _, item := range e.List {
+			walkExpr(item, fn)
+		}
+	case *Between:
+		walkExpr(e.X, fn)
+		walkExpr(e.Low, fn)
+		walkExpr(e.High, fn)
+	case *FuncCall:
+		for _, arg := range e.Args {
+			walkExpr(arg, fn)
+		}
+	}
+}
+
+/* columnsWithin reports whether e reads columns and every one is in [lo, hi) of the row */
+func columnsWithin(e Expr, lo, hi int) bool {
+	within, any := true, false
+	walkExpr(e, func(e Expr) bool {
+		if ref, ok := e.(*ColumnRef); ok {
+			any = true
+			within = within && ref.Index >= lo && ref.Index < hi
+		}
+		return within
+	})
+	return any && within
+}
+
+/*
+transform copies e, replacing the expressions fn handles with what it returns. fn sees an
+expression before those under it; the expressions it does not handle are copied with their
+operands transformed.
+*/
+func transform(e Expr, fn func(Expr) (Expr, bool, error)) (Expr, error) {
+	if e == nil {
+		return nil, nil
+	}
+	if out, ok, err := fn(e); ok || err != nil {
+		return out, err
+	}
+	var err error
+	switch e := e.(type) {
+	case *Unary:
+		c := *e
+		c.X, err = transform(e.X, fn)
+		return &c, err
+	case *Binary:
+		c := *e
+		if c.Left, err = transform(e.Left, fn); err != nil {
+			return nil, err
+		}
+		c.Right, err = transform(e.Right, fn)
+		return &c, err
+	case *IsNull:
+		c := *e
+		c.X, err = transform(e.X, fn)
+		return &c, err
+	case *Like:
+		c := *e
+		if c.X, err = transform(e.X, fn); err != nil {
+			return nil, err
+		}
+		c.Pattern, err = transform(e.Pattern, fn)
+		return &c, err
+	case *In:
+		c := *e
+		if c.X, err = transform(e.X, fn); err != nil {
+			return nil, err
+		}
+		c.List, err = transformList(e.List, fn)
+		return &c, err
+	case *Between:
+		c := *e
+		if c.X, err = transform(e.X, fn); err != nil {
+			return nil, err
+		}
+		if c.Low, err = transform(e.Low, fn); err != nil {
+			return nil, err
+		}
+		c.High, err = transform(e.High, fn)
+		return &c, err
+	case *FuncCall:
+		c := *e
+		c.Args, err = transformList(e.Args, fn)
+		return &c, err
+	}
+	return e, nil
+}
+
+func transformList(list []Expr, fn func(Expr) (Expr, bool, error)) ([]Expr, error) {
+	out := make([]Expr, len(list))
+	for i, e := range list {
+		var err error
+		if out[i], err = transform(e, fn); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+/*
+rebase copies e with its column references moved by delta, so it can be evaluated over rows
+holding only some of the columns it was bound against.
+*/
+func rebase(e Expr, delta int) Expr {
+	e, _ = transform(e, func(e Expr) (Expr, bool, error) {
+		if ref, ok := e.(*ColumnRef); ok {
+			c := *ref
+			c.Index += delta
+			return &c, true, nil
+		}
+		return e, false, nil
+	})
+	return e
+}
+
+func rebaseList(list []Expr, delta int) []Expr {
+	out := make([]Expr, len(list))
+	for i, e := range list {
+		out[i] = rebase(e, delta)
+	}
+	return out
+}
+
+/* conjuncts splits a condition into the conditions ANDed together in it */
+func conjuncts(e Expr) []Expr {
+	if e == nil {
+		return nil
+	}
+	if b, ok := e.(*Binary); ok && b.Op == "AND" {
+		return append(conjuncts(b.Left), conjuncts(b.Right)...)
+	}
+	return []Expr{e}
+}
+
+/* andAll ANDs conditions together, nil if there are none */
+func andAll(conds []Expr) Expr {
+	var e Expr
+	for _, cond := range conds {
+		if e == nil {
+			e = cond
+			continue
+		}
+		e = &Binary{exprBase: exprBase{pos: cond.Pos(), kind: KIND_BOOL}, Op: "AND", Left: e, Right: cond}
+	}
+	return e
+}
+
+/* equalExpr reports whether a and b are the same bound expression, so they compute the same value */
+func equalExpr(a, b Expr) bool {
+	switch a := a.(type) {
+	case *Literal:
+		b, ok := b.(*Literal)
+		return ok && a.Value == b.Value
+	case *ColumnRef:
+		b, ok := b.(*ColumnRef)
+		return ok && a.Index == b.Index
+	case *Unary:
+		b, ok := b.(*Unary)
+		return ok && a.Op == b.Op && equalExpr(a.X, b.X)
+	case *Binary:
+		b, ok := b.(*Binary)
+		return ok && a.Op == b.Op && equalExpr(a.Left, b.Left) && equalExpr(a.Right, b.Right)
+	case *IsNull:
+		b, ok := b.(*IsNull)
+		return ok && a.Not == b.Not && equalExpr(a.X, b.X)
+	case *Like:
+		b, ok := b.(*Like)
+		return ok && a.Not == b.Not && equalExpr(a.X, b.X) && equalExpr(a.Pattern, b.Pattern)
+	case *In:
+		b, ok := b.(*In)
+		return ok && a.Not == b.Not && equalExpr(a.X, b.X) && equalList(a.List, b.List)
+	case *Between:
+		b, ok := b.(*Between)
+		return ok && a.Not == b.Not && equalExpr(a.X, b.X) && equalExpr(a.Low, b.Low) && equalExpr(a.High, b.High)
+	case *FuncCall:
+		b, ok := b.(*FuncCall)
+		return ok && a.Name == b.Name && a.Star == b.Star && a.Distinct == b.Distinct && equalList(a.Args, b.Args)
+	}
+	return false
+}
+
+func equalList(a, b []Expr) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !equalExpr(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+/* hasAggregate reports whether e calls an aggregate */
+func hasAggregate(e Expr) bool {
+	found := false
+	walkExpr(e, func(e Expr) bool {
+		if _, ok := e.(*FuncCall); ok {
+			found = true
+		}
+		return !found
+	})
+	return found
+}
@@ -0,0 +1,38 @@
+package sql
+
+import (
+	"github.com/misachi/DarDB/column"
+	"github.com/misachi/DarDB/storage/db"
+)
+
+/* tableIndex looks up records with an index of their table, by the stored form of the key */
+type tableIndex struct {
+	index *db.Index
+	typ   column.SUPPORTED_TYPE
+}
+
+func (ti tableIndex) Lookup(key Value) ([]db.RecordID, error) {
+	data, err := encodeValue(key, ti.typ)
+	if err != nil {
+		return nil, err
+	}
+	return ti.index.Lookup(data), nil
+}
+
+/* tableIndexes returns the indexes of tbl by column */
+func tableIndexes(tbl *db.Table) (map[int]Index, error) {
+	indexes, err := tbl.Indexes()
+	if err != nil {
+		return nil, err
+	}
+	info := tbl.GetInfo()
+	out := make(map[int]Index, len(indexes))
+	for _, index := range indexes {
+		for i, col := range info.Column {
+			if col.Name == index.Column() {
+				out[i] = tableIndex{index: index, typ: col.Type}
+			}
+		}
+	}
+	return out, nil
+}
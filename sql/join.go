@@ -0,0 +1,803 @@
+package sql
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"math"
+
+	"github.com/misachi/DarDB/storage/db"
+)
+
+/*
+Joins read rows from a left and a right input. Cond is evaluated over the left row followed by
+the right row, and nil matches every pair. Inner and left joins return such combined rows, with
+RightWidth NULLs in place of the right row for left rows without a match; semi and anti joins
+return left rows only.
+*/
+
+/* joinRows pairs a left row with a right row, or with NULLs when right is nil */
+func joinRows(left, right Row, rightWidth int) Row {
+	out := make(Row, len(left)+rightWidth)
+	copy(out, left)
+	copy(out[len(left):], right)
+	return out
+}
+
+func joinMatch(cond Expr, left, right Row, rightWidth int) (bool, error) {
+	if cond == nil {
+		return true, nil
+	}
+	ok, err := Eval(cond, joinRows(left, right, rightWidth))
+	return isTrue(ok), err
+}
+
+/* joinUnmatched is the row a join returns for a left row without a match, nil if none */
+func joinUnmatched(typ JoinType, left Row, rightWidth int) Row {
+	switch typ {
+	case JOIN_LEFT:
+		return joinRows(left, nil, rightWidth)
+	case JOIN_ANTI:
+		return left
+	}
+	return nil
+}
+
+/*
+joinProbe matches one left row at a time against candidate right rows, the part of a join that
+is the same whatever found the candidates.
+*/
+type joinProbe struct {
+	typ        JoinType
+	cond       Expr
+	rightWidth int
+
+	left       Row
+	candidates []Row
+	next       int
+	matched    bool
+}
+
+func (p *joinProbe) start(left Row, candidates []Row) {
+	p.left, p.candidates, p.next, p.matched = left, candidates, 0, false
+}
+
+/* step returns the next row the current left row joins to, nil once it is done with it */
+func (p *joinProbe) step() (Row, error) {
+	for p.left != nil {
+		if p.next >= len(p.candidates) {
+			left := p.left
+			p.left = nil
+			if !p.matched {
+				if out := joinUnmatched(p.typ, left, p.rightWidth); out != nil {
+					return out, nil
+				}
+			}
+			return nil, nil
+		}
+		right := p.candidates[p.next]
+		p.next++
+		ok, err := joinMatch(p.cond, p.left, right, p.rightWidth)
+		if err != nil || !ok {
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		p.matched = true
+		switch p.typ {
+		case JOIN_SEMI:
+			left := p.left
+			p.left = nil
+			return left, nil
+		case JOIN_ANTI:
+			p.left = nil
+			return nil, nil
+		}
+		return joinRows(p.left, right, p.rightWidth), nil
+	}
+	return nil, nil
+}
+
+/* NestedLoopJoin scans its right input again for every left row */
+type NestedLoopJoin struct {
+	Left, Right Operator
+	Type        JoinType
+	Cond        Expr
+	RightWidth  int
+
+	ctx       *db.ClientContext
+	left      Row
+	matched   bool
+	rightOpen bool
+}
+
+func (j *NestedLoopJoin) Open(ctx *db.ClientContext) error {
+	j.ctx, j.left = ctx, nil
+	return j.Left.Open(ctx)
+}
+
+func (j *NestedLoopJoin) Next() (Row, error) {
+	for {
+		if j.left == nil {
+			left, err := j.Left.Next()
+			if err != nil || left == nil {
+				return nil, err
+			}
+			if err := j.Right.Open(j.ctx); err != nil {
+				return nil, err
+			}
+			j.left, j.matched, j.rightOpen = left, false, true
+		}
+		right, err := j.Right.Next()
+		if err != nil {
+			return nil, err
+		}
+		if right == nil {
+			left := j.left
+			if err := j.endLeft(); err != nil {
+				return nil, err
+			}
+			if out := joinUnmatched(j.Type, left, j.RightWidth); out != nil && !j.matched {
+				return out, nil
+			}
+			continue
+		}
+		ok, err := joinMatch(j.Cond, j.left, right, j.RightWidth)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+		j.matched = true
+		switch j.Type {
+		case JOIN_SEMI:
+			left := j.left
+			return left, j.endLeft()
+		case JOIN_ANTI:
+			if err := j.endLeft(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		return joinRows(j.left, right, j.RightWidth), nil
+	}
+}
+
+/* endLeft stops scanning the right input for the current left row */
+func (j *NestedLoopJoin) endLeft() error {
+	j.left = nil
+	j.rightOpen = false
+	return j.Right.Close()
+}
+
+func (j *NestedLoopJoin) Close() error {
+	if j.rightOpen {
+		j.rightOpen = false
+		j.Right.Close()
+	}
+	return j.Left.Close()
+}
+
+/*
+BlockNestedLoopJoin reads left rows a block at a time, up to WorkMem bytes of them, and scans the
+right input once per block, so the right input is read once for many left rows.
+*/
+type BlockNestedLoopJoin struct {
+	Left, Right Operator
+	Type        JoinType
+	Cond        Expr
+	RightWidth  int
+	WorkMem     int64 // Zero uses the config
+
+	ctx       *db.ClientContext
+	mem       int64
+	block     []Row
+	matched   []bool
+	out       []Row
+	leftDone  bool
+	rightOpen bool
+}
+
+func (j *BlockNestedLoopJoin) Open(ctx *db.ClientContext) error {
+	j.ctx, j.mem = ctx, workMem(ctx, j.WorkMem)
+	j.block, j.matched, j.out, j.leftDone = nil, nil, nil, false
+	return j.Left.Open(ctx)
+}
+
+func (j *BlockNestedLoopJoin) Next() (Row, error) {
+	for {
+		if len(j.out) > 0 {
+			out := j.out[0]
+			j.out = j.out[1:]
+			return out, nil
+		}
+		if j.rightOpen {
+			if err := j.scanRight(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if j.leftDone {
+			return nil, nil
+		}
+		if err := j.readBlock(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+/* readBlock reads the next block of left rows and starts a scan of the right input for it */
+func (j *BlockNestedLoopJoin) readBlock() error {
+	j.block = j.block[:0]
+	var size int64
+	for size < j.mem {
+		left, err := j.Left.Next()
+		if err != nil {
+			return err
+		}
+		if left == nil {
+			j.leftDone = true
+			break
+		}
+		j.block = append(j.block, left)
+		size += rowSize(left)
+	}
+	if len(j.block) == 0 {
+		return nil
+	}
+	j.matched = make([]bool, len(j.block))
+	if err := j.Right.Open(j.ctx); err != nil {
+		return err
+	}
+	j.rightOpen = true
+	return nil
+}
+
+/* scanRight matches the next right row with the block, or ends the block after the last */
+func (j *BlockNestedLoopJoin) scanRight() error {
+	right, err := j.Right.Next()
+	if err != nil {
+		return err
+	}
+	if right == nil {
+		j.rightOpen = false
+		if err := j.Right.Close(); err != nil {
+			return err
+		}
+		for i, left := range j.block {
+			if out := joinUnmatched(j.Type, left, j.RightWidth); out != nil && !j.matched[i] {
+				j.out = append(j.out, out)
+			}
+		}
+		return nil
+	}
+	for i, left := range j.block {
+		if j.matched[i] && (j.Type == JOIN_SEMI || j.Type == JOIN_ANTI) {
+			continue
+		}
+		ok, err := joinMatch(j.Cond, left, right, j.RightWidth)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		j.matched[i] = true
+		switch j.Type {
+		case JOIN_INNER, JOIN_LEFT:
+			j.out = append(j.out, joinRows(left, right, j.RightWidth))
+		case JOIN_SEMI:
+			j.out = append(j.out, left)
+		}
+	}
+	return nil
+}
+
+func (j *BlockNestedLoopJoin) Close() error {
+	j.block, j.out = nil, nil
+	if j.rightOpen {
+		j.rightOpen = false
+		j.Right.Close()
+	}
+	return j.Left.Close()
+}
+
+const (
+	HASH_PARTITIONS     = 16 // Partitions a hash join splits its inputs into when the right input does not fit in memory
+	MAX_PARTITION_DEPTH = 3  // Times a partition that still does not fit is split again
+)
+
+/*
+HashJoin builds a hash table of its right input keyed on the values of RightKeys, then looks up
+every left row with the values of LeftKeys. Keys with a NULL never match. Cond, if set, is checked
+on top of equal keys.
+
+If the hash table outgrows WorkMem, both inputs are split by key into partitions in temp files,
+and the partitions are joined one pair at a time, splitting any that still do not fit again.
+*/
+type HashJoin struct {
+	Left, Right Operator
+	LeftKeys    []Expr // Over left rows
+	RightKeys   []Expr // Over right rows
+	Type        JoinType
+	Cond        Expr
+	RightWidth  int
+	WorkMem     int64 // Zero uses the config
+
+	ctx       *db.ClientContext
+	mem       int64
+	table     map[string][]Row
+	probe     func() (Row, error)
+	current   *hashPartition
+	pending   []*hashPartition
+	spilled   int // Partitions written, for tests and EXPLAIN
+	matcher   joinProbe
+	leftOpen  bool
+	rightOpen bool
+}
+
+type hashPartition struct {
+	build, probe *spillFile
+	depth        int
+}
+
+func (p *hashPartition) close() {
+	if p.build != nil {
+		p.build.close()
+	}
+	if p.probe != nil {
+		p.probe.close()
+	}
+}
+
+func (j *HashJoin) Open(ctx *db.ClientContext) error {
+	j.ctx, j.mem = ctx, workMem(ctx, j.WorkMem)
+	j.table, j.probe, j.current, j.pending, j.spilled = nil, nil, nil, nil, 0
+	j.matcher = joinProbe{typ: j.Type, cond: j.Cond, rightWidth: j.RightWidth}
+
+	if err := j.Right.Open(ctx); err != nil {
+		return err
+	}
+	j.rightOpen = true
+	parts, err := j.build()
+	if err != nil {
+		return err
+	}
+	j.rightOpen = false
+	if err := j.Right.Close(); err != nil {
+		return err
+	}
+
+	if err := j.Left.Open(ctx); err != nil {
+		return err
+	}
+	j.leftOpen = true
+	if parts == nil {
+		j.probe = j.Left.Next
+		return nil
+	}
+	// The left input is split the same way as the right, so matching rows meet in the same partition
+	j.pending = parts
+	return j.partition(parts, j.Left.Next, j.LeftKeys, false, 0)
+}
+
+/* build reads the right input into the hash table, returning the partitions it spilled to if it did not fit */
+func (j *HashJoin) build() ([]*hashPartition, error) {
+	j.table = make(map[string][]Row)
+	var size int64
+	for {
+		right, err := j.Right.Next()
+		if err != nil {
+			return nil, err
+		}
+		if right == nil {
+			return nil, nil
+		}
+		key, ok, err := hashKey(j.RightKeys, right)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+		j.table[key] = append(j.table[key], right)
+		size += rowSize(right)
+		if size <= j.mem {
+			continue
+		}
+		parts, err := j.newPartitions(0)
+		if err != nil {
+			return nil, err
+		}
+		if err := j.spillTable(parts, 0); err != nil {
+			closePartitions(parts)
+			return nil, err
+		}
+		if err := j.partition(parts, j.Right.Next, j.RightKeys, true, 0); err != nil {
+			closePartitions(parts)
+			return nil, err
+		}
+		return parts, nil
+	}
+}
+
+func (j *HashJoin) newPartitions(depth int) ([]*hashPartition, error) {
+	parts := make([]*hashPartition, HASH_PARTITIONS)
+	for i := range parts {
+		parts[i] = &hashPartition{depth: depth}
+		var err error
+		if parts[i].build, err = newSpillFile(j.ctx); err == nil {
+			parts[i].probe, err = newSpillFile(j.ctx)
+		}
+		if err != nil {
+			closePartitions(parts[:i+1])
+			return nil, err
+		}
+	}
+	j.spilled += len(parts)
+	return parts, nil
+}
+
+func closePartitions(parts []*hashPartition) {
+	for _, p := range parts {
+		p.close()
+	}
+}
+
+/* spillTable moves the rows of the hash table to the build side of parts */
+func (j *HashJoin) spillTable(parts []*hashPartition, depth int) error {
+	for key, rows := range j.table {
+		p := parts[partitionOf(key, depth)]
+		for _, r := range rows {
+			if err := p.build.write(r); err != nil {
+				return err
+			}
+		}
+	}
+	j.table = nil
+	return nil
+}
+
+/*
+partition writes the rows of next to the build or probe side of parts by key. Rows with a NULL
+key cannot match: build rows are dropped and probe rows kept only where the join returns them.
+*/
+func (j *HashJoin) partition(parts []*hashPartition, next func() (Row, error), keys []Expr, build bool, depth int) error {
+	for {
+		r, err := next()
+		if err != nil || r == nil {
+			return err
+		}
+		key, ok, err := hashKey(keys, r)
+		if err != nil {
+			return err
+		}
+		if !ok && (build || j.Type == JOIN_INNER || j.Type == JOIN_SEMI) {
+			continue
+		}
+		p := parts[partitionOf(key, depth)]
+		f := p.probe
+		if build {
+			f = p.build
+		}
+		if err := f.write(r); err != nil {
+			return err
+		}
+	}
+}
+
+/* partitionOf picks the partition of a key; each level of splitting hashes differently */
+func partitionOf(key string, depth int) int {
+	h := fnv.New64a()
+	h.Write([]byte{byte(depth)})
+	h.Write([]byte(key))
+	return int(h.Sum64() % HASH_PARTITIONS)
+}
+
+/* nextPartition loads the build side of the next partition into the hash table and starts probing it */
+func (j *HashJoin) nextPartition() (bool, error) {
+	if j.current != nil {
+		j.current.close()
+		j.current = nil
+	}
+	for len(j.pending) > 0 {
+		p := j.pending[0]
+		j.pending = j.pending[1:]
+		j.current = p
+		if p.probe.rows == 0 {
+			p.close()
+			j.current = nil
+			continue
+		}
+		if err := p.build.rewind(); err != nil {
+			return false, err
+		}
+		j.table = make(map[string][]Row)
+		var size int64
+		for {
+			r, err := p.build.read()
+			if err != nil {
+				return false, err
+			}
+			if r == nil {
+				break
+			}
+			key, _, err := hashKey(j.RightKeys, r)
+			if err != nil {
+				return false, err
+			}
+			j.table[key] = append(j.table[key], r)
+			size += rowSize(r)
+		}
+		if size > j.mem && p.depth < MAX_PARTITION_DEPTH && len(j.table) > 1 {
+			if err := j.split(p); err != nil {
+				return false, err
+			}
+			continue
+		}
+		if err := p.probe.rewind(); err != nil {
+			return false, err
+		}
+		j.probe = p.probe.read
+		return true, nil
+	}
+	return false, nil
+}
+
+/* split divides a partition that does not fit in memory into partitions of the next level */
+func (j *HashJoin) split(p *hashPartition) error {
+	parts, err := j.newPartitions(p.depth + 1)
+	if err != nil {
+		return err
+	}
+	j.pending = append(parts, j.pending...)
+	if err := j.spillTable(parts, p.depth+1); err != nil {
+		return err
+	}
+	if err := p.probe.rewind(); err != nil {
+		return err
+	}
+	if err := j.partition(parts, p.probe.read, j.LeftKeys, false, p.depth+1); err != nil {
+		return err
+	}
+	p.close()
+	j.current = nil
+	return nil
+}
+
+func (j *HashJoin) Next() (Row, error) {
+	for {
+		if j.matcher.left != nil {
+			out, err := j.matcher.step()
+			if err != nil || out != nil {
+				return out, err
+			}
+			continue
+		}
+		if j.probe == nil {
+			ok, err := j.nextPartition()
+			if err != nil || !ok {
+				return nil, err
+			}
+		}
+		left, err := j.probe()
+		if err != nil {
+			return nil, err
+		}
+		if left == nil {
+			j.probe = nil
+			continue
+		}
+		key, ok, err := hashKey(j.LeftKeys, left)
+		if err != nil {
+			return nil, err
+		}
+		var candidates []Row
+		if ok {
+			candidates = j.table[key]
+		}
+		j.matcher.start(left, candidates)
+	}
+}
+
+func (j *HashJoin) Close() error {
+	j.table, j.probe = nil, nil
+	if j.current != nil {
+		j.current.close()
+		j.current = nil
+	}
+	closePartitions(j.pending)
+	j.pending = nil
+	if j.rightOpen {
+		j.rightOpen = false
+		j.Right.Close()
+	}
+	if !j.leftOpen {
+		return nil
+	}
+	j.leftOpen = false
+	return j.Left.Close()
+}
+
+/*
+hashKey encodes the values of keys over r so that values comparing equal encode the same. It
+reports false if a key is NULL.
+*/
+func hashKey(keys []Expr, r Row) (string, bool, error) {
+	var buf []byte
+	for _, e := range keys {
+		v, err := Eval(e, r)
+		if err != nil {
+			return "", false, err
+		}
+		if v.IsNull() {
+			return "", false, nil
+		}
+		buf = appendKey(buf, v)
+	}
+	return string(buf), true, nil
+}
+
+/* appendKey encodes v for hashing. Numbers of every kind that hold a whole number share one encoding */
+func appendKey(buf []byte, v Value) []byte {
+	switch v.Kind {
+	case KIND_NULL:
+		return append(buf, 'N')
+	case KIND_BOOL:
+		if v.B {
+			return append(buf, 'b', 1)
+		}
+		return append(buf, 'b', 0)
+	case KIND_STRING:
+		buf = binary.AppendUvarint(append(buf, 's'), uint64(len(v.S)))
+		return append(buf, v.S...)
+	}
+	return appendNumberKey(buf, v)
+}
+
+func appendNumberKey(buf []byte, v Value) []byte {
+	switch v.Kind {
+	case KIND_INT:
+		return binary.LittleEndian.AppendUint64(append(buf, 'i'), uint64(v.I))
+	case KIND_UINT:
+		if v.U <= math.MaxInt64 {
+			return binary.LittleEndian.AppendUint64(append(buf, 'i'), v.U)
+		}
+		return binary.LittleEndian.AppendUint64(append(buf, 'u'), v.U)
+	}
+	f := v.F
+	switch {
+	case math.IsNaN(f):
+		return append(buf, 'n')
+	case f == math.Trunc(f) && f >= math.MinInt64 && f < math.MaxInt64:
+		return appendNumberKey(buf, Int(int64(f)))
+	case f == math.Trunc(f) && f >= 0 && f < math.MaxUint64:
+		return appendNumberKey(buf, Uint(uint64(f)))
+	}
+	return binary.LittleEndian.AppendUint64(append(buf, 'f'), math.Float64bits(f))
+}
+
+/*
+MergeJoin joins inputs sorted ascending on their keys, NULLs last, by walking both in step. Right
+rows with equal keys are kept together so every left row with that key can be matched with them.
+*/
+type MergeJoin struct {
+	Left, Right Operator
+	LeftKeys    []Expr
+	RightKeys   []Expr
+	Type        JoinType
+	Cond        Expr
+	RightWidth  int
+
+	right    Row
+	rightKey Row
+	group    []Row
+	groupKey Row
+	matcher  joinProbe
+}
+
+func (j *MergeJoin) Open(ctx *db.ClientContext) error {
+	j.right, j.rightKey, j.group, j.groupKey = nil, nil, nil, nil
+	j.matcher = joinProbe{typ: j.Type, cond: j.Cond, rightWidth: j.RightWidth}
+	if err := j.Left.Open(ctx); err != nil {
+		return err
+	}
+	if err := j.Right.Open(ctx); err != nil {
+		return err
+	}
+	return j.advanceRight()
+}
+
+/* advanceRight reads the next right row whose keys are not NULL */
+func (j *MergeJoin) advanceRight() error {
+	for {
+		right, err := j.Right.Next()
+		if err != nil || right == nil {
+			j.right, j.rightKey = nil, nil
+			return err
+		}
+		key, err := evalKeys(j.RightKeys, right)
+		if err != nil {
+			return err
+		}
+		if key != nil {
+			j.right, j.rightKey = right, key
+			return nil
+		}
+	}
+}
+
+func (j *MergeJoin) Next() (Row, error) {
+	for {
+		if j.matcher.left != nil {
+			out, err := j.matcher.step()
+			if err != nil || out != nil {
+				return out, err
+			}
+			continue
+		}
+		left, err := j.Left.Next()
+		if err != nil || left == nil {
+			return nil, err
+		}
+		key, err := evalKeys(j.LeftKeys, left)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case key == nil:
+			j.matcher.start(left, nil)
+			continue
+		case j.groupKey != nil && compareRows(j.groupKey, key) == 0:
+			// Same key as the last left row
+			j.matcher.start(left, j.group)
+			continue
+		}
+		j.group, j.groupKey = nil, key
+		for j.right != nil && compareRows(j.rightKey, key) < 0 {
+			if err := j.advanceRight(); err != nil {
+				return nil, err
+			}
+		}
+		for j.right != nil && compareRows(j.rightKey, key) == 0 {
+			j.group = append(j.group, j.right)
+			if err := j.advanceRight(); err != nil {
+				return nil, err
+			}
+		}
+		j.matcher.start(left, j.group)
+	}
+}
+
+func (j *MergeJoin) Close() error {
+	j.group = nil
+	err := j.Right.Close()
+	if leftErr := j.Left.Close(); err == nil {
+		err = leftErr
+	}
+	return err
+}
+
+/* evalKeys evaluates keys over r, nil if any is NULL */
+func evalKeys(keys []Expr, r Row) (Row, error) {
+	out := make(Row, len(keys))
+	for i, e := range keys {
+		v, err := Eval(e, r)
+		if err != nil || v.IsNull() {
+			return nil, err
+		}
+		out[i] = v
+	}
+	return out, nil
+}
+
+/* compareRows orders two rows of values that are not NULL */
+func compareRows(a, b Row) int {
+	for i := range a {
+		if cmp := compare(a[i], b[i]); cmp != 0 {
+			return cmp
+		}
+	}
+	return 0
+}
@@ -0,0 +1,143 @@
+package sql
+
+import (
+	"path"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/misachi/DarDB/storage/db"
+)
+
+func lit(v Value) Expr { return &Literal{exprBase: exprBase{kind: v.Kind}, Value: v} }
+
+func col(i int) Expr { return &ColumnRef{Index: i} }
+
+/* valuesOf is a Values operator returning rows of the given values */
+func valuesOf(rows ...Row) *Values {
+	v := &Values{}
+	for _, r := range rows {
+		exprs := make([]Expr, len(r))
+		for i, value := range r {
+			exprs[i] = lit(value)
+		}
+		v.Rows = append(v.Rows, exprs)
+	}
+	return v
+}
+
+/* sortedText is rowsText with the lines sorted, for operators that return rows in no set order */
+func sortedText(rows []Row) string {
+	lines := strings.Split(rowsText(rows), "\n")
+	sort.Strings(lines)
+	return strings.Join(lines, "\n")
+}
+
+func TestJoinOperators(t *testing.T) {
+	_, ctx := testSession(t)
+	left := func() Operator {
+		return valuesOf(
+			Row{Int(1), String("a")}, Row{Int(2), String("b")}, Row{Int(2), String("b2")},
+			Row{Null(), String("n")}, Row{Int(3), String("c")},
+		)
+	}
+	right := func() Operator {
+		return valuesOf(
+			Row{Uint(1), String("x")}, Row{Float(2), String("y")}, Row{Int(2), String("z")},
+			Row{Null(), String("m")}, Row{Int(4), String("w")},
+		)
+	}
+	sorted := func(op Operator) Operator {
+		return &Sort{Child: op, Keys: []*OrderItem{{Expr: col(0)}}}
+	}
+	eq := &Binary{exprBase: exprBase{kind: KIND_BOOL}, Op: "=", Left: col(0), Right: col(2)}
+
+	expected := map[JoinType]string{
+		JOIN_INNER: "1|a|1|x\n2|b2|2|y\n2|b2|2|z\n2|b|2|y\n2|b|2|z",
+		JOIN_LEFT:  "1|a|1|x\n2|b2|2|y\n2|b2|2|z\n2|b|2|y\n2|b|2|z\n3|c|NULL|NULL\nNULL|n|NULL|NULL",
+		JOIN_SEMI:  "1|a\n2|b\n2|b2",
+		JOIN_ANTI:  "3|c\nNULL|n",
+	}
+	for typ, want := range expected {
+		joins := map[string]Operator{
+			"NestedLoop":      &NestedLoopJoin{Left: left(), Right: right(), Type: typ, Cond: eq, RightWidth: 2},
+			"BlockNestedLoop": &BlockNestedLoopJoin{Left: left(), Right: right(), Type: typ, Cond: eq, RightWidth: 2, WorkMem: 1},
+			"Hash": &HashJoin{Left: left(), Right: right(), LeftKeys: []Expr{col(0)}, RightKeys: []Expr{col(0)},
+				Type: typ, RightWidth: 2},
+			"HashSpilled": &HashJoin{Left: left(), Right: right(), LeftKeys: []Expr{col(0)}, RightKeys: []Expr{col(0)},
+				Type: typ, RightWidth: 2, WorkMem: 1},
+			"Merge": &MergeJoin{Left: sorted(left()), Right: sorted(right()), LeftKeys: []Expr{col(0)}, RightKeys: []Expr{col(0)},
+				Type: typ, RightWidth: 2},
+		}
+		for name, op := range joins {
+			rows, err := Run(ctx, op)
+			if err != nil {
+				t.Errorf("%s %s join error: %v", name, typ, err)
+				continue
+			}
+			if got := sortedText(rows); got != want {
+				t.Errorf("%s %s join: expected\n%s\nbut got\n%s", name, typ, want, got)
+			}
+			if hash, ok := op.(*HashJoin); ok && (hash.spilled > 0) != (hash.WorkMem > 0) {
+				t.Errorf("%s %s join: unexpected %d spilled partitions", name, typ, hash.spilled)
+			}
+		}
+	}
+
+	files, err := testDBCfg.FS().ReadDir(path.Join(testDBCfg.DataPath(), db.TEMP_DIR))
+	if err != nil {
+		t.Fatalf("ReadDir error: %v", err)
+	}
+	if len(files) != 0 {
+		t.Errorf("Join error: %d temp files left after the joins", len(files))
+	}
+
+	// Cond is checked on top of equal keys, and a left row failing it still has no match
+	ne := &Binary{exprBase: exprBase{kind: KIND_BOOL}, Op: "<>", Left: col(3), Right: lit(String("z"))}
+	join := &HashJoin{Left: left(), Right: right(), LeftKeys: []Expr{col(0)}, RightKeys: []Expr{col(0)},
+		Type: JOIN_LEFT, Cond: ne, RightWidth: 2}
+	rows, err := Run(ctx, join)
+	if err != nil {
+		t.Fatalf("Hash join error: %v", err)
+	}
+	if got, want := sortedText(rows), "1|a|1|x\n2|b2|2|y\n2|b|2|y\n3|c|NULL|NULL\nNULL|n|NULL|NULL"; got != want {
+		t.Errorf("Hash join with a condition: expected\n%s\nbut got\n%s", want, got)
+	}
+}
+
+func TestJoin(t *testing.T) {
+	s, _ := testSession(t)
+	exec(t, s, "CREATE TABLE clients (id int PRIMARY KEY, name text)")
+	exec(t, s, "CREATE TABLE sales (id int PRIMARY KEY, customer int, total int)")
+	exec(t, s, "INSERT INTO clients (id, name) VALUES (1, 'ann'), (2, 'bob'), (3, 'cy')")
+	exec(t, s, "INSERT INTO sales (id, customer, total) VALUES (10, 1, 5), (11, 1, 7), (12, 2, 3), (13, NULL, 9)")
+	t.Cleanup(func() { s.Exec("DROP TABLE clients; DROP TABLE sales") })
+
+	tests := []struct {
+		query    string
+		expected string
+	}{
+		{"SELECT c.name, p.total FROM clients c JOIN sales p ON p.customer = c.id ORDER BY p.id", "ann|5\nann|7\nbob|3"},
+		{"SELECT c.name, p.id FROM clients c LEFT JOIN sales p ON c.id = p.customer ORDER BY c.id, p.id", "ann|10\nann|11\nbob|12\ncy|NULL"},
+		{"SELECT c.name, p.id FROM clients AS c LEFT OUTER JOIN sales AS p ON c.id = p.customer AND p.total > 5 ORDER BY c.id", "ann|11\nbob|NULL\ncy|NULL"},
+		{"SELECT name, total FROM clients, sales WHERE customer = clients.id AND total < 7 ORDER BY total", "bob|3\nann|5"},
+		{"SELECT c.id, p.id FROM clients c CROSS JOIN sales p WHERE c.id = 3 ORDER BY p.id", "3|10\n3|11\n3|12\n3|13"},
+		{"SELECT c.name, p.total FROM clients c INNER JOIN sales p ON p.total > c.id * 3 ORDER BY c.id, p.id", "ann|5\nann|7\nann|9\nbob|7\nbob|9"},
+		{"SELECT a.name, b.name FROM clients a JOIN clients b ON a.id < b.id JOIN sales p ON p.customer = a.id AND p.total = 3 ORDER BY b.id", "bob|cy"},
+	}
+	for _, test := range tests {
+		r := exec(t, s, test.query)
+		if got := rowsText(r.Rows); got != test.expected {
+			t.Errorf("Exec error: %s: expected\n%s\nbut got\n%s", test.query, test.expected, got)
+		}
+	}
+
+	r := exec(t, s, "SELECT * FROM clients c JOIN sales p ON p.customer = c.id WHERE p.id = 12")
+	if names := columnNames(r.Columns); names != "id,name,id,customer,total" || rowsText(r.Rows) != "2|bob|12|2|3" {
+		t.Errorf("Exec error: unexpected SELECT * of a join %v\n%s", r.Columns, rowsText(r.Rows))
+	}
+
+	execError(t, s, "SELECT id FROM clients JOIN sales ON customer = clients.id", SQLSTATE_AMBIGUOUS_COLUMN)
+	execError(t, s, "SELECT 1 FROM clients c RIGHT JOIN sales p ON p.customer = c.id", SQLSTATE_FEATURE_UNSUPPORTED)
+	execError(t, s, "SELECT 1 FROM clients c JOIN sales p ON p.total", SQLSTATE_DATATYPE_MISMATCH)
+}
@@ -0,0 +1,184 @@
+package sql
+
+import (
+	"strings"
+)
+
+type tokenKind int
+
+const (
+	TOKEN_EOF tokenKind = iota
+	TOKEN_IDENT
+	TOKEN_NUMBER
+	TOKEN_STRING
+	TOKEN_OP
+	TOKEN_PARAM // $1, $2 and so on; the text is the number
+)
+
+type token struct {
+	kind   tokenKind
+	text   string // Identifiers unless quoted are lower case; strings are unescaped
+	pos    int    // Byte offset in the query
+	quoted bool   // A quoted identifier is never a keyword
+}
+
+/*
+reserved words cannot name a table or column unless quoted. Other keywords, such as KEY or
+FIRST, are only keywords where the grammar expects them.
+*/
+var reserved = map[string]bool{
+	"ALL": true, "AND": true, "AS": true, "ASC": true, "BETWEEN": true, "BY": true, "CREATE": true,
+	"CROSS": true, "DELETE": true, "DESC": true, "DISTINCT": true, "DROP": true, "FALSE": true,
+	"FROM": true, "FULL": true, "GROUP": true, "HAVING": true, "IN": true, "INNER": true,
+	"INSERT": true, "INTO": true, "IS": true, "JOIN": true, "LEFT": true, "LIKE": true,
+	"LIMIT": true, "NATURAL": true, "NOT": true, "NULL": true, "OFFSET": true, "ON": true,
+	"OR": true, "ORDER": true, "OUTER": true, "RIGHT": true, "SELECT": true, "SET": true,
+	"TABLE": true, "TRUE": true, "UPDATE": true, "VALUES": true, "WHERE": true,
+}
+
+/* operators longest first, so <= is not read as < = */
+var operators = []string{"<>", "!=", "<=", ">=", "||", "(", ")", ",", ";", ".", "*", "+", "-", "/", "%", "=", "<", ">"}
+
+/* lex splits a query into tokens, ending with TOKEN_EOF */
+func lex(query string) ([]token, error) {
+	tokens := make([]token, 0)
+	i := 0
+	for {
+		// Skip white space and comments
+		for i < len(query) {
+			switch {
+			case isSpace(query[i]):
+				i++
+			case strings.HasPrefix(query[i:], "--"):
+				end := strings.IndexByte(query[i:], '\n')
+				if end < 0 {
+					i = len(query)
+				} else {
+					i += end + 1
+				}
+			case strings.HasPrefix(query[i:], "/*"):
+				end := strings.Index(query[i+2:], "*/")
+				if end < 0 {
+					return nil, errorf(SQLSTATE_SYNTAX_ERROR, i, "unterminated comment")
+				}
+				i += end + 4
+			default:
+				goto scan
+			}
+		}
+		return append(tokens, token{kind: TOKEN_EOF, pos: len(query)}), nil
+
+	scan:
+		start := i
+		c := query[i]
+		switch {
+		case isLetter(c):
+			for i < len(query) && (isLetter(query[i]) || isDigit(query[i])) {
+				i++
+			}
+			tokens = append(tokens, token{kind: TOKEN_IDENT, text: strings.ToLower(query[start:i]), pos: start})
+		case isDigit(c) || (c == '.' && i+1 < len(query) && isDigit(query[i+1])):
+			i = scanNumber(query, i)
+			if i < len(query) && isLetter(query[i]) {
+				return nil, errorf(SQLSTATE_SYNTAX_ERROR, i, "trailing junk after numeric literal")
+			}
+			tokens = append(tokens, token{kind: TOKEN_NUMBER, text: query[start:i], pos: start})
+		case c == '$' && i+1 < len(query) && isDigit(query[i+1]):
+			i++
+			for i < len(query) && isDigit(query[i]) {
+				i++
+			}
+			tokens = append(tokens, token{kind: TOKEN_PARAM, text: query[start+1 : i], pos: start})
+		case c == '\'' || c == '"':
+			text, end, ok := scanQuoted(query, i)
+			if !ok {
+				if c == '"' {
+					return nil, errorf(SQLSTATE_SYNTAX_ERROR, start, "unterminated quoted identifier")
+				}
+				return nil, errorf(SQLSTATE_SYNTAX_ERROR, start, "unterminated quoted string")
+			}
+			i = end
+			if c == '"' {
+				if text == "" {
+					return nil, errorf(SQLSTATE_SYNTAX_ERROR, start, "zero-length delimited identifier")
+				}
+				tokens = append(tokens, token{kind: TOKEN_IDENT, text: text, pos: start, quoted: true})
+			} else {
+				tokens = append(tokens, token{kind: TOKEN_STRING, text: text, pos: start})
+			}
+		default:
+			op := ""
+			for _, candidate := range operators {
+				if strings.HasPrefix(query[i:], candidate) {
+					op = candidate
+					break
+				}
+			}
+			if op == "" {
+				return nil, errorf(SQLSTATE_SYNTAX_ERROR, i, "syntax error at or near %q", string(c))
+			}
+			i += len(op)
+			if op == "!=" {
+				op = "<>"
+			}
+			tokens = append(tokens, token{kind: TOKEN_OP, text: op, pos: start})
+		}
+	}
+}
+
+/* scanNumber returns the end of the numeric literal starting at i: digits, a fraction and an exponent */
+func scanNumber(query string, i int) int {
+	for i < len(query) && isDigit(query[i]) {
+		i++
+	}
+	if i < len(query) && query[i] == '.' {
+		i++
+		for i < len(query) && isDigit(query[i]) {
+			i++
+		}
+	}
+	if i < len(query) && (query[i] == 'e' || query[i] == 'E') {
+		j := i + 1
+		if j < len(query) && (query[j] == '+' || query[j] == '-') {
+			j++
+		}
+		if j < len(query) && isDigit(query[j]) {
+			i = j
+			for i < len(query) && isDigit(query[i]) {
+				i++
+			}
+		}
+	}
+	return i
+}
+
+/* scanQuoted reads the string or identifier quoted at i, where a doubled quote stands for itself */
+func scanQuoted(query string, i int) (string, int, bool) {
+	quote := query[i]
+	var text strings.Builder
+	for i++; i < len(query); i++ {
+		if query[i] != quote {
+			text.WriteByte(query[i])
+			continue
+		}
+		if i+1 < len(query) && query[i+1] == quote {
+			text.WriteByte(quote)
+			i++
+			continue
+		}
+		return text.String(), i + 1, true
+	}
+	return "", i, false
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f'
+}
+
+func isLetter(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || c >= 0x80
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
@@ -0,0 +1,518 @@
+package sql
+
+import (
+	"math/bits"
+
+	"github.com/misachi/DarDB/storage/db"
+)
+
+/*
+The optimizer plans the FROM and WHERE of a statement. Conditions on a single table are pushed
+into its scan, which checks them as it reads each block, or the table is read through an index
+when one finds fewer records for less. The tables are then joined in the order, and with the join
+algorithms, of the cheapest plan: every order is tried by dynamic programming over the sets of
+tables for up to MAX_DP_RELATIONS, and past that the cheapest join is made first. Tables are only
+joined without a condition between them when no join has one.
+
+A LEFT JOIN cannot be reordered with the joins around it, so the items before it are planned on
+their own and left joined with its table, which the joins after it see as a single item.
+*/
+const MAX_DP_RELATIONS = 10
+
+/* planner builds the plan of a statement, choosing between plans by their estimated cost */
+type planner struct {
+	mem    int64 // The work memory of sorts and hash tables
+	ests   map[Operator]*estimate
+	tables map[*db.Table]*tableStats
+}
+
+func newPlanner(mem int64) *planner {
+	return &planner{mem: mem, ests: make(map[Operator]*estimate), tables: make(map[*db.Table]*tableStats)}
+}
+
+/* relation is an item the optimizer joins: a table, or a left join planned before the joins after it */
+type relation struct {
+	lo, hi int // The bound columns it holds
+	table  *TableRef
+	path   *joinPath // Set for a left join
+}
+
+/* joinPath is a plan reading some of the relations of a statement */
+type joinPath struct {
+	op   Operator
+	rels uint64 // A bit for each relation read
+	cols []int  // The bound column in each column of the rows
+	est  *estimate
+}
+
+/* condition is a condition with a bit for each relation it reads */
+type condition struct {
+	expr Expr
+	rels uint64
+}
+
+/* planFrom plans a FROM item filtered by where, returning rows of the columns in the order they were bound */
+func (p *planner) planFrom(from TableExpr, where Expr) (Operator, error) {
+	path, err := p.planJoins(from, conjuncts(where))
+	if err != nil {
+		return nil, err
+	}
+	pos := positions(path.cols)
+	exprs := make([]Expr, len(path.cols))
+	reordered := false
+	for i := range exprs {
+		exprs[i] = &ColumnRef{Index: pos[i]}
+		reordered = reordered || pos[i] != i
+	}
+	if !reordered {
+		return path.op, nil
+	}
+	return &Project{Child: path.op, Exprs: exprs}, nil
+}
+
+/* planJoins plans t and the conditions conds over its columns, ANDed to those of its joins */
+func (p *planner) planJoins(t TableExpr, conds []Expr) (*joinPath, error) {
+	var rels []*relation
+	for {
+		j, ok := t.(*JoinExpr)
+		if !ok || j.Type != JOIN_INNER {
+			break
+		}
+		rel, err := tableRelation(j.Right)
+		if err != nil {
+			return nil, err
+		}
+		rels = append(rels, rel)
+		conds = append(conds, conjuncts(j.On)...)
+		t = j.Left
+	}
+	switch j := t.(type) {
+	case *JoinExpr:
+		if j.Type != JOIN_LEFT {
+			return nil, errorf(SQLSTATE_FEATURE_UNSUPPORTED, j.Pos, "%s joins are not supported", j.Type)
+		}
+		path, err := p.planLeftJoin(j)
+		if err != nil {
+			return nil, err
+		}
+		lo, hi := fromColumns(j)
+		rels = append(rels, &relation{lo: lo, hi: hi, path: path})
+	default:
+		rel, err := tableRelation(t)
+		if err != nil {
+			return nil, err
+		}
+		rels = append(rels, rel)
+	}
+	// In FROM order, so plans of equal cost keep the order the tables were written in
+	for i, j := 0, len(rels)-1; i < j; i, j = i+1, j-1 {
+		rels[i], rels[j] = rels[j], rels[i]
+	}
+	return p.joinRelations(rels, conds)
+}
+
+func tableRelation(t TableExpr) (*relation, error) {
+	ref, ok := t.(*TableRef)
+	if !ok {
+		return nil, errorf(SQLSTATE_FEATURE_UNSUPPORTED, -1, "unsupported FROM item %T", t)
+	}
+	lo, hi := fromColumns(ref)
+	return &relation{lo: lo, hi: hi, table: ref}, nil
+}
+
+/* fromColumns is the bound columns a FROM item holds */
+func fromColumns(t TableExpr) (int, int) {
+	switch t := t.(type) {
+	case *TableRef:
+		return t.Offset, t.Offset + len(t.Table.GetInfo().Column)
+	case *JoinExpr:
+		lo, _ := fromColumns(t.Left)
+		_, hi := fromColumns(t.Right)
+		return lo, hi
+	}
+	return 0, 0
+}
+
+/*
+planLeftJoin plans a left join. Conditions of ON on the right table alone filter its scan; the
+others decide which rows match, so they stay with the join.
+*/
+func (p *planner) planLeftJoin(j *JoinExpr) (*joinPath, error) {
+	left, err := p.planJoins(j.Left, nil)
+	if err != nil {
+		return nil, err
+	}
+	rel, err := tableRelation(j.Right)
+	if err != nil {
+		return nil, err
+	}
+	var pushed, rest []Expr
+	for _, cond := range conjuncts(j.On) {
+		if columnsWithin(cond, rel.lo, rel.hi) {
+			pushed = append(pushed, cond)
+		} else {
+			rest = append(rest, cond)
+		}
+	}
+	scan, err := p.access(rel.table, pushed)
+	if err != nil {
+		return nil, err
+	}
+	right, err := p.newPath(scan, 0, columnsOf(rel))
+	if err != nil {
+		return nil, err
+	}
+	return p.join(left, right, JOIN_LEFT, rest)
+}
+
+/* joinRelations plans the inner joins of rels on conds */
+func (p *planner) joinRelations(rels []*relation, conds []Expr) (*joinPath, error) {
+	if len(rels) > 64 {
+		return nil, errorf(SQLSTATE_FEATURE_UNSUPPORTED, -1, "at most 64 tables can be joined, not %d", len(rels))
+	}
+	filters := make([][]Expr, len(rels))
+	var joins []condition
+	var top []Expr
+	for _, cond := range conds {
+		mask := relationsOf(cond, rels)
+		switch bits.OnesCount64(mask) {
+		case 0:
+			top = append(top, cond)
+		case 1:
+			i := bits.TrailingZeros64(mask)
+			filters[i] = append(filters[i], cond)
+		default:
+			joins = append(joins, condition{expr: cond, rels: mask})
+		}
+	}
+
+	paths := make([]*joinPath, len(rels))
+	for i, rel := range rels {
+		var err error
+		if rel.table != nil {
+			var scan recordSource
+			if scan, err = p.access(rel.table, filters[i]); err == nil {
+				paths[i], err = p.newPath(scan, 1<<i, columnsOf(rel))
+			}
+		} else {
+			var op Operator = rel.path.op
+			if len(filters[i]) > 0 {
+				op = &Filter{Child: op, Pred: remap(andAll(filters[i]), positions(rel.path.cols))}
+			}
+			paths[i], err = p.newPath(op, 1<<i, rel.path.cols)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var path *joinPath
+	var err error
+	switch {
+	case len(paths) == 1:
+		path = paths[0]
+	case len(paths) <= MAX_DP_RELATIONS:
+		path, err = p.joinAll(paths, joins)
+	default:
+		path, err = p.joinGreedily(paths, joins)
+	}
+	if err != nil || len(top) == 0 {
+		return path, err
+	}
+	return p.newPath(&Filter{Child: path.op, Pred: remap(andAll(top), positions(path.cols))}, path.rels, path.cols)
+}
+
+/*
+joinAll finds the cheapest plan joining paths by dynamic programming: the best plan of every set
+of them is the cheapest join of the best plans of two parts of it. Sets are numbered by their
+bits, so the parts of a set are planned before it. When conditions link every path, only sets
+they link are planned, as every such set splits into two linked parts.
+*/
+func (p *planner) joinAll(paths []*joinPath, conds []condition) (*joinPath, error) {
+	best := make([]*joinPath, 1<<len(paths))
+	for i, path := range paths {
+		best[1<<i] = path
+	}
+	passes := []bool{false, true}
+	if linked(len(paths), conds) {
+		passes = passes[:1]
+	}
+	for set := uint64(1); set < uint64(len(best)); set++ {
+		if bits.OnesCount64(set) < 2 {
+			continue
+		}
+		for _, cross := range passes {
+			for part := (set - 1) & set; part > 0; part = (part - 1) & set {
+				left, right := best[part], best[set^part]
+				if left == nil || right == nil {
+					continue
+				}
+				on := joinConds(conds, left.rels, right.rels)
+				if len(on) == 0 && !cross {
+					continue
+				}
+				path, err := p.join(left, right, JOIN_INNER, on)
+				if err != nil {
+					return nil, err
+				}
+				if best[set] == nil || path.est.cost < best[set].est.cost {
+					best[set] = path
+				}
+			}
+			if best[set] != nil {
+				break
+			}
+		}
+	}
+	return best[len(best)-1], nil
+}
+
+/* joinGreedily joins paths by making the cheapest join of two of them until one is left */
+func (p *planner) joinGreedily(paths []*joinPath, conds []condition) (*joinPath, error) {
+	for len(paths) > 1 {
+		var best *joinPath
+		var bestLeft, bestRight int
+		for _, cross := range []bool{false, true} {
+			for i, left := range paths {
+				for j, right := range paths {
+					if i == j {
+						continue
+					}
+					on := joinConds(conds, left.rels, right.rels)
+					if len(on) == 0 && !cross {
+						continue
+					}
+					path, err := p.join(left, right, JOIN_INNER, on)
+					if err != nil {
+						return nil, err
+					}
+					if best == nil || path.est.cost < best.est.cost {
+						best, bestLeft, bestRight = path, i, j
+					}
+				}
+			}
+			if best != nil {
+				break
+			}
+		}
+		rest := []*joinPath{best}
+		for i, path := range paths {
+			if i != bestLeft && i != bestRight {
+				rest = append(rest, path)
+			}
+		}
+		paths = rest
+	}
+	return paths[0], nil
+}
+
+/* linked reports whether conds link n paths together, each to the others through a chain of conditions */
+func linked(n int, conds []condition) bool {
+	reached := uint64(1)
+	for grown := true; grown; {
+		grown = false
+		for _, cond := range conds {
+			if cond.rels&reached != 0 && cond.rels&^reached != 0 {
+				reached |= cond.rels
+				grown = true
+			}
+		}
+	}
+	return reached == 1<<n-1
+}
+
+/* joinConds returns the conditions that can first be checked when left and right are joined */
+func joinConds(conds []condition, left, right uint64) []Expr {
+	var out []Expr
+	for _, cond := range conds {
+		if cond.rels&^(left|right) == 0 && cond.rels&^left != 0 && cond.rels&^right != 0 {
+			out = append(out, cond.expr)
+		}
+	}
+	return out
+}
+
+/*
+join plans the cheapest join of left and right on conds, which are bound. Conditions comparing an
+expression over one side with one over the other for equality are keys for a hash or merge join;
+a block nested loop join can check any condition.
+*/
+func (p *planner) join(left, right *joinPath, typ JoinType, conds []Expr) (*joinPath, error) {
+	cols := make([]int, 0, len(left.cols)+len(right.cols))
+	cols = append(append(cols, left.cols...), right.cols...)
+	leftPos, rightPos, pos := positions(left.cols), positions(right.cols), positions(cols)
+	var leftKeys, rightKeys, rest []Expr
+	for _, cond := range conds {
+		if b, ok := cond.(*Binary); ok && b.Op == "=" {
+			switch {
+			case readsOnly(b.Left, leftPos) && readsOnly(b.Right, rightPos):
+				leftKeys, rightKeys = append(leftKeys, remap(b.Left, leftPos)), append(rightKeys, remap(b.Right, rightPos))
+				continue
+			case readsOnly(b.Right, leftPos) && readsOnly(b.Left, rightPos):
+				leftKeys, rightKeys = append(leftKeys, remap(b.Right, leftPos)), append(rightKeys, remap(b.Left, rightPos))
+				continue
+			}
+		}
+		rest = append(rest, cond)
+	}
+
+	width := len(right.cols)
+	ops := []Operator{&BlockNestedLoopJoin{Left: left.op, Right: right.op, Type: typ, Cond: remap(andAll(conds), pos), RightWidth: width}}
+	if len(leftKeys) > 0 {
+		cond := remap(andAll(rest), pos)
+		ops = append(ops,
+			&HashJoin{Left: left.op, Right: right.op, LeftKeys: leftKeys, RightKeys: rightKeys, Type: typ, Cond: cond, RightWidth: width},
+			&MergeJoin{
+				Left: &Sort{Child: left.op, Keys: ascending(leftKeys)}, Right: &Sort{Child: right.op, Keys: ascending(rightKeys)},
+				LeftKeys: leftKeys, RightKeys: rightKeys, Type: typ, Cond: cond, RightWidth: width,
+			})
+	}
+	var best *joinPath
+	for _, op := range ops {
+		path, err := p.newPath(op, left.rels|right.rels, cols)
+		if err != nil {
+			return nil, err
+		}
+		if best == nil || path.est.cost < best.est.cost {
+			best = path
+		}
+	}
+	return best, nil
+}
+
+func ascending(keys []Expr) []*OrderItem {
+	items := make([]*OrderItem, len(keys))
+	for i, key := range keys {
+		items[i] = &OrderItem{Expr: key}
+	}
+	return items
+}
+
+func (p *planner) newPath(op Operator, rels uint64, cols []int) (*joinPath, error) {
+	est, err := p.estimate(op)
+	if err != nil {
+		return nil, err
+	}
+	return &joinPath{op: op, rels: rels, cols: cols, est: est}, nil
+}
+
+/*
+access plans the read of a table filtered by conds, which are bound. The table is scanned with
+the conditions pushed into the scan, unless an index on a column a condition compares with a
+constant finds the records for less.
+*/
+func (p *planner) access(t *TableRef, conds []Expr) (recordSource, error) {
+	local := rebaseList(conds, -t.Offset)
+	var best recordSource = &SeqScan{Table: t.Table, Filter: andAll(local)}
+	bestEst, err := p.estimate(best)
+	if err != nil {
+		return nil, err
+	}
+	indexes, err := tableIndexes(t.Table)
+	if err != nil {
+		return nil, err
+	}
+	for i, cond := range local {
+		col, key, ok := indexKey(cond)
+		if !ok || indexes[col] == nil {
+			continue
+		}
+		var scan recordSource = &IndexScan{Table: t.Table, Index: indexes[col], Column: col, Key: key}
+		rest := append(append([]Expr{}, local[:i]...), local[i+1:]...)
+		if len(rest) > 0 {
+			scan = &Filter{Child: scan, Pred: andAll(rest)}
+		}
+		est, err := p.estimate(scan)
+		if err != nil {
+			return nil, err
+		}
+		if est.cost < bestEst.cost {
+			best, bestEst = scan, est
+		}
+	}
+	return best, nil
+}
+
+/* indexKey returns the column and the key of a condition an index can look up, column = constant */
+func indexKey(cond Expr) (int, Expr, bool) {
+	b, ok := cond.(*Binary)
+	if !ok || b.Op != "=" {
+		return 0, nil, false
+	}
+	for _, side := range [][2]Expr{{b.Left, b.Right}, {b.Right, b.Left}} {
+		if ref, ok := side[0].(*ColumnRef); ok && !readsColumns(side[1]) {
+			return ref.Index, side[1], true
+		}
+	}
+	return 0, nil, false
+}
+
+func columnsOf(rel *relation) []int {
+	cols := make([]int, rel.hi-rel.lo)
+	for i := range cols {
+		cols[i] = rel.lo + i
+	}
+	return cols
+}
+
+/* relationsOf returns a bit for each relation e reads */
+func relationsOf(e Expr, rels []*relation) uint64 {
+	var mask uint64
+	walkExpr(e, func(e Expr) bool {
+		if ref, ok := e.(*ColumnRef); ok {
+			for i, rel := range rels {
+				if ref.Index >= rel.lo && ref.Index < rel.hi {
+					mask |= 1 << i
+				}
+			}
+		}
+		return true
+	})
+	return mask
+}
+
+/* positions maps each bound column to its position in rows of cols */
+func positions(cols []int) map[int]int {
+	pos := make(map[int]int, len(cols))
+	for i, col := range cols {
+		pos[col] = i
+	}
+	return pos
+}
+
+/* remap copies a bound expression to be evaluated over rows whose columns are at pos */
+func remap(e Expr, pos map[int]int) Expr {
+	e, _ = transform(e, func(e Expr) (Expr, bool, error) {
+		if ref, ok := e.(*ColumnRef); ok {
+			c := *ref
+			c.Index = pos[ref.Index]
+			return &c, true, nil
+		}
+		return e, false, nil
+	})
+	return e
+}
+
+/* readsOnly reports whether e reads columns and every one is in pos */
+func readsOnly(e Expr, pos map[int]int) bool {
+	only, any := true, false
+	walkExpr(e, func(e Expr) bool {
+		if ref, ok := e.(*ColumnRef); ok {
+			_, in := pos[ref.Index]
+			any, only = true, only && in
+		}
+		return only
+	})
+	return any && only
+}
+
+func readsColumns(e Expr) bool {
+	found := false
+	walkExpr(e, func(e Expr) bool {
+		if _, ok := e.(*ColumnRef); ok {
+			found = true
+		}
+		return !found
+	})
+	return found
+}
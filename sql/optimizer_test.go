@@ -0,0 +1,226 @@
+package sql
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/misachi/DarDB/storage/db"
+)
+
+/* planOps lists the operators of a plan, parents before their children */
+func planOps(op Operator) []Operator {
+	ops := []Operator{op}
+	switch op := op.(type) {
+	case *Filter:
+		ops = append(ops, planOps(op.Child)...)
+	case *Project:
+		ops = append(ops, planOps(op.Child)...)
+	case *Limit:
+		ops = append(ops, planOps(op.Child)...)
+	case *Sort:
+		ops = append(ops, planOps(op.Child)...)
+	case *HashAggregate:
+		ops = append(ops, planOps(op.Child)...)
+	case *GroupAggregate:
+		ops = append(ops, planOps(op.Child)...)
+	case *Update:
+		ops = append(ops, planOps(op.Child)...)
+	case *Delete:
+		ops = append(ops, planOps(op.Child)...)
+	case *BlockNestedLoopJoin:
+		ops = append(append(ops, planOps(op.Left)...), planOps(op.Right)...)
+	case *HashJoin:
+		ops = append(append(ops, planOps(op.Left)...), planOps(op.Right)...)
+	case *MergeJoin:
+		ops = append(append(ops, planOps(op.Left)...), planOps(op.Right)...)
+	}
+	return ops
+}
+
+func TestSelectivity(t *testing.T) {
+	hist := make([]Value, 11)
+	for i := range hist {
+		hist[i] = Int(int64(i * 10))
+	}
+	cs := &colStats{known: true, nullFrac: 0.1, distinct: 50, mcv: []Value{Int(1)}, mcvFreq: []float64{0.2}, mcvTotal: 0.2, hist: hist}
+	cols := []*colStats{cs, {distinct: DEFAULT_DISTINCT}}
+	cmp := func(op string, left, right Expr) Expr {
+		return &Binary{exprBase: exprBase{kind: KIND_BOOL}, Op: op, Left: left, Right: right}
+	}
+	tests := []struct {
+		cond     Expr
+		expected float64
+	}{
+		{cmp("=", col(0), lit(Int(1))), 0.2},
+		{cmp("=", lit(Int(5)), col(0)), 0.7 / 49},
+		{cmp("<", col(0), lit(Int(50))), 0.2 + 0.7*0.5},
+		{cmp(">=", col(0), lit(Int(50))), 0.9 - 0.55},
+		{cmp(">", lit(Int(200)), col(0)), 0.9},
+		{cmp("=", col(0), lit(Null())), 0},
+		{&IsNull{X: col(0)}, 0.1},
+		{&Between{X: col(0), Low: lit(Int(0)), High: lit(Int(100))}, 0.9 + 0.7/49},
+		{&In{X: col(0), List: []Expr{lit(Int(1)), lit(Int(1))}}, 0.4},
+		{cmp("=", col(1), lit(Int(5))), DEFAULT_EQ_SEL},
+		{cmp("<", col(1), lit(Int(5))), DEFAULT_RANGE_SEL},
+		{cmp("=", col(0), col(1)), 0.9 / DEFAULT_DISTINCT},
+		{cmp("AND", cmp("=", col(0), lit(Int(1))), cmp("<", col(1), lit(Int(5)))), 0.2 * DEFAULT_RANGE_SEL},
+		{cmp("OR", cmp("=", col(0), lit(Int(1))), cmp("=", col(0), lit(Int(1)))), 0.2 + 0.2 - 0.04},
+		{&Unary{Op: "NOT", X: &IsNull{X: col(0)}}, 0.9},
+		{lit(Bool(false)), 0},
+		{nil, 1},
+	}
+	for i, test := range tests {
+		if got := selectivity(test.cond, cols); math.Abs(got-test.expected) > 1e-9 {
+			t.Errorf("selectivity error: condition %d: expected %g but got %g", i, test.expected, got)
+		}
+	}
+}
+
+func TestOptimizer(t *testing.T) {
+	s, _ := testSession(t)
+	database := testDB(t)
+	exec(t, s, "CREATE TABLE parts (id int PRIMARY KEY, kind int, name text)")
+	exec(t, s, "CREATE TABLE kinds (id int PRIMARY KEY, label text)")
+	t.Cleanup(func() { s.Exec("DROP TABLE parts; DROP TABLE kinds") })
+	var values []string
+	for i := 0; i < 3000; i++ {
+		values = append(values, fmt.Sprintf("(%d, %d, 'part %d')", i, i%10, i))
+	}
+	exec(t, s, "INSERT INTO parts (id, kind, name) VALUES "+strings.Join(values, ", "))
+	values = values[:0]
+	for i := 0; i < 10; i++ {
+		values = append(values, fmt.Sprintf("(%d, 'k%d')", i, i))
+	}
+	exec(t, s, "INSERT INTO kinds (id, label) VALUES "+strings.Join(values, ", "))
+
+	parts, kinds := database.GetTable("parts"), database.GetTable("kinds")
+	for _, tbl := range []*db.Table{parts, kinds} {
+		if _, err := database.Analyze(tbl); err != nil {
+			t.Fatalf("Analyze error: %v", err)
+		}
+	}
+	if err := database.CreateIndex(parts, "kind"); err != nil {
+		t.Fatalf("CreateIndex error: %v", err)
+	}
+
+	planOf := func(query string) []Operator {
+		op, err := Plan(bind(t, database, query))
+		if err != nil {
+			t.Fatalf("Plan error: %s: %v", query, err)
+		}
+		return planOps(op)
+	}
+	has := func(ops []Operator, match func(Operator) bool) bool {
+		for _, op := range ops {
+			if match(op) {
+				return true
+			}
+		}
+		return false
+	}
+	isIndexScan := func(op Operator) bool { _, ok := op.(*IndexScan); return ok }
+	isFilter := func(op Operator) bool { _, ok := op.(*Filter); return ok }
+
+	// A key found by an index is fetched; a tenth of the table is cheaper to scan, checking the condition in the scan
+	ops := planOf("SELECT name FROM parts WHERE id = 42")
+	if !has(ops, isIndexScan) {
+		t.Errorf("Plan error: expected an index scan for a single key")
+	}
+	ops = planOf("SELECT name FROM parts WHERE kind = 3 AND id > 10")
+	if has(ops, isIndexScan) || has(ops, isFilter) {
+		t.Errorf("Plan error: expected a filtered table scan for a common key")
+	}
+	for _, op := range ops {
+		if scan, ok := op.(*SeqScan); ok && len(conjuncts(scan.Filter)) != 2 {
+			t.Errorf("Plan error: expected both conditions pushed into the scan")
+		}
+	}
+
+	// Row estimates follow the statistics
+	p := newPlanner(DEFAULT_WORK_MEM)
+	kind := &Binary{exprBase: exprBase{kind: KIND_BOOL}, Op: "=", Left: &ColumnRef{Index: 1}, Right: lit(Int(3))}
+	est, err := p.estimate(&SeqScan{Table: parts, Filter: kind})
+	if err != nil {
+		t.Fatalf("estimate error: %v", err)
+	}
+	if est.rows < 200 || est.rows > 450 {
+		t.Errorf("estimate error: expected about 300 rows of a kind but got %g", est.rows)
+	}
+
+	// The small table is the hash table whichever side of the join it is written on
+	for _, query := range []string{
+		"SELECT p.id, k.label FROM parts p JOIN kinds k ON p.kind = k.id WHERE p.id < 25 AND k.label <> 'k1'",
+		"SELECT p.id, k.label FROM kinds k JOIN parts p ON p.kind = k.id WHERE p.id < 25 AND k.label <> 'k1'",
+	} {
+		var join *HashJoin
+		for _, op := range planOf(query) {
+			if hash, ok := op.(*HashJoin); ok && join == nil {
+				join = hash
+			}
+		}
+		if join == nil {
+			t.Errorf("Plan error: %s: expected a hash join", query)
+			continue
+		}
+		if scan, ok := join.Right.(*SeqScan); !ok || scan.Table != kinds {
+			t.Errorf("Plan error: %s: expected kinds to be the hash table", query)
+		}
+	}
+
+	tests := []struct {
+		query    string
+		expected string
+	}{
+		{"SELECT name FROM parts WHERE id = 42", "part 42"},
+		{"SELECT count(*) FROM parts WHERE kind = 3 AND id > 10", "299"},
+		{"SELECT k.label, count(*) FROM kinds k JOIN parts p ON p.kind = k.id WHERE p.id < 25 AND k.label <> 'k1' GROUP BY k.label ORDER BY k.label", "k0|3\nk2|3\nk3|3\nk4|3\nk5|2\nk6|2\nk7|2\nk8|2\nk9|2"},
+		{"SELECT * FROM kinds k JOIN parts p ON p.kind = k.id WHERE p.id = 13", "3|k3|13|3|part 13"},
+		{"SELECT k.id, count(p.id) FROM kinds k LEFT JOIN parts p ON p.kind = k.id AND p.id < 3 WHERE k.id < 5 GROUP BY k.id ORDER BY k.id", "0|1\n1|1\n2|1\n3|0\n4|0"},
+		{"SELECT count(*) FROM parts a JOIN kinds k ON a.kind = k.id LEFT JOIN parts b ON b.id = a.id + 1 WHERE a.id > 2990 AND b.id IS NULL", "1"},
+		{"SELECT count(*) FROM kinds a, kinds b WHERE a.id < 2", "20"},
+		{"SELECT count(*) FROM kinds a, kinds b WHERE 1 = 0", "0"},
+	}
+	for _, test := range tests {
+		r := exec(t, s, test.query)
+		if got := rowsText(r.Rows); got != test.expected {
+			t.Errorf("Exec error: %s: expected\n%s\nbut got\n%s", test.query, test.expected, got)
+		}
+	}
+
+	// Joins of many tables, ordered by dynamic programming up to MAX_DP_RELATIONS and greedily past it
+	for _, n := range []int{4, MAX_DP_RELATIONS - 1, MAX_DP_RELATIONS + 2} {
+		from := []string{"kinds k0"}
+		for i := 1; i < n; i++ {
+			from = append(from, fmt.Sprintf("JOIN kinds k%d ON k%d.id = k%d.id", i, i, i-1))
+		}
+		query := "SELECT count(*), max(k0.label) FROM " + strings.Join(from, " ") + " JOIN parts p ON p.kind = k1.id WHERE p.id < 100"
+		r := exec(t, s, query)
+		if got := rowsText(r.Rows); got != "100|k9" {
+			t.Errorf("Exec error: %d tables: expected 100|k9 but got %s", n+1, got)
+		}
+	}
+
+	if !has(planOf("UPDATE parts SET name = 'x' WHERE id = 7"), isIndexScan) || !has(planOf("DELETE FROM parts WHERE id = 7"), isIndexScan) {
+		t.Errorf("Plan error: expected UPDATE and DELETE of a key to use the index")
+	}
+	if r := exec(t, s, "DELETE FROM parts WHERE id = 7"); r.RowsAffected != 1 {
+		t.Errorf("Exec error: expected to delete 1 row but deleted %d", r.RowsAffected)
+	}
+	if r := exec(t, s, "SELECT name FROM parts WHERE id = 7"); len(r.Rows) != 0 {
+		t.Errorf("Exec error: expected the deleted row to be gone but got %s", rowsText(r.Rows))
+	}
+
+	// A row the index finds by a key it no longer holds is not returned
+	exec(t, s, "UPDATE parts SET id = 3001 WHERE id = 8")
+	for query, expected := range map[string]string{
+		"SELECT name FROM parts WHERE id = 8":                     "",
+		"SELECT name FROM parts WHERE id = 3001":                  "part 8",
+		"SELECT count(*) FROM parts WHERE kind = 8 AND id > 2999": "1",
+	} {
+		if r := exec(t, s, query); rowsText(r.Rows) != expected {
+			t.Errorf("Exec error: %s: expected %q but got %q", query, expected, rowsText(r.Rows))
+		}
+	}
+}
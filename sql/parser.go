@@ -0,0 +1,963 @@
+package sql
+
+import (
+	"math"
+	"strconv"
+	"strings"
+)
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+/* Parse parses a single statement, with or without a trailing semicolon */
+func Parse(query string) (Stmt, error) {
+	stmts, err := ParseAll(query)
+	if err != nil {
+		return nil, err
+	}
+	switch len(stmts) {
+	case 0:
+		return nil, errorf(SQLSTATE_SYNTAX_ERROR, 0, "empty query")
+	case 1:
+		return stmts[0], nil
+	}
+	return nil, errorf(SQLSTATE_SYNTAX_ERROR, -1, "expected one statement, got %d", len(stmts))
+}
+
+/* ParseAll parses the statements of a script separated by semicolons */
+func ParseAll(query string) ([]Stmt, error) {
+	tokens, err := lex(query)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+	stmts := make([]Stmt, 0)
+	for {
+		for p.op(";") {
+		}
+		if p.peek().kind == TOKEN_EOF {
+			return stmts, nil
+		}
+		stmt, err := p.statement()
+		if err != nil {
+			return nil, err
+		}
+		stmts = append(stmts, stmt)
+		if !p.op(";") && p.peek().kind != TOKEN_EOF {
+			return nil, p.unexpected()
+		}
+	}
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	tok := p.tokens[p.pos]
+	if tok.kind != TOKEN_EOF {
+		p.pos++
+	}
+	return tok
+}
+
+func (p *parser) unexpected() error {
+	tok := p.peek()
+	if tok.kind == TOKEN_EOF {
+		return errorf(SQLSTATE_SYNTAX_ERROR, tok.pos, "syntax error at end of input")
+	}
+	text := tok.text
+	if tok.kind == TOKEN_STRING {
+		text = "'" + text + "'"
+	}
+	return errorf(SQLSTATE_SYNTAX_ERROR, tok.pos, "syntax error at or near %q", text)
+}
+
+/* isKeyword reports whether the next token is the keyword kw, given in upper case */
+func (p *parser) isKeyword(kw string) bool {
+	tok := p.peek()
+	return tok.kind == TOKEN_IDENT && !tok.quoted && strings.ToUpper(tok.text) == kw
+}
+
+/* keyword consumes the keyword kw if it is next */
+func (p *parser) keyword(kw string) bool {
+	if p.isKeyword(kw) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) expectKeyword(kw string) error {
+	if !p.keyword(kw) {
+		return p.unexpected()
+	}
+	return nil
+}
+
+/* op consumes the operator or punctuation op if it is next */
+func (p *parser) op(op string) bool {
+	tok := p.peek()
+	if tok.kind == TOKEN_OP && tok.text == op {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) expectOp(op string) error {
+	if !p.op(op) {
+		return p.unexpected()
+	}
+	return nil
+}
+
+/* ident reads a name; reserved words only name things when quoted */
+func (p *parser) ident() (string, int, error) {
+	tok := p.peek()
+	if tok.kind != TOKEN_IDENT || (!tok.quoted && reserved[strings.ToUpper(tok.text)]) {
+		return "", tok.pos, p.unexpected()
+	}
+	p.pos++
+	return tok.text, tok.pos, nil
+}
+
+func (p *parser) statement() (Stmt, error) {
+	switch {
+	case p.keyword("SELECT"):
+		return p.selectStmt()
+	case p.keyword("INSERT"):
+		return p.insertStmt()
+	case p.keyword("UPDATE"):
+		return p.updateStmt()
+	case p.keyword("DELETE"):
+		return p.deleteStmt()
+	case p.keyword("CREATE"):
+		return p.createStmt()
+	case p.keyword("DROP"):
+		return p.dropStmt()
+	case p.keyword("EXPLAIN"):
+		return p.explainStmt()
+	case p.keyword("BEGIN"):
+		p.transactionNoise()
+		return &BeginStmt{}, nil
+	case p.keyword("START"):
+		if err := p.expectKeyword("TRANSACTION"); err != nil {
+			return nil, err
+		}
+		return &BeginStmt{}, nil
+	case p.keyword("COMMIT"), p.keyword("END"):
+		p.transactionNoise()
+		return &CommitStmt{}, nil
+	case p.keyword("ROLLBACK"), p.keyword("ABORT"):
+		p.transactionNoise()
+		return &RollbackStmt{}, nil
+	}
+	return nil, p.unexpected()
+}
+
+/* transactionNoise skips the optional WORK or TRANSACTION after BEGIN, COMMIT and ROLLBACK */
+func (p *parser) transactionNoise() {
+	if !p.keyword("WORK") {
+		p.keyword("TRANSACTION")
+	}
+}
+
+/* explainStmt reads EXPLAIN [ANALYZE] statement, or EXPLAIN (option [, ...]) statement with the options ANALYZE [boolean] and FORMAT {TEXT | JSON} */
+func (p *parser) explainStmt() (Stmt, error) {
+	stmt := &ExplainStmt{}
+	if p.op("(") {
+		for {
+			switch {
+			case p.keyword("ANALYZE"):
+				stmt.Analyze = p.optionValue()
+			case p.keyword("FORMAT"):
+				switch {
+				case p.keyword("TEXT"):
+					stmt.Format = EXPLAIN_TEXT
+				case p.keyword("JSON"):
+					stmt.Format = EXPLAIN_JSON
+				default:
+					return nil, p.unexpected()
+				}
+			default:
+				return nil, p.unexpected()
+			}
+			if !p.op(",") {
+				break
+			}
+		}
+		if err := p.expectOp(")"); err != nil {
+			return nil, err
+		}
+	} else {
+		stmt.Analyze = p.keyword("ANALYZE")
+	}
+	// Only statements that have a plan can be explained
+	if !p.isKeyword("SELECT") && !p.isKeyword("INSERT") && !p.isKeyword("UPDATE") && !p.isKeyword("DELETE") {
+		return nil, p.unexpected()
+	}
+	inner, err := p.statement()
+	if err != nil {
+		return nil, err
+	}
+	stmt.Stmt = inner
+	return stmt, nil
+}
+
+/* optionValue reads the optional boolean of an option, which is on when it is left out */
+func (p *parser) optionValue() bool {
+	switch {
+	case p.keyword("FALSE"), p.keyword("OFF"):
+		return false
+	case p.keyword("TRUE"), p.keyword("ON"):
+	}
+	return true
+}
+
+func (p *parser) createStmt() (Stmt, error) {
+	if err := p.expectKeyword("TABLE"); err != nil {
+		return nil, err
+	}
+	stmt := &CreateTableStmt{Pos: p.peek().pos}
+	if p.keyword("IF") {
+		if err := p.expectKeyword("NOT"); err != nil {
+			return nil, err
+		}
+		if err := p.expectKeyword("EXISTS"); err != nil {
+			return nil, err
+		}
+		stmt.IfNotExists = true
+	}
+	var err error
+	if stmt.Name, stmt.Pos, err = p.ident(); err != nil {
+		return nil, err
+	}
+	if err := p.expectOp("("); err != nil {
+		return nil, err
+	}
+	for {
+		if p.isKeyword("PRIMARY") {
+			pos := p.next().pos
+			if err := p.expectKeyword("KEY"); err != nil {
+				return nil, err
+			}
+			if err := p.expectOp("("); err != nil {
+				return nil, err
+			}
+			name, _, err := p.ident()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expectOp(")"); err != nil {
+				return nil, err
+			}
+			if stmt.PrimaryKey != "" {
+				return nil, errorf(SQLSTATE_SYNTAX_ERROR, pos, "multiple primary keys for table %q are not allowed", stmt.Name)
+			}
+			stmt.PrimaryKey = name
+		} else {
+			def, err := p.columnDef()
+			if err != nil {
+				return nil, err
+			}
+			if def.PrimaryKey {
+				if stmt.PrimaryKey != "" {
+					return nil, errorf(SQLSTATE_SYNTAX_ERROR, def.Pos, "multiple primary keys for table %q are not allowed", stmt.Name)
+				}
+				stmt.PrimaryKey = def.Name
+			}
+			stmt.Columns = append(stmt.Columns, def)
+		}
+		if !p.op(",") {
+			break
+		}
+	}
+	if err := p.expectOp(")"); err != nil {
+		return nil, err
+	}
+	if len(stmt.Columns) == 0 {
+		return nil, errorf(SQLSTATE_SYNTAX_ERROR, stmt.Pos, "table %q has no columns", stmt.Name)
+	}
+	if stmt.PrimaryKey == "" {
+		stmt.PrimaryKey = stmt.Columns[0].Name
+	}
+	return stmt, nil
+}
+
+func (p *parser) columnDef() (ColumnDef, error) {
+	def := ColumnDef{}
+	var err error
+	if def.Name, def.Pos, err = p.ident(); err != nil {
+		return def, err
+	}
+	tok := p.peek()
+	if tok.kind != TOKEN_IDENT || tok.quoted {
+		return def, p.unexpected()
+	}
+	p.pos++
+	typ, ok := typeNames[tok.text]
+	if !ok {
+		return def, errorf(SQLSTATE_UNDEFINED_OBJECT, tok.pos, "type %q does not exist", tok.text)
+	}
+	def.Type = typ
+	switch tok.text {
+	case "double":
+		p.keyword("PRECISION")
+	case "varchar", "char":
+		// The length is accepted but not enforced
+		if p.op("(") {
+			if p.peek().kind != TOKEN_NUMBER {
+				return def, p.unexpected()
+			}
+			p.pos++
+			if err := p.expectOp(")"); err != nil {
+				return def, err
+			}
+		}
+	}
+	for {
+		switch {
+		case p.keyword("PRIMARY"):
+			if err := p.expectKeyword("KEY"); err != nil {
+				return def, err
+			}
+			def.PrimaryKey = true
+		case p.keyword("NOT"):
+			if err := p.expectKeyword("NULL"); err != nil {
+				return def, err
+			}
+			def.NotNull = true
+		case p.keyword("NULL"):
+		default:
+			return def, nil
+		}
+	}
+}
+
+func (p *parser) dropStmt() (Stmt, error) {
+	if err := p.expectKeyword("TABLE"); err != nil {
+		return nil, err
+	}
+	stmt := &DropTableStmt{}
+	if p.keyword("IF") {
+		if err := p.expectKeyword("EXISTS"); err != nil {
+			return nil, err
+		}
+		stmt.IfExists = true
+	}
+	var err error
+	if stmt.Name, stmt.Pos, err = p.ident(); err != nil {
+		return nil, err
+	}
+	return stmt, nil
+}
+
+func (p *parser) tableRef() (*TableRef, error) {
+	name, pos, err := p.ident()
+	if err != nil {
+		return nil, err
+	}
+	ref := &TableRef{Name: name, Pos: pos}
+	if p.keyword("AS") {
+		if ref.Alias, _, err = p.ident(); err != nil {
+			return nil, err
+		}
+	} else if tok := p.peek(); tok.kind == TOKEN_IDENT && (tok.quoted || !reserved[strings.ToUpper(tok.text)]) {
+		ref.Alias = p.next().text
+	}
+	return ref, nil
+}
+
+func (p *parser) insertStmt() (Stmt, error) {
+	if err := p.expectKeyword("INTO"); err != nil {
+		return nil, err
+	}
+	name, pos, err := p.ident()
+	if err != nil {
+		return nil, err
+	}
+	stmt := &InsertStmt{Table: &TableRef{Name: name, Pos: pos}}
+	if p.op("(") {
+		for {
+			col, _, err := p.ident()
+			if err != nil {
+				return nil, err
+			}
+			stmt.Columns = append(stmt.Columns, col)
+			if !p.op(",") {
+				break
+			}
+		}
+		if err := p.expectOp(")"); err != nil {
+			return nil, err
+		}
+	}
+	if err := p.expectKeyword("VALUES"); err != nil {
+		return nil, err
+	}
+	for {
+		if err := p.expectOp("("); err != nil {
+			return nil, err
+		}
+		values, err := p.exprList()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expectOp(")"); err != nil {
+			return nil, err
+		}
+		stmt.Rows = append(stmt.Rows, values)
+		if !p.op(",") {
+			return stmt, nil
+		}
+	}
+}
+
+func (p *parser) exprList() ([]Expr, error) {
+	list := make([]Expr, 0)
+	for {
+		e, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, e)
+		if !p.op(",") {
+			return list, nil
+		}
+	}
+}
+
+func (p *parser) selectStmt() (Stmt, error) {
+	stmt := &SelectStmt{}
+	p.keyword("ALL")
+	for {
+		item, err := p.selectItem()
+		if err != nil {
+			return nil, err
+		}
+		stmt.Items = append(stmt.Items, item)
+		if !p.op(",") {
+			break
+		}
+	}
+	var err error
+	if p.keyword("FROM") {
+		if stmt.From, err = p.from(); err != nil {
+			return nil, err
+		}
+	}
+	if p.keyword("WHERE") {
+		if stmt.Where, err = p.expr(); err != nil {
+			return nil, err
+		}
+	}
+	if p.keyword("GROUP") {
+		if err := p.expectKeyword("BY"); err != nil {
+			return nil, err
+		}
+		if stmt.GroupBy, err = p.exprList(); err != nil {
+			return nil, err
+		}
+	}
+	if p.keyword("HAVING") {
+		if stmt.Having, err = p.expr(); err != nil {
+			return nil, err
+		}
+	}
+	if p.keyword("ORDER") {
+		if err := p.expectKeyword("BY"); err != nil {
+			return nil, err
+		}
+		if stmt.OrderBy, err = p.orderBy(); err != nil {
+			return nil, err
+		}
+	}
+	// LIMIT and OFFSET may come in either order
+	for i := 0; i < 2; i++ {
+		switch {
+		case stmt.Limit == nil && p.keyword("LIMIT"):
+			if p.keyword("ALL") {
+				stmt.Limit = &Literal{exprBase: exprBase{pos: p.tokens[p.pos-1].pos}, Value: Null()}
+				continue
+			}
+			if stmt.Limit, err = p.expr(); err != nil {
+				return nil, err
+			}
+		case stmt.Offset == nil && p.keyword("OFFSET"):
+			if stmt.Offset, err = p.expr(); err != nil {
+				return nil, err
+			}
+			if !p.keyword("ROWS") {
+				p.keyword("ROW")
+			}
+		}
+	}
+	return stmt, nil
+}
+
+/* from reads the FROM items, joined left to right. A comma is a cross join */
+func (p *parser) from() (TableExpr, error) {
+	ref, err := p.tableRef()
+	if err != nil {
+		return nil, err
+	}
+	var from TableExpr = ref
+	for {
+		join := &JoinExpr{Left: from, Pos: p.peek().pos}
+		hasOn := true
+		switch {
+		case p.op(","):
+			hasOn = false
+		case p.keyword("CROSS"):
+			if err := p.expectKeyword("JOIN"); err != nil {
+				return nil, err
+			}
+			hasOn = false
+		case p.keyword("JOIN"):
+		case p.keyword("INNER"):
+			if err := p.expectKeyword("JOIN"); err != nil {
+				return nil, err
+			}
+		case p.keyword("LEFT"):
+			p.keyword("OUTER")
+			if err := p.expectKeyword("JOIN"); err != nil {
+				return nil, err
+			}
+			join.Type = JOIN_LEFT
+		case p.isKeyword("RIGHT") || p.isKeyword("FULL") || p.isKeyword("NATURAL"):
+			return nil, errorf(SQLSTATE_FEATURE_UNSUPPORTED, join.Pos, "%s JOIN is not supported", strings.ToUpper(p.peek().text))
+		default:
+			return from, nil
+		}
+		if join.Right, err = p.tableRef(); err != nil {
+			return nil, err
+		}
+		if hasOn {
+			if err := p.expectKeyword("ON"); err != nil {
+				return nil, err
+			}
+			if join.On, err = p.expr(); err != nil {
+				return nil, err
+			}
+		}
+		from = join
+	}
+}
+
+func (p *parser) selectItem() (*SelectItem, error) {
+	pos := p.peek().pos
+	if p.op("*") {
+		return &SelectItem{Star: true, Pos: pos}, nil
+	}
+	// table.*
+	if tok := p.peek(); tok.kind == TOKEN_IDENT && p.tokens[p.pos+1].kind == TOKEN_OP && p.tokens[p.pos+1].text == "." && p.tokens[p.pos+2].text == "*" && p.tokens[p.pos+2].kind == TOKEN_OP {
+		name, _, err := p.ident()
+		if err != nil {
+			return nil, err
+		}
+		p.pos += 2
+		return &SelectItem{Star: true, Table: name, Pos: pos}, nil
+	}
+	e, err := p.expr()
+	if err != nil {
+		return nil, err
+	}
+	item := &SelectItem{Expr: e, Pos: pos}
+	if p.keyword("AS") {
+		if p.peek().kind != TOKEN_IDENT {
+			return nil, p.unexpected()
+		}
+		item.Alias = p.next().text
+	} else if tok := p.peek(); tok.kind == TOKEN_IDENT && (tok.quoted || !reserved[strings.ToUpper(tok.text)]) {
+		item.Alias = p.next().text
+	}
+	return item, nil
+}
+
+func (p *parser) orderBy() ([]*OrderItem, error) {
+	items := make([]*OrderItem, 0)
+	for {
+		e, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		item := &OrderItem{Expr: e}
+		if p.keyword("DESC") {
+			item.Desc = true
+		} else {
+			p.keyword("ASC")
+		}
+		if p.keyword("NULLS") {
+			switch {
+			case p.keyword("FIRST"):
+				item.Nulls = NULLS_FIRST
+			case p.keyword("LAST"):
+				item.Nulls = NULLS_LAST
+			default:
+				return nil, p.unexpected()
+			}
+		}
+		items = append(items, item)
+		if !p.op(",") {
+			return items, nil
+		}
+	}
+}
+
+func (p *parser) updateStmt() (Stmt, error) {
+	ref, err := p.tableRef()
+	if err != nil {
+		return nil, err
+	}
+	stmt := &UpdateStmt{Table: ref}
+	if err := p.expectKeyword("SET"); err != nil {
+		return nil, err
+	}
+	for {
+		name, pos, err := p.ident()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expectOp("="); err != nil {
+			return nil, err
+		}
+		value, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		stmt.Set = append(stmt.Set, &Assignment{Column: name, Value: value, Pos: pos})
+		if !p.op(",") {
+			break
+		}
+	}
+	if p.keyword("WHERE") {
+		if stmt.Where, err = p.expr(); err != nil {
+			return nil, err
+		}
+	}
+	return stmt, nil
+}
+
+func (p *parser) deleteStmt() (Stmt, error) {
+	if err := p.expectKeyword("FROM"); err != nil {
+		return nil, err
+	}
+	ref, err := p.tableRef()
+	if err != nil {
+		return nil, err
+	}
+	stmt := &DeleteStmt{Table: ref}
+	if p.keyword("WHERE") {
+		if stmt.Where, err = p.expr(); err != nil {
+			return nil, err
+		}
+	}
+	return stmt, nil
+}
+
+/*
+Expressions, loosest binding first:
+
+	OR
+	AND
+	NOT
+	comparisons, IS [NOT] NULL, [NOT] LIKE, [NOT] IN, [NOT] BETWEEN
+	||
+	+ -
+	* / %
+	unary -
+*/
+func (p *parser) expr() (Expr, error) {
+	return p.or()
+}
+
+func (p *parser) or() (Expr, error) {
+	left, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for p.isKeyword("OR") {
+		pos := p.next().pos
+		right, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		left = &Binary{exprBase: exprBase{pos: pos}, Op: "OR", Left: left, Right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) and() (Expr, error) {
+	left, err := p.not()
+	if err != nil {
+		return nil, err
+	}
+	for p.isKeyword("AND") {
+		pos := p.next().pos
+		right, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		left = &Binary{exprBase: exprBase{pos: pos}, Op: "AND", Left: left, Right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) not() (Expr, error) {
+	if p.isKeyword("NOT") {
+		pos := p.next().pos
+		x, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		return &Unary{exprBase: exprBase{pos: pos}, Op: "NOT", X: x}, nil
+	}
+	return p.comparison()
+}
+
+var comparisons = map[string]bool{"=": true, "<>": true, "<": true, "<=": true, ">": true, ">=": true}
+
+func (p *parser) comparison() (Expr, error) {
+	left, err := p.concat()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		tok := p.peek()
+		switch {
+		case tok.kind == TOKEN_OP && comparisons[tok.text]:
+			p.pos++
+			right, err := p.concat()
+			if err != nil {
+				return nil, err
+			}
+			left = &Binary{exprBase: exprBase{pos: tok.pos}, Op: tok.text, Left: left, Right: right}
+		case p.keyword("IS"):
+			not := p.keyword("NOT")
+			if err := p.expectKeyword("NULL"); err != nil {
+				return nil, err
+			}
+			left = &IsNull{exprBase: exprBase{pos: tok.pos}, X: left, Not: not}
+		default:
+			// [NOT] LIKE, IN and BETWEEN
+			not := false
+			if p.isKeyword("NOT") {
+				nextTok := p.tokens[p.pos+1]
+				kw := strings.ToUpper(nextTok.text)
+				if nextTok.kind != TOKEN_IDENT || nextTok.quoted || (kw != "LIKE" && kw != "IN" && kw != "BETWEEN") {
+					return left, nil
+				}
+				p.pos++
+				not = true
+			}
+			switch {
+			case p.keyword("LIKE"):
+				pattern, err := p.concat()
+				if err != nil {
+					return nil, err
+				}
+				left = &Like{exprBase: exprBase{pos: tok.pos}, X: left, Pattern: pattern, Not: not}
+			case p.keyword("IN"):
+				if err := p.expectOp("("); err != nil {
+					return nil, err
+				}
+				list, err := p.exprList()
+				if err != nil {
+					return nil, err
+				}
+				if err := p.expectOp(")"); err != nil {
+					return nil, err
+				}
+				left = &In{exprBase: exprBase{pos: tok.pos}, X: left, List: list, Not: not}
+			case p.keyword("BETWEEN"):
+				low, err := p.concat()
+				if err != nil {
+					return nil, err
+				}
+				if err := p.expectKeyword("AND"); err != nil {
+					return nil, err
+				}
+				high, err := p.concat()
+				if err != nil {
+					return nil, err
+				}
+				left = &Between{exprBase: exprBase{pos: tok.pos}, X: left, Low: low, High: high, Not: not}
+			default:
+				return left, nil
+			}
+		}
+	}
+}
+
+func (p *parser) concat() (Expr, error) {
+	return p.binary(p.additive, "||")
+}
+
+func (p *parser) additive() (Expr, error) {
+	return p.binary(p.multiplicative, "+", "-")
+}
+
+func (p *parser) multiplicative() (Expr, error) {
+	return p.binary(p.unary, "*", "/", "%")
+}
+
+/* binary parses a left associative chain of the operators ops over operands read by operand */
+func (p *parser) binary(operand func() (Expr, error), ops ...string) (Expr, error) {
+	left, err := operand()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		tok := p.peek()
+		matched := false
+		for _, op := range ops {
+			if tok.kind == TOKEN_OP && tok.text == op {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return left, nil
+		}
+		p.pos++
+		right, err := operand()
+		if err != nil {
+			return nil, err
+		}
+		left = &Binary{exprBase: exprBase{pos: tok.pos}, Op: tok.text, Left: left, Right: right}
+	}
+}
+
+func (p *parser) unary() (Expr, error) {
+	tok := p.peek()
+	if tok.kind == TOKEN_OP && (tok.text == "-" || tok.text == "+") {
+		p.pos++
+		// Fold the sign into numeric literals so the smallest integers can be written
+		if next := p.peek(); tok.text == "-" && next.kind == TOKEN_NUMBER {
+			p.pos++
+			return numberLiteral("-"+next.text, tok.pos)
+		}
+		x, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		if tok.text == "+" {
+			return x, nil
+		}
+		return &Unary{exprBase: exprBase{pos: tok.pos}, Op: "-", X: x}, nil
+	}
+	return p.primary()
+}
+
+func (p *parser) primary() (Expr, error) {
+	tok := p.peek()
+	switch tok.kind {
+	case TOKEN_NUMBER:
+		p.pos++
+		return numberLiteral(tok.text, tok.pos)
+	case TOKEN_PARAM:
+		p.pos++
+		n, err := strconv.Atoi(tok.text)
+		if err != nil || n < 1 || n > MAX_PARAMS {
+			return nil, errorf(SQLSTATE_UNDEFINED_PARAMETER, tok.pos, "there is no parameter $%s", tok.text)
+		}
+		return &Param{exprBase: exprBase{pos: tok.pos}, Index: n - 1}, nil
+	case TOKEN_STRING:
+		p.pos++
+		return &Literal{exprBase: exprBase{pos: tok.pos, kind: KIND_STRING}, Value: String(tok.text), untyped: true}, nil
+	case TOKEN_OP:
+		if p.op("(") {
+			e, err := p.expr()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expectOp(")"); err != nil {
+				return nil, err
+			}
+			return e, nil
+		}
+		return nil, p.unexpected()
+	case TOKEN_IDENT:
+		if !tok.quoted {
+			switch strings.ToUpper(tok.text) {
+			case "NULL":
+				p.pos++
+				return &Literal{exprBase: exprBase{pos: tok.pos, kind: KIND_NULL}, Value: Null()}, nil
+			case "TRUE", "FALSE":
+				p.pos++
+				return &Literal{exprBase: exprBase{pos: tok.pos, kind: KIND_BOOL}, Value: Bool(tok.text == "true")}, nil
+			}
+		}
+		name, pos, err := p.ident()
+		if err != nil {
+			return nil, err
+		}
+		if p.op("(") {
+			return p.funcCall(name, pos)
+		}
+		if p.op(".") {
+			col, _, err := p.ident()
+			if err != nil {
+				return nil, err
+			}
+			return &ColumnRef{exprBase: exprBase{pos: pos}, Table: name, Name: col, Index: -1}, nil
+		}
+		return &ColumnRef{exprBase: exprBase{pos: pos}, Name: name, Index: -1}, nil
+	}
+	return nil, p.unexpected()
+}
+
+/* funcCall parses the arguments of a call, after the opening parenthesis */
+func (p *parser) funcCall(name string, pos int) (Expr, error) {
+	call := &FuncCall{exprBase: exprBase{pos: pos}, Name: name}
+	if p.op("*") {
+		call.Star = true
+	} else if !p.isOpNext(")") {
+		if p.keyword("DISTINCT") {
+			call.Distinct = true
+		} else {
+			p.keyword("ALL")
+		}
+		args, err := p.exprList()
+		if err != nil {
+			return nil, err
+		}
+		call.Args = args
+	}
+	if err := p.expectOp(")"); err != nil {
+		return nil, err
+	}
+	return call, nil
+}
+
+func (p *parser) isOpNext(op string) bool {
+	tok := p.peek()
+	return tok.kind == TOKEN_OP && tok.text == op
+}
+
+/* numberLiteral types a numeric literal: integers are INT when they fit and UINT above, the rest FLOAT */
+func numberLiteral(text string, pos int) (Expr, error) {
+	lit := &Literal{exprBase: exprBase{pos: pos}}
+	if !strings.ContainsAny(text, ".eE") {
+		if i, err := strconv.ParseInt(text, 10, 64); err == nil {
+			lit.Value, lit.kind = Int(i), KIND_INT
+			return lit, nil
+		}
+		if u, err := strconv.ParseUint(text, 10, 64); err == nil {
+			lit.Value, lit.kind = Uint(u), KIND_UINT
+			return lit, nil
+		}
+	}
+	f, err := strconv.ParseFloat(text, 64)
+	if err != nil && !math.IsInf(f, 0) {
+		return nil, errorf(SQLSTATE_SYNTAX_ERROR, pos, "invalid number %q", text)
+	}
+	if math.IsInf(f, 0) {
+		return nil, errorf(SQLSTATE_OUT_OF_RANGE, pos, "number %q is out of range", text)
+	}
+	lit.Value, lit.kind = Float(f), KIND_FLOAT
+	return lit, nil
+}
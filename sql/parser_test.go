@@ -0,0 +1,258 @@
+package sql
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/misachi/DarDB/column"
+)
+
+func TestLex(t *testing.T) {
+	tokens, err := lex(`SELECT "Mixed ""Case""", x1 -- comment
+		FROM t /* block
+		comment */ WHERE a<>'it''s' AND b != 1.5e3 || .5`)
+	if err != nil {
+		t.Fatalf("lex error: %v", err)
+	}
+	expected := []token{
+		{kind: TOKEN_IDENT, text: "select"},
+		{kind: TOKEN_IDENT, text: `Mixed "Case"`, quoted: true},
+		{kind: TOKEN_OP, text: ","},
+		{kind: TOKEN_IDENT, text: "x1"},
+		{kind: TOKEN_IDENT, text: "from"},
+		{kind: TOKEN_IDENT, text: "t"},
+		{kind: TOKEN_IDENT, text: "where"},
+		{kind: TOKEN_IDENT, text: "a"},
+		{kind: TOKEN_OP, text: "<>"},
+		{kind: TOKEN_STRING, text: "it's"},
+		{kind: TOKEN_IDENT, text: "and"},
+		{kind: TOKEN_IDENT, text: "b"},
+		{kind: TOKEN_OP, text: "<>"},
+		{kind: TOKEN_NUMBER, text: "1.5e3"},
+		{kind: TOKEN_OP, text: "||"},
+		{kind: TOKEN_NUMBER, text: ".5"},
+		{kind: TOKEN_EOF},
+	}
+	if len(tokens) != len(expected) {
+		t.Fatalf("lex error: expected %d tokens but got %d: %v", len(expected), len(tokens), tokens)
+	}
+	for i, tok := range tokens {
+		tok.pos = 0
+		if tok != expected[i] {
+			t.Errorf("lex error: token %d expected %+v but got %+v", i, expected[i], tok)
+		}
+	}
+
+	for _, query := range []string{"SELECT 'open", `SELECT "open`, "SELECT 1 /* open", "SELECT 12abc", "SELECT #"} {
+		var sqlErr *Error
+		if _, err := lex(query); !errors.As(err, &sqlErr) || sqlErr.Code != SQLSTATE_SYNTAX_ERROR {
+			t.Errorf("lex error: expected a syntax error for %q but got %v", query, err)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	stmt, err := Parse(`CREATE TABLE IF NOT EXISTS orders (id bigint, customer int NOT NULL, note varchar(20), total double precision, PRIMARY KEY (customer))`)
+	if err != nil {
+		t.Fatalf("Parse error: %v", err)
+	}
+	create := stmt.(*CreateTableStmt)
+	if create.Name != "orders" || !create.IfNotExists || create.PrimaryKey != "customer" || len(create.Columns) != 4 {
+		t.Errorf("Parse error: unexpected CREATE TABLE %+v", create)
+	}
+	types := []column.SUPPORTED_TYPE{column.INT64, column.INT, column.STRING, column.FLOAT64}
+	for i, def := range create.Columns {
+		if def.Type != types[i] {
+			t.Errorf("Parse error: expected column %s of type %v but got %v", def.Name, types[i], def.Type)
+		}
+	}
+	if stmt, _ = Parse("create table t (a text, b int primary key)"); stmt.(*CreateTableStmt).PrimaryKey != "b" {
+		t.Errorf("Parse error: expected the column PRIMARY KEY to be the key")
+	}
+	if stmt, _ = Parse("create table t (a text, b int)"); stmt.(*CreateTableStmt).PrimaryKey != "a" {
+		t.Errorf("Parse error: expected the first column to be the key by default")
+	}
+
+	stmt, err = Parse(`SELECT *, o.id, total * 2 AS double, "key" FROM orders o WHERE id > 10 ORDER BY 2 DESC NULLS LAST, note LIMIT 5 OFFSET 1;`)
+	if err != nil {
+		t.Fatalf("Parse error: %v", err)
+	}
+	sel := stmt.(*SelectStmt)
+	if len(sel.Items) != 4 || !sel.Items[0].Star || sel.Items[2].Alias != "double" || sel.Items[3].Expr.(*ColumnRef).Name != "key" {
+		t.Errorf("Parse error: unexpected select list %+v", sel.Items)
+	}
+	if ref := sel.Items[1].Expr.(*ColumnRef); ref.Table != "o" || ref.Name != "id" {
+		t.Errorf("Parse error: unexpected qualified column %+v", ref)
+	}
+	if from := sel.From.(*TableRef); from.Name != "orders" || from.RefName() != "o" {
+		t.Errorf("Parse error: unexpected FROM %+v", from)
+	}
+	if len(sel.OrderBy) != 2 || !sel.OrderBy[0].Desc || sel.OrderBy[0].NullsFirst() || sel.OrderBy[1].Desc || sel.OrderBy[1].NullsFirst() {
+		t.Errorf("Parse error: unexpected ORDER BY %+v %+v", sel.OrderBy[0], sel.OrderBy[1])
+	}
+	if FormatExpr(sel.Limit) != "5" || FormatExpr(sel.Offset) != "1" {
+		t.Errorf("Parse error: unexpected LIMIT %s OFFSET %s", FormatExpr(sel.Limit), FormatExpr(sel.Offset))
+	}
+
+	stmt, err = Parse("SELECT 1 FROM a, b CROSS JOIN c LEFT OUTER JOIN d ON d.x = a.x JOIN e ON true")
+	if err != nil {
+		t.Fatalf("Parse error: %v", err)
+	}
+	join := stmt.(*SelectStmt).From.(*JoinExpr)
+	if join.Type != JOIN_INNER || join.Right.(*TableRef).Name != "e" || FormatExpr(join.On) != "true" {
+		t.Errorf("Parse error: unexpected JOIN %+v", join)
+	}
+	left := join.Left.(*JoinExpr)
+	if left.Type != JOIN_LEFT || left.Right.(*TableRef).Name != "d" || FormatExpr(left.On) != "(d.x = a.x)" {
+		t.Errorf("Parse error: unexpected LEFT JOIN %+v", left)
+	}
+	if cross := left.Left.(*JoinExpr); cross.On != nil || cross.Left.(*JoinExpr).Left.(*TableRef).Name != "a" {
+		t.Errorf("Parse error: unexpected CROSS JOIN %+v", cross)
+	}
+
+	stmt, err = Parse("SELECT a, count(DISTINCT b) FROM t GROUP BY a, b % 2 HAVING sum(c) > 1 ORDER BY a")
+	if err != nil {
+		t.Fatalf("Parse error: %v", err)
+	}
+	if sel := stmt.(*SelectStmt); len(sel.GroupBy) != 2 || FormatExpr(sel.GroupBy[1]) != "(b % 2)" || FormatExpr(sel.Having) != "(sum(c) > 1)" {
+		t.Errorf("Parse error: unexpected GROUP BY %v HAVING %s", sel.GroupBy, FormatExpr(sel.Having))
+	}
+
+	stmt, err = Parse("INSERT INTO orders (id, note) VALUES (1, 'a'), (2, NULL)")
+	if err != nil {
+		t.Fatalf("Parse error: %v", err)
+	}
+	insert := stmt.(*InsertStmt)
+	if insert.Table.Name != "orders" || len(insert.Columns) != 2 || len(insert.Rows) != 2 || FormatExpr(insert.Rows[1][1]) != "NULL" {
+		t.Errorf("Parse error: unexpected INSERT %+v", insert)
+	}
+
+	stmt, err = Parse("UPDATE orders SET note = note || '!', total = -total WHERE id IN (1, 2)")
+	if err != nil {
+		t.Fatalf("Parse error: %v", err)
+	}
+	update := stmt.(*UpdateStmt)
+	if len(update.Set) != 2 || FormatExpr(update.Set[0].Value) != "(note || '!')" || FormatExpr(update.Where) != "(id IN (1, 2))" {
+		t.Errorf("Parse error: unexpected UPDATE %+v", update)
+	}
+
+	stmts, err := ParseAll("BEGIN; DELETE FROM orders WHERE note IS NOT NULL; COMMIT WORK; ROLLBACK; DROP TABLE IF EXISTS orders;;")
+	if err != nil {
+		t.Fatalf("ParseAll error: %v", err)
+	}
+	if len(stmts) != 5 {
+		t.Fatalf("ParseAll error: expected 5 statements but got %d", len(stmts))
+	}
+	if _, ok := stmts[0].(*BeginStmt); !ok {
+		t.Errorf("ParseAll error: expected BEGIN but got %T", stmts[0])
+	}
+	if del := stmts[1].(*DeleteStmt); FormatExpr(del.Where) != "(note IS NOT NULL)" {
+		t.Errorf("ParseAll error: unexpected DELETE %+v", del)
+	}
+	if _, ok := stmts[2].(*CommitStmt); !ok {
+		t.Errorf("ParseAll error: expected COMMIT but got %T", stmts[2])
+	}
+	if _, ok := stmts[3].(*RollbackStmt); !ok {
+		t.Errorf("ParseAll error: expected ROLLBACK but got %T", stmts[3])
+	}
+	if drop := stmts[4].(*DropTableStmt); drop.Name != "orders" || !drop.IfExists {
+		t.Errorf("ParseAll error: unexpected DROP %+v", drop)
+	}
+}
+
+func TestParseExplain(t *testing.T) {
+	tests := []struct {
+		query   string
+		analyze bool
+		format  ExplainFormat
+	}{
+		{"EXPLAIN SELECT 1", false, EXPLAIN_TEXT},
+		{"explain analyze DELETE FROM t", true, EXPLAIN_TEXT},
+		{"EXPLAIN (FORMAT JSON) SELECT 1", false, EXPLAIN_JSON},
+		{"EXPLAIN (ANALYZE, FORMAT TEXT) UPDATE t SET a = 1", true, EXPLAIN_TEXT},
+		{"EXPLAIN (ANALYZE off, FORMAT json) INSERT INTO t VALUES (1)", false, EXPLAIN_JSON},
+		{"EXPLAIN (ANALYZE TRUE) SELECT 1", true, EXPLAIN_TEXT},
+	}
+	for _, test := range tests {
+		stmt, err := Parse(test.query)
+		if err != nil {
+			t.Errorf("Parse error: %s: %v", test.query, err)
+			continue
+		}
+		explain := stmt.(*ExplainStmt)
+		if explain.Analyze != test.analyze || explain.Format != test.format || explain.Stmt == nil {
+			t.Errorf("Parse error: %s: unexpected EXPLAIN %+v", test.query, explain)
+		}
+	}
+}
+
+func TestParseExpr(t *testing.T) {
+	tests := []struct {
+		expr     string
+		expected string
+	}{
+		{"1 + 2 * 3 - 4", "((1 + (2 * 3)) - 4)"},
+		{"(1 + 2) * 3", "((1 + 2) * 3)"},
+		{"a OR b AND NOT c", "(a OR (b AND (NOT c)))"},
+		{"a = 1 AND b <> 2 OR c >= 3", "(((a = 1) AND (b <> 2)) OR (c >= 3))"},
+		{"a || 'x' = b", "((a || 'x') = b)"},
+		{"-a * -2", "((-a) * -2)"},
+		{"-9223372036854775808", "-9223372036854775808"},
+		{"18446744073709551615", "18446744073709551615"},
+		{"a NOT BETWEEN 1 AND 2 + 3", "(a NOT BETWEEN 1 AND (2 + 3))"},
+		{"a NOT LIKE 'x%' AND b NOT IN (1, 2)", "((a NOT LIKE 'x%') AND (b NOT IN (1, 2)))"},
+		{"NOT a IS NULL", "(NOT (a IS NULL))"},
+		{"count(*) + count(DISTINCT a) + sum(t.b)", "((count(*) + count(DISTINCT a)) + sum(t.b))"},
+		{"TRUE AND FALSE", "(true AND false)"},
+		{"$1 + -$12", "($1 + (-$12))"},
+	}
+	for _, test := range tests {
+		stmt, err := Parse("SELECT " + test.expr)
+		if err != nil {
+			t.Errorf("Parse error: %s: %v", test.expr, err)
+			continue
+		}
+		if got := FormatExpr(stmt.(*SelectStmt).Items[0].Expr); got != test.expected {
+			t.Errorf("Parse error: %s: expected %s but got %s", test.expr, test.expected, got)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		query string
+		code  string
+		pos   int
+	}{
+		{"", SQLSTATE_SYNTAX_ERROR, 0},
+		{"SELEC 1", SQLSTATE_SYNTAX_ERROR, 0},
+		{"SELECT 1 +", SQLSTATE_SYNTAX_ERROR, 10},
+		{"SELECT a FROM select", SQLSTATE_SYNTAX_ERROR, 14},
+		{"SELECT (1", SQLSTATE_SYNTAX_ERROR, 9},
+		{"SELECT 1 2", SQLSTATE_SYNTAX_ERROR, 9},
+		{"CREATE TABLE t (a blob)", SQLSTATE_UNDEFINED_OBJECT, 18},
+		{"CREATE TABLE t (a int primary key, b int primary key)", SQLSTATE_SYNTAX_ERROR, 35},
+		{"CREATE TABLE t ()", SQLSTATE_SYNTAX_ERROR, 16},
+		{"INSERT INTO t VALUES 1", SQLSTATE_SYNTAX_ERROR, 21},
+		{"SELECT 1e999", SQLSTATE_OUT_OF_RANGE, 7},
+		{"SELECT 1; SELECT 2", SQLSTATE_SYNTAX_ERROR, -1},
+		{"SELECT 1 FROM a JOIN b", SQLSTATE_SYNTAX_ERROR, 22},
+		{"SELECT 1 FROM a FULL JOIN b ON true", SQLSTATE_FEATURE_UNSUPPORTED, 16},
+		{"EXPLAIN CREATE TABLE t (a int)", SQLSTATE_SYNTAX_ERROR, 8},
+		{"SELECT $0", SQLSTATE_UNDEFINED_PARAMETER, 7},
+		{"SELECT $65536", SQLSTATE_UNDEFINED_PARAMETER, 7},
+		{"EXPLAIN (FORMAT XML) SELECT 1", SQLSTATE_SYNTAX_ERROR, 16},
+		{"EXPLAIN (COSTS) SELECT 1", SQLSTATE_SYNTAX_ERROR, 9},
+	}
+	for _, test := range tests {
+		_, err := Parse(test.query)
+		var sqlErr *Error
+		if !errors.As(err, &sqlErr) {
+			t.Errorf("Parse error: %q: expected an error but got %v", test.query, err)
+			continue
+		}
+		if sqlErr.Code != test.code || sqlErr.Pos != test.pos {
+			t.Errorf("Parse error: %q: expected %s at %d but got %s at %d: %v", test.query, test.code, test.pos, sqlErr.Code, sqlErr.Pos, sqlErr)
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package sql
+
+import (
+	"errors"
+	"strconv"
+
+	"github.com/misachi/DarDB/column"
+	"github.com/misachi/DarDB/storage/db"
+)
+
+/* Result is the outcome of a statement. Rows are only set for queries */
+type Result struct {
+	Columns      []ResultColumn
+	Rows         []Row
+	RowsAffected int64
+	Tag          string // The command tag PostgreSQL reports, like "INSERT 0 2"
+}
+
+/*
+Plan builds the operators that run a bound query or data change, for the default work memory.
+The FROM and WHERE of a statement are planned by the optimizer. Groups are built in a hash table
+unless ORDER BY asks for them in the order of their values.
+*/
+func Plan(stmt Stmt) (Operator, error) {
+	return newPlanner(DEFAULT_WORK_MEM).plan(stmt)
+}
+
+func (p *planner) plan(stmt Stmt) (Operator, error) {
+	switch s := stmt.(type) {
+	case *SelectStmt:
+		var op Operator = &Values{Rows: [][]Expr{{}}}
+		if s.From != nil {
+			var err error
+			if op, err = p.planFrom(s.From, s.Where); err != nil {
+				return nil, err
+			}
+		} else if s.Where != nil {
+			op = &Filter{Child: op, Pred: s.Where}
+		}
+		sorted := false
+		if s.Grouped {
+			op, sorted = planAggregate(s, op)
+			if s.Having != nil {
+				op = &Filter{Child: op, Pred: s.Having}
+			}
+		}
+		// Sort keys are computed from the input rows, so the rows are sorted before they are projected
+		if len(s.OrderBy) > 0 && !sorted {
+			op = &Sort{Child: op, Keys: s.OrderBy}
+		}
+		exprs := make([]Expr, len(s.Items))
+		for i, item := range s.Items {
+			exprs[i] = item.Expr
+		}
+		op = &Project{Child: op, Exprs: exprs}
+		if s.Limit != nil || s.Offset != nil {
+			op = &Limit{Child: op, Limit: s.Limit, Offset: s.Offset}
+		}
+		return op, nil
+	case *InsertStmt:
+		return &Insert{Table: s.Table.Table, Targets: s.Targets, Child: &Values{Rows: s.Rows}}, nil
+	case *UpdateStmt:
+		child, err := p.access(s.Table, conjuncts(s.Where))
+		if err != nil {
+			return nil, err
+		}
+		return &Update{Table: s.Table.Table, Set: s.Set, Child: child}, nil
+	case *DeleteStmt:
+		child, err := p.access(s.Table, conjuncts(s.Where))
+		if err != nil {
+			return nil, err
+		}
+		return &Delete{Table: s.Table.Table, Child: child}, nil
+	}
+	return nil, errorf(SQLSTATE_INTERNAL_ERROR, -1, "statement %T has no plan", stmt)
+}
+
+/*
+planAggregate groups the input rows. When ORDER BY only asks for group values, the input is sorted
+on the group values in that order and aggregated as it streams, which returns the groups in the
+order asked for; it reports true then, as the groups need no sorting.
+*/
+func planAggregate(s *SelectStmt, input Operator) (Operator, bool) {
+	if len(s.GroupBy) == 0 {
+		return &GroupAggregate{Child: input, Aggs: s.Aggregates}, false
+	}
+	keys, ok := groupOrder(s)
+	if !ok {
+		return &HashAggregate{Child: input, GroupBy: s.GroupBy, Aggs: s.Aggregates}, false
+	}
+	return &GroupAggregate{Child: &Sort{Child: input, Keys: keys}, GroupBy: s.GroupBy, Aggs: s.Aggregates}, true
+}
+
+/* groupOrder turns an ORDER BY of group values into sort keys over the input rows, followed by the other group values */
+func groupOrder(s *SelectStmt) ([]*OrderItem, bool) {
+	if len(s.OrderBy) == 0 {
+		return nil, false
+	}
+	keys := make([]*OrderItem, 0, len(s.GroupBy))
+	used := make([]bool, len(s.GroupBy))
+	for _, item := range s.OrderBy {
+		ref, ok := item.Expr.(*ColumnRef)
+		if !ok || ref.Index >= len(s.GroupBy) {
+			return nil, false
+		}
+		if !used[ref.Index] {
+			used[ref.Index] = true
+			keys = append(keys, &OrderItem{Expr: s.GroupBy[ref.Index], Desc: item.Desc, Nulls: item.Nulls})
+		}
+	}
+	for i, e := range s.GroupBy {
+		if !used[i] {
+			keys = append(keys, &OrderItem{Expr: e})
+		}
+	}
+	return keys, true
+}
+
+/*
+Execute runs a bound statement inside the current transaction of ctx, leaving it to the caller to
+commit. CREATE and DROP TABLE change the catalog straight away whatever becomes of the transaction.
+*/
+func Execute(ctx *db.ClientContext, database *db.DB, stmt Stmt) (*Result, error) {
+	switch s := stmt.(type) {
+	case *CreateTableStmt:
+		return createTable(database, s)
+	case *DropTableStmt:
+		return dropTable(database, s)
+	case *ExplainStmt:
+		return explain(ctx, s)
+	case *BeginStmt, *CommitStmt, *RollbackStmt:
+		return nil, errorf(SQLSTATE_INVALID_TRANSACTION, -1, "transaction control statements are handled by a Session")
+	}
+	op, err := newPlanner(workMem(ctx, 0)).plan(stmt)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := Run(ctx, op)
+	if err != nil {
+		return nil, err
+	}
+	return result(stmt, rows), nil
+}
+
+/* result describes the rows the plan of stmt returned: those of a query, or the count of a data change */
+func result(stmt Stmt, rows []Row) *Result {
+	switch s := stmt.(type) {
+	case *SelectStmt:
+		return &Result{Columns: s.Columns, Rows: rows, RowsAffected: int64(len(rows)), Tag: "SELECT " + strconv.Itoa(len(rows))}
+	case *InsertStmt:
+		n := rows[0][0].I
+		return &Result{RowsAffected: n, Tag: "INSERT 0 " + strconv.FormatInt(n, 10)}
+	case *UpdateStmt:
+		n := rows[0][0].I
+		return &Result{RowsAffected: n, Tag: "UPDATE " + strconv.FormatInt(n, 10)}
+	}
+	n := rows[0][0].I
+	return &Result{RowsAffected: n, Tag: "DELETE " + strconv.FormatInt(n, 10)}
+}
+
+func createTable(database *db.DB, s *CreateTableStmt) (*Result, error) {
+	if database.GetTable(s.Name) != nil {
+		if s.IfNotExists {
+			return &Result{Tag: "CREATE TABLE"}, nil
+		}
+		return nil, errorf(SQLSTATE_DUPLICATE_TABLE, s.Pos, "relation %q already exists", s.Name)
+	}
+	cols := make(map[string]column.SUPPORTED_TYPE, len(s.Columns))
+	names := make([]string, len(s.Columns))
+	var pkey column.Column
+	for i, def := range s.Columns {
+		cols[def.Name] = def.Type
+		names[i] = def.Name
+		if def.Name == s.PrimaryKey {
+			pkey = column.NewColumn(def.Name, def.Type)
+		}
+	}
+	if _, err := database.CreateTableWithOptions(s.Name, cols, pkey, db.TableOptions{Columns: names}); err != nil {
+		return nil, err
+	}
+	return &Result{Tag: "CREATE TABLE"}, nil
+}
+
+func dropTable(database *db.DB, s *DropTableStmt) (*Result, error) {
+	err := database.DropTable(s.Name)
+	switch {
+	case errors.Is(err, db.ErrTableNotFound):
+		if s.IfExists {
+			return &Result{Tag: "DROP TABLE"}, nil
+		}
+		return nil, errorf(SQLSTATE_UNDEFINED_TABLE, s.Pos, "table %q does not exist", s.Name)
+	case errors.Is(err, db.ErrTableInUse):
+		return nil, errorf(SQLSTATE_OBJECT_IN_USE, s.Pos, "cannot drop table %s because a running transaction is using it", s.Name)
+	case err != nil:
+		return nil, err
+	}
+	return &Result{Tag: "DROP TABLE"}, nil
+}
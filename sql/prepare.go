@@ -0,0 +1,252 @@
+package sql
+
+import (
+	"github.com/misachi/DarDB/storage/db"
+)
+
+/* MAX_PARAMS is the most parameters a statement can have, as in PostgreSQL */
+const MAX_PARAMS = 65535
+
+/* params are the parameters of a prepared statement: their kinds, decided as it is bound, and the values of the current run */
+type params struct {
+	kinds  []Kind
+	values []Value
+}
+
+func init() {
+	db.RegisterPreparer(func(ctx *db.ClientContext, query string) (db.Statement, error) {
+		ps, err := Prepare(ctx, query)
+		if err != nil {
+			return nil, err
+		}
+		return ps, nil
+	})
+}
+
+/*
+PreparedStmt is a statement parsed, bound and planned once to run many times. ClientContext.Prepare
+returns one. Its parameters, $1 to $n, take the types declared when it is prepared or else the
+types their uses ask for, and are text when nothing decides. The plan is kept until a table the
+statement refers to is dropped or created again, or the indexes change, and is then made afresh;
+the columns of the result must stay the same. Statements without a plan, like CREATE TABLE, are
+bound again every run. A PreparedStmt belongs to its client and is not safe for concurrent use.
+*/
+type PreparedStmt struct {
+	ctx     *db.ClientContext
+	db      *db.DB
+	query   string
+	params  *params
+	stmt    Stmt
+	columns []ResultColumn
+	plan    Operator             // Nil for statements without a plan
+	tables  map[string]*db.Table // The tables the plan reads, by name
+	version uint64               // Schema version of the database the tables were checked at
+	indexes uint64               // Index version of the database the plan was made at
+	closed  bool
+}
+
+/* Prepare prepares query for ctx. types declares the kinds of the first parameters; KIND_NULL leaves one to its uses */
+func Prepare(ctx *db.ClientContext, query string, types ...Kind) (*PreparedStmt, error) {
+	ps := &PreparedStmt{ctx: ctx, db: ctx.DB(), query: query, params: &params{kinds: append([]Kind{}, types...)}}
+	// Binding finds the kinds of the parameters; binding again gives every use of a parameter its kind
+	if _, err := ps.bind(); err != nil {
+		return nil, err
+	}
+	for i, kind := range ps.params.kinds {
+		if kind == KIND_NULL {
+			ps.params.kinds[i] = KIND_STRING
+		}
+	}
+	if err := ps.load(); err != nil {
+		return nil, err
+	}
+	return ps, nil
+}
+
+/* Query is the SQL text of the statement */
+func (ps *PreparedStmt) Query() string {
+	return ps.query
+}
+
+/* ParamTypes returns the kinds of the parameters, in order */
+func (ps *PreparedStmt) ParamTypes() []Kind {
+	return append([]Kind{}, ps.params.kinds...)
+}
+
+/* Columns describes the columns of the rows the statement returns, nil if it returns none */
+func (ps *PreparedStmt) Columns() []ResultColumn {
+	return ps.columns
+}
+
+/* Stmt is the parsed statement, to tell what kind of statement it is */
+func (ps *PreparedStmt) Stmt() Stmt {
+	return ps.stmt
+}
+
+/*
+Exec runs the statement with args as the values of its parameters, inside the current transaction
+of the client, leaving it to the caller to commit as Execute does. A text value is read as the
+kind of its parameter, so clients can send every value as text.
+*/
+func (ps *PreparedStmt) Exec(args ...Value) (*Result, error) {
+	if ps.closed {
+		return nil, errorf(SQLSTATE_INVALID_STATEMENT_NAME, -1, "prepared statement is closed")
+	}
+	if len(args) != len(ps.params.kinds) {
+		return nil, errorf(SQLSTATE_PROTOCOL_VIOLATION, -1, "bind message supplies %d parameters, but prepared statement requires %d", len(args), len(ps.params.kinds))
+	}
+	values := make([]Value, len(args))
+	for i, arg := range args {
+		v, err := paramValue(arg, ps.params.kinds[i], i)
+		if err != nil {
+			return nil, err
+		}
+		values[i] = v
+	}
+	ps.params.values = values
+	defer func() { ps.params.values = nil }()
+
+	if ps.plan == nil {
+		stmt, err := ps.bind()
+		if err != nil {
+			return nil, err
+		}
+		return Execute(ps.ctx, ps.db, stmt)
+	}
+	if err := ps.check(); err != nil {
+		return nil, err
+	}
+	rows, err := Run(ps.ctx, ps.plan)
+	if err != nil {
+		return nil, err
+	}
+	return result(ps.stmt, rows), nil
+}
+
+/* Close releases the plan. The statement cannot run after */
+func (ps *PreparedStmt) Close() {
+	ps.closed = true
+	ps.stmt, ps.plan, ps.tables = nil, nil, nil
+}
+
+/* bind parses and binds the query against the tables as they are now */
+func (ps *PreparedStmt) bind() (Stmt, error) {
+	stmt, err := Parse(ps.query)
+	if err != nil {
+		return nil, err
+	}
+	if err := bindParams(stmt, ps.db, ps.params); err != nil {
+		return nil, err
+	}
+	return stmt, nil
+}
+
+/* load binds and plans the statement, checking the columns of its result have not changed if it was loaded before */
+func (ps *PreparedStmt) load() error {
+	// Versions are read first, so a change made while planning is seen by the next check
+	version, indexes := ps.db.SchemaVersion(), ps.db.IndexVersion()
+	stmt, err := ps.bind()
+	if err != nil {
+		return err
+	}
+	columns := resultColumns(stmt)
+	if ps.stmt != nil && !sameColumns(ps.columns, columns) {
+		return errorf(SQLSTATE_FEATURE_UNSUPPORTED, -1, "cached plan must not change result type")
+	}
+	var plan Operator
+	var tables map[string]*db.Table
+	switch stmt.(type) {
+	case *SelectStmt, *InsertStmt, *UpdateStmt, *DeleteStmt:
+		if plan, err = newPlanner(workMem(ps.ctx, 0)).plan(stmt); err != nil {
+			return err
+		}
+		tables = tablesOf(stmt)
+	}
+	ps.stmt, ps.columns, ps.plan, ps.tables = stmt, columns, plan, tables
+	ps.version, ps.indexes = version, indexes
+	return nil
+}
+
+/* check plans the statement again if a table it reads was dropped or created again, or the indexes changed */
+func (ps *PreparedStmt) check() error {
+	version, indexes := ps.db.SchemaVersion(), ps.db.IndexVersion()
+	if indexes != ps.indexes {
+		return ps.load()
+	}
+	if version == ps.version {
+		return nil
+	}
+	for name, tbl := range ps.tables {
+		if ps.db.GetTable(name) != tbl {
+			return ps.load()
+		}
+	}
+	ps.version = version
+	return nil
+}
+
+/* resultColumns describes the rows stmt returns */
+func resultColumns(stmt Stmt) []ResultColumn {
+	switch s := stmt.(type) {
+	case *SelectStmt:
+		return s.Columns
+	case *ExplainStmt:
+		return explainColumns
+	}
+	return nil
+}
+
+func sameColumns(a, b []ResultColumn) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+/* tablesOf returns the tables a bound statement refers to, by name */
+func tablesOf(stmt Stmt) map[string]*db.Table {
+	tables := make(map[string]*db.Table)
+	var from func(t TableExpr)
+	from = func(t TableExpr) {
+		switch t := t.(type) {
+		case *TableRef:
+			tables[t.Name] = t.Table
+		case *JoinExpr:
+			from(t.Left)
+			from(t.Right)
+		}
+	}
+	switch s := stmt.(type) {
+	case *SelectStmt:
+		from(s.From)
+	case *InsertStmt:
+		from(s.Table)
+	case *UpdateStmt:
+		from(s.Table)
+	case *DeleteStmt:
+		from(s.Table)
+	}
+	return tables
+}
+
+/* paramValue converts the value of parameter i to its kind. Text is read as a quoted literal of that kind is */
+func paramValue(v Value, kind Kind, i int) (Value, error) {
+	switch {
+	case v.IsNull() || v.Kind == kind:
+		return v, nil
+	case v.Kind == KIND_STRING:
+		parsed, ok := parseValue(v.S, kind)
+		if !ok {
+			return v, errorf(SQLSTATE_INVALID_TEXT, -1, "invalid input syntax for type %s: %q", kind, v.S)
+		}
+		return parsed, nil
+	case kind.numeric() && v.Kind.numeric():
+		return Coerce(v, kindType(kind))
+	}
+	return v, errorf(SQLSTATE_DATATYPE_MISMATCH, -1, "parameter $%d is of type %s but the value is of type %s", i+1, kind, v.Kind)
+}
@@ -0,0 +1,142 @@
+package sql
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestPrepare(t *testing.T) {
+	s, ctx := testSession(t)
+	exec(t, s, "CREATE TABLE tickets (id int PRIMARY KEY, seat int, holder text)")
+	t.Cleanup(func() { s.Exec("DROP TABLE tickets") })
+	exec(t, s, "INSERT INTO tickets (id, seat, holder) VALUES (1, 10, 'ann'), (2, 20, 'bob'), (3, 30, NULL)")
+
+	prepare := func(query string, types ...Kind) *PreparedStmt {
+		ps, err := Prepare(ctx, query, types...)
+		if err != nil {
+			t.Fatalf("Prepare error: %s: %v", query, err)
+		}
+		return ps
+	}
+	run := func(ps *PreparedStmt, args ...Value) string {
+		r, err := s.ExecPrepared(ps, args...)
+		if err != nil {
+			t.Fatalf("ExecPrepared error: %s: %v", ps.Query(), err)
+		}
+		return rowsText(r.Rows)
+	}
+	failsWith := func(err error, code string) bool {
+		var sqlErr *Error
+		return errors.As(err, &sqlErr) && sqlErr.Code == code
+	}
+
+	stmt, err := ctx.Prepare("SELECT holder FROM tickets WHERE id = $1")
+	if err != nil {
+		t.Fatalf("Prepare error: %v", err)
+	}
+	byID, ok := stmt.(*PreparedStmt)
+	if !ok {
+		t.Fatalf("Prepare error: expected a *PreparedStmt but got %T", stmt)
+	}
+	plan := byID.plan
+	if got := run(byID, Int(2)); got != "bob" {
+		t.Errorf("Exec error: expected bob but got %s", got)
+	}
+	if got := run(byID, String("1")); got != "ann" {
+		t.Errorf("Exec error: expected a text parameter read as an integer but got %s", got)
+	}
+	if byID.plan != plan {
+		t.Errorf("Exec error: expected the plan to be kept between runs")
+	}
+	if _, err := byID.Exec(); !failsWith(err, SQLSTATE_PROTOCOL_VIOLATION) {
+		t.Errorf("Exec error: expected %s for a missing parameter but got %v", SQLSTATE_PROTOCOL_VIOLATION, err)
+	}
+	if _, err := byID.Exec(String("one")); !failsWith(err, SQLSTATE_INVALID_TEXT) {
+		t.Errorf("Exec error: expected %s for a bad value but got %v", SQLSTATE_INVALID_TEXT, err)
+	}
+	execError(t, s, "SELECT holder FROM tickets WHERE id = $1", SQLSTATE_UNDEFINED_PARAMETER)
+
+	tests := []struct {
+		query    string
+		types    []Kind
+		expected []Kind
+		args     []Value
+		rows     string
+	}{
+		{"SELECT $1", nil, []Kind{KIND_STRING}, []Value{String("x")}, "x"},
+		{"SELECT $1", []Kind{KIND_INT}, []Kind{KIND_INT}, []Value{String("7")}, "7"},
+		{"SELECT count(*) FROM tickets WHERE seat > $1 LIMIT $2", nil, []Kind{KIND_INT, KIND_INT}, []Value{Int(15), Int(1)}, "2"},
+		{"SELECT id FROM tickets WHERE $1 IS NULL OR id = $1 ORDER BY id", nil, []Kind{KIND_INT}, []Value{Null()}, "1\n2\n3"},
+		{"SELECT id FROM tickets WHERE holder LIKE $1 OR seat BETWEEN -$2 AND $3", nil, []Kind{KIND_STRING, KIND_FLOAT, KIND_INT}, []Value{String("a%"), Float(1), Int(0)}, "1"},
+		{"SELECT id FROM tickets WHERE id IN ($2, $3)", nil, []Kind{KIND_STRING, KIND_INT, KIND_INT}, []Value{Null(), Int(3), Int(9)}, "3"},
+	}
+	for _, test := range tests {
+		ps := prepare(test.query, test.types...)
+		kinds := ps.ParamTypes()
+		if len(kinds) != len(test.expected) {
+			t.Errorf("Prepare error: %s: expected parameters %v but got %v", test.query, test.expected, kinds)
+			continue
+		}
+		for i := range kinds {
+			if kinds[i] != test.expected[i] {
+				t.Errorf("Prepare error: %s: expected parameters %v but got %v", test.query, test.expected, kinds)
+			}
+		}
+		if got := run(ps, test.args...); got != test.rows {
+			t.Errorf("Exec error: %s: expected\n%s\nbut got\n%s", test.query, test.rows, got)
+		}
+	}
+	if cols := prepare("SELECT $1", KIND_INT).Columns(); cols[0].Kind != KIND_INT {
+		t.Errorf("Prepare error: expected a declared parameter to type the column but got %s", cols[0].Kind)
+	}
+
+	// Data changes commit as statements of the session do
+	insert := prepare("INSERT INTO tickets (id, seat, holder) VALUES ($1, $2, $3)")
+	update := prepare("UPDATE tickets SET holder = $2 WHERE id = $1")
+	run(insert, Int(4), Int(40), String("dan"))
+	run(update, Int(4), String("eve"))
+	if got := run(byID, Int(4)); got != "eve" {
+		t.Errorf("Exec error: expected the prepared changes but got %s", got)
+	}
+	if _, err := insert.Exec(Int(5), String("x"), Null()); !failsWith(err, SQLSTATE_INVALID_TEXT) {
+		t.Errorf("Exec error: expected a text value that is not a number to fail but got %v", err)
+	}
+	ctx.Rollback()
+	explain := prepare("EXPLAIN SELECT holder FROM tickets WHERE id = $1")
+	if cols := explain.Columns(); len(cols) != 1 || cols[0].Name != "QUERY PLAN" || run(explain, Int(1)) == "" {
+		t.Errorf("Prepare error: expected EXPLAIN to be prepared with its parameters")
+	}
+
+	// Creating an index plans the statement again, so it can use the index
+	tickets := testDB(t).GetTable("tickets")
+	if err := testDB(t).CreateIndex(tickets, "seat"); err != nil {
+		t.Fatalf("CreateIndex error: %v", err)
+	}
+	if run(byID, Int(1)); byID.plan == plan {
+		t.Errorf("Exec error: expected a new plan once the indexes changed")
+	}
+	if err := testDB(t).DropIndex(tickets, "seat"); err != nil {
+		t.Fatalf("DropIndex error: %v", err)
+	}
+
+	// Dropping the table makes the statement fail until the table is created again
+	exec(t, s, "DROP TABLE tickets")
+	if _, err := byID.Exec(Int(1)); !failsWith(err, SQLSTATE_UNDEFINED_TABLE) {
+		t.Errorf("Exec error: expected %s for a dropped table but got %v", SQLSTATE_UNDEFINED_TABLE, err)
+	}
+	exec(t, s, "CREATE TABLE tickets (id int PRIMARY KEY, seat int, holder text)")
+	exec(t, s, "INSERT INTO tickets (id, seat, holder) VALUES (1, 1, 'fay')")
+	if got := run(byID, Int(1)); got != "fay" {
+		t.Errorf("Exec error: expected the new table to be read but got %s", got)
+	}
+	exec(t, s, "DROP TABLE tickets")
+	exec(t, s, "CREATE TABLE tickets (id int PRIMARY KEY, seat int, holder int)")
+	if _, err := byID.Exec(Int(1)); !failsWith(err, SQLSTATE_FEATURE_UNSUPPORTED) {
+		t.Errorf("Exec error: expected a changed result type to fail but got %v", err)
+	}
+
+	byID.Close()
+	if _, err := byID.Exec(Int(1)); !failsWith(err, SQLSTATE_INVALID_STATEMENT_NAME) {
+		t.Errorf("Exec error: expected a closed statement to fail but got %v", err)
+	}
+}
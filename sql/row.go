@@ -0,0 +1,82 @@
+package sql
+
+import (
+	"strconv"
+
+	"github.com/misachi/DarDB/column"
+)
+
+/* Row is a row of typed values flowing between operators */
+type Row []Value
+
+/* STRING_ESCAPE marks an empty string, which storage would otherwise read back as NULL */
+const STRING_ESCAPE = 0x00
+
+/*
+encodeValue converts v to the bytes a column of type typ stores, failing if the column cannot hold
+it. Values are stored as text; an empty value is NULL, so strings that are empty or start with the
+escape byte get an escape byte in front.
+*/
+func encodeValue(v Value, typ column.SUPPORTED_TYPE) ([]byte, error) {
+	v, err := Coerce(v, typ)
+	if err != nil || v.IsNull() {
+		return nil, err
+	}
+	switch v.Kind {
+	case KIND_STRING:
+		if len(v.S) == 0 || v.S[0] == STRING_ESCAPE {
+			return append([]byte{STRING_ESCAPE}, v.S...), nil
+		}
+		return []byte(v.S), nil
+	case KIND_FLOAT:
+		if typ == column.FLOAT32 {
+			return strconv.AppendFloat(nil, v.F, 'g', -1, 32), nil
+		}
+		return strconv.AppendFloat(nil, v.F, 'g', -1, 64), nil
+	}
+	return []byte(v.String()), nil
+}
+
+/* decodeValue reads a value stored in a column of type typ. Nil is NULL */
+func decodeValue(data []byte, typ column.SUPPORTED_TYPE) (Value, error) {
+	if data == nil {
+		return Null(), nil
+	}
+	kind := KindOf(typ)
+	if kind == KIND_STRING {
+		if len(data) > 0 && data[0] == STRING_ESCAPE {
+			data = data[1:]
+		}
+		return String(string(data)), nil
+	}
+	if typ == column.FLOAT32 {
+		// Read back the float32 that was stored rather than the float64 nearest its text
+		f, err := strconv.ParseFloat(string(data), 32)
+		if err != nil {
+			return Null(), errorf(SQLSTATE_INTERNAL_ERROR, -1, "invalid stored value %q for type %s", data, TypeName(typ))
+		}
+		return Float(f), nil
+	}
+	value, ok := parseValue(string(data), kind)
+	if !ok {
+		return Null(), errorf(SQLSTATE_INTERNAL_ERROR, -1, "invalid stored value %q for type %s", data, TypeName(typ))
+	}
+	return value, nil
+}
+
+/* decodeRow reads the stored values of the columns of a table */
+func decodeRow(values [][]byte, cols []column.Column) (Row, error) {
+	r := make(Row, len(cols))
+	for i, col := range cols {
+		var data []byte
+		if i < len(values) {
+			data = values[i]
+		}
+		v, err := decodeValue(data, col.Type)
+		if err != nil {
+			return nil, err
+		}
+		r[i] = v
+	}
+	return r, nil
+}
@@ -0,0 +1,108 @@
+package sql
+
+import (
+	"github.com/misachi/DarDB/storage/db"
+)
+
+/*
+Session runs SQL text for a client. Each statement commits on its own unless it runs between BEGIN
+and COMMIT. A statement that fails rolls back its transaction, so a failed transaction block
+ignores statements until it is ended with COMMIT or ROLLBACK, as in PostgreSQL.
+*/
+type Session struct {
+	db      *db.DB
+	ctx     *db.ClientContext
+	inBlock bool // Between BEGIN and COMMIT or ROLLBACK
+	failed  bool // The transaction block hit an error and was rolled back
+}
+
+func NewSession(database *db.DB, ctx *db.ClientContext) *Session {
+	return &Session{db: database, ctx: ctx}
+}
+
+/* InTransaction reports whether the session is inside a transaction block, and whether that block failed */
+func (s *Session) InTransaction() (bool, bool) {
+	return s.inBlock, s.failed
+}
+
+/* Exec runs the statements of query in order, stopping at the first that fails */
+func (s *Session) Exec(query string) ([]*Result, error) {
+	stmts, err := ParseAll(query)
+	if err != nil {
+		return nil, err
+	}
+	results := make([]*Result, 0, len(stmts))
+	for _, stmt := range stmts {
+		result, err := s.ExecStmt(stmt)
+		if err != nil {
+			return results, err
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+/* ExecStmt binds and runs a parsed statement */
+func (s *Session) ExecStmt(stmt Stmt) (*Result, error) {
+	return s.exec(stmt, func() (*Result, error) { return s.run(stmt) })
+}
+
+/* ExecPrepared runs a statement the session's client prepared, with args as its parameters */
+func (s *Session) ExecPrepared(ps *PreparedStmt, args ...Value) (*Result, error) {
+	if ps.ctx != s.ctx {
+		return nil, errorf(SQLSTATE_INVALID_STATEMENT_NAME, -1, "prepared statement belongs to another client")
+	}
+	return s.exec(ps.stmt, func() (*Result, error) { return ps.Exec(args...) })
+}
+
+/* exec runs a statement with run, in a transaction of its own unless inside a transaction block */
+func (s *Session) exec(stmt Stmt, run func() (*Result, error)) (*Result, error) {
+	switch stmt.(type) {
+	case *BeginStmt:
+		if !s.inBlock {
+			s.inBlock, s.failed = true, false
+		}
+		return &Result{Tag: "BEGIN"}, nil
+	case *CommitStmt:
+		if s.failed {
+			return s.end("ROLLBACK", s.ctx.Rollback)
+		}
+		return s.end("COMMIT", s.ctx.Commit)
+	case *RollbackStmt:
+		return s.end("ROLLBACK", s.ctx.Rollback)
+	}
+	if s.failed {
+		return nil, errorf(SQLSTATE_FAILED_TRANSACTION, -1, "current transaction is aborted, commands ignored until end of transaction block")
+	}
+
+	result, err := run()
+	if err != nil {
+		if rbErr := s.ctx.Rollback(); rbErr != nil {
+			return nil, rbErr
+		}
+		s.failed = s.inBlock
+		return nil, err
+	}
+	if !s.inBlock {
+		if err := s.ctx.Commit(); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+func (s *Session) run(stmt Stmt) (*Result, error) {
+	if err := Bind(stmt, s.db); err != nil {
+		return nil, err
+	}
+	return Execute(s.ctx, s.db, stmt)
+}
+
+/* end finishes the transaction block with commit or rollback */
+func (s *Session) end(tag string, finish func() error) (*Result, error) {
+	s.inBlock, s.failed = false, false
+	if err := finish(); err != nil {
+		return nil, err
+	}
+	return &Result{Tag: tag}, nil
+}
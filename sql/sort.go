@@ -0,0 +1,307 @@
+package sql
+
+import (
+	"container/heap"
+	"sort"
+
+	"github.com/misachi/DarDB/storage/db"
+)
+
+const MAX_MERGE_RUNS = 64 // Runs merged at once; more are merged in passes
+
+/*
+Sort returns the rows of its child ordered by Keys. Rows are sorted in memory while they fit in
+WorkMem and with an external merge sort past it. Rows with equal keys keep their input order.
+*/
+type Sort struct {
+	Child   Operator
+	Keys    []*OrderItem
+	WorkMem int64 // Zero uses the config
+
+	sorter *sorter
+}
+
+func (s *Sort) Open(ctx *db.ClientContext) error {
+	if err := s.Child.Open(ctx); err != nil {
+		return err
+	}
+	s.sorter = newSorter(ctx, s.Keys, workMem(ctx, s.WorkMem))
+	for {
+		r, err := s.Child.Next()
+		if err != nil {
+			return err
+		}
+		if r == nil {
+			break
+		}
+		if err := s.sorter.add(r); err != nil {
+			return err
+		}
+	}
+	return s.sorter.sort()
+}
+
+func (s *Sort) Next() (Row, error) {
+	return s.sorter.next()
+}
+
+func (s *Sort) Close() error {
+	if s.sorter != nil {
+		s.sorter.close()
+		s.sorter = nil
+	}
+	return s.Child.Close()
+}
+
+/* compareKeys orders two rows of sort key values */
+func compareKeys(a, b Row, keys []*OrderItem) int {
+	for i, key := range keys {
+		cmp := 0
+		switch {
+		case a[i].IsNull() && b[i].IsNull():
+		case a[i].IsNull():
+			cmp = 1
+			if key.NullsFirst() {
+				cmp = -1
+			}
+		case b[i].IsNull():
+			cmp = -1
+			if key.NullsFirst() {
+				cmp = 1
+			}
+		default:
+			cmp = compare(a[i], b[i])
+			if key.Desc {
+				cmp = -cmp
+			}
+		}
+		if cmp != 0 {
+			return cmp
+		}
+	}
+	return 0
+}
+
+/* sortRow is a row with the values of its sort keys */
+type sortRow struct {
+	keys, row Row
+}
+
+/*
+sorter orders rows by keys, for ORDER BY, the inputs of merge joins and grouping, and index
+builds. Rows are held in memory up to mem bytes; past that, the rows held are sorted and written
+to a temp file as a run, each row after its key values, and once every row is added the runs are
+merged. Rows with equal keys come out in the order they were added.
+*/
+type sorter struct {
+	ctx     *db.ClientContext
+	keys    []*OrderItem
+	mem     int64
+	size    int64
+	rows    []sortRow
+	pos     int
+	runs    []*spillFile // In the order their rows were added
+	merger  *runMerger
+	spilled int // Runs written, for tests and EXPLAIN
+}
+
+func newSorter(ctx *db.ClientContext, keys []*OrderItem, mem int64) *sorter {
+	return &sorter{ctx: ctx, keys: keys, mem: mem}
+}
+
+func (s *sorter) add(r Row) error {
+	keys := make(Row, len(s.keys))
+	for i, key := range s.keys {
+		var err error
+		if keys[i], err = Eval(key.Expr, r); err != nil {
+			return err
+		}
+	}
+	s.rows = append(s.rows, sortRow{keys: keys, row: r})
+	s.size += rowSize(keys) + rowSize(r)
+	if s.size <= s.mem {
+		return nil
+	}
+	return s.writeRun()
+}
+
+func (s *sorter) sortRows() {
+	sort.SliceStable(s.rows, func(i, j int) bool {
+		return compareKeys(s.rows[i].keys, s.rows[j].keys, s.keys) < 0
+	})
+}
+
+/* writeRun sorts the rows held and writes them to a new run */
+func (s *sorter) writeRun() error {
+	s.sortRows()
+	run, err := newSpillFile(s.ctx)
+	if err != nil {
+		return err
+	}
+	s.runs = append(s.runs, run)
+	s.spilled++
+	for _, r := range s.rows {
+		if err := run.write(append(r.keys, r.row...)); err != nil {
+			return err
+		}
+	}
+	s.rows, s.size = nil, 0
+	return nil
+}
+
+/* sort ends the input and gets the rows ready to be read in order */
+func (s *sorter) sort() error {
+	s.pos = 0
+	if len(s.runs) == 0 {
+		s.sortRows()
+		return nil
+	}
+	if len(s.rows) > 0 {
+		if err := s.writeRun(); err != nil {
+			return err
+		}
+	}
+	// The first runs are merged into one that takes their place, so rows with equal keys stay in order
+	for len(s.runs) > MAX_MERGE_RUNS {
+		merged, err := s.mergeRuns(s.runs[:MAX_MERGE_RUNS])
+		if err != nil {
+			return err
+		}
+		s.runs = append([]*spillFile{merged}, s.runs[MAX_MERGE_RUNS:]...)
+	}
+	var err error
+	s.merger, err = newRunMerger(s.runs, s.keys)
+	return err
+}
+
+/* mergeRuns merges runs into a new run, closing them */
+func (s *sorter) mergeRuns(runs []*spillFile) (*spillFile, error) {
+	merger, err := newRunMerger(runs, s.keys)
+	if err != nil {
+		return nil, err
+	}
+	out, err := newSpillFile(s.ctx)
+	if err != nil {
+		return nil, err
+	}
+	s.spilled++
+	for {
+		r, err := merger.next()
+		if err == nil && r == nil {
+			break
+		}
+		if err == nil {
+			err = out.write(r)
+		}
+		if err != nil {
+			out.close()
+			return nil, err
+		}
+	}
+	for _, run := range runs {
+		run.close()
+	}
+	return out, nil
+}
+
+/* next returns the next row in order, nil after the last */
+func (s *sorter) next() (Row, error) {
+	if s.merger != nil {
+		r, err := s.merger.next()
+		if err != nil || r == nil {
+			return nil, err
+		}
+		return r[len(s.keys):], nil
+	}
+	if s.pos >= len(s.rows) {
+		return nil, nil
+	}
+	r := s.rows[s.pos].row
+	s.rows[s.pos] = sortRow{}
+	s.pos++
+	return r, nil
+}
+
+func (s *sorter) close() {
+	for _, run := range s.runs {
+		run.close()
+	}
+	s.runs, s.rows, s.merger = nil, nil, nil
+}
+
+/*
+runMerger merges sorted runs, whose rows start with their key values, by keeping the next row of
+every run in a heap. Of rows with equal keys, the one of the earliest run comes first.
+*/
+type runMerger struct {
+	runs  []*spillFile
+	heads mergeHeap
+}
+
+type mergeHead struct {
+	row Row
+	run int
+}
+
+type mergeHeap struct {
+	heads []mergeHead
+	keys  []*OrderItem
+}
+
+func (h *mergeHeap) Len() int { return len(h.heads) }
+
+func (h *mergeHeap) Less(i, j int) bool {
+	a, b := h.heads[i], h.heads[j]
+	if cmp := compareKeys(a.row, b.row, h.keys); cmp != 0 {
+		return cmp < 0
+	}
+	return a.run < b.run
+}
+
+func (h *mergeHeap) Swap(i, j int) { h.heads[i], h.heads[j] = h.heads[j], h.heads[i] }
+
+func (h *mergeHeap) Push(x any) { h.heads = append(h.heads, x.(mergeHead)) }
+
+func (h *mergeHeap) Pop() any {
+	last := h.heads[len(h.heads)-1]
+	h.heads = h.heads[:len(h.heads)-1]
+	return last
+}
+
+func newRunMerger(runs []*spillFile, keys []*OrderItem) (*runMerger, error) {
+	m := &runMerger{runs: runs, heads: mergeHeap{keys: keys}}
+	for i, run := range runs {
+		if err := run.rewind(); err != nil {
+			return nil, err
+		}
+		r, err := run.read()
+		if err != nil {
+			return nil, err
+		}
+		if r != nil {
+			m.heads.heads = append(m.heads.heads, mergeHead{row: r, run: i})
+		}
+	}
+	heap.Init(&m.heads)
+	return m, nil
+}
+
+/* next returns the least row of the runs, nil once they are all read */
+func (m *runMerger) next() (Row, error) {
+	if m.heads.Len() == 0 {
+		return nil, nil
+	}
+	head := &m.heads.heads[0]
+	r := head.row
+	next, err := m.runs[head.run].read()
+	if err != nil {
+		return nil, err
+	}
+	if next == nil {
+		heap.Pop(&m.heads)
+	} else {
+		head.row = next
+		heap.Fix(&m.heads, 0)
+	}
+	return r, nil
+}
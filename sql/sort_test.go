@@ -0,0 +1,110 @@
+package sql
+
+import (
+	"path"
+	"testing"
+
+	"github.com/misachi/DarDB/storage/db"
+)
+
+func TestExternalSort(t *testing.T) {
+	_, ctx := testSession(t)
+	var rows []Row
+	for i := 0; i < 2000; i++ {
+		// Few distinct keys, so the order of rows with equal keys shows
+		a := Int(int64(i*7919) % 13)
+		if i%11 == 0 {
+			a = Null()
+		}
+		rows = append(rows, Row{a, String(string(rune('a' + i*31%26))), Int(int64(i))})
+	}
+	orders := [][]*OrderItem{
+		{{Expr: col(0)}, {Expr: col(1), Desc: true}},
+		{{Expr: col(0), Desc: true, Nulls: NULLS_LAST}, {Expr: col(1)}},
+		{{Expr: col(0), Nulls: NULLS_FIRST}},
+	}
+	for _, keys := range orders {
+		inMemory := &Sort{Child: valuesOf(rows...), Keys: keys}
+		expected, err := Run(ctx, inMemory)
+		if err != nil {
+			t.Fatalf("Sort error: %v", err)
+		}
+		external := &Sort{Child: valuesOf(rows...), Keys: keys, WorkMem: 4096}
+		if err := external.Open(ctx); err != nil {
+			t.Fatalf("Sort error: %v", err)
+		}
+		if external.sorter.spilled <= MAX_MERGE_RUNS {
+			t.Errorf("Sort error: expected more runs than are merged at once but got %d", external.sorter.spilled)
+		}
+		var got []Row
+		for {
+			r, err := external.Next()
+			if err != nil {
+				t.Fatalf("Sort error: %v", err)
+			}
+			if r == nil {
+				break
+			}
+			got = append(got, r)
+		}
+		if err := external.Close(); err != nil {
+			t.Fatalf("Sort error: %v", err)
+		}
+		if rowsText(got) != rowsText(expected) {
+			t.Errorf("Sort error: external sort differs from the sort in memory")
+		}
+
+		keyOf := func(r Row) Row {
+			values := make(Row, len(keys))
+			for i, key := range keys {
+				values[i], _ = Eval(key.Expr, r)
+			}
+			return values
+		}
+		for i := 1; i < len(got); i++ {
+			prev, r := got[i-1], got[i]
+			// Rows with equal keys keep their input order, which the third column counts
+			cmp := compareKeys(keyOf(prev), keyOf(r), keys)
+			if cmp > 0 || cmp == 0 && prev[2].I > r[2].I {
+				t.Fatalf("Sort error: row %s before row %s", rowsText([]Row{prev}), rowsText([]Row{r}))
+			}
+		}
+		if keys[0].NullsFirst() != got[0][0].IsNull() {
+			t.Errorf("Sort error: expected NULLS FIRST %v but the first row is %s", keys[0].NullsFirst(), rowsText(got[:1]))
+		}
+	}
+
+	files, err := testDBCfg.FS().ReadDir(path.Join(testDBCfg.DataPath(), db.TEMP_DIR))
+	if err != nil {
+		t.Fatalf("ReadDir error: %v", err)
+	}
+	if len(files) != 0 {
+		t.Errorf("Sort error: %d temp files left", len(files))
+	}
+}
+
+func TestOrderBySpill(t *testing.T) {
+	s, _ := testSession(t)
+	exec(t, s, "CREATE TABLE events (id int PRIMARY KEY, kind text, score double)")
+	exec(t, s, "INSERT INTO events (id, kind, score) VALUES (1, 'b', 2.5), (2, 'a', NULL), (3, 'b', 1), (4, NULL, 2.5), (5, 'a', 0)")
+	t.Cleanup(func() { s.Exec("DROP TABLE events") })
+
+	// A config whose WorkMem is less than a row spills every row to its own run
+	testDBCfg.SetWorkMem(1)
+	defer testDBCfg.SetWorkMem(0)
+	tests := []struct {
+		query    string
+		expected string
+	}{
+		{"SELECT id FROM events ORDER BY kind, score DESC", "2\n5\n1\n3\n4"},
+		{"SELECT id FROM events ORDER BY kind DESC NULLS LAST, score NULLS FIRST", "3\n1\n2\n5\n4"},
+		{"SELECT id FROM events ORDER BY score, id DESC LIMIT 3", "5\n3\n4"},
+		{"SELECT kind, count(*) FROM events GROUP BY kind ORDER BY kind NULLS FIRST", "NULL|1\na|2\nb|2"},
+	}
+	for _, test := range tests {
+		r := exec(t, s, test.query)
+		if got := rowsText(r.Rows); got != test.expected {
+			t.Errorf("Exec error: %s: expected\n%s\nbut got\n%s", test.query, test.expected, got)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package sql
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+
+	"github.com/misachi/DarDB/storage/db"
+)
+
+/* DEFAULT_WORK_MEM is the memory a sort or hash table may use when the config does not set it */
+const DEFAULT_WORK_MEM = 4 << 20
+
+/* workMem is the memory budget of an operator: its own setting, else the config's, else the default */
+func workMem(ctx *db.ClientContext, own int64) int64 {
+	if own > 0 {
+		return own
+	}
+	if cfg := ctx.Config(); cfg != nil && cfg.WorkMem() > 0 {
+		return cfg.WorkMem()
+	}
+	return DEFAULT_WORK_MEM
+}
+
+/* rowSize estimates the memory a row takes */
+func rowSize(r Row) int64 {
+	size := int64(24 + 56*len(r))
+	for _, v := range r {
+		size += int64(len(v.S))
+	}
+	return size
+}
+
+/*
+spillFile holds rows written to a temp file. Each row is its number of values followed by the
+values, each a kind byte and then its data.
+*/
+type spillFile struct {
+	file   *db.TempFile
+	writer *bufio.Writer
+	reader *bufio.Reader
+	rows   int64
+	buf    []byte
+}
+
+func newSpillFile(ctx *db.ClientContext) (*spillFile, error) {
+	file, err := ctx.CreateTempFile()
+	if err != nil {
+		return nil, err
+	}
+	return &spillFile{file: file, writer: bufio.NewWriter(file)}, nil
+}
+
+func (f *spillFile) write(r Row) error {
+	buf := binary.AppendUvarint(f.buf[:0], uint64(len(r)))
+	for _, v := range r {
+		buf = append(buf, byte(v.Kind))
+		switch v.Kind {
+		case KIND_BOOL:
+			if v.B {
+				buf = append(buf, 1)
+			} else {
+				buf = append(buf, 0)
+			}
+		case KIND_INT:
+			buf = binary.LittleEndian.AppendUint64(buf, uint64(v.I))
+		case KIND_UINT:
+			buf = binary.LittleEndian.AppendUint64(buf, v.U)
+		case KIND_FLOAT:
+			buf = binary.LittleEndian.AppendUint64(buf, math.Float64bits(v.F))
+		case KIND_STRING:
+			buf = binary.AppendUvarint(buf, uint64(len(v.S)))
+			buf = append(buf, v.S...)
+		}
+	}
+	f.buf = buf
+	f.rows++
+	_, err := f.writer.Write(buf)
+	return err
+}
+
+/* rewind finishes writing and starts reading the rows from the first */
+func (f *spillFile) rewind() error {
+	if err := f.writer.Flush(); err != nil {
+		return err
+	}
+	if err := f.file.Rewind(); err != nil {
+		return err
+	}
+	f.reader = bufio.NewReader(f.file)
+	return nil
+}
+
+/* read returns the next row, nil after the last */
+func (f *spillFile) read() (Row, error) {
+	n, err := binary.ReadUvarint(f.reader)
+	if errors.Is(err, io.EOF) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	r := make(Row, n)
+	var word [8]byte
+	for i := range r {
+		kind, err := f.reader.ReadByte()
+		if err != nil {
+			return nil, spillError(err)
+		}
+		switch Kind(kind) {
+		case KIND_NULL:
+			r[i] = Null()
+		case KIND_BOOL:
+			b, err := f.reader.ReadByte()
+			if err != nil {
+				return nil, spillError(err)
+			}
+			r[i] = Bool(b == 1)
+		case KIND_INT, KIND_UINT, KIND_FLOAT:
+			if _, err := io.ReadFull(f.reader, word[:]); err != nil {
+				return nil, spillError(err)
+			}
+			bits := binary.LittleEndian.Uint64(word[:])
+			switch Kind(kind) {
+			case KIND_INT:
+				r[i] = Int(int64(bits))
+			case KIND_UINT:
+				r[i] = Uint(bits)
+			default:
+				r[i] = Float(math.Float64frombits(bits))
+			}
+		case KIND_STRING:
+			size, err := binary.ReadUvarint(f.reader)
+			if err != nil {
+				return nil, spillError(err)
+			}
+			data := make([]byte, size)
+			if _, err := io.ReadFull(f.reader, data); err != nil {
+				return nil, spillError(err)
+			}
+			r[i] = String(string(data))
+		default:
+			return nil, errorf(SQLSTATE_INTERNAL_ERROR, -1, "spilled row has a value of kind %d", kind)
+		}
+	}
+	return r, nil
+}
+
+func spillError(err error) error {
+	if errors.Is(err, io.EOF) {
+		return errorf(SQLSTATE_INTERNAL_ERROR, -1, "spilled row is truncated")
+	}
+	return err
+}
+
+func (f *spillFile) close() error {
+	return f.file.Close()
+}
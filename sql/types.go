@@ -0,0 +1,261 @@
+package sql
+
+import (
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/misachi/DarDB/column"
+)
+
+/* Kind is the type of a value while a statement runs. Every column type maps onto one */
+type Kind int
+
+const (
+	KIND_NULL Kind = iota // The type of a NULL literal, which fits any column
+	KIND_BOOL
+	KIND_INT
+	KIND_UINT
+	KIND_FLOAT
+	KIND_STRING
+)
+
+func (k Kind) String() string {
+	switch k {
+	case KIND_NULL:
+		return "unknown"
+	case KIND_BOOL:
+		return "boolean"
+	case KIND_INT:
+		return "integer"
+	case KIND_UINT:
+		return "unsigned integer"
+	case KIND_FLOAT:
+		return "float"
+	case KIND_STRING:
+		return "text"
+	}
+	return "kind " + strconv.Itoa(int(k))
+}
+
+func (k Kind) numeric() bool {
+	return k == KIND_INT || k == KIND_UINT || k == KIND_FLOAT
+}
+
+/* KindOf is the kind of the values of a column of type typ */
+func KindOf(typ column.SUPPORTED_TYPE) Kind {
+	switch typ {
+	case column.UINT, column.UINT8, column.UINT16, column.UINT32, column.UINT64:
+		return KIND_UINT
+	case column.FLOAT32, column.FLOAT64:
+		return KIND_FLOAT
+	case column.STRING:
+		return KIND_STRING
+	}
+	return KIND_INT
+}
+
+/*
+typeNames maps SQL type names onto column types. The standard names keep their usual sizes;
+intN, uintN and floatN count bits, as the column types do.
+*/
+var typeNames = map[string]column.SUPPORTED_TYPE{
+	"tinyint":  column.INT8,
+	"smallint": column.INT16,
+	"int":      column.INT,
+	"integer":  column.INT,
+	"bigint":   column.INT64,
+	"int8":     column.INT8,
+	"int16":    column.INT16,
+	"int32":    column.INT32,
+	"int64":    column.INT64,
+	"uint":     column.UINT,
+	"uint8":    column.UINT8,
+	"uint16":   column.UINT16,
+	"uint32":   column.UINT32,
+	"uint64":   column.UINT64,
+	"real":     column.FLOAT32,
+	"float32":  column.FLOAT32,
+	"float":    column.FLOAT64,
+	"float64":  column.FLOAT64,
+	"double":   column.FLOAT64,
+	"text":     column.STRING,
+	"string":   column.STRING,
+	"varchar":  column.STRING,
+	"char":     column.STRING,
+}
+
+/* TypeName is the SQL name of a column type */
+func TypeName(typ column.SUPPORTED_TYPE) string {
+	switch typ {
+	case column.INT8:
+		return "tinyint"
+	case column.INT16:
+		return "smallint"
+	case column.INT, column.INT32:
+		return "integer"
+	case column.INT64:
+		return "bigint"
+	case column.UINT8:
+		return "uint8"
+	case column.UINT16:
+		return "uint16"
+	case column.UINT, column.UINT32:
+		return "uint32"
+	case column.UINT64:
+		return "uint64"
+	case column.FLOAT32:
+		return "real"
+	case column.FLOAT64:
+		return "double"
+	}
+	return "text"
+}
+
+/* Value is a typed value of a row. Only the field of its kind is set */
+type Value struct {
+	Kind Kind
+	B    bool
+	I    int64
+	U    uint64
+	F    float64
+	S    string
+}
+
+func Null() Value               { return Value{Kind: KIND_NULL} }
+func Bool(b bool) Value         { return Value{Kind: KIND_BOOL, B: b} }
+func Int(i int64) Value         { return Value{Kind: KIND_INT, I: i} }
+func Uint(u uint64) Value       { return Value{Kind: KIND_UINT, U: u} }
+func Float(f float64) Value     { return Value{Kind: KIND_FLOAT, F: f} }
+func String(s string) Value     { return Value{Kind: KIND_STRING, S: s} }
+func (v Value) IsNull() bool    { return v.Kind == KIND_NULL }
+func (v Value) isNumeric() bool { return v.Kind.numeric() }
+
+/* String formats the value as psql shows it; NULL is empty */
+func (v Value) String() string {
+	switch v.Kind {
+	case KIND_BOOL:
+		if v.B {
+			return "t"
+		}
+		return "f"
+	case KIND_INT:
+		return strconv.FormatInt(v.I, 10)
+	case KIND_UINT:
+		return strconv.FormatUint(v.U, 10)
+	case KIND_FLOAT:
+		return strconv.FormatFloat(v.F, 'g', -1, 64)
+	case KIND_STRING:
+		return v.S
+	}
+	return ""
+}
+
+/* float is a numeric value as a float64 */
+func (v Value) float() float64 {
+	switch v.Kind {
+	case KIND_INT:
+		return float64(v.I)
+	case KIND_UINT:
+		return float64(v.U)
+	}
+	return v.F
+}
+
+/* columnRange is the range of the integer column types; unsigned types have a zero min */
+func columnRange(typ column.SUPPORTED_TYPE) (int64, uint64) {
+	switch typ {
+	case column.INT8:
+		return math.MinInt8, math.MaxInt8
+	case column.INT16:
+		return math.MinInt16, math.MaxInt16
+	case column.INT, column.INT32:
+		return math.MinInt32, math.MaxInt32
+	case column.INT64:
+		return math.MinInt64, math.MaxInt64
+	case column.UINT8:
+		return 0, math.MaxUint8
+	case column.UINT16:
+		return 0, math.MaxUint16
+	case column.UINT, column.UINT32:
+		return 0, math.MaxUint32
+	}
+	return 0, math.MaxUint64
+}
+
+/*
+Coerce converts v to the kind of a column of type typ, failing if the column cannot hold it.
+Integers widen to floats; floats never narrow to integers.
+*/
+func Coerce(v Value, typ column.SUPPORTED_TYPE) (Value, error) {
+	if v.IsNull() {
+		return v, nil
+	}
+	kind := KindOf(typ)
+	switch {
+	case kind == KIND_STRING:
+		if v.Kind != KIND_STRING {
+			return v, errorf(SQLSTATE_DATATYPE_MISMATCH, -1, "cannot store %s in a column of type %s", v.Kind, TypeName(typ))
+		}
+		return v, nil
+	case kind == KIND_FLOAT:
+		if !v.isNumeric() {
+			return v, errorf(SQLSTATE_DATATYPE_MISMATCH, -1, "cannot store %s in a column of type %s", v.Kind, TypeName(typ))
+		}
+		f := v.float()
+		if typ == column.FLOAT32 && !math.IsInf(f, 0) && math.Abs(f) > math.MaxFloat32 {
+			return v, errorf(SQLSTATE_OUT_OF_RANGE, -1, "value %s is out of range for type %s", v, TypeName(typ))
+		}
+		return Float(f), nil
+	case v.Kind != KIND_INT && v.Kind != KIND_UINT:
+		return v, errorf(SQLSTATE_DATATYPE_MISMATCH, -1, "cannot store %s in a column of type %s", v.Kind, TypeName(typ))
+	}
+
+	min, max := columnRange(typ)
+	inRange := false
+	if v.Kind == KIND_INT {
+		inRange = v.I >= min && (v.I < 0 || uint64(v.I) <= max)
+	} else {
+		inRange = v.U <= max
+	}
+	if !inRange {
+		return v, errorf(SQLSTATE_OUT_OF_RANGE, -1, "value %s is out of range for type %s", v, TypeName(typ))
+	}
+	if kind == KIND_UINT {
+		if v.Kind == KIND_INT {
+			return Uint(uint64(v.I)), nil
+		}
+		return v, nil
+	}
+	if v.Kind == KIND_UINT {
+		return Int(int64(v.U)), nil
+	}
+	return v, nil
+}
+
+/* parseValue reads text as a value of kind, the way a quoted literal is read where a number or boolean is expected */
+func parseValue(text string, kind Kind) (Value, bool) {
+	text = strings.TrimSpace(text)
+	switch kind {
+	case KIND_INT:
+		i, err := strconv.ParseInt(text, 10, 64)
+		return Int(i), err == nil
+	case KIND_UINT:
+		u, err := strconv.ParseUint(text, 10, 64)
+		return Uint(u), err == nil
+	case KIND_FLOAT:
+		f, err := strconv.ParseFloat(text, 64)
+		return Float(f), err == nil
+	case KIND_BOOL:
+		switch strings.ToLower(text) {
+		case "t", "true", "yes", "on", "1":
+			return Bool(true), true
+		case "f", "false", "no", "off", "0":
+			return Bool(false), true
+		}
+		return Value{}, false
+	case KIND_STRING:
+		return String(text), true
+	}
+	return Value{}, false
+}
@@ -0,0 +1,78 @@
+package storage
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+)
+
+/*
+Cipher seals data with AES-256-GCM as
+
+	nonce(12) | data encrypted | tag(16)
+
+The nonce is random rather than derived from where the data goes: a block can be written again
+at the same LSN with other contents, for instance when recovery replays it, and a repeated nonce
+under one key gives away the key stream. What the data belongs to is bound to it as additional
+authenticated data instead, so it fails to open anywhere else.
+*/
+const (
+	KEY_SIZE   = 32
+	NONCE_SIZE = 12
+	TAG_SIZE   = 16
+	SEAL_SIZE  = NONCE_SIZE + TAG_SIZE // Bytes Seal adds
+)
+
+var ErrDecrypt = errors.New("data failed to decrypt, the key is wrong or the data is damaged")
+
+type Cipher struct {
+	aead cipher.AEAD
+}
+
+func NewCipher(key []byte) (*Cipher, error) {
+	if len(key) != KEY_SIZE {
+		return nil, fmt.Errorf("NewCipher: key of %d bytes, expected %d", len(key), KEY_SIZE)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("NewCipher: %v", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("NewCipher: %v", err)
+	}
+	return &Cipher{aead: aead}, nil
+}
+
+/* GenerateKey returns a new random key */
+func GenerateKey() ([]byte, error) {
+	key := make([]byte, KEY_SIZE)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("GenerateKey: %v", err)
+	}
+	return key, nil
+}
+
+/* Seal appends data sealed with aad to dst */
+func (c *Cipher) Seal(dst, data, aad []byte) ([]byte, error) {
+	nonce := make([]byte, NONCE_SIZE)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("Seal: %v", err)
+	}
+	dst = append(dst, nonce...)
+	return c.aead.Seal(dst, nonce, data, aad), nil
+}
+
+/* Open appends the data of sealed to dst, failing with ErrDecrypt unless it was sealed with this key and aad */
+func (c *Cipher) Open(dst, sealed, aad []byte) ([]byte, error) {
+	if len(sealed) < SEAL_SIZE {
+		return nil, fmt.Errorf("Open: %d bytes: %w", len(sealed), ErrDecrypt)
+	}
+	out, err := c.aead.Open(dst, sealed[:NONCE_SIZE], sealed[NONCE_SIZE:], aad)
+	if err != nil {
+		return nil, fmt.Errorf("Open: %w", ErrDecrypt)
+	}
+	return out, nil
+}
@@ -0,0 +1,273 @@
+package db
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"time"
+
+	cfg "github.com/misachi/DarDB/config"
+	st "github.com/misachi/DarDB/storage"
+)
+
+const (
+	BGWRITER_DELAY     = 200 * time.Millisecond // Default pause between background writer rounds
+	BGWRITER_MAX_PAGES = 100                    // Default number of blocks written per round
+	CHECKPOINT_TIMEOUT = 5 * time.Minute        // Default time between checkpoints
+)
+
+/* BgWriter trickles dirty blocks to disk so foreground work rarely has to write them itself */
+type BgWriter struct {
+	buf      *BufferPoolMgr
+	delay    time.Duration
+	maxPages int
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+func NewBgWriter(buf *BufferPoolMgr, delay time.Duration, maxPages int) *BgWriter {
+	if delay <= 0 {
+		delay = BGWRITER_DELAY
+	}
+	if maxPages <= 0 {
+		maxPages = BGWRITER_MAX_PAGES
+	}
+	return &BgWriter{buf: buf, delay: delay, maxPages: maxPages}
+}
+
+func (w *BgWriter) Start() {
+	w.stop = make(chan struct{})
+	w.done = make(chan struct{})
+	go func() {
+		defer close(w.done)
+		ticker := time.NewTicker(w.delay)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-w.stop:
+				return
+			case <-ticker.C:
+				if _, err := w.Round(); err != nil {
+					slog.Warn("BgWriter: round failed", "err", err)
+				}
+			}
+		}
+	}()
+}
+
+/* Round writes up to maxPages dirty blocks that are not pinned */
+func (w *BgWriter) Round() (int, error) {
+	return w.buf.flushFrames(w.maxPages, nil)
+}
+
+func (w *BgWriter) Stop() {
+	if w.stop == nil {
+		return
+	}
+	close(w.stop)
+	<-w.done
+	w.stop = nil
+}
+
+/* Checkpointer takes a checkpoint every timeout */
+type Checkpointer struct {
+	config  *cfg.Config
+	timeout time.Duration
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+func NewCheckpointer(config *cfg.Config, timeout time.Duration) *Checkpointer {
+	if timeout <= 0 {
+		timeout = CHECKPOINT_TIMEOUT
+	}
+	return &Checkpointer{config: config, timeout: timeout}
+}
+
+func (c *Checkpointer) Start() {
+	c.stop = make(chan struct{})
+	c.done = make(chan struct{})
+	go func() {
+		defer close(c.done)
+		ticker := time.NewTicker(c.timeout)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-c.stop:
+				return
+			case <-ticker.C:
+				if _, err := Checkpoint(c.config); err != nil {
+					slog.Warn("Checkpointer: checkpoint failed", "err", err)
+				}
+			}
+		}
+	}()
+}
+
+func (c *Checkpointer) Stop() {
+	if c.stop == nil {
+		return
+	}
+	close(c.stop)
+	<-c.done
+	c.stop = nil
+}
+
+/* BgWorkers bundles the background writer and the checkpointer of a data directory */
+type BgWorkers struct {
+	Writer       *BgWriter
+	Checkpointer *Checkpointer
+}
+
+func StartBgWorkers(config *cfg.Config) *BgWorkers {
+	workers := &BgWorkers{
+		Writer:       NewBgWriter(GetBufMgr(config), config.BgWriterDelay(), config.BgWriterMaxPages()),
+		Checkpointer: NewCheckpointer(config, config.CheckpointTimeout()),
+	}
+	workers.Writer.Start()
+	workers.Checkpointer.Start()
+	return workers
+}
+
+/* Stop stops both workers and takes a final checkpoint */
+func (bw *BgWorkers) Stop() error {
+	bw.Writer.Stop()
+	bw.Checkpointer.Stop()
+	if _, err := Checkpoint(bw.Checkpointer.config); err != nil {
+		return fmt.Errorf("BgWorkers Stop: %v", err)
+	}
+	return nil
+}
+
+type activeTxn struct {
+	txnID    st.Txn_t
+	firstLSN wal_t
+}
+
+/* checkpointData is the payload of a checkpoint entry */
+type checkpointData struct {
+	redoLSN wal_t // Recovery redoes changes from here on
+	dpt     map[pageKey]wal_t
+	active  []activeTxn
+}
+
+func (c checkpointData) encode() []byte {
+	data := make([]byte, 0, 16+len(c.dpt)*24+len(c.active)*16)
+	data = binary.LittleEndian.AppendUint64(data, uint64(c.redoLSN))
+	data = binary.LittleEndian.AppendUint32(data, uint32(len(c.dpt)))
+	for key, recLSN := range c.dpt {
+		data = binary.LittleEndian.AppendUint64(data, uint64(key.tbl))
+		data = binary.LittleEndian.AppendUint64(data, uint64(key.blk))
+		data = binary.LittleEndian.AppendUint64(data, uint64(recLSN))
+	}
+	data = binary.LittleEndian.AppendUint32(data, uint32(len(c.active)))
+	for _, txn := range c.active {
+		data = binary.LittleEndian.AppendUint64(data, uint64(txn.txnID))
+		data = binary.LittleEndian.AppendUint64(data, uint64(txn.firstLSN))
+	}
+	return data
+}
+
+func decodeCheckpoint(data []byte) (checkpointData, error) {
+	c := checkpointData{dpt: make(map[pageKey]wal_t)}
+	if len(data) < 12 {
+		return c, fmt.Errorf("decodeCheckpoint: %w", ErrWalCorrupt)
+	}
+	c.redoLSN = wal_t(binary.LittleEndian.Uint64(data[0:8]))
+	n := int(binary.LittleEndian.Uint32(data[8:12]))
+	data = data[12:]
+	if len(data) < n*24+4 {
+		return c, fmt.Errorf("decodeCheckpoint: %w", ErrWalCorrupt)
+	}
+	for i := 0; i < n; i++ {
+		key := newPageKey(st.Tbl_t(binary.LittleEndian.Uint64(data[0:8])), st.Blk_t(binary.LittleEndian.Uint64(data[8:16])))
+		c.dpt[key] = wal_t(binary.LittleEndian.Uint64(data[16:24]))
+		data = data[24:]
+	}
+	n = int(binary.LittleEndian.Uint32(data[0:4]))
+	data = data[4:]
+	if len(data) != n*16 {
+		return c, fmt.Errorf("decodeCheckpoint: %w", ErrWalCorrupt)
+	}
+	for i := 0; i < n; i++ {
+		c.active = append(c.active, activeTxn{
+			txnID:    st.Txn_t(binary.LittleEndian.Uint64(data[0:8])),
+			firstLSN: wal_t(binary.LittleEndian.Uint64(data[8:16])),
+		})
+		data = data[16:]
+	}
+	return c, nil
+}
+
+/* oldestLSN is the first LSN recovery from this checkpoint needs, for redo or for undo */
+func (c checkpointData) oldestLSN() wal_t {
+	lsn := c.redoLSN
+	for _, txn := range c.active {
+		if txn.firstLSN < lsn {
+			lsn = txn.firstLSN
+		}
+	}
+	return lsn
+}
+
+/*
+Checkpoint takes a fuzzy checkpoint: dirty blocks are not written, their first change LSNs and the
+transactions still running are logged instead. Data files are synced before the checkpoint is
+recorded in the control file, after which WAL segments recovery no longer needs are removed.
+*/
+func Checkpoint(config *cfg.Config) (wal_t, error) {
+	return getEngine(config).checkpoint()
+}
+
+func (e *engine) checkpoint() (wal_t, error) {
+	wal := e.wal
+	buf := e.buf
+
+	buf.flushMtx.Lock()
+	defer buf.flushMtx.Unlock()
+	buf.ckptLock.Lock()
+	ckpt := checkpointData{redoLSN: wal.NextLSN(), dpt: buf.dirtyPageTable()}
+	buf.fullPageLSN.Store(uint64(ckpt.redoLSN))
+	for _, recLSN := range ckpt.dpt {
+		if recLSN < ckpt.redoLSN {
+			ckpt.redoLSN = recLSN
+		}
+	}
+	// No change is half applied while buf.ckptLock is held, so pinned blocks can be written too
+	frames := buf.dirtyFrames(0, nil, true)
+	txnMgr := e.txns
+	txnMgr.txnMgrMtx.Lock()
+	for _, txn := range txnMgr.ActiveTransactions {
+		if txn.firstLSN > 0 {
+			ckpt.active = append(ckpt.active, activeTxn{txnID: txn.transactionId, firstLSN: txn.firstLSN})
+		}
+	}
+	txnMgr.txnMgrMtx.Unlock()
+	buf.ckptLock.Unlock()
+
+	// Every block dirty at the start is written, so a block torn after the checkpoint has a full page image after its redo point
+	if _, err := buf.writeFrames(frames); err != nil {
+		return 0, fmt.Errorf("Checkpoint: %v", err)
+	}
+	if err := buf.syncFiles(); err != nil {
+		return 0, fmt.Errorf("Checkpoint: %v", err)
+	}
+
+	entry := NewEntry(0)
+	entry.state = WAL_CHECKPOINT
+	entry.newVal = ckpt.encode()
+	lsn, err := wal.Append(entry)
+	if err != nil {
+		return 0, fmt.Errorf("Checkpoint: %v", err)
+	}
+	if err := wal.Flush(lsn); err != nil {
+		return 0, fmt.Errorf("Checkpoint: %v", err)
+	}
+	if err := writeControl(wal.FS(), wal.Dir(), lsn); err != nil {
+		return 0, fmt.Errorf("Checkpoint: %v", err)
+	}
+	if _, err := wal.Truncate(ckpt.oldestLSN()); err != nil {
+		return lsn, fmt.Errorf("Checkpoint: %v", err)
+	}
+	return lsn, nil
+}
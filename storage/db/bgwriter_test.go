@@ -0,0 +1,110 @@
+package db
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/misachi/DarDB/column"
+	st "github.com/misachi/DarDB/storage"
+)
+
+func TestBgWriterRound(t *testing.T) {
+	var tblId st.Tbl_t = 9
+	fsys := st.NewMemFS()
+	f := "/9"
+	if _, err := fsys.Create(f); err != nil {
+		t.Fatalf("Create error: %v", err)
+	}
+	buf := &BufferPoolMgr{pages: newPageTable(), files: newFileMgr()}
+	buf.files.setFS(fsys, 0)
+	buf.files.registerPath(tblId, f)
+
+	record := []byte("3\n0,1:2,2\n6:15")
+	guards := make([]*BlockGuard, 0)
+	for _, blockId := range []st.Blk_t{0, 2 * BLKSIZE} {
+		guard, err := buf.fetchOrCreate(f, tblId, blockId)
+		if err != nil {
+			t.Fatalf("fetchOrCreate error: %v", err)
+		}
+		if err := guard.Block().AddRecordWithBytes(record); err != nil {
+			t.Fatalf("AddRecordWithBytes error: %v", err)
+		}
+		guard.Block().markModified(0)
+		guard.MarkDirty()
+		guards = append(guards, guard)
+	}
+	guards[0].Close()
+	defer guards[1].Close()
+
+	written, err := NewBgWriter(buf, 0, 0).Round()
+	if err != nil {
+		t.Fatalf("Round error: %v", err)
+	}
+	if written != 1 {
+		t.Errorf("Round error: expected only the unpinned block to be written but %d were", written)
+	}
+	if guards[0].Block().isDirty || !guards[1].Block().isDirty {
+		t.Errorf("Round error: expected the pinned block to stay dirty and the other to be clean")
+	}
+
+	mgr, err := st.NewDiskMgr(fsys, f)
+	if err != nil {
+		t.Fatalf("NewDiskMgr error: %v", err)
+	}
+	defer mgr.Close()
+	page, err := readPage(mgr, 0)
+	if err != nil {
+		t.Fatalf("readPage error: %v", err)
+	}
+	blk, err := decodePage(page, 0, tblId, BLKSIZE)
+	if err != nil {
+		t.Fatalf("decodePage error: %v", err)
+	}
+	if got, _ := blk.recordBytes(0); !bytes.Equal(got, record) {
+		t.Errorf("Round error: expected record %q on disk but got %q", record, got)
+	}
+	if _, err := readPage(mgr, 2*BLKSIZE); err != ErrBlockNotFound {
+		t.Errorf("Round error: expected pinned block not to be written but got %v", err)
+	}
+}
+
+func TestCheckpoint(t *testing.T) {
+	cfg := newTestConfig(t, st.NewMemFS())
+	db := NewDB("ckptDB", cfg)
+	tbl, err := db.CreateTable("table1", map[string]column.SUPPORTED_TYPE{"id": column.INT}, column.NewColumn("id", column.INT))
+	if err != nil {
+		t.Fatalf("CreateTable error: %v", err)
+	}
+	ctx := GetClientContextMgr(cfg).NewClientCtx(cfg, db)
+	defer ctx.Close()
+	if err := db.AddRecord(ctx, tbl, map[string][]byte{"id": []byte("1")}); err != nil {
+		t.Fatalf("AddRecord error: %v", err)
+	}
+
+	lsn, err := Checkpoint(cfg)
+	if err != nil {
+		t.Fatalf("Checkpoint error: %v", err)
+	}
+	wal := GetWalMgr(cfg)
+	if ckptLSN, _ := readControl(wal.FS(), wal.Dir()); ckptLSN != lsn {
+		t.Errorf("Checkpoint error: expected control file to point at %d but got %d", lsn, ckptLSN)
+	}
+	ckpt, err := readCheckpoint(wal, lsn)
+	if err != nil {
+		t.Fatalf("readCheckpoint error: %v", err)
+	}
+	txn := ctx.CurrentTxn()
+	found := false
+	for _, active := range ckpt.active {
+		found = found || (active.txnID == txn.transactionId && active.firstLSN == txn.firstLSN)
+	}
+	if !found {
+		t.Errorf("Checkpoint error: expected running transaction %d in %+v", txn.transactionId, ckpt.active)
+	}
+	if recLSN, ok := ckpt.dpt[newPageKey(tbl.tblID, 0)]; !ok || recLSN != txn.firstLSN {
+		t.Errorf("Checkpoint error: expected dirty block with recLSN %d in %+v", txn.firstLSN, ckpt.dpt)
+	}
+	if ckpt.oldestLSN() > txn.firstLSN {
+		t.Errorf("Checkpoint error: expected recovery to start at or before %d but got %d", txn.firstLSN, ckpt.oldestLSN())
+	}
+}
@@ -13,10 +13,12 @@ import (
 )
 
 var (
-	ErrBlockFull = errors.New("Block is full")
+	ErrBlockFull      = errors.New("Block is full")
+	ErrRecordNotFound = errors.New("record does not exist")
+	ErrBadBlock       = errors.New("block contents are malformed")
 )
 
-const BLKSIZE = 4096 // Size of block on disk
+const BLKSIZE = st.DEFAULT_BLOCK_SIZE // Size of block on disk unless the table chose another
 
 type BlockLocationPair struct {
 	*row.LocationPair
@@ -34,33 +36,51 @@ func NewBlockLocationPair(offset, size st.Location_T) *BlockLocationPair {
 type Block struct {
 	isDirty     bool
 	pinCount    int
+	used        bool // Asked for since the eviction sweep last passed it; guarded, like pinCount, by the shard lock
+	lsn         wal_t // LSN of the last logged change applied to the block
+	recLSN      wal_t // LSN of the first change since the block was last written
 	size        int // Current size of block contents on storage device
+	capacity    int // Size of the block on disk, 0 for BLKSIZE
 	blockId     st.Blk_t
 	tblId       st.Tbl_t
-	mut         *sync.RWMutex
+	mut         *sync.RWMutex // Guards the records, their locations and the dirty state; pinning only keeps the block pooled
 	recLocation []BlockLocationPair // Contains list of two items (Record offset, Record size)
 	records     []byte
+	legacy      bool // Read from a bare block or a page flagged PAGE_FLAG_LEGACY; records keep the legacy layout
+	files       *fileMgr // Of the pool holding the block, which opens the toast files of its records
+}
+
+/* NewSizedBlock is NewBlock for a table whose blocks are blockSize bytes */
+func NewSizedBlock(data []byte, blkID st.Blk_t, tblId st.Tbl_t, blockSize int) (*Block, error) {
+	blk, err := NewBlock(data, blkID, tblId)
+	if err != nil {
+		return nil, err
+	}
+	if blockSize != BLKSIZE {
+		blk.capacity = blockSize
+	}
+	return blk, nil
 }
 
 func NewBlock(data []byte, blkID st.Blk_t, tblId st.Tbl_t) (*Block, error) {
 	if len(data) < 1 {
-		return new(Block), nil
+		return &Block{blockId: blkID, tblId: tblId, mut: &sync.RWMutex{}}, nil
 	}
 	copyData := make([]byte, len(data))
 	copy(copyData, data)
 	szOffset := bytes.IndexByte(copyData, row.Term)
+	if szOffset < 0 {
+		return nil, fmt.Errorf("NewBlock: %w", ErrBadBlock)
+	}
 	reader := bytes.NewReader(copyData[:szOffset])
 	sz, err := row.ByteArrayToInt(reader)
 	if err != nil {
 		return nil, fmt.Errorf("NewBlock: byte slice to integer %v", err)
 	}
 
-	if szOffset < 0 {
-		szOffset = 0
-	}
 	locOffset := bytes.IndexByte(copyData[szOffset+1:], row.Term)
 	if locOffset < 0 {
-		locOffset = 0
+		return nil, fmt.Errorf("NewBlock: %w", ErrBadBlock)
 	}
 
 	locations, err := setBlockLocation(copyData[szOffset+1 : locOffset+szOffset+1])
@@ -70,6 +90,11 @@ func NewBlock(data []byte, blkID st.Blk_t, tblId st.Tbl_t) (*Block, error) {
 
 	copyData = copyData[szOffset+1:]
 	records := copyData[locOffset+1:]
+	for _, location := range locations {
+		if int(location.Offset()) > len(records) {
+			return nil, fmt.Errorf("NewBlock: record at %d is past the end of the block: %w", location.Offset(), ErrBadBlock)
+		}
+	}
 
 	return &Block{
 		size:        int(sz),
@@ -105,6 +130,9 @@ func setBlockLocation(lData []byte) ([]BlockLocationPair, error) {
 		if locSepIdx == -1 {
 			locSepIdx = len(newBuf)
 		}
+		if fieldSepIdx == -1 || fieldSepIdx > locSepIdx {
+			return nil, fmt.Errorf("setLocation: location without a size: %w", ErrBadBlock)
+		}
 
 		offset, err := row.ByteArrayToInt(bytes.NewReader(newBuf[:fieldSepIdx]))
 		if err != nil {
@@ -116,12 +144,15 @@ func setBlockLocation(lData []byte) ([]BlockLocationPair, error) {
 			return nil, fmt.Errorf("setLocation: Unable to set size: %v", err)
 		}
 
-		if size > 0 {
-			if len(location) <= 0 {
-				location = []BlockLocationPair{*NewBlockLocationPair(st.Location_T(offset), st.Location_T(size))}
-			} else {
-				location = append(location, *NewBlockLocationPair(st.Location_T(offset), st.Location_T(size)))
-			}
+		if offset < 0 || offset > st.MAX_BLOCK_SIZE || size < 0 || size > st.MAX_BLOCK_SIZE {
+			return nil, fmt.Errorf("setLocation: location %d,%d out of range: %w", offset, size, ErrBadBlock)
+		}
+
+		// Zero sized locations are deleted records. They are kept so record slots stay stable
+		if len(location) <= 0 {
+			location = []BlockLocationPair{*NewBlockLocationPair(st.Location_T(offset), st.Location_T(size))}
+		} else {
+			location = append(location, *NewBlockLocationPair(st.Location_T(offset), st.Location_T(size)))
 		}
 
 		idx += 1
@@ -184,7 +215,7 @@ func setBlockLocation(lData []byte) ([]BlockLocationPair, error) {
 // 	}, nil
 // }
 
-func (b Block) BlockID() st.Blk_t {
+func (b *Block) BlockID() st.Blk_t {
 	return b.blockId
 }
 
@@ -196,6 +227,183 @@ func (b *Block) Size() int {
 	return b.size
 }
 
+/* pageSize is the number of bytes the block takes on disk, page header included */
+func (b *Block) pageSize() int {
+	return b.resizedPageSize(-1, 0)
+}
+
+/* resizedPageSize is the page size once the record in slot grows by delta bytes, moving the records after it */
+func (b *Block) resizedPageSize(slot, delta int) int {
+	sz := PAGE_HDR_SIZE + len(intToByte(b.size+delta)) + 1
+	for i, location := range b.recLocation {
+		if i > 0 {
+			sz++
+		}
+		offset, size := int(location.Offset()), int(location.Size())
+		if i == slot {
+			size += delta
+		} else if slot >= 0 && i > slot {
+			offset += delta
+		}
+		sz += len(intToByte(offset)) + 1 + len(intToByte(size))
+	}
+	return sz + 1 + len(b.records) + delta
+}
+
+/* blockSize is the size of the block on disk */
+func (b *Block) blockSize() int {
+	if b.capacity == 0 {
+		return BLKSIZE
+	}
+	return b.capacity
+}
+
+/* freeSpace is the number of bytes that can still be added to the block's page */
+func (b *Block) freeSpace() int {
+	return b.blockSize() - b.pageSize()
+}
+
+/* recordSpace is the page space a record of sz bytes needs in a block of blockSize bytes, its location and size digits included */
+func recordSpace(sz, blockSize int) int {
+	return sz + 2*len(intToByte(blockSize)) + 3
+}
+
+func (b *Block) hasRoom(sz int) bool {
+	return b.size <= b.blockSize() && recordSpace(sz, b.blockSize()) <= b.freeSpace()
+}
+
+func (b *Block) LSN() wal_t {
+	return b.lsn
+}
+
+/* markModified stamps the block with the LSN of a logged change just applied to it */
+func (b *Block) markModified(lsn wal_t) {
+	if b.recLSN == 0 {
+		b.recLSN = lsn
+	}
+	b.lsn = lsn
+	b.isDirty = true
+}
+
+/* recordBytes returns a copy of the record stored in slot */
+func (b *Block) recordBytes(slot int) ([]byte, error) {
+	if slot < 0 || slot >= len(b.recLocation) {
+		return nil, fmt.Errorf("recordBytes: slot %d out of range", slot)
+	}
+	loc := b.recLocation[slot]
+	if int(loc.Offset())+int(loc.Size()) > len(b.records) {
+		return nil, fmt.Errorf("recordBytes: slot %d: %w", slot, ErrBadBlock)
+	}
+	data := make([]byte, loc.Size())
+	copy(data, b.records[loc.Offset():loc.Offset()+loc.Size()])
+	return data, nil
+}
+
+/* layout converts an encoded record to the layout of the records of the block */
+func (b *Block) layout(data []byte) ([]byte, error) {
+	if !b.legacy {
+		return data, nil
+	}
+	return row.LegacyLayout(data)
+}
+
+/* insertRecordAt adds an encoded record in slot, which must be the next free slot */
+func (b *Block) insertRecordAt(slot int, data []byte) error {
+	if slot != len(b.recLocation) {
+		return fmt.Errorf("insertRecordAt: expected slot %d but got %d", len(b.recLocation), slot)
+	}
+	data, err := b.layout(data)
+	if err != nil {
+		return fmt.Errorf("insertRecordAt: %v", err)
+	}
+	if !b.hasRoom(len(data)) {
+		return ErrBlockFull
+	}
+	offset := len(b.records)
+	b.recLocation = append(b.recLocation, *NewBlockLocationPair(st.Location_T(offset), st.Location_T(len(data))))
+	b.records = append(b.records, data...)
+	b.size += len(data)
+	b.isDirty = true
+	return nil
+}
+
+/* replaceRecord swaps the record in slot for data. An empty data deletes the record but keeps its slot */
+func (b *Block) replaceRecord(slot int, data []byte) error {
+	if slot < 0 || slot >= len(b.recLocation) {
+		return fmt.Errorf("replaceRecord: slot %d out of range", slot)
+	}
+	data, err := b.layout(data)
+	if err != nil {
+		return fmt.Errorf("replaceRecord: %v", err)
+	}
+	offset := int(b.recLocation[slot].Offset())
+	oldSize := int(b.recLocation[slot].Size())
+	delta := len(data) - oldSize
+	if delta > 0 && (b.size+delta > b.blockSize() || b.resizedPageSize(slot, delta) > b.blockSize()) {
+		return ErrBlockFull
+	}
+
+	records := make([]byte, 0, len(b.records)+delta)
+	records = append(records, b.records[:offset]...)
+	records = append(records, data...)
+	records = append(records, b.records[offset+oldSize:]...)
+	b.records = records
+
+	b.recLocation[slot].SetSize(st.Location_T(len(data)))
+	for i := slot + 1; i < len(b.recLocation); i++ {
+		b.recLocation[i].SetOffset(st.Location_T(int(b.recLocation[i].Offset()) + delta))
+	}
+	b.size += delta
+	b.isDirty = true
+	return nil
+}
+
+/* undoInsert removes the record an undone insert added. The last slot is dropped so the block gets back the room its location took */
+func (b *Block) undoInsert(slot int) error {
+	if err := b.replaceRecord(slot, nil); err != nil {
+		return err
+	}
+	if slot == len(b.recLocation)-1 {
+		b.recLocation = b.recLocation[:slot]
+	}
+	return nil
+}
+
+/* isDeleted reports whether the record in slot has been deleted */
+func (b *Block) isDeleted(slot int) bool {
+	return b.recLocation[slot].Size() == 0
+}
+
+/* liveRecords is the number of records in the block that are not deleted */
+func (b *Block) liveRecords() int {
+	n := 0
+	for i := range b.recLocation {
+		if !b.isDeleted(i) {
+			n++
+		}
+	}
+	return n
+}
+
+/* compact drops the slots of deleted records and packs the records that are left, renumbering their slots. It returns the number of slots dropped */
+func (b *Block) compact() int {
+	locations := make([]BlockLocationPair, 0, len(b.recLocation))
+	records := make([]byte, 0, len(b.records))
+	for i, location := range b.recLocation {
+		if b.isDeleted(i) {
+			continue
+		}
+		data := b.records[location.Offset() : location.Offset()+location.Size()]
+		locations = append(locations, *NewBlockLocationPair(st.Location_T(len(records)), location.Size()))
+		records = append(records, data...)
+	}
+	dropped := len(b.recLocation) - len(locations)
+	b.recLocation = locations
+	b.records = records
+	b.isDirty = true
+	return dropped
+}
+
 func (b *Block) ToByte() []byte {
 	// var recordSep byte = '\t'
 	retData := intToByte(b.size)
@@ -221,6 +429,8 @@ func (b *Block) ToByte() []byte {
 }
 
 func (b *Block) AddRecordWithBytes(data []byte) error {
+	b.mut.Lock()
+	defer b.mut.Unlock()
 	record, err := row.NewVarLengthRecordWithHDR(data)
 
 	if err != nil {
@@ -228,8 +438,8 @@ func (b *Block) AddRecordWithBytes(data []byte) error {
 	}
 
 	length := record.RecordSize()
-	if b.size > BLKSIZE || (b.size+length) > BLKSIZE {
-		return fmt.Errorf("AddRecord: Block is full")
+	if !b.hasRoom(length) {
+		return fmt.Errorf("AddRecord: %w", ErrBlockFull)
 	}
 
 	offset := len(b.records)
@@ -242,10 +452,12 @@ func (b *Block) AddRecordWithBytes(data []byte) error {
 }
 
 func (b *Block) AddRecord(record *row.VarLengthRecord) error {
+	b.mut.Lock()
+	defer b.mut.Unlock()
 	length := record.RecordSize()
 
-	if b.size > BLKSIZE || (b.size+length) > BLKSIZE {
-		return fmt.Errorf("AddRecord: Block is full")
+	if !b.hasRoom(length) {
+		return fmt.Errorf("AddRecord: %w", ErrBlockFull)
 	}
 
 	offset := len(b.records)
@@ -262,30 +474,47 @@ func (b *Block) ResetIsDirtyFlag() {
 }
 
 func (b *Block) getRecordSlice(offset, size int) (row.Record, error) {
-	return row.NewVarLengthRecordWithHDR(b.records[offset : offset+size])
+	record, err := row.NewVarLengthRecordWithHDR(b.records[offset : offset+size])
+	if err != nil {
+		return nil, err
+	}
+	record.SetToast(tableToast{files: b.files, tblId: b.tblId})
+	record.SetLegacy(b.legacy)
+	return record, nil
 }
 
 func (b *Block) Records(ctx *ClientContext) ([]row.Record, error) {
+	b.mut.RLock()
+	defer b.mut.RUnlock()
 	filtered := make([]row.Record, 0)
 	txn := ctx.CurrentTxn()
-	for _, location := range b.recLocation {
+	txn.touch(b.tblId, b.blockId)
+	for slot, location := range b.recLocation {
+		if location.Size() == 0 {
+			continue
+		}
 		record, err := b.getRecordSlice(int(location.Offset()), int(location.Size()))
 		if err != nil {
 			return nil, fmt.Errorf("Records: Unable to initialize record %v", err)
 		}
 		location.lockField.AcquireLock(st.SHARED_LOCK)
-		txn.TxnReadRecord(b.tblId, b.blockId, *location.LocationPair)
+		txn.TxnReadRecord(b.tblId, b.blockId, slot, *location.LocationPair)
 
 		filtered = append(filtered, record)
 	}
 	return filtered, nil
 }
 
-func (b Block) FilterRecords(ctx *ClientContext, colData row.ColumnData, fieldName string, fieldVal []byte) ([]row.Record, error) {
+func (b *Block) FilterRecords(ctx *ClientContext, colData row.ColumnData, fieldName string, fieldVal []byte) ([]row.Record, error) {
+	b.mut.RLock()
+	defer b.mut.RUnlock()
 	filtered := make([]row.Record, 0)
+	ctx.CurrentTxn().touch(b.tblId, b.blockId)
 
 	for i, location := range b.recLocation {
-		// if b.recLocation[i].Offset() >= 0 && b.recLocation[i].Size() > 0 {
+		if location.Size() == 0 {
+			continue
+		}
 
 		record, err := b.getRecordSlice(int(b.recLocation[i].Offset()), int(b.recLocation[i].Size()))
 
@@ -295,7 +524,7 @@ func (b Block) FilterRecords(ctx *ClientContext, colData row.ColumnData, fieldNa
 		if field := record.GetField(colData, fieldName); bytes.Equal(field, fieldVal) {
 			b.recLocation[i].lockField.AcquireLock(st.SHARED_LOCK)
 			txn := ctx.CurrentTxn()
-			txn.TxnReadRecord(b.tblId, b.blockId, *location.LocationPair)
+			txn.TxnReadRecord(b.tblId, b.blockId, i, *location.LocationPair)
 
 			filtered = append(filtered, record)
 		}
@@ -304,7 +533,13 @@ func (b Block) FilterRecords(ctx *ClientContext, colData row.ColumnData, fieldNa
 }
 
 func (b *Block) UpdateFiteredRecords(ctx *ClientContext, colData row.ColumnData, fieldName string, searchVal []byte, newVal []byte) error {
-	for _, location := range b.recLocation {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	ctx.CurrentTxn().touch(b.tblId, b.blockId)
+	for slot, location := range b.recLocation {
+		if location.Size() == 0 {
+			continue
+		}
 		record, err := b.getRecordSlice(int(location.Offset()), int(location.Size()))
 		// oldRecordBytes := record.(*row.VarLengthRecord).ToByte()
 
@@ -319,7 +554,7 @@ func (b *Block) UpdateFiteredRecords(ctx *ClientContext, colData row.ColumnData,
 			// 	wal = NewWalSegment(ctx.currentTxn.transactionId)
 			// }
 			// wal.WalLog(ctx, NewEntry(txn.transactionId))
-			txn.TxnReadRecord(b.tblId, b.blockId, *location.LocationPair)
+			txn.TxnReadRecord(b.tblId, b.blockId, slot, *location.LocationPair)
 
 			b.size -= record.(*row.VarLengthRecord).RecordSize()
 			record.UpdateField(colData, fieldName, newVal)
@@ -334,6 +569,9 @@ func (b *Block) UpdateFiteredRecords(ctx *ClientContext, colData row.ColumnData,
 }
 
 func (b *Block) UpdateRecords(ctx *ClientContext, colData row.ColumnData, fieldName string, fieldVal []byte) error {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	ctx.CurrentTxn().touch(b.tblId, b.blockId)
 	for i, location := range b.recLocation {
 		oldOff := location.Offset()
 		oldSize := location.Size()
@@ -350,7 +588,7 @@ func (b *Block) UpdateRecords(ctx *ClientContext, colData row.ColumnData, fieldN
 
 		location.lockField.AcquireLock(st.EXCLUSIVE_LOCK)
 		txn := ctx.CurrentTxn()
-		txn.TxnReadRecord(b.tblId, b.blockId, *location.LocationPair)
+		txn.TxnReadRecord(b.tblId, b.blockId, i, *location.LocationPair)
 
 		b.size -= record.RecordSize()
 		record.UpdateField(colData, fieldName, fieldVal)
@@ -2,10 +2,12 @@ package db
 
 import (
 	"bytes"
+	"errors"
+	"strings"
+	"sync"
 	"testing"
 
 	"github.com/misachi/DarDB/column"
-	"github.com/misachi/DarDB/config"
 	st "github.com/misachi/DarDB/storage"
 	row "github.com/misachi/DarDB/storage/db/row"
 )
@@ -56,6 +58,7 @@ import (
 func TestNewBlock(t *testing.T) {
 	data := []byte("107\n0,58:58,34\n127\n0,2:3,2:6,4:11,2:14,2:16,3:21,3\n12:34:1467:56\nitwasyou127\n0,2:3,2:6,4:11,2\n12:34:1467:56")
 	block := Block{
+		mut:         &sync.RWMutex{},
 		size:        107,
 		recLocation: []BlockLocationPair{{row.NewLocationPair(0, 58), &st.Lock{}}, {row.NewLocationPair(58, 34), &st.Lock{}}},
 		records:     []byte("127\n0,2:3,2:6,4:11,2:14,2:16,3:21,3\n12:34:1467:56\nitwasyou127\n0,2:3,2:6,4:11,2\n12:34:1467:56"),
@@ -118,6 +121,7 @@ func TestBlockToByte(t *testing.T) {
 	}
 
 	block := Block{
+		mut:         &sync.RWMutex{},
 		size:        123,
 		recLocation: []BlockLocationPair{{row.NewLocationPair(0, 20), &st.Lock{}}, {row.NewLocationPair(21, 50), &st.Lock{}}},
 		records:     []byte("0000000000000000000000000000000000000000000000000"),
@@ -145,6 +149,7 @@ func TestAddRecordWithBytes(t *testing.T) {
 		{
 			data: []byte("127\n0,2:3,2:6,4:11,2:14,2:16,3:21,3\n12:34:1467:56\nitwasher"),
 			given: Block{
+				mut:         &sync.RWMutex{},
 				size:        123,
 				recLocation: []BlockLocationPair{{row.NewLocationPair(0, 58), &st.Lock{}}, {row.NewLocationPair(58, 58), &st.Lock{}}},
 				records:     []byte("127\n0,2:3,2:6,4:11,2:14,2:16,3:21,3\n12:34:1467:56\nitwasyou127\n0,2:3,2:6,4:11,2:14,2:16,3:21,3\n12:34:1467:56\nitwashim"),
@@ -155,6 +160,7 @@ func TestAddRecordWithBytes(t *testing.T) {
 		{
 			data: []byte("127\n0,2:3,2:6,4:11,2\n12:34:1467:56"),
 			given: Block{
+				mut:         &sync.RWMutex{},
 				size:        123,
 				recLocation: []BlockLocationPair{{row.NewLocationPair(0, 58), &st.Lock{}}, {row.NewLocationPair(58, 58), &st.Lock{}}},
 				records:     []byte("127\n0,2:3,2:6,4:11,2:14,2:16,3:21,3\n12:34:1467:56\nitwasyou127\n0,2:3,2:6,4:11,2:14,2:16,3:21,3\n12:34:1467:56\nitwashim"),
@@ -192,6 +198,7 @@ func TestAddRecord(t *testing.T) {
 		{
 			data: []byte("127\n0,2:3,2:6,4:11,2:14,2:16,3:21,3\n12:34:1467:56\nitwasher"),
 			given: Block{
+				mut:         &sync.RWMutex{},
 				size:        123,
 				recLocation: []BlockLocationPair{{row.NewLocationPair(0, 58), &st.Lock{}}, {row.NewLocationPair(58, 58), &st.Lock{}}},
 				records:     []byte("127\n0,2:3,2:6,4:11,2:14,2:16,3:21,3\n12:34:1467:56\nitwasyou127\n0,2:3,2:6,4:11,2:14,2:16,3:21,3\n12:34:1467:56\nitwashim"),
@@ -202,6 +209,7 @@ func TestAddRecord(t *testing.T) {
 		{
 			data: []byte("127\n0,2:3,2:6,4:11,2\n12:34:1467:56"),
 			given: Block{
+				mut:         &sync.RWMutex{},
 				size:        123,
 				recLocation: []BlockLocationPair{{row.NewLocationPair(0, 58), &st.Lock{}}, {row.NewLocationPair(58, 58), &st.Lock{}}},
 				records:     []byte("127\n0,2:3,2:6,4:11,2:14,2:16,3:21,3\n12:34:1467:56\nitwasyou127\n0,2:3,2:6,4:11,2:14,2:16,3:21,3\n12:34:1467:56\nitwashim"),
@@ -235,6 +243,7 @@ func TestRecords(t *testing.T) {
 	}
 
 	blk := Block{
+		mut:         &sync.RWMutex{},
 		size:        107,
 		recLocation: []BlockLocationPair{{row.NewLocationPair(0, 58), &st.Lock{}}, {row.NewLocationPair(58, 34), &st.Lock{}}},
 		records:     []byte("127\n0,2:3,2:6,4:11,2:14,2:16,3:21,3\n12:34:1467:56\nitwasyou127\n0,2:3,2:6,4:11,2\n12:34:1467:56"),
@@ -248,9 +257,9 @@ func TestRecords(t *testing.T) {
 		},
 	}
 
-	cfg := config.NewConfig(t.TempDir(), 1, 1)
+	cfg := newTestConfig(t, st.NewMemFS())
 	db := NewDB("test", cfg)
-	ctx := GetClientContextMgr().NewClientCtx(cfg, db)
+	ctx := GetClientContextMgr(cfg).NewClientCtx(cfg, db)
 	recs, err := value.given.Records(ctx)
 	if err != nil {
 		t.Errorf("TestRecords: %v", err)
@@ -273,6 +282,7 @@ func TestFilterRecords(t *testing.T) {
 	}
 
 	blk := Block{
+		mut:         &sync.RWMutex{},
 		size:        107,
 		recLocation: []BlockLocationPair{{row.NewLocationPair(0, 58), &st.Lock{}}, {row.NewLocationPair(58, 34), &st.Lock{}}},
 		records:     []byte("127\n0,2:3,2:6,4:11,2:14,2:16,3:21,3\n12:34:1467:56\nitwasyou120\n0,2:3,2:6,4:11,2\n12:34:1467:56"),
@@ -296,9 +306,9 @@ func TestFilterRecords(t *testing.T) {
 		{Name: "id7", Type: column.STRING},
 	}
 	colData := row.NewColumnData_(cols)
-	cfg := config.NewConfig(t.TempDir(), 1, 1)
+	cfg := newTestConfig(t, st.NewMemFS())
 	db := NewDB("test", cfg)
-	ctx := GetClientContextMgr().NewClientCtx(cfg, db)
+	ctx := GetClientContextMgr(cfg).NewClientCtx(cfg, db)
 	recs, err := value.given.FilterRecords(ctx, colData, "id6", []byte("was"))
 	if err != nil {
 		t.Errorf("TestFilterRecords: %v", err)
@@ -326,6 +336,7 @@ func TestUpdateFiteredRecords(t *testing.T) {
 	}
 
 	blk := Block{
+		mut:         &sync.RWMutex{},
 		size:        107,
 		recLocation: []BlockLocationPair{{row.NewLocationPair(0, 58), &st.Lock{}}, {row.NewLocationPair(58, 34), &st.Lock{}}},
 		records:     []byte("127\n0,2:3,2:6,4:11,2:14,2:16,3:19,3\n12:34:1467:56\nitwasyou120\n0,2:3,2:6,4:11,2\n12:34:1467:56"),
@@ -347,9 +358,9 @@ func TestUpdateFiteredRecords(t *testing.T) {
 		{Name: "id7", Type: column.STRING},
 	}
 	colData := row.NewColumnData_(cols)
-	cfg := config.NewConfig(t.TempDir(), 1, 1)
+	cfg := newTestConfig(t, st.NewMemFS())
 	db := NewDB("test", cfg)
-	ctx := GetClientContextMgr().NewClientCtx(cfg, db)
+	ctx := GetClientContextMgr(cfg).NewClientCtx(cfg, db)
 	err := value.given.UpdateFiteredRecords(ctx, colData, "id6", []byte("was"), []byte("be"))
 	if err != nil {
 		t.Errorf("TestUpdateFiteredRecords: %v", err)
@@ -375,6 +386,7 @@ func TestUpdateRecords(t *testing.T) {
 	}
 
 	blk := Block{
+		mut:         &sync.RWMutex{},
 		size:        107,
 		recLocation: []BlockLocationPair{{row.NewLocationPair(0, 58), &st.Lock{}}, {row.NewLocationPair(58, 34), &st.Lock{}}},
 		records:     []byte("127\n0,2:3,2:6,4:11,2:14,2:16,3:19,3\n12:34:1467:56\nitwasyou120\n0,2:3,2:6,4:11,2\n12:34:1467:56"),
@@ -396,9 +408,9 @@ func TestUpdateRecords(t *testing.T) {
 		{Name: "id7", Type: column.STRING},
 	}
 	colData := row.NewColumnData_(cols)
-	cfg := config.NewConfig(t.TempDir(), 1, 1)
+	cfg := newTestConfig(t, st.NewMemFS())
 	db := NewDB("test", cfg)
-	ctx := GetClientContextMgr().NewClientCtx(cfg, db)
+	ctx := GetClientContextMgr(cfg).NewClientCtx(cfg, db)
 	err := value.given.UpdateRecords(ctx, colData, "id6", []byte("wasn't"))
 	if err != nil {
 		t.Errorf("TestUpdateRecords: %v", err)
@@ -415,3 +427,45 @@ func TestUpdateRecords(t *testing.T) {
 	txn := ctx.CurrentTxn()
 	txn.unlockAll()
 }
+
+/* Records that grow move the ones after them, whose offsets can gain a digit. The page must still fit */
+func TestReplaceRecord(t *testing.T) {
+	blk, err := NewSizedBlock(nil, 0, 1, BLKSIZE)
+	if err != nil {
+		t.Fatalf("NewSizedBlock error: %v", err)
+	}
+	record := func(n int) []byte { return []byte(strings.Repeat("x", n)) }
+	// Ten records end just short of offset 1000, then a last one fills the page
+	sizes := []int{1, 988, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1000}
+	for slot, n := range sizes {
+		if err := blk.insertRecordAt(slot, record(n)); err != nil {
+			t.Fatalf("insertRecordAt error: %v", err)
+		}
+	}
+	const grow = 10
+	last := len(sizes) - 1
+	if err := blk.replaceRecord(last, record(sizes[last]+blk.freeSpace()-grow-2)); err != nil {
+		t.Fatalf("replaceRecord error: %v", err)
+	}
+
+	if err := blk.replaceRecord(0, record(1+grow)); !errors.Is(err, ErrBlockFull) {
+		t.Errorf("replaceRecord error: expected ErrBlockFull but got %v", err)
+	}
+	if blk.pageSize() > blk.blockSize() {
+		t.Errorf("replaceRecord error: page of %d bytes does not fit a block of %d", blk.pageSize(), blk.blockSize())
+	}
+	if err := blk.replaceRecord(0, record(2)); err != nil {
+		t.Errorf("replaceRecord error: %v", err)
+	}
+
+	// Undoing an insert into the last slot gives the slot back
+	if err := blk.undoInsert(last); err != nil {
+		t.Fatalf("undoInsert error: %v", err)
+	}
+	if err := blk.undoInsert(0); err != nil {
+		t.Fatalf("undoInsert error: %v", err)
+	}
+	if len(blk.recLocation) != last || !blk.isDeleted(0) {
+		t.Errorf("undoInsert error: expected %d slots with slot 0 deleted but got %d", last, len(blk.recLocation))
+	}
+}
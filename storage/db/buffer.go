@@ -1,31 +1,33 @@
 package db
 
 import (
+	"errors"
 	"fmt"
 	"log/slog"
-	"math"
-	"reflect"
+	"sync"
 	"sync/atomic"
+	"unsafe"
 
+	cfg "github.com/misachi/DarDB/config"
 	dsk "github.com/misachi/DarDB/storage"
-	ds "github.com/misachi/DarDB/structure"
 )
 
-type Pool interface {
-	Pop() interface{}
-	Get(key interface{}) interface{}
-	Push(_key interface{}, _data interface{})
-	Remove(key interface{})
-	Head() interface{}
-}
-
-var BufMgr *BufferPoolMgr
+var (
+	ErrBlockPinned    = errors.New("block is pinned")
+	ErrBlockNotCached = errors.New("block is not in the buffer pool")
+	ErrBlockNotPinned = errors.New("block is not pinned")
+)
 
 const (
 	ALIGN      = BLKSIZE
 	ALIGN_MASK = (ALIGN - 1)
 )
 
+const (
+	BUFFER_POOL_SIZE  = 128 << 20 // Default for Config.BufferSize
+	BUFFER_MIN_FRAMES = 16        // Frames a pool holds however small Config.BufferSize is
+)
+
 func isAligned(val int64) bool {
 	return (val & ALIGN_MASK) == 0
 }
@@ -38,77 +40,77 @@ func alignBlock(sz int64) int64 {
 	}
 }
 
-func GetBufMgr() *BufferPoolMgr {
-	if BufMgr == nil {
-		buf, err := NewBufferPoolMgr()
-		if err != nil {
-			panic(err)
-		}
-		return buf
+/* alignedBuffer returns sz zeroed bytes starting at a multiple of ALIGN, with capacity for whole blocks, as O_DIRECT needs */
+func alignedBuffer(sz int64) []byte {
+	n := alignBlock(sz)
+	buf := make([]byte, n+ALIGN)
+	off := int64(uintptr(unsafe.Pointer(&buf[0]))) & ALIGN_MASK
+	if off != 0 {
+		off = ALIGN - off
 	}
-	return BufMgr
+	return buf[off : off+sz : off+n]
+}
+
+/* GetBufMgr returns the buffer pool of the databases opened with config */
+func GetBufMgr(config *cfg.Config) *BufferPoolMgr {
+	return getEngine(config).buf
 }
 
 type BufferPoolMgr struct {
 	blkCount atomic.Int64 // number of blocks
-	block    Pool
-	// freeList Pool
+	hits     atomic.Int64 // Blocks asked for that were in the pool
+	reads    atomic.Int64 // Blocks asked for that were read from disk
+	pages    *pageTable
+	files    *fileMgr
+	wal      *WalMgr    // Made durable up to a block's LSN before the block is written, nil if nothing is logged
+	flushMtx sync.Mutex // Serializes flushes so an older image of a block never lands after a newer one
+	// ckptLock is held shared by anything that logs a change and applies it to a block, and by block
+	// writes. A checkpoint takes it exclusively while it builds the dirty page table so every change
+	// is either on a dirty block or already written.
+	ckptLock    sync.RWMutex
+	fullPageLSN atomic.Uint64          // Where the last checkpoint started. The first change to a block older than it logs a full page image
+	capacity    int64                  // Blocks the pool holds before a fetch evicts one, 0 for no limit
+	clock       atomic.Uint64          // Shard the next eviction sweep starts at
+	inUse       func(key pageKey) bool // Reports blocks running transactions hold row locks on, which are never evicted
 }
 
 func NewBufferPoolMgr() (*BufferPoolMgr, error) {
-	if BufMgr != nil {
-		return BufMgr, nil
-	}
 	// mgr, err := dsk.NewDiskMgr(tblID)
 	// if err != nil {
 	// 	return nil, fmt.Errorf("NewBufferPoolMgr: Unable to create new file manager %v", err)
 	// }
-	BufMgr = &BufferPoolMgr{
+	buf := &BufferPoolMgr{
 		// blkCount: 0, // int64(math.Ceil(float64(alignBlock(mgr.Size()))/BLKSIZE)),
-		block:    ds.NewList(),
+		pages: newPageTable(),
+		files: newFileMgr(),
 	}
 
-	BufMgr.blkCount.Store(0)
-	return BufMgr, nil
+	buf.blkCount.Store(0)
+	return buf, nil
 }
 
-func NewInternalBufferPoolMgr(psize int64, fName string) (*BufferPoolMgr, error) {
-	mgr, err := dsk.NewDiskMgr(fName)
-	if err != nil {
-		return nil, fmt.Errorf("NewInternalBufferPoolMgr: Unable to create new file manager %v", err)
+/* setCapacity limits the pool to size bytes of BLKSIZE blocks, BUFFER_POOL_SIZE if size is 0 */
+func (buf *BufferPoolMgr) setCapacity(size uint64) {
+	if size == 0 {
+		size = BUFFER_POOL_SIZE
 	}
-	BufMgr = &BufferPoolMgr{
-		// blkCount: int64(math.Ceil(float64(alignBlock(mgr.Size())) / BLKSIZE)),
-		block:    ds.NewList(),
+	buf.capacity = int64(size / BLKSIZE)
+	if buf.capacity < BUFFER_MIN_FRAMES {
+		buf.capacity = BUFFER_MIN_FRAMES
 	}
-	BufMgr.blkCount.Store(int64(math.Ceil(float64(alignBlock(mgr.Size())) / BLKSIZE)))
-	return BufMgr, nil
 }
 
+/* Load reads every page of the table's data file into the pool. Blocks never written are skipped */
 func (buf *BufferPoolMgr) Load(tblID dsk.Tbl_t, loc string) error {
-	mgr, err := dsk.NewDiskMgr(loc)
+	buf.files.registerPath(tblID, loc)
+	store, err := buf.files.store(loc)
 	if err != nil {
-		return fmt.Errorf("Load: Unable to create new file manager %v", err)
+		return fmt.Errorf("Load: Unable to open data file %w", err)
 	}
-	fData := make([]byte, mgr.Size())
-
-	if _, err := mgr.Read(fData); err != nil {
-		return fmt.Errorf("Load: error reading file %v", err)
-	}
-
-	blockID := 1
-	for {
-		if len(fData) < 1 {
-			break
-		}
-		blk, err := NewBlock(fData[:BLKSIZE], dsk.Blk_t(blockID), tblID)
-		if err != nil {
-			return fmt.Errorf("Load: error creating new block %v", err)
+	for blockID := dsk.Blk_t(0); int64(blockID) < store.numBlocks(); blockID++ {
+		if _, err := buf.getBlock(nil, loc, tblID, blockID, false); err != nil && !errors.Is(err, ErrBlockNotFound) {
+			return fmt.Errorf("Load: %w", err)
 		}
-		key := fmt.Sprintf("%d_%d", tblID, blk.blockId)
-		buf.AddBlockToPool(key, blk)
-		fData = fData[BLKSIZE:]
-		blockID += 1
 	}
 	return nil
 }
@@ -117,273 +119,649 @@ func (buf *BufferPoolMgr) NumBlocks() int64 {
 	return buf.blkCount.Load()
 }
 
-func (buf *BufferPoolMgr) AddBlockToPool(key string, blk *Block) {
-	buf.blkCount.Add(1)
-	buf.block.Push(key, blk)
+/* BufferStats counts the blocks asked of the pool since it was created */
+type BufferStats struct {
+	Hits  int64 // Found in the pool
+	Reads int64 // Read from disk
 }
 
+/* Stats returns the block counts of every caller of the pool. ClientContext.BufferStats counts those of one client */
+func (buf *BufferPoolMgr) Stats() BufferStats {
+	return BufferStats{Hits: buf.hits.Load(), Reads: buf.reads.Load()}
+}
+
+/* AddBlockToPool caches blk under its table and block IDs. A block already cached under the same IDs is kept */
+func (buf *BufferPoolMgr) AddBlockToPool(blk *Block) {
+	buf.addBlockToPool(newPageKey(blk.tblId, blk.blockId), blk)
+}
+
+func (buf *BufferPoolMgr) addBlockToPool(key pageKey, blk *Block) *Block {
+	blk.files = buf.files
+	blk, added := buf.pages.put(key, blk)
+	if added {
+		buf.blkCount.Add(1)
+	}
+	return blk
+}
+
+/* GetBlock returns the block without pinning it. Table, transaction and iterator code should use FetchBlock */
 func (buf *BufferPoolMgr) GetBlock(path string, tblId dsk.Tbl_t, blockId dsk.Blk_t) (*Block, error) {
-	key := fmt.Sprintf("%d_%d", tblId, blockId)
+	return buf.getBlock(nil, path, tblId, blockId, false)
+}
 
-	if blk := buf.block.Get(key); blk != nil {
-		return blk.(*Block), nil
+func (buf *BufferPoolMgr) pinBlock(key pageKey) *Block {
+	shard := buf.pages.lock(key)
+	defer shard.mtx.Unlock()
+	blk := shard.frames[key]
+	if blk != nil {
+		blk.pinCount++
+		blk.used = true
 	}
+	return blk
+}
 
-	mgr, err := dsk.NewDiskMgr(path)
-	if err != nil {
-		return nil, fmt.Errorf("GetBlock: Unable to create new disk manager %v", err)
+/* getBlock returns the block, reading it into the pool if needed. The block is counted for ctx too, unless ctx is nil */
+func (buf *BufferPoolMgr) getBlock(ctx *ClientContext, path string, tblId dsk.Tbl_t, blockId dsk.Blk_t, pin bool) (*Block, error) {
+	key := newPageKey(tblId, blockId)
+	buf.files.registerPath(tblId, path)
+
+	var blk *Block
+	if pin {
+		blk = buf.pinBlock(key)
+	} else {
+		blk = buf.pages.get(key)
+	}
+	if blk != nil {
+		buf.hits.Add(1)
+		if ctx != nil {
+			ctx.hits.Add(1)
+		}
+		return blk, nil
 	}
 
-	_, err = mgr.Seek(int64(blockId), 0)
+	store, err := buf.files.store(path)
 	if err != nil {
-		return nil, fmt.Errorf("GetBlock: Seek error %v", err)
+		return nil, fmt.Errorf("GetBlock: Unable to open data file %w", err)
+	}
+
+	buf.makeRoom()
+	blkData, err := store.readPage(blockId)
+	if err == errTornPage || errors.Is(err, ErrBadCompression) || errors.Is(err, dsk.ErrDecrypt) {
+		return nil, fmt.Errorf("GetBlock: %w", &ErrCorruptPage{Table: tblId, Block: blockId, Offset: store.offset(blockId), Err: err})
 	}
-	blkData := make([]byte, BLKSIZE)
-	_, err = mgr.Read(blkData)
 	if err != nil {
-		return nil, fmt.Errorf("GetBlock: Read error %v", err)
+		return nil, fmt.Errorf("GetBlock: Read error %w", err)
 	}
-	blk, err := NewBlock(blkData, blockId, tblId)
+	buf.reads.Add(1)
+	if ctx != nil {
+		ctx.reads.Add(1)
+	}
+	blk, err = decodePage(blkData, blockId, tblId, store.blockSize())
 	if err != nil {
-		return nil, fmt.Errorf("GetBlock: new block error %v", err)
+		return nil, fmt.Errorf("GetBlock: %w", &ErrCorruptPage{Table: tblId, Block: blockId, Offset: store.offset(blockId), Err: err})
 	}
 	blk.tblId = tblId
-	buf.AddBlockToPool(key, blk)
+
+	// Another caller may have loaded the block while we were reading it
+	blk = buf.addBlockToPool(key, blk)
+	if pin {
+		if blk = buf.pinBlock(key); blk == nil {
+			return nil, fmt.Errorf("GetBlock: %d_%d: %w", tblId, blockId, ErrBlockNotCached)
+		}
+	}
 	return blk, nil
 }
 
+/* GetFree returns a block with room for sz bytes without pinning it. Table code should use FetchFree */
 func (buf *BufferPoolMgr) GetFree(path string, tblId dsk.Tbl_t, sz int) *Block {
-	next := buf.block.Head()
-	for !reflect.ValueOf(next.(*ds.Value)).IsNil() {
-		key := fmt.Sprintf("%d_%d", tblId, next.(*ds.Value).Data().(*Block).blockId)
-		if next.(*ds.Value).Data().(*Block).Size() >= sz && reflect.ValueOf(next.(*ds.Value).Key()).String() == key {
-			return next.(*ds.Value).Data().(*Block)
-		}
-		next = next.(*ds.Value).Next()
-	}
+	return buf.getFree(nil, path, tblId, sz, false)
+}
 
-	mgr, err := dsk.NewDiskMgr(path)
+func (buf *BufferPoolMgr) getFree(ctx *ClientContext, path string, tblId dsk.Tbl_t, sz int, pin bool) *Block {
+	buf.files.registerPath(tblId, path)
+	fsm, err := buf.files.fsm(tblId, path)
 	if err != nil {
-		slog.Warn("GetFree: Unable to create new disk manager %v", err)
+		slog.Warn("GetFree: Unable to load free space map", "err", err)
 		return nil
 	}
 
-	fileSize := mgr.Size()
-	newBlkID := (math.Ceil(float64(fileSize)/BLKSIZE) * BLKSIZE) + 1
-	blk, err := NewBlock(make([]byte, 0), dsk.Blk_t(newBlkID), tblId)
-	if err != nil {
-		slog.Warn("GetFree: Unable to create new block %v", err)
-		return nil
+	blockSize := buf.files.blockSize(path)
+	need := recordSpace(sz, blockSize)
+	for {
+		blockId, ok := fsm.Search(need)
+		if !ok {
+			break
+		}
+		blk, err := buf.getBlock(ctx, path, tblId, blockId, pin)
+		if errors.Is(err, ErrBlockNotFound) {
+			// Handed out before but never written
+			return buf.newBlock(tblId, blockId, blockSize, pin)
+		}
+		free := 0
+		if err == nil {
+			blk.mut.RLock()
+			free = blk.freeSpace()
+			blk.mut.RUnlock()
+		}
+		if err == nil && free >= need {
+			return blk
+		}
+
+		// The map was stale
+		if err == nil && pin {
+			buf.UnpinBlock(tblId, blockId, false)
+		}
+		fsm.Update(blockId, free)
 	}
 
-	key := fmt.Sprintf("%d_%d", tblId, blk.blockId)
-	blk.tblId = tblId
-	buf.AddBlockToPool(key, blk)
-	return blk
+	blk, _ := NewSizedBlock(nil, 0, tblId, blockSize)
+	return buf.newBlock(tblId, fsm.Extend(blk.freeSpace()), blockSize, pin)
 }
 
-func (buf *BufferPoolMgr) writeBlock(path string, blk *Block) {
-	mgr, err := dsk.NewDiskMgr(path)
-	if err != nil {
-		panic(fmt.Sprintf("flushBlock: Unable to create new disk manager: %v", err))
+/* newBlock pools an empty block of blockSize bytes, unless another caller pooled the block first */
+func (buf *BufferPoolMgr) newBlock(tblId dsk.Tbl_t, blockId dsk.Blk_t, blockSize int, pin bool) *Block {
+	blk, _ := NewSizedBlock(nil, blockId, tblId, blockSize)
+	key := newPageKey(tblId, blockId)
+	buf.makeRoom()
+	buf.addBlockToPool(key, blk)
+	if pin {
+		return buf.pinBlock(key)
 	}
+	return buf.pages.get(key)
+}
 
-	if _, err := mgr.Seek(int64(blk.blockId), 0); err != nil {
-		panic(fmt.Sprintf("flushBlock Seek: %v", err))
+/* recordFree notes the room left in blk in the free space map. Callers hold blk.mut */
+func (buf *BufferPoolMgr) recordFree(blk *Block) {
+	if fsm := buf.files.loadedFsm(blk.tblId); fsm != nil {
+		fsm.Update(blk.blockId, blk.freeSpace())
 	}
+}
 
-	if _, err = mgr.Write(blk.ToByte(), mgr.Size()); err != nil {
-		panic(fmt.Sprintf("flushBlock Write: %v", err))
+/* TableBlocks is the number of blocks in the table, including those not written yet */
+func (buf *BufferPoolMgr) TableBlocks(path string, tblId dsk.Tbl_t) (int, error) {
+	buf.files.registerPath(tblId, path)
+	fsm, err := buf.files.fsm(tblId, path)
+	if err != nil {
+		return 0, fmt.Errorf("TableBlocks: %v", err)
 	}
+	return fsm.NumBlocks(), nil
+}
 
-	blk.ResetIsDirtyFlag()
+/* FetchBlock pins the block in the pool. The block stays pinned until the returned guard is closed */
+func (buf *BufferPoolMgr) FetchBlock(path string, tblId dsk.Tbl_t, blockId dsk.Blk_t) (*BlockGuard, error) {
+	return buf.fetchBlock(nil, path, tblId, blockId)
 }
 
-func (buf *BufferPoolMgr) WriteBlock(path string, tblId dsk.Tbl_t, blockID dsk.Blk_t) {
-	defer func() {
-		if r := recover(); r != nil {
-			slog.Error("WriteBlock error: %v", r)
-		}
-	}()
+/* fetchBlock is FetchBlock for a client, which the block is counted for */
+func (buf *BufferPoolMgr) fetchBlock(ctx *ClientContext, path string, tblId dsk.Tbl_t, blockId dsk.Blk_t) (*BlockGuard, error) {
+	blk, err := buf.getBlock(ctx, path, tblId, blockId, true)
+	if err != nil {
+		return nil, fmt.Errorf("FetchBlock: %w", err)
+	}
+	return newBlockGuard(buf, blk), nil
+}
 
-	key := fmt.Sprintf("%d_%d", tblId, blockID)
-	blk := buf.block.Get(key)
-	if blk != nil {
-		buf.writeBlock(path, blk.(*Block))
+/* FetchFree pins a block with room for sz bytes. The block stays pinned until the returned guard is closed */
+func (buf *BufferPoolMgr) FetchFree(path string, tblId dsk.Tbl_t, sz int) (*BlockGuard, error) {
+	return buf.fetchFree(nil, path, tblId, sz)
+}
+
+/* fetchFree is FetchFree for a client, which the blocks it looks at are counted for */
+func (buf *BufferPoolMgr) fetchFree(ctx *ClientContext, path string, tblId dsk.Tbl_t, sz int) (*BlockGuard, error) {
+	blk := buf.getFree(ctx, path, tblId, sz, true)
+	if blk == nil {
+		return nil, fmt.Errorf("FetchFree: no free block for table %d", tblId)
 	}
+	return newBlockGuard(buf, blk), nil
 }
 
-func (buf *BufferPoolMgr) Flush(path string, tblId dsk.Tbl_t) error {
-	mgr, err := dsk.NewDiskMgr(path)
-	if err != nil {
-		return fmt.Errorf("BufferPoolMgr Flush: Unable to create new disk manager: %v", err)
+/* UnpinBlock drops one pin on the block. A dirty unpin marks the block for writing */
+func (buf *BufferPoolMgr) UnpinBlock(tblId dsk.Tbl_t, blockId dsk.Blk_t, dirty bool) error {
+	key := newPageKey(tblId, blockId)
+	shard := buf.pages.lock(key)
+	defer shard.mtx.Unlock()
+
+	blk := shard.frames[key]
+	if blk == nil {
+		return fmt.Errorf("UnpinBlock: %d_%d: %w", tblId, blockId, ErrBlockNotCached)
+	}
+	if blk.pinCount <= 0 {
+		return fmt.Errorf("UnpinBlock: %d_%d: %w", tblId, blockId, ErrBlockNotPinned)
+	}
+	blk.pinCount--
+	if dirty {
+		blk.mut.Lock()
+		blk.isDirty = true
+		blk.mut.Unlock()
+	}
+	return nil
+}
+
+/* IsPinned reports whether a pooled block is in use */
+func (buf *BufferPoolMgr) IsPinned(tblId dsk.Tbl_t, blockId dsk.Blk_t) bool {
+	key := newPageKey(tblId, blockId)
+	shard := buf.pages.lock(key)
+	defer shard.mtx.Unlock()
+
+	if blk := shard.frames[key]; blk != nil {
+		return blk.pinCount > 0
 	}
+	return false
+}
 
-	if err := mgr.Flush(); err != nil {
-		return fmt.Errorf("BufferPoolMgr Flush error: %v", err)
+/*
+Evict writes the block if it is dirty and drops it from the pool. Pinned blocks, and blocks running
+transactions hold row locks on, cannot be evicted.
+*/
+func (buf *BufferPoolMgr) Evict(path string, tblId dsk.Tbl_t, blockId dsk.Blk_t) error {
+	buf.files.registerPath(tblId, path)
+	buf.flushMtx.Lock()
+	defer buf.flushMtx.Unlock()
+	buf.ckptLock.RLock()
+	defer buf.ckptLock.RUnlock()
+	if err := buf.dropFrame(newPageKey(tblId, blockId)); err != nil {
+		return fmt.Errorf("Evict: %w", err)
 	}
 	return nil
 }
 
-type BufferPoolMgr2 struct {
-	poolLength  uint
-	poolSize    int64 // number of blocks
-	tblID       dsk.Tbl_t
-	diskManager *dsk.DiskMgr
-	block       Pool
-	freeList    Pool
+/*
+dropFrame writes the block if it is dirty and drops it from the pool. The page is written, like
+every flush, under flushMtx but not the shard lock; a block changed while it was written is written
+again before it is dropped. Callers hold flushMtx and buf.ckptLock shared.
+*/
+func (buf *BufferPoolMgr) dropFrame(key pageKey) error {
+	for {
+		shard := buf.pages.lock(key)
+		blk := shard.frames[key]
+		if blk == nil {
+			shard.mtx.Unlock()
+			return nil
+		}
+		if blk.pinCount > 0 || (buf.inUse != nil && buf.inUse(key)) {
+			shard.mtx.Unlock()
+			return fmt.Errorf("%d_%d: %w", key.tbl, key.blk, ErrBlockPinned)
+		}
+		frame, dirty := takeFrame(key, blk)
+		if !dirty {
+			delete(shard.frames, key)
+			buf.blkCount.Add(-1)
+			shard.mtx.Unlock()
+			return nil
+		}
+		shard.mtx.Unlock()
+		if _, err := buf.writeFrames([]dirtyFrame{frame}); err != nil {
+			return err
+		}
+	}
 }
 
-func NewBufferPoolMgr2(psize int64, fName string, tblID dsk.Tbl_t) (*BufferPoolMgr, error) {
-	if BufMgr != nil {
-		return BufMgr, nil
+/*
+makeRoom evicts blocks while the pool is full. The pool grows past its capacity instead when every
+block is pinned or locked, or only dirty blocks are left and a flush or checkpoint is running.
+*/
+func (buf *BufferPoolMgr) makeRoom() {
+	if buf.capacity <= 0 {
+		return
+	}
+	for buf.blkCount.Load() >= buf.capacity {
+		if !buf.evictOne() {
+			return
+		}
 	}
-	mgr, err := dsk.NewDiskMgr(fName)
-	if err != nil {
-		return nil, fmt.Errorf("NewBufferPoolMgr: Unable to create new manager %v", err)
+}
+
+/*
+evictOne drops one block from the pool, picked by a clock sweep over the shards: a block asked for
+since the sweep last passed it is spared once. Clean blocks are dropped as the sweep finds them. A
+dirty block is written first, which waits for neither a running flush nor a checkpoint, since the
+caller may hold buf.ckptLock already.
+*/
+func (buf *BufferPoolMgr) evictOne() bool {
+	var victim *pageKey
+	for i := 0; i < 2*PAGE_TABLE_SHARDS; i++ {
+		shard := &buf.pages.shards[buf.clock.Add(1)%PAGE_TABLE_SHARDS]
+		shard.mtx.Lock()
+		for key, blk := range shard.frames {
+			if blk.pinCount > 0 || (buf.inUse != nil && buf.inUse(key)) {
+				continue
+			}
+			if blk.used {
+				blk.used = false
+				continue
+			}
+			blk.mut.RLock()
+			dirty := blk.isDirty
+			blk.mut.RUnlock()
+			if !dirty {
+				delete(shard.frames, key)
+				buf.blkCount.Add(-1)
+				shard.mtx.Unlock()
+				return true
+			}
+			if victim == nil {
+				victim = &pageKey{tbl: key.tbl, blk: key.blk}
+			}
+		}
+		shard.mtx.Unlock()
+	}
+	if victim == nil || !buf.flushMtx.TryLock() {
+		return false
+	}
+	defer buf.flushMtx.Unlock()
+	if !buf.ckptLock.TryRLock() {
+		return false
 	}
-	BufMgr = &BufferPoolMgr{
-		// blkCount: int64(math.Ceil(float64(alignBlock(mgr.Size())) / BLKSIZE)), //  alignBlock(mgr.Size()) / BLKSIZE,
-		// diskManager: mgr,
-		block: ds.NewList(),
-		// freeList:    ds.NewList(),
-		// tblID:       tblID,
+	defer buf.ckptLock.RUnlock()
+	if err := buf.dropFrame(*victim); err != nil {
+		slog.Warn("evictOne: unable to evict block", "table", victim.tbl, "block", victim.blk, "err", err)
+		return false
 	}
-	BufMgr.blkCount.Store(int64(math.Ceil(float64(alignBlock(mgr.Size())) / BLKSIZE)))
-	return BufMgr, nil
+	return true
 }
 
-func NewInternalBufferPoolMgr2(psize int64, fName string) (*BufferPoolMgr, error) {
-	mgr, err := dsk.NewDiskMgr(fName)
+/* writePage writes an encoded page at the block's offset. The WAL is made durable up to lsn first */
+func (buf *BufferPoolMgr) writePage(path string, blockId dsk.Blk_t, page []byte, lsn wal_t) error {
+	if buf.wal != nil && lsn > 0 {
+		if err := buf.wal.Flush(lsn); err != nil {
+			return fmt.Errorf("writePage: WAL flush error: %v", err)
+		}
+	}
+
+	store, err := buf.files.store(path)
 	if err != nil {
-		return nil, fmt.Errorf("BufferPoolMgr: Unable to create new manager %v", err)
+		return fmt.Errorf("writePage: Unable to open data file: %v", err)
 	}
-	BufMgr = &BufferPoolMgr{
-		// blkCount: int64(math.Ceil(float64(alignBlock(mgr.Size())) / BLKSIZE)),
-		// diskManager: mgr,
-		block: ds.NewList(),
-		// freeList:    ds.NewList(),
+	if err := store.writePage(blockId, page); err != nil {
+		return fmt.Errorf("writePage: %v", err)
 	}
-	BufMgr.blkCount.Store(int64(math.Ceil(float64(alignBlock(mgr.Size())) / BLKSIZE)))
-	return BufMgr, nil
+	return nil
 }
 
-func (buf *BufferPoolMgr2) NumBlocks() int64 {
-	return buf.poolSize
+/* WriteBlock writes the block if it is dirty, pinned or not */
+func (buf *BufferPoolMgr) WriteBlock(path string, tblId dsk.Tbl_t, blockID dsk.Blk_t) {
+	buf.files.registerPath(tblId, path)
+	key := newPageKey(tblId, blockID)
+	buf.flushMtx.Lock()
+	defer buf.flushMtx.Unlock()
+	buf.ckptLock.RLock()
+	defer buf.ckptLock.RUnlock()
+
+	frames := make([]dirtyFrame, 0, 1)
+	shard := buf.pages.lock(key)
+	if blk := shard.frames[key]; blk != nil {
+		if frame, dirty := takeFrame(key, blk); dirty {
+			frames = append(frames, frame)
+		}
+	}
+	shard.mtx.Unlock()
+	if _, err := buf.writeFrames(frames); err != nil {
+		slog.Error("WriteBlock error", "err", err)
+	}
 }
 
-func (buf *BufferPoolMgr2) Load() error {
-	fData := make([]byte, buf.diskManager.Size())
-	_, err := buf.diskManager.Read(fData)
+func (buf *BufferPoolMgr) Flush(path string, tblId dsk.Tbl_t) error {
+	store, err := buf.files.store(path)
 	if err != nil {
-		return fmt.Errorf("Load: error reading file %v", err)
+		return fmt.Errorf("BufferPoolMgr Flush: Unable to open data file: %v", err)
+	}
+	if err := store.sync(); err != nil {
+		return fmt.Errorf("BufferPoolMgr Flush error: %v", err)
 	}
+	return nil
+}
 
-	blockID := 1
-	for {
-		if len(fData) < 1 {
-			break
+type dirtyFrame struct {
+	key    pageKey
+	page   []byte
+	lsn    wal_t
+	recLSN wal_t
+}
+
+/*
+flushFrames writes up to max dirty frames that are not pinned, or all of them when max <= 0. Only
+frames for which match returns true are written; a nil match writes frames of any table. The page
+image is taken under the shard lock so the write never sees a half applied change.
+*/
+func (buf *BufferPoolMgr) flushFrames(max int, match func(key pageKey) bool) (int, error) {
+	buf.flushMtx.Lock()
+	defer buf.flushMtx.Unlock()
+	buf.ckptLock.RLock()
+	defer buf.ckptLock.RUnlock()
+	return buf.writeFrames(buf.dirtyFrames(max, match, false))
+}
+
+/* dirtyFrames takes the page images of dirty frames and marks the frames clean. Pinned frames are skipped unless the caller holds buf.ckptLock exclusively */
+func (buf *BufferPoolMgr) dirtyFrames(max int, match func(key pageKey) bool, pinned bool) []dirtyFrame {
+	frames := make([]dirtyFrame, 0)
+	for i := range buf.pages.shards {
+		shard := &buf.pages.shards[i]
+		shard.mtx.Lock()
+		for key, blk := range shard.frames {
+			if max > 0 && len(frames) >= max {
+				break
+			}
+			if (blk.pinCount > 0 && !pinned) || (match != nil && !match(key)) {
+				continue
+			}
+			if frame, dirty := takeFrame(key, blk); dirty {
+				frames = append(frames, frame)
+			}
 		}
-		blk, err := NewBlock(fData[:BLKSIZE], dsk.Blk_t(blockID), buf.tblID)
-		buf.poolSize += 1
-		if err != nil {
-			return fmt.Errorf("Load: error creating new block %v", err)
+		shard.mtx.Unlock()
+	}
+	return frames
+}
+
+/* takeFrame takes the page image of the block if it is dirty and marks it clean. Callers hold the shard lock */
+func takeFrame(key pageKey, blk *Block) (dirtyFrame, bool) {
+	blk.mut.Lock()
+	defer blk.mut.Unlock()
+	if !blk.isDirty {
+		return dirtyFrame{}, false
+	}
+	frame := dirtyFrame{key: key, page: encodePage(blk), lsn: blk.lsn, recLSN: blk.recLSN}
+	blk.isDirty = false
+	blk.recLSN = 0
+	return frame, true
+}
+
+/* writeFrames writes page images taken by dirtyFrames. Frames that fail are marked dirty again. Callers hold flushMtx */
+func (buf *BufferPoolMgr) writeFrames(frames []dirtyFrame) (int, error) {
+	written := 0
+	var firstErr error
+	for _, frame := range frames {
+		err := func() error {
+			path, ok := buf.files.path(frame.key.tbl)
+			if !ok {
+				return fmt.Errorf("flushFrames: no data file for table %d", frame.key.tbl)
+			}
+			return buf.writePage(path, frame.key.blk, frame.page, frame.lsn)
+		}()
+		if err == nil {
+			written++
+			continue
 		}
-		buf.block.Push(int64(blk.blockId), blk)
-		fData = fData[BLKSIZE:]
-		blockID += 1
+		if firstErr == nil {
+			firstErr = err
+		}
+		// Leave the frame dirty so a later round retries it
+		shard := buf.pages.lock(frame.key)
+		if blk := shard.frames[frame.key]; blk != nil {
+			blk.mut.Lock()
+			blk.isDirty = true
+			if blk.recLSN == 0 || (frame.recLSN > 0 && frame.recLSN < blk.recLSN) {
+				blk.recLSN = frame.recLSN
+			}
+			blk.mut.Unlock()
+		}
+		shard.mtx.Unlock()
 	}
-	return nil
+	return written, firstErr
 }
 
-func (buf *BufferPoolMgr2) GetBlock(blockId int64) (*Block, error) {
-	if blk := buf.block.Get(blockId); blk != nil {
-		return blk.(*Block), nil
+/* FlushTable writes the dirty blocks of the table and syncs its data file */
+func (buf *BufferPoolMgr) FlushTable(path string, tblId dsk.Tbl_t) error {
+	buf.files.registerPath(tblId, path)
+	if _, err := buf.flushFrames(0, func(key pageKey) bool { return key.tbl == tblId }); err != nil {
+		return fmt.Errorf("FlushTable: %v", err)
 	}
-	_, err := buf.diskManager.Seek(int64(blockId), 0)
-	if err != nil {
-		return nil, fmt.Errorf("GetBlock: Seek error %v", err)
+	if err := buf.Flush(path, tblId); err != nil {
+		return fmt.Errorf("FlushTable: %v", err)
 	}
-	blkData := make([]byte, BLKSIZE)
-	_, err = buf.diskManager.Read(blkData)
-	if err != nil {
-		return nil, fmt.Errorf("GetBlock: Read error %v", err)
+	if fsm := buf.files.loadedFsm(tblId); fsm != nil {
+		if err := fsm.Save(); err != nil {
+			return fmt.Errorf("FlushTable: %v", err)
+		}
 	}
-	blk, err := NewBlock(blkData, 0, 0)
-	if err != nil {
-		return nil, fmt.Errorf("GetBlock: new block error %v", err)
+	return nil
+}
+
+/* FlushAll writes every dirty block that is not pinned and syncs all data files */
+func (buf *BufferPoolMgr) FlushAll() error {
+	if _, err := buf.flushFrames(0, nil); err != nil {
+		return fmt.Errorf("FlushAll: %v", err)
 	}
-	buf.block.Push(int64(blk.blockId), blk)
-	return blk, nil
+	return buf.syncFiles()
 }
 
-func (buf *BufferPoolMgr2) GetFree(sz int) *Block {
-	blk := buf.block.Head()
-	if blk == nil {
-		blk = buf.freeList.Head()
+func (buf *BufferPoolMgr) syncFiles() error {
+	for _, path := range buf.files.allPaths() {
+		if err := buf.Flush(path, 0); err != nil {
+			return fmt.Errorf("syncFiles: %v", err)
+		}
+	}
+	for _, fsm := range buf.files.allFsms() {
+		if err := fsm.Save(); err != nil {
+			return fmt.Errorf("syncFiles: %v", err)
+		}
 	}
+	return nil
+}
 
-	if reflect.ValueOf(blk.(*ds.Value)).IsNil() {
-		data := make([]byte, 0)
-		fileSize := buf.diskManager.Size()
-		if buf.NumBlocks() <= 0 {
-			_blk, err := NewBlock(data, dsk.Blk_t(fileSize), buf.tblID)
-			if err != nil {
-				return nil
-			}
-			buf.poolSize += 1
-			buf.block.Push(fileSize, _blk)
-			return _blk
-		} else {
-			blkID := buf.NumBlocks() - 1
-			_blk, err := buf.GetBlock(blkID)
-			if err != nil {
-				return nil
+/* dirtyPageTable maps every block with unwritten changes to the LSN of its first change. Callers must hold buf.ckptLock */
+func (buf *BufferPoolMgr) dirtyPageTable() map[pageKey]wal_t {
+	dpt := make(map[pageKey]wal_t)
+	for i := range buf.pages.shards {
+		shard := &buf.pages.shards[i]
+		shard.mtx.Lock()
+		for key, blk := range shard.frames {
+			blk.mut.RLock()
+			if blk.recLSN > 0 {
+				dpt[key] = blk.recLSN
 			}
-			buf.block.Push(fileSize, _blk)
-			return _blk
+			blk.mut.RUnlock()
 		}
+		shard.mtx.Unlock()
+	}
+	return dpt
+}
+
+/* fetchOrCreate pins the block, creating an empty one if it does not exist on disk yet */
+func (buf *BufferPoolMgr) fetchOrCreate(path string, tblId dsk.Tbl_t, blockId dsk.Blk_t) (*BlockGuard, error) {
+	guard, err := buf.FetchBlock(path, tblId, blockId)
+	if err == nil {
+		return guard, nil
 	}
-	if blk != nil && blk.(*ds.Value).Data().(*Block).size > sz {
-		return blk.(*ds.Value).Data().(*Block)
+	if !errors.Is(err, ErrBlockNotFound) {
+		return nil, err
 	}
+	blk := buf.newBlock(tblId, blockId, buf.files.blockSize(path), true)
+	if blk == nil {
+		return nil, fmt.Errorf("fetchOrCreate: %d_%d: %w", tblId, blockId, ErrBlockNotCached)
+	}
+	return newBlockGuard(buf, blk), nil
+}
 
-	return nil
+/* restoreBlock replaces the pooled contents of the block with blk, read from a full page image, and pins it */
+func (buf *BufferPoolMgr) restoreBlock(path string, blk *Block) (*BlockGuard, error) {
+	buf.files.registerPath(blk.tblId, path)
+	key := newPageKey(blk.tblId, blk.blockId)
+	if cached := buf.addBlockToPool(key, blk); cached != blk {
+		shard := buf.pages.lock(key)
+		cached.mut.Lock()
+		cached.size = blk.size
+		cached.recLocation = blk.recLocation
+		cached.records = blk.records
+		cached.lsn = blk.lsn
+		cached.mut.Unlock()
+		shard.mtx.Unlock()
+	}
+	pinned := buf.pinBlock(key)
+	if pinned == nil {
+		return nil, fmt.Errorf("restoreBlock: %d_%d: %w", blk.tblId, blk.blockId, ErrBlockNotCached)
+	}
+	return newBlockGuard(buf, pinned), nil
 }
 
-func (buf *BufferPoolMgr2) flushBlock(blockID int, blk *Block) error {
-	_, err := buf.diskManager.Seek(int64(blockID), 0)
-	if err != nil {
-		return fmt.Errorf("flushBlock Seek: %v", err)
+/* dropFrames removes the pooled blocks of the table from keep on without writing them */
+func (buf *BufferPoolMgr) dropFrames(tblId dsk.Tbl_t, keep dsk.Blk_t) {
+	for i := range buf.pages.shards {
+		shard := &buf.pages.shards[i]
+		shard.mtx.Lock()
+		for key := range shard.frames {
+			if key.tbl == tblId && key.blk >= keep {
+				delete(shard.frames, key)
+				buf.blkCount.Add(-1)
+			}
+		}
+		shard.mtx.Unlock()
 	}
+}
 
-	_, err = buf.diskManager.Write(blk.ToByte(), 0)
+/* cutTable drops the blocks of the table from keep on from its free space map and data file. None of them may be pooled */
+func (buf *BufferPoolMgr) cutTable(path string, tblId dsk.Tbl_t, keep dsk.Blk_t) error {
+	fsm, err := buf.files.fsm(tblId, path)
 	if err != nil {
-		return fmt.Errorf("flushBlock Write: %v", err)
+		return fmt.Errorf("cutTable: %v", err)
+	}
+	fsm.Truncate(int(keep))
+	store, err := buf.files.store(path)
+	if err != nil {
+		return fmt.Errorf("cutTable: Unable to open data file %w", err)
+	}
+	if err := store.truncate(int64(keep)); err != nil {
+		return fmt.Errorf("cutTable: %v", err)
+	}
+	if err := store.sync(); err != nil {
+		return fmt.Errorf("cutTable: %v", err)
+	}
+	if err := fsm.Save(); err != nil {
+		return fmt.Errorf("cutTable: %v", err)
 	}
-
-	buf.diskManager.Flush()
-	buf.freeList.Push(int64(blockID), blk)
 	return nil
 }
 
-func (buf *BufferPoolMgr2) FlushBlock(blockID int) {
-	blk := buf.block.Get(int64(blockID))
-	if blk != nil {
-		buf.flushBlock(blockID, blk.(*Block))
-	}
-}
-
-// func (buf *BufferPoolMgr) Flush() error {
-// 	allBlks := make([]byte, buf.poolSize * BLKSIZE)
-// 	blk := buf.block.Head()
-// 	// for blk != nil {
-// 	// 	blk = blk.
-// 	// }
-// 	i := 0
-// 	for buf.poolSize > int64(i) && blk != nil {
-// 		allBlks = append(allBlks, )
-// 		i += 1
-// 	}
-// 	return nil
-// }
+/* BlockGuard holds a pin on a pooled block. Close releases the pin */
+type BlockGuard struct {
+	buf    *BufferPoolMgr
+	blk    *Block
+	dirty  bool
+	closed bool
+}
+
+func newBlockGuard(buf *BufferPoolMgr, blk *Block) *BlockGuard {
+	return &BlockGuard{buf: buf, blk: blk}
+}
+
+func (g *BlockGuard) Block() *Block {
+	return g.blk
+}
+
+/* MarkDirty records that the block was modified while pinned */
+func (g *BlockGuard) MarkDirty() {
+	g.dirty = true
+}
+
+func (g *BlockGuard) Close() error {
+	if g.closed {
+		return nil
+	}
+	g.closed = true
+	if g.dirty {
+		g.blk.mut.RLock()
+		g.buf.recordFree(g.blk)
+		g.blk.mut.RUnlock()
+	}
+	return g.buf.UnpinBlock(g.blk.tblId, g.blk.blockId, g.dirty)
+}
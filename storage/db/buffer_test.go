@@ -1,11 +1,15 @@
 package db
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"path"
+	"strings"
+	"sync"
 	"testing"
 
+	"github.com/misachi/DarDB/column"
 	st "github.com/misachi/DarDB/storage"
 )
 
@@ -23,7 +27,6 @@ func getFile(t *testing.T, tblID st.Tbl_t) string {
 
 func TestNewBufferPoolMgr(t *testing.T) {
 	poolSize := 0
-	BufMgr = nil
 	pmgr, err := NewBufferPoolMgr()
 	if err != nil {
 		t.Errorf("error creating buffer: %v", err)
@@ -35,7 +38,7 @@ func TestNewBufferPoolMgr(t *testing.T) {
 }
 
 func TestGetBlock(t *testing.T) {
-	var blockId st.Blk_t = 3
+	var blockId st.Blk_t = 2
 	var tblId st.Tbl_t = 4
 	f := getFile(t, tblId)
 	pmgr, _ := NewBufferPoolMgr()
@@ -43,6 +46,11 @@ func TestGetBlock(t *testing.T) {
 	if err != nil {
 		t.Errorf("Load error: %v", err)
 	}
+	for i := st.Blk_t(0); i <= blockId; i++ {
+		if pmgr.pages.get(newPageKey(tblId, i)) == nil {
+			t.Errorf("Load error: expected block %d to be pooled", i)
+		}
+	}
 	blk, err := pmgr.GetBlock(f, tblId, blockId)
 	if err != nil {
 		t.Errorf("GetBlock error: %v", err)
@@ -54,3 +62,296 @@ func TestGetBlock(t *testing.T) {
 		t.Errorf("GetBlock error: expected size to be %d but got %d", BLKSIZE, blk.size)
 	}
 }
+
+func TestFetchBlock(t *testing.T) {
+	var blockId st.Blk_t = 2
+	var tblId st.Tbl_t = 5
+	f := getFile(t, tblId)
+	pmgr, _ := NewBufferPoolMgr()
+	if err := pmgr.Load(tblId, f); err != nil {
+		t.Errorf("Load error: %v", err)
+	}
+
+	guard, err := pmgr.FetchBlock(f, tblId, blockId)
+	if err != nil {
+		t.Fatalf("FetchBlock error: %v", err)
+	}
+	guard2, err := pmgr.FetchBlock(f, tblId, blockId)
+	if err != nil {
+		t.Fatalf("FetchBlock error: %v", err)
+	}
+	if guard.Block() != guard2.Block() {
+		t.Errorf("FetchBlock error: expected both guards to share the pooled block")
+	}
+	if guard.Block().pinCount != 2 {
+		t.Errorf("FetchBlock error: expected pin count to be %d but got %d", 2, guard.Block().pinCount)
+	}
+
+	if err := pmgr.Evict(f, tblId, blockId); !errors.Is(err, ErrBlockPinned) {
+		t.Errorf("Evict error: expected %v but got %v", ErrBlockPinned, err)
+	}
+
+	guard.MarkDirty()
+	guard.Close()
+	guard.Close() // Closing twice must not drop a second pin
+	if !pmgr.IsPinned(tblId, blockId) {
+		t.Errorf("UnpinBlock error: expected block to still be pinned")
+	}
+	if !guard.Block().isDirty {
+		t.Errorf("UnpinBlock error: expected block to be dirty")
+	}
+
+	guard2.Close()
+	if pmgr.IsPinned(tblId, blockId) {
+		t.Errorf("UnpinBlock error: expected block to be unpinned")
+	}
+	if err := pmgr.UnpinBlock(tblId, blockId, false); !errors.Is(err, ErrBlockNotPinned) {
+		t.Errorf("UnpinBlock error: expected %v but got %v", ErrBlockNotPinned, err)
+	}
+}
+
+func TestBufferStats(t *testing.T) {
+	var tblId st.Tbl_t = 6
+	f := getFile(t, tblId)
+	pmgr := &BufferPoolMgr{pages: newPageTable(), files: newFileMgr()}
+	for i, expected := range []BufferStats{{Reads: 1}, {Hits: 1, Reads: 1}} {
+		guard, err := pmgr.FetchBlock(f, tblId, 1)
+		if err != nil {
+			t.Fatalf("FetchBlock error: %v", err)
+		}
+		guard.Close()
+		if got := pmgr.Stats(); got != expected {
+			t.Errorf("Stats error: fetch %d: expected %+v but got %+v", i, expected, got)
+		}
+	}
+	if err := pmgr.Evict(f, tblId, 1); err != nil {
+		t.Fatalf("Evict error: %v", err)
+	}
+	if _, err := pmgr.GetBlock(f, tblId, 1); err != nil {
+		t.Fatalf("GetBlock error: %v", err)
+	}
+	if got := pmgr.Stats(); got.Reads != 2 {
+		t.Errorf("Stats error: expected an evicted block to be read again but got %+v", got)
+	}
+}
+
+/* Load reads pages the way fetches do, so compressed and encrypted tables load too */
+func TestLoad(t *testing.T) {
+	fsys := st.NewMemFS()
+	keyFile := newTestKeyFile(t)
+	cols := map[string]column.SUPPORTED_TYPE{"key": column.INT, "val": column.STRING}
+	pkey := column.Column{Name: "key", Type: column.INT}
+	opts := TableOptions{Compression: COMPRESSION_LZ}
+
+	cfg := newEncryptedConfig(t, fsys, keyFile)
+	db := NewDB("loadDB", cfg)
+	tbl, err := db.CreateTableWithOptions("table1", cols, pkey, opts)
+	if err != nil {
+		t.Fatalf("CreateTable error: %v", err)
+	}
+	ctx := GetClientContextMgr(cfg).NewClientCtx(cfg, db)
+	want := make(map[string]string)
+	for i := 0; i < 40; i++ {
+		key, val := fmt.Sprint(i), strings.Repeat(fmt.Sprintf("value %d ", i), 30)
+		if _, err := crashInsert(ctx, tbl, key, val); err != nil {
+			t.Fatalf("insert error: %v", err)
+		}
+		want[key] = val
+	}
+	if err := ctx.Commit(); err != nil {
+		t.Fatalf("Commit error: %v", err)
+	}
+	ctx.Close()
+	crash(cfg)
+	cfg = newEncryptedConfig(t, fsys, keyFile)
+	db = NewDB("loadDB", cfg)
+	tbl = db.GetTable("table1")
+	blocks, err := GetBufMgr(cfg).TableBlocks(tbl.info.Location, tbl.tblID)
+	if err != nil || blocks < 2 {
+		t.Fatalf("TableBlocks error: expected several blocks but got %d: %v", blocks, err)
+	}
+	for i := 0; i < blocks; i++ {
+		if err := GetBufMgr(cfg).Evict(tbl.info.Location, tbl.tblID, st.Blk_t(i)); err != nil {
+			t.Fatalf("Evict error: %v", err)
+		}
+	}
+	before := GetBufMgr(cfg).Stats()
+	if err := GetBufMgr(cfg).Load(tbl.tblID, tbl.info.Location); err != nil {
+		t.Fatalf("Load error: %v", err)
+	}
+	loaded := GetBufMgr(cfg).Stats()
+	if loaded.Reads-before.Reads != int64(blocks) {
+		t.Errorf("Load error: expected %d blocks to be read but got %d", blocks, loaded.Reads-before.Reads)
+	}
+	ctx = GetClientContextMgr(cfg).NewClientCtx(cfg, db)
+	defer ctx.Close()
+	if got := crashRows(t, ctx, tbl); !sameRows(got, want) {
+		t.Errorf("Load error: expected rows\n%s\nbut got\n%s", rowsString(want), rowsString(got))
+	}
+	if got := GetBufMgr(cfg).Stats(); got.Reads != loaded.Reads {
+		t.Errorf("Load error: expected every block to be pooled but %d were read again", got.Reads-loaded.Reads)
+	}
+}
+
+func TestPoolCapacity(t *testing.T) {
+	t.Parallel()
+	cfg := newTestConfig(t, st.NewMemFS())
+	db := NewDB("capacityDB", cfg)
+	cols := map[string]column.SUPPORTED_TYPE{"key": column.INT, "val": column.STRING}
+	tbl, err := db.CreateTable("table1", cols, column.Column{Name: "key", Type: column.INT})
+	if err != nil {
+		t.Fatalf("CreateTable error: %v", err)
+	}
+	ctx := GetClientContextMgr(cfg).NewClientCtx(cfg, db)
+	defer ctx.Close()
+	want := make(map[string]string)
+	for i := 0; i < 200; i++ {
+		key, val := fmt.Sprint(i), strings.Repeat(fmt.Sprintf("value %d ", i), 100)
+		if _, err := crashInsert(ctx, tbl, key, val); err != nil {
+			t.Fatalf("insert error: %v", err)
+		}
+		if err := ctx.Commit(); err != nil {
+			t.Fatalf("Commit error: %v", err)
+		}
+		want[key] = val
+	}
+	buf := GetBufMgr(cfg)
+	blocks, err := buf.TableBlocks(tbl.info.Location, tbl.tblID)
+	if err != nil || blocks <= BUFFER_MIN_FRAMES {
+		t.Fatalf("TableBlocks error: expected more than %d blocks but got %d: %v", BUFFER_MIN_FRAMES, blocks, err)
+	}
+	if n := buf.NumBlocks(); n > BUFFER_MIN_FRAMES {
+		t.Errorf("NumBlocks error: expected at most %d pooled blocks but got %d", BUFFER_MIN_FRAMES, n)
+	}
+	// Evicted blocks are read back with their changes
+	if got := crashRows(t, ctx, tbl); !sameRows(got, want) {
+		t.Errorf("capacity error: expected rows\n%s\nbut got\n%s", rowsString(want), rowsString(got))
+	}
+	if err := ctx.Commit(); err != nil {
+		t.Fatalf("Commit error: %v", err)
+	}
+}
+
+func TestEvictWriteError(t *testing.T) {
+	var tblId st.Tbl_t = 8
+	fsys := st.NewFaultFS(st.NewMemFS(), 1)
+	f := "/8"
+	pmgr := &BufferPoolMgr{pages: newPageTable(), files: newFileMgr()}
+	if err := st.WriteFileAtomic(fsys, f, nil); err != nil {
+		t.Fatalf("WriteFileAtomic error: %v", err)
+	}
+	pmgr.files.setFS(fsys, 0)
+	pmgr.files.registerPath(tblId, f)
+
+	blk := pmgr.newBlock(tblId, 0, BLKSIZE, true)
+	blk.mut.Lock()
+	err := blk.insertRecordAt(0, []byte("3\n0,1:2,2\n6:15"))
+	blk.mut.Unlock()
+	if err != nil {
+		t.Fatalf("insertRecordAt error: %v", err)
+	}
+	pmgr.UnpinBlock(tblId, 0, true)
+
+	// A failed write keeps the block pooled and dirty
+	fsys.InjectWrite(1, st.FAULT_EIO)
+	if err := pmgr.Evict(f, tblId, 0); err == nil {
+		t.Fatalf("Evict error: expected the write to fail")
+	}
+	if cached := pmgr.pages.get(newPageKey(tblId, 0)); cached != blk || !cached.isDirty {
+		t.Fatalf("Evict error: expected a block that failed to write to stay pooled and dirty")
+	}
+	fsys.ClearFaults()
+	if err := pmgr.Evict(f, tblId, 0); err != nil {
+		t.Fatalf("Evict error: %v", err)
+	}
+	if pmgr.pages.get(newPageKey(tblId, 0)) != nil {
+		t.Errorf("Evict error: expected the block to be dropped")
+	}
+	read, err := pmgr.GetBlock(f, tblId, 0)
+	if err != nil {
+		t.Fatalf("GetBlock error: %v", err)
+	}
+	if data, err := read.recordBytes(0); err != nil || string(data) != "3\n0,1:2,2\n6:15" {
+		t.Errorf("GetBlock error: expected the evicted record but got %q: %v", data, err)
+	}
+}
+
+func newTestPool(numBlocks int, tblId st.Tbl_t) *BufferPoolMgr {
+	pmgr := &BufferPoolMgr{pages: newPageTable(), files: newFileMgr()}
+	for i := 0; i < numBlocks; i++ {
+		blk, _ := NewBlock(make([]byte, 0), st.Blk_t(i), tblId)
+		pmgr.AddBlockToPool(blk)
+	}
+	return pmgr
+}
+
+func TestPageTableConcurrentFetch(t *testing.T) {
+	var tblId st.Tbl_t = 6
+	numBlocks := 256
+	pmgr := newTestPool(numBlocks, tblId)
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				blockId := st.Blk_t((g + i) % numBlocks)
+				guard, err := pmgr.FetchBlock("", tblId, blockId)
+				if err != nil {
+					t.Errorf("FetchBlock error: %v", err)
+					return
+				}
+				guard.MarkDirty()
+				guard.Close()
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	if pmgr.NumBlocks() != int64(numBlocks) {
+		t.Errorf("Expected pool size to be %d but got %d", numBlocks, pmgr.NumBlocks())
+	}
+	for i := 0; i < numBlocks; i++ {
+		if pmgr.IsPinned(tblId, st.Blk_t(i)) {
+			t.Errorf("Expected block %d to be unpinned", i)
+		}
+	}
+}
+
+func BenchmarkGetBlock(b *testing.B) {
+	var tblId st.Tbl_t = 7
+	for _, numBlocks := range []int{1_000, 10_000, 100_000} {
+		pmgr := newTestPool(numBlocks, tblId)
+		b.Run(fmt.Sprintf("blocks=%d", numBlocks), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				blockId := st.Blk_t((i * 7919) % numBlocks)
+				if _, err := pmgr.GetBlock("", tblId, blockId); err != nil {
+					b.Fatalf("GetBlock error: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkFetchBlockParallel(b *testing.B) {
+	var tblId st.Tbl_t = 8
+	for _, numBlocks := range []int{1_000, 100_000} {
+		pmgr := newTestPool(numBlocks, tblId)
+		b.Run(fmt.Sprintf("blocks=%d", numBlocks), func(b *testing.B) {
+			b.RunParallel(func(pb *testing.PB) {
+				i := 0
+				for pb.Next() {
+					blockId := st.Blk_t((i * 7919) % numBlocks)
+					guard, err := pmgr.FetchBlock("", tblId, blockId)
+					if err != nil {
+						b.Errorf("FetchBlock error: %v", err)
+						return
+					}
+					guard.Close()
+					i++
+				}
+			})
+		})
+	}
+}
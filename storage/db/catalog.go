@@ -1,10 +1,13 @@
 package db
 
 import (
+	"errors"
 	"fmt"
+	"io/fs"
 	"log/slog"
-	"os"
+	"path"
 	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"unsafe"
@@ -15,8 +18,6 @@ import (
 	row "github.com/misachi/DarDB/storage/db/row"
 )
 
-var _Catalog *Catalog
-
 const CATALOG_PATH = "/tmp/.meta/catalog"
 
 type Catalog struct {
@@ -25,24 +26,64 @@ type Catalog struct {
 	maxTxnID    atomic.Uint64
 	maxCommitID atomic.Uint64
 	db          map[string]*DB
+	tables      map[st.Tbl_t]*tableEntry // Open tables, guarded by mut
 	mut         *sync.Mutex
 }
 
-func load(filePath string, catalog *Catalog) error {
-	dbDirs, err := os.ReadDir(filePath)
+/* load registers the data file of every table found under filePath with the buffer pool so the WAL can be replayed */
+func load(fsys st.FS, filePath string, catalog *Catalog, bufMgr *BufferPoolMgr) error {
+	dbDirs, err := fsys.ReadDir(filePath)
 	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
 		return fmt.Errorf("load: unable to read directory %s: %v", filePath, err)
 	}
 	for _, dir := range dbDirs {
-		// path :=
-		dir.Name()
+		if !dir.IsDir() {
+			continue
+		}
+		files, err := fsys.ReadDir(path.Join(filePath, dir.Name()))
+		if err != nil {
+			return fmt.Errorf("load: %v", err)
+		}
+		for _, file := range files {
+			if !file.IsDir() && strings.HasSuffix(file.Name(), DROPPED_FILE_EXT) {
+				// Dropped tables keep their IDs from being reused
+				if id, err := strconv.ParseUint(strings.TrimSuffix(file.Name(), DROPPED_FILE_EXT), 10, 64); err == nil {
+					storeMax(&catalog.maxTblID, id)
+				}
+				continue
+			}
+			if file.IsDir() || !strings.HasSuffix(file.Name(), META_FILE_EXT) {
+				continue
+			}
+			metaPath := path.Join(filePath, dir.Name(), file.Name())
+			info, err := readTableInfo(fsys, metaPath)
+			if err != nil {
+				return fmt.Errorf("load: table meta data %s: %v", metaPath, err)
+			}
+			bufMgr.files.registerPath(info.ID, info.Location)
+			storeMax(&catalog.maxTblID, uint64(info.ID))
+		}
 	}
 	return nil
 }
 
-func startCatalog(cfg *config.Config, catalog *Catalog) {
+/* storeMax raises v to val if val is larger */
+func storeMax(v *atomic.Uint64, val uint64) {
+	for {
+		old := v.Load()
+		if old >= val || v.CompareAndSwap(old, val) {
+			return
+		}
+	}
+}
+
+func startCatalog(e *engine, catalog *Catalog) {
 	// cfg := config.NewConfig(".old", 0, 0)
-	_db := NewDB("catalog", cfg)
+	cfg := e.config
+	_db := newDB("catalog", e)
 	schema := map[string]col.SUPPORTED_TYPE{
 		"id":    col.INT64,
 		"maxID": col.UINT64,
@@ -51,7 +92,7 @@ func startCatalog(cfg *config.Config, catalog *Catalog) {
 	pkey := col.NewColumn("id", col.INT64)
 	tbl, err := _db.CreateTable("table1", schema, pkey)
 	if err != nil {
-		slog.Error("startCatalog: %v", err)
+		slog.Error("startCatalog", "err", err)
 		panic(err)
 	}
 
@@ -59,13 +100,17 @@ func startCatalog(cfg *config.Config, catalog *Catalog) {
 		[]col.Column{col.NewColumn("id", col.INT64), col.NewColumn("maxID", col.UINT64), col.NewColumn("name", col.STRING)},
 	)
 
-	ctx := GetClientContextMgr().NewClientCtx(cfg, _db)
+	ctx := e.clients.NewClientCtx(cfg, _db)
 	recs, _ := tbl.GetRecord(ctx, "name", []byte("dbID"))
 	if len(recs) <= 0 {
 		tbl.AddRecord(ctx, colData.Keys(), [][]byte{[]byte("1"), []byte("1"), []byte("dbID")})
 		tbl.AddRecord(ctx, colData.Keys(), [][]byte{[]byte("2"), []byte("1"), []byte("tblID")})
 		tbl.AddRecord(ctx, colData.Keys(), [][]byte{[]byte("3"), []byte("1"), []byte("txnID")})
 		tbl.AddRecord(ctx, colData.Keys(), [][]byte{[]byte("4"), []byte("1"), []byte("commitID")})
+		if err := ctx.Commit(); err != nil {
+			slog.Error("startCatalog: commit", "err", err)
+			panic(err)
+		}
 		tbl.Flush() // Persist to disk
 	}
 	recs, _ = tbl.GetRecord(ctx, "name", []byte("dbID"))
@@ -73,7 +118,7 @@ func startCatalog(cfg *config.Config, catalog *Catalog) {
 	dbIDConv, errDB := strconv.ParseUint(*(*string)(unsafe.Pointer(&dbID)), 10, 64)
 
 	if errDB != nil {
-		slog.Error("startCatalog: get max DB ID: %v", errDB)
+		slog.Error("startCatalog: get max DB ID", "err", errDB)
 		panic(errDB)
 	}
 
@@ -85,30 +130,30 @@ func startCatalog(cfg *config.Config, catalog *Catalog) {
 
 	recs, err = tbl.GetRecord(ctx, "name", []byte("tblID"))
 	if err != nil {
-		slog.Error("startCatalog: Get table record: %v", err)
+		slog.Error("startCatalog: Get table record", "err", err)
 	}
 	tblID := recs[0].GetField(colData, "maxID")
 	tblIDConv, errTbl := strconv.ParseUint(*(*string)(unsafe.Pointer(&tblID)), 10, 64)
 	if errTbl != nil {
-		slog.Error("startCatalog: get max table ID: %v", errTbl)
+		slog.Error("startCatalog: get max table ID", "err", errTbl)
 		panic(errTbl)
 	}
-	catalog.maxTblID.Store(uint64(tblIDConv))
+	storeMax(&catalog.maxTblID, tblIDConv)
 
 	recs, _ = tbl.GetRecord(ctx, "name", []byte("txnID"))
 	txnID := recs[0].GetField(colData, "maxID")
 	txnIDConv, errTxn := strconv.ParseUint(*(*string)(unsafe.Pointer(&txnID)), 10, 64)
 	if errTxn != nil {
-		slog.Error("startCatalog: get max transaction ID: %v", errTxn)
+		slog.Error("startCatalog: get max transaction ID", "err", errTxn)
 		panic(errTxn)
 	}
-	catalog.maxTxnID.Store(uint64(txnIDConv))
+	storeMax(&catalog.maxTxnID, txnIDConv)
 
 	recs, _ = tbl.GetRecord(ctx, "name", []byte("commitID"))
 	commitID := recs[0].GetField(colData, "maxID")
 	commitIDConv, errCommitID := strconv.ParseUint(*(*string)(unsafe.Pointer(&commitID)), 10, 64)
 	if errCommitID != nil {
-		slog.Error("startCatalog: get max commit ID: %v", errCommitID)
+		slog.Error("startCatalog: get max commit ID", "err", errCommitID)
 		panic(errCommitID)
 	}
 	catalog.maxCommitID.Store(uint64(commitIDConv))
@@ -117,10 +162,6 @@ func startCatalog(cfg *config.Config, catalog *Catalog) {
 	_db.table[tbl.info.Name] = tbl
 	// _db.mut.Unlock()
 
-	if _Catalog == nil {
-		_Catalog = catalog
-	}
-
 	// catalog.mut.Lock()
 	catalog.db = make(map[string]*DB)
 	catalog.db[_db.name] = _db
@@ -129,21 +170,30 @@ func startCatalog(cfg *config.Config, catalog *Catalog) {
 	ctx.Close()
 }
 
-func NewCatalog(cfg *config.Config) *Catalog {
-	if _Catalog != nil {
-		return _Catalog
-	}
+/* newCatalog recovers the data directory of the engine and reads the highest IDs handed out */
+func newCatalog(e *engine) *Catalog {
+	cfg := e.config
 	catalog := &Catalog{mut: &sync.Mutex{}}
-	_Catalog = catalog
-	startCatalog(cfg, catalog)
+	e.catalog = catalog
+	if err := load(cfg.FS(), cfg.DataPath(), catalog, e.buf); err != nil {
+		slog.Error("newCatalog", "err", err)
+		panic(err)
+	}
+	if err := removeTempFiles(cfg); err != nil {
+		slog.Warn("newCatalog", "err", err)
+	}
+	maxTxnID, err := e.recover()
+	if err != nil {
+		slog.Error("newCatalog: recovery failed", "err", err)
+		panic(err)
+	}
+	storeMax(&catalog.maxTxnID, uint64(maxTxnID)+1)
+	startCatalog(e, catalog)
 	return catalog
 }
 
 func GetCatalog(cfg *config.Config) *Catalog {
-	if _Catalog == nil {
-		return NewCatalog(cfg)
-	}
-	return _Catalog
+	return getEngine(cfg).catalog
 }
 
 func (cat *Catalog) SetMaxTblId(tblId st.Tbl_t) error {
@@ -0,0 +1,208 @@
+package db
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+/*
+Compression is the page codec of a table. COMPRESSION_LZ uses the snappy block format: the
+uncompressed length as a uvarint followed by literals and back references, found with a hash of
+the next four bytes. It favours speed over ratio, which suits pages that are read far more often
+than they are written.
+*/
+type Compression uint8
+
+const (
+	COMPRESSION_NONE Compression = iota
+	COMPRESSION_LZ
+)
+
+const (
+	lzTagLiteral = 0x00
+	lzTagCopy1   = 0x01
+	lzTagCopy2   = 0x02
+	lzTagCopy4   = 0x03
+
+	lzMinMatch  = 4
+	lzHashBits  = 14
+	lzMaxOffset = 1<<16 - 1
+)
+
+var ErrBadCompression = errors.New("compressed data is malformed")
+
+func (c Compression) String() string {
+	switch c {
+	case COMPRESSION_NONE:
+		return "none"
+	case COMPRESSION_LZ:
+		return "lz"
+	}
+	return fmt.Sprintf("compression(%d)", uint8(c))
+}
+
+func (c Compression) valid() bool {
+	return c <= COMPRESSION_LZ
+}
+
+/* compress encodes src with the codec. The result is never used when it is not smaller than src */
+func (c Compression) compress(src []byte) []byte {
+	if c == COMPRESSION_LZ {
+		return compressLZ(src)
+	}
+	return src
+}
+
+func (c Compression) decompress(src []byte) ([]byte, error) {
+	switch c {
+	case COMPRESSION_NONE:
+		return src, nil
+	case COMPRESSION_LZ:
+		return decompressLZ(src)
+	}
+	return nil, fmt.Errorf("decompress: unknown codec %d: %w", uint8(c), ErrBadCompression)
+}
+
+func lzHash(u uint32) uint32 {
+	return (u * 0x1e35a7bd) >> (32 - lzHashBits)
+}
+
+func compressLZ(src []byte) []byte {
+	dst := make([]byte, binary.MaxVarintLen64, len(src)/2+16)
+	dst = dst[:binary.PutUvarint(dst, uint64(len(src)))]
+	if len(src) < lzMinMatch+4 {
+		return appendLiteral(dst, src)
+	}
+	var table [1 << lzHashBits]int32
+	lit := 0 // Start of the bytes not encoded yet
+	for i := 0; i+lzMinMatch <= len(src); {
+		cur := binary.LittleEndian.Uint32(src[i:])
+		h := lzHash(cur)
+		cand := int(table[h]) - 1
+		table[h] = int32(i + 1)
+		if cand < 0 || i-cand > lzMaxOffset || binary.LittleEndian.Uint32(src[cand:]) != cur {
+			i++
+			continue
+		}
+		n := lzMinMatch
+		for i+n < len(src) && src[cand+n] == src[i+n] {
+			n++
+		}
+		dst = appendLiteral(dst, src[lit:i])
+		dst = appendCopy(dst, i-cand, n)
+		i += n
+		lit = i
+	}
+	return appendLiteral(dst, src[lit:])
+}
+
+func appendLiteral(dst, lit []byte) []byte {
+	if len(lit) == 0 {
+		return dst
+	}
+	n := len(lit) - 1
+	switch {
+	case n < 60:
+		dst = append(dst, byte(n)<<2|lzTagLiteral)
+	case n < 1<<8:
+		dst = append(dst, 60<<2|lzTagLiteral, byte(n))
+	case n < 1<<16:
+		dst = append(dst, 61<<2|lzTagLiteral, byte(n), byte(n>>8))
+	case n < 1<<24:
+		dst = append(dst, 62<<2|lzTagLiteral, byte(n), byte(n>>8), byte(n>>16))
+	default:
+		dst = append(dst, 63<<2|lzTagLiteral, byte(n), byte(n>>8), byte(n>>16), byte(n>>24))
+	}
+	return append(dst, lit...)
+}
+
+/* appendCopy emits a back reference of n bytes at offset, split in pieces of at most 64 bytes */
+func appendCopy(dst []byte, offset, n int) []byte {
+	for n > 0 {
+		l := n
+		if l > 64 {
+			l = 64
+			if n-l < lzMinMatch {
+				// Leave enough for a last copy
+				l = n - lzMinMatch
+			}
+		}
+		if l >= 4 && l <= 11 && offset < 2048 {
+			dst = append(dst, byte(offset>>8)<<5|byte(l-4)<<2|lzTagCopy1, byte(offset))
+		} else {
+			dst = append(dst, byte(l-1)<<2|lzTagCopy2, byte(offset), byte(offset>>8))
+		}
+		n -= l
+	}
+	return dst
+}
+
+/* decompressLZ decodes src, failing on anything that reads or writes out of bounds */
+func decompressLZ(src []byte) ([]byte, error) {
+	size, k := binary.Uvarint(src)
+	if k <= 0 || size > 1<<30 {
+		return nil, fmt.Errorf("decompressLZ: bad length: %w", ErrBadCompression)
+	}
+	dst := make([]byte, 0, size)
+	for i := k; i < len(src); {
+		tag := src[i]
+		i++
+		var offset, n int
+		switch tag & 0x03 {
+		case lzTagLiteral:
+			n = int(tag >> 2)
+			if n >= 60 {
+				extra := n - 59
+				if i+extra > len(src) {
+					return nil, fmt.Errorf("decompressLZ: literal length past the end: %w", ErrBadCompression)
+				}
+				n = 0
+				for j := extra - 1; j >= 0; j-- {
+					n = n<<8 | int(src[i+j])
+				}
+				i += extra
+			}
+			n++
+			if n > len(src)-i || len(dst)+n > int(size) {
+				return nil, fmt.Errorf("decompressLZ: literal past the end: %w", ErrBadCompression)
+			}
+			dst = append(dst, src[i:i+n]...)
+			i += n
+			continue
+		case lzTagCopy1:
+			if i >= len(src) {
+				return nil, fmt.Errorf("decompressLZ: copy past the end: %w", ErrBadCompression)
+			}
+			n = 4 + int(tag>>2)&0x07
+			offset = int(tag>>5)<<8 | int(src[i])
+			i++
+		case lzTagCopy2:
+			if i+2 > len(src) {
+				return nil, fmt.Errorf("decompressLZ: copy past the end: %w", ErrBadCompression)
+			}
+			n = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint16(src[i:]))
+			i += 2
+		case lzTagCopy4:
+			if i+4 > len(src) {
+				return nil, fmt.Errorf("decompressLZ: copy past the end: %w", ErrBadCompression)
+			}
+			n = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint32(src[i:]))
+			i += 4
+		}
+		if offset <= 0 || offset > len(dst) || len(dst)+n > int(size) {
+			return nil, fmt.Errorf("decompressLZ: copy out of range: %w", ErrBadCompression)
+		}
+		// Copies may overlap the bytes they produce, so go byte by byte
+		start := len(dst) - offset
+		for j := 0; j < n; j++ {
+			dst = append(dst, dst[start+j])
+		}
+	}
+	if len(dst) != int(size) {
+		return nil, fmt.Errorf("decompressLZ: expected %d bytes but got %d: %w", size, len(dst), ErrBadCompression)
+	}
+	return dst, nil
+}
@@ -0,0 +1,49 @@
+package db
+
+import (
+	"bytes"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func TestCompressLZ(t *testing.T) {
+	t.Parallel()
+	rnd := rand.New(rand.NewSource(1))
+	random := make([]byte, 5000)
+	rnd.Read(random)
+	values := [][]byte{
+		nil,
+		[]byte("a"),
+		[]byte("abcabcabcabcabcabcabcabc"),
+		bytes.Repeat([]byte{0}, 70000),
+		[]byte(strings.Repeat("name,street,city;", 300)),
+		random,
+		append(append([]byte{}, random[:300]...), random[:300]...),
+	}
+	for _, val := range values {
+		enc := compressLZ(val)
+		dec, err := decompressLZ(enc)
+		if err != nil {
+			t.Fatalf("decompressLZ error: %v", err)
+		}
+		if !bytes.Equal(dec, val) {
+			t.Errorf("decompressLZ error: round trip of %d bytes changed the data", len(val))
+		}
+	}
+	if enc := compressLZ(values[4]); len(enc) > len(values[4])/10 {
+		t.Errorf("compressLZ error: expected repeated text to shrink tenfold but got %d of %d bytes", len(enc), len(values[4]))
+	}
+
+	// Damaged input is rejected, never read or written out of bounds
+	enc := compressLZ(values[4])
+	for i := 0; i < 2000; i++ {
+		bad := append([]byte{}, enc[:rnd.Intn(len(enc))]...)
+		if len(bad) > 0 {
+			bad[rnd.Intn(len(bad))] ^= byte(1 + rnd.Intn(255))
+		}
+		if dec, err := decompressLZ(bad); err == nil && bytes.Equal(dec, values[4]) {
+			t.Errorf("decompressLZ error: expected damaged input to be rejected")
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package db
 
 import (
+	"errors"
 	"fmt"
 	"log/slog"
 	"sync"
@@ -10,7 +11,7 @@ import (
 	// txn "github.com/misachi/DarDB/storage"
 )
 
-var ClientCtxMgr *ClientContextMgr
+var ErrNoPreparer = errors.New("no SQL layer is registered to prepare statements")
 
 type ClientContextMgr struct {
 	maxID   atomic.Uint32
@@ -25,12 +26,9 @@ func NewClientContextMgr() *ClientContextMgr {
 	}
 }
 
-func GetClientContextMgr() *ClientContextMgr {
-	if ClientCtxMgr != nil {
-		return ClientCtxMgr
-	}
-	ClientCtxMgr := NewClientContextMgr()
-	return ClientCtxMgr
+/* GetClientContextMgr returns the clients of the databases opened with config */
+func GetClientContextMgr(config *cfg.Config) *ClientContextMgr {
+	return getEngine(config).clients
 }
 
 func (ctxMgr *ClientContextMgr) NewClientCtx(cfg *cfg.Config, db *DB) *ClientContext {
@@ -40,42 +38,129 @@ func (ctxMgr *ClientContextMgr) NewClientCtx(cfg *cfg.Config, db *DB) *ClientCon
 		slog.Error("NewClientCtx: unable to create new context")
 		panic(err)
 	}
+	ctxMgr.mtx.Lock()
+	defer ctxMgr.mtx.Unlock()
 	ctxMgr.context[newID] = ctx
 	return ctx
 }
 
+/* CloseClientCtx closes ctx, rolling back its open transaction, and forgets it */
+func (ctxMgr *ClientContextMgr) CloseClientCtx(ctx *ClientContext) {
+	ctx.Close()
+	ctxMgr.mtx.Lock()
+	defer ctxMgr.mtx.Unlock()
+	delete(ctxMgr.context, ctx.ctxID)
+}
+
+/* NumClients is the number of client contexts open */
+func (ctxMgr *ClientContextMgr) NumClients() int {
+	ctxMgr.mtx.RLock()
+	defer ctxMgr.mtx.RUnlock()
+	return len(ctxMgr.context)
+}
+
 type ClientContext struct {
 	ctxID      uint32
 	currentTxn *Transaction
 	txnMgr     *TransactionManager
 	config     *cfg.Config
 	database   *DB
+	engine     *engine
+	hits       atomic.Int64 // Blocks the client asked for that were in the pool
+	reads      atomic.Int64 // Blocks the client asked for that were read from disk
 }
 
 func NewClientContext(ctxID uint32, cfg *cfg.Config, db *DB) (*ClientContext, error) {
-	txnMgr := NewTxnManager()
-	ctx := &ClientContext{}
-	transaction, err := txnMgr.StartTransaction(ctx)
-	if err != nil {
+	e := db.engine
+	ctx := &ClientContext{txnMgr: e.txns, config: cfg, database: db, ctxID: ctxID, engine: e}
+	if err := ctx.begin(); err != nil {
 		return nil, fmt.Errorf("NewClientContext: Unable to create new transaction: %v", err)
 	}
-	ctx.currentTxn = transaction
-	ctx.txnMgr = txnMgr
-	ctx.config = cfg
-	ctx.database =db
-	ctx.ctxID = ctxID
 	return ctx, nil
 }
 
+func (ctx *ClientContext) begin() error {
+	transaction, err := ctx.txnMgr.StartTransaction(ctx)
+	if err != nil {
+		return err
+	}
+	ctx.currentTxn = transaction
+	return nil
+}
+
+/* Commit commits the current transaction and starts a new one */
+func (ctx *ClientContext) Commit() error {
+	if err := ctx.txnMgr.Commit(ctx.currentTxn); err != nil {
+		return fmt.Errorf("Commit: %v", err)
+	}
+	return ctx.begin()
+}
+
+/* Rollback undoes the current transaction and starts a new one */
+func (ctx *ClientContext) Rollback() error {
+	if err := ctx.txnMgr.Rollback(ctx.currentTxn); err != nil {
+		return fmt.Errorf("Rollback: %v", err)
+	}
+	return ctx.begin()
+}
+
 func (ctx *ClientContext) Close() {
 	// CleanUp
 	txn := ctx.currentTxn
 	if txn.state == STARTED || txn.state == PENDING {
-		txn.rollback()
+		if err := txn.rollback(); err != nil {
+			slog.Error("Close: rollback failed", "err", err)
+		}
 	}
 	ctx.txnMgr.EndTransaction(txn)
 }
 
+/*
+Statement is SQL text a client prepared to run many times. The SQL layer registers the Preparer
+that makes statements and documents their type, which clients assert to run them; the storage
+layer only hands them back.
+*/
+type Statement interface {
+	Query() string
+}
+
+/* Preparer parses and plans query for ctx */
+type Preparer func(ctx *ClientContext, query string) (Statement, error)
+
+var preparer Preparer
+
+/* RegisterPreparer sets what ClientContext.Prepare uses. It is meant to be called from an init function */
+func RegisterPreparer(p Preparer) {
+	preparer = p
+}
+
+/* Prepare prepares query to run many times in the transactions of ctx */
+func (ctx *ClientContext) Prepare(query string) (Statement, error) {
+	if preparer == nil {
+		return nil, fmt.Errorf("Prepare: %w", ErrNoPreparer)
+	}
+	return preparer(ctx, query)
+}
+
+/* ID identifies the client among those of its ClientContextMgr */
+func (ctx *ClientContext) ID() uint32 {
+	return ctx.ctxID
+}
+
+func (ctx *ClientContext) Config() *cfg.Config {
+	return ctx.config
+}
+
 func (ctx *ClientContext) CurrentTxn() *Transaction {
 	return ctx.currentTxn
 }
+
+/* DB is the database the client works in */
+func (ctx *ClientContext) DB() *DB {
+	return ctx.database
+}
+
+/* BufferStats counts the blocks the client asked the buffer pool for since it was created */
+func (ctx *ClientContext) BufferStats() BufferStats {
+	return BufferStats{Hits: ctx.hits.Load(), Reads: ctx.reads.Load()}
+}
@@ -0,0 +1,42 @@
+package db
+
+import (
+	"sync"
+	"testing"
+
+	st "github.com/misachi/DarDB/storage"
+)
+
+func TestClientContextMgr(t *testing.T) {
+	cfg := newTestConfig(t, st.NewMemFS())
+	db := NewDB("ctxDB", cfg)
+	mgr := GetClientContextMgr(cfg)
+	if GetClientContextMgr(cfg) != mgr || db.engine.clients != mgr {
+		t.Fatalf("GetClientContextMgr error: expected the same manager every call")
+	}
+	before := mgr.NumClients()
+
+	var wg sync.WaitGroup
+	ctxs := make([]*ClientContext, 20)
+	for i := range ctxs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ctxs[i] = GetClientContextMgr(cfg).NewClientCtx(cfg, db)
+		}(i)
+	}
+	wg.Wait()
+	ids := make(map[uint32]bool)
+	for _, ctx := range ctxs {
+		ids[ctx.ID()] = true
+	}
+	if len(ids) != len(ctxs) || mgr.NumClients() != before+len(ctxs) {
+		t.Errorf("NewClientCtx error: expected %d clients with their own IDs but got %d IDs and %d clients", len(ctxs), len(ids), mgr.NumClients()-before)
+	}
+	for _, ctx := range ctxs {
+		mgr.CloseClientCtx(ctx)
+	}
+	if mgr.NumClients() != before {
+		t.Errorf("CloseClientCtx error: expected %d clients left but got %d", before, mgr.NumClients())
+	}
+}
@@ -0,0 +1,240 @@
+package db
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/misachi/DarDB/column"
+	st "github.com/misachi/DarDB/storage"
+	"github.com/misachi/DarDB/storage/db/row"
+)
+
+/* crashRow is a row of the workload as the running transaction sees it */
+type crashRow struct {
+	rid RecordID
+	val string
+}
+
+/* crashInsert adds a row and returns where it went */
+func crashInsert(ctx *ClientContext, tbl *Table, key, val string) (RecordID, error) {
+	cols := tbl.info.Column
+	vals, err := tbl.toastValues(cols, [][]byte{[]byte(key), []byte(val)})
+	if err != nil {
+		return RecordID{}, err
+	}
+	record, err := row.NewVarLengthRecord(cols, vals)
+	if err != nil {
+		return RecordID{}, err
+	}
+	return tbl.insert(ctx, record)
+}
+
+/* crashRows reads back every row of the table */
+func crashRows(t *testing.T, ctx *ClientContext, tbl *Table) map[string]string {
+	colData := row.NewColumnData_(tbl.info.Column)
+	rows := make(map[string]string)
+	iter := tbl.blockIterator()
+	defer iter.Close()
+	for {
+		blk, err := iter.Next()
+		if err != nil {
+			t.Fatalf("Next error: %v", err)
+		}
+		if blk == nil {
+			return rows
+		}
+		recs, err := blk.Records(ctx)
+		if err != nil {
+			t.Fatalf("Records error: %v", err)
+		}
+		for _, rec := range recs {
+			key := string(rec.GetField(colData, "key"))
+			if _, ok := rows[key]; ok {
+				t.Errorf("Recover error: key %s is stored twice", key)
+			}
+			rows[key] = string(rec.GetField(colData, "val"))
+		}
+	}
+}
+
+func sameRows(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if w, ok := b[k]; !ok || v != w {
+			return false
+		}
+	}
+	return true
+}
+
+func rowsString(rows map[string]string) string {
+	keys := make([]string, 0, len(rows))
+	for k := range rows {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	s := ""
+	for _, k := range keys {
+		s += fmt.Sprintf("%s=%s ", k, rows[k])
+	}
+	return s
+}
+
+/*
+runCrashWorkload runs random inserts, updates, deletes, commits, rollbacks, flushes and checkpoints
+on a FaultFS, optionally failing one write, then pulls the plug. The data is encrypted when keyFile
+holds a master key. A failed commit, rollback, flush or checkpoint is retried, and a failed change
+rolls its transaction back, so the workload goes on past the fault as a server would. After
+recovery the table must hold exactly the committed rows.
+*/
+func runCrashWorkload(t *testing.T, seed int64, fault st.Fault, opts TableOptions, keyFile string) {
+	rnd := rand.New(rand.NewSource(seed))
+	fsys := st.NewFaultFS(st.NewMemFS(), seed)
+	cols := map[string]column.SUPPORTED_TYPE{"key": column.INT, "val": column.STRING}
+	pkey := column.Column{Name: "key", Type: column.INT}
+
+	cfg := newEncryptedConfig(t, fsys, keyFile)
+	db := NewDB("crashDB", cfg)
+	tbl, err := db.CreateTableWithOptions("table1", cols, pkey, opts)
+	if err != nil {
+		t.Fatalf("CreateTable error: %v", err)
+	}
+	ctx := GetClientContextMgr(cfg).NewClientCtx(cfg, db)
+	if fault != 0 {
+		fsys.InjectWrite(1+rnd.Intn(150), fault)
+	}
+
+	committed := make(map[string]string)
+	live := make(map[string]crashRow)
+	snapshot := func() map[string]crashRow {
+		copied := make(map[string]crashRow, len(live))
+		for k, v := range live {
+			copied[k] = v
+		}
+		return copied
+	}
+	start := snapshot()
+	nextKey := 0
+
+	// Only one write fails, so a second attempt goes through
+	retry := func(what string, f func() error) {
+		if err := f(); err != nil {
+			if err := f(); err != nil {
+				t.Fatalf("%s error: retry failed: %v", what, err)
+			}
+		}
+	}
+	rollback := func() {
+		retry("Rollback", ctx.Rollback)
+		live = make(map[string]crashRow, len(start))
+		for k, v := range start {
+			live[k] = v
+		}
+	}
+
+	for op := 0; op < 300; op++ {
+		switch r := rnd.Intn(20); {
+		case r < 8 || len(live) == 0:
+			key, val := fmt.Sprintf("%d", nextKey), fmt.Sprintf("v%d", op)
+			nextKey++
+			rid, err := crashInsert(ctx, tbl, key, val)
+			if err != nil {
+				rollback()
+				continue
+			}
+			live[key] = crashRow{rid: rid, val: val}
+		case r < 11:
+			key := fmt.Sprintf("%d", rnd.Intn(nextKey))
+			cur, ok := live[key]
+			if !ok {
+				continue
+			}
+			// Values of different lengths make some updates move the row
+			val := fmt.Sprintf("v%d%s", op, strings.Repeat("x", rnd.Intn(3)*400))
+			rid, err := tbl.UpdateRecord(ctx, cur.rid, tbl.info.Column, [][]byte{[]byte(key), []byte(val)})
+			if err != nil {
+				rollback()
+				continue
+			}
+			live[key] = crashRow{rid: rid, val: val}
+		case r < 13:
+			key := fmt.Sprintf("%d", rnd.Intn(nextKey))
+			cur, ok := live[key]
+			if !ok {
+				continue
+			}
+			if err := tbl.DeleteRecord(ctx, cur.rid); err != nil {
+				rollback()
+				continue
+			}
+			delete(live, key)
+		case r < 16:
+			retry("Commit", ctx.Commit)
+			committed = make(map[string]string, len(live))
+			for k, v := range live {
+				committed[k] = v.val
+			}
+			start = snapshot()
+		case r < 17:
+			rollback()
+		case r < 18:
+			retry("FlushAll", GetBufMgr(cfg).FlushAll)
+		default:
+			retry("Checkpoint", func() error {
+				_, err := Checkpoint(cfg)
+				return err
+			})
+		}
+	}
+
+	crash(cfg)
+	if err := fsys.Crash(rnd.Intn(2) == 0); err != nil {
+		t.Fatalf("Crash error: %v", err)
+	}
+
+	cfg = newEncryptedConfig(t, fsys, keyFile)
+	db = NewDB("crashDB", cfg)
+	tbl, err = db.CreateTable("table1", cols, pkey)
+	if err != nil {
+		t.Fatalf("CreateTable error: %v", err)
+	}
+	ctx = GetClientContextMgr(cfg).NewClientCtx(cfg, db)
+	defer ctx.Close()
+	if got := crashRows(t, ctx, tbl); !sameRows(got, committed) {
+		t.Errorf("Recover error: expected committed rows\n%s\nbut got\n%s", rowsString(committed), rowsString(got))
+	}
+}
+
+func TestCrashRecovery(t *testing.T) {
+	values := []struct {
+		name  string
+		fault st.Fault
+	}{
+		{name: "power loss", fault: 0},
+		{name: "eio", fault: st.FAULT_EIO},
+		{name: "short write", fault: st.FAULT_SHORT},
+	}
+	keyFile := newTestKeyFile(t)
+	for _, val := range values {
+		for _, codec := range []Compression{COMPRESSION_NONE, COMPRESSION_LZ} {
+			for _, key := range []string{"", keyFile} {
+				mode := "plain"
+				if key != "" {
+					mode = "encrypted"
+				}
+				for seed := int64(1); seed <= 10; seed++ {
+					fault, opts, key, seed := val.fault, TableOptions{Compression: codec}, key, seed
+					t.Run(fmt.Sprintf("%s/%v/%s/seed%d", val.name, codec, mode, seed), func(t *testing.T) {
+						t.Parallel()
+						runCrashWorkload(t, seed, fault, opts, key)
+					})
+				}
+			}
+		}
+	}
+}
@@ -1,10 +1,15 @@
 package db
 
 import (
+	"errors"
 	"fmt"
-	"os"
+	"io/fs"
+	"log/slog"
 	"path"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 
 	"github.com/misachi/DarDB/column"
 	cfg "github.com/misachi/DarDB/config"
@@ -15,23 +20,47 @@ import (
 
 // type db_t uint64
 
+const (
+	META_FILE_EXT    = ".meta"
+	DROPPED_FILE_EXT = ".dropped" // Meta data of a dropped table, named by its table ID
+)
+
+var (
+	ErrTableNotFound = errors.New("table does not exist")
+	ErrTableInUse    = errors.New("table is in use by a running transaction")
+)
+
 type DB struct {
-	dbID   st.DB_t
-	name   string
-	table  map[string]*Table
-	mut    *sync.RWMutex
-	config *cfg.Config
+	dbID    st.DB_t
+	name    string
+	table   map[string]*Table
+	mut     *sync.RWMutex
+	config  *cfg.Config
+	engine  *engine
+	schema  atomic.Uint64 // Counts tables created and dropped
+	indexes atomic.Uint64 // Counts indexes created and dropped
 }
 
+/* NewDB opens the database dbName in the data directory of cfg, with the engine the databases opened with cfg share */
 func NewDB(dbName string, cfg *cfg.Config) *DB {
+	e, err := loadEngine(cfg)
+	if err != nil {
+		slog.Error("NewDB", "err", err)
+		return nil
+	}
+	return newDB(dbName, e)
+}
+
+func newDB(dbName string, e *engine) *DB {
 	var dbID st.DB_t
+	cfg := e.config
 	dbPath := path.Join(cfg.DataPath(), dbName)
-	err := os.MkdirAll(dbPath, 0750)
+	err := cfg.FS().MkdirAll(dbPath)
 	if err != nil {
 		return nil
 	}
 
-	catalog := GetCatalog(cfg)
+	catalog := e.catalog
 	if catalog != nil {
 		if _, ok := catalog.db["catalog"]; ok {
 			successful := false
@@ -49,20 +78,61 @@ func NewDB(dbName string, cfg *cfg.Config) *DB {
 	return &DB{
 		name:   dbName,
 		config: cfg,
+		engine: e,
 		table:  make(map[string]*Table),
 		dbID:   dbID,
 		mut:    &sync.RWMutex{},
 	}
 }
 
+/* TableOptions are the storage settings a table is created with. The zero value uses the defaults */
+type TableOptions struct {
+	BlockSize   int         // A power of two from 4 KiB to 64 KiB, zero for the block size of the database config
+	Compression Compression // Codec of the pages on disk
+	Columns     []string    // Names of the columns in the order they were declared, nil to leave them in layout order
+}
+
+/* CreateTable creates the table with the block size of the database config, or opens it if it exists */
 func (db *DB) CreateTable(tblName string, cols map[string]column.SUPPORTED_TYPE, pkey column.Column) (*Table, error) {
+	return db.CreateTableWithOptions(tblName, cols, pkey, TableOptions{})
+}
+
+/* CreateTableWithBlockSize creates the table with blocks of blockSize bytes */
+func (db *DB) CreateTableWithBlockSize(tblName string, cols map[string]column.SUPPORTED_TYPE, pkey column.Column, blockSize int) (*Table, error) {
+	return db.CreateTableWithOptions(tblName, cols, pkey, TableOptions{BlockSize: blockSize})
+}
+
+/*
+CreateTableWithOptions creates the table with the storage settings of opts. An existing table
+keeps the settings it was created with and fails to open if other non zero settings are asked for.
+*/
+func (db *DB) CreateTableWithOptions(tblName string, cols map[string]column.SUPPORTED_TYPE, pkey column.Column, opts TableOptions) (*Table, error) {
+	if opts.BlockSize != 0 && !st.ValidBlockSize(opts.BlockSize) {
+		return nil, fmt.Errorf("CreateTable: %d: %w", opts.BlockSize, st.ErrBlockSize)
+	}
+	if !opts.Compression.valid() {
+		return nil, fmt.Errorf("CreateTable: %v: %w", opts.Compression, st.ErrCompression)
+	}
+	if !validTableName(tblName) {
+		return nil, fmt.Errorf("CreateTable: %q: invalid table name", tblName)
+	}
+	db.mut.Lock()
+	defer db.mut.Unlock()
 	if _, ok := db.table[tblName]; ok {
 		return nil, fmt.Errorf("CreateTable: Table already exists")
 	}
 	schema := make([]column.Column, 0)
 
+	// Map iteration order is random; sort so records are always laid out the same way
+	names := make([]string, 0, len(cols))
+	for name := range cols {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
 	varLenKeys := make([]column.Column, 0)
-	for name, _type := range cols {
+	for _, name := range names {
+		_type := cols[name]
 		if _type == column.STRING {
 			varLenKeys = append(varLenKeys, column.NewColumn(name, _type))
 		} else {
@@ -72,35 +142,173 @@ func (db *DB) CreateTable(tblName string, cols map[string]column.SUPPORTED_TYPE,
 	schema = append(schema, varLenKeys...)
 
 	tblInfo := NewTableInfo(tblName, schema, pkey)
+	tblInfo.BlockSize = opts.BlockSize
+	tblInfo.Compression = opts.Compression
+	if opts.Columns != nil {
+		order, err := declaredOrder(schema, opts.Columns)
+		if err != nil {
+			return nil, fmt.Errorf("CreateTable: %v", err)
+		}
+		tblInfo.Order = order
+	}
 
-	tb, err := NewTable(db.name, tblInfo, db.config)
+	tb, err := newTable(db.name, tblInfo, db.engine)
 	if err != nil {
-		return nil, fmt.Errorf("CreateTable: NewTable error %v", err)
+		return nil, fmt.Errorf("CreateTable: newTable error %w", err)
 	}
-	db.mut.Lock()
-	defer db.mut.Unlock()
 	db.table[tblName] = tb
+	db.schema.Add(1)
 	return tb, nil
 }
 
+/* declaredOrder returns the index into schema of each of names, which must name every column once */
+func declaredOrder(schema []column.Column, names []string) ([]int, error) {
+	if len(names) != len(schema) {
+		return nil, fmt.Errorf("declaredOrder: %d column names for %d columns", len(names), len(schema))
+	}
+	order := make([]int, len(names))
+	seen := make(map[int]bool, len(names))
+	for i, name := range names {
+		order[i] = -1
+		for j, col := range schema {
+			if col.Name == name {
+				order[i] = j
+			}
+		}
+		if order[i] < 0 || seen[order[i]] {
+			return nil, fmt.Errorf("declaredOrder: column %q is unknown or named twice", name)
+		}
+		seen[order[i]] = true
+	}
+	return order, nil
+}
+
+/* GetTable returns the table, opening it from its meta data if an earlier process created it. Nil if there is no such table */
 func (db *DB) GetTable(tblName string) *Table {
+	db.mut.RLock()
+	table, ok := db.table[tblName]
+	db.mut.RUnlock()
+	if ok {
+		return table
+	}
+	if !validTableName(tblName) {
+		return nil
+	}
+	info, err := readTableInfo(db.config.FS(), db.metaPath(tblName))
+	if err != nil {
+		return nil
+	}
+	db.mut.Lock()
+	defer db.mut.Unlock()
 	if table, ok := db.table[tblName]; ok {
 		return table
 	}
+	table, err = newTable(db.name, info, db.engine)
+	if err != nil {
+		slog.Error("GetTable", "table", tblName, "err", err)
+		return nil
+	}
+	db.table[tblName] = table
+	return table
+}
+
+/* Tables returns the names of the tables of the database, open or not, in order */
+func (db *DB) Tables() ([]string, error) {
+	names := make(map[string]bool)
+	db.mut.RLock()
+	for name := range db.table {
+		names[name] = true
+	}
+	db.mut.RUnlock()
+	files, err := db.config.FS().ReadDir(path.Join(db.config.DataPath(), db.name))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("Tables: %v", err)
+	}
+	for _, file := range files {
+		if !file.IsDir() && strings.HasSuffix(file.Name(), META_FILE_EXT) {
+			names[strings.TrimSuffix(file.Name(), META_FILE_EXT)] = true
+		}
+	}
+	tables := make([]string, 0, len(names))
+	for name := range names {
+		tables = append(tables, name)
+	}
+	sort.Strings(tables)
+	return tables, nil
+}
+
+/*
+DropTable removes the table and its files. No running transaction may have used it. The meta data
+is removed last and kept as a marker of the table's ID, so a table created later never reuses an
+ID the WAL may still hold changes for. A crash part way leaves the table to be dropped again.
+*/
+func (db *DB) DropTable(tblName string) error {
+	tbl := db.GetTable(tblName)
+	if tbl == nil {
+		return fmt.Errorf("DropTable: %s: %w", tblName, ErrTableNotFound)
+	}
+	db.mut.Lock()
+	defer db.mut.Unlock()
+	if db.engine.txns.tableInUse(tbl.tblID, nil) {
+		return fmt.Errorf("DropTable: %s: %w", tblName, ErrTableInUse)
+	}
+
+	buf := db.engine.buf
+	buf.flushMtx.Lock()
+	buf.dropFrames(tbl.tblID, 0)
+	buf.files.forget(tbl.tblID, tbl.info.Location)
+	buf.flushMtx.Unlock()
+
+	fsys := db.config.FS()
+	loc := tbl.info.Location
+	for _, file := range []string{loc, fsmPath(loc), pmapPath(loc), toastPath(loc), statsPath(tbl.info.Path)} {
+		if err := fsys.Remove(file); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("DropTable: %v", err)
+		}
+	}
+	marker := path.Join(path.Dir(tbl.info.Path), fmt.Sprintf("%d%s", tbl.tblID, DROPPED_FILE_EXT))
+	if err := fsys.Rename(tbl.info.Path, marker); err != nil {
+		return fmt.Errorf("DropTable: %v", err)
+	}
+	if err := fsys.Sync(path.Dir(marker)); err != nil {
+		return fmt.Errorf("DropTable: %v", err)
+	}
+	delete(db.table, tblName)
+	db.schema.Add(1)
+	db.engine.catalog.dropTable(tbl.tblID)
 	return nil
 }
 
+/*
+SchemaVersion changes whenever a table of the database is created or dropped, so what was planned
+against the tables can tell cheaply when to check them again.
+*/
+func (db *DB) SchemaVersion() uint64 {
+	return db.schema.Load()
+}
+
+/* IndexVersion changes whenever an index of a table of the database is created or dropped */
+func (db *DB) IndexVersion() uint64 {
+	return db.indexes.Load()
+}
+
+func (db *DB) metaPath(tblName string) string {
+	return path.Join(db.config.DataPath(), db.name, tblName+META_FILE_EXT)
+}
+
+/* validTableName reports whether the name can be used for the table's files */
+func validTableName(tblName string) bool {
+	return tblName != "" && tblName != "." && tblName != ".." && !strings.ContainsAny(tblName, "/\\\x00")
+}
+
 func (db *DB) AddRecord(ctx *ClientContext, tbl *Table, data map[string][]byte) error {
 	fields := make([]column.Column, 0)
 	fieldVals := make([][]byte, 0)
 	columns := tbl.GetInfo().Column
-	for field, val := range data {
-		for _, col := range columns {
-			if col.Name == field {
-				fields = append(fields, col)
-				fieldVals = append(fieldVals, val)
-				break
-			}
+	for _, col := range columns {
+		if val, ok := data[col.Name]; ok {
+			fields = append(fields, col)
+			fieldVals = append(fieldVals, val)
 		}
 	}
 	_, err := tbl.AddRecord(ctx, fields, fieldVals)
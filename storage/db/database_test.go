@@ -2,17 +2,20 @@ package db
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 
 	"github.com/misachi/DarDB/column"
-	"github.com/misachi/DarDB/config"
 	"github.com/misachi/DarDB/storage"
 	"github.com/misachi/DarDB/storage/db/row"
 )
 
 func TestNewDB(t *testing.T) {
-	_Catalog = nil
-	cfg := config.NewConfig(t.TempDir(), 1, 1)
+	cfg := newTestConfig(t, storage.NewMemFS())
 	db := NewDB("testDB", cfg)
 
 	if db.dbID != 2 {
@@ -25,8 +28,7 @@ func TestNewDB(t *testing.T) {
 }
 
 func TestCreateTable(t *testing.T) {
-	_Catalog = nil
-	cfg := config.NewConfig(t.TempDir(), 1, 1)
+	cfg := newTestConfig(t, storage.NewMemFS())
 	db := NewDB("testDB", cfg)
 
 	pkey := column.Column{Name: "id1", Type: column.INT}
@@ -75,6 +77,118 @@ func TestCreateTable(t *testing.T) {
 			t.Errorf("TestCreateTable: Expected name `%s` but found `%s`", val.wantTableName, table.info.Name)
 		}
 	}
+
+	// Records are laid out with strings last, but the declared order is kept in the meta data
+	cols := map[string]column.SUPPORTED_TYPE{"name": column.STRING, "id1": column.INT, "age": column.INT}
+	opts := TableOptions{Columns: []string{"name", "id1", "age"}}
+	if _, err := db.CreateTableWithOptions("table104", cols, pkey, opts); err != nil {
+		t.Fatalf("TestCreateTable: %v", err)
+	}
+	info, err := readTableInfo(cfg.FS(), db.metaPath("table104"))
+	if err != nil {
+		t.Fatalf("TestCreateTable: readTableInfo error %v", err)
+	}
+	declared := make([]string, 0)
+	for _, i := range info.DeclaredOrder() {
+		declared = append(declared, info.Column[i].Name)
+	}
+	if strings.Join(declared, ",") != "name,id1,age" || info.Column[len(info.Column)-1].Name != "name" {
+		t.Errorf("TestCreateTable: Expected declared order name,id1,age but found %v in layout %v", declared, info.Column)
+	}
+	opts.Columns = []string{"name", "id1", "id1"}
+	if _, err := db.CreateTableWithOptions("table105", cols, pkey, opts); err == nil {
+		t.Errorf("TestCreateTable: Expected an error for a column named twice")
+	}
+
+	// Only one of the callers racing to create a table gets it
+	var wg sync.WaitGroup
+	var created atomic.Int32
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := db.CreateTable("table106", map[string]column.SUPPORTED_TYPE{"id1": column.INT}, pkey); err == nil {
+				created.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	if created.Load() != 1 {
+		t.Errorf("TestCreateTable: Expected one of the concurrent creates to succeed but %d did", created.Load())
+	}
+
+	// Meta data that cannot be read is an error, not a new table
+	garbage := []byte("{not json")
+	if err := storage.WriteFileAtomic(cfg.FS(), db.metaPath("table107"), garbage); err != nil {
+		t.Fatalf("TestCreateTable: WriteFileAtomic error %v", err)
+	}
+	if _, err := db.CreateTable("table107", map[string]column.SUPPORTED_TYPE{"id1": column.INT}, pkey); err == nil {
+		t.Errorf("TestCreateTable: Expected an error for unreadable meta data")
+	}
+	if data, err := storage.ReadFile(cfg.FS(), db.metaPath("table107")); err != nil || string(data) != string(garbage) {
+		t.Errorf("TestCreateTable: Expected the meta data to be left alone but found %q: %v", data, err)
+	}
+}
+
+func TestBlockSize(t *testing.T) {
+	fsys := storage.NewMemFS()
+	cols := map[string]column.SUPPORTED_TYPE{"id": column.INT, "name": column.STRING}
+	pkey := column.Column{Name: "id", Type: column.INT}
+	name := func(i int) []byte { return []byte(fmt.Sprintf("%s%d", strings.Repeat("x", 3000), i)) }
+
+	cfg := newTestConfig(t, fsys)
+	cfg.SetBlockSize(16384)
+	db := NewDB("sizeDB", cfg)
+	tbl, err := db.CreateTable("table1", cols, pkey)
+	if err != nil {
+		t.Fatalf("CreateTable error: %v", err)
+	}
+	if tbl.info.BlockSize != 16384 {
+		t.Errorf("CreateTable error: expected blocks of %d bytes but got %d", 16384, tbl.info.BlockSize)
+	}
+	if _, err := db.CreateTableWithBlockSize("table2", cols, pkey, 1000); !errors.Is(err, storage.ErrBlockSize) {
+		t.Errorf("CreateTableWithBlockSize error: expected an invalid block size but got %v", err)
+	}
+	ctx := GetClientContextMgr(cfg).NewClientCtx(cfg, db)
+	for i := 0; i < 20; i++ {
+		if err := db.AddRecord(ctx, tbl, map[string][]byte{"id": []byte(fmt.Sprint(i)), "name": name(i)}); err != nil {
+			t.Fatalf("AddRecord error: %v", err)
+		}
+	}
+	if err := ctx.Commit(); err != nil {
+		t.Fatalf("Commit error: %v", err)
+	}
+	ctx.Close()
+	if err := GetBufMgr(cfg).FlushAll(); err != nil {
+		t.Fatalf("FlushAll error: %v", err)
+	}
+	// Values of 3000 bytes stay in the record and several records share a block
+	if n, _ := GetBufMgr(cfg).TableBlocks(tbl.info.Location, tbl.tblID); n > 4 {
+		t.Errorf("AddRecord error: expected 20 records in at most 4 blocks but got %d", n)
+	}
+	if data, _ := storage.ReadFile(fsys, toastPath(tbl.info.Location)); len(data) != 0 {
+		t.Errorf("AddRecord error: expected no overflow pages but got %d bytes", len(data))
+	}
+
+	// The table keeps its block size when opened with the default config
+	closeEngine(cfg)
+	cfg = newTestConfig(t, fsys)
+	db = NewDB("sizeDB", cfg)
+	tbl, err = db.CreateTable("table1", cols, pkey)
+	if err != nil {
+		t.Fatalf("CreateTable error: %v", err)
+	}
+	if tbl.info.BlockSize != 16384 {
+		t.Errorf("CreateTable error: expected the stored block size %d but got %d", 16384, tbl.info.BlockSize)
+	}
+	ctx = GetClientContextMgr(cfg).NewClientCtx(cfg, db)
+	defer ctx.Close()
+	if recs, err := db.GetRecord(ctx, tbl, "name", name(17)); err != nil || len(recs) != 1 {
+		t.Errorf("GetRecord error: expected record %d but got %d (%v)", 17, len(recs), err)
+	}
+	if _, err := NewDB("sizeDB", cfg).CreateTableWithBlockSize("table1", cols, pkey, 8192); !errors.Is(err, storage.ErrBlockSize) {
+		t.Errorf("CreateTableWithBlockSize error: expected a block size mismatch but got %v", err)
+	}
 }
 
 func TestGetRecord(t *testing.T) {
@@ -122,10 +236,9 @@ func TestGetRecord(t *testing.T) {
 	}
 
 	for _, val := range values {
-		_Catalog = nil
-		cfg := config.NewConfig(t.TempDir(), 1, 1)
+		cfg := newTestConfig(t, storage.NewMemFS())
 		db := NewDB("testDB", cfg)
-		ctx := GetClientContextMgr().NewClientCtx(cfg, db)
+		ctx := GetClientContextMgr(cfg).NewClientCtx(cfg, db)
 
 		cols := map[string]column.SUPPORTED_TYPE{
 			"id1": column.INT,
@@ -0,0 +1,101 @@
+package db
+
+import (
+	"fmt"
+	"log/slog"
+	"sync"
+
+	cfg "github.com/misachi/DarDB/config"
+)
+
+/*
+An engine is what the databases opened with one config share: the buffer pool, the WAL, the
+catalog, and the transactions and clients running on them. The config holds it, so databases
+opened with different configs, such as those of tests running in parallel, share nothing.
+*/
+type engine struct {
+	config    *cfg.Config
+	buf       *BufferPoolMgr
+	wal       *WalMgr
+	catalog   *Catalog
+	txns      *TransactionManager
+	rows      *rowLocks
+	clients   *ClientContextMgr
+	vacuumMtx sync.Mutex // Serializes vacuums, which lock several shards of the page table at once
+}
+
+/* engineMtx serializes opening and closing engines, so databases opened at once with a config share one */
+var engineMtx sync.Mutex
+
+/* getEngine returns the engine of config, opening it and recovering the data directory the first time */
+func getEngine(config *cfg.Config) *engine {
+	e, err := loadEngine(config)
+	if err != nil {
+		slog.Error("getEngine", "err", err)
+		panic(err)
+	}
+	return e
+}
+
+/* loadEngine is getEngine for callers that report the error */
+func loadEngine(config *cfg.Config) (*engine, error) {
+	engineMtx.Lock()
+	defer engineMtx.Unlock()
+	if e, ok := config.Engine().(*engine); ok {
+		return e, nil
+	}
+	e, err := openEngine(config)
+	if err != nil {
+		return nil, err
+	}
+	config.SetEngine(e)
+	return e, nil
+}
+
+/* openedEngine returns the engine of config, nil if no database was opened with it */
+func openedEngine(config *cfg.Config) *engine {
+	engineMtx.Lock()
+	defer engineMtx.Unlock()
+	e, _ := config.Engine().(*engine)
+	return e
+}
+
+/* openEngine opens the WAL and the data files of the data directory of config and recovers them */
+func openEngine(config *cfg.Config) (*engine, error) {
+	buf, err := NewBufferPoolMgr()
+	if err != nil {
+		return nil, fmt.Errorf("openEngine: %v", err)
+	}
+	e := &engine{config: config, buf: buf, txns: NewTxnManager(), rows: newRowLocks(), clients: NewClientContextMgr()}
+	buf.setCapacity(config.BufferSize())
+	buf.inUse = func(key pageKey) bool { return e.txns.inUse(key, nil) }
+	if err := buf.files.configure(config); err != nil {
+		return nil, fmt.Errorf("openEngine: %v", err)
+	}
+	wal, err := openWal(config)
+	if err != nil {
+		return nil, fmt.Errorf("openEngine: %v", err)
+	}
+	e.wal = wal
+	buf.wal = wal
+	e.catalog = newCatalog(e)
+	return e, nil
+}
+
+/* Close closes the WAL and the data files. Blocks still dirty in the pool are not written */
+func (e *engine) Close() error {
+	e.buf.files.closeFiles()
+	return e.wal.Close()
+}
+
+/* closeEngine closes the engine of config. The next database opened with config opens a new one */
+func closeEngine(config *cfg.Config) error {
+	engineMtx.Lock()
+	defer engineMtx.Unlock()
+	e, ok := config.Engine().(*engine)
+	if !ok {
+		return nil
+	}
+	config.SetEngine(nil)
+	return e.Close()
+}
@@ -0,0 +1,326 @@
+package db
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sync"
+
+	cfg "github.com/misachi/DarDB/config"
+	dsk "github.com/misachi/DarDB/storage"
+)
+
+/*
+fileMgr opens the files of the tables in the buffer pool: their data files, with the keys they are
+encrypted with, their free space maps and their overflow pages. It opens them in the filesystem, with
+the flags and under the master key of the config.
+*/
+type fileMgr struct {
+	hintMtx sync.Mutex                  // Guards fsms, toasts and paths
+	fsms    map[dsk.Tbl_t]*freeSpaceMap // Free space map of every table with pooled blocks
+	toasts  map[dsk.Tbl_t]*toastStore   // Overflow pages of every table with long values
+	paths   map[dsk.Tbl_t]string        // Data file of every table with pooled blocks
+
+	fileMtx  sync.Mutex              // Guards fs, flags, master, keyrings, files and stores
+	fs       dsk.FS                  // Filesystem the data files live in
+	flags    int                     // dsk.OpenWith flags of the data files
+	master   []byte                  // Master key of the config, nil when it has none
+	keyrings map[string]*keyring     // Keys of the encrypted databases by directory
+	files    map[string]*dsk.DiskMgr // Open data files by path, one handle each
+	stores   map[string]pageStore    // Pages of the open data files by path
+}
+
+func newFileMgr() *fileMgr {
+	return &fileMgr{
+		fsms:     make(map[dsk.Tbl_t]*freeSpaceMap),
+		toasts:   make(map[dsk.Tbl_t]*toastStore),
+		paths:    make(map[dsk.Tbl_t]string),
+		fs:       dsk.OSFS{},
+		keyrings: make(map[string]*keyring),
+		files:    make(map[string]*dsk.DiskMgr),
+		stores:   make(map[string]pageStore),
+	}
+}
+
+/* fsm returns the free space map of the table, loading it from dataPath the first time */
+func (fm *fileMgr) fsm(tblId dsk.Tbl_t, dataPath string) (*freeSpaceMap, error) {
+	fm.hintMtx.Lock()
+	defer fm.hintMtx.Unlock()
+	if m, ok := fm.fsms[tblId]; ok {
+		return m, nil
+	}
+	var store pageStore
+	s, err := fm.store(dataPath)
+	if err == nil {
+		store = s
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	m, err := loadFreeSpaceMap(fm.filesystem(), fsmPath(dataPath), store, tblId)
+	if err != nil {
+		return nil, err
+	}
+	fm.fsms[tblId] = m
+	return m, nil
+}
+
+/* toast returns the overflow store of the table, opening it next to dataPath the first time */
+func (fm *fileMgr) toast(tblId dsk.Tbl_t, dataPath string) (*toastStore, error) {
+	fm.hintMtx.Lock()
+	defer fm.hintMtx.Unlock()
+	if s, ok := fm.toasts[tblId]; ok {
+		return s, nil
+	}
+	mgr, err := fm.file(dataPath)
+	if err != nil {
+		return nil, err
+	}
+	var keys *keyring
+	if mgr.Encrypted() {
+		if keys, err = fm.keyring(path.Dir(dataPath)); err != nil {
+			return nil, err
+		}
+	}
+	s, err := openToastStore(fm.filesystem(), dataPath, tblId, keys, mgr.Header().KeyID)
+	if err != nil {
+		return nil, err
+	}
+	fm.toasts[tblId] = s
+	return s, nil
+}
+
+/* file returns the disk manager of the data file at dataPath, opening it with the key it is encrypted with the first time */
+func (fm *fileMgr) file(dataPath string) (*dsk.DiskMgr, error) {
+	fm.fileMtx.Lock()
+	defer fm.fileMtx.Unlock()
+	if mgr, ok := fm.files[dataPath]; ok {
+		return mgr, nil
+	}
+	mgr, err := dsk.OpenDiskMgr(fm.fs, dataPath, fm.flags)
+	if err != nil {
+		return nil, err
+	}
+	if mgr.Encrypted() {
+		c, err := fm.cipher(path.Dir(dataPath), mgr.Header().KeyID)
+		if err != nil {
+			mgr.Close()
+			return nil, fmt.Errorf("%s: %w", dataPath, err)
+		}
+		mgr.SetCipher(c)
+	}
+	fm.files[dataPath] = mgr
+	return mgr, nil
+}
+
+func (fm *fileMgr) cipher(dir string, keyID uint32) (*dsk.Cipher, error) {
+	keys, err := fm.keyringLocked(dir)
+	if err != nil {
+		return nil, err
+	}
+	return keys.cipher(keyID)
+}
+
+/* keyring returns the keys of the database in dir, loading them the first time */
+func (fm *fileMgr) keyring(dir string) (*keyring, error) {
+	fm.fileMtx.Lock()
+	defer fm.fileMtx.Unlock()
+	return fm.keyringLocked(dir)
+}
+
+func (fm *fileMgr) keyringLocked(dir string) (*keyring, error) {
+	if keys, ok := fm.keyrings[dir]; ok {
+		return keys, nil
+	}
+	if fm.master == nil {
+		return nil, ErrNoMasterKey
+	}
+	keys, err := loadKeyring(fm.fs, dir, fm.master)
+	if err != nil {
+		return nil, err
+	}
+	fm.keyrings[dir] = keys
+	return keys, nil
+}
+
+/* dataKey is the key new tables of the database in dir are encrypted with, 0 without a master key */
+func (fm *fileMgr) dataKey(dir string) (uint32, error) {
+	fm.fileMtx.Lock()
+	defer fm.fileMtx.Unlock()
+	if fm.master == nil {
+		return 0, nil
+	}
+	keys, err := fm.keyringLocked(dir)
+	if err != nil {
+		return 0, err
+	}
+	return keys.current()
+}
+
+/* isOpen reports whether the data file at dataPath is open */
+func (fm *fileMgr) isOpen(dataPath string) bool {
+	fm.fileMtx.Lock()
+	defer fm.fileMtx.Unlock()
+	_, ok := fm.files[dataPath]
+	return ok
+}
+
+/* store returns the pages of the data file at path, opening it the first time */
+func (fm *fileMgr) store(path string) (pageStore, error) {
+	mgr, err := fm.file(path)
+	if err != nil {
+		return nil, err
+	}
+	fm.fileMtx.Lock()
+	defer fm.fileMtx.Unlock()
+	if s, ok := fm.stores[path]; ok {
+		return s, nil
+	}
+	s, err := openPageStore(fm.fs, path, mgr)
+	if err != nil {
+		return nil, err
+	}
+	fm.stores[path] = s
+	return s, nil
+}
+
+/* blockSize is the block size of the data file at path, BLKSIZE if it cannot be opened */
+func (fm *fileMgr) blockSize(path string) int {
+	s, err := fm.store(path)
+	if err != nil {
+		return BLKSIZE
+	}
+	return s.blockSize()
+}
+
+func (fm *fileMgr) filesystem() dsk.FS {
+	fm.fileMtx.Lock()
+	defer fm.fileMtx.Unlock()
+	return fm.fs
+}
+
+/* setFS switches to opening data files in fsys with flags, closing the files opened before */
+func (fm *fileMgr) setFS(fsys dsk.FS, flags int) {
+	fm.fileMtx.Lock()
+	same := fm.fs == fsys && fm.flags == flags
+	fm.fileMtx.Unlock()
+	if same {
+		return
+	}
+	fm.closeFiles()
+	fm.fileMtx.Lock()
+	defer fm.fileMtx.Unlock()
+	fm.fs = fsys
+	fm.flags = flags
+}
+
+/* configure opens data files with the filesystem, flags and master key of config */
+func (fm *fileMgr) configure(config *cfg.Config) error {
+	master, err := config.MasterKey()
+	if err != nil {
+		return err
+	}
+	fm.setFS(config.FS(), dataFileFlags(config))
+	fm.fileMtx.Lock()
+	same := bytes.Equal(fm.master, master)
+	fm.fileMtx.Unlock()
+	if same {
+		return nil
+	}
+	fm.closeFiles()
+	fm.fileMtx.Lock()
+	defer fm.fileMtx.Unlock()
+	fm.master = master
+	return nil
+}
+
+/* dataFileFlags are the flags data files are opened with under config */
+func dataFileFlags(config *cfg.Config) int {
+	if config.DirectIO() {
+		return dsk.O_DIRECT
+	}
+	return 0
+}
+
+/* closeFiles closes the data and overflow files opened so far */
+func (fm *fileMgr) closeFiles() {
+	fm.hintMtx.Lock()
+	for tblId, s := range fm.toasts {
+		s.Close()
+		delete(fm.toasts, tblId)
+	}
+	fm.hintMtx.Unlock()
+
+	fm.fileMtx.Lock()
+	defer fm.fileMtx.Unlock()
+	for path, mgr := range fm.files {
+		mgr.Close()
+		delete(fm.files, path)
+		delete(fm.stores, path)
+	}
+	fm.keyrings = make(map[string]*keyring)
+}
+
+/* forget closes the files of a dropped table and drops what is known about it */
+func (fm *fileMgr) forget(tblId dsk.Tbl_t, dataPath string) {
+	fm.hintMtx.Lock()
+	if s, ok := fm.toasts[tblId]; ok {
+		s.Close()
+		delete(fm.toasts, tblId)
+	}
+	delete(fm.fsms, tblId)
+	delete(fm.paths, tblId)
+	fm.hintMtx.Unlock()
+
+	fm.fileMtx.Lock()
+	defer fm.fileMtx.Unlock()
+	if mgr, ok := fm.files[dataPath]; ok {
+		mgr.Close()
+		delete(fm.files, dataPath)
+		delete(fm.stores, dataPath)
+	}
+}
+
+/* loadedFsm returns the free space map of the table if it has been loaded */
+func (fm *fileMgr) loadedFsm(tblId dsk.Tbl_t) *freeSpaceMap {
+	fm.hintMtx.Lock()
+	defer fm.hintMtx.Unlock()
+	return fm.fsms[tblId]
+}
+
+func (fm *fileMgr) allFsms() []*freeSpaceMap {
+	fm.hintMtx.Lock()
+	defer fm.hintMtx.Unlock()
+	fsms := make([]*freeSpaceMap, 0, len(fm.fsms))
+	for _, m := range fm.fsms {
+		fsms = append(fsms, m)
+	}
+	return fsms
+}
+
+func (fm *fileMgr) registerPath(tblId dsk.Tbl_t, path string) {
+	if path == "" {
+		return
+	}
+	fm.hintMtx.Lock()
+	defer fm.hintMtx.Unlock()
+	fm.paths[tblId] = path
+}
+
+func (fm *fileMgr) path(tblId dsk.Tbl_t) (string, bool) {
+	fm.hintMtx.Lock()
+	defer fm.hintMtx.Unlock()
+	path, ok := fm.paths[tblId]
+	return path, ok
+}
+
+func (fm *fileMgr) allPaths() []string {
+	fm.hintMtx.Lock()
+	defer fm.hintMtx.Unlock()
+	paths := make([]string, 0, len(fm.paths))
+	for _, path := range fm.paths {
+		paths = append(paths, path)
+	}
+	return paths
+}
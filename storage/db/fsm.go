@@ -0,0 +1,280 @@
+package db
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io/fs"
+	"path"
+	"strings"
+	"sync"
+
+	dsk "github.com/misachi/DarDB/storage"
+)
+
+/*
+The free space map of a table keeps one byte per block: the free bytes of the block divided by
+its category size, a 256th of the block size. The bytes are the leaves of a max tree so a block
+with room for a record is found in O(log n) without reading any block. The map is a hint; GetFree
+checks the block it picks and corrects the map when it was wrong.
+
+On disk the map is stored next to the data file as
+
+	magic(4) | number of blocks(4) | crc32c of the categories(4) | categories
+*/
+const (
+	FSM_MAGIC      uint32 = 0x4653414d // "FSAM"
+	FSM_HDR_SIZE          = 12
+	FSM_CATEGORIES        = 256
+	FSM_FILE_EXT          = ".fsm"
+)
+
+var ErrFsmCorrupt = errors.New("free space map is corrupt")
+
+type freeSpaceMap struct {
+	mtx    sync.Mutex
+	fs     dsk.FS
+	path   string // Path of the map file
+	unit   int    // Free bytes per category
+	blocks int    // Number of blocks in the table
+	leaves int    // Leaf capacity of tree, a power of two
+	tree   []uint8
+	dirty  bool
+}
+
+/* fsmPath is the map file of the table stored in dataPath */
+func fsmPath(dataPath string) string {
+	return strings.TrimSuffix(dataPath, path.Ext(dataPath)) + FSM_FILE_EXT
+}
+
+/* category rounds free bytes down, so a block is never promised more room than it has */
+func (m *freeSpaceMap) category(free int) uint8 {
+	if free <= 0 {
+		return 0
+	}
+	c := free / m.unit
+	if c > 255 {
+		c = 255
+	}
+	return uint8(c)
+}
+
+/* neededCategory rounds the bytes needed up */
+func (m *freeSpaceMap) neededCategory(sz int) uint8 {
+	c := (sz + m.unit - 1) / m.unit
+	if c > 255 {
+		c = 255
+	}
+	return uint8(c)
+}
+
+func newFreeSpaceMap(fsys dsk.FS, mapPath string, blockSize int) *freeSpaceMap {
+	return &freeSpaceMap{fs: fsys, path: mapPath, unit: blockSize / FSM_CATEGORIES, leaves: 1, tree: make([]uint8, 2)}
+}
+
+/* grow makes room for n blocks. Callers hold mtx */
+func (m *freeSpaceMap) grow(n int) {
+	if n <= m.leaves {
+		if n > m.blocks {
+			m.blocks = n
+		}
+		return
+	}
+	leaves := m.leaves
+	for leaves < n {
+		leaves *= 2
+	}
+	tree := make([]uint8, 2*leaves)
+	copy(tree[leaves:], m.tree[m.leaves:m.leaves+m.blocks])
+	for i := leaves - 1; i > 0; i-- {
+		tree[i] = maxCategory(tree[2*i], tree[2*i+1])
+	}
+	m.tree = tree
+	m.leaves = leaves
+	m.blocks = n
+}
+
+func maxCategory(a, b uint8) uint8 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+/* set records the free bytes of a block, adding it to the map if it is new. Callers hold mtx */
+func (m *freeSpaceMap) set(blockId dsk.Blk_t, free int) {
+	idx := int(blockId)
+	m.grow(idx + 1)
+	node := m.leaves + idx
+	c := m.category(free)
+	if m.tree[node] == c {
+		return
+	}
+	m.tree[node] = c
+	m.dirty = true
+	for node /= 2; node > 0; node /= 2 {
+		c = maxCategory(m.tree[2*node], m.tree[2*node+1])
+		if m.tree[node] == c {
+			break
+		}
+		m.tree[node] = c
+	}
+}
+
+/* Update records the free bytes of a block */
+func (m *freeSpaceMap) Update(blockId dsk.Blk_t, free int) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.set(blockId, free)
+}
+
+/* Search returns the first block with at least sz free bytes */
+func (m *freeSpaceMap) Search(sz int) (dsk.Blk_t, bool) {
+	need := m.neededCategory(sz)
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if m.blocks == 0 || m.tree[1] < need {
+		return 0, false
+	}
+	node := 1
+	for node < m.leaves {
+		if m.tree[2*node] >= need {
+			node = 2 * node
+		} else {
+			node = 2*node + 1
+		}
+	}
+	idx := node - m.leaves
+	if idx >= m.blocks {
+		return 0, false
+	}
+	return dsk.Blk_t(idx), true
+}
+
+/* Extend adds a block with free bytes at the end of the table and returns its ID */
+func (m *freeSpaceMap) Extend(free int) dsk.Blk_t {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	blockId := dsk.Blk_t(m.blocks)
+	m.set(blockId, free)
+	return blockId
+}
+
+/* Truncate drops the blocks from n on */
+func (m *freeSpaceMap) Truncate(n int) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if n >= m.blocks {
+		return
+	}
+	for idx := n; idx < m.blocks; idx++ {
+		m.set(dsk.Blk_t(idx), 0)
+	}
+	m.blocks = n
+	m.dirty = true
+}
+
+/* Free returns the free bytes recorded for a block, rounded down to the category */
+func (m *freeSpaceMap) Free(blockId dsk.Blk_t) int {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if int(blockId) >= m.blocks {
+		return 0
+	}
+	return int(m.tree[m.leaves+int(blockId)]) * m.unit
+}
+
+/* NumBlocks is the number of blocks in the table */
+func (m *freeSpaceMap) NumBlocks() int {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	return m.blocks
+}
+
+/* Save writes the map if it changed since it was last saved */
+func (m *freeSpaceMap) Save() error {
+	m.mtx.Lock()
+	if !m.dirty {
+		m.mtx.Unlock()
+		return nil
+	}
+	data := make([]byte, FSM_HDR_SIZE+m.blocks)
+	copy(data[FSM_HDR_SIZE:], m.tree[m.leaves:m.leaves+m.blocks])
+	m.dirty = false
+	m.mtx.Unlock()
+
+	binary.LittleEndian.PutUint32(data[0:4], FSM_MAGIC)
+	binary.LittleEndian.PutUint32(data[4:8], uint32(len(data)-FSM_HDR_SIZE))
+	binary.LittleEndian.PutUint32(data[8:12], crc32.Checksum(data[FSM_HDR_SIZE:], crc32c))
+
+	err := dsk.WriteFileAtomic(m.fs, m.path, data)
+	if err != nil {
+		m.mtx.Lock()
+		m.dirty = true
+		m.mtx.Unlock()
+		return fmt.Errorf("freeSpaceMap Save: %v", err)
+	}
+	return nil
+}
+
+/* readFreeSpaceMap loads the map saved at mapPath for a table with blocks of blockSize bytes */
+func readFreeSpaceMap(fsys dsk.FS, mapPath string, blockSize int) (*freeSpaceMap, error) {
+	data, err := dsk.ReadFile(fsys, mapPath)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < FSM_HDR_SIZE || binary.LittleEndian.Uint32(data[0:4]) != FSM_MAGIC {
+		return nil, ErrFsmCorrupt
+	}
+	n := int(binary.LittleEndian.Uint32(data[4:8]))
+	if len(data) != FSM_HDR_SIZE+n || crc32.Checksum(data[FSM_HDR_SIZE:], crc32c) != binary.LittleEndian.Uint32(data[8:12]) {
+		return nil, ErrFsmCorrupt
+	}
+	m := newFreeSpaceMap(fsys, mapPath, blockSize)
+	m.grow(n)
+	copy(m.tree[m.leaves:], data[FSM_HDR_SIZE:])
+	for i := m.leaves - 1; i > 0; i-- {
+		m.tree[i] = maxCategory(m.tree[2*i], m.tree[2*i+1])
+	}
+	return m, nil
+}
+
+/*
+loadFreeSpaceMap opens the map saved at mapPath for the table in store, which is nil when the table
+has no data file yet. A missing or corrupt map is rebuilt from the data file, and blocks written
+after the map was saved are read to learn their free space.
+*/
+func loadFreeSpaceMap(fsys dsk.FS, mapPath string, store pageStore, tblId dsk.Tbl_t) (*freeSpaceMap, error) {
+	blockSize := BLKSIZE
+	if store != nil {
+		blockSize = store.blockSize()
+	}
+	m, err := readFreeSpaceMap(fsys, mapPath, blockSize)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) && !errors.Is(err, ErrFsmCorrupt) {
+			return nil, fmt.Errorf("loadFreeSpaceMap: %v", err)
+		}
+		m = newFreeSpaceMap(fsys, mapPath, blockSize)
+	}
+	if store == nil {
+		return m, nil
+	}
+
+	empty, _ := NewSizedBlock(nil, 0, tblId, blockSize)
+	onDisk := int(store.numBlocks())
+	for blockId := m.NumBlocks(); blockId < onDisk; blockId++ {
+		page, err := store.readPage(dsk.Blk_t(blockId))
+		free := 0
+		if err == ErrBlockNotFound {
+			// A hole left by a later block written first
+			free = empty.freeSpace()
+		} else if err == nil {
+			if blk, err := decodePage(page, dsk.Blk_t(blockId), tblId, blockSize); err == nil {
+				free = blk.freeSpace()
+			}
+		}
+		m.Update(dsk.Blk_t(blockId), free)
+	}
+	return m, nil
+}
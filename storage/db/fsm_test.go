@@ -0,0 +1,154 @@
+package db
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/misachi/DarDB/column"
+	st "github.com/misachi/DarDB/storage"
+	"github.com/misachi/DarDB/storage/db/row"
+)
+
+func TestFreeSpaceMap(t *testing.T) {
+	t.Parallel()
+	fsys := st.NewMemFS()
+	mapPath := "/1.fsm"
+	m := newFreeSpaceMap(fsys, mapPath, BLKSIZE)
+	if _, ok := m.Search(1); ok {
+		t.Errorf("Search error: expected no block in an empty map")
+	}
+
+	for i := 0; i < 100; i++ {
+		if blockId := m.Extend(100); blockId != st.Blk_t(i) {
+			t.Fatalf("Extend error: expected block %d but got %d", i, blockId)
+		}
+	}
+	m.Update(70, 2000)
+	m.Update(40, 1000)
+
+	values := []struct {
+		need      int
+		wantBlock st.Blk_t
+		wantFound bool
+	}{
+		{need: 50, wantBlock: 0, wantFound: true},
+		{need: 500, wantBlock: 40, wantFound: true},
+		{need: 1500, wantBlock: 70, wantFound: true},
+		{need: 3000, wantFound: false},
+	}
+	for _, val := range values {
+		blockId, ok := m.Search(val.need)
+		if ok != val.wantFound || (ok && blockId != val.wantBlock) {
+			t.Errorf("Search(%d) error: expected block %d (%v) but got %d (%v)", val.need, val.wantBlock, val.wantFound, blockId, ok)
+		}
+	}
+
+	if err := m.Save(); err != nil {
+		t.Fatalf("Save error: %v", err)
+	}
+	loaded, err := readFreeSpaceMap(fsys, mapPath, BLKSIZE)
+	if err != nil {
+		t.Fatalf("readFreeSpaceMap error: %v", err)
+	}
+	if loaded.NumBlocks() != 100 {
+		t.Errorf("readFreeSpaceMap error: expected %d blocks but got %d", 100, loaded.NumBlocks())
+	}
+	if blockId, ok := loaded.Search(1500); !ok || blockId != 70 {
+		t.Errorf("readFreeSpaceMap error: expected block %d to keep its free space", 70)
+	}
+}
+
+func TestGetFreeReusesSpace(t *testing.T) {
+	fsys := st.NewMemFS()
+	cfg := newTestConfig(t, fsys)
+	db := NewDB("fsmDB", cfg)
+	cols := []column.Column{column.NewColumn("id", column.INT), column.NewColumn("name", column.STRING)}
+	tbl, err := db.CreateTable("table1", map[string]column.SUPPORTED_TYPE{"id": column.INT, "name": column.STRING}, cols[0])
+	if err != nil {
+		t.Fatalf("CreateTable error: %v", err)
+	}
+	ctx := GetClientContextMgr(cfg).NewClientCtx(cfg, db)
+	defer ctx.Close()
+
+	name := []byte(fmt.Sprintf("%0200d", 0))
+	for i := 0; i < 60; i++ {
+		if _, err := tbl.AddRecord(ctx, cols, [][]byte{[]byte(fmt.Sprintf("%d", i)), name}); err != nil {
+			t.Fatalf("AddRecord error: %v", err)
+		}
+	}
+	bufMgr := GetBufMgr(cfg)
+	numBlocks, _ := bufMgr.TableBlocks(tbl.info.Location, tbl.tblID)
+	if numBlocks < 3 {
+		t.Fatalf("AddRecord error: expected records to spill over several blocks but got %d", numBlocks)
+	}
+	for blockId := 0; blockId < numBlocks; blockId++ {
+		blk, err := bufMgr.GetBlock(tbl.info.Location, tbl.tblID, st.Blk_t(blockId))
+		if err != nil {
+			t.Fatalf("GetBlock error: %v", err)
+		}
+		if blk.pageSize() > BLKSIZE {
+			t.Errorf("AddRecord error: block %d holds %d bytes, more than a page", blockId, blk.pageSize())
+		}
+	}
+
+	// Freeing space in the first block makes it the insert target again
+	for slot := 0; slot < 5; slot++ {
+		if err := tbl.DeleteRecord(ctx, RecordID{Block: 0, Slot: slot}); err != nil {
+			t.Fatalf("DeleteRecord error: %v", err)
+		}
+	}
+	rid, err := tbl.insert(ctx, mustRecord(t, cols, [][]byte{[]byte("100"), name}))
+	if err != nil {
+		t.Fatalf("insert error: %v", err)
+	}
+	if rid.Block != 0 {
+		t.Errorf("GetFree error: expected freed space in block 0 to be reused but got block %d", rid.Block)
+	}
+	if after, _ := bufMgr.TableBlocks(tbl.info.Location, tbl.tblID); after != numBlocks {
+		t.Errorf("GetFree error: expected no new block but table grew from %d to %d", numBlocks, after)
+	}
+
+	// A record that outgrows its block moves elsewhere
+	for i := 0; i < 10 && rid.Block == 0; i++ {
+		if rid, err = tbl.insert(ctx, mustRecord(t, cols, [][]byte{[]byte("100"), name})); err != nil {
+			t.Fatalf("insert error: %v", err)
+		}
+	}
+	longName := []byte(fmt.Sprintf("%01000d", 1))
+	moved, err := tbl.UpdateRecord(ctx, RecordID{Block: 0, Slot: 5}, cols, [][]byte{[]byte("5"), longName})
+	if err != nil {
+		t.Fatalf("UpdateRecord error: %v", err)
+	}
+	if moved.Block == 0 {
+		t.Errorf("UpdateRecord error: expected the record to move out of the full block")
+	}
+	if err := ctx.Commit(); err != nil {
+		t.Fatalf("Commit error: %v", err)
+	}
+
+	// The map survives a restart
+	if err := tbl.Flush(); err != nil {
+		t.Fatalf("Flush error: %v", err)
+	}
+	fsm, err := readFreeSpaceMap(fsys, fsmPath(tbl.info.Location), BLKSIZE)
+	if err != nil {
+		t.Fatalf("readFreeSpaceMap error: %v", err)
+	}
+	want := bufMgr.files.loadedFsm(tbl.tblID)
+	if fsm.NumBlocks() != want.NumBlocks() {
+		t.Errorf("Save error: expected %d blocks but got %d", want.NumBlocks(), fsm.NumBlocks())
+	}
+	for blockId := 0; blockId < fsm.NumBlocks(); blockId++ {
+		if fsm.Free(st.Blk_t(blockId)) != want.Free(st.Blk_t(blockId)) {
+			t.Errorf("Save error: block %d has %d free bytes on disk but %d in memory", blockId, fsm.Free(st.Blk_t(blockId)), want.Free(st.Blk_t(blockId)))
+		}
+	}
+}
+
+func mustRecord(t *testing.T, cols []column.Column, fieldVals [][]byte) *row.VarLengthRecord {
+	record, err := row.NewVarLengthRecord(cols, fieldVals)
+	if err != nil {
+		t.Fatalf("NewVarLengthRecord error: %v", err)
+	}
+	return record
+}
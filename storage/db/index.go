@@ -0,0 +1,389 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/misachi/DarDB/column"
+	st "github.com/misachi/DarDB/storage"
+	"github.com/misachi/DarDB/storage/db/row"
+)
+
+/*
+An index maps the values of a column of a table to the records holding them. A table with a
+primary key has a unique index on it, and DB.CreateIndex adds indexes on other columns, listed in
+the meta data of the table. The catalog keeps the indexes in memory and reads them from the table
+the first time they are used after the database is opened. Records without a value in the column,
+or added without the column, are not indexed.
+
+Inserts, updates and deletes change the indexes with the records, vacuum follows the records it
+moves and renumbers, and the end of a transaction settles the entries it added and removed. A key
+removed by a running transaction stays reserved until the transaction commits, so no other
+transaction takes a key a rollback gives back. Taking a unique key another running transaction
+added or removed fails with ErrWriteConflict, as it is not known yet whether the key stays taken.
+*/
+var (
+	ErrDuplicateKey   = errors.New("duplicate key value violates unique constraint")
+	ErrIndexExists    = errors.New("index already exists")
+	ErrIndexNotFound  = errors.New("index does not exist")
+	ErrColumnNotFound = errors.New("column does not exist")
+)
+
+type indexEntry struct {
+	key     string
+	rid     RecordID
+	placed  bool         // False until the record of a reserved key is added
+	added   *Transaction // Running transaction that added the entry, nil once it commits
+	removed *Transaction // Running transaction that removed the record or changed its key
+}
+
+/* Index finds the records of a table by the value of a column */
+type Index struct {
+	column  string
+	unique  bool
+	mtx     sync.Mutex
+	entries map[string][]*indexEntry
+	rids    map[RecordID]*indexEntry // Placed entries nobody removed, by record
+}
+
+/* indexChange is an entry of an index a transaction added or removed */
+type indexChange struct {
+	idx   *Index
+	entry *indexEntry
+}
+
+func newIndex(column string, unique bool) *Index {
+	return &Index{
+		column:  column,
+		unique:  unique,
+		entries: make(map[string][]*indexEntry),
+		rids:    make(map[RecordID]*indexEntry),
+	}
+}
+
+func (idx *Index) Column() string { return idx.column }
+
+func (idx *Index) Unique() bool { return idx.unique }
+
+/* Lookup returns the records whose column holds key. A record may have changed since, so callers check the key again */
+func (idx *Index) Lookup(key []byte) []RecordID {
+	idx.mtx.Lock()
+	defer idx.mtx.Unlock()
+	var rids []RecordID
+	for _, e := range idx.entries[string(key)] {
+		if e.placed && e.removed == nil {
+			rids = append(rids, e.rid)
+		}
+	}
+	return rids
+}
+
+/* reserve adds an entry for key, placed once txn has added its record. A unique index fails if the key is taken */
+func (idx *Index) reserve(txn *Transaction, key string) (*indexEntry, error) {
+	idx.mtx.Lock()
+	defer idx.mtx.Unlock()
+	if idx.unique {
+		for _, e := range idx.entries[key] {
+			switch {
+			case e.removed == txn:
+				// Free for txn, and reserved for it until it ends
+			case e.removed != nil || (e.added != nil && e.added != txn):
+				return nil, fmt.Errorf("key %q: %w", key, ErrWriteConflict)
+			default:
+				return nil, fmt.Errorf("key %q: %w", key, ErrDuplicateKey)
+			}
+		}
+	}
+	e := &indexEntry{key: key, added: txn}
+	idx.entries[key] = append(idx.entries[key], e)
+	return e, nil
+}
+
+/* place points a reserved entry at the record txn added for it */
+func (idx *Index) place(txn *Transaction, e *indexEntry, rid RecordID) {
+	idx.mtx.Lock()
+	e.rid, e.placed = rid, true
+	idx.rids[rid] = e
+	idx.mtx.Unlock()
+	txn.indexed = append(txn.indexed, indexChange{idx: idx, entry: e})
+}
+
+/* unreserve drops entries whose records were not added */
+func unreserve(reserved []indexChange) {
+	for _, c := range reserved {
+		c.idx.mtx.Lock()
+		c.idx.drop(c.entry)
+		c.idx.mtx.Unlock()
+	}
+}
+
+/* at returns the entry of the record at rid, nil if the record is not indexed */
+func (idx *Index) at(rid RecordID) *indexEntry {
+	idx.mtx.Lock()
+	defer idx.mtx.Unlock()
+	return idx.rids[rid]
+}
+
+/* unset marks the entry of the record at rid removed by txn, which deleted the record or changed its key */
+func (idx *Index) unset(txn *Transaction, rid RecordID) {
+	idx.mtx.Lock()
+	e := idx.rids[rid]
+	if e == nil {
+		idx.mtx.Unlock()
+		return
+	}
+	e.removed = txn
+	delete(idx.rids, rid)
+	idx.mtx.Unlock()
+	txn.indexed = append(txn.indexed, indexChange{idx: idx, entry: e})
+}
+
+/* move points the entry of the record at from to to, where txn moved the record */
+func (idx *Index) move(txn *Transaction, from, to RecordID) {
+	idx.mtx.Lock()
+	e := idx.rids[from]
+	if e == nil {
+		idx.mtx.Unlock()
+		return
+	}
+	e.removed = txn
+	delete(idx.rids, from)
+	moved := &indexEntry{key: e.key, rid: to, placed: true, added: txn}
+	idx.entries[e.key] = append(idx.entries[e.key], moved)
+	idx.rids[to] = moved
+	idx.mtx.Unlock()
+	txn.indexed = append(txn.indexed, indexChange{idx: idx, entry: e}, indexChange{idx: idx, entry: moved})
+}
+
+/* renumber follows the records of a block vacuum compacted, slots mapping their old slots to the new ones */
+func (idx *Index) renumber(blockId st.Blk_t, slots map[int]int) {
+	idx.mtx.Lock()
+	defer idx.mtx.Unlock()
+	moved := make([]*indexEntry, 0, len(slots))
+	for from, to := range slots {
+		rid := RecordID{Block: blockId, Slot: from}
+		if e := idx.rids[rid]; e != nil {
+			delete(idx.rids, rid)
+			e.rid.Slot = to
+			moved = append(moved, e)
+		}
+	}
+	for _, e := range moved {
+		idx.rids[e.rid] = e
+	}
+}
+
+/* drop removes an entry. Callers hold mtx */
+func (idx *Index) drop(e *indexEntry) {
+	list := idx.entries[e.key]
+	for i, other := range list {
+		if other == e {
+			list = append(list[:i:i], list[i+1:]...)
+			break
+		}
+	}
+	if len(list) == 0 {
+		delete(idx.entries, e.key)
+	} else {
+		idx.entries[e.key] = list
+	}
+	if e.placed && idx.rids[e.rid] == e {
+		delete(idx.rids, e.rid)
+	}
+}
+
+/* settleIndexes keeps or drops the index entries t added and removed once it commits or rolls back, newest first */
+func (t *Transaction) settleIndexes(committed bool) {
+	for i := len(t.indexed) - 1; i >= 0; i-- {
+		c := t.indexed[i]
+		c.idx.mtx.Lock()
+		e := c.entry
+		switch {
+		case committed && e.removed == t, !committed && e.added == t:
+			c.idx.drop(e)
+		case committed && e.added == t:
+			e.added = nil
+		case !committed && e.removed == t:
+			e.removed = nil
+			c.idx.rids[e.rid] = e
+		}
+		c.idx.mtx.Unlock()
+	}
+	t.indexed = nil
+}
+
+/* columnValue returns the value fieldVals give the column named name, empty if they do not set it */
+func columnValue(cols []column.Column, fieldVals [][]byte, name string) string {
+	for i, col := range cols {
+		if col.Name == name && i < len(fieldVals) {
+			return string(fieldVals[i])
+		}
+	}
+	return ""
+}
+
+/* lockIndexes read-locks the indexes of the table, reading them first if needed. Callers unlock entry.idxMtx */
+func (tbl *Table) lockIndexes() ([]*Index, error) {
+	entry := tbl.entry
+	entry.idxMtx.RLock()
+	for !entry.indexed {
+		entry.idxMtx.RUnlock()
+		entry.idxMtx.Lock()
+		err := tbl.buildIndexes()
+		entry.idxMtx.Unlock()
+		if err != nil {
+			return nil, err
+		}
+		entry.idxMtx.RLock()
+	}
+	return entry.indexes, nil
+}
+
+/* Indexes returns the indexes of the table */
+func (tbl *Table) Indexes() ([]*Index, error) {
+	indexes, err := tbl.lockIndexes()
+	if err != nil {
+		return nil, fmt.Errorf("Indexes: %v", err)
+	}
+	defer tbl.entry.idxMtx.RUnlock()
+	return append([]*Index{}, indexes...), nil
+}
+
+/* buildIndexes reads the indexes of the table if they are not loaded. Callers hold entry.idxMtx */
+func (tbl *Table) buildIndexes() error {
+	if tbl.entry.indexed {
+		return nil
+	}
+	var indexes []*Index
+	if tbl.info.Pkey.Name != "" {
+		indexes = append(indexes, newIndex(tbl.info.Pkey.Name, true))
+	}
+	for _, name := range tbl.info.Indexes {
+		indexes = append(indexes, newIndex(name, false))
+	}
+	if err := tbl.readIndexes(indexes...); err != nil {
+		return err
+	}
+	tbl.entry.indexes, tbl.entry.indexed = indexes, true
+	return nil
+}
+
+/* readIndexes adds the live records of the table to indexes */
+func (tbl *Table) readIndexes(indexes ...*Index) error {
+	if len(indexes) == 0 {
+		return nil
+	}
+	cols := make([]int, len(indexes))
+	for i, idx := range indexes {
+		cols[i] = -1
+		for j, col := range tbl.info.Column {
+			if col.Name == idx.column {
+				cols[i] = j
+			}
+		}
+	}
+	colData := row.NewColumnData_(tbl.info.Column)
+	iter := tbl.blockIterator()
+	defer iter.Close()
+	for {
+		blk, err := iter.Next()
+		if err != nil {
+			return fmt.Errorf("readIndexes: %v", err)
+		}
+		if blk == nil {
+			return nil
+		}
+		blk.mut.RLock()
+		for slot := range blk.recLocation {
+			if blk.isDeleted(slot) {
+				continue
+			}
+			values, err := blk.recordValues(slot, colData)
+			if err != nil {
+				blk.mut.RUnlock()
+				return fmt.Errorf("readIndexes: %v", err)
+			}
+			rid := RecordID{Block: blk.blockId, Slot: slot}
+			for i, idx := range indexes {
+				if cols[i] < 0 || len(values[cols[i]]) == 0 {
+					continue
+				}
+				e := &indexEntry{key: string(values[cols[i]]), rid: rid, placed: true}
+				idx.entries[e.key] = append(idx.entries[e.key], e)
+				idx.rids[rid] = e
+			}
+		}
+		blk.mut.RUnlock()
+	}
+}
+
+/* CreateIndex indexes the records of tbl by the value of column. No running transaction may have used the table */
+func (db *DB) CreateIndex(tbl *Table, column string) error {
+	if !tbl.hasColumn(column) {
+		return fmt.Errorf("CreateIndex: %s.%s: %w", tbl.info.Name, column, ErrColumnNotFound)
+	}
+	entry := tbl.entry
+	entry.idxMtx.Lock()
+	defer entry.idxMtx.Unlock()
+	if err := tbl.buildIndexes(); err != nil {
+		return fmt.Errorf("CreateIndex: %v", err)
+	}
+	for _, idx := range entry.indexes {
+		if idx.column == column {
+			return fmt.Errorf("CreateIndex: %s.%s: %w", tbl.info.Name, column, ErrIndexExists)
+		}
+	}
+	// The changes of a running transaction would not be settled in the new index
+	if db.engine.txns.tableInUse(tbl.tblID, nil) {
+		return fmt.Errorf("CreateIndex: %s: %w", tbl.info.Name, ErrTableInUse)
+	}
+	idx := newIndex(column, false)
+	if err := tbl.readIndexes(idx); err != nil {
+		return fmt.Errorf("CreateIndex: %v", err)
+	}
+	tbl.info.Indexes = append(tbl.info.Indexes, column)
+	if err := tbl.saveInfo(); err != nil {
+		tbl.info.Indexes = tbl.info.Indexes[:len(tbl.info.Indexes)-1]
+		return fmt.Errorf("CreateIndex: %v", err)
+	}
+	entry.indexes = append(entry.indexes, idx)
+	db.indexes.Add(1)
+	return nil
+}
+
+/* DropIndex drops the index on column of tbl that CreateIndex added */
+func (db *DB) DropIndex(tbl *Table, column string) error {
+	entry := tbl.entry
+	entry.idxMtx.Lock()
+	defer entry.idxMtx.Unlock()
+	names := tbl.info.Indexes
+	for i, name := range names {
+		if name != column {
+			continue
+		}
+		tbl.info.Indexes = append(names[:i:i], names[i+1:]...)
+		if err := tbl.saveInfo(); err != nil {
+			tbl.info.Indexes = names
+			return fmt.Errorf("DropIndex: %v", err)
+		}
+		for j, idx := range entry.indexes {
+			if idx.column == column && !idx.unique {
+				entry.indexes = append(entry.indexes[:j:j], entry.indexes[j+1:]...)
+				break
+			}
+		}
+		db.indexes.Add(1)
+		return nil
+	}
+	return fmt.Errorf("DropIndex: %s.%s: %w", tbl.info.Name, column, ErrIndexNotFound)
+}
+
+func (tbl *Table) hasColumn(name string) bool {
+	for _, col := range tbl.info.Column {
+		if col.Name == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,266 @@
+package db
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/misachi/DarDB/column"
+	st "github.com/misachi/DarDB/storage"
+)
+
+func TestPrimaryKey(t *testing.T) {
+	cfg := newTestConfig(t, st.NewMemFS())
+	db := NewDB("pkeyDB", cfg)
+	cols := map[string]column.SUPPORTED_TYPE{"key": column.STRING, "val": column.STRING}
+	tbl, err := db.CreateTable("table1", cols, column.Column{Name: "key", Type: column.STRING})
+	if err != nil {
+		t.Fatalf("CreateTable error: %v", err)
+	}
+	ctx := GetClientContextMgr(cfg).NewClientCtx(cfg, db)
+	defer ctx.Close()
+
+	values := func(key, val string) [][]byte {
+		vals := make([][]byte, len(tbl.info.Column))
+		for i, col := range tbl.info.Column {
+			if col.Name == "key" {
+				vals[i] = []byte(key)
+			} else {
+				vals[i] = []byte(val)
+			}
+		}
+		return vals
+	}
+	add := func(key string) error {
+		_, err := tbl.AddRecord(ctx, tbl.info.Column, values(key, "v"))
+		return err
+	}
+
+	// Keys moved out of line are compared by value
+	long := strings.Repeat("k", 3000)
+	for _, key := range []string{"a", "b", long} {
+		if err := add(key); err != nil {
+			t.Fatalf("AddRecord error: %v", err)
+		}
+	}
+	if err := ctx.Commit(); err != nil {
+		t.Fatalf("Commit error: %v", err)
+	}
+	for _, key := range []string{"a", long} {
+		if err := add(key); !errors.Is(err, ErrDuplicateKey) {
+			t.Errorf("AddRecord error: expected ErrDuplicateKey for key %.10q but got %v", key, err)
+		}
+	}
+
+	// The keys are read back from the table once the indexes are dropped from memory
+	tbl.entry.idxMtx.Lock()
+	tbl.entry.indexed = false
+	tbl.entry.idxMtx.Unlock()
+	if err := add(long); !errors.Is(err, ErrDuplicateKey) {
+		t.Errorf("AddRecord error: expected ErrDuplicateKey after reading the keys but got %v", err)
+	}
+
+	rids := make(map[string]RecordID)
+	scan := tbl.Scan(ctx)
+	for {
+		rid, vals, err := scan.Next()
+		if err != nil {
+			t.Fatalf("Scan error: %v", err)
+		}
+		if vals == nil {
+			break
+		}
+		for i, col := range tbl.info.Column {
+			if col.Name == "key" {
+				rids[string(vals[i])] = rid
+			}
+		}
+	}
+	if _, err := tbl.UpdateRecord(ctx, rids["a"], tbl.info.Column, values("b", "v")); !errors.Is(err, ErrDuplicateKey) {
+		t.Errorf("UpdateRecord error: expected ErrDuplicateKey but got %v", err)
+	}
+	if _, err := tbl.UpdateRecord(ctx, rids["a"], tbl.info.Column, values("a", "w")); err != nil {
+		t.Errorf("UpdateRecord error: keeping the key: %v", err)
+	}
+	if _, err := tbl.UpdateRecord(ctx, rids["a"], tbl.info.Column, values("c", "v")); err != nil {
+		t.Fatalf("UpdateRecord error: %v", err)
+	}
+	if err := add("a"); err != nil {
+		t.Errorf("AddRecord error: expected the old key to be free but got %v", err)
+	}
+	if err := tbl.DeleteRecord(ctx, rids["b"]); err != nil {
+		t.Fatalf("DeleteRecord error: %v", err)
+	}
+	if err := add("b"); err != nil {
+		t.Errorf("AddRecord error: expected a key the transaction deleted to be free for it but got %v", err)
+	}
+
+	// Rolling back gives the keys back to the records they belonged to
+	if err := ctx.Rollback(); err != nil {
+		t.Fatalf("Rollback error: %v", err)
+	}
+	for _, key := range []string{"a", "b"} {
+		if err := add(key); !errors.Is(err, ErrDuplicateKey) {
+			t.Errorf("AddRecord error: expected ErrDuplicateKey for %q after rollback but got %v", key, err)
+		}
+	}
+	if err := add("c"); err != nil {
+		t.Errorf("AddRecord error: expected the rolled back key to be free but got %v", err)
+	}
+}
+
+func TestIndexReservesKeys(t *testing.T) {
+	cfg := newTestConfig(t, st.NewMemFS())
+	db := NewDB("pkeyDB", cfg)
+	cols := map[string]column.SUPPORTED_TYPE{"key": column.STRING, "val": column.STRING}
+	tbl, err := db.CreateTable("table1", cols, column.Column{Name: "key", Type: column.STRING})
+	if err != nil {
+		t.Fatalf("CreateTable error: %v", err)
+	}
+	first := GetClientContextMgr(cfg).NewClientCtx(cfg, db)
+	defer first.Close()
+	second := GetClientContextMgr(cfg).NewClientCtx(cfg, db)
+	defer second.Close()
+	add := func(ctx *ClientContext, key, val string) error {
+		_, err := tbl.AddRecord(ctx, []column.Column{{Name: "key", Type: column.STRING}, {Name: "val", Type: column.STRING}}, [][]byte{[]byte(key), []byte(val)})
+		return err
+	}
+	lookup := func(key string) []RecordID {
+		indexes, err := tbl.Indexes()
+		if err != nil {
+			t.Fatalf("Indexes error: %v", err)
+		}
+		return indexes[0].Lookup([]byte(key))
+	}
+	if err := add(first, "a", "one"); err != nil {
+		t.Fatalf("AddRecord error: %v", err)
+	}
+	if err := add(second, "a", "two"); !errors.Is(err, ErrWriteConflict) {
+		t.Errorf("AddRecord error: expected ErrWriteConflict for a key added by a running transaction but got %v", err)
+	}
+	if err := first.Commit(); err != nil {
+		t.Fatalf("Commit error: %v", err)
+	}
+	rids := lookup("a")
+	if len(rids) != 1 {
+		t.Fatalf("Lookup error: expected one record but got %v", rids)
+	}
+
+	// A deleted key stays taken until the delete commits, so the rollback gets it back
+	if err := tbl.DeleteRecord(first, rids[0]); err != nil {
+		t.Fatalf("DeleteRecord error: %v", err)
+	}
+	if got := lookup("a"); len(got) != 0 {
+		t.Errorf("Lookup error: expected no record once deleted but got %v", got)
+	}
+	if err := add(second, "a", "two"); !errors.Is(err, ErrWriteConflict) {
+		t.Errorf("AddRecord error: expected ErrWriteConflict for a key deleted by a running transaction but got %v", err)
+	}
+	if err := first.Rollback(); err != nil {
+		t.Fatalf("Rollback error: %v", err)
+	}
+	if err := add(second, "a", "two"); !errors.Is(err, ErrDuplicateKey) {
+		t.Errorf("AddRecord error: expected ErrDuplicateKey after the rollback but got %v", err)
+	}
+	if got := lookup("a"); len(got) != 1 || got[0] != rids[0] {
+		t.Errorf("Lookup error: expected %v after the rollback but got %v", rids, got)
+	}
+
+	// Once the delete commits the key is free
+	if err := tbl.DeleteRecord(first, rids[0]); err != nil {
+		t.Fatalf("DeleteRecord error: %v", err)
+	}
+	if err := first.Commit(); err != nil {
+		t.Fatalf("Commit error: %v", err)
+	}
+	if err := add(second, "a", "two"); err != nil {
+		t.Errorf("AddRecord error: expected the key to be free but got %v", err)
+	}
+	if err := second.Commit(); err != nil {
+		t.Fatalf("Commit error: %v", err)
+	}
+}
+
+func TestCreateIndex(t *testing.T) {
+	cfg := newTestConfig(t, st.NewMemFS())
+	db := NewDB("indexDB", cfg)
+	cols := map[string]column.SUPPORTED_TYPE{"key": column.STRING, "val": column.STRING}
+	tbl, err := db.CreateTable("table1", cols, column.Column{Name: "key", Type: column.STRING})
+	if err != nil {
+		t.Fatalf("CreateTable error: %v", err)
+	}
+	ctx := GetClientContextMgr(cfg).NewClientCtx(cfg, db)
+	defer ctx.Close()
+	add := func(key, val string) RecordID {
+		if _, err := tbl.AddRecord(ctx, []column.Column{{Name: "key", Type: column.STRING}, {Name: "val", Type: column.STRING}}, [][]byte{[]byte(key), []byte(val)}); err != nil {
+			t.Fatalf("AddRecord error: %v", err)
+		}
+		return tbl.entry.indexes[0].Lookup([]byte(key))[0]
+	}
+	add("a", "x")
+	rid := add("b", "x")
+	if err := db.CreateIndex(tbl, "val"); !errors.Is(err, ErrTableInUse) {
+		t.Errorf("CreateIndex error: expected ErrTableInUse but got %v", err)
+	}
+	if err := ctx.Commit(); err != nil {
+		t.Fatalf("Commit error: %v", err)
+	}
+	version := db.IndexVersion()
+	if err := db.CreateIndex(tbl, "val"); err != nil {
+		t.Fatalf("CreateIndex error: %v", err)
+	}
+	if err := db.CreateIndex(tbl, "val"); !errors.Is(err, ErrIndexExists) {
+		t.Errorf("CreateIndex error: expected ErrIndexExists but got %v", err)
+	}
+	if err := db.CreateIndex(tbl, "missing"); !errors.Is(err, ErrColumnNotFound) {
+		t.Errorf("CreateIndex error: expected ErrColumnNotFound but got %v", err)
+	}
+	if db.IndexVersion() == version {
+		t.Errorf("CreateIndex error: expected the index version to change")
+	}
+	byVal := tbl.entry.indexes[1]
+	if got := byVal.Lookup([]byte("x")); len(got) != 2 {
+		t.Errorf("Lookup error: expected the two records read from the table but got %v", got)
+	}
+
+	// Updates move the entries of the records they change
+	newRid, err := tbl.UpdateRecord(ctx, rid, []column.Column{{Name: "key", Type: column.STRING}, {Name: "val", Type: column.STRING}}, [][]byte{[]byte("b"), []byte(strings.Repeat("y", 3000))})
+	if err != nil {
+		t.Fatalf("UpdateRecord error: %v", err)
+	}
+	if err := ctx.Commit(); err != nil {
+		t.Fatalf("Commit error: %v", err)
+	}
+	if got := byVal.Lookup([]byte("x")); len(got) != 1 {
+		t.Errorf("Lookup error: expected one record left with the old value but got %v", got)
+	}
+	if got := byVal.Lookup([]byte(strings.Repeat("y", 3000))); len(got) != 1 || got[0] != newRid {
+		t.Errorf("Lookup error: expected [%v] but got %v", newRid, got)
+	}
+	if got := tbl.entry.indexes[0].Lookup([]byte("b")); len(got) != 1 || got[0] != newRid {
+		t.Errorf("Lookup error: expected the key to follow the record to %v but got %v", newRid, got)
+	}
+
+	// The index is read back from the table once the database is opened again
+	closeEngine(cfg)
+	db = NewDB("indexDB", cfg)
+	if tbl = db.GetTable("table1"); tbl == nil {
+		t.Fatalf("GetTable error: table1 is gone")
+	}
+	indexes, err := tbl.Indexes()
+	if err != nil {
+		t.Fatalf("Indexes error: %v", err)
+	}
+	if len(indexes) != 2 || indexes[1].Column() != "val" || len(indexes[1].Lookup([]byte("x"))) != 1 {
+		t.Errorf("Indexes error: expected the index on val back")
+	}
+	if err := db.DropIndex(tbl, "val"); err != nil {
+		t.Fatalf("DropIndex error: %v", err)
+	}
+	if err := db.DropIndex(tbl, "key"); !errors.Is(err, ErrIndexNotFound) {
+		t.Errorf("DropIndex error: expected ErrIndexNotFound for the primary key but got %v", err)
+	}
+	if indexes, _ := tbl.Indexes(); len(indexes) != 1 {
+		t.Errorf("DropIndex error: expected the primary key index only but got %d indexes", len(indexes))
+	}
+}
@@ -0,0 +1,319 @@
+package db
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	cfg "github.com/misachi/DarDB/config"
+	dsk "github.com/misachi/DarDB/storage"
+)
+
+/*
+Every encrypted database, and the WAL, has a keyring of data keys wrapped with the master key of
+the config:
+
+	magic(4) | version(2) | reserved(2) | number of keys(4) | crc32c of the keys(4) | ID(4) and wrapped key of each
+
+Each key is sealed with its ID as additional data. The newest key encrypts new files; the header
+of a data file records the ID of the key its pages are sealed with, so older keys stay until no
+table uses them. Only table pages, overflow values and the WAL are encrypted. Meta data, free space
+maps and page maps hold no row data and are not.
+*/
+const (
+	KEYRING_FILE              = "keyring"
+	KEYRING_MAGIC      uint32 = 0x4441524b // "DARK"
+	KEYRING_VERSION    uint16 = 1
+	KEYRING_HDR_SIZE          = 16
+	KEYRING_ENTRY_SIZE        = 4 + dsk.SEAL_SIZE + dsk.KEY_SIZE
+	ROTATE_FILE_EXT           = ".rotate"
+)
+
+var (
+	ErrNoMasterKey    = errors.New("data is encrypted but no master key is configured")
+	ErrKeyringCorrupt = errors.New("keyring is corrupt")
+	ErrNotEncrypted   = errors.New("table is not encrypted")
+	ErrTableOpen      = errors.New("table is open")
+)
+
+type keyring struct {
+	mtx     sync.Mutex
+	fs      dsk.FS
+	path    string
+	master  *dsk.Cipher
+	keys    map[uint32]*dsk.Cipher
+	wrapped map[uint32][]byte // Sealed keys as saved
+	latest  uint32            // ID of the newest key, 0 when there is none
+}
+
+func keyringPath(dir string) string {
+	return path.Join(dir, KEYRING_FILE)
+}
+
+func keyAAD(id uint32) []byte {
+	aad := make([]byte, 4)
+	binary.LittleEndian.PutUint32(aad, id)
+	return aad
+}
+
+/* loadKeyring reads the keyring in dir, or starts an empty one. A wrong master key fails with dsk.ErrDecrypt */
+func loadKeyring(fsys dsk.FS, dir string, master []byte) (*keyring, error) {
+	masterCipher, err := dsk.NewCipher(master)
+	if err != nil {
+		return nil, fmt.Errorf("loadKeyring: master key: %v", err)
+	}
+	k := &keyring{fs: fsys, path: keyringPath(dir), master: masterCipher, keys: make(map[uint32]*dsk.Cipher), wrapped: make(map[uint32][]byte)}
+	data, err := dsk.ReadFile(fsys, k.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return k, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("loadKeyring: %v", err)
+	}
+	if len(data) < KEYRING_HDR_SIZE || binary.LittleEndian.Uint32(data[0:4]) != KEYRING_MAGIC {
+		return nil, fmt.Errorf("loadKeyring: %s: %w", k.path, ErrKeyringCorrupt)
+	}
+	if version := binary.LittleEndian.Uint16(data[4:6]); version != KEYRING_VERSION {
+		return nil, fmt.Errorf("loadKeyring: %s: unknown version %d: %w", k.path, version, ErrKeyringCorrupt)
+	}
+	n := int(binary.LittleEndian.Uint32(data[8:12]))
+	if len(data) != KEYRING_HDR_SIZE+n*KEYRING_ENTRY_SIZE || crc32.Checksum(data[KEYRING_HDR_SIZE:], crc32c) != binary.LittleEndian.Uint32(data[12:16]) {
+		return nil, fmt.Errorf("loadKeyring: %s: %w", k.path, ErrKeyringCorrupt)
+	}
+	for i := 0; i < n; i++ {
+		entry := data[KEYRING_HDR_SIZE+i*KEYRING_ENTRY_SIZE:][:KEYRING_ENTRY_SIZE]
+		id := binary.LittleEndian.Uint32(entry[0:4])
+		key, err := masterCipher.Open(nil, entry[4:], keyAAD(id))
+		if err != nil {
+			return nil, fmt.Errorf("loadKeyring: %s: key %d: wrong master key: %w", k.path, id, err)
+		}
+		if k.keys[id], err = dsk.NewCipher(key); err != nil {
+			return nil, fmt.Errorf("loadKeyring: %v", err)
+		}
+		k.wrapped[id] = append([]byte{}, entry[4:]...)
+		if id > k.latest {
+			k.latest = id
+		}
+	}
+	return k, nil
+}
+
+/* current is the ID of the newest key, adding the first key if there is none */
+func (k *keyring) current() (uint32, error) {
+	k.mtx.Lock()
+	latest := k.latest
+	k.mtx.Unlock()
+	if latest != 0 {
+		return latest, nil
+	}
+	return k.add()
+}
+
+/* add saves a new random key and returns its ID */
+func (k *keyring) add() (uint32, error) {
+	k.mtx.Lock()
+	defer k.mtx.Unlock()
+	key, err := dsk.GenerateKey()
+	if err != nil {
+		return 0, fmt.Errorf("keyring add: %v", err)
+	}
+	id := k.latest + 1
+	wrapped, err := k.master.Seal(nil, key, keyAAD(id))
+	if err != nil {
+		return 0, fmt.Errorf("keyring add: %v", err)
+	}
+	c, err := dsk.NewCipher(key)
+	if err != nil {
+		return 0, fmt.Errorf("keyring add: %v", err)
+	}
+	k.keys[id] = c
+	k.wrapped[id] = wrapped
+	if err := k.save(); err != nil {
+		delete(k.keys, id)
+		delete(k.wrapped, id)
+		return 0, fmt.Errorf("keyring add: %v", err)
+	}
+	k.latest = id
+	return id, nil
+}
+
+func (k *keyring) cipher(id uint32) (*dsk.Cipher, error) {
+	k.mtx.Lock()
+	defer k.mtx.Unlock()
+	c, ok := k.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("keyring: %s has no key %d: %w", k.path, id, dsk.ErrNoKey)
+	}
+	return c, nil
+}
+
+/* retain drops the keys other than the newest that are not in used */
+func (k *keyring) retain(used map[uint32]bool) error {
+	k.mtx.Lock()
+	defer k.mtx.Unlock()
+	dropped := make(map[uint32]*dsk.Cipher)
+	for id, c := range k.keys {
+		if id != k.latest && !used[id] {
+			dropped[id] = c
+		}
+	}
+	if len(dropped) == 0 {
+		return nil
+	}
+	for id := range dropped {
+		delete(k.keys, id)
+	}
+	if err := k.save(); err != nil {
+		for id, c := range dropped {
+			k.keys[id] = c
+		}
+		return fmt.Errorf("keyring retain: %v", err)
+	}
+	for id := range dropped {
+		delete(k.wrapped, id)
+	}
+	return nil
+}
+
+/* save writes the keys in k.keys. The caller holds mtx */
+func (k *keyring) save() error {
+	ids := make([]uint32, 0, len(k.keys))
+	for id := range k.keys {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	data := make([]byte, KEYRING_HDR_SIZE, KEYRING_HDR_SIZE+len(ids)*KEYRING_ENTRY_SIZE)
+	for _, id := range ids {
+		data = append(data, keyAAD(id)...)
+		data = append(data, k.wrapped[id]...)
+	}
+	binary.LittleEndian.PutUint32(data[0:4], KEYRING_MAGIC)
+	binary.LittleEndian.PutUint16(data[4:6], KEYRING_VERSION)
+	binary.LittleEndian.PutUint32(data[8:12], uint32(len(ids)))
+	binary.LittleEndian.PutUint32(data[12:16], crc32.Checksum(data[KEYRING_HDR_SIZE:], crc32c))
+	if err := dsk.WriteFileAtomic(k.fs, k.path, data); err != nil {
+		return fmt.Errorf("keyring save: %v", err)
+	}
+	return nil
+}
+
+/*
+RotateTableKey re-encrypts the pages, overflow values and statistics of a table with a new data key of its
+database, then drops the keys no table of the database uses any more. It works on the files
+directly, so the database must not be open while it runs.
+*/
+func RotateTableKey(config *cfg.Config, dbName, tblName string) error {
+	master, err := config.MasterKey()
+	if err != nil {
+		return fmt.Errorf("RotateTableKey: %v", err)
+	}
+	if master == nil {
+		return fmt.Errorf("RotateTableKey: %w", ErrNoMasterKey)
+	}
+	fsys := config.FS()
+	dir := path.Join(config.DataPath(), dbName)
+	dataPath := path.Join(dir, fmt.Sprintf("%s.data", tblName))
+	if e := openedEngine(config); e != nil && e.buf.files.isOpen(dataPath) {
+		return fmt.Errorf("RotateTableKey: %s: %w", tblName, ErrTableOpen)
+	}
+	keys, err := loadKeyring(fsys, dir, master)
+	if err != nil {
+		return fmt.Errorf("RotateTableKey: %w", err)
+	}
+
+	src, err := dsk.NewDiskMgr(fsys, dataPath)
+	if err != nil {
+		return fmt.Errorf("RotateTableKey: %w", err)
+	}
+	defer src.Close()
+	hdr := src.Header()
+	if !src.Encrypted() {
+		return fmt.Errorf("RotateTableKey: %s: %w", tblName, ErrNotEncrypted)
+	}
+	oldCipher, err := keys.cipher(hdr.KeyID)
+	if err != nil {
+		return fmt.Errorf("RotateTableKey: %w", err)
+	}
+	src.SetCipher(oldCipher)
+	if hdr.KeyID, err = keys.add(); err != nil {
+		return fmt.Errorf("RotateTableKey: %v", err)
+	}
+	newCipher, _ := keys.cipher(hdr.KeyID)
+
+	// Both copies are complete and synced before either replaces its original. Overflow pages
+	// record the key they are sealed with, so a crash between the renames loses nothing
+	toastCopy, err := resealToast(fsys, dataPath, hdr.Table, keys, hdr.KeyID)
+	if err != nil {
+		return fmt.Errorf("RotateTableKey: %v", err)
+	}
+	if err := resealStats(fsys, path.Join(dir, tblName+STATS_FILE_EXT), hdr.Table, keys, hdr.KeyID); err != nil {
+		return fmt.Errorf("RotateTableKey: %v", err)
+	}
+	tmp := dataPath + ROTATE_FILE_EXT
+	if err := fsys.Remove(tmp); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("RotateTableKey: %v", err)
+	}
+	dst, err := dsk.CreateDiskMgr(fsys, tmp, hdr)
+	if err != nil {
+		return fmt.Errorf("RotateTableKey: %v", err)
+	}
+	defer dst.Close()
+	dst.SetCipher(newCipher)
+	store, err := openPageStore(fsys, dataPath, src)
+	if err != nil {
+		return fmt.Errorf("RotateTableKey: %v", err)
+	}
+	if err := store.copyTo(dst); err != nil {
+		return fmt.Errorf("RotateTableKey: %s: %w", tblName, err)
+	}
+	if err := dst.Flush(); err != nil {
+		return fmt.Errorf("RotateTableKey: %v", err)
+	}
+	if toastCopy != "" {
+		if err := fsys.Rename(toastCopy, toastPath(dataPath)); err != nil {
+			return fmt.Errorf("RotateTableKey: %v", err)
+		}
+	}
+	if err := fsys.Rename(tmp, dataPath); err != nil {
+		return fmt.Errorf("RotateTableKey: %v", err)
+	}
+	if err := fsys.Sync(dir); err != nil {
+		return fmt.Errorf("RotateTableKey: %v", err)
+	}
+
+	used, err := usedKeys(fsys, dir)
+	if err != nil {
+		return fmt.Errorf("RotateTableKey: %v", err)
+	}
+	if err := keys.retain(used); err != nil {
+		return fmt.Errorf("RotateTableKey: %v", err)
+	}
+	return nil
+}
+
+/* usedKeys is the set of keys the data files in dir are sealed with */
+func usedKeys(fsys dsk.FS, dir string) (map[uint32]bool, error) {
+	files, err := fsys.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("usedKeys: %v", err)
+	}
+	used := make(map[uint32]bool)
+	for _, f := range files {
+		if !strings.HasSuffix(f.Name(), ".data") {
+			continue
+		}
+		mgr, err := dsk.NewDiskMgr(fsys, path.Join(dir, f.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("usedKeys: %v", err)
+		}
+		used[mgr.Header().KeyID] = true
+		mgr.Close()
+	}
+	return used, nil
+}
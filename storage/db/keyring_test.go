@@ -0,0 +1,220 @@
+package db
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/misachi/DarDB/column"
+	"github.com/misachi/DarDB/config"
+	st "github.com/misachi/DarDB/storage"
+)
+
+/* newTestKeyFile writes a new master key to a file and returns its path */
+func newTestKeyFile(t *testing.T) string {
+	key, err := st.GenerateKey()
+	if err != nil {
+		t.Fatalf("GenerateKey error: %v", err)
+	}
+	name := path.Join(t.TempDir(), "master.key")
+	if err := os.WriteFile(name, []byte(hex.EncodeToString(key)+"\n"), 0600); err != nil {
+		t.Fatalf("WriteFile error: %v", err)
+	}
+	return name
+}
+
+func newEncryptedConfig(t *testing.T, fsys st.FS, keyFile string) *config.Config {
+	cfg := newTestConfig(t, fsys)
+	cfg.SetMasterKeyFile(keyFile)
+	return cfg
+}
+
+/* secretValue is long enough to be moved to overflow pages */
+func secretValue(i int) string {
+	return strings.Repeat(fmt.Sprintf("classified %d ", i), 200)
+}
+
+func TestEncryptedTable(t *testing.T) {
+	fsys := st.NewMemFS()
+	keyFile := newTestKeyFile(t)
+	cols := map[string]column.SUPPORTED_TYPE{"key": column.INT, "val": column.STRING}
+	pkey := column.Column{Name: "key", Type: column.INT}
+
+	cfg := newEncryptedConfig(t, fsys, keyFile)
+	db := NewDB("secretDB", cfg)
+	tbl, err := db.CreateTable("table1", cols, pkey)
+	if err != nil {
+		t.Fatalf("CreateTable error: %v", err)
+	}
+	ctx := GetClientContextMgr(cfg).NewClientCtx(cfg, db)
+	want := make(map[string]string)
+	for i := 0; i < 50; i++ {
+		val := fmt.Sprintf("classified row %d", i)
+		if i%10 == 0 {
+			val = secretValue(i)
+		}
+		if _, err := crashInsert(ctx, tbl, fmt.Sprint(i), val); err != nil {
+			t.Fatalf("insert error: %v", err)
+		}
+		want[fmt.Sprint(i)] = val
+	}
+	if err := ctx.Commit(); err != nil {
+		t.Fatalf("Commit error: %v", err)
+	}
+
+	// Recovery replays the encrypted log into encrypted pages
+	crash(cfg)
+	cfg = newEncryptedConfig(t, fsys, keyFile)
+	db = NewDB("secretDB", cfg)
+	if tbl, err = db.CreateTable("table1", cols, pkey); err != nil {
+		t.Fatalf("CreateTable error: %v", err)
+	}
+	ctx = GetClientContextMgr(cfg).NewClientCtx(cfg, db)
+	if got := crashRows(t, ctx, tbl); !sameRows(got, want) {
+		t.Errorf("Recover error: expected %d rows but got %d", len(want), len(got))
+	}
+	ctx.Close()
+	if _, err := db.Analyze(tbl); err != nil {
+		t.Fatalf("Analyze error: %v", err)
+	}
+	if err := GetBufMgr(cfg).FlushAll(); err != nil {
+		t.Fatalf("FlushAll error: %v", err)
+	}
+	tbl.entry.analysis = nil
+	if analysis, err := tbl.Analysis(); err != nil || analysis == nil || analysis.Column("val").Max == nil {
+		t.Errorf("Analysis error: expected the sealed statistics to read back but got %v", err)
+	}
+	// Sampled values are base64 in JSON, so plain text statistics would not show up as row data below
+	if data, _ := st.ReadFile(fsys, statsPath(tbl.info.Path)); json.Valid(data) {
+		t.Errorf("encryption error: statistics of an encrypted table are in plain text")
+	}
+
+	walDir := path.Join(cfg.DataPath(), WAL_DIR)
+	files := []string{tbl.info.Location, toastPath(tbl.info.Location), statsPath(tbl.info.Path)}
+	segments, _ := listSegments(fsys, walDir)
+	for _, lsn := range segments {
+		files = append(files, path.Join(walDir, segmentName(lsn)))
+	}
+	for _, name := range files {
+		data, err := st.ReadFile(fsys, name)
+		if err != nil || len(data) == 0 {
+			t.Fatalf("ReadFile error: expected %s to be written (%v)", name, err)
+		}
+		if bytes.Contains(data, []byte("classified")) {
+			t.Errorf("encryption error: %s holds row data in plain text", name)
+		}
+	}
+
+	// Without the master key, or with another one, nothing can be read
+	closeEngine(cfg)
+	if _, err := OpenWalMgr(fsys, walDir, 0, config.WAL_SYNC_FSYNC, nil); !errors.Is(err, ErrNoMasterKey) {
+		t.Errorf("OpenWalMgr error: expected an encrypted log to need the master key but got %v", err)
+	}
+	other, _ := st.GenerateKey()
+	if _, err := loadKeyring(fsys, path.Dir(tbl.info.Location), other); !errors.Is(err, st.ErrDecrypt) {
+		t.Errorf("loadKeyring error: expected the wrong master key to fail but got %v", err)
+	}
+	fm := newFileMgr()
+	fm.setFS(fsys, 0)
+	if _, err := fm.store(tbl.info.Location); !errors.Is(err, ErrNoMasterKey) {
+		t.Errorf("store error: expected an encrypted table to need the master key but got %v", err)
+	}
+}
+
+func TestRotateTableKey(t *testing.T) {
+	for _, codec := range []Compression{COMPRESSION_NONE, COMPRESSION_LZ} {
+		codec := codec
+		t.Run(codec.String(), func(t *testing.T) {
+			t.Parallel()
+			testRotateTableKey(t, codec)
+		})
+	}
+}
+
+func testRotateTableKey(t *testing.T, codec Compression) {
+	fsys := st.NewMemFS()
+	keyFile := newTestKeyFile(t)
+	cols := map[string]column.SUPPORTED_TYPE{"key": column.INT, "val": column.STRING}
+	pkey := column.Column{Name: "key", Type: column.INT}
+	opts := TableOptions{Compression: codec}
+
+	cfg := newEncryptedConfig(t, fsys, keyFile)
+	db := NewDB("rotateDB", cfg)
+	tbl, err := db.CreateTableWithOptions("table1", cols, pkey, opts)
+	if err != nil {
+		t.Fatalf("CreateTable error: %v", err)
+	}
+	ctx := GetClientContextMgr(cfg).NewClientCtx(cfg, db)
+	want := make(map[string]string)
+	for i := 0; i < 200; i++ {
+		val := fmt.Sprintf("row %d", i)
+		if i%40 == 0 {
+			val = secretValue(i)
+		}
+		if _, err := crashInsert(ctx, tbl, fmt.Sprint(i), val); err != nil {
+			t.Fatalf("insert error: %v", err)
+		}
+		want[fmt.Sprint(i)] = val
+	}
+	if err := ctx.Commit(); err != nil {
+		t.Fatalf("Commit error: %v", err)
+	}
+	ctx.Close()
+	if _, err := db.Analyze(tbl); err != nil {
+		t.Fatalf("Analyze error: %v", err)
+	}
+	if err := GetBufMgr(cfg).FlushAll(); err != nil {
+		t.Fatalf("FlushAll error: %v", err)
+	}
+	if err := RotateTableKey(cfg, "rotateDB", "table1"); !errors.Is(err, ErrTableOpen) {
+		t.Errorf("RotateTableKey error: expected an open table to be refused but got %v", err)
+	}
+	closeEngine(cfg)
+
+	dataPath := tbl.info.Location
+	before, _ := st.ReadFile(fsys, dataPath)
+	if err := RotateTableKey(cfg, "rotateDB", "table1"); err != nil {
+		t.Fatalf("RotateTableKey error: %v", err)
+	}
+	after, _ := st.ReadFile(fsys, dataPath)
+	if len(after) != len(before) || bytes.Equal(after[st.FILE_HDR_SIZE:], before[st.FILE_HDR_SIZE:]) {
+		t.Errorf("RotateTableKey error: expected every page to be sealed again in place")
+	}
+	mgr, err := st.NewDiskMgr(fsys, dataPath)
+	if err != nil {
+		t.Fatalf("NewDiskMgr error: %v", err)
+	}
+	keyID := mgr.Header().KeyID
+	mgr.Close()
+	master, _ := cfg.MasterKey()
+	keys, err := loadKeyring(fsys, path.Dir(dataPath), master)
+	if err != nil {
+		t.Fatalf("loadKeyring error: %v", err)
+	}
+	if keyID != 2 {
+		t.Errorf("RotateTableKey error: expected the table to use key 2 but got %d", keyID)
+	}
+	if _, err := keys.cipher(1); !errors.Is(err, st.ErrNoKey) {
+		t.Errorf("RotateTableKey error: expected the old key to be dropped but got %v", err)
+	}
+
+	cfg = newEncryptedConfig(t, fsys, keyFile)
+	db = NewDB("rotateDB", cfg)
+	if tbl, err = db.CreateTableWithOptions("table1", cols, pkey, opts); err != nil {
+		t.Fatalf("CreateTable error: %v", err)
+	}
+	ctx = GetClientContextMgr(cfg).NewClientCtx(cfg, db)
+	defer ctx.Close()
+	if got := crashRows(t, ctx, tbl); !sameRows(got, want) {
+		t.Errorf("RotateTableKey error: expected %d rows after rotation but got %d", len(want), len(got))
+	}
+	if analysis, err := tbl.Analysis(); err != nil || analysis == nil || analysis.Rows != int64(len(want)) {
+		t.Errorf("RotateTableKey error: expected the statistics to be sealed with the new key but got %v", err)
+	}
+}
@@ -0,0 +1,326 @@
+package db
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+
+	dsk "github.com/misachi/DarDB/storage"
+)
+
+/*
+On disk every block is framed by a page header:
+
+	magic(4) | version(2) | flags(2) | lsn(8) | payload length(4) | crc32c(4)
+
+followed by the payload written by Block.ToByte. The checksum covers the header, with the
+checksum field zeroed, and the payload, so torn writes and bit rot are caught when the page is
+read. Pages without the magic number predate the header and are parsed as a bare block. A page of
+zeros was allocated but never written.
+
+Bare blocks hold records in the legacy layout of row.VarLengthRecord.SetLegacy. Their blocks keep
+that layout when written back, and the page is flagged PAGE_FLAG_LEGACY.
+*/
+const (
+	PAGE_MAGIC       uint32 = 0x44415247 // "DARG"
+	PAGE_VERSION     uint16 = 2
+	PAGE_FLAG_LEGACY uint16 = 1 // Records in the legacy layout
+	PAGE_HDR_SIZE           = 24
+)
+
+var (
+	ErrBlockNotFound = errors.New("block does not exist on disk")
+	errTornPage      = errors.New("page is shorter than its header says")
+)
+
+/* ErrCorruptPage reports a page that failed verification when it was read */
+type ErrCorruptPage struct {
+	Table  dsk.Tbl_t
+	Block  dsk.Blk_t
+	Offset int64 // Offset of the page in the data file
+	Err    error
+}
+
+func (e *ErrCorruptPage) Error() string {
+	return fmt.Sprintf("corrupt page: table %d block %d at offset %d: %v", e.Table, e.Block, e.Offset, e.Err)
+}
+
+func (e *ErrCorruptPage) Unwrap() error {
+	return e.Err
+}
+
+type pageHeader struct {
+	magic   uint32
+	version uint16
+	flags   uint16
+	lsn     wal_t
+	length  uint32
+}
+
+func (h pageHeader) encode(buf []byte) {
+	binary.LittleEndian.PutUint32(buf[0:4], h.magic)
+	binary.LittleEndian.PutUint16(buf[4:6], h.version)
+	binary.LittleEndian.PutUint16(buf[6:8], h.flags)
+	binary.LittleEndian.PutUint64(buf[8:16], uint64(h.lsn))
+	binary.LittleEndian.PutUint32(buf[16:20], h.length)
+	binary.LittleEndian.PutUint32(buf[20:24], 0)
+}
+
+/* pageChecksum is the crc32c of the page with its checksum field zeroed */
+func pageChecksum(page []byte) uint32 {
+	sum := crc32.Update(0, crc32c, page[:20])
+	sum = crc32.Update(sum, crc32c, []byte{0, 0, 0, 0})
+	return crc32.Update(sum, crc32c, page[PAGE_HDR_SIZE:])
+}
+
+func decodePageHeader(buf []byte) (pageHeader, bool) {
+	if len(buf) < PAGE_HDR_SIZE || binary.LittleEndian.Uint32(buf[0:4]) != PAGE_MAGIC {
+		return pageHeader{}, false
+	}
+	return pageHeader{
+		magic:   PAGE_MAGIC,
+		version: binary.LittleEndian.Uint16(buf[4:6]),
+		flags:   binary.LittleEndian.Uint16(buf[6:8]),
+		lsn:     wal_t(binary.LittleEndian.Uint64(buf[8:16])),
+		length:  binary.LittleEndian.Uint32(buf[16:20]),
+	}, true
+}
+
+/* encodePage frames the block contents with a page header */
+func encodePage(blk *Block) []byte {
+	payload := blk.ToByte()
+	page := alignedBuffer(int64(PAGE_HDR_SIZE + len(payload)))
+	var flags uint16
+	if blk.legacy {
+		flags |= PAGE_FLAG_LEGACY
+	}
+	pageHeader{
+		magic:   PAGE_MAGIC,
+		version: PAGE_VERSION,
+		flags:   flags,
+		lsn:     blk.lsn,
+		length:  uint32(len(payload)),
+	}.encode(page)
+	copy(page[PAGE_HDR_SIZE:], payload)
+	binary.LittleEndian.PutUint32(page[20:24], pageChecksum(page))
+	return page
+}
+
+/* decodePage parses a framed page of a table with blocks of blockSize bytes, falling back to a bare block for pages without a header */
+func decodePage(data []byte, blkID dsk.Blk_t, tblId dsk.Tbl_t, blockSize int) (*Block, error) {
+	hdr, ok := decodePageHeader(data)
+	if !ok {
+		blk, err := NewSizedBlock(data, blkID, tblId, blockSize)
+		if err != nil {
+			return nil, err
+		}
+		blk.legacy = true
+		return blk, nil
+	}
+	if hdr.version != PAGE_VERSION {
+		return nil, fmt.Errorf("decodePage: unknown page version %d", hdr.version)
+	}
+	if hdr.flags&^PAGE_FLAG_LEGACY != 0 {
+		return nil, fmt.Errorf("decodePage: unknown page flags %#x", hdr.flags)
+	}
+	end := PAGE_HDR_SIZE + int(hdr.length)
+	if end > len(data) || end > blockSize {
+		return nil, fmt.Errorf("decodePage: payload of %d bytes exceeds page of %d bytes", hdr.length, len(data)-PAGE_HDR_SIZE)
+	}
+	if sum := pageChecksum(data[:end]); sum != binary.LittleEndian.Uint32(data[20:24]) {
+		return nil, fmt.Errorf("decodePage: checksum %08x does not match %08x", sum, binary.LittleEndian.Uint32(data[20:24]))
+	}
+	blk, err := NewSizedBlock(data[PAGE_HDR_SIZE:end], blkID, tblId, blockSize)
+	if err != nil {
+		return nil, fmt.Errorf("decodePage: %v", err)
+	}
+	blk.blockId = blkID
+	blk.tblId = tblId
+	blk.lsn = hdr.lsn
+	blk.legacy = hdr.flags&PAGE_FLAG_LEGACY != 0
+	return blk, nil
+}
+
+/*
+readPage reads block blockId, opening it if the file is encrypted. Reading past the end of the
+file, or a block of zeros, returns ErrBlockNotFound. A page cut short by the end of the file
+returns errTornPage
+*/
+func readPage(mgr *dsk.DiskMgr, blockId dsk.Blk_t) ([]byte, error) {
+	data := alignedBuffer(int64(mgr.BlockSize()))
+	n, err := mgr.ReadBlock(blockId, data)
+	if n == 0 && err == io.EOF {
+		return nil, ErrBlockNotFound
+	}
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, fmt.Errorf("readPage: Read error %v", err)
+	}
+	data = data[:n]
+	if isZero(data) {
+		return nil, ErrBlockNotFound
+	}
+	complete := n == mgr.BlockSize()
+	if mgr.Encrypted() {
+		page, _, err := mgr.OpenPage(data, blockId)
+		if errors.Is(err, io.ErrUnexpectedEOF) && !complete {
+			return nil, errTornPage
+		}
+		if err != nil {
+			return nil, fmt.Errorf("readPage: %w", err)
+		}
+		data, complete = page, true
+	}
+
+	hdr, ok := decodePageHeader(data)
+	if !ok {
+		// Bare block without a header
+		return data, nil
+	}
+	end := PAGE_HDR_SIZE + int(hdr.length)
+	if end > len(data) {
+		if !complete {
+			return nil, errTornPage
+		}
+		// decodePage rejects the length
+		return data, nil
+	}
+	return data[:end], nil
+}
+
+/* pageLSN is the LSN in the header of page, 0 for a bare block */
+func pageLSN(page []byte) uint64 {
+	hdr, _ := decodePageHeader(page)
+	return uint64(hdr.lsn)
+}
+
+func isZero(data []byte) bool {
+	for _, b := range data {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+fullPageImage returns the page of a block changed for the first time since the last checkpoint
+started, and nil otherwise. Logged with the change, it lets recovery rebuild the block when its
+write was torn.
+*/
+func (buf *BufferPoolMgr) fullPageImage(blk *Block) []byte {
+	if uint64(blk.lsn) >= buf.fullPageLSN.Load() {
+		return nil
+	}
+	return encodePage(blk)
+}
+
+/* pageStore reads and writes the pages of a table's data file, turning block IDs into file extents */
+type pageStore interface {
+	// readPage has the contract of the function readPage
+	readPage(blockId dsk.Blk_t) ([]byte, error)
+	writePage(blockId dsk.Blk_t, page []byte) error
+	numBlocks() int64
+	// blockSize is the room for a page, less than a block when pages are encrypted
+	blockSize() int
+	// offset is where the page of the block is stored, -1 if it is nowhere
+	offset(blockId dsk.Blk_t) int64
+	// usage is the number of blocks written and the bytes they take on disk
+	usage() (int64, int64)
+	sync() error
+	// copyTo writes every page to the same place in dst, sealed with the key of dst
+	copyTo(dst *dsk.DiskMgr) error
+	// truncate drops every block from n on
+	truncate(n int64) error
+}
+
+/* openPageStore picks the store matching the compression recorded in the header of the data file */
+func openPageStore(fsys dsk.FS, dataPath string, mgr *dsk.DiskMgr) (pageStore, error) {
+	codec := Compression(mgr.Compression())
+	if codec == COMPRESSION_NONE {
+		return filePages{mgr: mgr}, nil
+	}
+	if !codec.valid() {
+		return nil, fmt.Errorf("openPageStore: %s: unknown compression %d", dataPath, codec)
+	}
+	pmap, err := loadPageMap(fsys, pmapPath(dataPath))
+	if err != nil {
+		return nil, fmt.Errorf("openPageStore: %v", err)
+	}
+	return &compressedPages{mgr: mgr, pmap: pmap, codec: codec}, nil
+}
+
+/* filePages stores block n at the offset of block n */
+type filePages struct {
+	mgr *dsk.DiskMgr
+}
+
+func (p filePages) readPage(blockId dsk.Blk_t) ([]byte, error) {
+	return readPage(p.mgr, blockId)
+}
+
+func (p filePages) writePage(blockId dsk.Blk_t, page []byte) error {
+	sealed, err := p.mgr.SealPage(page, blockId, pageLSN(page))
+	if err != nil {
+		return fmt.Errorf("writePage: %w", err)
+	}
+	return p.mgr.WriteBlock(blockId, sealed)
+}
+
+func (p filePages) numBlocks() int64 {
+	return p.mgr.NumBlocks()
+}
+
+func (p filePages) blockSize() int {
+	return p.mgr.PageSize()
+}
+
+func (p filePages) offset(blockId dsk.Blk_t) int64 {
+	return p.mgr.BlockOffset(blockId)
+}
+
+func (p filePages) usage() (int64, int64) {
+	n := p.mgr.NumBlocks()
+	return n, n * int64(p.mgr.BlockSize())
+}
+
+func (p filePages) sync() error {
+	return p.mgr.Flush()
+}
+
+func (p filePages) truncate(n int64) error {
+	if p.mgr.NumBlocks() <= n {
+		return nil
+	}
+	return p.mgr.Truncate(n)
+}
+
+func (p filePages) copyTo(dst *dsk.DiskMgr) error {
+	data := alignedBuffer(int64(p.mgr.BlockSize()))
+	for blockId := dsk.Blk_t(0); int64(blockId) < p.mgr.NumBlocks(); blockId++ {
+		n, err := p.mgr.ReadBlock(blockId, data)
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return fmt.Errorf("copyTo: block %d: %v", blockId, err)
+		}
+		if isZero(data[:n]) {
+			// Keep blocks that were allocated but never written
+			if err := dst.WriteBlock(blockId, data[:0]); err != nil {
+				return fmt.Errorf("copyTo: %v", err)
+			}
+			continue
+		}
+		page, lsn, err := p.mgr.OpenPage(data[:n], blockId)
+		if err != nil {
+			return fmt.Errorf("copyTo: %w", err)
+		}
+		sealed, err := dst.SealPage(page, blockId, lsn)
+		if err != nil {
+			return fmt.Errorf("copyTo: %v", err)
+		}
+		if err := dst.WriteBlock(blockId, sealed); err != nil {
+			return fmt.Errorf("copyTo: %v", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package db
+
+import (
+	"sync"
+
+	dsk "github.com/misachi/DarDB/storage"
+)
+
+const PAGE_TABLE_SHARDS = 64 // Must be a power of two
+
+/* pageKey identifies a block frame in the buffer pool */
+type pageKey struct {
+	tbl dsk.Tbl_t
+	blk dsk.Blk_t
+}
+
+func newPageKey(tblId dsk.Tbl_t, blockId dsk.Blk_t) pageKey {
+	return pageKey{tbl: tblId, blk: blockId}
+}
+
+func (k pageKey) shard() uint64 {
+	// splitmix64 finalizer; block IDs are strided so the low bits alone are a poor hash
+	h := uint64(k.tbl)*0x9e3779b97f4a7c15 ^ uint64(k.blk)
+	h ^= h >> 30
+	h *= 0xbf58476d1ce4e5b9
+	h ^= h >> 27
+	h *= 0x94d049bb133111eb
+	h ^= h >> 31
+	return h & (PAGE_TABLE_SHARDS - 1)
+}
+
+type pageTableShard struct {
+	mtx    sync.Mutex // Guards frames and the pin counts of the blocks in it
+	frames map[pageKey]*Block
+}
+
+/* pageTable maps (table, block) pairs to pooled blocks. Each shard has its own lock so lookups on different blocks do not contend */
+type pageTable struct {
+	shards [PAGE_TABLE_SHARDS]pageTableShard
+}
+
+func newPageTable() *pageTable {
+	pt := &pageTable{}
+	for i := range pt.shards {
+		pt.shards[i].frames = make(map[pageKey]*Block)
+	}
+	return pt
+}
+
+/* lock locks and returns the shard holding key */
+func (pt *pageTable) lock(key pageKey) *pageTableShard {
+	shard := &pt.shards[key.shard()]
+	shard.mtx.Lock()
+	return shard
+}
+
+/* get returns the block of key, marking it used for the eviction sweep */
+func (pt *pageTable) get(key pageKey) *Block {
+	shard := pt.lock(key)
+	defer shard.mtx.Unlock()
+	blk := shard.frames[key]
+	if blk != nil {
+		blk.used = true
+	}
+	return blk
+}
+
+/* put adds blk unless the key is already present. The block in the table is returned */
+func (pt *pageTable) put(key pageKey, blk *Block) (*Block, bool) {
+	shard := pt.lock(key)
+	defer shard.mtx.Unlock()
+	if cached, ok := shard.frames[key]; ok {
+		return cached, false
+	}
+	shard.frames[key] = blk
+	return blk, true
+}
@@ -0,0 +1,343 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/misachi/DarDB/column"
+	"github.com/misachi/DarDB/config"
+	st "github.com/misachi/DarDB/storage"
+	"github.com/misachi/DarDB/storage/db/row"
+)
+
+func TestNewBlockGarbage(t *testing.T) {
+	t.Parallel()
+	values := [][]byte{
+		[]byte("no terminator"),
+		[]byte("12\nno second terminator"),
+		[]byte("12\n5:6\nrecord"),
+		[]byte("12\n900,2\nrecord"),
+		{0xff, 0xfe, '\n', 0x01, '\n'},
+	}
+	for _, val := range values {
+		if _, err := NewBlock(val, 0, 1); err == nil {
+			t.Errorf("NewBlock error: expected %q to be rejected", val)
+		}
+	}
+}
+
+func TestCorruptPage(t *testing.T) {
+	var tblId st.Tbl_t = 7
+	fsys, f := st.NewMemFS(), "/7"
+
+	blk, _ := NewBlock(nil, 1, tblId)
+	if err := blk.AddRecordWithBytes([]byte("3\n0,1:2,2\n6:15")); err != nil {
+		t.Fatalf("AddRecordWithBytes error: %v", err)
+	}
+	page := encodePage(blk)
+	data := make([]byte, 2*BLKSIZE)
+	copy(data[BLKSIZE:], page)
+	data[BLKSIZE+PAGE_HDR_SIZE+2] ^= 0x01 // Bit rot in the payload
+	if err := st.WriteFileAtomic(fsys, f, data); err != nil {
+		t.Fatalf("WriteFileAtomic error: %v", err)
+	}
+	buf := &BufferPoolMgr{pages: newPageTable(), files: newFileMgr()}
+	buf.files.setFS(fsys, 0)
+
+	_, err := buf.GetBlock(f, tblId, 1)
+	var corrupt *ErrCorruptPage
+	if !errors.As(err, &corrupt) {
+		t.Fatalf("GetBlock error: expected a corrupt page but got %v", err)
+	}
+	if corrupt.Table != tblId || corrupt.Block != 1 || corrupt.Offset != BLKSIZE {
+		t.Errorf("GetBlock error: expected table %d block %d at %d but got %+v", tblId, 1, BLKSIZE, corrupt)
+	}
+	if _, err := buf.GetBlock(f, tblId, 0); !errors.Is(err, ErrBlockNotFound) {
+		t.Errorf("GetBlock error: expected a page of zeros to be unwritten but got %v", err)
+	}
+}
+
+func TestLegacyPage(t *testing.T) {
+	t.Parallel()
+	cols := []column.Column{{Name: "id", Type: column.INT}, {Name: "a", Type: column.STRING}, {Name: "b", Type: column.STRING}}
+	colData := row.NewColumnData_(cols)
+	encode := func(vals ...string) []byte {
+		fieldVals := make([][]byte, len(vals))
+		for i, val := range vals {
+			fieldVals[i] = []byte(val)
+		}
+		record, err := row.NewVarLengthRecord(cols, fieldVals)
+		if err != nil {
+			t.Fatalf("NewVarLengthRecord error: %v", err)
+		}
+		return record.ToByte()
+	}
+	old, err := row.LegacyLayout(encode("1", "first", "second"))
+	if err != nil {
+		t.Fatalf("LegacyLayout error: %v", err)
+	}
+
+	// A bare block, written before the page header, and the page it is written back as
+	bare, _ := NewBlock(nil, 1, 7)
+	if err := bare.insertRecordAt(0, old); err != nil {
+		t.Fatalf("insertRecordAt error: %v", err)
+	}
+	written, err := decodePage(bare.ToByte(), 1, 7, BLKSIZE)
+	if err != nil {
+		t.Fatalf("decodePage error: %v", err)
+	}
+	for _, page := range [][]byte{bare.ToByte(), encodePage(written)} {
+		blk, err := decodePage(page, 1, 7, BLKSIZE)
+		if err != nil {
+			t.Fatalf("decodePage error: %v", err)
+		}
+		// New records are stored in the layout of the page
+		if err := blk.insertRecordAt(1, encode("2", "third", "fourth")); err != nil {
+			t.Fatalf("insertRecordAt error: %v", err)
+		}
+		if blk, err = decodePage(encodePage(blk), 1, 7, BLKSIZE); err != nil {
+			t.Fatalf("decodePage error: %v", err)
+		}
+		if hdr, _ := decodePageHeader(encodePage(blk)); hdr.flags != PAGE_FLAG_LEGACY {
+			t.Errorf("encodePage error: expected a legacy block to be flagged but got flags %#x", hdr.flags)
+		}
+		for slot, want := range []string{"1|first|second", "2|third|fourth"} {
+			values, err := blk.recordValues(slot, colData)
+			if err != nil {
+				t.Fatalf("recordValues error: %v", err)
+			}
+			if got := fmt.Sprintf("%s|%s|%s", values[0], values[1], values[2]); got != want {
+				t.Errorf("recordValues error: expected %s but got %s", want, got)
+			}
+		}
+	}
+
+	current, _ := NewBlock(nil, 1, 7)
+	if hdr, _ := decodePageHeader(encodePage(current)); hdr.version != PAGE_VERSION || hdr.flags != 0 {
+		t.Errorf("encodePage error: expected version %d without flags but got %d, %#x", PAGE_VERSION, hdr.version, hdr.flags)
+	}
+}
+
+func TestTornPageRepair(t *testing.T) {
+	fsys := st.NewMemFS()
+	cols := map[string]column.SUPPORTED_TYPE{"id": column.INT, "name": column.STRING}
+	pkey := column.Column{Name: "id", Type: column.INT}
+
+	cfg := newTestConfig(t, fsys)
+	db := NewDB("tornDB", cfg)
+	tbl, err := db.CreateTable("table1", cols, pkey)
+	if err != nil {
+		t.Fatalf("CreateTable error: %v", err)
+	}
+	ctx := GetClientContextMgr(cfg).NewClientCtx(cfg, db)
+	if err := db.AddRecord(ctx, tbl, map[string][]byte{"id": []byte("1"), "name": []byte("before")}); err != nil {
+		t.Fatalf("AddRecord error: %v", err)
+	}
+	if err := ctx.Commit(); err != nil {
+		t.Fatalf("Commit error: %v", err)
+	}
+	ckptLSN, err := Checkpoint(cfg)
+	if err != nil {
+		t.Fatalf("Checkpoint error: %v", err)
+	}
+
+	if err := db.AddRecord(ctx, tbl, map[string][]byte{"id": []byte("2"), "name": []byte("after")}); err != nil {
+		t.Fatalf("AddRecord error: %v", err)
+	}
+	if err := ctx.Commit(); err != nil {
+		t.Fatalf("Commit error: %v", err)
+	}
+	ctx.Close()
+	images := 0
+	for _, entry := range scanAll(t, GetWalMgr(cfg), ckptLSN) {
+		if entry.image != nil {
+			images++
+		}
+	}
+	if images != 1 {
+		t.Errorf("logChange error: expected one full page image after the checkpoint but got %d", images)
+	}
+
+	// The write of the block is torn by the crash
+	if err := GetBufMgr(cfg).FlushAll(); err != nil {
+		t.Fatalf("FlushAll error: %v", err)
+	}
+	file, err := fsys.Open(tbl.info.Location)
+	if err != nil {
+		t.Fatalf("Open error: %v", err)
+	}
+	if _, err := file.WriteAt(make([]byte, 64), st.FILE_HDR_SIZE+PAGE_HDR_SIZE+8); err != nil {
+		t.Fatalf("WriteAt error: %v", err)
+	}
+	file.Close()
+	crash(cfg)
+
+	cfg = newTestConfig(t, fsys)
+	db = NewDB("tornDB", cfg)
+	tbl, err = db.CreateTable("table1", cols, pkey)
+	if err != nil {
+		t.Fatalf("CreateTable error: %v", err)
+	}
+	ctx = GetClientContextMgr(cfg).NewClientCtx(cfg, db)
+	defer ctx.Close()
+	for _, name := range []string{"before", "after"} {
+		recs, err := db.GetRecord(ctx, tbl, "name", []byte(name))
+		if err != nil {
+			t.Fatalf("GetRecord error: %v", err)
+		}
+		if len(recs) != 1 {
+			t.Errorf("Recover error: expected record %q to be repaired but found %d", name, len(recs))
+		}
+	}
+}
+
+func TestDirectIO(t *testing.T) {
+	dataPath := t.TempDir()
+	probe := path.Join(dataPath, "probe")
+	if err := st.WriteFileAtomic(st.OSFS{}, probe, nil); err != nil {
+		t.Fatalf("WriteFileAtomic error: %v", err)
+	}
+	if mgr, err := st.OpenDiskMgr(st.OSFS{}, probe, st.O_DIRECT); err != nil {
+		t.Skipf("O_DIRECT is not supported here: %v", err)
+	} else {
+		mgr.Close()
+	}
+	cols := map[string]column.SUPPORTED_TYPE{"id": column.INT, "name": column.STRING}
+	pkey := column.Column{Name: "id", Type: column.INT}
+	newConfig := func() *config.Config {
+		cfg := config.NewConfig(dataPath, 1, 1)
+		cfg.SetDirectIO(true)
+		cfg.SetWalSync(config.WAL_SYNC_DSYNC)
+		t.Cleanup(func() { closeEngine(cfg) })
+		return cfg
+	}
+
+	cfg := newConfig()
+	db := NewDB("directDB", cfg)
+	tbl, err := db.CreateTable("table1", cols, pkey)
+	if err != nil {
+		t.Fatalf("CreateTable error: %v", err)
+	}
+	ctx := GetClientContextMgr(cfg).NewClientCtx(cfg, db)
+	for i := 0; i < 100; i++ {
+		if err := db.AddRecord(ctx, tbl, map[string][]byte{"id": []byte(fmt.Sprint(i)), "name": []byte(fmt.Sprintf("name%d", i))}); err != nil {
+			t.Fatalf("AddRecord error: %v", err)
+		}
+	}
+	if err := ctx.Commit(); err != nil {
+		t.Fatalf("Commit error: %v", err)
+	}
+	ctx.Close()
+	if err := GetBufMgr(cfg).FlushAll(); err != nil {
+		t.Fatalf("FlushAll error: %v", err)
+	}
+
+	closeEngine(cfg)
+	cfg = newConfig()
+	db = NewDB("directDB", cfg)
+	tbl, err = db.CreateTable("table1", cols, pkey)
+	if err != nil {
+		t.Fatalf("CreateTable error: %v", err)
+	}
+	ctx = GetClientContextMgr(cfg).NewClientCtx(cfg, db)
+	defer ctx.Close()
+	for _, i := range []int{0, 57, 99} {
+		recs, err := db.GetRecord(ctx, tbl, "name", []byte(fmt.Sprintf("name%d", i)))
+		if err != nil || len(recs) != 1 {
+			t.Errorf("GetRecord error: expected record %d to be read back with O_DIRECT but got %d (%v)", i, len(recs), err)
+		}
+	}
+}
+
+func TestCompressedTable(t *testing.T) {
+	fsys := st.NewMemFS()
+	cols := map[string]column.SUPPORTED_TYPE{"key": column.INT, "val": column.STRING}
+	pkey := column.Column{Name: "key", Type: column.INT}
+	opts := TableOptions{Compression: COMPRESSION_LZ}
+	name := func(i, round int) []byte {
+		return []byte(fmt.Sprintf("customer %d of round %d lives at %s", i, round, strings.Repeat("Main Street ", 10)))
+	}
+
+	cfg := newTestConfig(t, fsys)
+	db := NewDB("lzDB", cfg)
+	tbl, err := db.CreateTableWithOptions("table1", cols, pkey, opts)
+	if err != nil {
+		t.Fatalf("CreateTableWithOptions error: %v", err)
+	}
+	ctx := GetClientContextMgr(cfg).NewClientCtx(cfg, db)
+	rids := make([]RecordID, 200)
+	for i := range rids {
+		if rids[i], err = crashInsert(ctx, tbl, fmt.Sprint(i), string(name(i, 0))); err != nil {
+			t.Fatalf("insert error: %v", err)
+		}
+	}
+	if err := ctx.Commit(); err != nil {
+		t.Fatalf("Commit error: %v", err)
+	}
+	if err := GetBufMgr(cfg).FlushAll(); err != nil {
+		t.Fatalf("FlushAll error: %v", err)
+	}
+	stats, err := tbl.Stats()
+	if err != nil {
+		t.Fatalf("Stats error: %v", err)
+	}
+	if stats.Blocks == 0 || stats.CompressionRatio < 2 {
+		t.Errorf("Stats error: expected repetitive rows to compress at least twofold but got %+v", stats)
+	}
+
+	// Rewritten pages reuse the extents given up once the map is saved
+	fInfo, _ := dataFileSize(fsys, tbl.info.Location)
+	for round := 1; round <= 5; round++ {
+		for i, rid := range rids {
+			if rids[i], err = tbl.UpdateRecord(ctx, rid, tbl.info.Column, [][]byte{[]byte(fmt.Sprint(i)), name(i, round)}); err != nil {
+				t.Fatalf("UpdateRecord error: %v", err)
+			}
+		}
+		if err := ctx.Commit(); err != nil {
+			t.Fatalf("Commit error: %v", err)
+		}
+		if err := GetBufMgr(cfg).FlushAll(); err != nil {
+			t.Fatalf("FlushAll error: %v", err)
+		}
+	}
+	if size, _ := dataFileSize(fsys, tbl.info.Location); size > 3*fInfo {
+		t.Errorf("writePage error: expected the data file to stay near %d bytes but it grew to %d", fInfo, size)
+	}
+	ctx.Close()
+
+	closeEngine(cfg)
+	cfg = newTestConfig(t, fsys)
+	db = NewDB("lzDB", cfg)
+	if _, err := db.CreateTableWithOptions("table1", cols, pkey, TableOptions{Compression: Compression(9)}); !errors.Is(err, st.ErrCompression) {
+		t.Errorf("CreateTableWithOptions error: expected an unknown codec to be rejected but got %v", err)
+	}
+	tbl, err = db.CreateTable("table1", cols, pkey)
+	if err != nil {
+		t.Fatalf("CreateTable error: %v", err)
+	}
+	if tbl.info.Compression != COMPRESSION_LZ {
+		t.Errorf("CreateTable error: expected the stored compression but got %v", tbl.info.Compression)
+	}
+	ctx = GetClientContextMgr(cfg).NewClientCtx(cfg, db)
+	defer ctx.Close()
+	rows := crashRows(t, ctx, tbl)
+	if len(rows) != len(rids) || rows["117"] != string(name(117, 5)) {
+		t.Errorf("Recover error: expected %d rows of the last round but got %d, row 117 %q", len(rids), len(rows), rows["117"])
+	}
+}
+
+func dataFileSize(fsys st.FS, name string) (int64, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	fInfo, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return fInfo.Size(), nil
+}
@@ -0,0 +1,375 @@
+package db
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	dsk "github.com/misachi/DarDB/storage"
+)
+
+/*
+A compressed table stores the page of every block, compressed, in an extent of whole sectors
+anywhere after the file header:
+
+	codec(1) | page compressed with the codec
+
+The codec is COMPRESSION_NONE for pages that did not shrink. Extents of encrypted tables hold this
+sealed as a page by the DiskMgr. The page map, saved next to the data file, records where the
+extent of each block is:
+
+	magic(4) | number of blocks(4) | crc32c of the entries(4) | first sector(4) and length(4) of each block
+
+with a length of zero for a block never written. Pages are written copy on write to a free extent,
+so the saved map only ever points at complete pages and torn writes cannot hit a page in use. An
+extent given up by a page is reused only once a map that no longer points at it has been saved.
+*/
+const (
+	PMAP_MAGIC      uint32 = 0x504d4150 // "PMAP"
+	PMAP_HDR_SIZE          = 12
+	PMAP_ENTRY_SIZE        = 8
+	PMAP_FILE_EXT          = ".pmap"
+	SECTOR_SIZE            = dsk.DIRECT_IO_ALIGN
+)
+
+var ErrPageMapCorrupt = errors.New("page map is corrupt")
+
+/* extent is where a block's page is stored */
+type extent struct {
+	sector uint32
+	length uint32 // Bytes stored, 0 when the block was never written
+}
+
+func (e extent) sectors() uint32 {
+	return (e.length + SECTOR_SIZE - 1) / SECTOR_SIZE
+}
+
+/* sectorRun is a run of free sectors */
+type sectorRun struct {
+	sector uint32
+	count  uint32
+}
+
+type pageMap struct {
+	saveMtx sync.Mutex // Serializes saves so an older map never replaces a newer one
+	mtx     sync.Mutex
+	fs      dsk.FS
+	path    string   // Path of the map file
+	entries []extent // Extent of each block
+	end     uint32   // First sector past every extent handed out
+	free    []sectorRun
+	pending []sectorRun // Given up since the map was last saved
+	dirty   bool
+}
+
+/* pmapPath is the page map file of the table stored in dataPath */
+func pmapPath(dataPath string) string {
+	return strings.TrimSuffix(dataPath, path.Ext(dataPath)) + PMAP_FILE_EXT
+}
+
+/* loadPageMap reads the map saved at mapPath, or starts an empty one. The sectors no block uses are free */
+func loadPageMap(fsys dsk.FS, mapPath string) (*pageMap, error) {
+	m := &pageMap{fs: fsys, path: mapPath}
+	data, err := dsk.ReadFile(fsys, mapPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("loadPageMap: %v", err)
+	}
+	if len(data) < PMAP_HDR_SIZE || binary.LittleEndian.Uint32(data[0:4]) != PMAP_MAGIC {
+		return nil, fmt.Errorf("loadPageMap: %s: %w", mapPath, ErrPageMapCorrupt)
+	}
+	n := int(binary.LittleEndian.Uint32(data[4:8]))
+	if len(data) != PMAP_HDR_SIZE+n*PMAP_ENTRY_SIZE || crc32.Checksum(data[PMAP_HDR_SIZE:], crc32c) != binary.LittleEndian.Uint32(data[8:12]) {
+		return nil, fmt.Errorf("loadPageMap: %s: %w", mapPath, ErrPageMapCorrupt)
+	}
+	m.entries = make([]extent, n)
+	used := make([]extent, 0, n)
+	for i := range m.entries {
+		entry := data[PMAP_HDR_SIZE+i*PMAP_ENTRY_SIZE:]
+		m.entries[i] = extent{sector: binary.LittleEndian.Uint32(entry[0:4]), length: binary.LittleEndian.Uint32(entry[4:8])}
+		if m.entries[i].length > 0 {
+			used = append(used, m.entries[i])
+		}
+	}
+
+	sort.Slice(used, func(i, j int) bool { return used[i].sector < used[j].sector })
+	for _, e := range used {
+		if e.sector < m.end {
+			return nil, fmt.Errorf("loadPageMap: %s: extents overlap: %w", mapPath, ErrPageMapCorrupt)
+		}
+		if e.sector > m.end {
+			m.free = append(m.free, sectorRun{sector: m.end, count: e.sector - m.end})
+		}
+		m.end = e.sector + e.sectors()
+	}
+	return m, nil
+}
+
+func (m *pageMap) lookup(blockId dsk.Blk_t) (extent, bool) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if int(blockId) >= len(m.entries) || m.entries[blockId].length == 0 {
+		return extent{}, false
+	}
+	return m.entries[blockId], true
+}
+
+/* allocate hands out count free sectors, from the first free run large enough or else past the end */
+func (m *pageMap) allocate(count uint32) uint32 {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	for i, run := range m.free {
+		if run.count < count {
+			continue
+		}
+		if run.count == count {
+			m.free = append(m.free[:i], m.free[i+1:]...)
+		} else {
+			m.free[i] = sectorRun{sector: run.sector + count, count: run.count - count}
+		}
+		return run.sector
+	}
+	sector := m.end
+	m.end += count
+	return sector
+}
+
+/* unallocate returns sectors that were allocated but never made part of the map */
+func (m *pageMap) unallocate(sector, count uint32) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.free = append(m.free, sectorRun{sector: sector, count: count})
+}
+
+/* assign makes e the extent of the block. Its previous extent is freed once the map is saved */
+func (m *pageMap) assign(blockId dsk.Blk_t, e extent) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	for int(blockId) >= len(m.entries) {
+		m.entries = append(m.entries, extent{})
+	}
+	if old := m.entries[blockId]; old.length > 0 {
+		m.pending = append(m.pending, sectorRun{sector: old.sector, count: old.sectors()})
+	}
+	m.entries[blockId] = e
+	m.dirty = true
+}
+
+/* truncate drops the blocks from n on. Their extents are freed once the map is saved */
+func (m *pageMap) truncate(n int64) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if int64(len(m.entries)) <= n {
+		return
+	}
+	for _, e := range m.entries[n:] {
+		if e.length > 0 {
+			m.pending = append(m.pending, sectorRun{sector: e.sector, count: e.sectors()})
+		}
+	}
+	m.entries = m.entries[:n]
+	m.dirty = true
+}
+
+func (m *pageMap) numBlocks() int64 {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	return int64(len(m.entries))
+}
+
+/* usage is the number of blocks written and the bytes their extents take */
+func (m *pageMap) usage() (int64, int64) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	var blocks, sectors int64
+	for _, e := range m.entries {
+		if e.length > 0 {
+			blocks++
+			sectors += int64(e.sectors())
+		}
+	}
+	return blocks, sectors * SECTOR_SIZE
+}
+
+/*
+save writes the map if it changed. sync must make the data file durable; it runs after the map is
+copied, so every extent in the copy has been written when it is synced.
+*/
+func (m *pageMap) save(sync func() error) error {
+	m.saveMtx.Lock()
+	defer m.saveMtx.Unlock()
+	m.mtx.Lock()
+	if !m.dirty {
+		m.mtx.Unlock()
+		return sync()
+	}
+	n := len(m.entries)
+	data := make([]byte, PMAP_HDR_SIZE+n*PMAP_ENTRY_SIZE)
+	for i, e := range m.entries {
+		entry := data[PMAP_HDR_SIZE+i*PMAP_ENTRY_SIZE:]
+		binary.LittleEndian.PutUint32(entry[0:4], e.sector)
+		binary.LittleEndian.PutUint32(entry[4:8], e.length)
+	}
+	released := m.pending
+	m.pending = nil
+	m.dirty = false
+	m.mtx.Unlock()
+
+	binary.LittleEndian.PutUint32(data[0:4], PMAP_MAGIC)
+	binary.LittleEndian.PutUint32(data[4:8], uint32(n))
+	binary.LittleEndian.PutUint32(data[8:12], crc32.Checksum(data[PMAP_HDR_SIZE:], crc32c))
+
+	err := sync()
+	if err == nil {
+		err = dsk.WriteFileAtomic(m.fs, m.path, data)
+	}
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if err != nil {
+		m.pending = append(released, m.pending...)
+		m.dirty = true
+		return fmt.Errorf("pageMap save: %v", err)
+	}
+	m.free = append(m.free, released...)
+	return nil
+}
+
+/* compressedPages stores the pages of a compressed table where its page map says */
+type compressedPages struct {
+	mgr   *dsk.DiskMgr
+	pmap  *pageMap
+	codec Compression
+}
+
+func (p *compressedPages) sectorOffset(sector uint32) int64 {
+	return p.mgr.BlockOffset(0) + int64(sector)*SECTOR_SIZE
+}
+
+func (p *compressedPages) readPage(blockId dsk.Blk_t) ([]byte, error) {
+	e, ok := p.pmap.lookup(blockId)
+	if !ok {
+		return nil, ErrBlockNotFound
+	}
+	buf := alignedBuffer(int64(e.sectors() * SECTOR_SIZE))
+	n, err := p.mgr.ReadAt(buf, p.sectorOffset(e.sector))
+	if n < int(e.length) {
+		if err == nil || err == io.EOF {
+			return nil, errTornPage
+		}
+		return nil, fmt.Errorf("readPage: Read error %v", err)
+	}
+	data := buf[:e.length]
+	if p.mgr.Encrypted() {
+		if data, _, err = p.mgr.OpenPage(data, blockId); err != nil {
+			return nil, fmt.Errorf("readPage: %w", err)
+		}
+		if len(data) == 0 {
+			return nil, fmt.Errorf("readPage: empty extent: %w", ErrBadCompression)
+		}
+	}
+	page, err := Compression(data[0]).decompress(data[1:])
+	if err != nil {
+		return nil, fmt.Errorf("readPage: %w", err)
+	}
+	return page, nil
+}
+
+func (p *compressedPages) writePage(blockId dsk.Blk_t, page []byte) error {
+	codec, data := p.codec, p.codec.compress(page)
+	if len(data) >= len(page) {
+		codec, data = COMPRESSION_NONE, page
+	}
+	e := extent{length: uint32(1 + len(data))}
+	buf := alignedBuffer(int64(e.sectors() * SECTOR_SIZE))
+	buf[0] = byte(codec)
+	copy(buf[1:], data)
+	if p.mgr.Encrypted() {
+		sealed, err := p.mgr.SealPage(buf[:e.length], blockId, pageLSN(page))
+		if err != nil {
+			return fmt.Errorf("writePage: %w", err)
+		}
+		e.length = uint32(len(sealed))
+		// SealPage leaves room for whole sectors
+		buf = sealed[:e.sectors()*SECTOR_SIZE]
+	}
+
+	e.sector = p.pmap.allocate(e.sectors())
+	if _, err := p.mgr.WriteAt(buf, p.sectorOffset(e.sector)); err != nil {
+		p.pmap.unallocate(e.sector, e.sectors())
+		return fmt.Errorf("writePage: %w", err)
+	}
+	p.pmap.assign(blockId, e)
+	return nil
+}
+
+func (p *compressedPages) numBlocks() int64 {
+	return p.pmap.numBlocks()
+}
+
+func (p *compressedPages) blockSize() int {
+	return p.mgr.PageSize()
+}
+
+func (p *compressedPages) offset(blockId dsk.Blk_t) int64 {
+	e, ok := p.pmap.lookup(blockId)
+	if !ok {
+		return -1
+	}
+	return p.sectorOffset(e.sector)
+}
+
+func (p *compressedPages) usage() (int64, int64) {
+	return p.pmap.usage()
+}
+
+/* sync makes the written pages durable and then saves the map pointing at them */
+func (p *compressedPages) sync() error {
+	return p.pmap.save(p.mgr.Flush)
+}
+
+/* truncate gives the extents of the dropped blocks back to the map for later pages; the file keeps its size */
+func (p *compressedPages) truncate(n int64) error {
+	p.pmap.truncate(n)
+	return nil
+}
+
+/* copyTo keeps the extents where they are; a page sealed with another key takes as many bytes */
+func (p *compressedPages) copyTo(dst *dsk.DiskMgr) error {
+	for blockId := dsk.Blk_t(0); int64(blockId) < p.pmap.numBlocks(); blockId++ {
+		e, ok := p.pmap.lookup(blockId)
+		if !ok {
+			continue
+		}
+		buf := alignedBuffer(int64(e.sectors() * SECTOR_SIZE))
+		if n, err := p.mgr.ReadAt(buf, p.sectorOffset(e.sector)); n < int(e.length) {
+			if err == nil || err == io.EOF {
+				err = errTornPage
+			}
+			return fmt.Errorf("copyTo: block %d: %w", blockId, err)
+		}
+		data, lsn, err := p.mgr.OpenPage(buf[:e.length], blockId)
+		if err != nil {
+			return fmt.Errorf("copyTo: %w", err)
+		}
+		sealed, err := dst.SealPage(data, blockId, lsn)
+		if err != nil {
+			return fmt.Errorf("copyTo: %v", err)
+		}
+		if len(sealed) != int(e.length) {
+			return fmt.Errorf("copyTo: block %d sealed to %d bytes, not %d", blockId, len(sealed), e.length)
+		}
+		if _, err := dst.WriteAt(sealed[:e.sectors()*SECTOR_SIZE], dst.BlockOffset(0)+int64(e.sector)*SECTOR_SIZE); err != nil {
+			return fmt.Errorf("copyTo: %v", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package db
+
+import (
+	"bytes"
+	"testing"
+
+	st "github.com/misachi/DarDB/storage"
+)
+
+func openTestPages(t *testing.T, fsys st.FS, name string) pageStore {
+	mgr, err := st.CreateDiskMgr(fsys, name, st.FileHeader{BlockSize: BLKSIZE, Compression: uint8(COMPRESSION_LZ)})
+	if err != nil {
+		t.Fatalf("CreateDiskMgr error: %v", err)
+	}
+	t.Cleanup(func() { mgr.Close() })
+	store, err := openPageStore(fsys, name, mgr)
+	if err != nil {
+		t.Fatalf("openPageStore error: %v", err)
+	}
+	return store
+}
+
+func TestPageMapCrash(t *testing.T) {
+	t.Parallel()
+	fsys := st.NewFaultFS(st.NewMemFS(), 1)
+	store := openTestPages(t, fsys, "/1.data")
+	first := bytes.Repeat([]byte("first version "), 100)
+	if err := store.writePage(0, first); err != nil {
+		t.Fatalf("writePage error: %v", err)
+	}
+	if err := store.sync(); err != nil {
+		t.Fatalf("sync error: %v", err)
+	}
+
+	// Block 1 must not take the extent block 0 gave up while the saved map still points at it
+	if err := store.writePage(0, bytes.Repeat([]byte("second version"), 100)); err != nil {
+		t.Fatalf("writePage error: %v", err)
+	}
+	if err := store.writePage(1, bytes.Repeat([]byte("other block   "), 100)); err != nil {
+		t.Fatalf("writePage error: %v", err)
+	}
+	fsys.InjectWrite(1, st.FAULT_EIO) // The data file is synced but the map is not saved
+	if err := store.sync(); err == nil {
+		t.Fatalf("sync error: expected the map save to fail")
+	}
+	if err := fsys.Crash(false); err != nil {
+		t.Fatalf("Crash error: %v", err)
+	}
+
+	store = openTestPages(t, fsys, "/1.data")
+	if store.numBlocks() != 1 {
+		t.Errorf("loadPageMap error: expected the saved map of %d block but got %d", 1, store.numBlocks())
+	}
+	page, err := store.readPage(0)
+	if err != nil {
+		t.Fatalf("readPage error: %v", err)
+	}
+	if !bytes.Equal(page, first) {
+		t.Errorf("readPage error: expected the first version of block 0 but got %q", page[:14])
+	}
+	if _, err := store.readPage(1); err != ErrBlockNotFound {
+		t.Errorf("readPage error: expected block 1 to be unwritten but got %v", err)
+	}
+}
@@ -0,0 +1,354 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+
+	st "github.com/misachi/DarDB/storage"
+)
+
+var errStopScan = errors.New("stop scan")
+
+type recoveryTxn struct {
+	ended   bool // Committed or aborted
+	entries []*Entry
+}
+
+/* applyEntry redoes the change logged by entry on blk. A compensating delete undoes an insert */
+func applyEntry(blk *Block, entry *Entry) error {
+	switch entry.state {
+	case WAL_INSERT:
+		return blk.insertRecordAt(int(entry.slot), entry.newVal)
+	case WAL_UPDATE:
+		return blk.replaceRecord(int(entry.slot), entry.newVal)
+	case WAL_DELETE:
+		if entry.isCompensation() {
+			return blk.undoInsert(int(entry.slot))
+		}
+		return blk.replaceRecord(int(entry.slot), nil)
+	}
+	return fmt.Errorf("applyEntry: entry %d is not a block change", entry.lsn)
+}
+
+/* reapplyEntry puts back the change of entry after its undo could not be logged */
+func reapplyEntry(blk *Block, entry *Entry) error {
+	if entry.state == WAL_INSERT && int(entry.slot) < len(blk.recLocation) {
+		return blk.replaceRecord(int(entry.slot), entry.newVal)
+	}
+	return applyEntry(blk, entry)
+}
+
+/* redoEntry applies entry to its block unless the block already has it. An entry with a full page image replaces the block */
+func redoEntry(buf *BufferPoolMgr, entry *Entry) error {
+	path, ok := buf.files.path(entry.tag.tblID)
+	if !ok {
+		slog.Warn("redoEntry: skipping entry for unknown table", "lsn", entry.lsn, "table", entry.tag.tblID)
+		return nil
+	}
+	if entry.image != nil {
+		image, err := decodePage(entry.image, entry.tag.blockID, entry.tag.tblID, buf.files.blockSize(path))
+		if err != nil {
+			return fmt.Errorf("redoEntry: LSN %d: %v", entry.lsn, err)
+		}
+		guard, err := buf.restoreBlock(path, image)
+		if err != nil {
+			return fmt.Errorf("redoEntry: %v", err)
+		}
+		defer guard.Close()
+		blk := guard.Block()
+		blk.mut.Lock()
+		blk.markModified(entry.lsn)
+		blk.mut.Unlock()
+		guard.MarkDirty()
+		return nil
+	}
+	guard, err := buf.fetchOrCreate(path, entry.tag.tblID, entry.tag.blockID)
+	if err != nil {
+		return fmt.Errorf("redoEntry: %w", err)
+	}
+	defer guard.Close()
+
+	blk := guard.Block()
+	blk.mut.Lock()
+	defer blk.mut.Unlock()
+	if blk.lsn >= entry.lsn {
+		return nil
+	}
+	if err := applyEntry(blk, entry); err != nil {
+		return fmt.Errorf("redoEntry: LSN %d: %v", entry.lsn, err)
+	}
+	blk.markModified(entry.lsn)
+	guard.MarkDirty()
+	return nil
+}
+
+/* truncation records that the blocks of a table from keep on were dropped at lsn */
+type truncation struct {
+	lsn  wal_t
+	keep st.Blk_t
+}
+
+/* loggedTruncations returns the truncations logged from lsn on, by table */
+func loggedTruncations(wal *WalMgr, from wal_t) (map[st.Tbl_t][]truncation, error) {
+	truncs := make(map[st.Tbl_t][]truncation)
+	err := wal.Scan(from, func(entry *Entry) error {
+		if entry.state == WAL_TRUNCATE {
+			truncs[entry.tag.tblID] = append(truncs[entry.tag.tblID], truncation{lsn: entry.lsn, keep: entry.tag.blockID})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("loggedTruncations: %v", err)
+	}
+	return truncs, nil
+}
+
+/*
+truncatedLater reports whether the block of entry is dropped by a truncation logged after it. The
+change is not redone: the block was empty when it was dropped, and it may be missing from the data
+file already, so a change without a full page image would not apply.
+*/
+func truncatedLater(truncs map[st.Tbl_t][]truncation, entry *Entry) bool {
+	for _, trunc := range truncs[entry.tag.tblID] {
+		if trunc.lsn > entry.lsn && entry.tag.blockID >= trunc.keep {
+			return true
+		}
+	}
+	return false
+}
+
+/* redoTruncate drops the blocks a vacuum cut from the end of a table */
+func redoTruncate(buf *BufferPoolMgr, entry *Entry) error {
+	path, ok := buf.files.path(entry.tag.tblID)
+	if !ok {
+		slog.Warn("redoTruncate: skipping entry for unknown table", "lsn", entry.lsn, "table", entry.tag.tblID)
+		return nil
+	}
+	buf.dropFrames(entry.tag.tblID, entry.tag.blockID)
+	if err := buf.cutTable(path, entry.tag.tblID, entry.tag.blockID); err != nil {
+		return fmt.Errorf("redoTruncate: LSN %d: %v", entry.lsn, err)
+	}
+	return nil
+}
+
+/* undoEntry reverts the change logged by entry and logs a compensation entry for it. Callers hold buf.ckptLock shared */
+func undoEntry(wal *WalMgr, buf *BufferPoolMgr, entry *Entry) error {
+	path, ok := buf.files.path(entry.tag.tblID)
+	if !ok {
+		return fmt.Errorf("undoEntry: no data file for table %d", entry.tag.tblID)
+	}
+	guard, err := buf.fetchOrCreate(path, entry.tag.tblID, entry.tag.blockID)
+	if err != nil {
+		return fmt.Errorf("undoEntry: %v", err)
+	}
+	defer guard.Close()
+
+	clr := NewEntry(entry.txnID)
+	clr.slot = entry.slot
+	clr.undoLSN = entry.lsn
+	switch entry.state {
+	case WAL_INSERT:
+		clr.state = WAL_DELETE
+		clr.InsertVal(entry.newVal, []byte{}, entry.tag)
+	case WAL_UPDATE, WAL_DELETE:
+		clr.state = WAL_UPDATE
+		clr.InsertVal(entry.newVal, entry.oldVal, entry.tag)
+	default:
+		return fmt.Errorf("undoEntry: entry %d is not a block change", entry.lsn)
+	}
+
+	blk := guard.Block()
+	blk.mut.Lock()
+	defer blk.mut.Unlock()
+	if err := applyEntry(blk, clr); err != nil {
+		return fmt.Errorf("undoEntry: LSN %d: %v", entry.lsn, err)
+	}
+	clr.image = buf.fullPageImage(blk)
+	lsn, err := wal.Append(clr)
+	if err != nil {
+		// The change stays in the block and in the undo log, so the rollback can be tried again
+		if err := reapplyEntry(blk, entry); err != nil {
+			slog.Error("undoEntry: restoring the change", "lsn", entry.lsn, "error", err)
+		}
+		return fmt.Errorf("undoEntry: %v", err)
+	}
+	blk.markModified(lsn)
+	guard.MarkDirty()
+	return nil
+}
+
+/* readCheckpoint returns the checkpoint logged at lsn */
+func readCheckpoint(wal *WalMgr, lsn wal_t) (checkpointData, error) {
+	var ckpt checkpointData
+	found := false
+	err := wal.Scan(lsn, func(entry *Entry) error {
+		if entry.lsn != lsn || entry.state != WAL_CHECKPOINT {
+			return fmt.Errorf("readCheckpoint: no checkpoint at LSN %d", lsn)
+		}
+		var err error
+		ckpt, err = decodeCheckpoint(entry.newVal)
+		found = err == nil
+		if err != nil {
+			return err
+		}
+		return errStopScan
+	})
+	if err != nil && err != errStopScan {
+		return ckpt, err
+	}
+	if !found {
+		return ckpt, fmt.Errorf("readCheckpoint: no checkpoint at LSN %d", lsn)
+	}
+	return ckpt, nil
+}
+
+/*
+recover brings the data files up to date with the WAL after a crash. Changes logged since the
+redo point of the last checkpoint are redone on blocks that do not have them, then the changes of
+transactions that neither committed nor aborted are undone. The data file of every table in
+tables must be known to the buffer pool. Recovery ends with a checkpoint and returns the highest
+transaction ID found in the log.
+*/
+func (e *engine) recover() (st.Txn_t, error) {
+	wal := e.wal
+	buf := e.buf
+
+	ckptLSN, err := readControl(wal.FS(), wal.Dir())
+	if err != nil {
+		return 0, fmt.Errorf("recover: %v", err)
+	}
+
+	var from, redoLSN wal_t
+	txns := make(map[st.Txn_t]*recoveryTxn)
+	if ckptLSN > 0 {
+		ckpt, err := readCheckpoint(wal, ckptLSN)
+		if err != nil {
+			return 0, fmt.Errorf("recover: %v", err)
+		}
+		redoLSN = ckpt.redoLSN
+		from = ckpt.oldestLSN()
+		for _, txn := range ckpt.active {
+			txns[txn.txnID] = &recoveryTxn{}
+		}
+	}
+
+	truncs, err := loggedTruncations(wal, from)
+	if err != nil {
+		return 0, fmt.Errorf("recover: %v", err)
+	}
+
+	var maxTxnID st.Txn_t
+	torn := make(map[pageKey]error) // Corrupt blocks waiting for a full page image
+	err = wal.Scan(from, func(entry *Entry) error {
+		if entry.txnID > maxTxnID {
+			maxTxnID = entry.txnID
+		}
+		switch entry.state {
+		case WAL_CHECKPOINT:
+			return nil
+		case WAL_TRUNCATE:
+			if entry.lsn < redoLSN {
+				return nil
+			}
+			return redoTruncate(buf, entry)
+		case WAL_VACUUM:
+			// Logged outside any transaction and never undone
+		default:
+			txn, ok := txns[entry.txnID]
+			if !ok {
+				txn = &recoveryTxn{}
+				txns[entry.txnID] = txn
+			}
+			switch entry.state {
+			case WAL_COMMITTED, WAL_ABORTED:
+				txn.ended = true
+				return nil
+			case WAL_INSERT, WAL_UPDATE, WAL_DELETE:
+				txn.entries = append(txn.entries, entry)
+			default:
+				return nil
+			}
+		}
+
+		if entry.lsn < redoLSN || truncatedLater(truncs, entry) {
+			return nil
+		}
+		key := newPageKey(entry.tag.tblID, entry.tag.blockID)
+		if _, ok := torn[key]; ok && entry.image == nil {
+			return nil
+		}
+		err := redoEntry(buf, entry)
+		var corrupt *ErrCorruptPage
+		if errors.As(err, &corrupt) {
+			torn[key] = err
+			return nil
+		}
+		if err == nil {
+			delete(torn, key)
+		}
+		return err
+	})
+	if err != nil {
+		return 0, fmt.Errorf("recover: redo: %v", err)
+	}
+	for _, err := range torn {
+		return 0, fmt.Errorf("recover: redo: no full page image to repair block: %w", err)
+	}
+
+	if err := undoLosers(wal, buf, txns); err != nil {
+		return 0, fmt.Errorf("recover: undo: %v", err)
+	}
+	if err := wal.Flush(wal.NextLSN() - 1); err != nil {
+		return 0, fmt.Errorf("recover: %v", err)
+	}
+	if err := buf.FlushAll(); err != nil {
+		return 0, fmt.Errorf("recover: %v", err)
+	}
+	if _, err := e.checkpoint(); err != nil {
+		return 0, fmt.Errorf("recover: %v", err)
+	}
+	return maxTxnID, nil
+}
+
+/* undoLosers rolls back, newest change first, every transaction that did not end before the crash */
+func undoLosers(wal *WalMgr, buf *BufferPoolMgr, txns map[st.Txn_t]*recoveryTxn) error {
+	buf.ckptLock.RLock()
+	defer buf.ckptLock.RUnlock()
+
+	losers := make([]st.Txn_t, 0)
+	undo := make([]*Entry, 0)
+	for txnID, txn := range txns {
+		if txn.ended {
+			continue
+		}
+		losers = append(losers, txnID)
+		compensated := make(map[wal_t]bool)
+		for _, entry := range txn.entries {
+			if entry.isCompensation() {
+				compensated[entry.undoLSN] = true
+			}
+		}
+		for _, entry := range txn.entries {
+			if !entry.isCompensation() && !compensated[entry.lsn] {
+				undo = append(undo, entry)
+			}
+		}
+	}
+	sort.Slice(undo, func(i, j int) bool { return undo[i].lsn > undo[j].lsn })
+
+	for _, entry := range undo {
+		if err := undoEntry(wal, buf, entry); err != nil {
+			return err
+		}
+	}
+	for _, txnID := range losers {
+		entry := NewEntry(txnID)
+		entry.state = WAL_ABORTED
+		if _, err := wal.Append(entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -62,7 +62,9 @@ type recordHeader struct {
 
 type VarLengthRecord struct {
 	recordHeader
-	field []byte
+	field  []byte
+	toast  ToastFetcher // Reads values stored out of line
+	legacy bool         // Offsets are in the legacy layout, see SetLegacy
 }
 
 func ByteArrayToInt(r io.Reader) (int64, error) {
@@ -101,19 +103,17 @@ func NewVarLengthRecord(cols []column.Column, data [][]byte) (*VarLengthRecord,
 			nullField = nullField | (1 << i)
 		}
 
-		var offset st.Location_T = 0
-
 		if key.Type == column.STRING {
 			if i > 0 && cols[i-1].Type != column.STRING {
 				field = append(field, '\n')
 			}
-			offset = location[len(location)-1].offset + location[len(location)-1].size + 1
 		} else {
 			if i > 0 {
 				field = append(field, ':')
-				offset = location[len(location)-1].offset + location[len(location)-1].size + 1
 			}
 		}
+		// STRING fields follow each other without a separator
+		offset := st.Location_T(len(field))
 		location = append(location, *NewLocationPair(offset, st.Location_T(_len)))
 		field = append(field, data[i]...)
 	}
@@ -241,13 +241,8 @@ func setLocation(lData []byte) (*[]LocationPair, error) {
 			return nil, fmt.Errorf("setLocation: Unable to set size: %v", err)
 		}
 
-		if size > 0 {
-			if len(location) <= 0 {
-				location = []LocationPair{*NewLocationPair(st.Location_T(offset), st.Location_T(size))}
-			} else {
-				location = append(location, *NewLocationPair(st.Location_T(offset), st.Location_T(size)))
-			}
-		}
+		// Null fields keep their empty location so the fields after them keep their index
+		location = append(location, *NewLocationPair(st.Location_T(offset), st.Location_T(size)))
 
 		idx += 1
 		if (locSepIdx + 1) > len(newBuf) {
@@ -258,6 +253,65 @@ func setLocation(lData []byte) (*[]LocationPair, error) {
 	return &location, nil
 }
 
+/*
+SetLegacy marks a record read from a page written before the current layout. That layout counted a
+separator before every field after the first, though none is written between consecutive STRING
+fields, so each STRING field that follows another is stored one byte before its recorded offset,
+plus one for every such pair before it. The column types are needed to find the fields.
+*/
+func (v *VarLengthRecord) SetLegacy(legacy bool) {
+	v.legacy = legacy
+}
+
+/* fieldLocation returns the location of field idx, correcting the offsets of legacy records */
+func (v VarLengthRecord) fieldLocation(colData ColumnData, idx int) *LocationPair {
+	if idx < 0 || idx >= len(v.location) {
+		return nil
+	}
+	location := v.location[idx]
+	if v.legacy {
+		for i := 1; i <= idx && i < len(colData.keys); i++ {
+			if colData.keys[i].Type == column.STRING && colData.keys[i-1].Type == column.STRING {
+				location.offset--
+			}
+		}
+	}
+	return &location
+}
+
+/* LegacyLayout re-encodes a record with the offsets of the legacy layout, which follow from the field sizes alone */
+func LegacyLayout(data []byte) ([]byte, error) {
+	if len(data) < 1 {
+		return data, nil
+	}
+	record, err := NewVarLengthRecordWithHDR(data)
+	if err != nil {
+		return nil, fmt.Errorf("LegacyLayout: %v", err)
+	}
+	for i := 1; i < len(record.location); i++ {
+		record.location[i].offset = record.location[i-1].offset + record.location[i-1].size + 1
+	}
+	return record.ToByte(), nil
+}
+
+/* CurrentLayout re-encodes a record in the legacy layout, written with the columns of colData, in the current layout */
+func CurrentLayout(data []byte, colData ColumnData) ([]byte, error) {
+	if len(data) < 1 {
+		return data, nil
+	}
+	record, err := NewVarLengthRecordWithHDR(data)
+	if err != nil {
+		return nil, fmt.Errorf("CurrentLayout: %v", err)
+	}
+	record.legacy = true
+	location := make([]LocationPair, len(record.location))
+	for i := range location {
+		location[i] = *record.fieldLocation(colData, i)
+	}
+	record.location = location
+	return record.ToByte(), nil
+}
+
 func (v VarLengthRecord) Field() []byte {
 	return v.field
 }
@@ -340,7 +394,7 @@ func (v VarLengthRecord) GetField(colData ColumnData, key string) []byte {
 	colLen := len(colData.keys)
 	if !v.fieldIsNull(st.NullField_T(colLen - (idx + 1))) {
 		if num := column.GetTypeSize(col.Type); num < 0 {
-			location := getFieldLocation(colData, v.location, key)
+			location := v.fieldLocation(colData, idx)
 
 			if location == nil {
 				panic("GetField: Location is missing")
@@ -348,7 +402,15 @@ func (v VarLengthRecord) GetField(colData ColumnData, key string) []byte {
 
 			newField := make([]byte, location.size)
 			copy(newField, v.field[location.offset:location.offset+location.size])
-			return newField
+			inline, pointer := DecodeValue(newField)
+			if pointer == nil {
+				return inline
+			}
+			value, err := v.fetchToast(pointer)
+			if err != nil {
+				panic(fmt.Sprintf("GetField: %v", err))
+			}
+			return value
 		}
 		byteLen := bytes.IndexByte(v.field, Term)
 		if byteLen == -1 {
@@ -373,6 +435,37 @@ func (v VarLengthRecord) GetField(colData ColumnData, key string) []byte {
 	return nil
 }
 
+/*
+Values returns the value of every column in colData, nil for nulls. Field i is null when bit i of
+the null field is clear, as NewVarLengthRecord writes it. Out of line values are read in full.
+*/
+func (v VarLengthRecord) Values(colData ColumnData) ([][]byte, error) {
+	values := make([][]byte, len(colData.keys))
+	for i, col := range colData.keys {
+		if IsNull(st.NullField_T(i), v.nullField) || i >= len(v.location) {
+			continue
+		}
+		loc := v.fieldLocation(colData, i)
+		if int(loc.offset)+int(loc.size) > len(v.field) {
+			return nil, fmt.Errorf("Values: field %s is out of range", col.Name)
+		}
+		value := make([]byte, loc.size)
+		copy(value, v.field[loc.offset:loc.offset+loc.size])
+		if column.GetTypeSize(col.Type) < 0 {
+			inline, pointer := DecodeValue(value)
+			if pointer != nil {
+				var err error
+				if inline, err = v.fetchToast(pointer); err != nil {
+					return nil, fmt.Errorf("Values: field %s: %v", col.Name, err)
+				}
+			}
+			value = inline
+		}
+		values[i] = value
+	}
+	return values, nil
+}
+
 func isNumber(value []byte) bool {
 	if len(value) > 1 && value[0] == '-' {
 		value = value[1:]
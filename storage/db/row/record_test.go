@@ -340,6 +340,7 @@ func TestNewVarLengthRecord(t *testing.T) {
 	type valType struct {
 		given      [][]byte
 		wantRecord VarLengthRecord
+		wantLegacy []LocationPair // Offsets pages before the current layout recorded
 	}
 
 	values := []valType{
@@ -369,10 +370,18 @@ func TestNewVarLengthRecord(t *testing.T) {
 						{st.Location_T(9), st.Location_T(7)},
 						{st.Location_T(17), st.Location_T(0)},
 						{st.Location_T(18), st.Location_T(11)},
-						{st.Location_T(30), st.Location_T(19)},
+						{st.Location_T(29), st.Location_T(19)},
 					}},
 				field: []byte("12:23846:-983738:\nHello WorldPower to the People"),
 			},
+			wantLegacy: []LocationPair{
+				{st.Location_T(0), st.Location_T(2)},
+				{st.Location_T(3), st.Location_T(5)},
+				{st.Location_T(9), st.Location_T(7)},
+				{st.Location_T(17), st.Location_T(0)},
+				{st.Location_T(18), st.Location_T(11)},
+				{st.Location_T(30), st.Location_T(19)},
+			},
 		},
 	}
 
@@ -396,6 +405,28 @@ func TestNewVarLengthRecord(t *testing.T) {
 		if !bytes.Equal(record.field, val.wantRecord.field) {
 			t.Errorf("Expected field: %s but got %s", val.wantRecord.field, record.field)
 		}
+		if val.wantLegacy == nil {
+			continue
+		}
+
+		// Both layouts convert to each other
+		legacyData, err := LegacyLayout(record.ToByte())
+		if err != nil {
+			t.Fatalf("LegacyLayout error: %v", err)
+		}
+		legacy, err := NewVarLengthRecordWithHDR(legacyData)
+		if err != nil {
+			t.Fatalf("NewVarLengthRecordWithHDR error: %v", err)
+		}
+		for i, loc := range val.wantLegacy {
+			if loc.offset != legacy.location[i].offset || loc.size != legacy.location[i].size {
+				t.Errorf("Expected legacy offset: %d and size %d\nbut got offset: %d and size %d", loc.offset, loc.size, legacy.location[i].offset, legacy.location[i].size)
+			}
+		}
+		current, err := CurrentLayout(legacyData, cols)
+		if err != nil || !bytes.Equal(current, record.ToByte()) {
+			t.Errorf("CurrentLayout: expected %q but got %q: %v", record.ToByte(), current, err)
+		}
 	}
 }
 
@@ -438,3 +469,50 @@ func TestRecordSize(t *testing.T) {
 		t.Errorf("Record size: expected \n%d \n\nbut got\n \n%d", wantSize, sz)
 	}
 }
+
+func TestValues(t *testing.T) {
+	values := []struct {
+		cols  []column.Column
+		given [][]byte
+	}{
+		{
+			cols:  []column.Column{{Name: "a", Type: column.INT}, {Name: "b", Type: column.INT}, {Name: "c", Type: column.STRING}, {Name: "d", Type: column.STRING}},
+			given: [][]byte{[]byte("12"), nil, []byte("it:was\n"), []byte("you")},
+		},
+		{
+			cols:  []column.Column{{Name: "a", Type: column.INT}, {Name: "b", Type: column.STRING}, {Name: "c", Type: column.STRING}},
+			given: [][]byte{nil, nil, []byte("last")},
+		},
+		{
+			cols:  []column.Column{{Name: "a", Type: column.STRING}, {Name: "b", Type: column.STRING}},
+			given: [][]byte{[]byte("first"), []byte("second")},
+		},
+	}
+	for _, val := range values {
+		record, err := NewVarLengthRecord(val.cols, val.given)
+		if err != nil {
+			t.Fatalf("NewVarLengthRecord error: %v", err)
+		}
+		legacyData, err := LegacyLayout(record.ToByte())
+		if err != nil {
+			t.Fatalf("LegacyLayout error: %v", err)
+		}
+		// Read back from the stored bytes, as blocks do
+		for _, data := range [][]byte{record.ToByte(), legacyData} {
+			stored, err := NewVarLengthRecordWithHDR(data)
+			if err != nil {
+				t.Fatalf("NewVarLengthRecordWithHDR error: %v", err)
+			}
+			stored.SetLegacy(bytes.Equal(data, legacyData))
+			got, err := stored.Values(NewColumnData_(val.cols))
+			if err != nil {
+				t.Fatalf("Values error: %v", err)
+			}
+			for i := range val.given {
+				if !bytes.Equal(got[i], val.given[i]) || (got[i] == nil) != (len(val.given[i]) == 0) {
+					t.Errorf("Values error: expected %q for column %s but got %q", val.given[i], val.cols[i].Name, got[i])
+				}
+			}
+		}
+	}
+}
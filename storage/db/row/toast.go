@@ -0,0 +1,115 @@
+package row
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/misachi/DarDB/column"
+	st "github.com/misachi/DarDB/storage"
+)
+
+/*
+STRING values too long to keep in the record are stored out of line and replaced by a pointer:
+
+	ToastMarker | 'T' | pointer
+
+Inline values starting with ToastMarker get a second ToastMarker in front so they are never read
+as a pointer. EncodeValue and DecodeValue add and strip it.
+*/
+const (
+	ToastMarker = 0x00
+	toastTag    = 'T'
+)
+
+var ErrNoToastFetcher = errors.New("record has no fetcher for out of line values")
+
+/* ToastFetcher reads out of line values */
+type ToastFetcher interface {
+	Open(pointer []byte) (io.Reader, error)
+}
+
+/* ToastPointer builds the record value that points at an out of line value */
+func ToastPointer(pointer []byte) []byte {
+	return append([]byte{ToastMarker, toastTag}, pointer...)
+}
+
+/* EncodeValue escapes an inline value that could be mistaken for a pointer */
+func EncodeValue(value []byte) []byte {
+	if len(value) > 0 && value[0] == ToastMarker {
+		return append([]byte{ToastMarker}, value...)
+	}
+	return value
+}
+
+/* DecodeValue strips the escape added by EncodeValue. The pointer is returned for out of line values */
+func DecodeValue(value []byte) (inline []byte, pointer []byte) {
+	if len(value) < 2 || value[0] != ToastMarker {
+		return value, nil
+	}
+	if value[1] == toastTag {
+		return nil, value[2:]
+	}
+	return value[1:], nil
+}
+
+func IsToastPointer(value []byte) bool {
+	_, pointer := DecodeValue(value)
+	return pointer != nil
+}
+
+/* SetToast sets the fetcher used to read the out of line values of the record */
+func (v *VarLengthRecord) SetToast(fetcher ToastFetcher) {
+	v.toast = fetcher
+}
+
+/*
+OpenField returns a reader over the value of a STRING field. Out of line values are read lazily, a
+page at a time, so very large values never have to be held in memory.
+*/
+func (v VarLengthRecord) OpenField(colData ColumnData, key string) (io.Reader, error) {
+	raw, err := v.rawField(colData, key)
+	if err != nil {
+		return nil, err
+	}
+	inline, pointer := DecodeValue(raw)
+	if pointer == nil {
+		return bytes.NewReader(inline), nil
+	}
+	if v.toast == nil {
+		return nil, ErrNoToastFetcher
+	}
+	return v.toast.Open(pointer)
+}
+
+/* rawField returns the stored bytes of a STRING field without resolving pointers */
+func (v VarLengthRecord) rawField(colData ColumnData, key string) ([]byte, error) {
+	col, err := colData.column(key)
+	if err != nil {
+		return nil, fmt.Errorf("rawField: %w", err)
+	}
+	if column.GetTypeSize(col.Type) >= 0 {
+		return nil, fmt.Errorf("rawField: column %s is not a STRING", key)
+	}
+	idx, _ := colData.index(key)
+	if v.fieldIsNull(st.NullField_T(len(colData.keys) - (idx + 1))) {
+		return nil, nil
+	}
+	location := v.fieldLocation(colData, idx)
+	if location == nil {
+		return nil, fmt.Errorf("rawField: location of %s is missing", key)
+	}
+	return v.field[location.offset : location.offset+location.size], nil
+}
+
+func (v VarLengthRecord) fetchToast(pointer []byte) ([]byte, error) {
+	if v.toast == nil {
+		return nil, ErrNoToastFetcher
+	}
+	r, err := v.toast.Open(pointer)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
@@ -0,0 +1,61 @@
+package row
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/misachi/DarDB/column"
+)
+
+type mapFetcher map[string][]byte
+
+func (m mapFetcher) Open(pointer []byte) (io.Reader, error) {
+	return bytes.NewReader(m[string(pointer)]), nil
+}
+
+func TestEncodeValue(t *testing.T) {
+	values := [][]byte{nil, []byte("abc"), {ToastMarker}, {ToastMarker, 'T', '1'}}
+	for _, val := range values {
+		inline, pointer := DecodeValue(EncodeValue(val))
+		if pointer != nil || !bytes.Equal(inline, val) {
+			t.Errorf("DecodeValue error: expected %q but got %q (pointer %q)", val, inline, pointer)
+		}
+	}
+	if _, pointer := DecodeValue(ToastPointer([]byte("7,100"))); string(pointer) != "7,100" {
+		t.Errorf("DecodeValue error: expected pointer %q but got %q", "7,100", pointer)
+	}
+}
+
+func TestGetFieldToast(t *testing.T) {
+	cols := []column.Column{{Name: "id", Type: column.INT}, {Name: "name", Type: column.STRING}}
+	colData := NewColumnData_(cols)
+	long := bytes.Repeat([]byte("x"), 10000)
+
+	record, err := NewVarLengthRecord(cols, [][]byte{[]byte("1"), ToastPointer([]byte("0,10000"))})
+	if err != nil {
+		t.Fatalf("NewVarLengthRecord error: %v", err)
+	}
+	if _, err := record.OpenField(colData, "name"); err != ErrNoToastFetcher {
+		t.Errorf("OpenField error: expected %v but got %v", ErrNoToastFetcher, err)
+	}
+
+	stored, err := NewVarLengthRecordWithHDR(record.ToByte())
+	if err != nil {
+		t.Fatalf("NewVarLengthRecordWithHDR error: %v", err)
+	}
+	stored.SetToast(mapFetcher{"0,10000": long})
+	if got := stored.GetField(colData, "name"); !bytes.Equal(got, long) {
+		t.Errorf("GetField error: expected the out of line value but got %d bytes", len(got))
+	}
+	r, err := stored.OpenField(colData, "name")
+	if err != nil {
+		t.Fatalf("OpenField error: %v", err)
+	}
+	if got, _ := io.ReadAll(r); !bytes.Equal(got, long) {
+		t.Errorf("OpenField error: expected the out of line value but got %d bytes", len(got))
+	}
+	if got := stored.GetField(colData, "id"); string(got) != "1" {
+		t.Errorf("GetField error: expected %q but got %q", "1", got)
+	}
+}
@@ -0,0 +1,76 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	st "github.com/misachi/DarDB/storage"
+)
+
+/*
+A transaction that writes a record holds its write lock until it commits or rolls back, so no other
+transaction changes the record in between: a rollback copies back the record as it was before the
+transaction wrote it, which would undo the later change. Writers do not wait for each other. The
+second writer of a record fails with ErrWriteConflict, and can retry once the first has ended.
+Inserts take the lock of the slot they add, so a record nobody committed yet is not changed either.
+*/
+var ErrWriteConflict = errors.New("could not serialize access due to concurrent update")
+
+/* rowKey identifies a record of a table */
+type rowKey struct {
+	tbl st.Tbl_t
+	rid RecordID
+}
+
+/* rowLocks maps each record written by a running transaction to that transaction */
+type rowLocks struct {
+	mtx    sync.Mutex
+	owners map[rowKey]*Transaction
+}
+
+func newRowLocks() *rowLocks {
+	return &rowLocks{owners: make(map[rowKey]*Transaction)}
+}
+
+/* lock takes the write lock of the record for txn. It fails if another transaction holds it */
+func (rl *rowLocks) lock(txn *Transaction, tblId st.Tbl_t, rid RecordID) error {
+	key := rowKey{tbl: tblId, rid: rid}
+	rl.mtx.Lock()
+	defer rl.mtx.Unlock()
+	if owner, ok := rl.owners[key]; ok {
+		if owner == txn {
+			return nil
+		}
+		return fmt.Errorf("record %d_%d: %w", rid.Block, rid.Slot, ErrWriteConflict)
+	}
+	rl.owners[key] = txn
+	txn.written = append(txn.written, key)
+	return nil
+}
+
+/*
+claim takes the write lock of a slot txn just added. A transaction whose insert of the slot was
+rolled back may still hold it until its rollback ends; the slot is no longer its record.
+*/
+func (rl *rowLocks) claim(txn *Transaction, tblId st.Tbl_t, rid RecordID) {
+	key := rowKey{tbl: tblId, rid: rid}
+	rl.mtx.Lock()
+	defer rl.mtx.Unlock()
+	if rl.owners[key] != txn {
+		rl.owners[key] = txn
+		txn.written = append(txn.written, key)
+	}
+}
+
+/* release drops the write locks of txn, which has committed or rolled back */
+func (rl *rowLocks) release(txn *Transaction) {
+	rl.mtx.Lock()
+	defer rl.mtx.Unlock()
+	for _, key := range txn.written {
+		if rl.owners[key] == txn {
+			delete(rl.owners, key)
+		}
+	}
+	txn.written = nil
+}
@@ -0,0 +1,143 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+
+	st "github.com/misachi/DarDB/storage"
+	row "github.com/misachi/DarDB/storage/db/row"
+)
+
+/*
+TableScan reads the live records of a table in block order, with their record IDs. Records are
+read a block at a time and decoded into the values of the table's columns, nil for nulls, so no
+block stays pinned between calls. Like Block.Records, every record read is share locked until
+the transaction of the context ends.
+*/
+type TableScan struct {
+	tbl     *Table
+	ctx     *ClientContext
+	colData row.ColumnData
+	match   func(values [][]byte) (bool, error)
+	next    st.Blk_t
+	blocks  int64
+	rids    []RecordID
+	values  [][][]byte
+}
+
+func (tbl *Table) Scan(ctx *ClientContext) *TableScan {
+	return &TableScan{tbl: tbl, ctx: ctx, colData: row.NewColumnData_(tbl.info.Column), blocks: -1}
+}
+
+/*
+Where makes the scan skip the records match rejects. Like Block.FilterRecords, records are matched
+as their block is read and only those returned are locked.
+*/
+func (s *TableScan) Where(match func(values [][]byte) (bool, error)) {
+	s.match = match
+}
+
+/* Next returns the next record. Values are nil once the table is exhausted */
+func (s *TableScan) Next() (RecordID, [][]byte, error) {
+	for len(s.rids) == 0 {
+		if s.blocks < 0 {
+			n, err := s.tbl.buf.TableBlocks(s.tbl.info.Location, s.tbl.tblID)
+			if err != nil {
+				return RecordID{}, nil, fmt.Errorf("TableScan: %v", err)
+			}
+			s.blocks = int64(n)
+		}
+		if int64(s.next) >= s.blocks {
+			return RecordID{}, nil, nil
+		}
+		if err := s.readBlock(s.next); err != nil {
+			return RecordID{}, nil, fmt.Errorf("TableScan: %v", err)
+		}
+		s.next++
+	}
+	rid, values := s.rids[0], s.values[0]
+	s.rids, s.values = s.rids[1:], s.values[1:]
+	return rid, values, nil
+}
+
+func (s *TableScan) readBlock(blockId st.Blk_t) error {
+	guard, err := s.tbl.buf.fetchBlock(s.ctx, s.tbl.info.Location, s.tbl.tblID, blockId)
+	if errors.Is(err, ErrBlockNotFound) {
+		// Allocated but never written
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer guard.Close()
+	blk := guard.Block()
+	blk.mut.RLock()
+	defer blk.mut.RUnlock()
+	txn := s.ctx.CurrentTxn()
+	txn.touch(blk.tblId, blk.blockId)
+	for slot, location := range blk.recLocation {
+		if location.Size() == 0 {
+			continue
+		}
+		values, err := blk.recordValues(slot, s.colData)
+		if err != nil {
+			return err
+		}
+		if s.match != nil {
+			ok, err := s.match(values)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				continue
+			}
+		}
+		location.lockField.AcquireLock(st.SHARED_LOCK)
+		txn.TxnReadRecord(blk.tblId, blk.blockId, slot, *location.LocationPair)
+		s.rids = append(s.rids, RecordID{Block: blockId, Slot: slot})
+		s.values = append(s.values, values)
+	}
+	return nil
+}
+
+/* Fetch returns the column values of the record at rid, share locking it like a scan */
+func (tbl *Table) Fetch(ctx *ClientContext, rid RecordID) ([][]byte, error) {
+	guard, err := tbl.buf.fetchBlock(ctx, tbl.info.Location, tbl.tblID, rid.Block)
+	if errors.Is(err, ErrBlockNotFound) {
+		return nil, fmt.Errorf("Fetch: record %d_%d: %w", rid.Block, rid.Slot, ErrRecordNotFound)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Fetch: %v", err)
+	}
+	defer guard.Close()
+	blk := guard.Block()
+	blk.mut.RLock()
+	defer blk.mut.RUnlock()
+	if rid.Slot < 0 || rid.Slot >= len(blk.recLocation) || blk.isDeleted(rid.Slot) {
+		return nil, fmt.Errorf("Fetch: record %d_%d: %w", rid.Block, rid.Slot, ErrRecordNotFound)
+	}
+	values, err := blk.recordValues(rid.Slot, row.NewColumnData_(tbl.info.Column))
+	if err != nil {
+		return nil, fmt.Errorf("Fetch: %v", err)
+	}
+	txn := ctx.CurrentTxn()
+	txn.touch(blk.tblId, blk.blockId)
+	location := blk.recLocation[rid.Slot]
+	location.lockField.AcquireLock(st.SHARED_LOCK)
+	txn.TxnReadRecord(blk.tblId, blk.blockId, rid.Slot, *location.LocationPair)
+	return values, nil
+}
+
+/* recordValues decodes the record in slot into the values of the columns of colData */
+func (b *Block) recordValues(slot int, colData row.ColumnData) ([][]byte, error) {
+	location := b.recLocation[slot]
+	record, err := b.getRecordSlice(int(location.Offset()), int(location.Size()))
+	if err != nil {
+		return nil, fmt.Errorf("record %d_%d: %v", b.blockId, slot, err)
+	}
+	values, err := record.(*row.VarLengthRecord).Values(colData)
+	if err != nil {
+		return nil, fmt.Errorf("record %d_%d: %v", b.blockId, slot, err)
+	}
+	return values, nil
+}
@@ -0,0 +1,250 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/misachi/DarDB/column"
+	st "github.com/misachi/DarDB/storage"
+)
+
+func TestTableScan(t *testing.T) {
+	cfg := newTestConfig(t, st.NewMemFS())
+	db := NewDB("scanDB", cfg)
+	cols := map[string]column.SUPPORTED_TYPE{"key": column.INT, "val": column.STRING}
+	tbl, err := db.CreateTable("table1", cols, column.Column{Name: "key", Type: column.INT})
+	if err != nil {
+		t.Fatalf("CreateTable error: %v", err)
+	}
+	ctx := GetClientContextMgr(cfg).NewClientCtx(cfg, db)
+	defer ctx.Close()
+	idle := GetClientContextMgr(cfg).NewClientCtx(cfg, db)
+	defer idle.Close()
+
+	rids := make(map[RecordID]string)
+	for i := 0; i < 200; i++ {
+		val := fmt.Sprintf("value %d", i)
+		if i == 7 {
+			val = strings.Repeat("long", 2000)
+		}
+		rid, err := crashInsert(ctx, tbl, fmt.Sprintf("%d", i), val)
+		if err != nil {
+			t.Fatalf("insert error: %v", err)
+		}
+		rids[rid] = val
+	}
+	deleted := RecordID{}
+	for rid := range rids {
+		deleted = rid
+		break
+	}
+	if err := tbl.DeleteRecord(ctx, deleted); err != nil {
+		t.Fatalf("DeleteRecord error: %v", err)
+	}
+	delete(rids, deleted)
+	if err := ctx.Commit(); err != nil {
+		t.Fatalf("Commit error: %v", err)
+	}
+
+	scan := tbl.Scan(ctx)
+	seen := 0
+	for {
+		rid, values, err := scan.Next()
+		if err != nil {
+			t.Fatalf("Scan error: %v", err)
+		}
+		if values == nil {
+			break
+		}
+		seen++
+		if len(values) != 2 || string(values[1]) != rids[rid] {
+			t.Errorf("Scan error: record %v expected %.20q but got %.20q", rid, rids[rid], values)
+		}
+		fetched, err := tbl.Fetch(ctx, rid)
+		if err != nil || string(fetched[0]) != string(values[0]) {
+			t.Errorf("Fetch error: record %v expected %q but got %q: %v", rid, values[0], fetched, err)
+		}
+	}
+	if seen != len(rids) {
+		t.Errorf("Scan error: expected %d records but got %d", len(rids), seen)
+	}
+	if _, err := tbl.Fetch(ctx, deleted); !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("Fetch error: expected ErrRecordNotFound for a deleted record but got %v", err)
+	}
+	// Blocks are counted for the client that asked for them
+	if got := ctx.BufferStats(); got.Hits+got.Reads < int64(len(rids)) {
+		t.Errorf("BufferStats error: expected the scan and fetches to count blocks but got %+v", got)
+	}
+	if got := idle.BufferStats(); got != (BufferStats{}) {
+		t.Errorf("BufferStats error: expected no blocks for an idle client but got %+v", got)
+	}
+
+	// Records a filtered scan skips are not locked
+	if err := ctx.Commit(); err != nil {
+		t.Fatalf("Commit error: %v", err)
+	}
+	scan = tbl.Scan(ctx)
+	scan.Where(func(values [][]byte) (bool, error) { return strings.HasSuffix(string(values[0]), "3"), nil })
+	matched := 0
+	for {
+		_, values, err := scan.Next()
+		if err != nil {
+			t.Fatalf("Scan error: %v", err)
+		}
+		if values == nil {
+			break
+		}
+		matched++
+		if !strings.HasSuffix(string(values[0]), "3") {
+			t.Errorf("Scan error: record %q does not match the filter", values[0])
+		}
+	}
+	if matched == 0 || len(ctx.CurrentTxn().dataList) != matched {
+		t.Errorf("Scan error: %d records matched but %d were locked", matched, len(ctx.CurrentTxn().dataList))
+	}
+	scan = tbl.Scan(ctx)
+	scan.Where(func(values [][]byte) (bool, error) { return false, errors.New("bad filter") })
+	if _, _, err := scan.Next(); err == nil || !strings.Contains(err.Error(), "bad filter") {
+		t.Errorf("Scan error: expected the filter error but got %v", err)
+	}
+}
+
+func TestDropTable(t *testing.T) {
+	fsys := st.NewMemFS()
+	cfg := newTestConfig(t, fsys)
+	db := NewDB("dropDB", cfg)
+	cols := map[string]column.SUPPORTED_TYPE{"key": column.INT, "val": column.STRING}
+	pkey := column.Column{Name: "key", Type: column.INT}
+	tbl, err := db.CreateTable("table1", cols, pkey)
+	if err != nil {
+		t.Fatalf("CreateTable error: %v", err)
+	}
+	if _, err := db.CreateTable("table2", cols, pkey); err != nil {
+		t.Fatalf("CreateTable error: %v", err)
+	}
+	ctx := GetClientContextMgr(cfg).NewClientCtx(cfg, db)
+	defer ctx.Close()
+	if _, err := crashInsert(ctx, tbl, "1", strings.Repeat("x", 9000)); err != nil {
+		t.Fatalf("insert error: %v", err)
+	}
+	if err := db.DropTable("table1"); !errors.Is(err, ErrTableInUse) {
+		t.Errorf("DropTable error: expected ErrTableInUse while a transaction uses the table but got %v", err)
+	}
+	if err := ctx.Commit(); err != nil {
+		t.Fatalf("Commit error: %v", err)
+	}
+	if err := tbl.Flush(); err != nil {
+		t.Fatalf("Flush error: %v", err)
+	}
+	droppedID, version := tbl.tblID, db.SchemaVersion()
+	if err := db.DropTable("table1"); err != nil {
+		t.Fatalf("DropTable error: %v", err)
+	}
+	if db.SchemaVersion() == version {
+		t.Errorf("SchemaVersion error: expected dropping a table to change the schema version")
+	}
+	if db.GetTable("table1") != nil {
+		t.Errorf("GetTable error: expected a dropped table to be gone")
+	}
+	if err := db.DropTable("table1"); !errors.Is(err, ErrTableNotFound) {
+		t.Errorf("DropTable error: expected ErrTableNotFound but got %v", err)
+	}
+	tables, err := db.Tables()
+	if err != nil || len(tables) != 1 || tables[0] != "table2" {
+		t.Errorf("Tables error: expected [table2] but got %v: %v", tables, err)
+	}
+	files, _ := fsys.ReadDir("/data/dropDB")
+	for _, file := range files {
+		if strings.HasPrefix(file.Name(), "table1") {
+			t.Errorf("DropTable error: file %s was left behind", file.Name())
+		}
+	}
+
+	// After a restart the table is gone and its ID is not handed out again
+	crash(cfg)
+	db = NewDB("dropDB", cfg)
+	if db.GetTable("table1") != nil {
+		t.Errorf("GetTable error: expected the dropped table to stay gone after a restart")
+	}
+	if db.GetTable("table2") == nil {
+		t.Errorf("GetTable error: expected table2 to be opened from its meta data after a restart")
+	}
+	tbl, err = db.CreateTable("table1", cols, pkey)
+	if err != nil {
+		t.Fatalf("CreateTable error: %v", err)
+	}
+	if tbl.tblID <= droppedID {
+		t.Errorf("CreateTable error: expected a new ID above %d but got %d", droppedID, tbl.tblID)
+	}
+	ctx2 := GetClientContextMgr(cfg).NewClientCtx(cfg, db)
+	defer ctx2.Close()
+	if rows := crashRows(t, ctx2, tbl); len(rows) != 0 {
+		t.Errorf("CreateTable error: expected the new table to be empty but got %d rows", len(rows))
+	}
+}
+
+/* Sessions share blocks: inserts fill the same free block, and scans read blocks others are changing */
+func TestConcurrentSessions(t *testing.T) {
+	cfg := newTestConfig(t, st.NewMemFS())
+	db := NewDB("concurrentDB", cfg)
+	cols := map[string]column.SUPPORTED_TYPE{"key": column.INT, "val": column.STRING}
+	tbl, err := db.CreateTable("table1", cols, column.Column{Name: "key", Type: column.INT})
+	if err != nil {
+		t.Fatalf("CreateTable error: %v", err)
+	}
+
+	const sessions, rows = 8, 40
+	var wg sync.WaitGroup
+	errs := make(chan error, sessions)
+	for i := 0; i < sessions; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ctx := GetClientContextMgr(cfg).NewClientCtx(cfg, db)
+			defer GetClientContextMgr(cfg).CloseClientCtx(ctx)
+			for j := 0; j < rows; j++ {
+				key := fmt.Sprintf("%d", i*rows+j)
+				rid, err := crashInsert(ctx, tbl, key, strings.Repeat("v", j*10))
+				if err != nil {
+					errs <- fmt.Errorf("insert error: %v", err)
+					return
+				}
+				if j%4 == 0 {
+					if err := tbl.DeleteRecord(ctx, rid); err != nil {
+						errs <- fmt.Errorf("DeleteRecord error: %v", err)
+						return
+					}
+				}
+				scan := tbl.Scan(ctx)
+				for {
+					_, values, err := scan.Next()
+					if err != nil {
+						errs <- fmt.Errorf("Scan error: %v", err)
+						return
+					}
+					if values == nil {
+						break
+					}
+				}
+				if err := ctx.Commit(); err != nil {
+					errs <- fmt.Errorf("Commit error: %v", err)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	ctx := GetClientContextMgr(cfg).NewClientCtx(cfg, db)
+	defer ctx.Close()
+	if got := crashRows(t, ctx, tbl); len(got) != sessions*rows*3/4 {
+		t.Errorf("Scan error: expected %d records but got %d", sessions*rows*3/4, len(got))
+	}
+}
@@ -0,0 +1,516 @@
+package db
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"math/rand"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/misachi/DarDB/column"
+	st "github.com/misachi/DarDB/storage"
+	"github.com/misachi/DarDB/storage/db/row"
+)
+
+/*
+The catalog keeps the number of live records of every open table. A transaction adds the records
+it inserted and takes away those it deleted when it commits. The count is written to the meta data
+of the table, with the number of blocks, when the table is flushed, vacuumed or analyzed, so after
+a crash it is the count of the last write until the next analyze of the whole table.
+
+Analyze reads a sample of the blocks of a table and keeps a sample of their records to describe
+every column: the share of nulls, the number of distinct values, the smallest and largest value,
+the most common values and an equi-depth histogram of the rest. The statistics are written next
+to the meta data in a .stats file. As they hold sampled values, the file of an encrypted table is
+sealed with the data key of the table: the ID of the key, then the sealed JSON.
+*/
+const (
+	ANALYZE_SAMPLE_BLOCKS = 300  // Blocks read by analyze
+	ANALYZE_SAMPLE_ROWS   = 3000 // Records kept from the blocks read
+	ANALYZE_MCV           = 10   // Most common values kept per column
+	ANALYZE_BUCKETS       = 10   // Histogram buckets per column
+	STATS_FILE_EXT        = ".stats"
+)
+
+/* tableEntry is what the catalog keeps about an open table */
+type tableEntry struct {
+	rows     atomic.Int64 // Live records committed
+	mtx      sync.Mutex   // Serializes meta data writes and guards analysis
+	analysis *TableAnalysis
+	idxMtx   sync.RWMutex // Held shared by changes to the records, exclusively to read or drop indexes
+	indexed  bool         // Whether indexes is loaded
+	indexes  []*Index
+}
+
+/* tableEntry returns the entry of the table, seeding a new one with rows */
+func (cat *Catalog) tableEntry(tblId st.Tbl_t, rows int64) *tableEntry {
+	cat.mut.Lock()
+	defer cat.mut.Unlock()
+	if cat.tables == nil {
+		cat.tables = make(map[st.Tbl_t]*tableEntry)
+	}
+	entry, ok := cat.tables[tblId]
+	if !ok {
+		entry = &tableEntry{}
+		entry.rows.Store(rows)
+		cat.tables[tblId] = entry
+	}
+	return entry
+}
+
+/* dropTable forgets the counts and statistics of a dropped table */
+func (cat *Catalog) dropTable(tblId st.Tbl_t) {
+	cat.mut.Lock()
+	defer cat.mut.Unlock()
+	delete(cat.tables, tblId)
+}
+
+/* addRows applies the record counts a transaction committed to the tables that are open */
+func (cat *Catalog) addRows(deltas map[st.Tbl_t]int64) {
+	cat.mut.Lock()
+	defer cat.mut.Unlock()
+	for tblId, delta := range deltas {
+		if entry, ok := cat.tables[tblId]; ok {
+			entry.rows.Add(delta)
+		}
+	}
+}
+
+/* rowDeltas counts the records the changes in log added to or removed from every table */
+func rowDeltas(log []*Entry) map[st.Tbl_t]int64 {
+	deltas := make(map[st.Tbl_t]int64)
+	for _, entry := range log {
+		switch entry.state {
+		case WAL_INSERT:
+			deltas[entry.tag.tblID]++
+		case WAL_DELETE:
+			deltas[entry.tag.tblID]--
+		}
+	}
+	return deltas
+}
+
+/* NumRecords is the number of live records committed to the table */
+func (tbl *Table) NumRecords() int64 {
+	return tbl.entry.rows.Load()
+}
+
+/* NumBlocks is the number of blocks in the table, including those not written yet */
+func (tbl *Table) NumBlocks() (int, error) {
+	return tbl.buf.TableBlocks(tbl.info.Location, tbl.tblID)
+}
+
+/* saveInfo writes the record and block counts to the meta data of the table */
+func (tbl *Table) saveInfo() error {
+	blocks, err := tbl.NumBlocks()
+	if err != nil {
+		return fmt.Errorf("saveInfo: %v", err)
+	}
+	tbl.entry.mtx.Lock()
+	defer tbl.entry.mtx.Unlock()
+	tbl.info.NumRecords = tbl.NumRecords()
+	tbl.info.NumBlocks = blocks
+	if err := writeTableInfo(tbl.buf.files.filesystem(), tbl.info.Path, tbl.info); err != nil {
+		return fmt.Errorf("saveInfo: %v", err)
+	}
+	return nil
+}
+
+/* ColumnStats describes the values of a column in the sample analyze took */
+type ColumnStats struct {
+	Name      string
+	Type      column.SUPPORTED_TYPE
+	NullFrac  float64   // Share of records where the column is null
+	Distinct  float64   // Estimated number of distinct values in the table
+	Min       []byte    // Nil when every value is null
+	Max       []byte    // Nil when every value is null
+	MCV       [][]byte  // Most common values, most common first
+	MCVFreq   []float64 // Share of records holding each most common value
+	Histogram [][]byte  // Bounds of buckets holding about as many of the other values each
+}
+
+/* TableAnalysis is what analyze found in a table */
+type TableAnalysis struct {
+	Rows       int64 // Estimated live records
+	Blocks     int
+	SampleRows int
+	Analyzed   time.Time
+	Columns    []ColumnStats
+}
+
+/* Column returns the statistics of the named column, nil if it has none */
+func (a *TableAnalysis) Column(name string) *ColumnStats {
+	for i := range a.Columns {
+		if a.Columns[i].Name == name {
+			return &a.Columns[i]
+		}
+	}
+	return nil
+}
+
+/* statsPath is the statistics file kept next to the meta data in metaPath */
+func statsPath(metaPath string) string {
+	return strings.TrimSuffix(metaPath, ".meta") + STATS_FILE_EXT
+}
+
+/* Analysis returns the statistics of the last analyze of the table, nil if it was never analyzed */
+func (tbl *Table) Analysis() (*TableAnalysis, error) {
+	tbl.entry.mtx.Lock()
+	defer tbl.entry.mtx.Unlock()
+	if tbl.entry.analysis != nil {
+		return tbl.entry.analysis, nil
+	}
+	data, err := st.ReadFile(tbl.buf.files.filesystem(), statsPath(tbl.info.Path))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Analysis: %v", err)
+	}
+	keys, _, err := tbl.statsKey()
+	if err != nil {
+		return nil, fmt.Errorf("Analysis: %v", err)
+	}
+	if data, err = openStats(data, keys, tbl.tblID); err != nil {
+		return nil, fmt.Errorf("Analysis: %v", err)
+	}
+	analysis := &TableAnalysis{}
+	if err := json.Unmarshal(data, analysis); err != nil {
+		return nil, fmt.Errorf("Analysis: Unmarshal error %v", err)
+	}
+	tbl.entry.analysis = analysis
+	return analysis, nil
+}
+
+/* Analyze samples the records of tbl, keeps the statistics of its columns and returns them */
+func (db *DB) Analyze(tbl *Table) (*TableAnalysis, error) {
+	ctx, err := NewClientContext(0, db.config, db)
+	if err != nil {
+		return nil, fmt.Errorf("Analyze: %v", err)
+	}
+	defer ctx.Close()
+
+	n, err := tbl.NumBlocks()
+	if err != nil {
+		return nil, fmt.Errorf("Analyze: %s: %v", tbl.info.Name, err)
+	}
+	blocks := sampleBlocks(n, ANALYZE_SAMPLE_BLOCKS)
+	colData := row.NewColumnData_(tbl.info.Column)
+	sample := make([][][]byte, 0, ANALYZE_SAMPLE_ROWS)
+	seen, read := 0, 0
+	for _, blockId := range blocks {
+		recs, err := tbl.blockRecords(ctx, blockId)
+		if err != nil {
+			return nil, fmt.Errorf("Analyze: %s: %v", tbl.info.Name, err)
+		}
+		read++
+		for _, rec := range recs {
+			// Reservoir sampling keeps every record read with the same chance
+			seen++
+			slot := len(sample)
+			if slot >= ANALYZE_SAMPLE_ROWS {
+				if slot = rand.Intn(seen); slot >= ANALYZE_SAMPLE_ROWS {
+					continue
+				}
+			}
+			vals, err := rec.(*row.VarLengthRecord).Values(colData)
+			if err != nil {
+				return nil, fmt.Errorf("Analyze: %s: %v", tbl.info.Name, err)
+			}
+			if slot == len(sample) {
+				sample = append(sample, vals)
+			} else {
+				sample[slot] = vals
+			}
+		}
+		// Release the read locks of the block
+		if err := ctx.Commit(); err != nil {
+			return nil, fmt.Errorf("Analyze: %v", err)
+		}
+	}
+
+	rows := int64(seen)
+	if read < n && read > 0 {
+		rows = int64(float64(seen) / float64(read) * float64(n))
+	}
+	analysis := &TableAnalysis{Rows: rows, Blocks: n, SampleRows: len(sample), Analyzed: time.Now()}
+	for i, col := range tbl.info.Column {
+		values := make([][]byte, len(sample))
+		for j, vals := range sample {
+			values[j] = vals[i]
+		}
+		analysis.Columns = append(analysis.Columns, columnStats(col, values, rows))
+	}
+
+	if read == n {
+		// Every block was read, so the count is exact but for transactions still running
+		tbl.entry.rows.Store(rows)
+	}
+	if err := tbl.saveInfo(); err != nil {
+		return nil, fmt.Errorf("Analyze: %v", err)
+	}
+	data, err := json.Marshal(analysis)
+	if err != nil {
+		return nil, fmt.Errorf("Analyze: Marshal error %v", err)
+	}
+	keys, keyID, err := tbl.statsKey()
+	if err != nil {
+		return nil, fmt.Errorf("Analyze: %v", err)
+	}
+	if data, err = sealStats(data, keys, keyID, tbl.tblID); err != nil {
+		return nil, fmt.Errorf("Analyze: %v", err)
+	}
+	tbl.entry.mtx.Lock()
+	defer tbl.entry.mtx.Unlock()
+	if err := st.WriteFileAtomic(db.config.FS(), statsPath(tbl.info.Path), data); err != nil {
+		return nil, fmt.Errorf("Analyze: %v", err)
+	}
+	tbl.entry.analysis = analysis
+	return analysis, nil
+}
+
+/* statsKey returns the keys of the database of tbl and the data key of the table, nil keys if the table is not encrypted */
+func (tbl *Table) statsKey() (*keyring, uint32, error) {
+	files := tbl.buf.files
+	mgr, err := files.file(tbl.info.Location)
+	if err != nil {
+		return nil, 0, fmt.Errorf("statsKey: %v", err)
+	}
+	if !mgr.Encrypted() {
+		return nil, 0, nil
+	}
+	keys, err := files.keyring(path.Dir(tbl.info.Location))
+	if err != nil {
+		return nil, 0, fmt.Errorf("statsKey: %w", err)
+	}
+	return keys, mgr.Header().KeyID, nil
+}
+
+/* statsAAD binds sealed statistics to their table */
+func statsAAD(tblId st.Tbl_t) []byte {
+	return binary.LittleEndian.AppendUint64([]byte(STATS_FILE_EXT), uint64(tblId))
+}
+
+/* sealStats seals the statistics in data with keyID of keys. Without keys they are left in plain text */
+func sealStats(data []byte, keys *keyring, keyID uint32, tblId st.Tbl_t) ([]byte, error) {
+	if keys == nil {
+		return data, nil
+	}
+	c, err := keys.cipher(keyID)
+	if err != nil {
+		return nil, fmt.Errorf("sealStats: %v", err)
+	}
+	sealed := binary.LittleEndian.AppendUint32(make([]byte, 0, 4+st.SEAL_SIZE+len(data)), keyID)
+	if sealed, err = c.Seal(sealed, data, statsAAD(tblId)); err != nil {
+		return nil, fmt.Errorf("sealStats: %v", err)
+	}
+	return sealed, nil
+}
+
+/* openStats opens statistics sealed by sealStats */
+func openStats(data []byte, keys *keyring, tblId st.Tbl_t) ([]byte, error) {
+	if keys == nil {
+		return data, nil
+	}
+	if len(data) < 4 {
+		return nil, fmt.Errorf("openStats: %w", st.ErrDecrypt)
+	}
+	c, err := keys.cipher(binary.LittleEndian.Uint32(data[0:4]))
+	if err != nil {
+		return nil, fmt.Errorf("openStats: %w", err)
+	}
+	if data, err = c.Open(nil, data[4:], statsAAD(tblId)); err != nil {
+		return nil, fmt.Errorf("openStats: %w", err)
+	}
+	return data, nil
+}
+
+/* resealStats seals the statistics file at name again with keyID, if the table has one */
+func resealStats(fsys st.FS, name string, tblId st.Tbl_t, keys *keyring, keyID uint32) error {
+	data, err := st.ReadFile(fsys, name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("resealStats: %v", err)
+	}
+	if data, err = openStats(data, keys, tblId); err != nil {
+		return fmt.Errorf("resealStats: %v", err)
+	}
+	if data, err = sealStats(data, keys, keyID, tblId); err != nil {
+		return fmt.Errorf("resealStats: %v", err)
+	}
+	return st.WriteFileAtomic(fsys, name, data)
+}
+
+/* sampleBlocks picks up to max of the n blocks of a table, in block order */
+func sampleBlocks(n, max int) []st.Blk_t {
+	blocks := make([]st.Blk_t, 0, n)
+	if n <= max {
+		for blockId := 0; blockId < n; blockId++ {
+			blocks = append(blocks, st.Blk_t(blockId))
+		}
+		return blocks
+	}
+	for _, blockId := range rand.Perm(n)[:max] {
+		blocks = append(blocks, st.Blk_t(blockId))
+	}
+	sort.Slice(blocks, func(i, j int) bool { return blocks[i] < blocks[j] })
+	return blocks
+}
+
+/* blockRecords returns the live records of a block, none for a block that was never written */
+func (tbl *Table) blockRecords(ctx *ClientContext, blockId st.Blk_t) ([]row.Record, error) {
+	guard, err := tbl.buf.fetchBlock(ctx, tbl.info.Location, tbl.tblID, blockId)
+	if errors.Is(err, ErrBlockNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer guard.Close()
+	return guard.Block().Records(ctx)
+}
+
+/* columnStats describes the sampled values of col in a table of rows records. Empty values are null */
+func columnStats(col column.Column, values [][]byte, rows int64) ColumnStats {
+	stats := ColumnStats{Name: col.Name, Type: col.Type}
+	nonNull := make([][]byte, 0, len(values))
+	for _, val := range values {
+		if len(val) > 0 {
+			nonNull = append(nonNull, val)
+		}
+	}
+	if len(values) > 0 {
+		stats.NullFrac = float64(len(values)-len(nonNull)) / float64(len(values))
+	}
+	if len(nonNull) == 0 {
+		return stats
+	}
+	sort.SliceStable(nonNull, func(i, j int) bool { return CompareValues(col.Type, nonNull[i], nonNull[j]) < 0 })
+	stats.Min, stats.Max = nonNull[0], nonNull[len(nonNull)-1]
+
+	// Runs of equal values in sorted order
+	type run struct {
+		val   []byte
+		count int
+	}
+	runs := make([]run, 0)
+	for _, val := range nonNull {
+		if last := len(runs) - 1; last >= 0 && CompareValues(col.Type, runs[last].val, val) == 0 {
+			runs[last].count++
+			continue
+		}
+		runs = append(runs, run{val: val, count: 1})
+	}
+	once := 0
+	for _, r := range runs {
+		if r.count == 1 {
+			once++
+		}
+	}
+	stats.Distinct = estimateDistinct(len(nonNull), len(runs), once, float64(rows)*(1-stats.NullFrac))
+
+	// Values seen more than once and more often than the average value are the most common
+	common := make([]run, 0)
+	avg := float64(len(nonNull)) / float64(len(runs))
+	for _, r := range runs {
+		if r.count > 1 && float64(r.count) > 1.25*avg {
+			common = append(common, r)
+		}
+	}
+	sort.SliceStable(common, func(i, j int) bool { return common[i].count > common[j].count })
+	if len(common) > ANALYZE_MCV {
+		common = common[:ANALYZE_MCV]
+	}
+	isCommon := make(map[string]bool, len(common))
+	for _, r := range common {
+		stats.MCV = append(stats.MCV, r.val)
+		stats.MCVFreq = append(stats.MCVFreq, float64(r.count)/float64(len(values)))
+		isCommon[string(r.val)] = true
+	}
+
+	rest := make([][]byte, 0, len(nonNull))
+	for _, val := range nonNull {
+		if !isCommon[string(val)] {
+			rest = append(rest, val)
+		}
+	}
+	if len(runs)-len(common) < 2 {
+		return stats
+	}
+	buckets := ANALYZE_BUCKETS
+	if len(rest)-1 < buckets {
+		buckets = len(rest) - 1
+	}
+	for i := 0; i <= buckets; i++ {
+		stats.Histogram = append(stats.Histogram, rest[i*(len(rest)-1)/buckets])
+	}
+	return stats
+}
+
+/*
+estimateDistinct scales the d distinct values found in a sample of n values, once of them seen a
+single time, to a table of total values with the Haas-Stokes estimator
+*/
+func estimateDistinct(n, d, once int, total float64) float64 {
+	if total <= float64(n) || once == 0 {
+		// Every value was read, or every value was seen more than once and likely all were
+		return float64(d)
+	}
+	est := float64(n) * float64(d) / (float64(n-once) + float64(once)*float64(n)/total)
+	if est < float64(d) {
+		est = float64(d)
+	}
+	if est > total {
+		est = total
+	}
+	return est
+}
+
+/* CompareValues orders two stored values of a column of type typ: numbers by value, strings by bytes */
+func CompareValues(typ column.SUPPORTED_TYPE, a, b []byte) int {
+	switch typ {
+	case column.STRING:
+		return bytes.Compare(a, b)
+	case column.FLOAT32, column.FLOAT64:
+		x, errA := strconv.ParseFloat(string(a), 64)
+		y, errB := strconv.ParseFloat(string(b), 64)
+		if errA == nil && errB == nil {
+			return compareOrdered(x < y, x > y)
+		}
+	case column.UINT, column.UINT8, column.UINT16, column.UINT32, column.UINT64:
+		x, errA := strconv.ParseUint(string(a), 10, 64)
+		y, errB := strconv.ParseUint(string(b), 10, 64)
+		if errA == nil && errB == nil {
+			return compareOrdered(x < y, x > y)
+		}
+	default:
+		x, errA := strconv.ParseInt(string(a), 10, 64)
+		y, errB := strconv.ParseInt(string(b), 10, 64)
+		if errA == nil && errB == nil {
+			return compareOrdered(x < y, x > y)
+		}
+	}
+	// Values that do not parse sort by their bytes
+	return bytes.Compare(a, b)
+}
+
+func compareOrdered(less, greater bool) int {
+	if less {
+		return -1
+	}
+	if greater {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,182 @@
+package db
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/misachi/DarDB/column"
+	st "github.com/misachi/DarDB/storage"
+)
+
+func TestTableCounts(t *testing.T) {
+	fsys := st.NewMemFS()
+	cfg := newTestConfig(t, fsys)
+	db := NewDB("statsDB", cfg)
+	cols := map[string]column.SUPPORTED_TYPE{"key": column.INT, "val": column.STRING}
+	pkey := column.Column{Name: "key", Type: column.INT}
+	tbl, err := db.CreateTable("table1", cols, pkey)
+	if err != nil {
+		t.Fatalf("CreateTable error: %v", err)
+	}
+	ctx := GetClientContextMgr(cfg).NewClientCtx(cfg, db)
+	defer ctx.Close()
+
+	rids := make([]RecordID, 0)
+	for i := 0; i < 100; i++ {
+		rid, err := crashInsert(ctx, tbl, fmt.Sprintf("%d", i), "value")
+		if err != nil {
+			t.Fatalf("insert error: %v", err)
+		}
+		rids = append(rids, rid)
+	}
+	if n := tbl.NumRecords(); n != 0 {
+		t.Errorf("NumRecords error: expected uncommitted records not to count but got %d", n)
+	}
+	if err := ctx.Commit(); err != nil {
+		t.Fatalf("Commit error: %v", err)
+	}
+	for _, rid := range rids[:30] {
+		if err := tbl.DeleteRecord(ctx, rid); err != nil {
+			t.Fatalf("DeleteRecord error: %v", err)
+		}
+	}
+	// Moving a record to another block neither adds nor removes one
+	if _, err := tbl.UpdateRecord(ctx, rids[50], tbl.info.Column, [][]byte{[]byte("50"), []byte(strings.Repeat("x", 900))}); err != nil {
+		t.Fatalf("UpdateRecord error: %v", err)
+	}
+	if err := ctx.Commit(); err != nil {
+		t.Fatalf("Commit error: %v", err)
+	}
+	if _, err := crashInsert(ctx, tbl, "1000", "rolled back"); err != nil {
+		t.Fatalf("insert error: %v", err)
+	}
+	if err := ctx.Rollback(); err != nil {
+		t.Fatalf("Rollback error: %v", err)
+	}
+	if n := tbl.NumRecords(); n != 70 {
+		t.Errorf("NumRecords error: expected %d but got %d", 70, n)
+	}
+
+	// The counts are saved with the meta data when the table is flushed
+	if err := tbl.Flush(); err != nil {
+		t.Fatalf("Flush error: %v", err)
+	}
+	blocks, err := tbl.NumBlocks()
+	if err != nil {
+		t.Fatalf("NumBlocks error: %v", err)
+	}
+	crash(cfg)
+	cfg = newTestConfig(t, fsys)
+	db = NewDB("statsDB", cfg)
+	if tbl, err = db.CreateTable("table1", cols, pkey); err != nil {
+		t.Fatalf("CreateTable error: %v", err)
+	}
+	if info := tbl.GetInfo(); info.NumRecords != 70 || info.NumBlocks != blocks {
+		t.Errorf("CreateTable error: expected %d records in %d blocks but got %d in %d", 70, blocks, info.NumRecords, info.NumBlocks)
+	}
+	if n := tbl.NumRecords(); n != 70 {
+		t.Errorf("NumRecords error: expected %d after reopening but got %d", 70, n)
+	}
+}
+
+func TestAnalyze(t *testing.T) {
+	fsys := st.NewMemFS()
+	cfg := newTestConfig(t, fsys)
+	db := NewDB("statsDB", cfg)
+	cols := map[string]column.SUPPORTED_TYPE{"key": column.INT, "val": column.STRING}
+	tbl, err := db.CreateTable("table1", cols, column.Column{Name: "key", Type: column.INT})
+	if err != nil {
+		t.Fatalf("CreateTable error: %v", err)
+	}
+	ctx := GetClientContextMgr(cfg).NewClientCtx(cfg, db)
+	defer ctx.Close()
+
+	// Half the values are "common", the rest spread over 100 others
+	rows := 2000
+	for i := 0; i < rows; i++ {
+		val := "common"
+		if i%2 == 1 {
+			val = fmt.Sprintf("v%03d", i%200)
+		}
+		if _, err := crashInsert(ctx, tbl, fmt.Sprintf("%d", i), val); err != nil {
+			t.Fatalf("insert error: %v", err)
+		}
+	}
+	if err := ctx.Commit(); err != nil {
+		t.Fatalf("Commit error: %v", err)
+	}
+
+	analysis, err := db.Analyze(tbl)
+	if err != nil {
+		t.Fatalf("Analyze error: %v", err)
+	}
+	if analysis.Rows != int64(rows) || analysis.SampleRows != rows {
+		t.Errorf("Analyze error: expected %d rows sampled but got %d of %d", rows, analysis.SampleRows, analysis.Rows)
+	}
+
+	key := analysis.Column("key")
+	if key == nil {
+		t.Fatalf("Column error: no statistics for key")
+	}
+	if string(key.Min) != "0" || string(key.Max) != fmt.Sprintf("%d", rows-1) {
+		t.Errorf("Analyze error: expected key from 0 to %d but got %s to %s", rows-1, key.Min, key.Max)
+	}
+	if key.Distinct != float64(rows) || len(key.MCV) != 0 || key.NullFrac != 0 {
+		t.Errorf("Analyze error: expected %d unique keys but got %+v", rows, key)
+	}
+	if len(key.Histogram) != ANALYZE_BUCKETS+1 || string(key.Histogram[0]) != "0" || string(key.Histogram[ANALYZE_BUCKETS]) != fmt.Sprintf("%d", rows-1) {
+		t.Errorf("Analyze error: expected %d buckets from the smallest to the largest key but got %q", ANALYZE_BUCKETS, key.Histogram)
+	}
+	// Numbers sort by value, not by their digits
+	for i := 1; i < len(key.Histogram); i++ {
+		if CompareValues(column.INT, key.Histogram[i-1], key.Histogram[i]) >= 0 {
+			t.Errorf("Analyze error: histogram bounds %s and %s are out of order", key.Histogram[i-1], key.Histogram[i])
+		}
+	}
+
+	val := analysis.Column("val")
+	if val.Distinct != 101 {
+		t.Errorf("Analyze error: expected %d distinct values but got %v", 101, val.Distinct)
+	}
+	if len(val.MCV) != 1 || string(val.MCV[0]) != "common" || math.Abs(val.MCVFreq[0]-0.5) > 1e-9 {
+		t.Errorf("Analyze error: expected common in half the records but got %q %v", val.MCV, val.MCVFreq)
+	}
+
+	// The statistics are kept with the table
+	crash(cfg)
+	cfg = newTestConfig(t, fsys)
+	db = NewDB("statsDB", cfg)
+	if tbl, err = db.CreateTable("table1", cols, column.Column{Name: "key", Type: column.INT}); err != nil {
+		t.Fatalf("CreateTable error: %v", err)
+	}
+	saved, err := tbl.Analysis()
+	if err != nil {
+		t.Fatalf("Analysis error: %v", err)
+	}
+	if saved == nil || saved.Rows != analysis.Rows || saved.Column("val").Distinct != val.Distinct {
+		t.Errorf("Analysis error: expected the saved statistics but got %+v", saved)
+	}
+	if n := tbl.NumRecords(); n != int64(rows) {
+		t.Errorf("NumRecords error: expected %d after analyze but got %d", rows, n)
+	}
+}
+
+func TestEstimateDistinct(t *testing.T) {
+	t.Parallel()
+	values := []struct {
+		n, d, once int
+		total      float64
+		want       float64
+	}{
+		{n: 100, d: 100, once: 100, total: 100, want: 100},     // Whole table read
+		{n: 100, d: 100, once: 100, total: 10000, want: 10000}, // Unique values scale with the table
+		{n: 100, d: 5, once: 0, total: 10000, want: 5},         // Repeated values do not
+	}
+	for _, val := range values {
+		if got := estimateDistinct(val.n, val.d, val.once, val.total); math.Abs(got-val.want) > 1e-9 {
+			t.Errorf("estimateDistinct error: expected %v for %+v but got %v", val.want, val, got)
+		}
+	}
+}
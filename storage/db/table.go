@@ -1,12 +1,13 @@
 package db
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
-	"os"
+	"io/fs"
 	"path"
 
 	"github.com/misachi/DarDB/column"
-	"github.com/misachi/DarDB/config"
 	st "github.com/misachi/DarDB/storage"
 
 	// blk "github.com/misachi/DarDB/storage/database/block"
@@ -17,27 +18,64 @@ import (
 
 /* TableInfo represents table meta data */
 type TableInfo struct {
-	NumBlocks  int             `json:"num_blocks,omitempty"`
-	NumRecords int64           `json:"num_records,omitempty"`
-	Name       string          `json:"name,omitempty"`
-	Location   string          `json:"location,omitempty"`
-	Path       string          `json:"path,omitempty"`
-	Pkey       column.Column   `json:"pkey,omitempty"`
-	Column     []column.Column `json:"schema,omitempty"`
+	ID          st.Tbl_t        `json:"id"`
+	NumBlocks   int             `json:"num_blocks,omitempty"`
+	NumRecords  int64           `json:"num_records,omitempty"`
+	Name        string          `json:"name,omitempty"`
+	Location    string          `json:"location,omitempty"`
+	Path        string          `json:"path,omitempty"`
+	Pkey        column.Column   `json:"pkey,omitempty"`
+	Column      []column.Column `json:"schema,omitempty"`
+	BlockSize   int             `json:"block_size,omitempty"` // Zero for tables created before block sizes were configurable
+	Compression Compression     `json:"compression,omitempty"`
+	Order       []int           `json:"order,omitempty"` // Indexes into Column in the order the columns were declared, empty for the order of Column
+	Indexes     []string        `json:"indexes,omitempty"` // Columns indexed by DB.CreateIndex
+}
+
+/* RecordID locates a record by block and slot. Slots stay stable when other records change */
+type RecordID struct {
+	Block st.Blk_t
+	Slot  int
 }
 
 type Table struct {
 	tblID st.Tbl_t
 	// internalBuf *BufferPoolMgr
-	info *TableInfo
+	buf   *BufferPoolMgr // Pool of the engine the table was opened with
+	info  *TableInfo
+	entry *tableEntry // Live counts and statistics kept in the catalog
 }
 
-func openRWCreate(file string) (*os.File, error) {
-	return os.OpenFile(file, os.O_CREATE|os.O_RDWR, 0750)
+/* readTableInfo reads the table meta data file written by writeTableInfo */
+func readTableInfo(fsys st.FS, metaPath string) (*TableInfo, error) {
+	data, err := st.ReadFile(fsys, metaPath)
+	if err != nil {
+		return nil, err
+	}
+	info := &TableInfo{}
+	if err := json.Unmarshal(data, info); err != nil {
+		return nil, fmt.Errorf("readTableInfo: Unmarshal error %v", err)
+	}
+	return info, nil
 }
 
-func NewTable(dbName string, tblInfo *TableInfo, cfg *config.Config) (*Table, error) {
+/* writeTableInfo persists the table meta data so the table keeps its ID across restarts */
+func writeTableInfo(fsys st.FS, metaPath string, info *TableInfo) error {
+	data, err := json.Marshal(info)
+	if err != nil {
+		return fmt.Errorf("writeTableInfo: Marshal error %v", err)
+	}
+	if err := st.WriteFileAtomic(fsys, metaPath, data); err != nil {
+		return fmt.Errorf("writeTableInfo: %v", err)
+	}
+	return nil
+}
+
+/* newTable opens the table described by tblInfo in dbName, creating its files if it has none */
+func newTable(dbName string, tblInfo *TableInfo, e *engine) (*Table, error) {
+	cfg := e.config
 	tblPath := path.Join(cfg.DataPath(), dbName, fmt.Sprintf("%s.data", tblInfo.Name))
+	metaPath := path.Join(cfg.DataPath(), dbName, fmt.Sprintf("%s.meta", tblInfo.Name))
 	// tblID := dbName // & 0xffffffff
 	// tblID += 1
 	// m, err := NewBufferPoolMgr(0, tblPath, st.Tbl_t(tblID))
@@ -45,8 +83,24 @@ func NewTable(dbName string, tblInfo *TableInfo, cfg *config.Config) (*Table, er
 	// 	return nil, fmt.Errorf("NewTable: unable to create a new manager\n %v", err)
 	// }
 	var tblID st.Tbl_t
-	catalog := GetCatalog(cfg)
-	if catalog != nil {
+	stored, err := readTableInfo(cfg.FS(), metaPath)
+	catalog := e.catalog
+	if err == nil {
+		tblID = stored.ID
+		if tblInfo.BlockSize != 0 && tblInfo.BlockSize != stored.blockSize() {
+			return nil, fmt.Errorf("CreateTable: table %s has blocks of %d bytes, not %d: %w", tblInfo.Name, stored.blockSize(), tblInfo.BlockSize, st.ErrBlockSize)
+		}
+		if tblInfo.Compression != COMPRESSION_NONE && tblInfo.Compression != stored.Compression {
+			return nil, fmt.Errorf("CreateTable: table %s has compression %v, not %v: %w", tblInfo.Name, stored.Compression, tblInfo.Compression, st.ErrCompression)
+		}
+		tblInfo.BlockSize = stored.BlockSize
+		tblInfo.Compression = stored.Compression
+		tblInfo.NumBlocks = stored.NumBlocks
+		tblInfo.NumRecords = stored.NumRecords
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		// Only a missing meta data file makes a new table; anything else would overwrite it
+		return nil, fmt.Errorf("newTable: table %s: %w", tblInfo.Name, err)
+	} else if catalog != nil {
 		if _, ok := catalog.db["catalog"]; ok {
 			// newTblID := catalog.maxTblID.Add(1)
 			// catalog.SetMaxTblId(st.Tbl_t(newTblID))
@@ -61,7 +115,15 @@ func NewTable(dbName string, tblInfo *TableInfo, cfg *config.Config) (*Table, er
 		}
 	}
 
+	if stored == nil && tblInfo.BlockSize == 0 {
+		tblInfo.BlockSize = cfg.BlockSize()
+		if tblInfo.BlockSize == 0 {
+			tblInfo.BlockSize = BLKSIZE
+		}
+	}
 	tblInfo.Location = tblPath
+	tblInfo.Path = metaPath
+	tblInfo.ID = tblID
 
 	// tID := fmt.Sprintf("%d", tblID)
 	// infoDir := path.Join(cfg.DataPath(), dbName)
@@ -70,17 +132,31 @@ func NewTable(dbName string, tblInfo *TableInfo, cfg *config.Config) (*Table, er
 	// if err != nil {
 	// 	return nil, fmt.Errorf("CreateTable: MkdirAll infoDir error %v", err)
 	// }
-	err := os.MkdirAll(dataDir, 0750)
+	err = cfg.FS().MkdirAll(dataDir)
 	if err != nil {
 		return nil, fmt.Errorf("CreateTable: MkdirAll dataDir error %v", err)
 	}
 
-	dataFile, err := openRWCreate(path.Join(dataDir, fmt.Sprintf("%s.data", tblInfo.Name)))
+	// New tables are encrypted when the config has a master key
+	keyID, err := e.buf.files.dataKey(dataDir)
+	if err != nil {
+		return nil, fmt.Errorf("CreateTable: data key error %w", err)
+	}
+	// The header of the data file has to agree with the meta data
+	hdr := st.FileHeader{BlockSize: tblInfo.blockSize(), Compression: uint8(tblInfo.Compression), Table: tblID, KeyID: keyID}
+	dataFile, err := st.CreateDiskMgr(cfg.FS(), tblPath, hdr)
 	if err != nil {
-		return nil, fmt.Errorf("CreateTable: data file error %v", err)
+		return nil, fmt.Errorf("CreateTable: data file error %w", err)
 	}
 	defer dataFile.Close()
 
+	if stored == nil {
+		if err := writeTableInfo(cfg.FS(), metaPath, tblInfo); err != nil {
+			return nil, fmt.Errorf("CreateTable: meta file error %v", err)
+		}
+	}
+	e.buf.files.registerPath(tblID, tblPath)
+
 	// infoFile, err := openRWCreate(path.Join(infoDir, fmt.Sprintf("%s.data", tblInfo.Name)))
 	// if err != nil {
 	// 	return nil, fmt.Errorf("CreateTable: meta file error %v", err)
@@ -89,18 +165,67 @@ func NewTable(dbName string, tblInfo *TableInfo, cfg *config.Config) (*Table, er
 
 	return &Table{
 		// internalBuf: m,
+		buf:   e.buf,
 		info:  tblInfo,
 		tblID: tblID,
+		entry: catalog.tableEntry(tblID, tblInfo.NumRecords),
 	}, nil
 }
 
+/* blockSize is the size of the table's blocks on disk */
+func (info *TableInfo) blockSize() int {
+	if info.BlockSize == 0 {
+		return BLKSIZE
+	}
+	return info.BlockSize
+}
+
+/* blockSize is the room for a page in the table's blocks, less than their size when they are encrypted */
+func (tbl *Table) blockSize() int {
+	return tbl.buf.files.blockSize(tbl.info.Location)
+}
+
+/* TableStats describes how the pages of a table are stored. Blocks only in the buffer pool are not counted */
+type TableStats struct {
+	Blocks           int64 // Blocks written to the data file
+	BlockSize        int
+	Compression      Compression
+	LogicalBytes     int64   // Bytes the written blocks take uncompressed
+	PhysicalBytes    int64   // Bytes the written blocks take in the data file
+	CompressionRatio float64 // LogicalBytes over PhysicalBytes, 1 without compression
+}
+
+func (tbl *Table) Stats() (TableStats, error) {
+	store, err := tbl.buf.files.store(tbl.info.Location)
+	if err != nil {
+		return TableStats{}, fmt.Errorf("Stats: %v", err)
+	}
+	blocks, physical := store.usage()
+	stats := TableStats{
+		Blocks:           blocks,
+		BlockSize:        tbl.info.blockSize(),
+		Compression:      tbl.info.Compression,
+		LogicalBytes:     blocks * int64(tbl.info.blockSize()),
+		PhysicalBytes:    physical,
+		CompressionRatio: 1,
+	}
+	if physical > 0 {
+		stats.CompressionRatio = float64(stats.LogicalBytes) / float64(physical)
+	}
+	return stats, nil
+}
+
 func (tbl *Table) GetInfo() *TableInfo {
 	return tbl.info
 }
 
-func (tbl *Table) Flush() {
-	bufMgr := GetBufMgr()
-	bufMgr.Flush(tbl.info.Location, tbl.tblID)
+/* Flush writes the dirty blocks of the table, syncs its data file and saves its counts */
+func (tbl *Table) Flush() error {
+	bufMgr := tbl.buf
+	if err := bufMgr.FlushTable(tbl.info.Location, tbl.tblID); err != nil {
+		return err
+	}
+	return tbl.saveInfo()
 	// var i int64 = 0
 	// for i < tbl.mgr.NumBlocks() {
 	// 	tbl.mgr.FlushBlock(int(i))
@@ -109,43 +234,234 @@ func (tbl *Table) Flush() {
 }
 
 func (tbl *Table) AddRecord(ctx *ClientContext, cols []column.Column, fieldVals [][]byte) (bool, error) {
-	recSize := 0
-	for i := 0; i < len(fieldVals); i++ {
-		recSize += len(fieldVals[i])
+	indexes, err := tbl.lockIndexes()
+	if err != nil {
+		return false, fmt.Errorf("AddRecord: %v", err)
+	}
+	defer tbl.entry.idxMtx.RUnlock()
+	txn := ctx.CurrentTxn()
+	var reserved []indexChange
+	defer func() { unreserve(reserved) }()
+	for _, idx := range indexes {
+		key := columnValue(cols, fieldVals, idx.column)
+		if key == "" {
+			continue
+		}
+		e, err := idx.reserve(txn, key)
+		if err != nil {
+			return false, fmt.Errorf("AddRecord: %w", err)
+		}
+		reserved = append(reserved, indexChange{idx: idx, entry: e})
+	}
+	fieldVals, err = tbl.toastValues(cols, fieldVals)
+	if err != nil {
+		return false, fmt.Errorf("AddRecord: %v", err)
+	}
+	record, err := row.NewVarLengthRecord(cols, fieldVals)
+	if err != nil {
+		return false, fmt.Errorf("AddRecord: record error %v", err)
+	}
+	recSize := record.RecordSize()
+	if empty, _ := NewSizedBlock(nil, 0, tbl.tblID, tbl.blockSize()); !empty.hasRoom(recSize) {
+		return false, fmt.Errorf("AddRecord: record of %d bytes: %w", recSize, ErrBlockFull)
 	}
 
-	bufMgr := GetBufMgr()
-	blk := bufMgr.GetFree(tbl.info.Location, tbl.tblID, recSize)
-	if blk == nil {
-		return false, fmt.Errorf("AddRecord: check disk space")
+	rid, err := tbl.insert(ctx, record)
+	if err != nil {
+		return false, err
+	}
+	for _, c := range reserved {
+		c.idx.place(txn, c.entry, rid)
+	}
+	reserved = nil
+	return true, nil
+}
+
+/* insert adds an encoded record to a block with room for it */
+func (tbl *Table) insert(ctx *ClientContext, record *row.VarLengthRecord) (RecordID, error) {
+	bufMgr := tbl.buf
+	// Blocks of old pages store the legacy layout, which is never shorter
+	legacy, err := row.LegacyLayout(record.ToByte())
+	if err != nil {
+		return RecordID{}, fmt.Errorf("AddRecord: %v", err)
+	}
+	for {
+		rid, added, err := tbl.addRecord(ctx, bufMgr, record, len(legacy))
+		if err != nil || added {
+			return rid, err
+		}
+		// Another insert filled the block first
+	}
+}
+
+/* addRecord inserts record in a block with room for it. It returns false if the block filled up before the record could be added */
+func (tbl *Table) addRecord(ctx *ClientContext, bufMgr *BufferPoolMgr, record *row.VarLengthRecord, recSize int) (RecordID, bool, error) {
+	guard, err := bufMgr.fetchFree(ctx, tbl.info.Location, tbl.tblID, recSize)
+	if err != nil {
+		return RecordID{}, false, fmt.Errorf("AddRecord: check disk space: %v", err)
+	}
+	defer guard.Close()
+	blk := guard.Block()
+
+	tbl.buf.ckptLock.RLock()
+	defer tbl.buf.ckptLock.RUnlock()
+	blk.mut.Lock()
+	defer blk.mut.Unlock()
+	slot := len(blk.recLocation)
+	if err := blk.insertRecordAt(slot, record.ToByte()); err != nil {
+		if errors.Is(err, ErrBlockFull) {
+			bufMgr.recordFree(blk)
+			return RecordID{}, false, nil
+		}
+		return RecordID{}, false, fmt.Errorf("AddRecord: %v", err)
+	}
+	rid := RecordID{Block: blk.BlockID(), Slot: slot}
+	ctx.engine.rows.claim(ctx.CurrentTxn(), tbl.tblID, rid)
+	tag := NewETag(ctx.database.dbID, tbl.tblID, blk.BlockID())
+	lsn, err := ctx.CurrentTxn().logChange(WAL_INSERT, tag, blk, slot, nil, record.ToByte())
+	if err != nil {
+		blk.undoInsert(slot)
+		return RecordID{}, false, fmt.Errorf("AddRecord: %v", err)
 	}
+	blk.markModified(lsn)
+	guard.MarkDirty()
+	return rid, true, nil
+}
 
+/* UpdateRecord replaces the record at rid. A record that no longer fits its block is moved and its new ID returned */
+func (tbl *Table) UpdateRecord(ctx *ClientContext, rid RecordID, cols []column.Column, fieldVals [][]byte) (RecordID, error) {
+	indexes, err := tbl.lockIndexes()
+	if err != nil {
+		return rid, fmt.Errorf("UpdateRecord: %v", err)
+	}
+	defer tbl.entry.idxMtx.RUnlock()
+	txn := ctx.CurrentTxn()
+	// Nobody else changes the record, and so its index entries, until txn ends
+	if err := ctx.engine.rows.lock(txn, tbl.tblID, rid); err != nil {
+		return rid, fmt.Errorf("UpdateRecord: %w", err)
+	}
+	keys := make([]string, len(indexes))
+	old := make([]*indexEntry, len(indexes))
+	var reserved []indexChange
+	defer func() { unreserve(reserved) }()
+	for i, idx := range indexes {
+		keys[i], old[i] = columnValue(cols, fieldVals, idx.column), idx.at(rid)
+		if keys[i] == "" || (old[i] != nil && old[i].key == keys[i]) {
+			continue
+		}
+		e, err := idx.reserve(txn, keys[i])
+		if err != nil {
+			return rid, fmt.Errorf("UpdateRecord: %w", err)
+		}
+		reserved = append(reserved, indexChange{idx: idx, entry: e})
+	}
+	fieldVals, err = tbl.toastValues(cols, fieldVals)
+	if err != nil {
+		return rid, fmt.Errorf("UpdateRecord: %v", err)
+	}
 	record, err := row.NewVarLengthRecord(cols, fieldVals)
 	if err != nil {
-		return false, fmt.Errorf("AddRecord: record error %v", err)
+		return rid, fmt.Errorf("UpdateRecord: record error %v", err)
 	}
 
-	if err := blk.AddRecord(record); err != nil {
-		return false, fmt.Errorf("AddRecord: %v", err)
+	newRid, err := tbl.update(ctx, rid, record)
+	if err != nil {
+		return rid, fmt.Errorf("UpdateRecord: %w", err)
+	}
+	for i, idx := range indexes {
+		if old[i] == nil || (old[i].key == keys[i] && newRid == rid) {
+			continue
+		}
+		if old[i].key == keys[i] {
+			idx.move(txn, rid, newRid)
+		} else {
+			idx.unset(txn, rid)
+		}
+	}
+	for _, c := range reserved {
+		c.idx.place(txn, c.entry, newRid)
 	}
-	bufMgr.WriteBlock(tbl.info.Location, tbl.tblID, blk.BlockID())
+	reserved = nil
+	return newRid, nil
+}
 
-	return true, nil
+/* update replaces the record at rid, moving it to another block if it no longer fits */
+func (tbl *Table) update(ctx *ClientContext, rid RecordID, record *row.VarLengthRecord) (RecordID, error) {
+	moved, err := tbl.changeRecord(ctx, rid, WAL_UPDATE, record.ToByte())
+	if err != nil || !moved {
+		return rid, err
+	}
+	if _, err := tbl.changeRecord(ctx, rid, WAL_DELETE, nil); err != nil {
+		return rid, err
+	}
+	return tbl.insert(ctx, record)
+}
+
+/* DeleteRecord removes the record at rid. Its slot stays reserved so other record IDs do not change */
+func (tbl *Table) DeleteRecord(ctx *ClientContext, rid RecordID) error {
+	indexes, err := tbl.lockIndexes()
+	if err != nil {
+		return fmt.Errorf("DeleteRecord: %v", err)
+	}
+	defer tbl.entry.idxMtx.RUnlock()
+	if _, err := tbl.changeRecord(ctx, rid, WAL_DELETE, nil); err != nil {
+		return fmt.Errorf("DeleteRecord: %w", err)
+	}
+	for _, idx := range indexes {
+		idx.unset(ctx.CurrentTxn(), rid)
+	}
+	return nil
+}
+
+/* changeRecord logs and applies an update or delete. It reports true if an update does not fit the block */
+func (tbl *Table) changeRecord(ctx *ClientContext, rid RecordID, state WALSTATE_t, data []byte) (bool, error) {
+	if err := ctx.engine.rows.lock(ctx.CurrentTxn(), tbl.tblID, rid); err != nil {
+		return false, err
+	}
+	guard, err := tbl.buf.fetchBlock(ctx, tbl.info.Location, tbl.tblID, rid.Block)
+	if err != nil {
+		return false, err
+	}
+	defer guard.Close()
+	blk := guard.Block()
+
+	tbl.buf.ckptLock.RLock()
+	defer tbl.buf.ckptLock.RUnlock()
+	blk.mut.Lock()
+	defer blk.mut.Unlock()
+	if rid.Slot < 0 || rid.Slot >= len(blk.recLocation) || blk.isDeleted(rid.Slot) {
+		return false, fmt.Errorf("record %d_%d: %w", rid.Block, rid.Slot, ErrRecordNotFound)
+	}
+	oldVal, _ := blk.recordBytes(rid.Slot)
+	if err := blk.replaceRecord(rid.Slot, data); err != nil {
+		if errors.Is(err, ErrBlockFull) {
+			return true, nil
+		}
+		return false, err
+	}
+	tag := NewETag(ctx.database.dbID, tbl.tblID, rid.Block)
+	lsn, err := ctx.CurrentTxn().logChange(state, tag, blk, rid.Slot, oldVal, data)
+	if err != nil {
+		blk.replaceRecord(rid.Slot, oldVal)
+		return false, err
+	}
+	blk.markModified(lsn)
+	guard.MarkDirty()
+	return false, nil
 }
 
 func (tbl *Table) GetRecord(ctx *ClientContext, colName string, colValue []byte) ([]row.Record, error) {
-	var f_block int64 = 0
 	records := make([]row.Record, 0)
-	var tblSz int64 = 1 //tbl.info.NumBlocks
+	iter := tbl.blockIterator()
+	defer iter.Close()
 
 	for {
-		if tblSz < f_block {
-			break
-		}
-		bufMgr := GetBufMgr()
-		blk, err := bufMgr.GetBlock(tbl.info.Location, tbl.tblID, st.Blk_t(f_block))
+		blk, err := iter.Next()
 		if err != nil {
-			return nil, fmt.Errorf("GetRecord: GetBlock: %v", err)
+			return nil, fmt.Errorf("GetRecord: %v", err)
+		}
+		if blk == nil {
+			break
 		}
 		// fmt.Printf("Block: %q\n", blk.records)
 		rec, err := blk.FilterRecords(ctx, row.NewColumnData_(tbl.info.Column), colName, colValue)
@@ -155,11 +471,65 @@ func (tbl *Table) GetRecord(ctx *ClientContext, colName string, colValue []byte)
 			return nil, fmt.Errorf("GetRecord: FilterRecords: %v", err)
 		}
 		records = append(records, rec...)
-		f_block += BLKSIZE
 	}
 	return records, nil
 }
 
+/* BlockIterator walks the blocks of a table. Only the block last returned by Next is pinned */
+type BlockIterator struct {
+	tbl     *Table
+	bufMgr  *BufferPoolMgr
+	f_block int64
+	tblSz   int64
+	guard   *BlockGuard
+}
+
+func (tbl *Table) blockIterator() *BlockIterator {
+	return &BlockIterator{
+		tbl:    tbl,
+		bufMgr: tbl.buf,
+		tblSz:  -1,
+	}
+}
+
+/* Next unpins the previous block and pins the next one. A nil block means the table is exhausted */
+func (it *BlockIterator) Next() (*Block, error) {
+	it.release()
+	if it.tblSz < 0 {
+		numBlocks, err := it.bufMgr.TableBlocks(it.tbl.info.Location, it.tbl.tblID)
+		if err != nil {
+			return nil, fmt.Errorf("BlockIterator: %v", err)
+		}
+		it.tblSz = int64(numBlocks)
+	}
+
+	for it.f_block < it.tblSz {
+		guard, err := it.bufMgr.FetchBlock(it.tbl.info.Location, it.tbl.tblID, st.Blk_t(it.f_block))
+		it.f_block++
+		if errors.Is(err, ErrBlockNotFound) {
+			// Allocated but never written
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("BlockIterator: %v", err)
+		}
+		it.guard = guard
+		return guard.Block(), nil
+	}
+	return nil, nil
+}
+
+func (it *BlockIterator) release() {
+	if it.guard != nil {
+		it.guard.Close()
+		it.guard = nil
+	}
+}
+
+func (it *BlockIterator) Close() {
+	it.release()
+}
+
 func NewTableInfo(name string, cols []column.Column, pkey column.Column) *TableInfo {
 	return &TableInfo{
 		Column:   cols,
@@ -169,6 +539,18 @@ func NewTableInfo(name string, cols []column.Column, pkey column.Column) *TableI
 	}
 }
 
+/* DeclaredOrder returns the indexes into Column of the columns in the order they were declared */
+func (info *TableInfo) DeclaredOrder() []int {
+	if len(info.Order) == len(info.Column) {
+		return info.Order
+	}
+	order := make([]int, len(info.Column))
+	for i := range order {
+		order[i] = i
+	}
+	return order
+}
+
 // func DSerialize(td *TableInfo) error {
 // 	dsk, err := st.NewDiskMgr(td.Path)
 // 	if err != nil {
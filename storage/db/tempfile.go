@@ -0,0 +1,202 @@
+package db
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"strconv"
+	"sync/atomic"
+
+	cfg "github.com/misachi/DarDB/config"
+	st "github.com/misachi/DarDB/storage"
+)
+
+const (
+	TEMP_DIR        = "tmp" // Under the data path, next to the databases
+	TEMP_FILE_EXT   = ".tmp"
+	TEMP_CHUNK_SIZE = 64 * 1024 // Bytes buffered before a write, and sealed together when encrypted
+)
+
+var tempFileID atomic.Uint64
+
+/*
+TempFile is a scratch file a query spills to, written once from the start and then read back.
+Writes are buffered in chunks; when a master key is configured every chunk is sealed with a key
+that lives only as long as the file, so spilled rows are never on disk in the clear. The file is
+removed when it is closed, and files left by a crash are removed when the catalog starts.
+*/
+type TempFile struct {
+	fsys    st.FS
+	path    string
+	file    st.File
+	cipher  *st.Cipher
+	buf     []byte
+	size    int64 // Bytes written through Write
+	written int64 // Bytes in the file
+	readPos int64
+	pending []byte // Read but not yet returned
+}
+
+/* CreateTempFile creates a temp file under the data path of the context's config */
+func (ctx *ClientContext) CreateTempFile() (*TempFile, error) {
+	return NewTempFile(ctx.config)
+}
+
+func NewTempFile(config *cfg.Config) (*TempFile, error) {
+	fsys := config.FS()
+	dir := path.Join(config.DataPath(), TEMP_DIR)
+	if err := fsys.MkdirAll(dir); err != nil {
+		return nil, fmt.Errorf("NewTempFile: %v", err)
+	}
+	master, err := config.MasterKey()
+	if err != nil {
+		return nil, fmt.Errorf("NewTempFile: %v", err)
+	}
+	f := &TempFile{fsys: fsys, path: path.Join(dir, strconv.FormatUint(tempFileID.Add(1), 10)+TEMP_FILE_EXT)}
+	if master != nil {
+		key, err := st.GenerateKey()
+		if err != nil {
+			return nil, fmt.Errorf("NewTempFile: %v", err)
+		}
+		if f.cipher, err = st.NewCipher(key); err != nil {
+			return nil, fmt.Errorf("NewTempFile: %v", err)
+		}
+	}
+	if f.file, err = fsys.Create(f.path); err != nil {
+		return nil, fmt.Errorf("NewTempFile: %v", err)
+	}
+	return f, nil
+}
+
+/* Size is the number of bytes written */
+func (f *TempFile) Size() int64 {
+	return f.size
+}
+
+func (f *TempFile) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		room := TEMP_CHUNK_SIZE - len(f.buf)
+		if room > len(p) {
+			room = len(p)
+		}
+		f.buf = append(f.buf, p[:room]...)
+		p = p[room:]
+		if len(f.buf) == TEMP_CHUNK_SIZE {
+			if err := f.flush(); err != nil {
+				return 0, err
+			}
+		}
+	}
+	f.size += int64(n)
+	return n, nil
+}
+
+/* flush writes the buffered bytes as a chunk: its length, then the bytes, sealed when encrypted */
+func (f *TempFile) flush() error {
+	if len(f.buf) == 0 {
+		return nil
+	}
+	data := f.buf
+	if f.cipher != nil {
+		sealed, err := f.cipher.Seal(nil, f.buf, chunkAAD(f.written))
+		if err != nil {
+			return fmt.Errorf("TempFile: %v", err)
+		}
+		data = sealed
+	}
+	chunk := make([]byte, 4+len(data))
+	binary.LittleEndian.PutUint32(chunk, uint32(len(data)))
+	copy(chunk[4:], data)
+	if _, err := f.file.WriteAt(chunk, f.written); err != nil {
+		return fmt.Errorf("TempFile: %v", err)
+	}
+	f.written += int64(len(chunk))
+	f.buf = f.buf[:0]
+	return nil
+}
+
+/* chunkAAD binds a sealed chunk to its offset, so chunks cannot be swapped */
+func chunkAAD(offset int64) []byte {
+	aad := make([]byte, 8)
+	binary.LittleEndian.PutUint64(aad, uint64(offset))
+	return aad
+}
+
+/* Rewind writes out what is buffered and starts reading from the start */
+func (f *TempFile) Rewind() error {
+	if err := f.flush(); err != nil {
+		return err
+	}
+	f.readPos = 0
+	f.pending = nil
+	return nil
+}
+
+func (f *TempFile) Read(p []byte) (int, error) {
+	for len(f.pending) == 0 {
+		if f.readPos >= f.written {
+			return 0, io.EOF
+		}
+		var hdr [4]byte
+		if _, err := f.file.ReadAt(hdr[:], f.readPos); err != nil {
+			return 0, fmt.Errorf("TempFile: %v", err)
+		}
+		data := make([]byte, binary.LittleEndian.Uint32(hdr[:]))
+		if _, err := f.file.ReadAt(data, f.readPos+4); err != nil {
+			return 0, fmt.Errorf("TempFile: %v", err)
+		}
+		if f.cipher != nil {
+			var err error
+			if data, err = f.cipher.Open(nil, data, chunkAAD(f.readPos)); err != nil {
+				return 0, fmt.Errorf("TempFile: %v", err)
+			}
+		}
+		f.readPos += 4 + int64(binary.LittleEndian.Uint32(hdr[:]))
+		f.pending = data
+	}
+	n := copy(p, f.pending)
+	f.pending = f.pending[n:]
+	return n, nil
+}
+
+/* Close closes and removes the file */
+func (f *TempFile) Close() error {
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	if rmErr := f.fsys.Remove(f.path); err == nil {
+		err = rmErr
+	}
+	if err != nil {
+		return fmt.Errorf("TempFile: %v", err)
+	}
+	return nil
+}
+
+/* removeTempFiles removes the temp files a previous run left behind */
+func removeTempFiles(config *cfg.Config) error {
+	fsys := config.FS()
+	dir := path.Join(config.DataPath(), TEMP_DIR)
+	files, err := fsys.ReadDir(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("removeTempFiles: %v", err)
+	}
+	for _, file := range files {
+		if path.Ext(file.Name()) != TEMP_FILE_EXT {
+			continue
+		}
+		if err := fsys.Remove(path.Join(dir, file.Name())); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("removeTempFiles: %v", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package db
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"path"
+	"testing"
+
+	st "github.com/misachi/DarDB/storage"
+)
+
+func TestTempFile(t *testing.T) {
+	data := bytes.Repeat([]byte("spilled row data "), TEMP_CHUNK_SIZE/8)
+	tests := []struct {
+		name    string
+		keyFile string
+	}{
+		{"Plain", ""},
+		{"Encrypted", newTestKeyFile(t)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fsys := st.NewMemFS()
+			cfg := newTestConfig(t, fsys)
+			if tt.keyFile != "" {
+				cfg.SetMasterKeyFile(tt.keyFile)
+			}
+			f, err := NewTempFile(cfg)
+			if err != nil {
+				t.Fatalf("NewTempFile error: %v", err)
+			}
+			for i := 0; i < len(data); i += 1000 {
+				end := i + 1000
+				if end > len(data) {
+					end = len(data)
+				}
+				if _, err := f.Write(data[i:end]); err != nil {
+					t.Fatalf("Write error: %v", err)
+				}
+			}
+			if f.Size() != int64(len(data)) {
+				t.Errorf("Size = %d, want %d", f.Size(), len(data))
+			}
+			for pass := 0; pass < 2; pass++ {
+				if err := f.Rewind(); err != nil {
+					t.Fatalf("Rewind error: %v", err)
+				}
+				got, err := io.ReadAll(f)
+				if err != nil {
+					t.Fatalf("ReadAll error: %v", err)
+				}
+				if !bytes.Equal(got, data) {
+					t.Fatalf("read %d bytes back, want the %d written", len(got), len(data))
+				}
+			}
+
+			onDisk, err := st.ReadFile(fsys, f.path)
+			if err != nil {
+				t.Fatalf("ReadFile error: %v", err)
+			}
+			if contains := bytes.Contains(onDisk, []byte("spilled row data")); contains != (tt.keyFile == "") {
+				t.Errorf("file holds the plain text: %v", contains)
+			}
+
+			if err := f.Close(); err != nil {
+				t.Fatalf("Close error: %v", err)
+			}
+			if _, err := fsys.Open(f.path); !errors.Is(err, fs.ErrNotExist) {
+				t.Errorf("Open after Close: %v, want ErrNotExist", err)
+			}
+		})
+	}
+}
+
+func TestRemoveTempFiles(t *testing.T) {
+	fsys := st.NewMemFS()
+	cfg := newTestConfig(t, fsys)
+	if err := removeTempFiles(cfg); err != nil {
+		t.Fatalf("removeTempFiles with no temp dir: %v", err)
+	}
+	f, err := NewTempFile(cfg)
+	if err != nil {
+		t.Fatalf("NewTempFile error: %v", err)
+	}
+	if _, err := f.Write([]byte("left behind")); err != nil {
+		t.Fatalf("Write error: %v", err)
+	}
+	if err := f.Rewind(); err != nil {
+		t.Fatalf("Rewind error: %v", err)
+	}
+	if err := f.file.Close(); err != nil {
+		t.Fatalf("Close error: %v", err)
+	}
+
+	if err := removeTempFiles(cfg); err != nil {
+		t.Fatalf("removeTempFiles error: %v", err)
+	}
+	files, err := fsys.ReadDir(path.Join(cfg.DataPath(), TEMP_DIR))
+	if err != nil {
+		t.Fatalf("ReadDir error: %v", err)
+	}
+	if len(files) != 0 {
+		t.Errorf("%d temp files left, want 0", len(files))
+	}
+}
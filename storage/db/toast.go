@@ -0,0 +1,376 @@
+package db
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/misachi/DarDB/column"
+	dsk "github.com/misachi/DarDB/storage"
+	"github.com/misachi/DarDB/storage/db/row"
+)
+
+/*
+STRING values longer than TOAST_THRESHOLD, scaled up for tables with larger blocks, are moved out of the record into a chain of overflow
+pages in the toast file of the table, and the record keeps a pointer "<first page>,<length>".
+Every overflow page is
+
+	magic(4) | next page + 1, 0 ends the chain(8) | data length(4) | crc32c of the data(4) | data
+
+Chains are written and synced before the record pointing at them is logged, so a committed record
+never points at a missing chain. Nothing reclaims a chain once its value is deleted, replaced or
+rolled back, vacuum included, so the toast file only grows.
+
+The overflow pages of an encrypted table are sealed with the table and page number, after the ID
+of the key, which is kept with every page so a table being rotated to a new key stays readable:
+
+	key ID(4) | overflow page of BLKSIZE-TOAST_SEAL_OVERHEAD bytes sealed
+*/
+const (
+	TOAST_MAGIC         uint32 = 0x544f4153 // "TOAS"
+	TOAST_HDR_SIZE             = 20
+	TOAST_DATA_SIZE            = BLKSIZE - TOAST_HDR_SIZE
+	TOAST_THRESHOLD            = BLKSIZE / 4
+	TOAST_FILE_EXT             = ".toast"
+	TOAST_SEAL_OVERHEAD        = 4 + dsk.SEAL_SIZE
+)
+
+var ErrToastCorrupt = errors.New("overflow page is corrupt")
+
+type toastStore struct {
+	mtx   sync.Mutex // Guards pages and appends to file
+	file  dsk.File
+	pages int64 // Number of pages in the file
+	tblId dsk.Tbl_t
+	keys  *keyring // Keys of the database when the table is encrypted
+	keyID uint32   // Key new pages are sealed with
+}
+
+/* toastPath is the overflow file of the table stored in dataPath */
+func toastPath(dataPath string) string {
+	return strings.TrimSuffix(dataPath, path.Ext(dataPath)) + TOAST_FILE_EXT
+}
+
+/* openToastStore opens the overflow file of a table, sealing its pages with keyID of keys unless keys is nil */
+func openToastStore(fsys dsk.FS, dataPath string, tblId dsk.Tbl_t, keys *keyring, keyID uint32) (*toastStore, error) {
+	file, err := dsk.OpenOrCreate(fsys, toastPath(dataPath))
+	if err != nil {
+		return nil, fmt.Errorf("openToastStore: %v", err)
+	}
+	fInfo, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("openToastStore: %v", err)
+	}
+	// A torn last page is never referenced, so it is overwritten by the next chain
+	return &toastStore{file: file, pages: fInfo.Size() / BLKSIZE, tblId: tblId, keys: keys, keyID: keyID}, nil
+}
+
+/* dataSize is the room for data in an overflow page */
+func (s *toastStore) dataSize() int {
+	if s.keys != nil {
+		return TOAST_DATA_SIZE - TOAST_SEAL_OVERHEAD
+	}
+	return TOAST_DATA_SIZE
+}
+
+func (s *toastStore) pageAAD(pageNo int64) []byte {
+	aad := make([]byte, 16)
+	binary.LittleEndian.PutUint64(aad[0:8], uint64(s.tblId))
+	binary.LittleEndian.PutUint64(aad[8:16], uint64(pageNo))
+	return aad
+}
+
+/* encodePage fills page, BLKSIZE bytes, with overflow page pageNo holding chunk */
+func (s *toastStore) encodePage(page []byte, pageNo int64, next uint64, chunk []byte) error {
+	plain := page
+	if s.keys != nil {
+		plain = make([]byte, BLKSIZE-TOAST_SEAL_OVERHEAD)
+	}
+	binary.LittleEndian.PutUint32(plain[0:4], TOAST_MAGIC)
+	binary.LittleEndian.PutUint64(plain[4:12], next)
+	binary.LittleEndian.PutUint32(plain[12:16], uint32(len(chunk)))
+	binary.LittleEndian.PutUint32(plain[16:20], crc32.Checksum(chunk, crc32c))
+	copy(plain[TOAST_HDR_SIZE:], chunk)
+	if s.keys == nil {
+		return nil
+	}
+	c, err := s.keys.cipher(s.keyID)
+	if err != nil {
+		return err
+	}
+	binary.LittleEndian.PutUint32(page[0:4], s.keyID)
+	_, err = c.Seal(page[4:4:BLKSIZE], plain, s.pageAAD(pageNo))
+	return err
+}
+
+/* decodePage returns the next page + 1 and the data of overflow page pageNo */
+func (s *toastStore) decodePage(page []byte, pageNo int64) (uint64, []byte, error) {
+	if s.keys != nil {
+		c, err := s.keys.cipher(binary.LittleEndian.Uint32(page[0:4]))
+		if err != nil {
+			return 0, nil, err
+		}
+		if page, err = c.Open(nil, page[4:], s.pageAAD(pageNo)); err != nil {
+			return 0, nil, err
+		}
+	}
+	sz := int(binary.LittleEndian.Uint32(page[12:16]))
+	if binary.LittleEndian.Uint32(page[0:4]) != TOAST_MAGIC || sz > len(page)-TOAST_HDR_SIZE {
+		return 0, nil, ErrToastCorrupt
+	}
+	data := page[TOAST_HDR_SIZE : TOAST_HDR_SIZE+sz]
+	if crc32.Checksum(data, crc32c) != binary.LittleEndian.Uint32(page[16:20]) {
+		return 0, nil, ErrToastCorrupt
+	}
+	return binary.LittleEndian.Uint64(page[4:12]), data, nil
+}
+
+/* Write stores value in a new chain and returns the pointer to keep in the record */
+func (s *toastStore) Write(value []byte) ([]byte, error) {
+	dataSize := s.dataSize()
+	numPages := int64((len(value) + dataSize - 1) / dataSize)
+	s.mtx.Lock()
+	first := s.pages
+	s.pages += numPages
+	s.mtx.Unlock()
+
+	data := make([]byte, numPages*BLKSIZE)
+	for i := int64(0); i < numPages; i++ {
+		chunk := value[i*int64(dataSize):]
+		if len(chunk) > dataSize {
+			chunk = chunk[:dataSize]
+		}
+		var next uint64
+		if i < numPages-1 {
+			next = uint64(first+i+1) + 1
+		}
+		if err := s.encodePage(data[i*BLKSIZE:(i+1)*BLKSIZE], first+i, next, chunk); err != nil {
+			return nil, fmt.Errorf("toastStore Write: %v", err)
+		}
+	}
+	if _, err := s.file.WriteAt(data, first*BLKSIZE); err != nil {
+		return nil, fmt.Errorf("toastStore Write: %v", err)
+	}
+	if err := s.file.Sync(); err != nil {
+		return nil, fmt.Errorf("toastStore Write: %v", err)
+	}
+	return []byte(fmt.Sprintf("%d,%d", first, len(value))), nil
+}
+
+/* Open returns a reader that walks the chain of pointer one page at a time */
+func (s *toastStore) Open(pointer []byte) (io.Reader, error) {
+	first, length, err := parseToastPointer(pointer)
+	if err != nil {
+		return nil, err
+	}
+	return &toastReader{store: s, next: uint64(first) + 1, remaining: length}, nil
+}
+
+func parseToastPointer(pointer []byte) (int64, int64, error) {
+	parts := strings.SplitN(string(pointer), ",", 2)
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("parseToastPointer: bad pointer %q", pointer)
+	}
+	first, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("parseToastPointer: %v", err)
+	}
+	length, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("parseToastPointer: %v", err)
+	}
+	return first, length, nil
+}
+
+type toastReader struct {
+	store     *toastStore
+	next      uint64 // Next page + 1, 0 when the chain is exhausted
+	remaining int64
+	page      []byte
+	buf       []byte // Unread data of the current page
+}
+
+func (r *toastReader) Read(p []byte) (int, error) {
+	if r.remaining <= 0 {
+		return 0, io.EOF
+	}
+	if len(r.buf) == 0 {
+		if err := r.readPage(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.buf)
+	if int64(n) > r.remaining {
+		n = int(r.remaining)
+	}
+	r.buf = r.buf[n:]
+	r.remaining -= int64(n)
+	return n, nil
+}
+
+func (r *toastReader) readPage() error {
+	if r.next == 0 {
+		return fmt.Errorf("toastReader: chain ended %d bytes early: %w", r.remaining, ErrToastCorrupt)
+	}
+	if r.page == nil {
+		r.page = make([]byte, BLKSIZE)
+	}
+	pageNo := int64(r.next - 1)
+	if _, err := r.store.file.ReadAt(r.page, pageNo*BLKSIZE); err != nil {
+		return fmt.Errorf("toastReader: page %d: %v", pageNo, err)
+	}
+	next, data, err := r.store.decodePage(r.page, pageNo)
+	if err != nil {
+		return fmt.Errorf("toastReader: page %d: %w", pageNo, err)
+	}
+	r.next = next
+	r.buf = data
+	return nil
+}
+
+/*
+resealToast copies the overflow file of the table stored in dataPath to a file next to it, with
+every page sealed with keyID of keys, and returns the path of the copy, or "" when the table has
+no overflow file. Pages that do not open belong to no chain and are copied as they are.
+*/
+func resealToast(fsys dsk.FS, dataPath string, tblId dsk.Tbl_t, keys *keyring, keyID uint32) (string, error) {
+	name := toastPath(dataPath)
+	src, err := fsys.Open(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("resealToast: %v", err)
+	}
+	defer src.Close()
+	fInfo, err := src.Stat()
+	if err != nil {
+		return "", fmt.Errorf("resealToast: %v", err)
+	}
+	tmp := name + ROTATE_FILE_EXT
+	dst, err := fsys.Create(tmp)
+	if err != nil {
+		return "", fmt.Errorf("resealToast: %v", err)
+	}
+	defer dst.Close()
+
+	from := &toastStore{file: src, tblId: tblId, keys: keys}
+	to := &toastStore{file: dst, tblId: tblId, keys: keys, keyID: keyID}
+	page := make([]byte, BLKSIZE)
+	out := make([]byte, BLKSIZE)
+	for pageNo := int64(0); pageNo < fInfo.Size()/BLKSIZE; pageNo++ {
+		if _, err := src.ReadAt(page, pageNo*BLKSIZE); err != nil {
+			return "", fmt.Errorf("resealToast: page %d: %v", pageNo, err)
+		}
+		copy(out, page)
+		if next, data, err := from.decodePage(page, pageNo); err == nil {
+			if err := to.encodePage(out, pageNo, next, data); err != nil {
+				return "", fmt.Errorf("resealToast: page %d: %v", pageNo, err)
+			}
+		}
+		if _, err := dst.WriteAt(out, pageNo*BLKSIZE); err != nil {
+			return "", fmt.Errorf("resealToast: page %d: %v", pageNo, err)
+		}
+	}
+	if err := dst.Sync(); err != nil {
+		return "", fmt.Errorf("resealToast: %v", err)
+	}
+	return tmp, nil
+}
+
+func (s *toastStore) Close() error {
+	return s.file.Close()
+}
+
+/* tableToast reads the out of line values of a table, opening its toast file on first use */
+type tableToast struct {
+	files *fileMgr // Nil for blocks that are not pooled
+	tblId dsk.Tbl_t
+}
+
+func (t tableToast) Open(pointer []byte) (io.Reader, error) {
+	if t.files == nil {
+		return nil, fmt.Errorf("tableToast: block of table %d is not pooled", t.tblId)
+	}
+	dataPath, ok := t.files.path(t.tblId)
+	if !ok {
+		return nil, fmt.Errorf("tableToast: table %d has no data file", t.tblId)
+	}
+	store, err := t.files.toast(t.tblId, dataPath)
+	if err != nil {
+		return nil, err
+	}
+	return store.Open(pointer)
+}
+
+/*
+toastValues encodes the values of a new record. STRING values over a quarter of a block are moved
+to overflow pages, and then the largest remaining ones until the record fits an empty block.
+*/
+func (tbl *Table) toastValues(cols []column.Column, fieldVals [][]byte) ([][]byte, error) {
+	values := make([][]byte, len(fieldVals))
+	copy(values, fieldVals)
+	isString := func(i int) bool { return i < len(cols) && cols[i].Type == column.STRING }
+
+	var store *toastStore
+	moveOut := func(i int) error {
+		if store == nil {
+			s, err := tbl.buf.files.toast(tbl.tblID, tbl.info.Location)
+			if err != nil {
+				return err
+			}
+			store = s
+		}
+		pointer, err := store.Write(fieldVals[i])
+		if err != nil {
+			return err
+		}
+		values[i] = row.ToastPointer(pointer)
+		return nil
+	}
+
+	for i := range values {
+		if !isString(i) {
+			continue
+		}
+		if len(values[i]) > TOAST_THRESHOLD*tbl.blockSize()/BLKSIZE {
+			if err := moveOut(i); err != nil {
+				return nil, fmt.Errorf("toastValues: %v", err)
+			}
+			continue
+		}
+		values[i] = row.EncodeValue(values[i])
+	}
+
+	empty, _ := NewSizedBlock(nil, 0, tbl.tblID, tbl.blockSize())
+	for {
+		record, err := row.NewVarLengthRecord(cols, values)
+		if err != nil {
+			return nil, fmt.Errorf("toastValues: %v", err)
+		}
+		if empty.hasRoom(record.RecordSize()) {
+			return values, nil
+		}
+		largest := -1
+		for i := range values {
+			if isString(i) && !row.IsToastPointer(values[i]) && (largest < 0 || len(values[i]) > len(values[largest])) {
+				largest = i
+			}
+		}
+		if largest < 0 || len(values[largest]) == 0 {
+			// Nothing left to move out; AddRecord reports the record as too large
+			return values, nil
+		}
+		if err := moveOut(largest); err != nil {
+			return nil, fmt.Errorf("toastValues: %v", err)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package db
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/misachi/DarDB/column"
+	st "github.com/misachi/DarDB/storage"
+	"github.com/misachi/DarDB/storage/db/row"
+)
+
+func TestToastLongValues(t *testing.T) {
+	fsys := st.NewMemFS()
+	cols := map[string]column.SUPPORTED_TYPE{"id": column.INT, "name": column.STRING}
+	pkey := column.Column{Name: "id", Type: column.INT}
+
+	cfg := newTestConfig(t, fsys)
+	db := NewDB("toastDB", cfg)
+	tbl, err := db.CreateTable("table1", cols, pkey)
+	if err != nil {
+		t.Fatalf("CreateTable error: %v", err)
+	}
+	long := make([]byte, 100*1024)
+	for i := range long {
+		long[i] = byte('a' + i%26)
+	}
+	values := map[string][]byte{
+		"1": long,
+		"2": {row.ToastMarker, 'T', '0', ',', '1'}, // Looks like a pointer but is stored inline
+		"3": []byte("short"),
+	}
+	ctx := GetClientContextMgr(cfg).NewClientCtx(cfg, db)
+	for id, name := range values {
+		if err := db.AddRecord(ctx, tbl, map[string][]byte{"id": []byte(id), "name": name}); err != nil {
+			t.Fatalf("AddRecord error: %v", err)
+		}
+	}
+	if err := ctx.Commit(); err != nil {
+		t.Fatalf("Commit error: %v", err)
+	}
+	ctx.Close()
+	if err := GetBufMgr(cfg).FlushAll(); err != nil {
+		t.Fatalf("FlushAll error: %v", err)
+	}
+	if data, err := st.ReadFile(fsys, toastPath(tbl.info.Location)); err != nil || len(data) < len(long) {
+		t.Fatalf("AddRecord error: expected the long value in the toast file (%v)", err)
+	}
+
+	// Values are read back after a restart
+	closeEngine(cfg)
+	cfg = newTestConfig(t, fsys)
+	db = NewDB("toastDB", cfg)
+	tbl, err = db.CreateTable("table1", cols, pkey)
+	if err != nil {
+		t.Fatalf("CreateTable error: %v", err)
+	}
+	ctx = GetClientContextMgr(cfg).NewClientCtx(cfg, db)
+	defer ctx.Close()
+	colData := row.NewColumnData_(tbl.info.Column)
+	for id, name := range values {
+		recs, err := tbl.GetRecord(ctx, "id", []byte(id))
+		if err != nil || len(recs) != 1 {
+			t.Fatalf("GetRecord error: expected record %s but got %d (%v)", id, len(recs), err)
+		}
+		if got := recs[0].GetField(colData, "name"); !bytes.Equal(got, name) {
+			t.Errorf("GetField error: record %s expected %d bytes but got %d", id, len(name), len(got))
+		}
+	}
+
+	recs, _ := tbl.GetRecord(ctx, "id", []byte("1"))
+	r, err := recs[0].(*row.VarLengthRecord).OpenField(colData, "name")
+	if err != nil {
+		t.Fatalf("OpenField error: %v", err)
+	}
+	got := make([]byte, 0, len(long))
+	chunk := make([]byte, 100)
+	for {
+		n, err := r.Read(chunk)
+		got = append(got, chunk[:n]...)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Read error: %v", err)
+		}
+	}
+	if !bytes.Equal(got, long) {
+		t.Errorf("OpenField error: expected the long value but got %d bytes", len(got))
+	}
+}
@@ -10,8 +10,6 @@ import (
 
 // type txn_t st.Txn_t
 
-var TxnMgr *TransactionManager
-
 const (
 	PENDING = iota
 	STARTED
@@ -28,31 +26,27 @@ type TransactionManager struct {
 }
 
 func NewTxnManager() *TransactionManager {
-	if TxnMgr == nil {
-		// var txnID st.Txn_t
-		// var commitID st.Txn_t
-		// catalog := _Catalog
-		// if catalog != nil {
-		// 	if _, ok := catalog.db["catalog"]; ok {
-		// 		newTxnID := catalog.maxTxnID.Add(1)
-		// 		catalog.SetMaxTxnId(st.Txn_t(newTxnID))
-		// 		txnID = catalog.MaxTxnId()
-
-		// 		newCommitID := catalog.maxCommitID.Add(1)
-		// 		catalog.SetMaxCommitId(st.Txn_t(newCommitID))
-		// 		commitID = catalog.MaxCommitId()
-		// 	}
-		// }
-		TxnMgr = &TransactionManager{
-			ActiveTransactions: make([]*Transaction, 0),
-			DeleteTransactions: make([]*Transaction, 0),
-			txnMgrMtx:          &sync.Mutex{},
-			// maxTxnID:           txnID,
-			// maxCommitId:        commitID,
+	// var txnID st.Txn_t
+	// var commitID st.Txn_t
+	// catalog := _Catalog
+	// if catalog != nil {
+	// 	if _, ok := catalog.db["catalog"]; ok {
+	// 		newTxnID := catalog.maxTxnID.Add(1)
+	// 		catalog.SetMaxTxnId(st.Txn_t(newTxnID))
+	// 		txnID = catalog.MaxTxnId()
+
+	// 		newCommitID := catalog.maxCommitID.Add(1)
+	// 		catalog.SetMaxCommitId(st.Txn_t(newCommitID))
+	// 		commitID = catalog.MaxCommitId()
+	// 	}
+	// }
+	return &TransactionManager{
+		ActiveTransactions: make([]*Transaction, 0),
+		DeleteTransactions: make([]*Transaction, 0),
+		txnMgrMtx:          &sync.Mutex{},
+		// maxTxnID:           txnID,
+		// maxCommitId:        commitID,
 		}
-		return TxnMgr
-	}
-	return TxnMgr
 }
 
 // func (tM TransactionManager) MaxCommitID() st.Txn_t {
@@ -64,6 +58,8 @@ func NewTxnManager() *TransactionManager {
 // }
 
 func (tM *TransactionManager) EndTransaction(transaction *Transaction) {
+	tM.txnMgrMtx.Lock()
+	defer tM.txnMgrMtx.Unlock()
 	for idx, txn := range tM.ActiveTransactions {
 		if txn.transactionId == transaction.transactionId {
 			tM.ActiveTransactions = append(tM.ActiveTransactions[:idx], tM.ActiveTransactions[idx+1:]...)
@@ -75,7 +71,7 @@ func (tM *TransactionManager) EndTransaction(transaction *Transaction) {
 
 func (t *TransactionManager) StartTransaction(ctx * ClientContext) (*Transaction, error) {
 	newTxn := NewTransaction(ctx)
-	catalog := GetCatalog(ctx.config)
+	catalog := ctx.engine.catalog
 	// newTxn.commitId++
 	// if newTxn.commitId <= 0 {
 	// 	newTxn.transactionId = t.maxTxnID
@@ -104,14 +100,56 @@ func (t *TransactionManager) StartTransaction(ctx * ClientContext) (*Transaction
 	return txn, nil
 }
 
-func (t *TransactionManager) Commit(txn *Transaction) {}
+/* inUse reports whether a running transaction other than except read or changed the block */
+func (t *TransactionManager) inUse(key pageKey, except *Transaction) bool {
+	t.txnMgrMtx.Lock()
+	defer t.txnMgrMtx.Unlock()
+	for _, txn := range t.ActiveTransactions {
+		if txn != except && txn.pages[key] {
+			return true
+		}
+	}
+	return false
+}
+
+/* tableInUse reports whether a running transaction other than except read or changed a block of the table */
+func (t *TransactionManager) tableInUse(tblID st.Tbl_t, except *Transaction) bool {
+	t.txnMgrMtx.Lock()
+	defer t.txnMgrMtx.Unlock()
+	for _, txn := range t.ActiveTransactions {
+		if txn == except {
+			continue
+		}
+		for key := range txn.pages {
+			if key.tbl == tblID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (t *TransactionManager) Commit(txn *Transaction) error {
+	if err := txn.commit(); err != nil {
+		return fmt.Errorf("Commit: %v", err)
+	}
+	t.EndTransaction(txn)
+	return nil
+}
 
-func (t *TransactionManager) Rollback(txn *Transaction) {}
+func (t *TransactionManager) Rollback(txn *Transaction) error {
+	if err := txn.rollback(); err != nil {
+		return fmt.Errorf("Rollback: %v", err)
+	}
+	t.EndTransaction(txn)
+	return nil
+}
 
 type transactionRecord struct {
 	location row.LocationPair
 	blockID  st.Blk_t
 	tblID    st.Tbl_t
+	slot     int
 }
 
 type Transaction struct {
@@ -121,6 +159,12 @@ type Transaction struct {
 	commitId      st.Txn_t
 	ctx           *ClientContext
 	dataList      []transactionRecord
+	firstLSN      wal_t    // First change logged by the transaction
+	lastLSN       wal_t    // Last change logged by the transaction
+	undoLog       []*Entry // Changes to revert on rollback, oldest first
+	pages         map[pageKey]bool // Blocks the transaction read or changed, guarded by the manager's txnMgrMtx
+	written       []rowKey         // Records the transaction holds write locks on, see rowLocks
+	indexed       []indexChange    // Index entries the transaction added or removed, oldest first
 }
 
 func NewTransaction(ctx *ClientContext) *Transaction {
@@ -160,22 +204,28 @@ func (t *Transaction) startTransaction(cID, tID st.Txn_t) (*Transaction, error)
 }
 
 func (t *Transaction) unlockAll() error {
-	_bufMgr := GetBufMgr()
+	_bufMgr := t.ctx.engine.buf
 	if _bufMgr == nil {
 		return fmt.Errorf("unlockAll: Unable to get buffer manager")
 	}
 
 	for _, lockedRecord := range t.dataList {
-		path := fmt.Sprintf("%s/%s/%d", t.ctx.config.DataPath(), t.ctx.database.name, lockedRecord.tblID)
-		blk, err := _bufMgr.GetBlock(path, lockedRecord.tblID, lockedRecord.blockID)
+		path, ok := _bufMgr.files.path(lockedRecord.tblID)
+		if !ok {
+			path = fmt.Sprintf("%s/%s/%d", t.ctx.config.DataPath(), t.ctx.database.name, lockedRecord.tblID)
+		}
+		guard, err := _bufMgr.FetchBlock(path, lockedRecord.tblID, lockedRecord.blockID)
 		if err != nil {
-			return fmt.Errorf("unlockAll: GetBlock error: %v", err)
+			return fmt.Errorf("unlockAll: FetchBlock error: %v", err)
 		}
-		for idx, loc := range blk.recLocation {
-			if loc.Offset() == lockedRecord.location.Offset() && loc.Size() == lockedRecord.location.Size() {
-				blk.recLocation[idx].lockField.ReleaseLock()
-			}
+		blk := guard.Block()
+		// Records after one that changed size have moved, so the lock is found by slot rather than location
+		blk.mut.RLock()
+		if lockedRecord.slot >= 0 && lockedRecord.slot < len(blk.recLocation) {
+			blk.recLocation[lockedRecord.slot].lockField.ReleaseLock()
 		}
+		blk.mut.RUnlock()
+		guard.Close()
 	}
 	return nil
 }
@@ -185,9 +235,65 @@ func (t *Transaction) transactionAbort() {
 	t.rollback()
 }
 
+/* touch records that the transaction used a block, so vacuum leaves the block alone until the transaction ends */
+func (t *Transaction) touch(tblID st.Tbl_t, blockID st.Blk_t) {
+	txnMgr := t.ctx.txnMgr
+	txnMgr.txnMgrMtx.Lock()
+	defer txnMgr.txnMgrMtx.Unlock()
+	if t.pages == nil {
+		t.pages = make(map[pageKey]bool)
+	}
+	t.pages[newPageKey(tblID, blockID)] = true
+}
+
+/* logChange logs a change the transaction made to blk. Callers hold buf.ckptLock shared and the block pinned */
+func (t *Transaction) logChange(state WALSTATE_t, tag *ETag, blk *Block, slot int, oldVal, newVal []byte) (wal_t, error) {
+	entry := NewEntry(t.transactionId)
+	entry.state = state
+	entry.slot = uint32(slot)
+	entry.InsertVal(oldVal, newVal, tag)
+	entry.image = t.ctx.engine.buf.fullPageImage(blk)
+	t.touch(tag.tblID, tag.blockID)
+	lsn, err := t.ctx.engine.wal.Append(entry)
+	if err != nil {
+		return 0, fmt.Errorf("logChange: %v", err)
+	}
+	entry.image = nil
+	if t.firstLSN == 0 {
+		t.firstLSN = lsn
+	}
+	t.lastLSN = lsn
+	t.undoLog = append(t.undoLog, entry)
+	return lsn, nil
+}
+
+/* logEnd logs the outcome of a transaction that changed anything and waits for it to reach disk */
+func (t *Transaction) logEnd(state WALSTATE_t) error {
+	if t.lastLSN == 0 {
+		return nil
+	}
+	wal := t.ctx.engine.wal
+	entry := NewEntry(t.transactionId)
+	entry.state = state
+	lsn, err := wal.Append(entry)
+	if err != nil {
+		return err
+	}
+	t.lastLSN = lsn
+	return wal.Flush(lsn)
+}
+
 func (t *Transaction) commit() error {
-	// TODO: Write to WAL
+	if err := t.logEnd(WAL_COMMITTED); err != nil {
+		return fmt.Errorf("commit error: %v", err)
+	}
 	t.state = COMMITTED
+	if len(t.undoLog) > 0 {
+		t.ctx.engine.catalog.addRows(rowDeltas(t.undoLog))
+	}
+	t.undoLog = nil
+	t.settleIndexes(true)
+	t.ctx.engine.rows.release(t)
 	if err := t.unlockAll(); err != nil {
 		return fmt.Errorf("commit error: %v", err)
 	}
@@ -196,14 +302,42 @@ func (t *Transaction) commit() error {
 
 func (t *Transaction) rollback() error {
 	t.state = ABORTED
+	if err := t.undoAll(); err != nil {
+		return fmt.Errorf("rollback error: %v", err)
+	}
+	// The records are as they were before the transaction wrote them
+	t.settleIndexes(false)
+	t.ctx.engine.rows.release(t)
+	if err := t.logEnd(WAL_ABORTED); err != nil {
+		return fmt.Errorf("rollback error: %v", err)
+	}
 	if err := t.unlockAll(); err != nil {
 		return fmt.Errorf("rollback error: %v", err)
 	}
 	return nil
 }
 
-func (t *Transaction) TxnReadRecord(tblID st.Tbl_t, blockID st.Blk_t, loc row.LocationPair) error {
-	t.dataList = append(t.dataList, transactionRecord{blockID: blockID, location: loc, tblID: tblID})
+/* undoAll reverts the changes of the transaction, newest first */
+func (t *Transaction) undoAll() error {
+	if len(t.undoLog) == 0 {
+		return nil
+	}
+	wal := t.ctx.engine.wal
+	buf := t.ctx.engine.buf
+	buf.ckptLock.RLock()
+	defer buf.ckptLock.RUnlock()
+	for len(t.undoLog) > 0 {
+		entry := t.undoLog[len(t.undoLog)-1]
+		if err := undoEntry(wal, buf, entry); err != nil {
+			return err
+		}
+		t.undoLog = t.undoLog[:len(t.undoLog)-1]
+	}
+	return nil
+}
+
+func (t *Transaction) TxnReadRecord(tblID st.Tbl_t, blockID st.Blk_t, slot int, loc row.LocationPair) error {
+	t.dataList = append(t.dataList, transactionRecord{blockID: blockID, location: loc, tblID: tblID, slot: slot})
 	return nil
 }
 
@@ -214,7 +348,7 @@ func (t *Transaction) TxnReadRecord(tblID st.Tbl_t, blockID st.Blk_t, loc row.Lo
 // 	return nil
 // }
 
-func (t *Transaction) TxnWriteRecord(tblID st.Tbl_t, blockID st.Blk_t, loc row.LocationPair) error {
-	t.dataList = append(t.dataList, transactionRecord{blockID: blockID, location: loc, tblID: tblID})
+func (t *Transaction) TxnWriteRecord(tblID st.Tbl_t, blockID st.Blk_t, slot int, loc row.LocationPair) error {
+	t.dataList = append(t.dataList, transactionRecord{blockID: blockID, location: loc, tblID: tblID, slot: slot})
 	return nil
 }
@@ -0,0 +1,542 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"time"
+
+	st "github.com/misachi/DarDB/storage"
+	"github.com/misachi/DarDB/storage/db/row"
+)
+
+/*
+Vacuum gives back the space that deleted and moved records leave in the blocks of a table:
+
+  - the slots of deleted records are dropped, renumbering the slots after them, and logged as
+    WAL_VACUUM with a full page image of the block
+  - the records of sparse blocks are moved to the first earlier block with room, last block first.
+    A move is a logged insert and delete of a transaction of the vacuum, so a crash undoes a move
+    that did not commit. The slots they leave are dropped again
+  - the empty blocks at the end of the table are dropped from the buffer pool, the free space map
+    and the data file, logged as WAL_TRUNCATE before the file is cut. A compressed data file keeps
+    its size and reuses the extents of the dropped blocks
+
+A block is only changed while vacuum holds the only pin on it and no running transaction has read
+or changed it, so a scan never sees a record twice or misses it, and a rollback finds its records
+in the slots it left them in. Blocks in use are left for the next vacuum. The indexes of the table
+follow the records that are moved and renumbered. The overflow chains of deleted and updated
+values stay in the toast file, which vacuum does not shrink.
+*/
+const (
+	VACUUM_SPARSE_FILL   = 0.5         // Blocks filled less than this are emptied into earlier blocks
+	AUTOVACUUM_DELAY     = time.Minute // Default pause between autovacuum rounds
+	AUTOVACUUM_THRESHOLD = 0.2         // Default share of free space that gets a table vacuumed
+)
+
+var errBlockBusy = errors.New("block is in use")
+
+/* VacuumStats reports what a vacuum did */
+type VacuumStats struct {
+	RecordsMoved    int // Records moved out of sparse blocks
+	SlotsReclaimed  int // Slots of deleted records dropped
+	BlocksTruncated int // Empty blocks cut from the end of the table
+	BlocksSkipped   int // Blocks left alone because they were pinned or used by a running transaction
+}
+
+type vacuum struct {
+	tbl     *Table
+	ctx     *ClientContext // Runs the transactions that move records
+	buf     *BufferPoolMgr
+	wal     *WalMgr
+	skipped map[pageKey]bool
+	indexes []*Index
+}
+
+/* Vacuum compacts the blocks of tbl and truncates the empty ones at its end. Readers and writers may use the table meanwhile */
+func (db *DB) Vacuum(tbl *Table) (VacuumStats, error) {
+	db.engine.vacuumMtx.Lock()
+	defer db.engine.vacuumMtx.Unlock()
+	ctx, err := NewClientContext(0, db.config, db)
+	if err != nil {
+		return VacuumStats{}, fmt.Errorf("Vacuum: %v", err)
+	}
+	defer ctx.Close()
+	indexes, err := tbl.lockIndexes()
+	if err != nil {
+		return VacuumStats{}, fmt.Errorf("Vacuum: %v", err)
+	}
+	defer tbl.entry.idxMtx.RUnlock()
+
+	v := &vacuum{tbl: tbl, ctx: ctx, buf: db.engine.buf, wal: db.engine.wal, skipped: make(map[pageKey]bool), indexes: indexes}
+	var stats VacuumStats
+	// Compacting first shows which blocks are sparse; compacting again drops the slots the moves left
+	if err := v.compact(&stats); err != nil {
+		return stats, fmt.Errorf("Vacuum: %s: %v", tbl.info.Name, err)
+	}
+	if err := v.merge(&stats); err != nil {
+		return stats, fmt.Errorf("Vacuum: %s: %v", tbl.info.Name, err)
+	}
+	if err := v.compact(&stats); err != nil {
+		return stats, fmt.Errorf("Vacuum: %s: %v", tbl.info.Name, err)
+	}
+	if err := v.truncate(&stats); err != nil {
+		return stats, fmt.Errorf("Vacuum: %s: %v", tbl.info.Name, err)
+	}
+	stats.BlocksSkipped = len(v.skipped)
+	if err := tbl.saveInfo(); err != nil {
+		return stats, fmt.Errorf("Vacuum: %v", err)
+	}
+	return stats, nil
+}
+
+/*
+lockIdle locks the shards of blocks the vacuum holds the only pins on, in shard order, and returns
+the function that unlocks them. Callers hold buf.ckptLock shared. It returns nil, with nothing locked,
+if another caller pins one of the blocks or a running transaction used one.
+*/
+func (v *vacuum) lockIdle(blks ...*Block) func() {
+	shards := make([]int, 0, len(blks))
+	for _, blk := range blks {
+		shards = append(shards, int(newPageKey(blk.tblId, blk.blockId).shard()))
+	}
+	sort.Ints(shards)
+	locked := make([]*pageTableShard, 0, len(shards))
+	unlock := func() {
+		for _, shard := range locked {
+			shard.mtx.Unlock()
+		}
+	}
+	for i, idx := range shards {
+		if i > 0 && shards[i-1] == idx {
+			continue
+		}
+		shard := &v.buf.pages.shards[idx]
+		shard.mtx.Lock()
+		locked = append(locked, shard)
+	}
+
+	txnMgr := v.ctx.txnMgr
+	for _, blk := range blks {
+		key := newPageKey(blk.tblId, blk.blockId)
+		if blk.pinCount != 1 || txnMgr.inUse(key, v.ctx.CurrentTxn()) {
+			v.skipped[key] = true
+			unlock()
+			return nil
+		}
+	}
+	return unlock
+}
+
+/* merge empties sparse blocks into earlier blocks with room, last block first. The moves out of each block are committed together */
+func (v *vacuum) merge(stats *VacuumStats) error {
+	n, err := v.buf.TableBlocks(v.tbl.info.Location, v.tbl.tblID)
+	if err != nil {
+		return fmt.Errorf("merge: %v", err)
+	}
+	for blockId := n - 1; blockId > 0; blockId-- {
+		if err := v.mergeBlock(st.Blk_t(blockId), stats); err != nil {
+			return fmt.Errorf("merge: %v", err)
+		}
+		if err := v.ctx.Commit(); err != nil {
+			return fmt.Errorf("merge: %v", err)
+		}
+	}
+	return nil
+}
+
+func (v *vacuum) mergeBlock(blockId st.Blk_t, stats *VacuumStats) error {
+	guard, err := v.buf.FetchBlock(v.tbl.info.Location, v.tbl.tblID, blockId)
+	if errors.Is(err, ErrBlockNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer guard.Close()
+	for slot := 0; ; slot++ {
+		more, err := v.moveRecord(guard, slot, stats)
+		if err != nil || !more {
+			return err
+		}
+	}
+}
+
+/* moveRecord moves the record in slot of a sparse block to an earlier block. It returns false once nothing more can be moved out of the block */
+func (v *vacuum) moveRecord(src *BlockGuard, slot int, stats *VacuumStats) (bool, error) {
+	v.buf.ckptLock.RLock()
+	defer v.buf.ckptLock.RUnlock()
+	blk := src.Block()
+	fsm, err := v.buf.files.fsm(v.tbl.tblID, v.tbl.info.Location)
+	if err != nil {
+		return false, err
+	}
+
+	for {
+		unlock := v.lockIdle(blk)
+		if unlock == nil {
+			return false, nil
+		}
+		if slot >= len(blk.recLocation) || float64(blk.pageSize()) >= VACUUM_SPARSE_FILL*float64(blk.blockSize()) {
+			unlock()
+			return false, nil
+		}
+		if blk.isDeleted(slot) {
+			unlock()
+			return true, nil
+		}
+		data, err := blk.recordBytes(slot)
+		unlock()
+		if err != nil {
+			return false, err
+		}
+
+		target, ok := fsm.Search(recordSpace(len(data), blk.blockSize()))
+		if !ok || target >= blk.blockId {
+			return false, nil
+		}
+		dst, err := v.buf.fetchOrCreate(v.tbl.info.Location, v.tbl.tblID, target)
+		if err != nil {
+			return false, err
+		}
+		err = v.move(src, dst, slot, data)
+		dst.Close()
+		if errors.Is(err, ErrBlockFull) {
+			// The map was stale; move corrected it
+			continue
+		}
+		if err == errBlockBusy {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		stats.RecordsMoved++
+		return true, nil
+	}
+}
+
+/* move inserts data, the record in slot of src, into dst and deletes it from src */
+func (v *vacuum) move(src, dst *BlockGuard, slot int, data []byte) error {
+	from, to := src.Block(), dst.Block()
+	unlock := v.lockIdle(from, to)
+	if unlock == nil {
+		return errBlockBusy
+	}
+	defer unlock()
+	current, err := from.recordBytes(slot)
+	if err != nil || from.isDeleted(slot) || string(current) != string(data) {
+		// Changed by a transaction that ended since the record was read
+		return errBlockBusy
+	}
+	moved, err := v.layout(from, to, data)
+	if err != nil {
+		return err
+	}
+	if !to.hasRoom(len(moved)) {
+		v.buf.recordFree(to)
+		return ErrBlockFull
+	}
+
+	txn := v.ctx.CurrentTxn()
+	dbID := v.ctx.database.dbID
+	toSlot := len(to.recLocation)
+	if err := to.insertRecordAt(toSlot, moved); err != nil {
+		return err
+	}
+	// Neither block is in use, so no other transaction holds the lock of either record
+	v.ctx.engine.rows.claim(txn, to.tblId, RecordID{Block: to.blockId, Slot: toSlot})
+	v.ctx.engine.rows.claim(txn, from.tblId, RecordID{Block: from.blockId, Slot: slot})
+	lsn, err := txn.logChange(WAL_INSERT, NewETag(dbID, to.tblId, to.blockId), to, toSlot, nil, moved)
+	if err != nil {
+		to.replaceRecord(toSlot, nil)
+		return err
+	}
+	to.markModified(lsn)
+	dst.MarkDirty()
+
+	if err := from.replaceRecord(slot, nil); err != nil {
+		return err
+	}
+	lsn, err = txn.logChange(WAL_DELETE, NewETag(dbID, from.tblId, from.blockId), from, slot, data, nil)
+	if err != nil {
+		// The insert is logged; rolling the transaction back removes it
+		from.replaceRecord(slot, data)
+		return err
+	}
+	from.markModified(lsn)
+	src.MarkDirty()
+	for _, idx := range v.indexes {
+		idx.move(txn, RecordID{Block: from.blockId, Slot: slot}, RecordID{Block: to.blockId, Slot: toSlot})
+	}
+	return nil
+}
+
+/* layout converts data, a record of from, to the layout of the records of to */
+func (v *vacuum) layout(from, to *Block, data []byte) ([]byte, error) {
+	switch {
+	case to.legacy:
+		return row.LegacyLayout(data)
+	case from.legacy:
+		return row.CurrentLayout(data, row.NewColumnData_(v.tbl.info.Column))
+	}
+	return data, nil
+}
+
+/* compact drops the slots of deleted records from every block */
+func (v *vacuum) compact(stats *VacuumStats) error {
+	n, err := v.buf.TableBlocks(v.tbl.info.Location, v.tbl.tblID)
+	if err != nil {
+		return fmt.Errorf("compact: %v", err)
+	}
+	for blockId := 0; blockId < n; blockId++ {
+		dropped, err := v.compactBlock(st.Blk_t(blockId))
+		if err != nil {
+			return fmt.Errorf("compact: %v", err)
+		}
+		stats.SlotsReclaimed += dropped
+	}
+	return nil
+}
+
+func (v *vacuum) compactBlock(blockId st.Blk_t) (int, error) {
+	guard, err := v.buf.FetchBlock(v.tbl.info.Location, v.tbl.tblID, blockId)
+	if errors.Is(err, ErrBlockNotFound) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer guard.Close()
+	blk := guard.Block()
+
+	v.buf.ckptLock.RLock()
+	defer v.buf.ckptLock.RUnlock()
+	unlock := v.lockIdle(blk)
+	if unlock == nil {
+		return 0, nil
+	}
+	defer unlock()
+	if blk.liveRecords() == len(blk.recLocation) {
+		return 0, nil
+	}
+
+	locations, records := blk.recLocation, blk.records
+	slots := make(map[int]int, len(locations))
+	for slot := range locations {
+		if !blk.isDeleted(slot) {
+			slots[slot] = len(slots)
+		}
+	}
+	dropped := blk.compact()
+	entry := NewEntry(0)
+	entry.state = WAL_VACUUM
+	entry.tag = NewETag(v.ctx.database.dbID, blk.tblId, blk.blockId)
+	entry.image = encodePage(blk)
+	lsn, err := v.wal.Append(entry)
+	if err != nil {
+		blk.recLocation, blk.records = locations, records
+		return 0, err
+	}
+	blk.markModified(lsn)
+	guard.MarkDirty()
+	for _, idx := range v.indexes {
+		idx.renumber(blk.blockId, slots)
+	}
+	return dropped, nil
+}
+
+/*
+truncate drops the empty blocks at the end of the table. The shards of the blocks stay locked until
+the data file is cut, so nobody pins one of them meanwhile, and flushMtx keeps flushes from writing
+them. A block pinned again afterwards is empty and is added back to the table when it is used.
+*/
+func (v *vacuum) truncate(stats *VacuumStats) error {
+	loc, tblId := v.tbl.info.Location, v.tbl.tblID
+	fsm, err := v.buf.files.fsm(tblId, loc)
+	if err != nil {
+		return fmt.Errorf("truncate: %v", err)
+	}
+	store, err := v.buf.files.store(loc)
+	if err != nil {
+		return fmt.Errorf("truncate: %v", err)
+	}
+
+	v.buf.flushMtx.Lock()
+	defer v.buf.flushMtx.Unlock()
+	locked := make(map[*pageTableShard]bool)
+	defer func() {
+		for shard := range locked {
+			shard.mtx.Unlock()
+		}
+	}()
+
+	n := fsm.NumBlocks()
+	keep := n
+	for keep > 0 {
+		key := newPageKey(tblId, st.Blk_t(keep-1))
+		shard := &v.buf.pages.shards[key.shard()]
+		if !locked[shard] {
+			shard.mtx.Lock()
+			locked[shard] = true
+		}
+		if !v.droppable(store, shard, key) {
+			break
+		}
+		keep--
+	}
+	if keep == n {
+		return nil
+	}
+
+	// The file is only cut once the truncation is durable, so recovery never redoes a change on a block that is gone
+	entry := NewEntry(0)
+	entry.state = WAL_TRUNCATE
+	entry.tag = NewETag(v.ctx.database.dbID, tblId, st.Blk_t(keep))
+	lsn, err := v.wal.Append(entry)
+	if err != nil {
+		return fmt.Errorf("truncate: %v", err)
+	}
+	if err := v.wal.Flush(lsn); err != nil {
+		return fmt.Errorf("truncate: %v", err)
+	}
+	for blockId := keep; blockId < n; blockId++ {
+		key := newPageKey(tblId, st.Blk_t(blockId))
+		shard := &v.buf.pages.shards[key.shard()]
+		if _, ok := shard.frames[key]; ok {
+			delete(shard.frames, key)
+			v.buf.blkCount.Add(-1)
+		}
+	}
+	if err := v.buf.cutTable(loc, tblId, st.Blk_t(keep)); err != nil {
+		return fmt.Errorf("truncate: %v", err)
+	}
+	stats.BlocksTruncated = n - keep
+	return nil
+}
+
+/* droppable reports whether the block of key holds no records and nobody uses it. Callers hold the shard of key */
+func (v *vacuum) droppable(store pageStore, shard *pageTableShard, key pageKey) bool {
+	if blk := shard.frames[key]; blk != nil {
+		if blk.pinCount > 0 || blk.liveRecords() > 0 {
+			return false
+		}
+	} else {
+		page, err := store.readPage(key.blk)
+		if err != nil && err != ErrBlockNotFound {
+			return false
+		}
+		if err == nil {
+			blk, err := decodePage(page, key.blk, key.tbl, store.blockSize())
+			if err != nil || blk.liveRecords() > 0 {
+				return false
+			}
+		}
+	}
+	if v.ctx.txnMgr.inUse(key, v.ctx.CurrentTxn()) {
+		v.skipped[key] = true
+		return false
+	}
+	return true
+}
+
+/* freeShare is the share of free space in the blocks of the table before the last one, which is still being filled */
+func (tbl *Table) freeShare() (float64, error) {
+	buf := tbl.buf
+	buf.files.registerPath(tbl.tblID, tbl.info.Location)
+	fsm, err := buf.files.fsm(tbl.tblID, tbl.info.Location)
+	if err != nil {
+		return 0, fmt.Errorf("freeShare: %v", err)
+	}
+	n := fsm.NumBlocks() - 1
+	if n <= 0 {
+		return 0, nil
+	}
+	free := 0
+	for blockId := 0; blockId < n; blockId++ {
+		free += fsm.Free(st.Blk_t(blockId))
+	}
+	return float64(free) / float64(n*tbl.blockSize()), nil
+}
+
+/* Autovacuum vacuums the tables of a database whose free space passes a threshold */
+type Autovacuum struct {
+	db        *DB
+	delay     time.Duration
+	threshold float64
+	stop      chan struct{}
+	done      chan struct{}
+}
+
+func NewAutovacuum(db *DB, delay time.Duration, threshold float64) *Autovacuum {
+	if delay <= 0 {
+		delay = AUTOVACUUM_DELAY
+	}
+	if threshold <= 0 {
+		threshold = AUTOVACUUM_THRESHOLD
+	}
+	return &Autovacuum{db: db, delay: delay, threshold: threshold}
+}
+
+/* StartAutovacuum starts vacuuming the tables of the database in the background, as often as the config says */
+func (db *DB) StartAutovacuum() *Autovacuum {
+	av := NewAutovacuum(db, db.config.AutovacuumDelay(), db.config.AutovacuumThreshold())
+	av.Start()
+	return av
+}
+
+func (av *Autovacuum) Start() {
+	av.stop = make(chan struct{})
+	av.done = make(chan struct{})
+	go func() {
+		defer close(av.done)
+		ticker := time.NewTicker(av.delay)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-av.stop:
+				return
+			case <-ticker.C:
+				if _, err := av.Round(); err != nil {
+					slog.Warn("Autovacuum: round failed", "err", err)
+				}
+			}
+		}
+	}()
+}
+
+/* Round vacuums every table over the threshold and returns how many it vacuumed */
+func (av *Autovacuum) Round() (int, error) {
+	av.db.mut.RLock()
+	tables := make([]*Table, 0, len(av.db.table))
+	for _, tbl := range av.db.table {
+		tables = append(tables, tbl)
+	}
+	av.db.mut.RUnlock()
+
+	vacuumed := 0
+	for _, tbl := range tables {
+		share, err := tbl.freeShare()
+		if err != nil {
+			return vacuumed, fmt.Errorf("Autovacuum: %v", err)
+		}
+		if share < av.threshold {
+			continue
+		}
+		if _, err := av.db.Vacuum(tbl); err != nil {
+			return vacuumed, fmt.Errorf("Autovacuum: %v", err)
+		}
+		vacuumed++
+	}
+	return vacuumed, nil
+}
+
+func (av *Autovacuum) Stop() {
+	if av.stop == nil {
+		return
+	}
+	close(av.stop)
+	<-av.done
+	av.stop = nil
+}
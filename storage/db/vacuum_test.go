@@ -0,0 +1,225 @@
+package db
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/misachi/DarDB/column"
+	st "github.com/misachi/DarDB/storage"
+)
+
+/* vacuumTable fills a table with n rows, commits them, then deletes and commits every row whose key keep rejects */
+func vacuumTable(t *testing.T, opts TableOptions, n int, keep func(int) bool) (*DB, *Table, map[string]string) {
+	fsys := st.NewMemFS()
+	cfg := newTestConfig(t, fsys)
+	db := NewDB("vacuumDB", cfg)
+	cols := map[string]column.SUPPORTED_TYPE{"key": column.INT, "val": column.STRING}
+	tbl, err := db.CreateTableWithOptions("table1", cols, column.Column{Name: "key", Type: column.INT}, opts)
+	if err != nil {
+		t.Fatalf("CreateTable error: %v", err)
+	}
+	ctx := GetClientContextMgr(cfg).NewClientCtx(cfg, db)
+	defer ctx.Close()
+
+	rids := make([]RecordID, n)
+	for i := 0; i < n; i++ {
+		rid, err := crashInsert(ctx, tbl, fmt.Sprintf("%d", i), fmt.Sprintf("v%d%s", i, strings.Repeat("x", 60)))
+		if err != nil {
+			t.Fatalf("insert error: %v", err)
+		}
+		rids[i] = rid
+	}
+	if err := ctx.Commit(); err != nil {
+		t.Fatalf("Commit error: %v", err)
+	}
+	rows := make(map[string]string)
+	for i, rid := range rids {
+		if keep(i) {
+			rows[fmt.Sprintf("%d", i)] = fmt.Sprintf("v%d%s", i, strings.Repeat("x", 60))
+			continue
+		}
+		if err := tbl.DeleteRecord(ctx, rid); err != nil {
+			t.Fatalf("DeleteRecord error: %v", err)
+		}
+	}
+	if err := ctx.Commit(); err != nil {
+		t.Fatalf("Commit error: %v", err)
+	}
+	return db, tbl, rows
+}
+
+func TestVacuum(t *testing.T) {
+	for _, codec := range []Compression{COMPRESSION_NONE, COMPRESSION_LZ} {
+		codec := codec
+		t.Run(fmt.Sprintf("%v", codec), func(t *testing.T) {
+			t.Parallel()
+			db, tbl, rows := vacuumTable(t, TableOptions{Compression: codec}, 400, func(i int) bool { return i%4 == 0 })
+			before, err := GetBufMgr(db.config).TableBlocks(tbl.info.Location, tbl.tblID)
+			if err != nil {
+				t.Fatalf("TableBlocks error: %v", err)
+			}
+
+			stats, err := db.Vacuum(tbl)
+			if err != nil {
+				t.Fatalf("Vacuum error: %v", err)
+			}
+			if stats.RecordsMoved == 0 || stats.SlotsReclaimed == 0 || stats.BlocksTruncated == 0 {
+				t.Errorf("Vacuum error: expected records moved, slots reclaimed and blocks truncated but got %+v", stats)
+			}
+			after, err := GetBufMgr(db.config).TableBlocks(tbl.info.Location, tbl.tblID)
+			if err != nil {
+				t.Fatalf("TableBlocks error: %v", err)
+			}
+			if after != before-stats.BlocksTruncated || after >= before {
+				t.Errorf("Vacuum error: expected %d blocks less than %d but got %d", stats.BlocksTruncated, before, after)
+			}
+
+			ctx := GetClientContextMgr(db.config).NewClientCtx(db.config, db)
+			defer ctx.Close()
+			if got := crashRows(t, ctx, tbl); !sameRows(got, rows) {
+				t.Errorf("Vacuum error: expected rows\n%s\nbut got\n%s", rowsString(rows), rowsString(got))
+			}
+			// The primary key index follows the records that moved or were renumbered
+			for key := range rows {
+				rids := tbl.entry.indexes[0].Lookup([]byte(key))
+				if len(rids) != 1 {
+					t.Fatalf("Lookup error: expected one record for %s but got %v", key, rids)
+				}
+				values, err := tbl.Fetch(ctx, rids[0])
+				if err != nil || string(values[0]) != key {
+					t.Errorf("Lookup error: expected record %v to hold %s but got %q, %v", rids[0], key, values, err)
+				}
+			}
+
+			// A second vacuum finds nothing to do once the reader is done
+			if err := ctx.Commit(); err != nil {
+				t.Fatalf("Commit error: %v", err)
+			}
+			stats, err = db.Vacuum(tbl)
+			if err != nil {
+				t.Fatalf("Vacuum error: %v", err)
+			}
+			if stats != (VacuumStats{}) {
+				t.Errorf("Vacuum error: expected nothing left to do but got %+v", stats)
+			}
+		})
+	}
+}
+
+func TestVacuumRecover(t *testing.T) {
+	db, tbl, rows := vacuumTable(t, TableOptions{}, 300, func(i int) bool { return i%3 == 0 })
+	fsys := db.config.FS()
+	if _, err := db.Vacuum(tbl); err != nil {
+		t.Fatalf("Vacuum error: %v", err)
+	}
+
+	crash(db.config)
+	cfg := newTestConfig(t, fsys)
+	db = NewDB("vacuumDB", cfg)
+	cols := map[string]column.SUPPORTED_TYPE{"key": column.INT, "val": column.STRING}
+	tbl, err := db.CreateTable("table1", cols, column.Column{Name: "key", Type: column.INT})
+	if err != nil {
+		t.Fatalf("CreateTable error: %v", err)
+	}
+	ctx := GetClientContextMgr(cfg).NewClientCtx(cfg, db)
+	defer ctx.Close()
+	if got := crashRows(t, ctx, tbl); !sameRows(got, rows) {
+		t.Errorf("Recover error: expected rows\n%s\nbut got\n%s", rowsString(rows), rowsString(got))
+	}
+}
+
+func TestVacuumSkipsBusyBlocks(t *testing.T) {
+	db, tbl, rows := vacuumTable(t, TableOptions{}, 200, func(i int) bool { return i%2 == 0 })
+
+	// An uncommitted change keeps its block as it is, so a rollback finds the record in its slot
+	ctx := GetClientContextMgr(db.config).NewClientCtx(db.config, db)
+	defer ctx.Close()
+	rid, err := crashInsert(ctx, tbl, "1000", "uncommitted")
+	if err != nil {
+		t.Fatalf("insert error: %v", err)
+	}
+	stats, err := db.Vacuum(tbl)
+	if err != nil {
+		t.Fatalf("Vacuum error: %v", err)
+	}
+	if stats.BlocksSkipped == 0 {
+		t.Errorf("Vacuum error: expected the block of %v to be skipped but got %+v", rid, stats)
+	}
+	if err := ctx.Rollback(); err != nil {
+		t.Fatalf("Rollback error: %v", err)
+	}
+	if got := crashRows(t, ctx, tbl); !sameRows(got, rows) {
+		t.Errorf("Vacuum error: expected rows\n%s\nbut got\n%s", rowsString(rows), rowsString(got))
+	}
+}
+
+func TestVacuumConcurrentReaders(t *testing.T) {
+	db, tbl, rows := vacuumTable(t, TableOptions{}, 400, func(i int) bool { return i%5 == 0 })
+
+	ctxs := make([]*ClientContext, 4)
+	for i := range ctxs {
+		ctxs[i] = GetClientContextMgr(db.config).NewClientCtx(db.config, db)
+	}
+	var wg sync.WaitGroup
+	for _, ctx := range ctxs {
+		wg.Add(1)
+		go func(ctx *ClientContext) {
+			defer wg.Done()
+			defer ctx.Close()
+			for i := 0; i < 5; i++ {
+				if got := crashRows(t, ctx, tbl); !sameRows(got, rows) {
+					t.Errorf("Records error: expected %d rows but got %d", len(rows), len(got))
+				}
+				if err := ctx.Commit(); err != nil {
+					t.Errorf("Commit error: %v", err)
+				}
+			}
+		}(ctx)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := db.Vacuum(tbl); err != nil {
+			t.Errorf("Vacuum error: %v", err)
+		}
+	}
+	wg.Wait()
+
+	ctx := GetClientContextMgr(db.config).NewClientCtx(db.config, db)
+	defer ctx.Close()
+	if _, err := db.Vacuum(tbl); err != nil {
+		t.Fatalf("Vacuum error: %v", err)
+	}
+	if got := crashRows(t, ctx, tbl); !sameRows(got, rows) {
+		t.Errorf("Vacuum error: expected rows\n%s\nbut got\n%s", rowsString(rows), rowsString(got))
+	}
+}
+
+func TestAutovacuumRound(t *testing.T) {
+	db, _, _ := vacuumTable(t, TableOptions{}, 300, func(i int) bool { return i < 250 })
+
+	// Deleted records keep their slots until vacuum, so the free space map shows no room yet
+	av := NewAutovacuum(db, 0, 0.5)
+	vacuumed, err := av.Round()
+	if err != nil {
+		t.Fatalf("Round error: %v", err)
+	}
+	if vacuumed != 0 {
+		t.Errorf("Round error: expected no table over the threshold but vacuumed %d", vacuumed)
+	}
+
+	db, _, _ = vacuumTable(t, TableOptions{}, 300, func(i int) bool { return i%10 == 0 })
+	av = NewAutovacuum(db, 0, 0.5)
+	if vacuumed, err = av.Round(); err != nil {
+		t.Fatalf("Round error: %v", err)
+	}
+	if vacuumed != 1 {
+		t.Errorf("Round error: expected the table to be vacuumed but vacuumed %d", vacuumed)
+	}
+	if vacuumed, err = av.Round(); err != nil {
+		t.Fatalf("Round error: %v", err)
+	}
+	if vacuumed != 0 {
+		t.Errorf("Round error: expected nothing to vacuum after the first round but vacuumed %d", vacuumed)
+	}
+}
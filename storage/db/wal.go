@@ -1,8 +1,21 @@
 package db
 
 import (
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"log/slog"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"unsafe"
+
+	cfg "github.com/misachi/DarDB/config"
 	st "github.com/misachi/DarDB/storage"
 )
 
@@ -12,11 +25,36 @@ type wal_t uint64
 const (
 	WAL_START WALSTATE_t = 's'
 	// INPROGRESS WALSTATE_t = 'p'
-	WAL_COMMITTED WALSTATE_t = 'c'
-	WAL_ABORTED   WALSTATE_t = 'a'
+	WAL_COMMITTED  WALSTATE_t = 'c'
+	WAL_ABORTED    WALSTATE_t = 'a'
+	WAL_INSERT     WALSTATE_t = 'i'
+	WAL_UPDATE     WALSTATE_t = 'u'
+	WAL_DELETE     WALSTATE_t = 'd'
+	WAL_CHECKPOINT WALSTATE_t = 'k'
+	WAL_VACUUM     WALSTATE_t = 'v' // Vacuum rewrote a block; the entry holds its full page image
+	WAL_TRUNCATE   WALSTATE_t = 't' // Vacuum dropped the blocks of a table from the block of the tag on
 )
 
-var CurrentWalSegment *WalSegment
+const (
+	WAL_DIR                     = "wal"
+	WAL_CONTROL_FILE            = "control"
+	WAL_SEGMENT_SIZE            = 16 << 20 // Segments are rotated once they grow past this size
+	WAL_BUFFER_SIZE             = 64 << 10 // Default for Config.WalBufferSize
+	WAL_FRAME_HDR_SIZE          = 8        // length(4) | crc32c(4)
+	WAL_ENTRY_BODY_SIZE         = 65
+	WAL_FRAME_SEALED            = 1 << 31    // Set in the length of frames whose body is key ID(4) | body sealed with the key
+	WAL_SEGMENT_HDR_SIZE        = 8          // magic(4) | version(2) | zero(2)
+	WAL_MAGIC            uint32 = 0x4c415744 // "DWAL"
+	WAL_VERSION          uint16 = 1
+)
+
+var (
+	ErrWalClosed  = errors.New("WAL is closed")
+	ErrWalCorrupt = errors.New("WAL entry is corrupt")
+	ErrWalVersion = errors.New("WAL was written by another version")
+)
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
 
 type ETag struct {
 	dbID    st.DB_t
@@ -29,11 +67,15 @@ func NewETag(dbID st.DB_t, tblID st.Tbl_t, blkID st.Blk_t) *ETag {
 }
 
 type Entry struct {
-	state  WALSTATE_t
-	txnID  st.Txn_t
-	tag    *ETag
-	oldVal []byte
-	newVal []byte
+	state   WALSTATE_t
+	lsn     wal_t
+	txnID   st.Txn_t
+	tag     *ETag
+	slot    uint32 // Record index within the block
+	undoLSN wal_t  // For compensation entries, the LSN of the entry being undone
+	oldVal  []byte
+	newVal  []byte
+	image   []byte // Full page image of the block after the change, for the first change since a checkpoint
 }
 
 func NewEntry(txnID st.Txn_t) *Entry {
@@ -56,34 +98,627 @@ func (e Entry) Size() wal_t {
 	return wal_t(unsafe.Sizeof(e.state)) + wal_t(unsafe.Sizeof(e.txnID)) + wal_t(unsafe.Sizeof(e.tag)) + wal_t(len(e.oldVal)) + wal_t(len(e.newVal))
 }
 
+func (e Entry) LSN() wal_t {
+	return e.lsn
+}
+
+/* isCompensation reports whether the entry undoes an earlier entry of the same transaction */
+func (e Entry) isCompensation() bool {
+	return e.undoLSN > 0
+}
+
+/* encode frames the entry as length | crc32c | body */
+func (e *Entry) encode() []byte {
+	bodyLen := WAL_ENTRY_BODY_SIZE + len(e.oldVal) + len(e.newVal) + len(e.image)
+	frame := make([]byte, WAL_FRAME_HDR_SIZE+bodyLen)
+	body := frame[WAL_FRAME_HDR_SIZE:]
+
+	tag := e.tag
+	if tag == nil {
+		tag = &ETag{}
+	}
+	binary.LittleEndian.PutUint64(body[0:8], uint64(e.lsn))
+	body[8] = byte(e.state)
+	binary.LittleEndian.PutUint64(body[9:17], uint64(e.txnID))
+	binary.LittleEndian.PutUint64(body[17:25], uint64(tag.dbID))
+	binary.LittleEndian.PutUint64(body[25:33], uint64(tag.tblID))
+	binary.LittleEndian.PutUint64(body[33:41], uint64(tag.blockID))
+	binary.LittleEndian.PutUint32(body[41:45], e.slot)
+	binary.LittleEndian.PutUint64(body[45:53], uint64(e.undoLSN))
+	binary.LittleEndian.PutUint32(body[53:57], uint32(len(e.oldVal)))
+	copy(body[57:], e.oldVal)
+	off := 57 + len(e.oldVal)
+	binary.LittleEndian.PutUint32(body[off:off+4], uint32(len(e.newVal)))
+	copy(body[off+4:], e.newVal)
+	off += 4 + len(e.newVal)
+	binary.LittleEndian.PutUint32(body[off:off+4], uint32(len(e.image)))
+	copy(body[off+4:], e.image)
+
+	binary.LittleEndian.PutUint32(frame[0:4], uint32(bodyLen))
+	binary.LittleEndian.PutUint32(frame[4:8], crc32.Checksum(body, crc32c))
+	return frame
+}
+
+func decodeEntry(body []byte) (*Entry, error) {
+	if len(body) < WAL_ENTRY_BODY_SIZE {
+		return nil, ErrWalCorrupt
+	}
+	e := &Entry{
+		lsn:   wal_t(binary.LittleEndian.Uint64(body[0:8])),
+		state: WALSTATE_t(body[8]),
+		txnID: st.Txn_t(binary.LittleEndian.Uint64(body[9:17])),
+		tag: NewETag(
+			st.DB_t(binary.LittleEndian.Uint64(body[17:25])),
+			st.Tbl_t(binary.LittleEndian.Uint64(body[25:33])),
+			st.Blk_t(binary.LittleEndian.Uint64(body[33:41])),
+		),
+		slot:    binary.LittleEndian.Uint32(body[41:45]),
+		undoLSN: wal_t(binary.LittleEndian.Uint64(body[45:53])),
+	}
+	oldLen := int(binary.LittleEndian.Uint32(body[53:57]))
+	if 57+oldLen+4 > len(body) {
+		return nil, ErrWalCorrupt
+	}
+	e.oldVal = append([]byte{}, body[57:57+oldLen]...)
+	off := 57 + oldLen
+	newLen := int(binary.LittleEndian.Uint32(body[off : off+4]))
+	if off+4+newLen+4 > len(body) {
+		return nil, ErrWalCorrupt
+	}
+	e.newVal = append([]byte{}, body[off+4:off+4+newLen]...)
+	off += 4 + newLen
+	imgLen := int(binary.LittleEndian.Uint32(body[off : off+4]))
+	if off+4+imgLen != len(body) {
+		return nil, ErrWalCorrupt
+	}
+	if imgLen > 0 {
+		e.image = append([]byte{}, body[off+4:]...)
+	}
+	return e, nil
+}
+
+/* seal replaces the body of frame with the body sealed with keyID of keys */
+func seal(frame []byte, keys *keyring, keyID uint32) ([]byte, error) {
+	c, err := keys.cipher(keyID)
+	if err != nil {
+		return nil, fmt.Errorf("seal: %v", err)
+	}
+	sealed := make([]byte, WAL_FRAME_HDR_SIZE+4, WAL_FRAME_HDR_SIZE+4+st.SEAL_SIZE+len(frame))
+	binary.LittleEndian.PutUint32(sealed[WAL_FRAME_HDR_SIZE:], keyID)
+	if sealed, err = c.Seal(sealed, frame[WAL_FRAME_HDR_SIZE:], keyAAD(keyID)); err != nil {
+		return nil, fmt.Errorf("seal: %v", err)
+	}
+	body := sealed[WAL_FRAME_HDR_SIZE:]
+	binary.LittleEndian.PutUint32(sealed[0:4], uint32(len(body))|WAL_FRAME_SEALED)
+	binary.LittleEndian.PutUint32(sealed[4:8], crc32.Checksum(body, crc32c))
+	return sealed, nil
+}
+
+/*
+readEntry reads one framed entry, opening sealed frames with keys. io.EOF means a clean end;
+ErrWalCorrupt means a torn or damaged tail
+*/
+func readEntry(r io.Reader, keys *keyring) (*Entry, int, error) {
+	hdr := make([]byte, WAL_FRAME_HDR_SIZE)
+	n, err := io.ReadFull(r, hdr)
+	if n == 0 && err == io.EOF {
+		return nil, 0, io.EOF
+	}
+	if err != nil {
+		return nil, n, ErrWalCorrupt
+	}
+	bodyLen := binary.LittleEndian.Uint32(hdr[0:4])
+	sealed := bodyLen&WAL_FRAME_SEALED != 0
+	bodyLen &^= WAL_FRAME_SEALED
+	if bodyLen < WAL_ENTRY_BODY_SIZE || bodyLen > WAL_SEGMENT_SIZE {
+		return nil, n, ErrWalCorrupt
+	}
+	body := make([]byte, bodyLen)
+	m, err := io.ReadFull(r, body)
+	if err != nil {
+		return nil, n + m, ErrWalCorrupt
+	}
+	if crc32.Checksum(body, crc32c) != binary.LittleEndian.Uint32(hdr[4:8]) {
+		return nil, n + m, ErrWalCorrupt
+	}
+	if sealed {
+		// The checksum matched, so a frame that does not open was sealed with another key
+		if keys == nil {
+			return nil, n + m, ErrNoMasterKey
+		}
+		keyID := binary.LittleEndian.Uint32(body[0:4])
+		c, err := keys.cipher(keyID)
+		if err != nil {
+			return nil, n + m, err
+		}
+		if body, err = c.Open(nil, body[4:], keyAAD(keyID)); err != nil {
+			return nil, n + m, err
+		}
+	}
+	entry, err := decodeEntry(body)
+	return entry, n + m, err
+}
+
+/*
+WalSegment is one file of the log. Its name is the LSN of the first entry it holds. A segment
+starts with a header naming the version of the log, then the framed entries. Entries hold records
+in the layout of the version that logged them, so a log of another version, or one written before
+segments had a header, is refused rather than replayed; it is recovered by the build that wrote it.
+*/
 type WalSegment struct {
 	WalID    uint32
 	Size     wal_t
-	EntryBuf []*Entry
+	StartLSN wal_t
+	file     st.File
+}
+
+func segmentName(startLSN wal_t) string {
+	return fmt.Sprintf("%016x.wal", uint64(startLSN))
 }
 
-func NewWalSegment(txnID st.Txn_t) *WalSegment {
-	var currentWalNum = txnID & 0xffffffff
-	currentWalNum += 1
-	walSeg := &WalSegment{
-		WalID:    uint32(currentWalNum),
-		EntryBuf: []*Entry{},
+func createSegment(fsys st.FS, dir string, walID uint32, startLSN wal_t, flags int) (*WalSegment, error) {
+	name := path.Join(dir, segmentName(startLSN))
+	f, err := fsys.Create(name)
+	if err != nil {
+		return nil, fmt.Errorf("createSegment: %v", err)
+	}
+	if flags != 0 {
+		f.Close()
+		if f, err = st.OpenWith(fsys, name, flags); err != nil {
+			return nil, fmt.Errorf("createSegment: %v", err)
+		}
+	}
+	if err := writeSegmentHeader(f); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("createSegment: %v", err)
 	}
-	if CurrentWalSegment == nil {
-		CurrentWalSegment = walSeg
+	if err := fsys.Sync(dir); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("createSegment: %v", err)
 	}
-	return walSeg
+	return &WalSegment{WalID: walID, Size: WAL_SEGMENT_HDR_SIZE, StartLSN: startLSN, file: f}, nil
 }
 
-func (wal *WalSegment) WalLog(ctx *ClientContext, entry *Entry) error {
-	if wal.Size < wal_t(ctx.config.WalBufferSize()) {
-		return fmt.Errorf("WalLog: WAL Segment full")
+func writeSegmentHeader(f st.File) error {
+	hdr := make([]byte, WAL_SEGMENT_HDR_SIZE)
+	binary.LittleEndian.PutUint32(hdr[0:4], WAL_MAGIC)
+	binary.LittleEndian.PutUint16(hdr[4:6], WAL_VERSION)
+	if _, err := f.WriteAt(hdr, 0); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+/*
+readSegmentHeader reads the header at the start of a segment. io.EOF means the segment was cut
+short before its header was written, so it holds no entries; ErrWalVersion means it was not
+written by this version
+*/
+func readSegmentHeader(r io.Reader) error {
+	hdr := make([]byte, WAL_SEGMENT_HDR_SIZE)
+	if _, err := io.ReadFull(r, hdr); err == io.EOF || err == io.ErrUnexpectedEOF {
+		return io.EOF
+	} else if err != nil {
+		return err
+	}
+	if magic := binary.LittleEndian.Uint32(hdr[0:4]); magic != WAL_MAGIC {
+		return fmt.Errorf("segment without a header: %w", ErrWalVersion)
+	}
+	if version := binary.LittleEndian.Uint16(hdr[4:6]); version != WAL_VERSION {
+		return fmt.Errorf("version %d, expected %d: %w", version, WAL_VERSION, ErrWalVersion)
 	}
-	wal.EntryBuf = append(wal.EntryBuf, entry)
-	wal.Size = entry.Size()
 	return nil
 }
 
-func CurrentWal() *WalSegment {
-	return CurrentWalSegment
+/* listSegments returns the start LSNs of the segments in dir in ascending order */
+func listSegments(fsys st.FS, dir string) ([]wal_t, error) {
+	files, err := fsys.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("listSegments: %v", err)
+	}
+	segments := make([]wal_t, 0)
+	for _, f := range files {
+		name := f.Name()
+		if !strings.HasSuffix(name, ".wal") {
+			continue
+		}
+		lsn, err := strconv.ParseUint(strings.TrimSuffix(name, ".wal"), 16, 64)
+		if err != nil {
+			continue
+		}
+		segments = append(segments, wal_t(lsn))
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i] < segments[j] })
+	return segments, nil
+}
+
+/*
+WalMgr appends entries to the log. Entries are buffered in memory and written out when the buffer
+fills or when Flush is called; an entry is durable once FlushedLSN has reached its LSN.
+*/
+type WalMgr struct {
+	fs         st.FS
+	dir        string
+	bufSize    int
+	segSize    int
+	mtx        *sync.Mutex
+	segment    *WalSegment
+	nextLSN    wal_t
+	writtenLSN wal_t // Written to the segment file, maybe not synced
+	flushedLSN wal_t // Synced to disk
+	pending    [][]byte
+	pendingSz  int
+	closed     bool
+	syncMethod cfg.WalSyncMethod
+	keys       *keyring // Keys of the log when it is encrypted
+	keyID      uint32   // Key new entries are sealed with
+}
+
+/*
+OpenWalMgr opens the log in dir of fsys, dropping any torn entry at the tail of the last segment.
+Flushed entries are made durable with syncMethod. With a master key new entries are encrypted with
+the key of the log, which the master key wraps.
+*/
+func OpenWalMgr(fsys st.FS, dir string, bufSize int, syncMethod cfg.WalSyncMethod, master []byte) (*WalMgr, error) {
+	if bufSize <= 0 {
+		bufSize = WAL_BUFFER_SIZE
+	}
+	if err := fsys.MkdirAll(dir); err != nil {
+		return nil, fmt.Errorf("OpenWalMgr: MkdirAll error %v", err)
+	}
+	w := &WalMgr{fs: fsys, dir: dir, bufSize: bufSize, segSize: WAL_SEGMENT_SIZE, mtx: &sync.Mutex{}, nextLSN: 1, syncMethod: syncMethod}
+	if master != nil {
+		keys, err := loadKeyring(fsys, dir, master)
+		if err != nil {
+			return nil, fmt.Errorf("OpenWalMgr: %w", err)
+		}
+		if w.keyID, err = keys.current(); err != nil {
+			return nil, fmt.Errorf("OpenWalMgr: %v", err)
+		}
+		w.keys = keys
+	} else if _, err := st.ReadFile(fsys, keyringPath(dir)); err == nil {
+		return nil, fmt.Errorf("OpenWalMgr: %w", ErrNoMasterKey)
+	}
+
+	segments, err := listSegments(fsys, dir)
+	if err != nil {
+		return nil, fmt.Errorf("OpenWalMgr: %v", err)
+	}
+	if len(segments) == 0 {
+		seg, err := createSegment(fsys, dir, 1, w.nextLSN, w.segmentFlags())
+		if err != nil {
+			return nil, fmt.Errorf("OpenWalMgr: %v", err)
+		}
+		w.segment = seg
+		return w, nil
+	}
+
+	startLSN := segments[len(segments)-1]
+	f, err := st.OpenWith(fsys, path.Join(dir, segmentName(startLSN)), w.segmentFlags())
+	if err != nil {
+		return nil, fmt.Errorf("OpenWalMgr: %v", err)
+	}
+	var validSize int64 = WAL_SEGMENT_HDR_SIZE
+	lastLSN := startLSN - 1
+	if err := readSegmentHeader(f); err == io.EOF {
+		// Created but its header never reached disk
+		if err := writeSegmentHeader(f); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("OpenWalMgr: %v", err)
+		}
+	} else if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("OpenWalMgr: %s: %w", segmentName(startLSN), err)
+	}
+	for {
+		entry, n, err := readEntry(f, w.keys)
+		if err == ErrWalCorrupt {
+			slog.Warn("OpenWalMgr: dropping torn WAL tail", "segment", segmentName(startLSN), "offset", validSize)
+			break
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("OpenWalMgr: %w", err)
+		}
+		validSize += int64(n)
+		lastLSN = entry.lsn
+	}
+	if err := f.Truncate(validSize); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("OpenWalMgr: Truncate error %v", err)
+	}
+	w.segment = &WalSegment{WalID: uint32(len(segments)), Size: wal_t(validSize), StartLSN: startLSN, file: f}
+	w.nextLSN = lastLSN + 1
+	w.writtenLSN = lastLSN
+	w.flushedLSN = lastLSN
+	return w, nil
+}
+
+/* GetWalMgr returns the log of the data directory in config */
+func GetWalMgr(config *cfg.Config) *WalMgr {
+	return getEngine(config).wal
+}
+
+/* openWal opens the log of the data directory in config */
+func openWal(config *cfg.Config) (*WalMgr, error) {
+	master, err := config.MasterKey()
+	if err != nil {
+		return nil, fmt.Errorf("openWal: unable to read the master key: %v", err)
+	}
+	w, err := OpenWalMgr(config.FS(), path.Join(config.DataPath(), WAL_DIR), int(config.WalBufferSize()), config.WalSync(), master)
+	if err != nil {
+		return nil, fmt.Errorf("openWal: unable to open WAL: %v", err)
+	}
+	return w, nil
+}
+
+func (w *WalMgr) Dir() string {
+	return w.dir
+}
+
+func (w *WalMgr) FS() st.FS {
+	return w.fs
+}
+
+/* Append assigns the next LSN to entry and buffers it */
+func (w *WalMgr) Append(entry *Entry) (wal_t, error) {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	if w.closed {
+		return 0, ErrWalClosed
+	}
+
+	entry.lsn = w.nextLSN
+	frame := entry.encode()
+	if w.keys != nil {
+		var err error
+		if frame, err = seal(frame, w.keys, w.keyID); err != nil {
+			return 0, fmt.Errorf("Append: %v", err)
+		}
+	}
+	w.nextLSN++
+	w.pending = append(w.pending, frame)
+	w.pendingSz += len(frame)
+
+	if w.pendingSz >= w.bufSize {
+		if err := w.writePending(); err != nil {
+			// Writes stop at the first failure, so the entry is still the last one pending. Callers
+			// undo the change it logs, so it must not be written later
+			w.pending = w.pending[:len(w.pending)-1]
+			w.pendingSz -= len(frame)
+			w.nextLSN--
+			return 0, fmt.Errorf("Append: %v", err)
+		}
+	}
+	return entry.lsn, nil
+}
+
+/*
+writePending writes buffered entries to the segment file, rotating segments as they fill. The size
+of the segment only grows by whole frames: a frame that fails part way stays pending and is written
+again at the same offset, so a retry never leaves a torn frame ahead of later entries.
+*/
+func (w *WalMgr) writePending() error {
+	lsn := w.writtenLSN
+	for _, frame := range w.pending {
+		lsn++
+		if w.segment.Size > WAL_SEGMENT_HDR_SIZE && int(w.segment.Size)+len(frame) > w.segSize {
+			if err := w.rotate(lsn); err != nil {
+				return err
+			}
+		}
+		n, err := w.segment.file.WriteAt(frame, int64(w.segment.Size))
+		if err == nil && n < len(frame) {
+			err = io.ErrShortWrite
+		}
+		if err != nil {
+			// Drop what landed of the frame; should this fail too the retry overwrites it
+			w.segment.file.Truncate(int64(w.segment.Size))
+			return fmt.Errorf("writePending: %v", err)
+		}
+		w.segment.Size += wal_t(n)
+		w.writtenLSN = lsn
+		w.pending = w.pending[1:]
+		w.pendingSz -= len(frame)
+	}
+	w.pending = nil
+	return nil
+}
+
+func (w *WalMgr) segmentFlags() int {
+	if w.syncMethod == cfg.WAL_SYNC_DSYNC {
+		return st.O_DSYNC
+	}
+	return 0
+}
+
+/* syncSegment makes what was written to the current segment durable */
+func (w *WalMgr) syncSegment() error {
+	switch w.syncMethod {
+	case cfg.WAL_SYNC_DSYNC:
+		// Every write was durable when it returned
+		return nil
+	case cfg.WAL_SYNC_FDATASYNC:
+		return st.Datasync(w.segment.file)
+	}
+	return w.segment.file.Sync()
+}
+
+func (w *WalMgr) rotate(startLSN wal_t) error {
+	if err := w.syncSegment(); err != nil {
+		return fmt.Errorf("rotate: Sync error %v", err)
+	}
+	w.flushedLSN = w.writtenLSN
+	w.segment.file.Close()
+	seg, err := createSegment(w.fs, w.dir, w.segment.WalID+1, startLSN, w.segmentFlags())
+	if err != nil {
+		return fmt.Errorf("rotate: %v", err)
+	}
+	w.segment = seg
+	return nil
+}
+
+/* Flush makes every entry up to and including lsn durable */
+func (w *WalMgr) Flush(lsn wal_t) error {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	if w.closed {
+		return ErrWalClosed
+	}
+	if lsn <= w.flushedLSN {
+		return nil
+	}
+	if err := w.writePending(); err != nil {
+		return fmt.Errorf("Flush: %v", err)
+	}
+	if err := w.syncSegment(); err != nil {
+		return fmt.Errorf("Flush: Sync error %v", err)
+	}
+	w.flushedLSN = w.writtenLSN
+	return nil
+}
+
+func (w *WalMgr) FlushedLSN() wal_t {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	return w.flushedLSN
+}
+
+/* NextLSN is the LSN the next appended entry will get */
+func (w *WalMgr) NextLSN() wal_t {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	return w.nextLSN
+}
+
+/* Close flushes and closes the log */
+func (w *WalMgr) Close() error {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	if err := w.writePending(); err != nil {
+		w.segment.file.Close()
+		return fmt.Errorf("Close: %v", err)
+	}
+	if err := w.syncSegment(); err != nil {
+		w.segment.file.Close()
+		return fmt.Errorf("Close: Sync error %v", err)
+	}
+	return w.segment.file.Close()
+}
+
+/* Truncate removes segments whose entries all precede lsn. The current segment is never removed */
+func (w *WalMgr) Truncate(lsn wal_t) (int, error) {
+	w.mtx.Lock()
+	current := w.segment.StartLSN
+	w.mtx.Unlock()
+
+	segments, err := listSegments(w.fs, w.dir)
+	if err != nil {
+		return 0, fmt.Errorf("Truncate: %v", err)
+	}
+	removed := 0
+	for i := 0; i+1 < len(segments); i++ {
+		// A segment ends where the next one starts
+		if segments[i+1] > lsn || segments[i] >= current {
+			break
+		}
+		if err := w.fs.Remove(path.Join(w.dir, segmentName(segments[i]))); err != nil {
+			return removed, fmt.Errorf("Truncate: %v", err)
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+/* Scan calls fn on every entry with an LSN of at least from, in LSN order */
+func (w *WalMgr) Scan(from wal_t, fn func(entry *Entry) error) error {
+	w.mtx.Lock()
+	if !w.closed {
+		if err := w.writePending(); err != nil {
+			w.mtx.Unlock()
+			return fmt.Errorf("Scan: %v", err)
+		}
+	}
+	w.mtx.Unlock()
+	return scanWal(w.fs, w.dir, w.keys, from, fn)
+}
+
+func scanWal(fsys st.FS, dir string, keys *keyring, from wal_t, fn func(entry *Entry) error) error {
+	segments, err := listSegments(fsys, dir)
+	if err != nil {
+		return fmt.Errorf("scanWal: %v", err)
+	}
+	first := 0
+	for i, startLSN := range segments {
+		if startLSN <= from {
+			first = i
+		}
+	}
+	for i := first; i < len(segments); i++ {
+		f, err := fsys.Open(path.Join(dir, segmentName(segments[i])))
+		if err != nil {
+			return fmt.Errorf("scanWal: %v", err)
+		}
+		if err := readSegmentHeader(f); err == io.EOF {
+			f.Close()
+			continue
+		} else if err != nil {
+			f.Close()
+			return fmt.Errorf("scanWal: %s: %w", segmentName(segments[i]), err)
+		}
+		for {
+			entry, _, err := readEntry(f, keys)
+			if err == io.EOF || err == ErrWalCorrupt {
+				// A corrupt entry can only be the torn tail of the log
+				break
+			}
+			if err != nil {
+				f.Close()
+				return fmt.Errorf("scanWal: %v", err)
+			}
+			if entry.lsn < from {
+				continue
+			}
+			if err := fn(entry); err != nil {
+				f.Close()
+				return err
+			}
+		}
+		f.Close()
+	}
+	return nil
+}
+
+/* writeControl durably records the LSN of the last completed checkpoint */
+func writeControl(fsys st.FS, dir string, ckptLSN wal_t) error {
+	data := make([]byte, 12)
+	binary.LittleEndian.PutUint64(data[0:8], uint64(ckptLSN))
+	binary.LittleEndian.PutUint32(data[8:12], crc32.Checksum(data[0:8], crc32c))
+
+	if err := st.WriteFileAtomic(fsys, path.Join(dir, WAL_CONTROL_FILE), data); err != nil {
+		return fmt.Errorf("writeControl: %v", err)
+	}
+	return nil
+}
+
+/* readControl returns the LSN of the last completed checkpoint, or 0 if there is none */
+func readControl(fsys st.FS, dir string) (wal_t, error) {
+	data, err := st.ReadFile(fsys, path.Join(dir, WAL_CONTROL_FILE))
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("readControl: %v", err)
+	}
+	if len(data) != 12 || crc32.Checksum(data[0:8], crc32c) != binary.LittleEndian.Uint32(data[8:12]) {
+		return 0, fmt.Errorf("readControl: control file is corrupt")
+	}
+	return wal_t(binary.LittleEndian.Uint64(data[0:8])), nil
 }
@@ -0,0 +1,372 @@
+package db
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"path"
+	"testing"
+
+	"github.com/misachi/DarDB/column"
+	"github.com/misachi/DarDB/config"
+	st "github.com/misachi/DarDB/storage"
+)
+
+/* crash forgets everything the engine of cfg holds in memory without writing it, as a process crash would */
+func crash(cfg *config.Config) {
+	engineMtx.Lock()
+	defer engineMtx.Unlock()
+	e, ok := cfg.Engine().(*engine)
+	if !ok {
+		return
+	}
+	cfg.SetEngine(nil)
+	e.wal.mtx.Lock()
+	e.wal.closed = true
+	e.wal.segment.file.Close()
+	e.wal.mtx.Unlock()
+	e.buf.files.closeFiles()
+}
+
+/*
+newTestConfig returns a config whose data directory is in fsys, so tests do not touch the disk. The
+databases opened with it are closed when the test ends
+*/
+func newTestConfig(t *testing.T, fsys st.FS) *config.Config {
+	cfg := config.NewConfig("/data", 1, 1)
+	cfg.SetFS(fsys)
+	t.Cleanup(func() { closeEngine(cfg) })
+	return cfg
+}
+
+func newTestEntry(txnID st.Txn_t, slot int, val []byte) *Entry {
+	entry := NewEntry(txnID)
+	entry.state = WAL_INSERT
+	entry.slot = uint32(slot)
+	entry.InsertVal(nil, val, NewETag(1, 2, 3))
+	return entry
+}
+
+func scanAll(t *testing.T, w *WalMgr, from wal_t) []*Entry {
+	entries := make([]*Entry, 0)
+	err := w.Scan(from, func(entry *Entry) error {
+		entries = append(entries, entry)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Scan error: %v", err)
+	}
+	return entries
+}
+
+func TestWalReopen(t *testing.T) {
+	t.Parallel()
+	fsys, dir := st.NewMemFS(), "/wal"
+	w, err := OpenWalMgr(fsys, dir, 0, config.WAL_SYNC_FSYNC, nil)
+	if err != nil {
+		t.Fatalf("OpenWalMgr error: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := w.Append(newTestEntry(7, i, []byte(fmt.Sprintf("record%d", i)))); err != nil {
+			t.Fatalf("Append error: %v", err)
+		}
+	}
+	if err := w.Flush(3); err != nil {
+		t.Fatalf("Flush error: %v", err)
+	}
+	// Buffered but never flushed, so lost with the process
+	w.Append(newTestEntry(7, 3, []byte("lost")))
+	w.segment.file.Close()
+
+	// A torn frame at the tail of the log
+	f, err := fsys.Open(path.Join(dir, segmentName(1)))
+	if err != nil {
+		t.Fatalf("Open error: %v", err)
+	}
+	fInfo, _ := f.Stat()
+	f.WriteAt([]byte{0x40, 0, 0, 0, 1, 2, 3}, fInfo.Size())
+	f.Close()
+
+	w, err = OpenWalMgr(fsys, dir, 0, config.WAL_SYNC_FSYNC, nil)
+	if err != nil {
+		t.Fatalf("OpenWalMgr error: %v", err)
+	}
+	defer w.Close()
+	if w.NextLSN() != 4 {
+		t.Errorf("OpenWalMgr error: expected next LSN to be %d but got %d", 4, w.NextLSN())
+	}
+
+	entries := scanAll(t, w, 1)
+	if len(entries) != 3 {
+		t.Fatalf("Scan error: expected %d entries but got %d", 3, len(entries))
+	}
+	for i, entry := range entries {
+		if entry.lsn != wal_t(i+1) || entry.txnID != 7 || int(entry.slot) != i {
+			t.Errorf("Scan error: unexpected entry %+v", entry)
+		}
+		if !bytes.Equal(entry.newVal, []byte(fmt.Sprintf("record%d", i))) {
+			t.Errorf("Scan error: expected value %q but got %q", fmt.Sprintf("record%d", i), entry.newVal)
+		}
+		if *entry.tag != *NewETag(1, 2, 3) {
+			t.Errorf("Scan error: unexpected tag %+v", *entry.tag)
+		}
+	}
+
+	// Entries appended after the torn tail was dropped must be readable
+	lsn, _ := w.Append(newTestEntry(8, 0, []byte("after")))
+	if err := w.Flush(lsn); err != nil {
+		t.Fatalf("Flush error: %v", err)
+	}
+	if entries = scanAll(t, w, lsn); len(entries) != 1 || entries[0].txnID != 8 {
+		t.Errorf("Scan error: expected the entry appended after reopening")
+	}
+}
+
+func TestWalVersion(t *testing.T) {
+	t.Parallel()
+	frame := newTestEntry(7, 0, []byte("record")).encode()
+	header := func(version uint16) []byte {
+		hdr := make([]byte, WAL_SEGMENT_HDR_SIZE)
+		binary.LittleEndian.PutUint32(hdr[0:4], WAL_MAGIC)
+		binary.LittleEndian.PutUint16(hdr[4:6], version)
+		return hdr
+	}
+	for _, test := range []struct {
+		name    string
+		segment []byte
+		refused bool
+	}{
+		{"no header", frame, true},
+		{"newer version", append(header(WAL_VERSION+1), frame...), true},
+		{"torn header", header(WAL_VERSION)[:3], false},
+		{"current version", append(header(WAL_VERSION), frame...), false},
+	} {
+		fsys, dir := st.NewMemFS(), "/wal"
+		fsys.MkdirAll(dir)
+		f, err := fsys.Create(path.Join(dir, segmentName(1)))
+		if err != nil {
+			t.Fatalf("Create error: %v", err)
+		}
+		f.WriteAt(test.segment, 0)
+		f.Close()
+
+		w, err := OpenWalMgr(fsys, dir, 0, config.WAL_SYNC_FSYNC, nil)
+		if test.refused {
+			if !errors.Is(err, ErrWalVersion) {
+				t.Errorf("OpenWalMgr error: %s: expected ErrWalVersion but got %v", test.name, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("OpenWalMgr error: %s: %v", test.name, err)
+		}
+		lsn, _ := w.Append(newTestEntry(8, 0, []byte("after")))
+		if err := w.Flush(lsn); err != nil {
+			t.Fatalf("Flush error: %v", err)
+		}
+		if entries := scanAll(t, w, 1); len(entries) != int(lsn) || entries[len(entries)-1].txnID != 8 {
+			t.Errorf("Scan error: %s: expected %d entries ending with the one appended but got %d", test.name, lsn, len(entries))
+		}
+		w.Close()
+	}
+}
+
+func TestWalSyncMethods(t *testing.T) {
+	t.Parallel()
+	values := []struct {
+		name   string
+		method config.WalSyncMethod
+	}{
+		{name: "fsync", method: config.WAL_SYNC_FSYNC},
+		{name: "fdatasync", method: config.WAL_SYNC_FDATASYNC},
+		{name: "dsync", method: config.WAL_SYNC_DSYNC},
+	}
+	for _, val := range values {
+		val := val
+		t.Run(val.name, func(t *testing.T) {
+			t.Parallel()
+			fsys, dir := st.NewFaultFS(st.NewMemFS(), 1), "/wal"
+			w, err := OpenWalMgr(fsys, dir, 0, val.method, nil)
+			if err != nil {
+				t.Fatalf("OpenWalMgr error: %v", err)
+			}
+			w.segSize = 256
+			var lsn wal_t
+			for i := 0; i < 10; i++ {
+				lsn, _ = w.Append(newTestEntry(1, i, bytes.Repeat([]byte("x"), 50)))
+			}
+			if err := w.Flush(lsn); err != nil {
+				t.Fatalf("Flush error: %v", err)
+			}
+			w.Append(newTestEntry(1, 10, []byte("lost")))
+			if err := fsys.Crash(false); err != nil {
+				t.Fatalf("Crash error: %v", err)
+			}
+
+			w, err = OpenWalMgr(fsys, dir, 0, val.method, nil)
+			if err != nil {
+				t.Fatalf("OpenWalMgr error: %v", err)
+			}
+			defer w.Close()
+			if entries := scanAll(t, w, 1); len(entries) != 10 {
+				t.Errorf("Flush error: expected the %d flushed entries to survive a crash but got %d", 10, len(entries))
+			}
+		})
+	}
+}
+
+func TestWalFailedWrite(t *testing.T) {
+	t.Parallel()
+	for _, fault := range []st.Fault{st.FAULT_SHORT, st.FAULT_EIO} {
+		fsys, dir := st.NewFaultFS(st.NewMemFS(), 1), "/wal"
+		w, err := OpenWalMgr(fsys, dir, 0, config.WAL_SYNC_FSYNC, nil)
+		if err != nil {
+			t.Fatalf("OpenWalMgr error: %v", err)
+		}
+		var lsn wal_t
+		for i := 0; i < 4; i++ {
+			lsn, _ = w.Append(newTestEntry(1, i, []byte(fmt.Sprintf("record%d", i))))
+		}
+		// The second frame fails part way, then the flush is retried
+		fsys.InjectWrite(2, fault)
+		if err := w.Flush(lsn); err == nil {
+			t.Fatalf("Flush error: expected the injected fault %d to fail the flush", fault)
+		}
+		if err := w.Flush(lsn); err != nil {
+			t.Fatalf("Flush error: %v", err)
+		}
+		if err := fsys.Crash(false); err != nil {
+			t.Fatalf("Crash error: %v", err)
+		}
+
+		w, err = OpenWalMgr(fsys, dir, 0, config.WAL_SYNC_FSYNC, nil)
+		if err != nil {
+			t.Fatalf("OpenWalMgr error: %v", err)
+		}
+		if w.NextLSN() != lsn+1 {
+			t.Errorf("OpenWalMgr error: expected next LSN to be %d but got %d", lsn+1, w.NextLSN())
+		}
+		entries := scanAll(t, w, 1)
+		if len(entries) != 4 {
+			t.Fatalf("Flush error: expected the %d flushed entries to survive fault %d but got %d", 4, fault, len(entries))
+		}
+		for i, entry := range entries {
+			if entry.lsn != wal_t(i+1) || !bytes.Equal(entry.newVal, []byte(fmt.Sprintf("record%d", i))) {
+				t.Errorf("Scan error: unexpected entry %+v", entry)
+			}
+		}
+		w.Close()
+	}
+}
+
+func TestWalTruncate(t *testing.T) {
+	t.Parallel()
+	fsys, dir := st.NewMemFS(), "/wal"
+	w, err := OpenWalMgr(fsys, dir, 0, config.WAL_SYNC_FSYNC, nil)
+	if err != nil {
+		t.Fatalf("OpenWalMgr error: %v", err)
+	}
+	defer w.Close()
+	w.segSize = 256
+
+	var lsn wal_t
+	for i := 0; i < 20; i++ {
+		lsn, _ = w.Append(newTestEntry(1, i, bytes.Repeat([]byte("x"), 50)))
+	}
+	if err := w.Flush(lsn); err != nil {
+		t.Fatalf("Flush error: %v", err)
+	}
+	segments, _ := listSegments(fsys, dir)
+	if len(segments) < 3 {
+		t.Fatalf("rotate error: expected several segments but got %d", len(segments))
+	}
+
+	removed, err := w.Truncate(15)
+	if err != nil {
+		t.Fatalf("Truncate error: %v", err)
+	}
+	if remaining, _ := listSegments(fsys, dir); removed == 0 || len(remaining) != len(segments)-removed || remaining[0] > 15 {
+		t.Errorf("Truncate error: removed %d of %v, left %v", removed, segments, remaining)
+	}
+	if entries := scanAll(t, w, 15); len(entries) != 6 || entries[0].lsn != 15 {
+		t.Errorf("Truncate error: expected entries 15 to 20 to survive")
+	}
+}
+
+func TestRecoverAfterCrash(t *testing.T) {
+	values := []struct {
+		name      string
+		flushData bool // Write every dirty block, uncommitted ones included, before the crash
+	}{
+		{name: "redo", flushData: false},
+		{name: "undo", flushData: true},
+	}
+	cols := map[string]column.SUPPORTED_TYPE{
+		"id":   column.INT,
+		"name": column.STRING,
+	}
+	pkey := column.Column{Name: "id", Type: column.INT}
+
+	for _, val := range values {
+		val := val
+		t.Run(val.name, func(t *testing.T) {
+			t.Parallel()
+			fsys := st.NewMemFS()
+			cfg := newTestConfig(t, fsys)
+			db := NewDB("recoverDB", cfg)
+			tbl, err := db.CreateTable("table1", cols, pkey)
+			if err != nil {
+				t.Fatalf("CreateTable error: %v", err)
+			}
+			tblID := tbl.tblID
+
+			winner := GetClientContextMgr(cfg).NewClientCtx(cfg, db)
+			if err := db.AddRecord(winner, tbl, map[string][]byte{"id": []byte("1"), "name": []byte("kept")}); err != nil {
+				t.Fatalf("AddRecord error: %v", err)
+			}
+			if err := winner.Commit(); err != nil {
+				t.Fatalf("Commit error: %v", err)
+			}
+
+			loser := GetClientContextMgr(cfg).NewClientCtx(cfg, db)
+			if err := db.AddRecord(loser, tbl, map[string][]byte{"id": []byte("2"), "name": []byte("lost")}); err != nil {
+				t.Fatalf("AddRecord error: %v", err)
+			}
+			wal := GetWalMgr(cfg)
+			wal.Flush(wal.NextLSN() - 1)
+			if val.flushData {
+				if err := GetBufMgr(cfg).FlushAll(); err != nil {
+					t.Fatalf("FlushAll error: %v", err)
+				}
+			}
+			crash(cfg)
+
+			cfg = newTestConfig(t, fsys)
+			db = NewDB("recoverDB", cfg)
+			tbl, err = db.CreateTable("table1", cols, pkey)
+			if err != nil {
+				t.Fatalf("CreateTable error: %v", err)
+			}
+			if tbl.tblID != tblID {
+				t.Errorf("CreateTable error: expected table ID %d after restart but got %d", tblID, tbl.tblID)
+			}
+
+			ctx := GetClientContextMgr(cfg).NewClientCtx(cfg, db)
+			defer ctx.Close()
+			recs, err := db.GetRecord(ctx, tbl, "name", []byte("kept"))
+			if err != nil {
+				t.Fatalf("GetRecord error: %v", err)
+			}
+			if len(recs) != 1 {
+				t.Errorf("Recover error: expected committed record to survive but found %d", len(recs))
+			}
+			if recs, _ = db.GetRecord(ctx, tbl, "name", []byte("lost")); len(recs) != 0 {
+				t.Errorf("Recover error: expected uncommitted record to be undone but found %d", len(recs))
+			}
+			if ckptLSN, _ := readControl(fsys, GetWalMgr(cfg).Dir()); ckptLSN == 0 {
+				t.Errorf("Recover error: expected recovery to end with a checkpoint")
+			}
+		})
+	}
+}
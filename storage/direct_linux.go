@@ -0,0 +1,23 @@
+package storage
+
+import (
+	"os"
+	"syscall"
+)
+
+/* osFlags maps O_DIRECT and O_DSYNC to the flags of the OS */
+func osFlags(flags int) (int, error) {
+	osFlags := 0
+	if flags&O_DIRECT != 0 {
+		osFlags |= syscall.O_DIRECT
+	}
+	if flags&O_DSYNC != 0 {
+		osFlags |= syscall.O_DSYNC
+	}
+	return osFlags, nil
+}
+
+/* datasync flushes the data of f and only the metadata needed to read it back */
+func datasync(f *os.File) error {
+	return syscall.Fdatasync(int(f.Fd()))
+}
@@ -0,0 +1,21 @@
+//go:build !linux
+
+package storage
+
+import "os"
+
+/* osFlags maps O_DSYNC to O_SYNC. O_DIRECT is only supported on Linux */
+func osFlags(flags int) (int, error) {
+	if flags&O_DIRECT != 0 {
+		return 0, ErrDirectIO
+	}
+	osFlags := 0
+	if flags&O_DSYNC != 0 {
+		osFlags |= os.O_SYNC
+	}
+	return osFlags, nil
+}
+
+func datasync(f *os.File) error {
+	return f.Sync()
+}
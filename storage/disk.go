@@ -1,49 +1,451 @@
 package storage
 
 import (
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"hash/crc32"
+	"io"
 	"os"
+	"sync"
+	"unsafe"
 )
 
+const (
+	DEFAULT_BLOCK_SIZE = 4096
+	MIN_BLOCK_SIZE     = 4096
+	MAX_BLOCK_SIZE     = 65536
+	EXTENT_BLOCKS      = 16 // Blocks reserved on disk each time a file grows past its reservation
+)
+
+/*
+A data file created by CreateDiskMgr starts with a header recording its block size, the
+compression of its pages and the data key they are encrypted with, which the layers above
+interpret:
+
+	magic(4) | version(2) | compression(1) | reserved(1) | block size(4) | table(8) | key ID(4) | crc32c of the preceding bytes(4)
+
+padded with zeros to FILE_HDR_SIZE so the blocks after it stay aligned for O_DIRECT. Version 1
+headers end after the block size and hold neither table nor key. Files without the magic number
+predate the header and hold DEFAULT_BLOCK_SIZE blocks from offset 0.
+*/
+const (
+	FILE_MAGIC    uint32 = 0x44415246 // "DARF"
+	FILE_VERSION  uint16 = 2
+	FILE_HDR_SIZE        = 4096
+)
+
+/*
+A page of an encrypted file is sealed with its table, block and LSN as additional data, so a page
+moved to another block or table, or given another LSN, fails to open:
+
+	page length(4) | lsn(8) | page sealed by Cipher
+*/
+const PAGE_SEAL_OVERHEAD = 12 + SEAL_SIZE
+
+var (
+	ErrBlockSize   = errors.New("invalid block size")
+	ErrFileHeader  = errors.New("data file header is corrupt")
+	ErrCompression = errors.New("data file compression does not match")
+	ErrNoKey       = errors.New("data file is encrypted but its key is not loaded")
+)
+
+/* FileHeader describes the blocks of a data file */
+type FileHeader struct {
+	BlockSize   int
+	Compression uint8
+	Table       Tbl_t
+	KeyID       uint32 // Data key the pages are encrypted with, 0 when they are not
+}
+
+var fileCrc = crc32.MakeTable(crc32.Castagnoli)
+
+/* ValidBlockSize reports whether sz is a power of two between MIN_BLOCK_SIZE and MAX_BLOCK_SIZE */
+func ValidBlockSize(sz int) bool {
+	return sz >= MIN_BLOCK_SIZE && sz <= MAX_BLOCK_SIZE && sz&(sz-1) == 0
+}
+
+/*
+DiskMgr does block addressed, positional I/O on one file. Block n starts at base+n*BlockSize, reads
+and writes never move a shared file offset, so one DiskMgr is safe to share between goroutines.
+Space is reserved in extents of EXTENT_BLOCKS blocks as the file grows so appends do not fragment
+the file.
+
+With O_DIRECT the page cache is bypassed, and buffers, offsets and lengths must all be aligned to
+DIRECT_IO_ALIGN.
+*/
 type DiskMgr struct {
-	file *os.File
-	size int64
+	mtx       sync.Mutex // Guards size and allocated
+	file      File
+	blockSize int64
+	base      int64 // Offset of block 0, past the file header
+	compress  uint8 // Compression recorded in the file header
+	table     Tbl_t
+	keyID     uint32
+	cipher    *Cipher // Seals the pages when keyID is set
+	size      int64   // Offset just past the last byte written
+	allocated int64   // Bytes reserved on disk
+	direct    bool
 }
 
-func NewDiskMgr(loc string) (*DiskMgr, error) {
-	f, err := os.OpenFile(loc, os.O_RDWR, 0750)
+var ErrUnaligned = errors.New("direct I/O buffer, offset or length is not aligned")
+
+func NewDiskMgr(fsys FS, loc string) (*DiskMgr, error) {
+	return OpenDiskMgr(fsys, loc, 0)
+}
+
+/* OpenDiskMgr opens the file at loc with the O_DIRECT and O_DSYNC flags of OpenWith */
+func OpenDiskMgr(fsys FS, loc string, flags int) (*DiskMgr, error) {
+	f, err := OpenWith(fsys, loc, flags)
 	if err != nil {
-		return nil, fmt.Errorf("NewDiskMgr: os.OpenFile error %v", err)
+		return nil, fmt.Errorf("NewDiskMgr: Open error %w", err)
 	}
 	fInfo, err := f.Stat()
 	if err != nil {
+		f.Close()
 		return nil, fmt.Errorf("NewDiskMgr: Stat error %v", err)
 	}
-	return &DiskMgr{file: f, size: fInfo.Size()}, nil
+	d := &DiskMgr{file: f, blockSize: DEFAULT_BLOCK_SIZE, size: fInfo.Size(), allocated: fInfo.Size(), direct: flags&O_DIRECT != 0}
+	if d.size > 0 {
+		if err := d.readHeader(); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("NewDiskMgr: %s: %w", loc, err)
+		}
+	}
+	return d, nil
+}
+
+/*
+CreateDiskMgr opens the data file at loc, creating it with the header hdr if it does not exist or
+is empty. An existing file must have been created with the same block size and compression; its
+table and key are kept.
+*/
+func CreateDiskMgr(fsys FS, loc string, hdr FileHeader) (*DiskMgr, error) {
+	if !ValidBlockSize(hdr.BlockSize) {
+		return nil, fmt.Errorf("CreateDiskMgr: %d: %w", hdr.BlockSize, ErrBlockSize)
+	}
+	f, err := OpenOrCreate(fsys, loc)
+	if err != nil {
+		return nil, fmt.Errorf("CreateDiskMgr: %v", err)
+	}
+	f.Close()
+	d, err := NewDiskMgr(fsys, loc)
+	if err != nil {
+		return nil, fmt.Errorf("CreateDiskMgr: %w", err)
+	}
+	if d.size > 0 {
+		if d.BlockSize() != hdr.BlockSize {
+			d.Close()
+			return nil, fmt.Errorf("CreateDiskMgr: %s has blocks of %d bytes, not %d: %w", loc, d.blockSize, hdr.BlockSize, ErrBlockSize)
+		}
+		if d.compress != hdr.Compression {
+			d.Close()
+			return nil, fmt.Errorf("CreateDiskMgr: %s has compression %d, not %d: %w", loc, d.compress, hdr.Compression, ErrCompression)
+		}
+		return d, nil
+	}
+	if err := d.writeHeader(hdr); err != nil {
+		d.Close()
+		return nil, fmt.Errorf("CreateDiskMgr: %v", err)
+	}
+	return d, nil
+}
+
+/* readHeader takes the block size from the file header, leaving the defaults for a file without one */
+func (d *DiskMgr) readHeader() error {
+	hdr := alignedBytes(FILE_HDR_SIZE)
+	n, err := d.file.ReadAt(hdr, 0)
+	if err != nil && err != io.EOF {
+		return fmt.Errorf("readHeader: %v", err)
+	}
+	if n < 16 || binary.LittleEndian.Uint32(hdr[0:4]) != FILE_MAGIC {
+		return nil
+	}
+	end := 12
+	switch version := binary.LittleEndian.Uint16(hdr[4:6]); version {
+	case 1:
+	case FILE_VERSION:
+		end = 24
+	default:
+		return fmt.Errorf("unknown file version %d: %w", version, ErrFileHeader)
+	}
+	if crc32.Checksum(hdr[:end], fileCrc) != binary.LittleEndian.Uint32(hdr[end:end+4]) {
+		return ErrFileHeader
+	}
+	blockSize := int(binary.LittleEndian.Uint32(hdr[8:12]))
+	if !ValidBlockSize(blockSize) {
+		return fmt.Errorf("%d: %w", blockSize, ErrBlockSize)
+	}
+	d.blockSize = int64(blockSize)
+	d.base = FILE_HDR_SIZE
+	d.compress = hdr[6]
+	if end > 12 {
+		d.table = Tbl_t(binary.LittleEndian.Uint64(hdr[12:20]))
+		d.keyID = binary.LittleEndian.Uint32(hdr[20:24])
+	}
+	return nil
+}
+
+/* writeHeader formats an empty file with hdr and syncs it */
+func (d *DiskMgr) writeHeader(h FileHeader) error {
+	hdr := alignedBytes(FILE_HDR_SIZE)
+	binary.LittleEndian.PutUint32(hdr[0:4], FILE_MAGIC)
+	binary.LittleEndian.PutUint16(hdr[4:6], FILE_VERSION)
+	hdr[6] = h.Compression
+	binary.LittleEndian.PutUint32(hdr[8:12], uint32(h.BlockSize))
+	binary.LittleEndian.PutUint64(hdr[12:20], uint64(h.Table))
+	binary.LittleEndian.PutUint32(hdr[20:24], h.KeyID)
+	binary.LittleEndian.PutUint32(hdr[24:28], crc32.Checksum(hdr[:24], fileCrc))
+	if _, err := d.WriteAt(hdr, 0); err != nil {
+		return fmt.Errorf("writeHeader: %v", err)
+	}
+	if err := d.file.Sync(); err != nil {
+		return fmt.Errorf("writeHeader: %v", err)
+	}
+	d.blockSize = int64(h.BlockSize)
+	d.base = FILE_HDR_SIZE
+	d.compress = h.Compression
+	d.table = h.Table
+	d.keyID = h.KeyID
+	return nil
+}
+
+/* alignedBytes returns n zeroed bytes starting at a multiple of DIRECT_IO_ALIGN */
+func alignedBytes(n int) []byte {
+	buf := make([]byte, n+DIRECT_IO_ALIGN)
+	off := int(uintptr(unsafe.Pointer(&buf[0])) % DIRECT_IO_ALIGN)
+	if off != 0 {
+		off = DIRECT_IO_ALIGN - off
+	}
+	return buf[off : off+n : off+n]
+}
+
+/* IsAligned reports whether p can be used for direct I/O */
+func IsAligned(p []byte) bool {
+	return len(p)%DIRECT_IO_ALIGN == 0 && (len(p) == 0 || uintptr(unsafe.Pointer(&p[0]))%DIRECT_IO_ALIGN == 0)
+}
+
+func (d *DiskMgr) checkAligned(p []byte, off int64) error {
+	if d.direct && (off%DIRECT_IO_ALIGN != 0 || !IsAligned(p)) {
+		return ErrUnaligned
+	}
+	return nil
 }
 
 func (d *DiskMgr) Size() int64 {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
 	return d.size
 }
 
-func (d *DiskMgr) Read(p []byte) (n int, err error) {
-	return d.file.Read(p)
+func (d *DiskMgr) BlockSize() int {
+	return int(d.blockSize)
+}
+
+/* Compression is the page compression recorded in the file header, 0 for none */
+func (d *DiskMgr) Compression() uint8 {
+	return d.compress
 }
 
-func (d *DiskMgr) Seek(offset int64, whence int) (int64, error) {
-	return d.file.Seek(offset, whence)
+/* Header is what the file header records */
+func (d *DiskMgr) Header() FileHeader {
+	return FileHeader{BlockSize: int(d.blockSize), Compression: d.compress, Table: d.table, KeyID: d.keyID}
 }
 
-func (d *DiskMgr) Write(p []byte, off int64) (n int, err error) {
-	fInfo, _ := d.file.Stat()
-	fSize := fInfo.Size()
+/* Encrypted reports whether the pages of the file are sealed with a data key */
+func (d *DiskMgr) Encrypted() bool {
+	return d.keyID != 0
+}
+
+/* SetCipher sets the cipher of the data key in the file header. It must be set before any page is read or written */
+func (d *DiskMgr) SetCipher(c *Cipher) {
+	d.cipher = c
+}
+
+/* PageSize is the room for a page in a block, less than the block size when pages are sealed */
+func (d *DiskMgr) PageSize() int {
+	if d.Encrypted() {
+		return int(d.blockSize) - PAGE_SEAL_OVERHEAD
+	}
+	return int(d.blockSize)
+}
+
+/* pageAAD binds a sealed page to its table, block and LSN */
+func (d *DiskMgr) pageAAD(blk Blk_t, lsn uint64) []byte {
+	aad := make([]byte, 24)
+	binary.LittleEndian.PutUint64(aad[0:8], uint64(d.table))
+	binary.LittleEndian.PutUint64(aad[8:16], uint64(blk))
+	binary.LittleEndian.PutUint64(aad[16:24], lsn)
+	return aad
+}
+
+/*
+SealPage returns page sealed for block blk in an aligned buffer with room for at least a block.
+Pages of files that are not encrypted are returned as they are.
+*/
+func (d *DiskMgr) SealPage(page []byte, blk Blk_t, lsn uint64) ([]byte, error) {
+	if !d.Encrypted() {
+		return page, nil
+	}
+	if d.cipher == nil {
+		return nil, fmt.Errorf("SealPage: %w", ErrNoKey)
+	}
+	n := PAGE_SEAL_OVERHEAD + len(page)
+	size := (n + DIRECT_IO_ALIGN - 1) / DIRECT_IO_ALIGN * DIRECT_IO_ALIGN
+	if size < int(d.blockSize) {
+		size = int(d.blockSize)
+	}
+	buf := alignedBytes(size)
+	binary.LittleEndian.PutUint32(buf[0:4], uint32(len(page)))
+	binary.LittleEndian.PutUint64(buf[4:12], lsn)
+	sealed, err := d.cipher.Seal(buf[12:12], page, d.pageAAD(blk, lsn))
+	if err != nil {
+		return nil, fmt.Errorf("SealPage: %v", err)
+	}
+	return buf[:12+len(sealed)], nil
+}
+
+/*
+OpenPage returns the page sealed in data for block blk and its LSN. A page that does not open is
+reported as ErrDecrypt, io.ErrUnexpectedEOF when data is too short to hold it.
+*/
+func (d *DiskMgr) OpenPage(data []byte, blk Blk_t) ([]byte, uint64, error) {
+	if !d.Encrypted() {
+		return data, 0, nil
+	}
+	if d.cipher == nil {
+		return nil, 0, fmt.Errorf("OpenPage: %w", ErrNoKey)
+	}
+	if len(data) < PAGE_SEAL_OVERHEAD {
+		return nil, 0, fmt.Errorf("OpenPage: %w", io.ErrUnexpectedEOF)
+	}
+	n := int(binary.LittleEndian.Uint32(data[0:4]))
+	lsn := binary.LittleEndian.Uint64(data[4:12])
+	if n > MAX_BLOCK_SIZE {
+		return nil, 0, fmt.Errorf("OpenPage: page of %d bytes: %w", n, ErrDecrypt)
+	}
+	if PAGE_SEAL_OVERHEAD+n > len(data) {
+		return nil, 0, fmt.Errorf("OpenPage: %w", io.ErrUnexpectedEOF)
+	}
+	page, err := d.cipher.Open(nil, data[12:PAGE_SEAL_OVERHEAD+n], d.pageAAD(blk, lsn))
+	if err != nil {
+		return nil, 0, fmt.Errorf("OpenPage: block %d: %w", blk, err)
+	}
+	return page, lsn, nil
+}
+
+/* BlockOffset is where block blk starts in the file */
+func (d *DiskMgr) BlockOffset(blk Blk_t) int64 {
+	return d.base + int64(blk)*d.blockSize
+}
 
-	if fSize <= 0 {
-		return d.file.Write(p)
+/* NumBlocks is the number of blocks in the file, counting a partly written last block */
+func (d *DiskMgr) NumBlocks() int64 {
+	size := d.Size() - d.base
+	if size <= 0 {
+		return 0
 	}
-	return d.file.WriteAt(p, off)
+	return (size + d.blockSize - 1) / d.blockSize
+}
+
+func (d *DiskMgr) ReadAt(p []byte, off int64) (int, error) {
+	if err := d.checkAligned(p, off); err != nil {
+		return 0, err
+	}
+	return d.file.ReadAt(p, off)
+}
+
+/* WriteAt writes p at off, reserving another extent first when the write goes past the reservation */
+func (d *DiskMgr) WriteAt(p []byte, off int64) (int, error) {
+	if err := d.checkAligned(p, off); err != nil {
+		return 0, err
+	}
+	end := off + int64(len(p))
+	d.mtx.Lock()
+	if end > d.allocated {
+		extent := EXTENT_BLOCKS * d.blockSize
+		reserve := (end + extent - 1) / extent * extent
+		if f, ok := d.file.(*os.File); ok {
+			if err := preallocate(f, d.allocated, reserve-d.allocated); err != nil {
+				d.mtx.Unlock()
+				return 0, fmt.Errorf("DiskMgr WriteAt: preallocate error %v", err)
+			}
+		}
+		d.allocated = reserve
+	}
+	d.mtx.Unlock()
+
+	n, err := d.file.WriteAt(p, off)
+	d.mtx.Lock()
+	if off+int64(n) > d.size {
+		d.size = off + int64(n)
+	}
+	d.mtx.Unlock()
+	return n, err
+}
+
+/*
+ReadBlock reads up to len(buf) bytes of block blk. Reading past the end of the file returns 0 and
+io.EOF; a block cut short by the end of the file returns the bytes read and io.ErrUnexpectedEOF.
+*/
+func (d *DiskMgr) ReadBlock(blk Blk_t, buf []byte) (int, error) {
+	if int64(len(buf)) > d.blockSize {
+		buf = buf[:d.blockSize]
+	}
+	if err := d.checkAligned(buf, 0); err != nil {
+		return 0, err
+	}
+	n, err := d.file.ReadAt(buf, d.BlockOffset(blk))
+	if err == io.EOF && n > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+/*
+WriteBlock writes buf as block blk. A buf shorter than a block is padded with zeros, in place when
+its capacity allows so an aligned buffer stays aligned.
+*/
+func (d *DiskMgr) WriteBlock(blk Blk_t, buf []byte) error {
+	if int64(len(buf)) > d.blockSize {
+		return fmt.Errorf("WriteBlock: %d bytes do not fit a block of %d", len(buf), d.blockSize)
+	}
+	if int64(len(buf)) < d.blockSize && int64(cap(buf)) >= d.blockSize {
+		tail := buf[len(buf):d.blockSize]
+		for i := range tail {
+			tail[i] = 0
+		}
+		buf = buf[:d.blockSize]
+	} else if int64(len(buf)) < d.blockSize {
+		padded := make([]byte, d.blockSize)
+		copy(padded, buf)
+		buf = padded
+	}
+	if _, err := d.WriteAt(buf, d.BlockOffset(blk)); err != nil {
+		return fmt.Errorf("WriteBlock: %w", err)
+	}
+	return nil
+}
+
+/* Truncate cuts the file after its first n blocks */
+func (d *DiskMgr) Truncate(n int64) error {
+	size := d.BlockOffset(Blk_t(n))
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	if err := d.file.Truncate(size); err != nil {
+		return fmt.Errorf("DiskMgr Truncate: %w", err)
+	}
+	d.size = size
+	if d.allocated > size {
+		d.allocated = size
+	}
+	return nil
 }
 
 func (d *DiskMgr) Flush() error {
 	return d.file.Sync()
 }
+
+func (d *DiskMgr) Close() error {
+	return d.file.Close()
+}
@@ -0,0 +1,255 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"sync"
+	"testing"
+)
+
+func newTestDiskMgr(t *testing.T, fsys FS, dir string) (*DiskMgr, string) {
+	f := path.Join(dir, "1")
+	file, err := fsys.Create(f)
+	if err != nil {
+		t.Fatalf("Create error: %v", err)
+	}
+	file.Close()
+	mgr, err := NewDiskMgr(fsys, f)
+	if err != nil {
+		t.Fatalf("NewDiskMgr error: %v", err)
+	}
+	t.Cleanup(func() { mgr.Close() })
+	return mgr, f
+}
+
+func TestDiskMgrBlocks(t *testing.T) {
+	t.Parallel()
+	// Preallocation only happens on the OS filesystem
+	mgr, f := newTestDiskMgr(t, OSFS{}, t.TempDir())
+	buf := make([]byte, DEFAULT_BLOCK_SIZE)
+	if n, err := mgr.ReadBlock(0, buf); n != 0 || err != io.EOF {
+		t.Errorf("ReadBlock error: expected EOF on an empty file but got %d, %v", n, err)
+	}
+
+	// Writing block 2 of an empty file puts it at its offset, not at the start
+	if err := mgr.WriteBlock(2, []byte("block two")); err != nil {
+		t.Fatalf("WriteBlock error: %v", err)
+	}
+	if err := mgr.WriteBlock(0, []byte("block zero")); err != nil {
+		t.Fatalf("WriteBlock error: %v", err)
+	}
+	if mgr.NumBlocks() != 3 || mgr.Size() != 3*DEFAULT_BLOCK_SIZE {
+		t.Errorf("WriteBlock error: expected 3 blocks but got %d of %d bytes", mgr.NumBlocks(), mgr.Size())
+	}
+	if fInfo, _ := os.Stat(f); fInfo.Size() != mgr.Size() {
+		t.Errorf("WriteAt error: expected preallocation to keep the file size %d but got %d", mgr.Size(), fInfo.Size())
+	}
+
+	values := []struct {
+		blk  Blk_t
+		want []byte
+	}{
+		{blk: 0, want: []byte("block zero")},
+		{blk: 1, want: nil},
+		{blk: 2, want: []byte("block two")},
+	}
+	for _, val := range values {
+		n, err := mgr.ReadBlock(val.blk, buf)
+		if err != nil || n != DEFAULT_BLOCK_SIZE {
+			t.Fatalf("ReadBlock(%d) error: read %d bytes: %v", val.blk, n, err)
+		}
+		if !bytes.Equal(bytes.TrimRight(buf, "\x00"), val.want) {
+			t.Errorf("ReadBlock(%d) error: expected %q but got %q", val.blk, val.want, bytes.TrimRight(buf, "\x00"))
+		}
+	}
+	if err := mgr.WriteBlock(3, make([]byte, DEFAULT_BLOCK_SIZE+1)); err == nil {
+		t.Errorf("WriteBlock error: expected a buffer larger than a block to be rejected")
+	}
+}
+
+func TestDiskMgrConcurrent(t *testing.T) {
+	t.Parallel()
+	mgr, _ := newTestDiskMgr(t, NewMemFS(), "/")
+	var wg sync.WaitGroup
+	for i := 0; i < 32; i++ {
+		wg.Add(1)
+		go func(blk Blk_t) {
+			defer wg.Done()
+			if err := mgr.WriteBlock(blk, bytes.Repeat([]byte{byte(blk) + 1}, DEFAULT_BLOCK_SIZE)); err != nil {
+				t.Errorf("WriteBlock error: %v", err)
+			}
+		}(Blk_t(i))
+	}
+	wg.Wait()
+
+	buf := make([]byte, DEFAULT_BLOCK_SIZE)
+	for i := 0; i < 32; i++ {
+		if _, err := mgr.ReadBlock(Blk_t(i), buf); err != nil {
+			t.Fatalf("ReadBlock error: %v", err)
+		}
+		if buf[0] != byte(i)+1 || buf[DEFAULT_BLOCK_SIZE-1] != byte(i)+1 {
+			t.Errorf("ReadBlock error: block %d holds data of another block", i)
+		}
+	}
+}
+
+func TestDiskMgrDirect(t *testing.T) {
+	t.Parallel()
+	_, f := newTestDiskMgr(t, OSFS{}, t.TempDir())
+	mgr, err := OpenDiskMgr(OSFS{}, f, O_DIRECT)
+	if err != nil {
+		t.Skipf("O_DIRECT is not supported here: %v", err)
+	}
+	defer mgr.Close()
+
+	raw := make([]byte, 2*DEFAULT_BLOCK_SIZE)
+	off := 0
+	for !IsAligned(raw[off : off+DEFAULT_BLOCK_SIZE]) {
+		off++
+	}
+	aligned := raw[off : off+DEFAULT_BLOCK_SIZE]
+	copy(aligned, "direct")
+	if err := mgr.WriteBlock(1, aligned); err != nil {
+		t.Fatalf("WriteBlock error: %v", err)
+	}
+	if err := mgr.WriteBlock(0, raw[off+1:off+1+DEFAULT_BLOCK_SIZE]); !errors.Is(err, ErrUnaligned) {
+		t.Errorf("WriteBlock error: expected an unaligned buffer to be rejected but got %v", err)
+	}
+
+	got := raw[off : off+DEFAULT_BLOCK_SIZE]
+	for i := range got {
+		got[i] = 0
+	}
+	if _, err := mgr.ReadBlock(1, got); err != nil {
+		t.Fatalf("ReadBlock error: %v", err)
+	}
+	if !bytes.HasPrefix(got, []byte("direct")) {
+		t.Errorf("ReadBlock error: expected the block written with O_DIRECT but got %q", got[:8])
+	}
+}
+
+func TestDiskMgrHeader(t *testing.T) {
+	t.Parallel()
+	fsys := NewMemFS()
+	if _, err := CreateDiskMgr(fsys, "/1", FileHeader{BlockSize: 5000}); !errors.Is(err, ErrBlockSize) {
+		t.Errorf("CreateDiskMgr error: expected a block size that is not a power of two to be rejected but got %v", err)
+	}
+	mgr, err := CreateDiskMgr(fsys, "/1", FileHeader{BlockSize: 16384})
+	if err != nil {
+		t.Fatalf("CreateDiskMgr error: %v", err)
+	}
+	if err := mgr.WriteBlock(1, []byte("block one")); err != nil {
+		t.Fatalf("WriteBlock error: %v", err)
+	}
+	mgr.Close()
+
+	mgr, err = NewDiskMgr(fsys, "/1")
+	if err != nil {
+		t.Fatalf("NewDiskMgr error: %v", err)
+	}
+	defer mgr.Close()
+	if mgr.BlockSize() != 16384 || mgr.NumBlocks() != 2 || mgr.BlockOffset(1) != FILE_HDR_SIZE+16384 {
+		t.Errorf("NewDiskMgr error: expected 2 blocks of %d bytes but got %d of %d", 16384, mgr.NumBlocks(), mgr.BlockSize())
+	}
+	buf := make([]byte, 16384)
+	if _, err := mgr.ReadBlock(1, buf); err != nil || !bytes.HasPrefix(buf, []byte("block one")) {
+		t.Errorf("ReadBlock error: expected block one but got %q (%v)", buf[:9], err)
+	}
+	if _, err := CreateDiskMgr(fsys, "/1", FileHeader{BlockSize: 8192}); !errors.Is(err, ErrBlockSize) {
+		t.Errorf("CreateDiskMgr error: expected a different block size to be rejected but got %v", err)
+	}
+	if _, err := CreateDiskMgr(fsys, "/1", FileHeader{BlockSize: 16384, Compression: 1}); !errors.Is(err, ErrCompression) {
+		t.Errorf("CreateDiskMgr error: expected a different compression to be rejected but got %v", err)
+	}
+
+	// A file without the header predates it
+	if err := WriteFileAtomic(fsys, "/2", []byte("legacy")); err != nil {
+		t.Fatalf("WriteFileAtomic error: %v", err)
+	}
+	legacy, err := CreateDiskMgr(fsys, "/2", FileHeader{BlockSize: DEFAULT_BLOCK_SIZE})
+	if err != nil {
+		t.Fatalf("CreateDiskMgr error: %v", err)
+	}
+	if legacy.BlockOffset(1) != DEFAULT_BLOCK_SIZE {
+		t.Errorf("CreateDiskMgr error: expected a file without a header to start its blocks at 0")
+	}
+	legacy.Close()
+
+	data, _ := ReadFile(fsys, "/1")
+	data[9] ^= 0x01
+	if err := WriteFileAtomic(fsys, "/3", data); err != nil {
+		t.Fatalf("WriteFileAtomic error: %v", err)
+	}
+	if _, err := NewDiskMgr(fsys, "/3"); !errors.Is(err, ErrFileHeader) {
+		t.Errorf("NewDiskMgr error: expected a corrupt header but got %v", err)
+	}
+}
+
+func TestDiskMgrSealPage(t *testing.T) {
+	t.Parallel()
+	fsys := NewMemFS()
+	key, err := GenerateKey()
+	if err != nil {
+		t.Fatalf("GenerateKey error: %v", err)
+	}
+	c, err := NewCipher(key)
+	if err != nil {
+		t.Fatalf("NewCipher error: %v", err)
+	}
+	mgr, err := CreateDiskMgr(fsys, "/1", FileHeader{BlockSize: DEFAULT_BLOCK_SIZE, Table: 7, KeyID: 1})
+	if err != nil {
+		t.Fatalf("CreateDiskMgr error: %v", err)
+	}
+	page := bytes.Repeat([]byte("secret "), 100)
+	if _, err := mgr.SealPage(page, 2, 10); !errors.Is(err, ErrNoKey) {
+		t.Errorf("SealPage error: expected a page not to be sealed without the key but got %v", err)
+	}
+	mgr.SetCipher(c)
+	sealed, err := mgr.SealPage(page, 2, 10)
+	if err != nil {
+		t.Fatalf("SealPage error: %v", err)
+	}
+	if err := mgr.WriteBlock(2, sealed); err != nil {
+		t.Fatalf("WriteBlock error: %v", err)
+	}
+	mgr.Close()
+
+	data, _ := ReadFile(fsys, "/1")
+	if bytes.Contains(data, []byte("secret")) {
+		t.Errorf("SealPage error: expected no plain text in the data file")
+	}
+	mgr, err = NewDiskMgr(fsys, "/1")
+	if err != nil {
+		t.Fatalf("NewDiskMgr error: %v", err)
+	}
+	defer mgr.Close()
+	if hdr := mgr.Header(); hdr.Table != 7 || hdr.KeyID != 1 || mgr.PageSize() != DEFAULT_BLOCK_SIZE-PAGE_SEAL_OVERHEAD {
+		t.Errorf("NewDiskMgr error: expected table 7 and key 1 in the header but got %+v", hdr)
+	}
+	mgr.SetCipher(c)
+	buf := make([]byte, DEFAULT_BLOCK_SIZE)
+	if _, err := mgr.ReadBlock(2, buf); err != nil {
+		t.Fatalf("ReadBlock error: %v", err)
+	}
+	got, lsn, err := mgr.OpenPage(buf, 2)
+	if err != nil || lsn != 10 || !bytes.Equal(got, page) {
+		t.Errorf("OpenPage error: expected the page at LSN 10 but got LSN %d (%v)", lsn, err)
+	}
+	if _, _, err := mgr.OpenPage(buf, 3); !errors.Is(err, ErrDecrypt) {
+		t.Errorf("OpenPage error: expected a page moved to another block to fail but got %v", err)
+	}
+	buf[4]++ // The LSN
+	if _, _, err := mgr.OpenPage(buf, 2); !errors.Is(err, ErrDecrypt) {
+		t.Errorf("OpenPage error: expected a page with another LSN to fail but got %v", err)
+	}
+	buf[4]--
+	other, _ := GenerateKey()
+	c, _ = NewCipher(other)
+	mgr.SetCipher(c)
+	if _, _, err := mgr.OpenPage(buf, 2); !errors.Is(err, ErrDecrypt) {
+		t.Errorf("OpenPage error: expected a page to fail with the wrong key but got %v", err)
+	}
+}
@@ -0,0 +1,324 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math/rand"
+	"sync"
+	"syscall"
+)
+
+type Fault uint8
+
+const (
+	FAULT_EIO   Fault = iota + 1 // The write fails with EIO and nothing is written
+	FAULT_SHORT                  // Half of the write lands and it fails with io.ErrShortWrite
+)
+
+/*
+FaultFS wraps an FS to simulate failures. It remembers the contents of every file as of its last
+Sync, so Crash can throw away what was never synced as a power loss would, and it can fail chosen
+writes. Creating, renaming and removing files are treated as durable once they return.
+*/
+type FaultFS struct {
+	mtx    sync.Mutex
+	inner  FS
+	rnd    *rand.Rand
+	nodes  map[string]*faultNode
+	writes int           // Writes done so far
+	faults map[int]Fault // Fault of the write with that number
+	gen    int           // Bumped by Crash so handles opened before it stop working
+}
+
+/* faultNode tracks the durable contents of a file and the writes made since */
+type faultNode struct {
+	durable []byte
+	pending []faultWrite
+}
+
+type faultWrite struct {
+	off      int64
+	data     []byte
+	truncate bool // Truncate to off instead of writing data
+}
+
+var ErrCrashed = errors.New("file was open when the filesystem crashed")
+
+func NewFaultFS(inner FS, seed int64) *FaultFS {
+	return &FaultFS{inner: inner, rnd: rand.New(rand.NewSource(seed)), nodes: make(map[string]*faultNode), faults: make(map[int]Fault)}
+}
+
+/* InjectWrite makes the nth write from now fail with fault. n starts at 1 */
+func (f *FaultFS) InjectWrite(n int, fault Fault) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.faults[f.writes+n] = fault
+}
+
+/* Writes is the number of writes done through the filesystem */
+func (f *FaultFS) Writes() int {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	return f.writes
+}
+
+/* ClearFaults drops the faults that have not fired yet */
+func (f *FaultFS) ClearFaults() {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.faults = make(map[int]Fault)
+}
+
+/*
+Crash simulates a power loss: every file goes back to its contents as of its last Sync. With
+reorder a random subset of the unsynced writes is kept, applied in a random order, as a disk that
+reorders its write cache would leave them. Files opened before the crash can no longer be used.
+*/
+func (f *FaultFS) Crash(reorder bool) error {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.gen++
+	f.faults = make(map[int]Fault)
+	for name, node := range f.nodes {
+		data := append([]byte(nil), node.durable...)
+		if reorder {
+			for _, i := range f.rnd.Perm(len(node.pending)) {
+				if f.rnd.Intn(2) == 0 {
+					data = node.pending[i].apply(data)
+				}
+			}
+		}
+		file, err := f.inner.Create(name)
+		if err != nil {
+			return fmt.Errorf("Crash: %v", err)
+		}
+		_, err = file.Write(data)
+		file.Close()
+		if err != nil {
+			return fmt.Errorf("Crash: %v", err)
+		}
+		node.durable = data
+		node.pending = nil
+	}
+	return nil
+}
+
+func (w faultWrite) apply(data []byte) []byte {
+	end := w.off
+	if !w.truncate {
+		end += int64(len(w.data))
+	}
+	if end > int64(len(data)) {
+		data = append(data, make([]byte, end-int64(len(data)))...)
+	}
+	if w.truncate {
+		return data[:w.off]
+	}
+	copy(data[w.off:], w.data)
+	return data
+}
+
+/* node returns the tracking of name, taking its current contents as durable the first time. Callers hold mtx */
+func (f *FaultFS) node(name string, file File) (*faultNode, error) {
+	if node, ok := f.nodes[name]; ok {
+		return node, nil
+	}
+	fInfo, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, fInfo.Size())
+	if _, err := file.ReadAt(data, 0); err != nil && err != io.EOF {
+		return nil, err
+	}
+	node := &faultNode{durable: data}
+	f.nodes[name] = node
+	return node, nil
+}
+
+func (f *FaultFS) Open(name string) (File, error) {
+	name = cleanPath(name)
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	file, err := f.inner.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	node, err := f.node(name, file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &faultFile{fs: f, node: node, file: file, gen: f.gen}, nil
+}
+
+func (f *FaultFS) Create(name string) (File, error) {
+	name = cleanPath(name)
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	file, err := f.inner.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	node, err := f.node(name, file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	node.pending = append(node.pending, faultWrite{off: 0, truncate: true})
+	return &faultFile{fs: f, node: node, file: file, gen: f.gen}, nil
+}
+
+func (f *FaultFS) Remove(name string) error {
+	name = cleanPath(name)
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	if err := f.inner.Remove(name); err != nil {
+		return err
+	}
+	delete(f.nodes, name)
+	return nil
+}
+
+func (f *FaultFS) Rename(oldpath, newpath string) error {
+	oldpath, newpath = cleanPath(oldpath), cleanPath(newpath)
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	if err := f.inner.Rename(oldpath, newpath); err != nil {
+		return err
+	}
+	delete(f.nodes, newpath)
+	if node, ok := f.nodes[oldpath]; ok {
+		f.nodes[newpath] = node
+		delete(f.nodes, oldpath)
+	}
+	return nil
+}
+
+func (f *FaultFS) Sync(dir string) error {
+	return f.inner.Sync(dir)
+}
+
+func (f *FaultFS) ReadDir(dir string) ([]fs.DirEntry, error) {
+	return f.inner.ReadDir(dir)
+}
+
+func (f *FaultFS) MkdirAll(dir string) error {
+	return f.inner.MkdirAll(dir)
+}
+
+/* faultFile is an open FaultFS file. Reads and writes without an offset go through ReadAt and WriteAt */
+type faultFile struct {
+	fs   *FaultFS
+	node *faultNode
+	file File
+	gen  int
+	off  int64
+}
+
+/* check fails the call when the file was opened before a crash. Callers hold fs.mtx */
+func (f *faultFile) check() error {
+	if f.gen != f.fs.gen {
+		return ErrCrashed
+	}
+	return nil
+}
+
+func (f *faultFile) ReadAt(p []byte, off int64) (int, error) {
+	f.fs.mtx.Lock()
+	defer f.fs.mtx.Unlock()
+	if err := f.check(); err != nil {
+		return 0, err
+	}
+	return f.file.ReadAt(p, off)
+}
+
+func (f *faultFile) WriteAt(p []byte, off int64) (int, error) {
+	f.fs.mtx.Lock()
+	defer f.fs.mtx.Unlock()
+	if err := f.check(); err != nil {
+		return 0, err
+	}
+	f.fs.writes++
+	fault := f.fs.faults[f.fs.writes]
+	delete(f.fs.faults, f.fs.writes)
+	switch fault {
+	case FAULT_EIO:
+		return 0, &fs.PathError{Op: "write", Path: "", Err: syscall.EIO}
+	case FAULT_SHORT:
+		p = p[:len(p)/2]
+	}
+	n, err := f.file.WriteAt(p, off)
+	f.node.pending = append(f.node.pending, faultWrite{off: off, data: append([]byte(nil), p[:n]...)})
+	if err == nil && fault == FAULT_SHORT {
+		err = io.ErrShortWrite
+	}
+	return n, err
+}
+
+func (f *faultFile) Read(p []byte) (int, error) {
+	n, err := f.ReadAt(p, f.off)
+	f.off += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (f *faultFile) Write(p []byte) (int, error) {
+	n, err := f.WriteAt(p, f.off)
+	f.off += int64(n)
+	return n, err
+}
+
+func (f *faultFile) Stat() (fs.FileInfo, error) {
+	f.fs.mtx.Lock()
+	defer f.fs.mtx.Unlock()
+	if err := f.check(); err != nil {
+		return nil, err
+	}
+	return f.file.Stat()
+}
+
+/* Sync makes the current contents of the file durable */
+func (f *faultFile) Sync() error {
+	f.fs.mtx.Lock()
+	defer f.fs.mtx.Unlock()
+	if err := f.check(); err != nil {
+		return err
+	}
+	if err := f.file.Sync(); err != nil {
+		return err
+	}
+	for _, w := range f.node.pending {
+		f.node.durable = w.apply(f.node.durable)
+	}
+	f.node.pending = nil
+	return nil
+}
+
+func (f *faultFile) Truncate(size int64) error {
+	f.fs.mtx.Lock()
+	defer f.fs.mtx.Unlock()
+	if err := f.check(); err != nil {
+		return err
+	}
+	if err := f.file.Truncate(size); err != nil {
+		return err
+	}
+	f.node.pending = append(f.node.pending, faultWrite{off: size, truncate: true})
+	return nil
+}
+
+func (f *faultFile) Close() error {
+	f.fs.mtx.Lock()
+	defer f.fs.mtx.Unlock()
+	err := f.file.Close()
+	if f.gen != f.fs.gen {
+		// The handle died with the crash
+		return nil
+	}
+	return err
+}
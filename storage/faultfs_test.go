@@ -0,0 +1,82 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"syscall"
+	"testing"
+)
+
+func TestFaultFSCrash(t *testing.T) {
+	t.Parallel()
+	fsys := NewFaultFS(NewMemFS(), 1)
+	f, err := fsys.Create("/1.data")
+	if err != nil {
+		t.Fatalf("Create error: %v", err)
+	}
+	f.WriteAt([]byte("synced"), 0)
+	if err := f.Sync(); err != nil {
+		t.Fatalf("Sync error: %v", err)
+	}
+	f.WriteAt([]byte("SYN"), 0)
+	f.WriteAt([]byte("lost"), 6)
+	if data, _ := ReadFile(fsys, "/1.data"); string(data) != "SYNcedlost" {
+		t.Errorf("WriteAt error: expected unsynced writes to be visible but got %q", data)
+	}
+
+	if err := fsys.Crash(false); err != nil {
+		t.Fatalf("Crash error: %v", err)
+	}
+	if _, err := f.WriteAt([]byte("x"), 0); !errors.Is(err, ErrCrashed) {
+		t.Errorf("WriteAt error: expected a handle from before the crash to fail but got %v", err)
+	}
+	f.Close()
+	if data, _ := ReadFile(fsys, "/1.data"); string(data) != "synced" {
+		t.Errorf("Crash error: expected only synced data to survive but got %q", data)
+	}
+
+	// A reordering crash keeps any subset of the unsynced writes
+	f, _ = fsys.Open("/1.data")
+	f.WriteAt([]byte("S"), 0)
+	f.WriteAt([]byte("D"), 5)
+	f.Close()
+	if err := fsys.Crash(true); err != nil {
+		t.Fatalf("Crash error: %v", err)
+	}
+	data, _ := ReadFile(fsys, "/1.data")
+	if len(data) != 6 || (data[0] != 's' && data[0] != 'S') || (data[5] != 'd' && data[5] != 'D') || string(data[1:5]) != "ynce" {
+		t.Errorf("Crash error: unexpected contents %q", data)
+	}
+}
+
+func TestFaultFSWrites(t *testing.T) {
+	t.Parallel()
+	fsys := NewFaultFS(NewMemFS(), 1)
+	f, err := fsys.Create("/1.data")
+	if err != nil {
+		t.Fatalf("Create error: %v", err)
+	}
+	defer f.Close()
+	fsys.InjectWrite(2, FAULT_EIO)
+	fsys.InjectWrite(3, FAULT_SHORT)
+
+	if _, err := f.Write([]byte("first")); err != nil {
+		t.Errorf("Write error: %v", err)
+	}
+	if n, err := f.Write([]byte("second")); n != 0 || !errors.Is(err, syscall.EIO) {
+		t.Errorf("Write error: expected EIO but wrote %d (%v)", n, err)
+	}
+	if n, err := f.Write([]byte("third!")); n != 3 || err != io.ErrShortWrite {
+		t.Errorf("Write error: expected a short write but wrote %d (%v)", n, err)
+	}
+	if _, err := f.Write([]byte("fourth")); err != nil {
+		t.Errorf("Write error: %v", err)
+	}
+	if fsys.Writes() != 4 {
+		t.Errorf("Writes error: expected %d writes but got %d", 4, fsys.Writes())
+	}
+	if data, _ := ReadFile(fsys, "/1.data"); !bytes.Equal(data, []byte("firstthifourth")) {
+		t.Errorf("Write error: unexpected contents %q", data)
+	}
+}
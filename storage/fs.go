@@ -0,0 +1,456 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+/* File is an open file of an FS. Reads and writes without an offset share the file position */
+type File interface {
+	io.Reader
+	io.Writer
+	io.ReaderAt
+	io.WriterAt
+	io.Closer
+	Stat() (fs.FileInfo, error)
+	Sync() error
+	Truncate(size int64) error
+}
+
+/* FS is the filesystem storage keeps its files in */
+type FS interface {
+	Open(name string) (File, error)   // Opens an existing file for reading and writing
+	Create(name string) (File, error) // Creates a file, truncating it if it exists
+	Remove(name string) error
+	Rename(oldpath, newpath string) error
+	Sync(dir string) error // Makes the entries of dir durable
+	ReadDir(dir string) ([]fs.DirEntry, error)
+	MkdirAll(dir string) error
+}
+
+/* Flags for OpenWith */
+const (
+	O_DIRECT = 1 << iota // Bypass the page cache. Buffers, offsets and lengths must be aligned to DIRECT_IO_ALIGN
+	O_DSYNC              // Writes are durable when they return
+)
+
+const DIRECT_IO_ALIGN = 512
+
+var ErrDirectIO = errors.New("direct I/O is not supported on this platform")
+
+/* FlagFS is an FS that can open files with O_DIRECT and O_DSYNC */
+type FlagFS interface {
+	OpenFlags(name string, flags int) (File, error)
+}
+
+/*
+OpenWith opens an existing file with flags. Filesystems without a page cache ignore O_DIRECT, and
+O_DSYNC is emulated by syncing after every write when the FS cannot open files with it.
+*/
+func OpenWith(fsys FS, name string, flags int) (File, error) {
+	if ffs, ok := fsys.(FlagFS); ok {
+		return ffs.OpenFlags(name, flags)
+	}
+	f, err := fsys.Open(name)
+	if err != nil || flags&O_DSYNC == 0 {
+		return f, err
+	}
+	return dsyncFile{f}, nil
+}
+
+type dsyncFile struct {
+	File
+}
+
+func (f dsyncFile) Write(p []byte) (int, error) {
+	n, err := f.File.Write(p)
+	if err != nil {
+		return n, err
+	}
+	return n, f.File.Sync()
+}
+
+func (f dsyncFile) WriteAt(p []byte, off int64) (int, error) {
+	n, err := f.File.WriteAt(p, off)
+	if err != nil {
+		return n, err
+	}
+	return n, f.File.Sync()
+}
+
+/* Datasync is Sync without flushing metadata that is not needed to read the file back, such as the modification time */
+func Datasync(f File) error {
+	if osFile, ok := f.(*os.File); ok {
+		return datasync(osFile)
+	}
+	return f.Sync()
+}
+
+/* OpenOrCreate opens name, creating an empty file if it does not exist */
+func OpenOrCreate(fsys FS, name string) (File, error) {
+	f, err := fsys.Open(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return fsys.Create(name)
+	}
+	return f, err
+}
+
+func ReadFile(fsys FS, name string) ([]byte, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fInfo, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, fInfo.Size())
+	if _, err := io.ReadFull(f, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+/* WriteFileAtomic replaces name with data through a synced temporary file, so a crash leaves either the old or the new contents */
+func WriteFileAtomic(fsys FS, name string, data []byte) error {
+	tmp := name + ".tmp"
+	f, err := fsys.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := fsys.Rename(tmp, name); err != nil {
+		return err
+	}
+	return fsys.Sync(path.Dir(name))
+}
+
+/* OSFS is the operating system's filesystem */
+type OSFS struct{}
+
+func (OSFS) Open(name string) (File, error) {
+	return os.OpenFile(name, os.O_RDWR, 0640)
+}
+
+func (OSFS) OpenFlags(name string, flags int) (File, error) {
+	osFlags, err := osFlags(flags)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	return os.OpenFile(name, os.O_RDWR|osFlags, 0640)
+}
+
+func (OSFS) Create(name string) (File, error) {
+	return os.OpenFile(name, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0640)
+}
+
+func (OSFS) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (OSFS) Rename(oldpath, newpath string) error {
+	return os.Rename(oldpath, newpath)
+}
+
+func (OSFS) Sync(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+func (OSFS) ReadDir(dir string) ([]fs.DirEntry, error) {
+	return os.ReadDir(dir)
+}
+
+func (OSFS) MkdirAll(dir string) error {
+	return os.MkdirAll(dir, 0750)
+}
+
+/* MemFS keeps files in memory. Tests use it so they do not touch the disk */
+type MemFS struct {
+	mtx   sync.Mutex
+	files map[string]*memNode
+	dirs  map[string]bool
+}
+
+type memNode struct {
+	mtx     sync.RWMutex
+	data    []byte
+	modTime time.Time
+}
+
+func NewMemFS() *MemFS {
+	return &MemFS{files: make(map[string]*memNode), dirs: map[string]bool{"/": true, ".": true}}
+}
+
+func cleanPath(name string) string {
+	return path.Clean(name)
+}
+
+/* parentExists reports whether the directory of name exists. Callers hold mtx */
+func (m *MemFS) parentExists(name string) bool {
+	return m.dirs[path.Dir(name)]
+}
+
+func (m *MemFS) Open(name string) (File, error) {
+	name = cleanPath(name)
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	node, ok := m.files[name]
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	return &memFile{name: name, node: node}, nil
+}
+
+func (m *MemFS) Create(name string) (File, error) {
+	name = cleanPath(name)
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if !m.parentExists(name) {
+		return nil, &fs.PathError{Op: "create", Path: name, Err: fs.ErrNotExist}
+	}
+	if m.dirs[name] {
+		return nil, &fs.PathError{Op: "create", Path: name, Err: errors.New("is a directory")}
+	}
+	node, ok := m.files[name]
+	if !ok {
+		node = &memNode{}
+		m.files[name] = node
+	}
+	node.mtx.Lock()
+	node.data = nil
+	node.modTime = time.Now()
+	node.mtx.Unlock()
+	return &memFile{name: name, node: node}, nil
+}
+
+func (m *MemFS) Remove(name string) error {
+	name = cleanPath(name)
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if _, ok := m.files[name]; ok {
+		delete(m.files, name)
+		return nil
+	}
+	if m.dirs[name] {
+		prefix := name + "/"
+		for other := range m.files {
+			if strings.HasPrefix(other, prefix) {
+				return &fs.PathError{Op: "remove", Path: name, Err: errors.New("directory not empty")}
+			}
+		}
+		delete(m.dirs, name)
+		return nil
+	}
+	return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrNotExist}
+}
+
+func (m *MemFS) Rename(oldpath, newpath string) error {
+	oldpath, newpath = cleanPath(oldpath), cleanPath(newpath)
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	node, ok := m.files[oldpath]
+	if !ok {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: fs.ErrNotExist}
+	}
+	if !m.parentExists(newpath) {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: fs.ErrNotExist}
+	}
+	delete(m.files, oldpath)
+	m.files[newpath] = node
+	return nil
+}
+
+func (m *MemFS) Sync(dir string) error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if !m.dirs[cleanPath(dir)] {
+		return &fs.PathError{Op: "sync", Path: dir, Err: fs.ErrNotExist}
+	}
+	return nil
+}
+
+func (m *MemFS) ReadDir(dir string) ([]fs.DirEntry, error) {
+	dir = cleanPath(dir)
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if !m.dirs[dir] {
+		return nil, &fs.PathError{Op: "readdir", Path: dir, Err: fs.ErrNotExist}
+	}
+	entries := make([]fs.DirEntry, 0)
+	for name, node := range m.files {
+		if path.Dir(name) == dir {
+			node.mtx.RLock()
+			entries = append(entries, fs.FileInfoToDirEntry(memInfo{name: path.Base(name), size: int64(len(node.data)), modTime: node.modTime}))
+			node.mtx.RUnlock()
+		}
+	}
+	for name := range m.dirs {
+		if name != dir && path.Dir(name) == dir {
+			entries = append(entries, fs.FileInfoToDirEntry(memInfo{name: path.Base(name), dir: true}))
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, nil
+}
+
+func (m *MemFS) MkdirAll(dir string) error {
+	dir = cleanPath(dir)
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	for d := dir; !m.dirs[d]; d = path.Dir(d) {
+		if _, ok := m.files[d]; ok {
+			return &fs.PathError{Op: "mkdir", Path: d, Err: errors.New("not a directory")}
+		}
+		m.dirs[d] = true
+	}
+	return nil
+}
+
+type memInfo struct {
+	name    string
+	size    int64
+	dir     bool
+	modTime time.Time
+}
+
+func (i memInfo) Name() string       { return i.name }
+func (i memInfo) Size() int64        { return i.size }
+func (i memInfo) ModTime() time.Time { return i.modTime }
+func (i memInfo) IsDir() bool        { return i.dir }
+func (i memInfo) Sys() interface{}   { return nil }
+func (i memInfo) Mode() fs.FileMode {
+	if i.dir {
+		return fs.ModeDir | 0750
+	}
+	return 0640
+}
+
+/* memFile is an open MemFS file. Handles of the same file share its contents */
+type memFile struct {
+	name   string
+	node   *memNode
+	off    int64
+	closed bool
+}
+
+var errFileClosed = errors.New("file already closed")
+
+func (f *memFile) ReadAt(p []byte, off int64) (int, error) {
+	if f.closed {
+		return 0, errFileClosed
+	}
+	f.node.mtx.RLock()
+	defer f.node.mtx.RUnlock()
+	if off >= int64(len(f.node.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.node.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *memFile) WriteAt(p []byte, off int64) (int, error) {
+	if f.closed {
+		return 0, errFileClosed
+	}
+	f.node.mtx.Lock()
+	defer f.node.mtx.Unlock()
+	end := off + int64(len(p))
+	if end > int64(len(f.node.data)) {
+		if end > int64(cap(f.node.data)) {
+			data := make([]byte, end, 2*end)
+			copy(data, f.node.data)
+			f.node.data = data
+		} else {
+			oldLen := len(f.node.data)
+			f.node.data = f.node.data[:end]
+			for i := oldLen; i < int(end); i++ {
+				// Bytes past a truncation may still hold old data
+				f.node.data[i] = 0
+			}
+		}
+	}
+	copy(f.node.data[off:], p)
+	f.node.modTime = time.Now()
+	return len(p), nil
+}
+
+func (f *memFile) Read(p []byte) (int, error) {
+	n, err := f.ReadAt(p, f.off)
+	f.off += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	n, err := f.WriteAt(p, f.off)
+	f.off += int64(n)
+	return n, err
+}
+
+func (f *memFile) Stat() (fs.FileInfo, error) {
+	if f.closed {
+		return nil, errFileClosed
+	}
+	f.node.mtx.RLock()
+	defer f.node.mtx.RUnlock()
+	return memInfo{name: path.Base(f.name), size: int64(len(f.node.data)), modTime: f.node.modTime}, nil
+}
+
+func (f *memFile) Sync() error {
+	if f.closed {
+		return errFileClosed
+	}
+	return nil
+}
+
+func (f *memFile) Truncate(size int64) error {
+	if f.closed {
+		return errFileClosed
+	}
+	f.node.mtx.Lock()
+	defer f.node.mtx.Unlock()
+	if size <= int64(len(f.node.data)) {
+		f.node.data = f.node.data[:size]
+	} else {
+		data := make([]byte, size)
+		copy(data, f.node.data)
+		f.node.data = data
+	}
+	return nil
+}
+
+func (f *memFile) Close() error {
+	if f.closed {
+		return errFileClosed
+	}
+	f.closed = true
+	return nil
+}
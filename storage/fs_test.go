@@ -0,0 +1,111 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"io/fs"
+	"path"
+	"testing"
+)
+
+func TestFS(t *testing.T) {
+	values := []struct {
+		name string
+		fsys func(t *testing.T) (FS, string)
+	}{
+		{name: "os", fsys: func(t *testing.T) (FS, string) { return OSFS{}, t.TempDir() }},
+		{name: "mem", fsys: func(t *testing.T) (FS, string) { return NewMemFS(), "/" }},
+	}
+	for _, val := range values {
+		val := val
+		t.Run(val.name, func(t *testing.T) {
+			t.Parallel()
+			fsys, root := val.fsys(t)
+			dir := path.Join(root, "a", "b")
+			if err := fsys.MkdirAll(dir); err != nil {
+				t.Fatalf("MkdirAll error: %v", err)
+			}
+			name := path.Join(dir, "1.data")
+			if _, err := fsys.Open(name); !errors.Is(err, fs.ErrNotExist) {
+				t.Errorf("Open error: expected a missing file but got %v", err)
+			}
+
+			f, err := OpenOrCreate(fsys, name)
+			if err != nil {
+				t.Fatalf("OpenOrCreate error: %v", err)
+			}
+			if _, err := f.WriteAt([]byte("tail"), 8); err != nil {
+				t.Fatalf("WriteAt error: %v", err)
+			}
+			if _, err := f.Write([]byte("head")); err != nil {
+				t.Fatalf("Write error: %v", err)
+			}
+			if err := f.Truncate(6); err != nil {
+				t.Fatalf("Truncate error: %v", err)
+			}
+			if _, err := f.WriteAt([]byte("!"), 10); err != nil {
+				t.Fatalf("WriteAt error: %v", err)
+			}
+			if err := f.Sync(); err != nil {
+				t.Fatalf("Sync error: %v", err)
+			}
+			f.Close()
+			// Bytes cut off by Truncate read back as zeros when the file grows again
+			want := []byte{'h', 'e', 'a', 'd', 0, 0, 0, 0, 0, 0, '!'}
+			if data, err := ReadFile(fsys, name); err != nil || !bytes.Equal(data, want) {
+				t.Errorf("ReadFile error: expected %q but got %q (%v)", want, data, err)
+			}
+
+			if err := WriteFileAtomic(fsys, name, []byte("new")); err != nil {
+				t.Fatalf("WriteFileAtomic error: %v", err)
+			}
+			if data, _ := ReadFile(fsys, name); string(data) != "new" {
+				t.Errorf("WriteFileAtomic error: expected %q but got %q", "new", data)
+			}
+			if err := fsys.Rename(name, path.Join(dir, "2.data")); err != nil {
+				t.Fatalf("Rename error: %v", err)
+			}
+			entries, err := fsys.ReadDir(dir)
+			if err != nil {
+				t.Fatalf("ReadDir error: %v", err)
+			}
+			if len(entries) != 1 || entries[0].Name() != "2.data" || entries[0].IsDir() {
+				t.Errorf("ReadDir error: expected only 2.data but got %v", entries)
+			}
+			if err := fsys.Sync(dir); err != nil {
+				t.Errorf("Sync error: %v", err)
+			}
+			if err := fsys.Remove(dir); err == nil {
+				t.Errorf("Remove error: expected a directory with files to stay")
+			}
+			if err := fsys.Remove(path.Join(dir, "2.data")); err != nil {
+				t.Errorf("Remove error: %v", err)
+			}
+			if entries, _ := fsys.ReadDir(dir); len(entries) != 0 {
+				t.Errorf("Remove error: expected an empty directory but got %v", entries)
+			}
+		})
+	}
+}
+
+func TestOpenWithDsync(t *testing.T) {
+	t.Parallel()
+	fsys := NewFaultFS(NewMemFS(), 1)
+	if _, err := fsys.Create("/1.wal"); err != nil {
+		t.Fatalf("Create error: %v", err)
+	}
+	f, err := OpenWith(fsys, "/1.wal", O_DSYNC|O_DIRECT)
+	if err != nil {
+		t.Fatalf("OpenWith error: %v", err)
+	}
+	if _, err := f.Write([]byte("durable")); err != nil {
+		t.Fatalf("Write error: %v", err)
+	}
+	// Writes through an O_DSYNC file survive a crash without a Sync
+	if err := fsys.Crash(false); err != nil {
+		t.Fatalf("Crash error: %v", err)
+	}
+	if data, _ := ReadFile(fsys, "/1.wal"); string(data) != "durable" {
+		t.Errorf("OpenWith error: expected the write to survive but got %q", data)
+	}
+}
@@ -3,6 +3,7 @@ package storage
 import (
 	"fmt"
 	"sync"
+	"sync/atomic"
 )
 
 const (
@@ -13,16 +14,17 @@ const (
 
 type Lock struct {
 	sharedLockCount uint
-	lockType        uint8
+	lockType        atomic.Uint32 // Set by every shared holder at once
 	eLock           *sync.RWMutex
 }
 
 func NewLock() *Lock {
-	return &Lock{
+	l := &Lock{
 		sharedLockCount: 0,
 		eLock:           &sync.RWMutex{},
-		lockType:        NO_LOCK,
 	}
+	l.lockType.Store(uint32(NO_LOCK))
+	return l
 }
 
 func (l *Lock) AcquireLock(mode uint8) error {
@@ -37,9 +39,9 @@ func (l *Lock) AcquireLock(mode uint8) error {
 }
 
 func (l *Lock) ReleaseLock() error {
-	if l.lockType == EXCLUSIVE_LOCK {
+	if lockType := uint8(l.lockType.Load()); lockType == EXCLUSIVE_LOCK {
 		l.releaseExclusiveLock()
-	} else if l.lockType == SHARED_LOCK {
+	} else if lockType == SHARED_LOCK {
 		l.releaseSharedLock()
 	} else {
 		return fmt.Errorf("UnlockEntry: unknown lock type")
@@ -50,7 +52,7 @@ func (l *Lock) ReleaseLock() error {
 func (l *Lock) incrementCount() {
 	l.eLock.Lock()
 	l.sharedLockCount++
-	l.lockType = SHARED_LOCK
+	l.lockType.Store(uint32(SHARED_LOCK))
 	defer l.eLock.Unlock()
 }
 
@@ -63,7 +65,7 @@ func (l *Lock) decrementCount() {
 func (l *Lock) acquireSharedLock() error {
 	// l.incrementCount()
 	l.eLock.RLock()
-	l.lockType = SHARED_LOCK
+	l.lockType.Store(uint32(SHARED_LOCK))
 	return nil
 }
 
@@ -75,7 +77,7 @@ func (l *Lock) releaseSharedLock() error {
 
 func (l *Lock) acquireExclusiveLock() error {
 	l.eLock.Lock()
-	l.lockType = EXCLUSIVE_LOCK
+	l.lockType.Store(uint32(EXCLUSIVE_LOCK))
 	return nil
 }
 
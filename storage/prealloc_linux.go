@@ -0,0 +1,19 @@
+package storage
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+const FALLOC_FL_KEEP_SIZE = 0x01
+
+/* preallocate reserves n bytes at off without changing the file size, so readers never see the reserved space */
+func preallocate(f *os.File, off, n int64) error {
+	err := syscall.Fallocate(int(f.Fd()), FALLOC_FL_KEEP_SIZE, off, n)
+	if errors.Is(err, syscall.EOPNOTSUPP) || errors.Is(err, syscall.ENOSYS) {
+		// The filesystem cannot reserve space; blocks are allocated as they are written
+		return nil
+	}
+	return err
+}
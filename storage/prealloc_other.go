@@ -0,0 +1,10 @@
+//go:build !linux
+
+package storage
+
+import "os"
+
+/* preallocate is a no-op where the OS has no way to reserve space without growing the file */
+func preallocate(f *os.File, off, n int64) error {
+	return nil
+}
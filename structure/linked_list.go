@@ -75,7 +75,11 @@ func (l *List) Remove(key interface{}) {
 	var prev *Value
 	for next != nil {
 		if next.key == key {
-			prev.next = next.next
+			if prev == nil {
+				l.head = next.next
+			} else {
+				prev.next = next.next
+			}
 			l.size -= 1
 			break
 		}
@@ -48,3 +48,23 @@ func TestGet(t *testing.T) {
 		t.Errorf("The specified key should be present in the list")
 	}
 }
+
+func TestRemove(t *testing.T) {
+	l := NewList()
+	arr := []int{1, 2, 3, 4, 5}
+	for i := 0; i < len(arr); i++ {
+		l.Push(arr[i], arr[i])
+	}
+
+	// 5 is at the head of the list
+	for _, key := range []int{5, 3} {
+		l.Remove(key)
+		if elem := l.Get(key); elem != nil {
+			t.Errorf("Expected key %d to be removed but found %v", key, elem)
+		}
+	}
+
+	if l.size != len(arr)-2 {
+		t.Errorf("Expected size to be %d but found %d", len(arr)-2, l.size)
+	}
+}